@@ -0,0 +1,108 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImageSpec maps an image reference to the root its content is stored at
+type ImageSpec struct {
+	// Reference is the fully qualified reference mapped, such as index.docker.io/library/alpine:latest
+	Reference string `json:"reference"`
+
+	// Root is the cid of the image's root object
+	Root string `json:"root"`
+
+	// Signature is the base64 encoded signature of the mapping of Reference to Root, verified against the cluster's
+	// mapping keys when they're enforced
+	// +optional
+	Signature string `json:"signature,omitempty"`
+}
+
+// ImageStatus is the state of the image as observed on the manager's ipfs node
+type ImageStatus struct {
+	// ObservedRoot is the root the rest of the status was observed for
+	// +optional
+	ObservedRoot string `json:"observedRoot,omitempty"`
+
+	// Size is the size in bytes of everything stored for the image
+	// +optional
+	Size int64 `json:"size,omitempty"`
+
+	// Platforms are the platforms (such as linux/amd64) the image is available for
+	// +optional
+	Platforms []string `json:"platforms,omitempty"`
+
+	// Pinned reports whether every object of the image is pinned on the manager's node
+	// +optional
+	Pinned bool `json:"pinned,omitempty"`
+
+	// Message explains why the image couldn't be observed, when it couldn't be
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:shortName=rimg,categories=ripfs
+//+kubebuilder:printcolumn:name="Reference",type=string,JSONPath=`.spec.reference`
+//+kubebuilder:printcolumn:name="Root",type=string,JSONPath=`.spec.root`
+//+kubebuilder:printcolumn:name="Pinned",type=boolean,JSONPath=`.status.pinned`
+//+kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.size`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// Image maps an image reference to the root cid the webhook and registry resolve it to
+type Image struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageSpec   `json:"spec,omitempty"`
+	Status ImageStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ImageList contains a list of Image
+type ImageList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Image `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Image{}, &ImageList{})
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// ImageName returns the name of the Image mapping reference (fully qualified, as name.Reference's Name is). It's
+// derived from the reference itself, so an image is looked up without listing every other.
+func ImageName(reference string) string {
+	sum := sha256.Sum256([]byte(reference))
+
+	prefix := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(reference), "-"), "-")
+	if len(prefix) > 52 {
+		prefix = strings.TrimRight(prefix[:52], "-")
+	}
+	return prefix + "-" + hex.EncodeToString(sum[:])[:10]
+}
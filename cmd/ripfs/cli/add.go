@@ -1,11 +1,19 @@
 package cli
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
@@ -14,58 +22,143 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/hashicorp/go-multierror"
+	"github.com/ipfs/go-cid"
 	files "github.com/ipfs/go-ipfs-files"
-	httpapi "github.com/ipfs/go-ipfs-http-client"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	iopts "github.com/ipfs/interface-go-ipfs-core/options"
 	"github.com/ipfs/interface-go-ipfs-core/path"
-	"github.com/multiformats/go-multiaddr"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
 
+	"github.com/joshrwolf/ripfs/api/v1alpha1"
 	"github.com/joshrwolf/ripfs/internal/consts"
-	"github.com/joshrwolf/ripfs/internal/k8s"
+	"github.com/joshrwolf/ripfs/internal/platform"
 	"github.com/joshrwolf/ripfs/internal/registry"
+	"github.com/joshrwolf/ripfs/internal/verify"
 )
 
 type addCommandOpts struct {
-	IPFSApiAddress string
+	apiOpts
+	chunkingOpts
 
-	Name      string
-	Namespace string
-	Container string
+	Registry    string
+	File        string
+	Concurrency int
+	LayerIndex  string
+	Insecure    bool
 
 	OS           string
 	Architecture string
 	Variant      string
+	Platforms    []string
+	AllPlatforms bool
+
+	Verify                bool
+	Key                   string
+	CertificateIdentity   string
+	CertificateOIDCIssuer string
+	FulcioRoots           string
+	RekorPublicKey        string
+
+	Artifacts bool
+
+	MappingKey string
+
+	Replicas int
+	PinOn    string
+
+	Progress string
+
+	layers   registry.LayerIndex
+	verifier *verify.Verifier
+	progress *progressWriter
+
+	// stdin is the docker archive streamed to stdin, once it's been told apart from a list of images
+	stdin io.Reader
 }
 
 func newAddCommand() *cobra.Command {
 	o := &addCommandOpts{}
 
 	cmd := &cobra.Command{
-		Use:   "add",
+		Use:   "add [image]",
 		Short: "Add an image to the registry",
-		Args:  cobra.ExactArgs(1),
+		Long: `Add an image to the registry.
+
+The image may be given as a remote reference (alpine:latest), an oci layout directory, a docker archive (such as one
+created by docker save), or - to read either a docker archive or a list of images (one per line) from stdin.
+
+Many images can be added at once from a list given with --file, either one per line or as a yaml (or json) list. They
+are added concurrently, and mapped together once every image has been added.`,
+		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return o.Run(cmd.Context(), args[0])
+			references := args
+			if len(args) == 1 && args[0] == "-" {
+				listed, err := o.readStdin(cmd.InOrStdin())
+				if err != nil {
+					return fmt.Errorf("reading stdin: %v", err)
+				}
+				if listed != nil {
+					references = listed
+				}
+			}
+
+			if o.File != "" {
+				listed, err := readImageList(o.File)
+				if err != nil {
+					return fmt.Errorf("reading %s: %v", o.File, err)
+				}
+				references = append(references, listed...)
+			}
+
+			if len(references) == 0 {
+				return fmt.Errorf("an image must be given, or a list of them with --file")
+			}
+			return o.Run(cmd.Context(), references)
 		},
 	}
 
+	o.Flags(cmd)
+
+	f := cmd.Flags()
+	f.StringVarP(&o.File, "file", "f", "",
+		"Path to a list of images to add, one per line (# comments) or as a yaml list.")
+
+	return cmd
+}
+
+// Flags registers the flags of adding images, shared by every command that adds them
+func (o *addCommandOpts) Flags(cmd *cobra.Command) {
+	o.apiOpts.Flags(cmd)
+
 	f := cmd.Flags()
-	f.StringVarP(&o.IPFSApiAddress, "ipfs-api-address", "i", "/ip4/127.0.0.1/tcp/5001",
-		"IPFS api address to use for communicating with the IPFS store.")
-	f.StringVar(&o.Name, "pod-name", "ripfs-controller-manager",
-		"Name of the service containing the IPFS api")
-	f.StringVar(&o.Namespace, "pod-namespace", "ripfs-system",
-		"Namespace of the service containing the IPFS api")
-	f.StringVar(&o.Container, "container", "manager",
-		"Container within pod to forward to.")
+	f.StringVarP(&o.Registry, "registry", "r", "localhost:31609",
+		"Address of the ripfs registry, references already pointing at it are not added again.")
+	f.IntVar(&o.Concurrency, "concurrency", 4,
+		"Number of images to add at once.")
+	f.BoolVar(&o.Insecure, "insecure", false,
+		"Allow pulling remote images over plain http (always allowed from localhost and private addresses).")
+	f.StringVar(&o.LayerIndex, "layer-index", defaultLayerIndex(),
+		"Directory remembering the cid of every layer added, so layers that are still stored aren't added again (empty disables).")
+
+	f.StringSliceVar(&o.Platforms, "platform", nil,
+		"Platforms (os/arch[/variant]) to add from a remote image, stored as an index of only them (defaults to the single linux/amd64 image).")
+	f.BoolVar(&o.AllPlatforms, "all-platforms", false,
+		"Add every platform of a remote multi-arch image, stored together as an index.")
 
 	f.StringVar(&o.Architecture, "arch", "amd64",
 		"Image's architecture (only valid for remote images).")
@@ -73,91 +166,466 @@ func newAddCommand() *cobra.Command {
 		"Image's OS (only valid for remote images).")
 	f.StringVar(&o.Variant, "variant", "",
 		"Image's variant (only valid for remote images).")
+	f.MarkDeprecated("arch", "use --platform instead")
+	f.MarkDeprecated("os", "use --platform instead")
+	f.MarkDeprecated("variant", "use --platform instead")
+
+	f.BoolVar(&o.Verify, "verify", false,
+		"Only add remote images with a valid cosign signature, verified with --key or keylessly, storing the signatures (and the rest of their artifacts) alongside them.")
+	f.StringVar(&o.Key, "key", "",
+		"Path to the public key (such as cosign.pub) signatures are verified with.")
+	f.StringVar(&o.CertificateIdentity, "certificate-identity", "",
+		"Identity (email or uri) keyless signing certificates must be issued to.")
+	f.StringVar(&o.CertificateOIDCIssuer, "certificate-oidc-issuer", "",
+		"OIDC issuer (such as https://accounts.google.com) keyless signing certificates must be issued by.")
+	f.StringVar(&o.FulcioRoots, "fulcio-roots", "",
+		"Path to the fulcio root (and intermediate) certificates keyless signing certificates must chain to.")
+	f.StringVar(&o.RekorPublicKey, "rekor-public-key", "",
+		"Path to the public key of the rekor instance keyless signatures must be logged by.")
+
+	f.BoolVar(&o.Artifacts, "artifacts", false,
+		"Also add the cosign signatures, attestations and sboms attached to remote images, served as their referrers.")
+
+	f.StringVar(&o.MappingKey, "mapping-key", "",
+		"Path to the private key (pem encoded pkcs8) the added mappings are signed with, rather than the cluster's mapping key.")
+	envFlag(f, "mapping-key")
+
+	f.IntVar(&o.Replicas, "replicas", 0,
+		"Number of nodes to pin the added images on ahead of their pulls, recorded as their replication policy (0 with --pin-on pins them on every matching node).")
+	f.StringVar(&o.PinOn, "pin-on", "",
+		"Node selector (such as gpu=true,zone=a) of the nodes the added images are pinned on, recorded as their replication policy.")
+
+	f.StringVar(&o.Progress, "progress", "text",
+		"How progress is reported, text logs or json (newline delimited events on stdout, with logs on stderr).")
+
+	o.chunkingOpts.Flags(cmd)
+}
 
-	return cmd
+// chunkingOpts are how layers are chunked as they're added, shared by every command that adds them
+type chunkingOpts struct {
+	Chunker   string
+	RawLeaves bool
+	Hash      string
+}
+
+func (o *chunkingOpts) Flags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVar(&o.Chunker, "chunker", "",
+		"Chunker layers are split into blocks with, such as size-1048576, rabin-262144-524288-1048576 or buzhash (defaults to ipfs' size-262144).")
+	f.BoolVar(&o.RawLeaves, "raw-leaves", registry.DefaultChunking.RawLeaves,
+		"Store layers' leaves as raw blocks rather than unixfs nodes.")
+	f.StringVar(&o.Hash, "hash", "",
+		"Hash function layers' blocks are hashed with, such as sha2-256 or blake2b-256 (defaults to sha2-256).")
+}
+
+func (o *chunkingOpts) chunking() registry.Chunking {
+	return registry.Chunking{Chunker: o.Chunker, RawLeaves: o.RawLeaves, Hash: o.Hash}
+}
+
+// newVerifier returns the verifier of the signatures of images being added, either with a key or keylessly
+func (o *addCommandOpts) newVerifier(ctx context.Context) (*verify.Verifier, error) {
+	v := &verify.Verifier{
+		Options: []remote.Option{
+			remote.WithContext(ctx),
+			remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		},
+	}
+
+	if o.Key != "" {
+		k, err := verify.LoadPublicKey(o.Key)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %v", o.Key, err)
+		}
+		v.Key = k
+		return v, nil
+	}
+
+	if o.FulcioRoots == "" || o.RekorPublicKey == "" || o.CertificateIdentity == "" || o.CertificateOIDCIssuer == "" {
+		return nil, fmt.Errorf("--verify requires either --key, or --fulcio-roots, --rekor-public-key, --certificate-identity and --certificate-oidc-issuer")
+	}
+
+	roots, intermediates, err := verify.LoadCertificates(o.FulcioRoots)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %v", o.FulcioRoots, err)
+	}
+
+	rk, err := verify.LoadPublicKey(o.RekorPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %v", o.RekorPublicKey, err)
+	}
+
+	v.Roots, v.Intermediates, v.RekorKey = roots, intermediates, rk
+	v.Identity, v.Issuer = o.CertificateIdentity, o.CertificateOIDCIssuer
+	return v, nil
 }
 
-func (o *addCommandOpts) Run(ctx context.Context, reference string) error {
-	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+// logger returns the logger of adding images, which logs to stderr when progress is reported as json on stdout
+func (o *addCommandOpts) logger() zerolog.Logger {
+	if o.Progress == "json" {
+		return zerolog.New(zerolog.NewConsoleWriter(func(w *zerolog.ConsoleWriter) { w.Out = os.Stderr })).With().Timestamp().Logger()
+	}
+	return zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+}
+
+func (o *addCommandOpts) Run(ctx context.Context, references []string) error {
+	l := o.logger()
 	ctx = l.WithContext(ctx)
 
 	l.Debug().Msgf("loading k8s config")
 	kcfg := ctrl.GetConfigOrDie()
 
-	imgs, err := o.loadImages(ctx, reference)
+	client, closer, err := o.connect(ctx, kcfg)
 	if err != nil {
-		return fmt.Errorf("loading image: %v", err)
+		return err
 	}
+	defer closer()
 
-	if o.Container != "" {
-		// Open a tunnel to the ipfs pod
-		t, err := k8s.NewTunneler(kcfg)
-		if err != nil {
-			return err
+	return o.addAll(ctx, client, kcfg, references)
+}
+
+// addAll adds references concurrently, mapping everything that was added at once
+func (o *addCommandOpts) addAll(ctx context.Context, client iface.CoreAPI, kcfg *rest.Config, references []string) error {
+	l := zerolog.Ctx(ctx)
+
+	if o.Concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+
+	switch o.Progress {
+	case "text":
+	case "json":
+		o.progress = &progressWriter{enc: json.NewEncoder(os.Stdout)}
+	default:
+		return fmt.Errorf("--progress must be text or json")
+	}
+
+	if o.AllPlatforms {
+		if len(o.Platforms) > 0 {
+			return fmt.Errorf("only one of --platform and --all-platforms may be given")
 		}
+		o.Platforms = []string{"all"}
+	}
 
-		ipfsTargetPod, err := o.fwdTarget(ctx, kcfg)
-		if err != nil {
-			return err
+	match, err := platformMatcher(o.Platforms)
+	if err != nil {
+		return err
+	}
+
+	if err := o.chunking().Validate(); err != nil {
+		return err
+	}
+
+	if o.LayerIndex != "" {
+		if o.layers, err = registry.NewFileLayerIndex(o.LayerIndex); err != nil {
+			return fmt.Errorf("opening layer index: %v", err)
 		}
+	}
 
-		l.Debug().Msgf("opening tunnel to ipfs api")
-		fwd, err := t.Tunnel(ctx, ipfsTargetPod, []string{"5001:5001"})
-		if err != nil {
+	if o.Verify {
+		if o.verifier, err = o.newVerifier(ctx); err != nil {
 			return err
 		}
-		defer fwd.Close()
 	}
 
-	// Add the image
-	ma, err := multiaddr.NewMultiaddr(o.IPFSApiAddress)
+	policy, err := o.replicationPolicy()
 	if err != nil {
 		return err
 	}
 
-	client, err := httpapi.NewApi(ma)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		set    = make(map[string]string)
+		failed []error
+		refc   = make(chan string)
+	)
+	for w := 0; w < o.Concurrency && w < len(references); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for reference := range refc {
+				added, err := o.add(ctx, client, reference, match)
+
+				mu.Lock()
+				if err != nil {
+					l.Error().Msgf("adding %s: %v", reference, err)
+					failed = append(failed, fmt.Errorf("adding %s: %w", reference, err))
+					o.progress.write(addEvent{Image: reference, Progress: registry.Progress{Phase: phaseFailed}, Error: err.Error()})
+				}
+				for ref, p := range added {
+					set[ref] = p.String()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, reference := range references {
+		refc <- reference
+	}
+	close(refc)
+	wg.Wait()
+
+	// Everything added is mapped at once, even when some images failed, rather than publishing once per image
+	if len(set) > 0 {
+		if _, e, err := updateCidMap(ctx, client, kcfg, o.Namespace, o.MappingKey, set); err != nil {
+			failed = append(failed, fmt.Errorf("updating mappings: %v", err))
+			o.progress.write(addEvent{Progress: registry.Progress{Phase: phaseFailed}, Error: fmt.Sprintf("updating mappings: %v", err)})
+		} else {
+			refs := make([]string, 0, len(set))
+			for ref := range set {
+				refs = append(refs, ref)
+			}
+			sort.Strings(refs)
+
+			for _, ref := range refs {
+				l.Info().Msgf("updated mapping [%s] with [%s] => [%s]", e.Name(), ref, set[ref])
+				o.progress.write(addEvent{Image: ref, Progress: registry.Progress{Phase: phaseMapped, Cid: strings.TrimPrefix(set[ref], "/ipfs/")}})
+			}
+
+			if policy != nil {
+				err := updateReplicationPolicies(ctx, kcfg, o.Namespace, func(policies registry.ReplicationPolicies) bool {
+					for _, ref := range refs {
+						policies[ref] = *policy
+					}
+					return true
+				})
+				if err != nil {
+					failed = append(failed, fmt.Errorf("recording replication policies: %v", err))
+				} else {
+					l.Info().Msgf("recorded the replication policy of %d images", len(refs))
+				}
+			}
+		}
+	}
+
+	switch len(failed) {
+	case 0:
+		return nil
+	case 1:
+		return failed[0]
+	}
+	return multierror.Append(nil, failed...)
+}
+
+// add adds every image loaded from reference, returning the root each of them should be mapped to
+func (o *addCommandOpts) add(ctx context.Context, client iface.CoreAPI, reference string, match func(p *v1.Platform) bool) (map[string]path.Resolved, error) {
+	l := zerolog.Ctx(ctx)
+
+	if c, ok := o.hostedCid(reference); ok {
+		l.Warn().Msgf("%s is already hosted by ripfs as [%s], skipping", reference, c)
+		return nil, nil
+	}
+
+	added := make(map[string]path.Resolved)
+
+	src := o.ripfsSource(ctx, reference)
+
+	if src != nil && o.verifier != nil {
+		return nil, fmt.Errorf("images mirrored from ripfs registries can't be verified, their signatures aren't mirrored with them")
+	}
+
+	if src != nil {
+		l.Info().Msgf("mirroring [%s] from ripfs registry %s", src.root, src.ref.Context().RegistryStr())
+		p, err := registry.ImportRemoteCar(ctx, client, src.ref.Context().Registry, src.root, remote.DefaultTransport)
+		if err != nil {
+			return nil, err
+		}
+		l.Info().Msgf("added image with root cid [%s]", p.String())
+		o.progress.write(addEvent{Image: reference, Progress: registry.Progress{Phase: registry.PhaseAdded, Cid: p.Cid().String()}})
+
+		added[src.ref.Name()] = p
+		return added, nil
+	}
+
+	digests := make(map[string]v1.Hash)
+	imgs, idxs, err := o.loadImages(ctx, reference, digests)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("loading image: %v", err)
 	}
 
 	for ref, img := range imgs {
-		p, err := registry.AddImage(ctx, client, img)
+		p, err := registry.AddImage(ctx, client, img, o.layers, o.provenance(ref, digests)...)
 		if err != nil {
-			return err
+			return added, err
 		}
 		l.Info().Msgf("added image with root cid [%s]", p.String())
 
-		_, e, err := updateCidMap(ctx, client, kcfg, ref, p)
+		added[ref] = p
+	}
+
+	for ref, idx := range idxs {
+		p, err := registry.AddIndex(ctx, client, idx, match, o.layers, o.provenance(ref, digests)...)
 		if err != nil {
-			return err
+			return added, err
+		}
+		l.Info().Msgf("added multi-arch image with root cid [%s]", p.String())
+
+		added[ref] = p
+	}
+
+	// Verified images are stored with their signatures, so they can be verified again once they're stored
+	if o.Artifacts || o.verifier != nil {
+		if err := o.addArtifacts(ctx, client, digests, added); err != nil {
+			return added, err
 		}
+	}
 
-		l.Info().Msgf("updated mapping [%s] with [%s] => [%s]", e.Name(), ref, p.String())
+	return added, nil
+}
+
+// provenance returns the options ref is added with, stamped with the digest that was verified when it was
+func (o *addCommandOpts) provenance(ref string, digests map[string]v1.Hash) []registry.AddOption {
+	opts := []registry.AddOption{registry.WithProvenance(ref), registry.WithChunking(o.chunking()), o.progress.option(ref)}
+	if d, ok := digests[ref]; ok && o.verifier != nil {
+		opts = append(opts, registry.WithSignedDigest(d))
 	}
+	return opts
+}
+
+// addArtifacts adds the cosign artifacts attached to every remote image added, mapped alongside them
+func (o *addCommandOpts) addArtifacts(ctx context.Context, client iface.CoreAPI, digests map[string]v1.Hash, added map[string]path.Resolved) error {
+	l := zerolog.Ctx(ctx)
+
+	for ref, d := range digests {
+		root, ok := added[ref]
+		if !ok {
+			continue
+		}
+
+		r, err := name.ParseReference(ref, o.nameOptions()...)
+		if err != nil {
+			return err
+		}
+
+		artifacts, err := registry.AddArtifacts(ctx, client, r.Context(), d, root, o.layers,
+			remote.WithContext(ctx),
+			remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		)
+		if err != nil {
+			return fmt.Errorf("adding artifacts of %s: %v", ref, err)
+		}
 
+		for tag, p := range artifacts {
+			l.Info().Msgf("added artifact %s of %s with root cid [%s]", tag, ref, p.String())
+			added[r.Context().Tag(tag).Name()] = p
+		}
+	}
 	return nil
 }
 
+// The phases of adding images reported beyond those of the registry, once they're mapped or failed to be added
+const (
+	phaseMapped registry.Phase = "mapped"
+	phaseFailed registry.Phase = "failed"
+)
+
+// addEvent is a line of the progress reported with --progress json
+type addEvent struct {
+	// Image is the reference being added
+	Image string `json:"image,omitempty"`
+
+	registry.Progress
+
+	Error string `json:"error,omitempty"`
+}
+
+// progressWriter writes the progress of adding images as newline delimited json, nil reporting nothing
+type progressWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (w *progressWriter) write(e addEvent) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_ = w.enc.Encode(e)
+}
+
+// option returns the add option reporting the progress of adding ref
+func (w *progressWriter) option(ref string) registry.AddOption {
+	if w == nil {
+		return registry.WithProgress(nil)
+	}
+
+	return registry.WithProgress(func(p registry.Progress) {
+		w.write(addEvent{Image: ref, Progress: p})
+	})
+}
+
+// defaultLayerIndex is where the layers added are remembered by default, within the user's cache directory
+func defaultLayerIndex() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, consts.Name, "layers")
+}
+
+// platformMatcher matches the given platforms (os/arch[/variant]), nil (matching everything) when all are requested
+func platformMatcher(platforms []string) (func(p *v1.Platform) bool, error) {
+	for _, s := range platforms {
+		if s == "all" {
+			return nil, nil
+		}
+	}
+
+	want, err := platform.ParseAll(platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(p *v1.Platform) bool {
+		for _, w := range want {
+			if platform.Matches(*p, w) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
 // loadImages takes an arbitrary reference and either:
 // 		1) loads an image from a remote reference (ex: alpine:latest)
 // 		2) loads images from an oci layout directory (ex: path/to/oci/layout
 // 		3) loads images from a tarball (ex: path/to/tar.gz
-func (o *addCommandOpts) loadImages(ctx context.Context, reference string) (map[string]v1.Image, error) {
+// 		4) loads images from a tarball streamed to stdin (ex: -)
+// The digest each remote reference resolved to is recorded in digests.
+func (o *addCommandOpts) loadImages(ctx context.Context, reference string, digests map[string]v1.Hash) (map[string]v1.Image, map[string]v1.ImageIndex, error) {
 	var (
 		imgs = make(map[string]v1.Image)
+		idxs = make(map[string]v1.ImageIndex)
 		err  error
 	)
 
+	if reference == "-" {
+		if o.verifier != nil {
+			return nil, nil, fmt.Errorf("only remote images can be verified")
+		}
+
+		err = o.loadImagesFromStdin(imgs)
+		return imgs, idxs, err
+	}
+
 	// Check if we've got a valid remote reference first
-	iref, rerr := name.ParseReference(reference)
+	iref, rerr := name.ParseReference(reference, o.nameOptions()...)
 	if rerr == nil {
-		err = o.loadImagesFromRemote(ctx, iref, imgs)
-		return imgs, err
+		err = o.loadImagesFromRemote(ctx, iref, imgs, idxs, digests)
+		return imgs, idxs, err
 	}
 
 	fi, err := os.Stat(reference)
 	if err != nil {
-		return nil, fmt.Errorf("provided reference %s is neither a valid remote image or local path", reference)
+		return nil, nil, fmt.Errorf("%w: %s is neither a valid remote image or local path", registry.ErrInvalidReference, reference)
+	}
+
+	if o.verifier != nil {
+		return nil, nil, fmt.Errorf("only remote images can be verified")
 	}
 
 	if fi.IsDir() {
@@ -166,10 +634,80 @@ func (o *addCommandOpts) loadImages(ctx context.Context, reference string) (map[
 		err = o.loadImagesFromTar(reference, imgs)
 	}
 
-	return imgs, err
+	return imgs, idxs, err
+}
+
+// nameOptions are the options remote references are parsed with
+func (o *addCommandOpts) nameOptions() []name.Option {
+	if o.Insecure {
+		return []name.Option{name.Insecure}
+	}
+	return nil
+}
+
+// hostedCid reports whether reference already points at the ripfs registry, returning the cid it names. Other
+// registries are never considered hosted, even when serving ipfs/<cid> repositories (they may be other clusters).
+func (o *addCommandOpts) hostedCid(reference string) (string, bool) {
+	ref, err := name.ParseReference(reference, name.WeakValidation)
+	if err != nil || ref.Context().RegistryStr() != o.Registry {
+		return "", false
+	}
+
+	repo := strings.TrimPrefix(ref.Context().RepositoryStr(), "ipfs/")
+	if c, err := cid.Decode(repo); err == nil {
+		return c.String(), true
+	}
+	return repo, true
+}
+
+// remoteRipfs is an image hosted by another ripfs cluster, which can be transferred whole rather than layer by layer
+type remoteRipfs struct {
+	ref  name.Reference
+	root cid.Cid
+}
+
+// ripfsSource returns the remote ripfs image named by reference, or nil when reference isn't one (or its registry
+// can't be probed)
+func (o *addCommandOpts) ripfsSource(ctx context.Context, reference string) *remoteRipfs {
+	l := zerolog.Ctx(ctx)
+
+	ref, err := name.ParseReference(reference, o.nameOptions()...)
+	if err != nil {
+		return nil
+	}
+
+	repo := ref.Context().RepositoryStr()
+	if !strings.HasPrefix(repo, "ipfs/") {
+		return nil
+	}
+
+	root, err := cid.Decode(strings.TrimPrefix(repo, "ipfs/"))
+	if err != nil {
+		return nil
+	}
+
+	// Registries that can't be probed are pulled from like any other, failing there if they're unreachable
+	info, err := registry.ProbeRipfs(ctx, ref.Context().Registry, remote.DefaultTransport)
+	if err != nil {
+		l.Debug().Msgf("probing %s, treating it as a plain registry: %v", ref.Context().RegistryStr(), err)
+		return nil
+	}
+
+	if info == nil {
+		return nil
+	}
+
+	for _, t := range info.Transfers {
+		if t == registry.TransferCar {
+			return &remoteRipfs{ref: ref, root: root}
+		}
+	}
+
+	l.Debug().Msgf("%s is a ripfs registry, but doesn't support car transfers", ref.Context().RegistryStr())
+	return nil
 }
 
-func (o *addCommandOpts) loadImagesFromRemote(ctx context.Context, ref name.Reference, imgMap map[string]v1.Image) error {
+func (o *addCommandOpts) loadImagesFromRemote(ctx context.Context, ref name.Reference, imgMap map[string]v1.Image, idxMap map[string]v1.ImageIndex, digests map[string]v1.Hash) error {
 	l := zerolog.Ctx(ctx)
 
 	p := v1.Platform{
@@ -189,34 +727,187 @@ func (o *addCommandOpts) loadImagesFromRemote(ctx context.Context, ref name.Refe
 		return err
 	}
 
+	// Whatever the reference resolves to is verified, which for a multi-arch image is the index every platform is
+	// signed through
+	if o.verifier != nil {
+		if err := o.verifier.Verify(ref.Context(), desc.Digest); err != nil {
+			return fmt.Errorf("verifying %s: %v", ref.Name(), err)
+		}
+		l.Info().Msgf("verified signature of %s@%s", ref.Context().Name(), desc.Digest)
+	}
+	digests[ref.Name()] = desc.Digest
+
 	switch desc.MediaType {
 	case types.OCIImageIndex, types.DockerManifestList:
-		// TODO: actually handle indexes
+		// Without any requested platforms only the single linux/amd64 (or deprecated --os/--arch) image is added
+		if len(o.Platforms) == 0 {
+			break
+		}
+
+		l.Info().Msgf("loading remote multi-arch image: %s", ref.Name())
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+
+		idxMap[ref.Name()] = idx
+		return nil
 
 	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
-		return fmt.Errorf("lol no: %v", desc.MediaType)
+		return fmt.Errorf("%w: schema 1 images (%s) aren't supported", registry.ErrInvalidReference, desc.MediaType)
 
 	}
 
 	l.Info().Msgf("loading remote image: %s", ref.Name())
-	img, err := remote.Image(ref, opts...)
+	// Resolved from the descriptor, rather than the reference again, so it's exactly what was verified
+	img, err := desc.Image()
 	if err != nil {
 		return err
 	}
 
+	// A single platform image is only added when it's one of the requested platforms. Its config doesn't record a
+	// variant, so only its os and architecture are compared.
+	if match, err := platformMatcher(o.Platforms); err != nil {
+		return err
+	} else if len(o.Platforms) > 0 && match != nil {
+		want, err := platform.ParseAll(o.Platforms)
+		if err != nil {
+			return err
+		}
+
+		cf, err := img.ConfigFile()
+		if err != nil {
+			return err
+		}
+
+		matched := false
+		for _, w := range want {
+			matched = matched || (w.OS == cf.OS && w.Architecture == cf.Architecture)
+		}
+		if !matched {
+			return fmt.Errorf("%w: %s is a single %s/%s image, which isn't one of the requested platforms", registry.ErrNotFound, ref.Name(), cf.OS, cf.Architecture)
+		}
+	}
+
 	imgMap[ref.Name()] = img
 	return nil
 }
 
+// readImageList reads a list of images, either one per line (skipping blank lines and # comments) or as a yaml (or
+// json) list, which may also be given as the images of an object
+func readImageList(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml", ".json":
+		var images []string
+		if err := yaml.Unmarshal(data, &images); err == nil {
+			return images, nil
+		}
+
+		list := struct {
+			Images []string `json:"images"`
+		}{}
+		if err := yaml.UnmarshalStrict(data, &list); err != nil {
+			return nil, fmt.Errorf("expected a list of images: %v", err)
+		}
+		return list.Images, nil
+	}
+
+	return scanImageList(bytes.NewReader(data))
+}
+
+// scanImageList reads a list of images one per line, skipping blank lines and # comments
+func scanImageList(r io.Reader) ([]string, error) {
+	var images []string
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		images = append(images, line)
+	}
+	return images, s.Err()
+}
+
+// readStdin reads what's streamed to stdin for -, either a docker archive (kept to be loaded as it's added) or a list
+// of images one per line, which is returned
+func (o *addCommandOpts) readStdin(r io.Reader) ([]string, error) {
+	br := bufio.NewReader(r)
+
+	// Tar headers carry their magic 257 bytes in
+	if header, _ := br.Peek(262); len(header) == 262 && string(header[257:]) == "ustar" {
+		o.stdin = br
+		return nil, nil
+	}
+
+	images, err := scanImageList(br)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no images were listed")
+	}
+	return images, nil
+}
+
+// loadImagesFromTar loads every image saved to a docker archive (such as by docker save), by each of its repo tags
 func (o *addCommandOpts) loadImagesFromTar(path string, imgMap map[string]v1.Image) error {
-	img, err := tarball.ImageFromPath(path, nil)
+	return loadImagesFromArchive(path, func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}, imgMap)
+}
+
+// loadImagesFromStdin loads every image of a docker archive streamed to stdin (such as docker save alpine | ripfs add -).
+// The archive's manifest comes last, and is needed before any of it can be read as an image, so it's held in memory
+// rather than written anywhere.
+func (o *addCommandOpts) loadImagesFromStdin(imgMap map[string]v1.Image) error {
+	in := o.stdin
+	if in == nil {
+		in = os.Stdin
+	}
+
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("reading stdin: %v", err)
+	}
+
+	return loadImagesFromArchive("stdin", func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}, imgMap)
+}
+
+// loadImagesFromArchive loads every image of the docker archive opened by opener, by each of its repo tags
+func loadImagesFromArchive(src string, opener tarball.Opener, imgMap map[string]v1.Image) error {
+	m, err := tarball.LoadManifest(opener)
 	if err != nil {
 		return err
 	}
-	// TODO: Fix
-	imgMap["temp"] = img
 
-	// TODO: handle multi image saves
+	for _, desc := range m {
+		if len(desc.RepoTags) == 0 {
+			return fmt.Errorf("%w: image %s in %s has no repo tags to be mapped by", registry.ErrInvalidReference, desc.Config, src)
+		}
+
+		for _, rt := range desc.RepoTags {
+			tag, err := name.NewTag(rt)
+			if err != nil {
+				return fmt.Errorf("%w: %s in %s: %v", registry.ErrInvalidReference, rt, src, err)
+			}
+
+			img, err := tarball.Image(opener, &tag)
+			if err != nil {
+				return err
+			}
+			imgMap[tag.Name()] = img
+		}
+	}
+
 	return nil
 }
 
@@ -248,109 +939,306 @@ func (o *addCommandOpts) loadImagesFromLayout(path string, imgMap map[string]v1.
 	return nil
 }
 
-func updateCidMap(ctx context.Context, api iface.CoreAPI, kcfg *rest.Config, ref string, op path.Resolved) (path.Resolved, iface.IpnsEntry, error) {
+// replicationPolicy returns the replication policy the added images are recorded with, or nil if they have none
+func (o *addCommandOpts) replicationPolicy() (*registry.ReplicationPolicy, error) {
+	if o.Replicas == 0 && o.PinOn == "" {
+		return nil, nil
+	}
+
+	selector, err := labels.ConvertSelectorToLabelsMap(o.PinOn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --pin-on %s: %v", o.PinOn, err)
+	}
+
+	p := &registry.ReplicationPolicy{Replicas: o.Replicas, NodeSelector: selector}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// updateReplicationPolicies applies update to the replication policies of the cluster installed in namespace,
+// recording them unless it reports nothing changed
+func updateReplicationPolicies(ctx context.Context, kcfg *rest.Config, namespace string, update func(policies registry.ReplicationPolicies) bool) error {
 	kc, err := corev1client.NewForConfig(kcfg)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
+	cms := kc.ConfigMaps(namespace)
 
-	s, err := kc.Secrets("ripfs-system").Get(ctx, consts.CidMapperSecretName, metav1.GetOptions{})
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := cms.Get(ctx, consts.ReplicationPoliciesConfigMapName, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: consts.ReplicationPoliciesConfigMapName}}
+		} else if err != nil {
+			return err
+		}
+
+		policies, err := registry.ParseReplicationPolicies(cm.Data[consts.ReplicationPoliciesKey])
+		if err != nil {
+			return fmt.Errorf("invalid replication policies: %v", err)
+		}
+		if !update(policies) {
+			return nil
+		}
+
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[consts.ReplicationPoliciesKey] = policies.String()
+
+		if cm.ResourceVersion == "" {
+			_, err = cms.Create(ctx, cm, metav1.CreateOptions{})
+		} else {
+			_, err = cms.Update(ctx, cm, metav1.UpdateOptions{})
+		}
+		if errors.IsAlreadyExists(err) {
+			// Created by someone else meanwhile, retried as a conflict with their policies
+			return errors.NewConflict(corev1.Resource("configmaps"), cm.Name, err)
+		}
+		return err
+	})
+}
+
+// readCidMap reads the cluster's current reference => cid mappings from the mapper secret in namespace, and the path
+// they're published at
+func readCidMap(ctx context.Context, api iface.CoreAPI, kcfg *rest.Config, namespace string) (path.Path, map[string]string, error) {
+	kc, err := corev1client.NewForConfig(kcfg)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	idxPath, ok := s.Data[consts.CidMapperSecretKey]
-	if !ok {
-		return nil, nil, fmt.Errorf("couldn't find ipns key in secret: %v", s.Name)
+	s, err := kc.Secrets(namespace).Get(ctx, consts.CidMapperSecretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Update and publish the new ipns index
-	p, err := api.Name().Resolve(ctx, string(idxPath))
+	p, err := cidMapPath(ctx, api, s)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	nd, err := api.Unixfs().Get(ctx, p)
+	cidMap, err := registry.ReadMappings(ctx, api, p)
 	if err != nil {
 		return nil, nil, err
 	}
+	return p, cidMap, nil
+}
 
-	f, ok := nd.(files.File)
-	if !ok {
-		return nil, nil, fmt.Errorf("expected a file for the index, didn't get that")
+// cidMapPath returns the path of the mappings last committed to the mapper secret s, resolving its ipns name for
+// mappings published before they were committed there
+func cidMapPath(ctx context.Context, api iface.CoreAPI, s *corev1.Secret) (path.Path, error) {
+	if p, ok := s.Data[consts.CidMapperPathKey]; ok {
+		return path.New(string(p)), nil
 	}
-	defer f.Close()
 
-	cidMap := make(map[string]string)
-	if err := json.NewDecoder(f).Decode(&cidMap); err != nil {
-		return nil, nil, err
+	name, ok := s.Data[consts.CidMapperSecretKey]
+	if !ok {
+		return nil, fmt.Errorf("couldn't find ipns key in secret: %v", s.Name)
 	}
+	return api.Name().Resolve(ctx, string(name))
+}
 
-	cidMap[ref] = op.String()
+// updateCidMap sets every reference => root mapping of set within the cluster's mappings, publishing them once. They're
+// signed with the private key at signingKey, or the cluster's mapping key when it's empty.
+func updateCidMap(ctx context.Context, api iface.CoreAPI, kcfg *rest.Config, namespace string, signingKey string, set map[string]string) (path.Resolved, iface.IpnsEntry, error) {
+	return commitCidMap(ctx, api, kcfg, namespace, signingKey, func(cidMap map[string]string) (registry.MappingDelta, error) {
+		for ref, p := range set {
+			cidMap[ref] = p
+		}
+		return registry.MappingDelta{Set: set}, nil
+	})
+}
 
-	data, err := json.Marshal(cidMap)
+// commitCidMap applies update to the cluster's mappings and publishes them, unless the delta it returns is empty (in
+// which case nothing is returned). The mappings are committed to the mapper secret in namespace, conflicting with any
+// update committed since they were read. update is then applied again to the mappings committed meanwhile, so
+// concurrent updates merge rather than losing one another's references.
+//
+// Each commit counts a generation, recorded on the Images the delta is applied to, so Images applied by concurrent
+// updates end up as the last one committed left them, whichever is applied last. They're applied as soon as the
+// mappings are committed, ahead of publishing them. The manager records whatever is missed from the committed mappings.
+func commitCidMap(ctx context.Context, api iface.CoreAPI, kcfg *rest.Config, namespace string, signingKey string, update func(cidMap map[string]string) (registry.MappingDelta, error)) (path.Resolved, iface.IpnsEntry, error) {
+	kc, err := corev1client.NewForConfig(kcfg)
 	if err != nil {
 		return nil, nil, err
 	}
+	secrets := kc.Secrets(namespace)
 
-	nf := files.NewBytesFile(data)
-	defer nf.Close()
+	var (
+		prev path.Path
+		ap   path.Resolved
+		d    registry.MappingDelta
 
-	ap, err := api.Unixfs().Add(ctx, nf, iopts.Unixfs.Pin(true), iopts.Unixfs.CidVersion(1))
-	if err != nil {
+		// The mapping key is only loaded once anything is set, so removing mappings never needs it
+		signer crypto.Signer
+		loaded bool
+	)
+	err = retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		s, err := secrets.Get(ctx, consts.CidMapperSecretName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if prev, err = cidMapPath(ctx, api, s); err != nil {
+			return err
+		}
+
+		cidMap, err := registry.ReadMappings(ctx, api, prev)
+		if err != nil {
+			return err
+		}
+
+		ap = nil
+		if d, err = update(cidMap); err != nil || (len(d.Set) == 0 && len(d.Removed) == 0) {
+			return err
+		}
+
+		if len(d.Set) > 0 && !loaded {
+			if signer, err = mappingSigner(ctx, kcfg, namespace, signingKey); err != nil {
+				return fmt.Errorf("loading mapping key: %v", err)
+			}
+			loaded = true
+		}
+
+		if signer != nil && len(d.Set) > 0 {
+			d.Signatures = make(map[string]string, len(d.Set))
+			for ref, root := range d.Set {
+				if d.Signatures[ref], err = registry.SignMapping(signer, ref, root); err != nil {
+					return fmt.Errorf("signing %s: %v", ref, err)
+				}
+			}
+		}
+
+		data, err := json.Marshal(cidMap)
+		if err != nil {
+			return err
+		}
+
+		nf := files.NewBytesFile(data)
+		defer nf.Close()
+
+		if ap, err = api.Unixfs().Add(ctx, nf, iopts.Unixfs.Pin(true), iopts.Unixfs.CidVersion(1)); err != nil {
+			return err
+		}
+
+		// Counted from whatever was last committed, so a conflict counts it again
+		generation, _ := strconv.ParseInt(string(s.Data[consts.CidMapperGenerationKey]), 10, 64)
+		d.Generation = generation + 1
+
+		s.Data[consts.CidMapperPathKey] = []byte(ap.String())
+		s.Data[consts.CidMapperGenerationKey] = []byte(strconv.FormatInt(d.Generation, 10))
+		_, err = secrets.Update(ctx, s, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil || ap == nil {
 		return nil, nil, err
 	}
 
-	e, err := api.Name().Publish(ctx, ap, func(settings *iopts.NamePublishSettings) error {
-		settings.AllowOffline = true
-		return nil
-	})
+	// The mappings are committed regardless, and the manager records their Images too, only without d's signatures
+	// unless it holds the mapping key
+	if err := applyImages(ctx, kcfg, namespace, d); err != nil {
+		zerolog.Ctx(ctx).Warn().Msgf("recording images, leaving them to the manager: %v", err)
+	}
+
+	e, err := publishCidMap(ctx, api, secrets, ap)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	// Peers fall back to ipns regardless, so failing to announce the update isn't fatal
+	d.Path, d.Previous = ap.String(), prev.String()
+	if err := registry.PublishDelta(ctx, api, consts.MappingsTopic, d); err != nil {
+		zerolog.Ctx(ctx).Warn().Msgf("announcing mapping update: %v", err)
+	}
+
 	return ap, e, nil
 }
 
-func (o *addCommandOpts) fwdTarget(ctx context.Context, kcfg *rest.Config) (k8s.Target, error) {
-	c, err := corev1client.NewForConfig(kcfg)
-	if err != nil {
-		return k8s.Target{}, err
+// applyImages records the committed delta d in the Images of namespace
+func applyImages(ctx context.Context, kcfg *rest.Config, namespace string, d registry.MappingDelta) error {
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		return err
 	}
 
-	svc, err := c.Services(o.Namespace).Get(ctx, o.Name, metav1.GetOptions{})
+	c, err := client.New(kcfg, client.Options{Scheme: scheme})
 	if err != nil {
-		return k8s.Target{}, err
+		return err
 	}
+	return registry.ApplyImages(ctx, c, namespace, d)
+}
 
-	var sls []string
-	for k, v := range svc.Spec.Selector {
-		sls = append(sls, k+"="+v)
+// mappingSigner loads the private key at path mappings are signed with, or the cluster's mapping key (from namespace)
+// when path is empty. Mappings are left unsigned (returning nil) should the cluster have no mapping key, or should it
+// not be readable, unless the manager verifies mappings, as they'd never resolve.
+func mappingSigner(ctx context.Context, kcfg *rest.Config, namespace string, path string) (crypto.Signer, error) {
+	if path != "" {
+		return verify.LoadPrivateKey(path)
 	}
 
-	pods, err := c.Pods(o.Namespace).List(ctx, metav1.ListOptions{
-		LabelSelector: strings.Join(sls, ","),
-		Limit:         1,
-	})
+	kc, err := kubernetes.NewForConfig(kcfg)
 	if err != nil {
-		return k8s.Target{}, err
+		return nil, err
 	}
-	fwdPod := pods.Items[0]
 
-	found := false
-	for _, c := range fwdPod.Spec.Containers {
-		if c.Name == o.Container {
-			found = true
+	s, err := kc.CoreV1().Secrets(namespace).Get(ctx, consts.MappingKeySecretName, metav1.GetOptions{})
+	if errors.IsNotFound(err) || errors.IsForbidden(err) {
+		verifying, verr := verifiesMappings(ctx, kc, namespace)
+		if verr != nil {
+			zerolog.Ctx(ctx).Warn().Msgf("leaving mappings unsigned, they won't resolve should the cluster verify them: %v", err)
+			return nil, nil
+		} else if verifying {
+			return nil, fmt.Errorf("the cluster verifies mappings, but its mapping key isn't available (%v), sign them with --mapping-key instead", err)
 		}
+
+		zerolog.Ctx(ctx).Warn().Msgf("leaving mappings unsigned: %v", err)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
 
-	if !found {
-		return k8s.Target{}, fmt.Errorf("couldn't find container: %s in pod %s", o.Container, fwdPod.Name)
+	return verify.ParsePrivateKey(s.Data[consts.MappingKeySecretKey])
+}
+
+// verifiesMappings returns whether the manager in namespace runs with --verify-mappings
+func verifiesMappings(ctx context.Context, kc kubernetes.Interface, namespace string) (bool, error) {
+	deploy, err := kc.AppsV1().Deployments(namespace).Get(ctx, consts.ManagerDeploymentName, metav1.GetOptions{})
+	if err != nil {
+		return false, err
 	}
 
-	return k8s.Target{
-		Name:      fwdPod.Name,
-		Namespace: fwdPod.Namespace,
-		Container: o.Container,
-	}, nil
+	for _, c := range deploy.Spec.Template.Spec.Containers {
+		for _, arg := range append(c.Command, c.Args...) {
+			if arg == "--verify-mappings" || arg == "--verify-mappings=true" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// publishCidMap publishes the committed mappings p to ipns. An update committed after p may be published before it,
+// so the mapper secret is checked afterwards, publishing whatever was committed since in its place.
+func publishCidMap(ctx context.Context, api iface.CoreAPI, secrets corev1client.SecretInterface, p path.Path) (iface.IpnsEntry, error) {
+	for {
+		e, err := api.Name().Publish(ctx, p, func(settings *iopts.NamePublishSettings) error {
+			settings.AllowOffline = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := secrets.Get(ctx, consts.CidMapperSecretName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		latest := string(s.Data[consts.CidMapperPathKey])
+		if latest == "" || latest == p.String() {
+			return e, nil
+		}
+		p = path.New(latest)
+	}
 }
@@ -0,0 +1,183 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+type adoptCommandOpts struct {
+	addCommandOpts
+
+	AllNamespaces bool
+	Namespaces    []string
+	DryRun        bool
+}
+
+func newAdoptCommand() *cobra.Command {
+	o := &adoptCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "adopt",
+		Short: "Add every image already run by the cluster's workloads",
+		Long: `Add every image already run by the cluster's workloads, bootstrapping ripfs into an existing cluster so it
+can later be taken offline.
+
+Images are found in the pod templates of deployments, daemonsets, statefulsets, jobs and cronjobs (including those
+scaled to zero), along with every pod. Images that are already mapped, or already pulled from the ripfs registry, are
+skipped. The rest are added concurrently and mapped together, as with add --file.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Run(cmd.Context())
+		},
+	}
+
+	o.Flags(cmd)
+
+	f := cmd.Flags()
+	f.BoolVarP(&o.AllNamespaces, "all-namespaces", "A", false,
+		"Adopt the images of workloads in every namespace.")
+	f.StringSliceVarP(&o.Namespaces, "namespace", "n", []string{"default"},
+		"Namespaces to adopt the images of workloads in, ignored with --all-namespaces.")
+	f.BoolVar(&o.DryRun, "dry-run", false,
+		"Only print the images that would be added.")
+
+	return cmd
+}
+
+func (o *adoptCommandOpts) Run(ctx context.Context) error {
+	l := o.logger()
+	ctx = l.WithContext(ctx)
+
+	kcfg := ctrl.GetConfigOrDie()
+
+	kc, err := kubernetes.NewForConfig(kcfg)
+	if err != nil {
+		return err
+	}
+
+	namespaces := o.Namespaces
+	if o.AllNamespaces {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	found := make(map[string]bool)
+	for _, ns := range namespaces {
+		if err := workloadImages(ctx, kc, ns, found); err != nil {
+			return err
+		}
+	}
+
+	client, closer, err := o.connect(ctx, kcfg)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	_, cidMap, err := readCidMap(ctx, client, kcfg, o.Namespace)
+	if err != nil {
+		return fmt.Errorf("reading mappings: %v", err)
+	}
+
+	var references []string
+	for image := range found {
+		if _, ok := o.hostedCid(image); ok {
+			continue
+		}
+
+		ref, err := name.ParseReference(image)
+		if err != nil {
+			l.Warn().Msgf("skipping invalid image %s: %v", image, err)
+			continue
+		}
+
+		if _, ok := cidMap[ref.Name()]; ok {
+			l.Debug().Msgf("%s is already mapped, skipping", ref.Name())
+			continue
+		}
+		references = append(references, ref.Name())
+	}
+	sort.Strings(references)
+
+	if len(references) == 0 {
+		l.Info().Msgf("every image of %d found is already adopted", len(found))
+		return nil
+	}
+
+	if o.DryRun {
+		for _, ref := range references {
+			fmt.Println(ref)
+		}
+		return nil
+	}
+
+	l.Info().Msgf("adopting %d images of %d found", len(references), len(found))
+	return o.addAll(ctx, client, kcfg, references)
+}
+
+// workloadImages adds the image of every container run by the workloads (and pods) of namespace to images
+func workloadImages(ctx context.Context, kc kubernetes.Interface, namespace string, images map[string]bool) error {
+	var specs []corev1.PodSpec
+
+	pods, err := kc.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing pods: %v", err)
+	}
+	for _, pod := range pods.Items {
+		specs = append(specs, pod.Spec)
+	}
+
+	deploys, err := kc.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing deployments: %v", err)
+	}
+	for _, d := range deploys.Items {
+		specs = append(specs, d.Spec.Template.Spec)
+	}
+
+	daemonsets, err := kc.AppsV1().DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing daemonsets: %v", err)
+	}
+	for _, ds := range daemonsets.Items {
+		specs = append(specs, ds.Spec.Template.Spec)
+	}
+
+	statefulsets, err := kc.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing statefulsets: %v", err)
+	}
+	for _, ss := range statefulsets.Items {
+		specs = append(specs, ss.Spec.Template.Spec)
+	}
+
+	jobs, err := kc.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing jobs: %v", err)
+	}
+	for _, j := range jobs.Items {
+		specs = append(specs, j.Spec.Template.Spec)
+	}
+
+	cronjobs, err := kc.BatchV1().CronJobs(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing cronjobs: %v", err)
+	}
+	for _, cj := range cronjobs.Items {
+		specs = append(specs, cj.Spec.JobTemplate.Spec.Template.Spec)
+	}
+
+	for _, spec := range specs {
+		for _, c := range append(spec.InitContainers, spec.Containers...) {
+			images[c.Image] = true
+		}
+	}
+	return nil
+}
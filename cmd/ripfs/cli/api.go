@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/joshrwolf/ripfs/internal/k8s"
+)
+
+// apiOpts are the options for reaching the cluster's ipfs api, tunneling to the manager when a container is given
+type apiOpts struct {
+	IPFSApiAddress string
+
+	Name      string
+	Namespace string
+	Container string
+}
+
+func (o *apiOpts) Flags(cmd *cobra.Command) {
+	f := cmd.Flags()
+
+	f.StringVarP(&o.IPFSApiAddress, "ipfs-api-address", "i", "/ip4/127.0.0.1/tcp/5001",
+		"IPFS api address to use for communicating with the IPFS store.")
+	f.StringVar(&o.Name, "pod-name", "ripfs-controller-manager",
+		"Name of the service containing the IPFS api")
+	f.StringVar(&o.Namespace, "pod-namespace", "ripfs-system",
+		"Namespace of the service containing the IPFS api")
+	f.StringVar(&o.Container, "container", "manager",
+		"Container within pod to forward to.")
+}
+
+// connect returns a client for the ipfs api, along with a func closing any tunnel opened to reach it
+func (o *apiOpts) connect(ctx context.Context, kcfg *rest.Config) (iface.CoreAPI, func(), error) {
+	l := zerolog.Ctx(ctx)
+
+	closer := func() {}
+	if o.Container != "" {
+		// Open a tunnel to the ipfs pod
+		t, err := k8s.NewTunneler(kcfg)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ipfsTargetPod, err := o.fwdTarget(ctx, kcfg)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		l.Debug().Msgf("opening tunnel to ipfs api")
+		fwd, err := t.Tunnel(ctx, ipfsTargetPod, []string{"5001:5001"})
+		if err != nil {
+			return nil, nil, err
+		}
+		closer = fwd.Close
+	}
+
+	ma, err := multiaddr.NewMultiaddr(o.IPFSApiAddress)
+	if err != nil {
+		closer()
+		return nil, nil, err
+	}
+
+	client, err := httpapi.NewApi(ma)
+	if err != nil {
+		closer()
+		return nil, nil, err
+	}
+
+	return client, closer, nil
+}
+
+func (o *apiOpts) fwdTarget(ctx context.Context, kcfg *rest.Config) (k8s.Target, error) {
+	c, err := corev1client.NewForConfig(kcfg)
+	if err != nil {
+		return k8s.Target{}, err
+	}
+
+	svc, err := c.Services(o.Namespace).Get(ctx, o.Name, metav1.GetOptions{})
+	if err != nil {
+		return k8s.Target{}, err
+	}
+
+	var sls []string
+	for k, v := range svc.Spec.Selector {
+		sls = append(sls, k+"="+v)
+	}
+
+	pods, err := c.Pods(o.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: strings.Join(sls, ","),
+		Limit:         1,
+	})
+	if err != nil {
+		return k8s.Target{}, err
+	}
+
+	if len(pods.Items) == 0 {
+		return k8s.Target{}, fmt.Errorf("no pods found for service %s/%s", o.Namespace, o.Name)
+	}
+	fwdPod := pods.Items[0]
+
+	found := false
+	for _, c := range fwdPod.Spec.Containers {
+		if c.Name == o.Container {
+			found = true
+		}
+	}
+
+	if !found {
+		return k8s.Target{}, fmt.Errorf("couldn't find container: %s in pod %s", o.Container, fwdPod.Name)
+	}
+
+	return k8s.Target{
+		Name:      fwdPod.Name,
+		Namespace: fwdPod.Namespace,
+		Container: o.Container,
+	}, nil
+}
@@ -0,0 +1,222 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+)
+
+func newBenchCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Benchmark the registry",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+
+	cmd.AddCommand(newBenchPullCommand())
+	return cmd
+}
+
+type benchPullCommandOpts struct {
+	Concurrency int
+	Iterations  int
+	Insecure    bool
+
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+func newBenchPullCommand() *cobra.Command {
+	o := &benchPullCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "pull",
+		Short: "Simulate concurrent clients pulling an image through the registry",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Run(cmd.Context(), args[0])
+		},
+	}
+
+	f := cmd.Flags()
+	f.IntVarP(&o.Concurrency, "concurrency", "c", 1,
+		"Number of simultaneous clients pulling the image.")
+	f.IntVarP(&o.Iterations, "iterations", "n", 1,
+		"Number of times each client pulls the image.")
+	f.BoolVar(&o.Insecure, "insecure", false,
+		"Allow pulling over plain http (always allowed from localhost and private addresses).")
+
+	f.StringVar(&o.Architecture, "arch", "amd64",
+		"Image's architecture.")
+	f.StringVar(&o.OS, "os", "linux",
+		"Image's OS.")
+	f.StringVar(&o.Variant, "variant", "",
+		"Image's variant.")
+
+	return cmd
+}
+
+// pullSample is the timing of a single registry request made during a pull
+type pullSample struct {
+	kind     string
+	bytes    int64
+	duration time.Duration
+}
+
+func (o *benchPullCommandOpts) Run(ctx context.Context, reference string) error {
+	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+
+	if o.Concurrency < 1 || o.Iterations < 1 {
+		return fmt.Errorf("concurrency and iterations must both be at least 1")
+	}
+
+	var nopts []name.Option
+	if o.Insecure {
+		nopts = append(nopts, name.Insecure)
+	}
+
+	ref, err := name.ParseReference(reference, nopts...)
+	if err != nil {
+		return err
+	}
+
+	ropts := []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		remote.WithPlatform(v1.Platform{OS: o.OS, Architecture: o.Architecture, Variant: o.Variant}),
+	}
+
+	var (
+		mu      sync.Mutex
+		samples []pullSample
+	)
+
+	l.Info().Msgf("pulling %s with %d clients, %d times each", ref.Name(), o.Concurrency, o.Iterations)
+
+	start := time.Now()
+	g, gctx := errgroup.WithContext(ctx)
+	for c := 0; c < o.Concurrency; c++ {
+		g.Go(func() error {
+			for i := 0; i < o.Iterations; i++ {
+				s, err := o.pull(gctx, ref, ropts)
+				if err != nil {
+					return err
+				}
+
+				mu.Lock()
+				samples = append(samples, s...)
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	o.report(os.Stdout, samples, elapsed)
+	return nil
+}
+
+// pull pulls the manifest and every layer of an image, timing each request
+func (o *benchPullCommandOpts) pull(ctx context.Context, ref name.Reference, ropts []remote.Option) ([]pullSample, error) {
+	var samples []pullSample
+
+	start := time.Now()
+	img, err := remote.Image(ref, append(ropts, remote.WithContext(ctx))...)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := img.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	samples = append(samples, pullSample{kind: "manifest", bytes: int64(len(m)), duration: time.Since(start)})
+
+	start = time.Now()
+	cfg, err := img.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	samples = append(samples, pullSample{kind: "config", bytes: int64(len(cfg)), duration: time.Since(start)})
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, layer := range layers {
+		start := time.Now()
+		rc, err := layer.Compressed()
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		samples = append(samples, pullSample{kind: "blob", bytes: n, duration: time.Since(start)})
+	}
+
+	return samples, nil
+}
+
+func (o *benchPullCommandOpts) report(w io.Writer, samples []pullSample, elapsed time.Duration) {
+	var total int64
+	byKind := make(map[string][]time.Duration)
+	for _, s := range samples {
+		total += s.bytes
+		byKind[s.kind] = append(byKind[s.kind], s.duration)
+	}
+
+	pulls := o.Concurrency * o.Iterations
+	fmt.Fprintf(w, "pulls:\t%d in %s\n", pulls, elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "transferred:\t%.2f MiB\n", float64(total)/(1<<20))
+	fmt.Fprintf(w, "throughput:\t%.2f MiB/s, %.2f pulls/s\n\n",
+		float64(total)/(1<<20)/elapsed.Seconds(), float64(pulls)/elapsed.Seconds())
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REQUEST\tCOUNT\tP50\tP90\tP99\tMAX")
+	for _, kind := range []string{"manifest", "config", "blob"} {
+		ds := byKind[kind]
+		if len(ds) == 0 {
+			continue
+		}
+
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", kind, len(ds),
+			percentile(ds, 50), percentile(ds, 90), percentile(ds, 99), ds[len(ds)-1].Round(time.Microsecond))
+	}
+	tw.Flush()
+}
+
+// percentile returns the pth percentile of an already sorted set of durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i].Round(time.Microsecond)
+}
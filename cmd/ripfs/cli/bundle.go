@@ -0,0 +1,217 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/mholt/archiver/v4"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/joshrwolf/ripfs/internal/k8s/offline"
+	"github.com/joshrwolf/ripfs/internal/platform"
+)
+
+type bundleCommandOpts struct {
+	Output     string
+	Image      string
+	Layout     string
+	BusyboxDir string
+	Platforms  []string
+
+	Add      []string
+	Since    string
+	Manifest string
+
+	Compression string
+	SplitSize   string
+}
+
+func newBundleCommand() *cobra.Command {
+	o := &bundleCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "bundle",
+		Short: "Assemble a multi-arch offline payload for use with install --offline",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Run(cmd.Context())
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVarP(&o.Output, "output", "o", "offline-payload.tar.gz",
+		"Path to write the payload to.")
+	f.StringVar(&o.Image, "image", "",
+		"Remote (multi-arch) ripfs image to bundle (ex: ghcr.io/joshrwolf/ripfs:latest).")
+	f.StringVar(&o.Layout, "layout", "",
+		"Local oci layout containing the (multi-arch) ripfs image to bundle, such as one built by ko.")
+	f.StringVar(&o.BusyboxDir, "busybox-dir", "",
+		"Directory containing busybox-<os>-<arch>[-<variant>] executables, the embedded ones are used when unset.")
+
+	// Only linux/amd64's busybox is embedded, others need --busybox-dir, so only the host's platform is bundled unless
+	// more are asked for
+	f.StringSliceVar(&o.Platforms, "platform", []string{platform.String(platform.Host())},
+		"Platforms to include in the payload, each needs a busybox in --busybox-dir unless it's linux/amd64.")
+
+	f.StringSliceVar(&o.Add, "add", nil,
+		"Remote images to carry in the payload alongside ripfs, for adding once across the air-gap.")
+	f.StringVar(&o.Since, "since", "",
+		"Manifest of a previous bundle, blobs it already carried are left out of this one.")
+	f.StringVar(&o.Manifest, "manifest", "",
+		"Path to write the bundle's manifest to, for use with a later --since (defaults to <output>.json).")
+	f.StringVar(&o.Compression, "compression", "gzip",
+		"Compression of the payload, one of gzip or zstd.")
+	f.StringVar(&o.SplitSize, "split-size", "",
+		"Split the payload into volumes of at most this size (ex: 4G, 700Mi), joined again by install --offline <output>.volumes.json.")
+
+	return cmd
+}
+
+func (o *bundleCommandOpts) Run(ctx context.Context) error {
+	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+	ctx = l.WithContext(ctx)
+
+	platforms, err := platform.ParseAll(o.Platforms)
+	if err != nil {
+		return err
+	}
+
+	idx, err := o.index(ctx)
+	if err != nil {
+		return fmt.Errorf("loading ripfs image: %v", err)
+	}
+
+	b := &offline.PayloadBundle{
+		Index:      idx,
+		Platforms:  platforms,
+		BusyboxDir: o.BusyboxDir,
+	}
+
+	if b.Images, err = o.images(ctx); err != nil {
+		return err
+	}
+
+	if o.Since != "" {
+		if b.Since, err = offline.ReadBundleManifest(o.Since); err != nil {
+			return err
+		}
+	}
+
+	if b.Compression, err = o.compression(); err != nil {
+		return err
+	}
+
+	out, err := o.output()
+	if err != nil {
+		return err
+	}
+
+	if err := b.Write(ctx, out); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if o.SplitSize != "" {
+		l.Info().Msgf("wrote offline payload volumes, join them with %s", o.Output+offline.VolumesSuffix)
+	} else {
+		l.Info().Msgf("wrote offline payload to %s", o.Output)
+	}
+
+	m, err := b.Manifest()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	mp := o.Manifest
+	if mp == "" {
+		mp = o.Output + ".json"
+	}
+
+	if err := os.WriteFile(mp, data, 0644); err != nil {
+		return err
+	}
+	l.Info().Msgf("wrote bundle manifest to %s", mp)
+	return nil
+}
+
+func (o *bundleCommandOpts) compression() (archiver.Compression, error) {
+	switch o.Compression {
+	case "gzip", "gz":
+		return archiver.Gz{}, nil
+	case "zstd", "zst":
+		return archiver.Zstd{}, nil
+	}
+	return nil, fmt.Errorf("unsupported compression %s, expected gzip or zstd", o.Compression)
+}
+
+// output is where the payload is written, either a single file or volumes of at most --split-size
+func (o *bundleCommandOpts) output() (io.WriteCloser, error) {
+	if o.SplitSize == "" {
+		return os.Create(o.Output)
+	}
+
+	q, err := resource.ParseQuantity(o.SplitSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid split size %s: %v", o.SplitSize, err)
+	}
+	return offline.NewVolumeWriter(o.Output, q.Value())
+}
+
+// images fetches the additional images to carry in the payload
+func (o *bundleCommandOpts) images(ctx context.Context) (map[string]v1.Image, error) {
+	imgs := make(map[string]v1.Image, len(o.Add))
+	for _, image := range o.Add {
+		ref, err := name.ParseReference(image)
+		if err != nil {
+			return nil, err
+		}
+
+		img, err := remote.Image(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain))
+		if err != nil {
+			return nil, fmt.Errorf("fetching %s: %v", ref.Name(), err)
+		}
+		imgs[ref.Name()] = img
+	}
+	return imgs, nil
+}
+
+func (o *bundleCommandOpts) index(ctx context.Context) (v1.ImageIndex, error) {
+	switch {
+	case o.Image != "" && o.Layout != "":
+		return nil, fmt.Errorf("only one of --image or --layout may be specified")
+
+	case o.Layout != "":
+		p, err := layout.FromPath(o.Layout)
+		if err != nil {
+			return nil, err
+		}
+		return p.ImageIndex()
+
+	case o.Image != "":
+		ref, err := name.ParseReference(o.Image)
+		if err != nil {
+			return nil, err
+		}
+		return remote.Index(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	}
+
+	return nil, fmt.Errorf("one of --image or --layout is required")
+}
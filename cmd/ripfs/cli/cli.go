@@ -1,56 +1,192 @@
 package cli
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/dustin/go-humanize"
+	"github.com/hashicorp/go-multierror"
 	config "github.com/ipfs/go-ipfs-config"
 	httpapi "github.com/ipfs/go-ipfs-http-client"
 	"github.com/ipfs/go-ipfs/plugin/loader"
-	"github.com/ipfs/go-ipfs/repo"
 	"github.com/ipfs/go-ipfs/repo/fsrepo"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
-
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/joshrwolf/ripfs/internal/discovery"
 	"github.com/joshrwolf/ripfs/internal/ipfs"
+	"github.com/joshrwolf/ripfs/internal/registry"
 )
 
-func New() *cobra.Command {
+// Option configures the commands returned by New
+type Option func(*options)
+
+// options are what every command of one New shares, rather than anything process wide, so several can be run in one
+// process (such as an agent alongside a registry, or in tests)
+type options struct {
+	// lookupEnv looks up the environment variables flags fall back to
+	lookupEnv func(key string) (string, bool)
+}
+
+// WithEnv looks up the environment variables that flags fall back to with lookup, rather than os.LookupEnv
+func WithEnv(lookup func(key string) (string, bool)) Option {
+	return func(c *options) {
+		c.lookupEnv = lookup
+	}
+}
+
+// New returns the ripfs command, which can also be run programmatically with its args set:
+//
+//	cmd := cli.New(cli.WithEnv(func(string) (string, bool) { return "", false }))
+//	cmd.SetArgs([]string{"serve", "--standalone"})
+//	err := cmd.ExecuteContext(ctx)
+func New(opts ...Option) *cobra.Command {
+	c := &options{lookupEnv: os.LookupEnv}
+	for _, opt := range opts {
+		opt(c)
+	}
+
 	cmd := &cobra.Command{
 		Use:   "ripfs",
 		Short: "Registry backed by IPFS",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return applyEnv(cmd.Flags(), c.lookupEnv)
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return cmd.Help()
 		},
 	}
 
-	viper.AutomaticEnv()
-	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
-
 	cmd.AddCommand(
 		newManagerCommand(),
 		newServeCommand(),
 		newAddCommand(),
 		newInstallCommand(),
+		newUninstallCommand(),
+		newBundleCommand(),
+		newBenchCommand(),
+		newInspectCommand(),
+		newRmCommand(),
+		newDepotCommand(),
+		newValidateCommand(),
+		newSwarmCommand(),
+		newAdoptCommand(),
+		newListCommand(),
+		newExportCommand(),
+		newDuCommand(),
+		newCpCommand(),
+		newObservabilityCommand(),
+		newWarmCommand(),
+		newConfigureNodeCommand(),
 	)
 
 	return cmd
 }
 
-var ipfsOpts = ipfsSharedOpts{}
+// ExitCode maps err to the exit code ripfs exits with, so scripts can tell what went wrong
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, registry.ErrNotFound):
+		return 2
+	case errors.Is(err, registry.ErrInvalidReference):
+		return 3
+	case errors.Is(err, registry.ErrNotPeered):
+		return 4
+	}
+	return 1
+}
+
+// envAnnotation annotates flags that fall back to an environment variable, with its name
+const envAnnotation = "ripfs_env"
+
+// envFlag makes the flag name of f fall back to its environment variable (the flag's name in upper snake case, such
+// as IPFS_PATH for --ipfs-path) when it isn't set
+func envFlag(f *pflag.FlagSet, name string) {
+	key := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	_ = f.SetAnnotation(name, envAnnotation, []string{key})
+}
+
+// applyEnv sets every flag of f that falls back to an environment variable, and wasn't set itself, from lookup. List
+// flags are space separated in the environment.
+func applyEnv(f *pflag.FlagSet, lookup func(key string) (string, bool)) error {
+	var errs error
+	f.VisitAll(func(fl *pflag.Flag) {
+		keys, ok := fl.Annotations[envAnnotation]
+		if !ok || fl.Changed {
+			return
+		}
+
+		v, ok := lookup(keys[0])
+		if !ok {
+			return
+		}
+
+		if strings.HasSuffix(fl.Value.Type(), "Slice") {
+			v = strings.Join(strings.Fields(v), ",")
+		}
+		if err := fl.Value.Set(v); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("invalid %s: %v", keys[0], err))
+		}
+	})
+	return errs
+}
 
+// ipfsSharedOpts are the options of every command running an ipfs node
 type ipfsSharedOpts struct {
 	RepoPath       string
 	ApiAddress     string
 	GatewayAddress string
+	EnableGateway  bool
 	BootstrapPeers []string
+	Profile        string
+	Datastore      string
+	DatastoreSpec  string
+
+	StorageMax  string
+	GCWatermark int64
+	GCInterval  time.Duration
+
+	ConnLowWater                      int
+	ConnHighWater                     int
+	ConnGracePeriod                   time.Duration
+	BitswapTaskWorkers                int
+	BitswapEngineBlockstoreWorkers    int
+	BitswapEngineTaskWorkers          int
+	BitswapMaxOutstandingBytesPerPeer string
+
+	// PodName, PodNamespace and PodUID are the pod the node runs in (from the downward api), which its events are on
+	PodName      string
+	PodNamespace string
+	PodUID       string
+
+	ExternalIpfs         string
+	ExternalIpfsSwarmKey string
+
+	ShutdownTimeout time.Duration
+
+	PeerDiscovery         string
+	PeerDiscoveryInterval time.Duration
 }
 
 func (o *ipfsSharedOpts) Flags(cmd *cobra.Command) {
@@ -58,38 +194,126 @@ func (o *ipfsSharedOpts) Flags(cmd *cobra.Command) {
 
 	f.StringVar(&o.RepoPath, "ipfs-path", "/data/ipfs",
 		"The path to the ipfs repo.")
-	viper.BindPFlag("ipfs-path", f.Lookup("ipfs-path"))
+	envFlag(f, "ipfs-path")
 
 	f.StringVar(&o.ApiAddress, "ipfs-api-address", "/ip4/127.0.0.1/tcp/5001",
 		"The multicast address to use for the ipfs api.")
 	f.StringVar(&o.GatewayAddress, "ipfs-gateway-address", "/ip4/127.0.0.1/tcp/8080",
 		"The multicast address to use for the ipfs gateway.")
+	f.BoolVar(&o.EnableGateway, "enable-gateway", false,
+		"Serve the embedded ipfs node's read only gateway on --ipfs-gateway-address, so any content (such as bundles or charts) can be fetched over http.")
+	envFlag(f, "enable-gateway")
 
 	f.StringSliceVar(&o.BootstrapPeers, "ipfs-bootstrap-peers", []string{},
 		"List of bootstrap peers to configure.")
-	viper.BindPFlag("ipfs-bootstrap-peers", f.Lookup("ipfs-bootstrap-peers"))
+	envFlag(f, "ipfs-bootstrap-peers")
+
+	f.StringVar(&o.Profile, "profile", "default",
+		"Resource profile to tune the embedded ipfs node with (default, edge).")
+	envFlag(f, "profile")
+
+	f.StringVar(&o.Datastore, "ipfs-datastore", "",
+		"Datastore to initialize the embedded ipfs node's repo with (badgerds, flatfs, leveldb), rather than the profile's.")
+	envFlag(f, "ipfs-datastore")
+	f.StringVar(&o.DatastoreSpec, "ipfs-datastore-spec", "",
+		"Path to a json datastore spec (as in the Datastore.Spec of an ipfs config) to initialize the embedded ipfs node's repo with, overriding --ipfs-datastore.")
+	envFlag(f, "ipfs-datastore-spec")
+
+	f.StringVar(&o.StorageMax, "ipfs-storage-max", "",
+		"Size (such as 50GB) the embedded ipfs node's repo is kept under by garbage collection (empty keeps the repo's, 50GB when it's initialized).")
+	envFlag(f, "ipfs-storage-max")
+	f.Int64Var(&o.GCWatermark, "ipfs-gc-watermark", 0,
+		"Percentage of --ipfs-storage-max beyond which the embedded ipfs node's repo is garbage collected (0 keeps the repo's, 90 by default).")
+	envFlag(f, "ipfs-gc-watermark")
+	f.DurationVar(&o.GCInterval, "ipfs-gc-interval", time.Hour,
+		"How often the embedded ipfs node's repo is checked against its watermark, and garbage collected beyond it (0 disables).")
+	envFlag(f, "ipfs-gc-interval")
+
+	f.IntVar(&o.ConnLowWater, "ipfs-conn-low-water", 0,
+		"Connections the embedded ipfs node trims its swarm connections down to beyond --ipfs-conn-high-water (0 keeps the repo's).")
+	envFlag(f, "ipfs-conn-low-water")
+	f.IntVar(&o.ConnHighWater, "ipfs-conn-high-water", 0,
+		"Connections beyond which the embedded ipfs node trims its swarm connections (0 keeps the repo's).")
+	envFlag(f, "ipfs-conn-high-water")
+	f.DurationVar(&o.ConnGracePeriod, "ipfs-conn-grace-period", 0,
+		"How long new swarm connections are spared from trimming (0 keeps the repo's).")
+	envFlag(f, "ipfs-conn-grace-period")
+	f.IntVar(&o.BitswapTaskWorkers, "ipfs-bitswap-task-workers", 0,
+		"Workers the embedded ipfs node's bitswap runs (0 keeps the repo's).")
+	envFlag(f, "ipfs-bitswap-task-workers")
+	f.IntVar(&o.BitswapEngineBlockstoreWorkers, "ipfs-bitswap-engine-blockstore-workers", 0,
+		"Workers the embedded ipfs node's bitswap reads blocks to send with (0 keeps the repo's).")
+	envFlag(f, "ipfs-bitswap-engine-blockstore-workers")
+	f.IntVar(&o.BitswapEngineTaskWorkers, "ipfs-bitswap-engine-task-workers", 0,
+		"Workers the embedded ipfs node's bitswap sends blocks with (0 keeps the repo's).")
+	envFlag(f, "ipfs-bitswap-engine-task-workers")
+	f.StringVar(&o.BitswapMaxOutstandingBytesPerPeer, "ipfs-bitswap-max-outstanding-bytes-per-peer", "",
+		"Bytes (such as 256KB) the embedded ipfs node's bitswap sends a single peer at a time before serving the next (empty keeps the repo's).")
+	envFlag(f, "ipfs-bitswap-max-outstanding-bytes-per-peer")
+
+	f.StringVar(&o.PodName, "pod-name", "",
+		"Name of the pod ripfs runs in, which repo garbage collection events are recorded on.")
+	envFlag(f, "pod-name")
+	f.StringVar(&o.PodNamespace, "pod-namespace", "",
+		"Namespace of the pod ripfs runs in.")
+	envFlag(f, "pod-namespace")
+	f.StringVar(&o.PodUID, "pod-uid", "",
+		"UID of the pod ripfs runs in.")
+	envFlag(f, "pod-uid")
+
+	f.StringVar(&o.ExternalIpfs, "external-ipfs", "",
+		"Api multiaddr of an already running ipfs daemon (such as kubo or an ipfs-cluster peer) to use instead of the embedded node.")
+	envFlag(f, "external-ipfs")
+	f.StringVar(&o.ExternalIpfsSwarmKey, "external-ipfs-swarm-key", "",
+		"Path to the swarm key of the external ipfs daemon's private swarm, shared with the cluster's agents.")
+	envFlag(f, "external-ipfs-swarm-key")
+
+	f.DurationVar(&o.ShutdownTimeout, "shutdown-timeout", ipfs.DefaultShutdownTimeout,
+		"How long in flight requests are drained for when stopping, first from the registry and then the embedded ipfs node's api, before the node's repo is closed.")
+
+	f.StringVar(&o.PeerDiscovery, "peer-discovery", "",
+		"Kubernetes config map ([namespace/]name, in the pod's namespace by default) the ipfs node registers its addresses in and connects to every other node registered in, rather than discovering them with mDNS.")
+	envFlag(f, "peer-discovery")
+	f.DurationVar(&o.PeerDiscoveryInterval, "peer-discovery-interval", discovery.DefaultInterval,
+		"How often the ipfs node refreshes its registration for --peer-discovery, and connects to the nodes registered.")
 }
 
+// loadPlugins loads ipfs' plugins, which register themselves process wide and so are only ever loaded once
+var loadPlugins = func() func() error {
+	var (
+		once sync.Once
+		err  error
+	)
+	return func() error {
+		once.Do(func() {
+			var plugins *loader.PluginLoader
+			if plugins, err = loader.NewPluginLoader(""); err != nil {
+				return
+			}
+			if err = plugins.Initialize(); err != nil {
+				return
+			}
+			err = plugins.Inject()
+		})
+		return err
+	}
+}()
+
 func (o *ipfsSharedOpts) initRepo() error {
-	if err := func() error {
-		plugins, err := loader.NewPluginLoader("")
-		if err != nil {
-			return err
-		}
+	if err := loadPlugins(); err != nil {
+		return fmt.Errorf("loading plugins: %v", err)
+	}
 
-		if err := plugins.Initialize(); err != nil {
-			return err
-		}
+	profile, err := ipfs.GetProfile(o.Profile)
+	if err != nil {
+		return err
+	}
 
-		if err := plugins.Inject(); err != nil {
-			return err
-		}
-		return nil
-	}(); err != nil {
-		return fmt.Errorf("loading plugins: %v", err)
+	if profile.GCPercent != 0 {
+		debug.SetGCPercent(profile.GCPercent)
 	}
 
-	repoPath := viper.GetString("ipfs-path")
+	repoPath := o.RepoPath
 	if fsrepo.IsInitialized(repoPath) {
 		return nil
 	}
@@ -105,28 +329,32 @@ func (o *ipfsSharedOpts) initRepo() error {
 
 	cfg.Addresses.API = []string{o.ApiAddress}
 	cfg.Addresses.Gateway = []string{o.GatewayAddress}
-	cfg.Datastore = config.Datastore{
-		StorageMax: "50GB",
-		Spec: map[string]interface{}{
-			"type":   "measure",
-			"prefix": "badger.datastore",
-			"child": map[string]interface{}{
-				"type":       "badgerds",
-				"path":       "badgerds",
-				"syncWrites": false,
-				"truncate":   true,
-			},
-		},
+	cfg.Datastore = config.Datastore{StorageMax: "50GB"}
+	if err := ipfs.SetDatastore(cfg, "badgerds"); err != nil {
+		return err
 	}
 
-	// TODO: Make this work without mDNS?
-	// cfg.Discovery.MDNS.Enabled = false
-
 	// https://docs.ipfs.io/how-to/configure-node/#swarm
 	cfg.Swarm.DisableNatPortMap = true
 
-	fmt.Println("bootstrap peers: ", viper.GetStringSlice("ipfs-bootstrap-peers"))
-	cfg.Bootstrap = viper.GetStringSlice("ipfs-bootstrap-peers")
+	fmt.Println("bootstrap peers: ", o.BootstrapPeers)
+	cfg.Bootstrap = o.BootstrapPeers
+
+	// The datastore is only chosen when the repo is first initialized, later runs open whatever it was initialized with
+	switch {
+	case o.DatastoreSpec != "":
+		if err := ipfs.SetDatastoreSpec(cfg, o.DatastoreSpec); err != nil {
+			return err
+		}
+	case o.Datastore != "":
+		if err := ipfs.SetDatastore(cfg, o.Datastore); err != nil {
+			return err
+		}
+	case profile.Datastore != "":
+		if err := ipfs.SetDatastore(cfg, profile.Datastore); err != nil {
+			return err
+		}
+	}
 
 	if err := fsrepo.Init(repoPath, cfg); err != nil {
 		return err
@@ -134,13 +362,11 @@ func (o *ipfsSharedOpts) initRepo() error {
 
 	swarmKeyPath := filepath.Join(repoPath, "swarm.key")
 	if _, err := os.Stat(swarmKeyPath); err != nil {
-		key := make([]byte, 32)
-		if _, err := rand.Read(key); err != nil {
-			return fmt.Errorf("generating swarm key: %v", err)
+		swarmKey, err := newSwarmKey()
+		if err != nil {
+			return err
 		}
-
-		swarmKey := fmt.Sprintf("/key/swarm/psk/1.0.0/\n/base16/\n%s", hex.EncodeToString(key))
-		if err := os.WriteFile(swarmKeyPath, []byte(swarmKey), 0644); err != nil {
+		if err := os.WriteFile(swarmKeyPath, swarmKey, 0644); err != nil {
 			return err
 		}
 	}
@@ -148,32 +374,223 @@ func (o *ipfsSharedOpts) initRepo() error {
 	return nil
 }
 
-func (o *ipfsSharedOpts) initIpfs(bootstrapper bool) (*ipfs.Daemon, iface.CoreAPI, repo.Repo, error) {
-	ipfsRepoPath := viper.GetString("ipfs-path")
+// newSwarmKey generates the key of a new private swarm
+func newSwarmKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generating swarm key: %v", err)
+	}
+	return []byte(fmt.Sprintf("/key/swarm/psk/1.0.0/\n/base16/\n%s", hex.EncodeToString(key))), nil
+}
+
+// initIpfs returns the ipfs node to run, along with a client for its api. The embedded node's repo is initialized
+// (and opened) unless an external daemon is used instead, which is only reached through its api.
+//
+// The repo's garbage collection is recorded as events on the pod ripfs runs in with recorder, if set.
+func (o *ipfsSharedOpts) initIpfs(bootstrapper bool, recorder record.EventRecorder) (ipfs.Node, iface.CoreAPI, error) {
+	if o.ExternalIpfs != "" {
+		e, err := ipfs.NewExternal(o.ExternalIpfs, o.ExternalIpfsSwarmKey)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		fmt.Println("using external ipfs node at: ", o.ExternalIpfs)
+		return e, e.API(), nil
+	}
 
 	if err := o.initRepo(); err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
+	}
+
+	gcOpts := ipfs.GCOptions{
+		StorageMax: o.StorageMax,
+		Watermark:  o.GCWatermark,
+		Interval:   o.GCInterval,
+	}
+	if pod := o.pod(); recorder != nil && pod != nil {
+		gcOpts.Recorder = recorder
+		gcOpts.Object = pod
+	}
+
+	// Peers discovered through Kubernetes aren't also looked for on the local network, which may not allow multicast
+	tuning := ipfs.TuningOptions{
+		ConnLowWater:                   o.ConnLowWater,
+		ConnHighWater:                  o.ConnHighWater,
+		ConnGracePeriod:                o.ConnGracePeriod,
+		BitswapTaskWorkers:             o.BitswapTaskWorkers,
+		BitswapEngineBlockstoreWorkers: o.BitswapEngineBlockstoreWorkers,
+		BitswapEngineTaskWorkers:       o.BitswapEngineTaskWorkers,
+	}
+	if o.BitswapMaxOutstandingBytesPerPeer != "" {
+		n, err := humanize.ParseBytes(o.BitswapMaxOutstandingBytesPerPeer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid bitswap max outstanding bytes per peer %s: %v", o.BitswapMaxOutstandingBytesPerPeer, err)
+		}
+		tuning.BitswapMaxOutstandingBytesPerPeer = int64(n)
 	}
 
-	d, err := ipfs.NewDaemon(ipfsRepoPath, bootstrapper)
+	profile, err := ipfs.GetProfile(o.Profile)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
+	}
+
+	daemonOpts := []ipfs.DaemonOption{
+		ipfs.WithProfile(profile),
+		ipfs.WithGC(gcOpts),
+		ipfs.WithTuning(tuning),
+		ipfs.WithShutdownTimeout(o.ShutdownTimeout),
+		ipfs.WithMDNS(o.PeerDiscovery == ""),
+		ipfs.WithBootstrapPeers(o.BootstrapPeers),
+	}
+	if o.EnableGateway {
+		daemonOpts = append(daemonOpts, ipfs.WithGateway(o.GatewayAddress))
 	}
 
-	r, err := d.Open()
+	d, err := ipfs.NewDaemon(o.RepoPath, bootstrapper, daemonOpts...)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
+	}
+
+	if _, err := d.Open(); err != nil {
+		return nil, nil, err
 	}
 
 	ma, err := multiaddr.NewMultiaddr(o.ApiAddress)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
 
 	c, err := httpapi.NewApi(ma)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
+	}
+
+	return d, c, nil
+}
+
+// runIpfs starts node in the background, sending the error it fails with (if any) on errc. The node runs until stop is
+// called rather than until the command's context is done, so whatever reads from it can be drained first, and stop
+// only returns once the node is closed.
+func runIpfs(node ipfs.Node, errc chan<- error) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer node.Unlock()
+
+		if err := node.Start(ctx); err != nil {
+			errc <- err
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// waitForIpfs waits for the node behind client to serve its api, such as one runIpfs only just started
+func waitForIpfs(ctx context.Context, client iface.CoreAPI) error {
+	for {
+		if _, err := client.Key().Self(ctx); err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// shutdown drains srv of in flight requests for up to timeout, closing whatever is left after that
+func shutdown(srv *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Println("draining registry: ", err)
+		srv.Close()
+	}
+}
+
+// discoverer returns what discovers the peers of the node behind api through --peer-discovery, nil when it's disabled.
+// Only the manager (and standalone depots) create the config map, agents may only register in it once it exists.
+func (o *ipfsSharedOpts) discoverer(api iface.CoreAPI, create bool) (*discovery.Discoverer, error) {
+	if o.PeerDiscovery == "" {
+		return nil, nil
+	}
+
+	if o.PodName == "" {
+		return nil, fmt.Errorf("--peer-discovery requires the pod's name (--pod-name)")
+	}
+
+	peers := o.peers()
+
+	kcfg, err := ctrl.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	kc, err := corev1client.NewForConfig(kcfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return discovery.New(api, kc.ConfigMaps(peers.Namespace), peers.Name, o.PodName, o.PeerDiscoveryInterval, create), nil
+}
+
+// peers returns the config map nodes register in for --peer-discovery, which is empty when it's disabled
+func (o *ipfsSharedOpts) peers() types.NamespacedName {
+	if o.PeerDiscovery == "" {
+		return types.NamespacedName{}
+	}
+
+	ns, name := o.PodNamespace, o.PeerDiscovery
+	if i := strings.Index(name, "/"); i >= 0 {
+		ns, name = name[:i], name[i+1:]
+	}
+	if ns == "" {
+		ns = "ripfs-system"
+	}
+	return types.NamespacedName{Namespace: ns, Name: name}
+}
+
+// eventRecorder returns a recorder of events from component, nil when ripfs doesn't know the pod it runs in to record
+// them on
+func (o *ipfsSharedOpts) eventRecorder(component string) (record.EventRecorder, error) {
+	if o.pod() == nil {
+		return nil, nil
+	}
+
+	kcfg, err := ctrl.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	kc, err := corev1client.NewForConfig(kcfg)
+	if err != nil {
+		return nil, err
+	}
+
+	b := record.NewBroadcaster()
+	b.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: kc.Events("")})
+	return b.NewRecorder(clientgoscheme.Scheme, corev1.EventSource{Component: component}), nil
+}
+
+// pod returns a reference to the pod ripfs runs in, nil when it isn't known
+func (o *ipfsSharedOpts) pod() *corev1.ObjectReference {
+	if o.PodName == "" || o.PodNamespace == "" {
+		return nil
 	}
 
-	return d, c, r, nil
+	return &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Name:       o.PodName,
+		Namespace:  o.PodNamespace,
+		UID:        types.UID(o.PodUID),
+	}
 }
@@ -0,0 +1,143 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+// hostsHeader marks the hosts.toml files configure-node manages, only these are ever overwritten or removed
+const hostsHeader = "# Managed by ripfs configure-node, changes are overwritten\n"
+
+type configureNodeCommandOpts struct {
+	Endpoint         string
+	Registries       []string
+	CertsDir         string
+	ContainerdConfig string
+	Force            bool
+	Remove           bool
+}
+
+func newConfigureNodeCommand() *cobra.Command {
+	o := &configureNodeCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "configure-node",
+		Short: "Configure the node's containerd to pull through ripfs as a registry mirror",
+		Long: `Configure the node's containerd to pull through ripfs as a registry mirror.
+
+A hosts.toml is written for every registry in --registries, under containerd's registry config directory, resolving and
+pulling its images from the ripfs registry at --endpoint first. Images ripfs doesn't hold fall back to the registry
+itself, so pods pull through ripfs transparently without the webhook rewriting their images.
+
+containerd only reads the directory when its cri plugin's registry config_path points at it, which requires a restart
+of containerd to take effect:
+
+  [plugins."io.containerd.grpc.v1.cri".registry]
+    config_path = "/etc/containerd/certs.d"`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Run(cmd.Context())
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVar(&o.Endpoint, "endpoint", "http://localhost:31609",
+		"Url of the ripfs registry containerd pulls through, such as the node local port of the agents.")
+	f.StringSliceVar(&o.Registries, "registries", []string{"docker.io", "ghcr.io", "quay.io", "registry.k8s.io", "k8s.gcr.io", "gcr.io"},
+		"Registries to mirror through ripfs, _default mirrors every registry (containerd 1.7 and later).")
+	f.StringVar(&o.CertsDir, "certs-dir", "/etc/containerd/certs.d",
+		"containerd's registry config directory (its cri plugin's registry config_path).")
+	f.StringVar(&o.ContainerdConfig, "containerd-config", "/etc/containerd/config.toml",
+		"containerd's config, checked for the registry config_path (empty skips the check).")
+	f.BoolVar(&o.Force, "force", false,
+		"Overwrite (or remove) hosts.toml files that weren't written by ripfs.")
+	f.BoolVar(&o.Remove, "remove", false,
+		"Remove the mirror configuration instead, so containerd pulls from every registry directly again.")
+
+	return cmd
+}
+
+func (o *configureNodeCommandOpts) Run(ctx context.Context) error {
+	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+
+	endpoint, err := url.Parse(o.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("invalid endpoint %s, must be an http(s) url", o.Endpoint)
+	}
+
+	for _, registry := range o.Registries {
+		dir := filepath.Join(o.CertsDir, registry)
+		path := filepath.Join(dir, "hosts.toml")
+
+		if existing, err := os.ReadFile(path); err == nil && !bytes.HasPrefix(existing, []byte(hostsHeader)) && !o.Force {
+			return fmt.Errorf("%s wasn't written by ripfs, leaving it as it is (--force overwrites it)", path)
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if o.Remove {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			// The directory may hold certificates too, it's only removed if it's empty
+			os.Remove(dir)
+			l.Info().Msgf("removed the ripfs mirror of %s", registry)
+			continue
+		}
+
+		data, err := hostsTOML(registry, endpoint)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+		l.Info().Msgf("mirrored %s through %s in %s", registry, endpoint, path)
+	}
+
+	if o.ContainerdConfig != "" && !o.Remove {
+		if cfg, err := os.ReadFile(o.ContainerdConfig); err != nil {
+			l.Warn().Msgf("couldn't check containerd's config: %v", err)
+		} else if !bytes.Contains(cfg, []byte("config_path")) {
+			l.Warn().Msgf("%s doesn't set the cri plugin's registry config_path, containerd won't read %s until it does (and is restarted)", o.ContainerdConfig, o.CertsDir)
+		}
+	}
+	return nil
+}
+
+// hostsTOML renders the hosts.toml of registry, resolving and pulling through endpoint before registry itself
+func hostsTOML(registry string, endpoint *url.URL) ([]byte, error) {
+	var b strings.Builder
+	b.WriteString(hostsHeader)
+
+	// _default has no server of its own, containerd falls back to whichever registry an image names
+	if registry != "_default" {
+		reg, err := name.NewRegistry(registry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry %s: %v", registry, err)
+		}
+
+		server := "https://" + reg.RegistryStr()
+		if reg.RegistryStr() == name.DefaultRegistry {
+			server = "https://registry-1.docker.io"
+		}
+		fmt.Fprintf(&b, "server = %q\n", server)
+	}
+
+	fmt.Fprintf(&b, "\n[host.%q]\n", strings.TrimSuffix(endpoint.String(), "/"))
+	b.WriteString("  capabilities = [\"pull\", \"resolve\"]\n")
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,199 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/ipfs/go-cid"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+type cpCommandOpts struct {
+	apiOpts
+
+	FromContext string
+	ToContext   string
+	FromCar     string
+	ToCar       string
+	MappingKey  string
+}
+
+func newCpCommand() *cobra.Command {
+	o := &cpCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "cp",
+		Short: "Copy an image between ripfs clusters, or to and from a CAR",
+		Long: `Copy an image, and everything it references, from one ripfs cluster to another (such as to promote it from
+a dev to a prod air-gapped cluster), or export it to a CAR file to be carried across and imported later.
+
+The image may be given as a mapped reference (alpine:latest), a root cid, or an ipfs/<cid> reference. A mapped
+reference is mapped within the destination cluster too. When importing from a CAR, the image is only mapped when a
+reference is given to map it as.
+
+Clusters are given by their kubeconfig context, the current context when unset.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			reference := ""
+			if len(args) > 0 {
+				reference = args[0]
+			}
+			return o.Run(cmd.Context(), reference)
+		},
+	}
+
+	o.apiOpts.Flags(cmd)
+
+	f := cmd.Flags()
+	f.StringVar(&o.FromContext, "from-context", "",
+		"Kubeconfig context of the cluster to copy from.")
+	f.StringVar(&o.ToContext, "to-context", "",
+		"Kubeconfig context of the cluster to copy to.")
+	f.StringVar(&o.FromCar, "from-car", "",
+		"Path to a CAR (written with --to-car) to copy from, rather than a cluster.")
+	f.StringVar(&o.ToCar, "to-car", "",
+		"Path to write a CAR to, rather than copying to a cluster.")
+	f.StringVar(&o.MappingKey, "mapping-key", "",
+		"Path to the private key (pem encoded pkcs8) the copied mapping is signed with, rather than the destination cluster's mapping key.")
+	envFlag(f, "mapping-key")
+
+	return cmd
+}
+
+func (o *cpCommandOpts) Run(ctx context.Context, reference string) error {
+	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+	ctx = l.WithContext(ctx)
+
+	switch {
+	case o.FromCar != "" && o.ToCar != "":
+		return fmt.Errorf("--from-car and --to-car can't be used together")
+	case o.FromCar == "" && reference == "":
+		return fmt.Errorf("an image to copy is required")
+	case o.FromCar == "" && o.ToCar == "" && o.FromContext == o.ToContext:
+		return fmt.Errorf("the image would be copied to the cluster it's already in, set --to-context or --to-car")
+	}
+
+	car := o.FromCar
+	if car == "" {
+		car = o.ToCar
+		if car == "" {
+			// Each cluster is tunneled to in turn, so the image is staged in between
+			f, err := ioutil.TempFile("", "ripfs-cp-*.car")
+			if err != nil {
+				return err
+			}
+			f.Close()
+			defer os.Remove(f.Name())
+			car = f.Name()
+		}
+
+		if err := o.export(ctx, reference, car); err != nil {
+			return err
+		}
+
+		if o.ToCar != "" {
+			l.Info().Msgf("successfully exported %s to %s", reference, car)
+			return nil
+		}
+	}
+
+	return o.importCar(ctx, reference, car)
+}
+
+// export writes a CAR of the image named by reference, within the source cluster, to car
+func (o *cpCommandOpts) export(ctx context.Context, reference string, car string) error {
+	l := zerolog.Ctx(ctx)
+
+	kcfg, err := config.GetConfigWithContext(o.FromContext)
+	if err != nil {
+		return err
+	}
+
+	client, closer, err := o.connect(ctx, kcfg)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	root, err := resolveRoot(ctx, client, kcfg, o.Namespace, reference)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(car)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	l.Info().Msgf("exporting %s (%s)", reference, root)
+	if err := registry.ExportCar(ctx, client, root, f); err != nil {
+		return fmt.Errorf("exporting %s: %v", root, err)
+	}
+	return f.Close()
+}
+
+// importCar imports car into the destination cluster, mapping it as reference when it's a name rather than a cid
+func (o *cpCommandOpts) importCar(ctx context.Context, reference string, car string) error {
+	l := zerolog.Ctx(ctx)
+
+	kcfg, err := config.GetConfigWithContext(o.ToContext)
+	if err != nil {
+		return err
+	}
+
+	client, closer, err := o.connect(ctx, kcfg)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	f, err := os.Open(car)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rp, err := registry.ImportCar(ctx, client, f)
+	if err != nil {
+		return fmt.Errorf("importing %s: %v", car, err)
+	}
+
+	ref, ok := mappedName(reference)
+	if !ok {
+		l.Info().Msgf("successfully copied %s", rp.Cid())
+		return nil
+	}
+
+	if _, _, err := updateCidMap(ctx, client, kcfg, o.Namespace, o.MappingKey, map[string]string{ref: rp.String()}); err != nil {
+		return fmt.Errorf("mapping %s: %v", ref, err)
+	}
+
+	l.Info().Msgf("successfully copied %s (%s)", ref, rp.Cid())
+	return nil
+}
+
+// mappedName returns the name reference is mapped as, unless it's a root cid or an ipfs/<cid> reference
+func mappedName(reference string) (string, bool) {
+	if reference == "" {
+		return "", false
+	}
+
+	if _, err := cid.Decode(strings.TrimPrefix(reference, "/ipfs/")); err == nil {
+		return "", false
+	}
+
+	ref, err := name.ParseReference(reference)
+	if err != nil || strings.HasPrefix(ref.Context().RepositoryStr(), "ipfs/") {
+		return "", false
+	}
+	return ref.Name(), true
+}
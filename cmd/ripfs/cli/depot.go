@@ -0,0 +1,389 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	files "github.com/ipfs/go-ipfs-files"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	iopts "github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+type depotCommandOpts struct {
+	ipfsOpts ipfsSharedOpts
+	chunkingOpts
+
+	Address    string
+	Images     []string
+	ImagesFile string
+	Platforms  []string
+	Interval   time.Duration
+}
+
+// depotState is what the depot has mirrored so far, persisted so restarts don't start from scratch
+type depotState struct {
+	// Mappings are reference => root mappings, as published to clusters
+	Mappings map[string]string `json:"mappings"`
+
+	// Digests are the upstream digests each reference was last mirrored at
+	Digests map[string]string `json:"digests"`
+}
+
+func newDepotCommand() *cobra.Command {
+	o := &depotCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "depot",
+		Short: "Continuously mirror upstream images into a standalone swarm for air-gapped clusters to join",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Run(cmd.Context())
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVarP(&o.Address, "address", "a", "0.0.0.0:5050",
+		"Address to serve the depot's registry on.")
+	f.StringSliceVar(&o.Images, "image", nil,
+		"Upstream images to mirror.")
+	f.StringVar(&o.ImagesFile, "images-file", "",
+		"File listing upstream images to mirror, one per line. It's read again on every pass, so images can be added without a restart.")
+	f.StringSliceVar(&o.Platforms, "platform", []string{"all"},
+		"Platforms (os/arch[/variant], or all) to mirror from multi-arch images.")
+	f.DurationVar(&o.Interval, "interval", 15*time.Minute,
+		"How often to check upstream images for updates.")
+
+	o.chunkingOpts.Flags(cmd)
+	o.ipfsOpts.Flags(cmd)
+
+	return cmd
+}
+
+func (o *depotCommandOpts) Run(ctx context.Context) error {
+	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+	ctx = l.WithContext(ctx)
+
+	match, err := platformMatcher(o.Platforms)
+	if err != nil {
+		return err
+	}
+
+	if err := o.chunking().Validate(); err != nil {
+		return err
+	}
+
+	ipfsDaemon, ipfsClient, err := o.ipfsOpts.initIpfs(false, nil)
+	if err != nil {
+		return err
+	}
+
+	defer ipfsDaemon.Unlock()
+
+	errc := make(chan error, 2)
+	stopIpfs := runIpfs(ipfsDaemon, errc)
+	defer stopIpfs()
+
+	disc, err := o.ipfsOpts.discoverer(ipfsClient, true)
+	if err != nil {
+		return err
+	}
+	if disc != nil {
+		go disc.Start(ctx)
+	}
+
+	if err := waitForIpfs(ctx, ipfsClient); err != nil {
+		return err
+	}
+
+	if err := o.printJoin(ctx, ipfsClient); err != nil {
+		return err
+	}
+
+	repoPath := o.ipfsOpts.RepoPath
+	idx, err := registry.NewFileIndex(filepath.Join(repoPath, "ripfs-index"))
+	if err != nil {
+		return fmt.Errorf("opening index: %v", err)
+	}
+
+	mapper := registry.NewMemoryCidMapper()
+	reg := registry.NewIpfsRegistry(ipfsClient, &registry.IpfsRegistryOpts{
+		Mapper: mapper,
+		Index:  idx,
+	})
+
+	srv := &http.Server{
+		Addr:              o.Address,
+		Handler:           reg.Router,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	defer shutdown(srv, o.ipfsOpts.ShutdownTimeout)
+
+	go func() {
+		l.Info().Msgf("serving depot registry on %s", o.Address)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			errc <- err
+		}
+	}()
+
+	statePath := filepath.Join(repoPath, "ripfs-depot.json")
+	state, err := loadDepotState(statePath)
+	if err != nil {
+		return err
+	}
+
+	// Whatever was mirrored before a restart is served (and published) straight away
+	if len(state.Mappings) > 0 {
+		if err := o.publish(ctx, ipfsClient, mapper, state.Mappings); err != nil {
+			return err
+		}
+	}
+
+	t := time.NewTicker(o.Interval)
+	defer t.Stop()
+
+	for {
+		// Only what was published is recorded, so anything that fails to be is mirrored (and published) again next time
+		if next, changed := o.sync(ctx, ipfsClient, state, match); changed {
+			if err := o.publish(ctx, ipfsClient, mapper, next.Mappings); err != nil {
+				l.Error().Msgf("publishing mappings: %v", err)
+			} else {
+				state = next
+				if err := saveDepotState(statePath, state); err != nil {
+					l.Error().Msgf("saving depot state: %v", err)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err := <-errc:
+			return err
+
+		case <-t.C:
+		}
+	}
+}
+
+// sync mirrors every configured image that changed upstream since state, returning the state with them mirrored and
+// whether any of them did. state itself is left as it is.
+func (o *depotCommandOpts) sync(ctx context.Context, client iface.CoreAPI, state *depotState, match func(p *v1.Platform) bool) (*depotState, bool) {
+	l := zerolog.Ctx(ctx)
+
+	images, err := o.images()
+	if err != nil {
+		l.Error().Msgf("listing images to mirror: %v", err)
+		return state, false
+	}
+
+	next := state.clone()
+	changed := false
+	for _, image := range images {
+		ref, err := name.ParseReference(image)
+		if err != nil {
+			l.Error().Msgf("invalid image %s: %v", image, err)
+			continue
+		}
+
+		root, d, err := o.mirror(ctx, client, ref, state.Digests[ref.Name()], match)
+		if err != nil {
+			l.Error().Msgf("mirroring %s: %v", ref.Name(), err)
+			continue
+		}
+
+		if root == nil {
+			l.Debug().Msgf("%s is up to date", ref.Name())
+			continue
+		}
+
+		l.Info().Msgf("mirrored [%s] at %s => [%s]", ref.Name(), d, root.String())
+		next.Mappings[ref.Name()] = root.String()
+		next.Digests[ref.Name()] = d.String()
+		changed = true
+	}
+	return next, changed
+}
+
+// mirror adds ref to ipfs unless it's still at the last mirrored digest, returning the new root (nil when unchanged)
+func (o *depotCommandOpts) mirror(ctx context.Context, client iface.CoreAPI, ref name.Reference, last string, match func(p *v1.Platform) bool) (path.Resolved, v1.Hash, error) {
+	opts := []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+	}
+
+	desc, err := remote.Get(ref, opts...)
+	if err != nil {
+		return nil, v1.Hash{}, err
+	}
+
+	if desc.Digest.String() == last {
+		return nil, desc.Digest, nil
+	}
+
+	var root path.Resolved
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, v1.Hash{}, err
+		}
+
+		root, err = registry.AddIndex(ctx, client, idx, match, nil, registry.WithProvenance(ref.Name()), registry.WithChunking(o.chunking()))
+		if err != nil {
+			return nil, v1.Hash{}, err
+		}
+
+	default:
+		img, err := desc.Image()
+		if err != nil {
+			return nil, v1.Hash{}, err
+		}
+
+		root, err = registry.AddImage(ctx, client, img, nil, registry.WithProvenance(ref.Name()), registry.WithChunking(o.chunking()))
+		if err != nil {
+			return nil, v1.Hash{}, err
+		}
+	}
+
+	return root, desc.Digest, nil
+}
+
+// publish serves mappings from the depot's registry, and publishes them to the depot's ipns name for clusters to sync
+func (o *depotCommandOpts) publish(ctx context.Context, client iface.CoreAPI, mapper *registry.MemoryCidMapper, mappings map[string]string) error {
+	l := zerolog.Ctx(ctx)
+
+	data, err := json.Marshal(mappings)
+	if err != nil {
+		return err
+	}
+
+	p, err := client.Unixfs().Add(ctx, files.NewBytesFile(data), iopts.Unixfs.Pin(true), iopts.Unixfs.CidVersion(1))
+	if err != nil {
+		return err
+	}
+
+	served := make(map[string]string, len(mappings))
+	for k, v := range mappings {
+		served[k] = v
+	}
+	mapper.Set(p, served)
+
+	// Deltas aren't announced over pubsub, joined clusters share the swarm's topics but only follow their own mappings
+	e, err := client.Name().Publish(ctx, p, func(settings *iopts.NamePublishSettings) error {
+		settings.AllowOffline = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	l.Info().Msgf("published %d mappings to [%s] => [%s]", len(mappings), e.Name(), p.String())
+	return nil
+}
+
+// images returns every image to mirror, from both the flags and the images file
+func (o *depotCommandOpts) images() ([]string, error) {
+	images := append([]string{}, o.Images...)
+	if o.ImagesFile == "" {
+		return images, nil
+	}
+
+	f, err := os.Open(o.ImagesFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		images = append(images, line)
+	}
+	return images, s.Err()
+}
+
+// printJoin prints what clusters need to join the depot's swarm with install --join
+func (o *depotCommandOpts) printJoin(ctx context.Context, client iface.CoreAPI) error {
+	l := zerolog.Ctx(ctx)
+
+	self, err := client.Key().Self(ctx)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := client.Swarm().ListenAddrs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range addrs {
+		l.Info().Msgf("join with: --join %s/p2p/%s", a, self.ID())
+	}
+	l.Info().Msgf("swarm key: %s", filepath.Join(o.ipfsOpts.RepoPath, "swarm.key"))
+	return nil
+}
+
+func loadDepotState(p string) (*depotState, error) {
+	state := &depotState{
+		Mappings: make(map[string]string),
+		Digests:  make(map[string]string),
+	}
+
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("reading depot state %s: %v", p, err)
+	}
+	return state, nil
+}
+
+// clone returns a copy of s that can be changed without changing s
+func (s *depotState) clone() *depotState {
+	c := &depotState{
+		Mappings: make(map[string]string, len(s.Mappings)),
+		Digests:  make(map[string]string, len(s.Digests)),
+	}
+	for k, v := range s.Mappings {
+		c.Mappings[k] = v
+	}
+	for k, v := range s.Digests {
+		c.Digests[k] = v
+	}
+	return c
+}
+
+func saveDepotState(p string, state *depotState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(p, data, 0644)
+}
@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+type duCommandOpts struct {
+	apiOpts
+
+	Output string
+}
+
+func newDuCommand() *cobra.Command {
+	o := &duCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "du [image]...",
+		Short: "Report the disk usage of images stored in the registry",
+		Long: `Report the disk usage of images stored in the registry, split into the bytes unique to each image and the
+bytes it shares with the other images given, along with the total of every distinct blob. The total is what exporting
+all of them takes with a shared --blob-store.
+
+Images may be given as mapped references (alpine:latest), root cids, or ipfs/<cid> references.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Run(cmd.Context(), args)
+		},
+	}
+
+	o.apiOpts.Flags(cmd)
+
+	f := cmd.Flags()
+	f.StringVarP(&o.Output, "output", "o", "text",
+		"Output format (text, json).")
+
+	return cmd
+}
+
+// diskUsage is the usage of a single image
+type diskUsage struct {
+	Reference string `json:"reference"`
+	Root      string `json:"root"`
+	Size      int64  `json:"size"`
+	Unique    int64  `json:"unique"`
+	Shared    int64  `json:"shared"`
+}
+
+// diskUsageReport is the usage of every image given, and of all of them together
+type diskUsageReport struct {
+	Images []*diskUsage `json:"images"`
+	Total  int64        `json:"total"`
+}
+
+func (o *duCommandOpts) Run(ctx context.Context, references []string) error {
+	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+	ctx = l.WithContext(ctx)
+
+	if o.Output != "text" && o.Output != "json" {
+		return fmt.Errorf("unknown output format %s", o.Output)
+	}
+
+	kcfg := ctrl.GetConfigOrDie()
+
+	client, closer, err := o.connect(ctx, kcfg)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	var (
+		report = &diskUsageReport{}
+		blobs  = make([]map[digest.Digest]int64, len(references))
+		users  = make(map[digest.Digest]int)
+		sizes  = make(map[digest.Digest]int64)
+	)
+	for i, reference := range references {
+		root, err := resolveRoot(ctx, client, kcfg, o.Namespace, reference)
+		if err != nil {
+			return err
+		}
+
+		if blobs[i], err = registry.StoredBlobs(ctx, client, root); err != nil {
+			return fmt.Errorf("reading %s: %v", reference, err)
+		}
+
+		for d, s := range blobs[i] {
+			users[d]++
+			sizes[d] = s
+		}
+		report.Images = append(report.Images, &diskUsage{Reference: reference, Root: root.String()})
+	}
+
+	for i, du := range report.Images {
+		for d, s := range blobs[i] {
+			du.Size += s
+			if users[d] == 1 {
+				du.Unique += s
+			} else {
+				du.Shared += s
+			}
+		}
+	}
+
+	for _, s := range sizes {
+		report.Total += s
+	}
+
+	if o.Output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	printDiskUsage(os.Stdout, report)
+	return nil
+}
+
+func printDiskUsage(w io.Writer, report *diskUsageReport) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "REFERENCE\tROOT\tSIZE\tUNIQUE\tSHARED")
+	for _, du := range report.Images {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", du.Reference, du.Root, du.Size, du.Unique, du.Shared)
+	}
+	fmt.Fprintf(tw, "TOTAL\t\t%d\t\t\n", report.Total)
+	tw.Flush()
+}
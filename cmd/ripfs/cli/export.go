@@ -0,0 +1,346 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/ipfs/go-cid"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+type exportCommandOpts struct {
+	apiOpts
+
+	Output    string
+	Format    string
+	Tag       string
+	Platforms []string
+	BlobStore string
+}
+
+func newExportCommand() *cobra.Command {
+	o := &exportCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export an image stored in the registry to an oci layout or docker archive",
+		Long: `Export an image stored in the registry to an oci layout directory or a docker archive tarball, read straight
+from ipfs without a registry endpoint, such as to debug it or migrate it elsewhere.
+
+The image may be given as a mapped reference (alpine:latest), a root cid, or an ipfs/<cid> reference. Multi-arch
+images are exported whole to an oci layout, while a docker archive holds a single image, picked with --platform.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Run(cmd.Context(), args[0])
+		},
+	}
+
+	o.apiOpts.Flags(cmd)
+
+	f := cmd.Flags()
+	f.StringVarP(&o.Output, "output", "o", "",
+		"Path to write the oci layout directory or docker archive to.")
+	f.StringVar(&o.Format, "format", "oci",
+		"Export format (oci, docker).")
+	f.StringVar(&o.Tag, "tag", "",
+		"Tag the exported image with, defaulting to the mapped reference or ipfs/<cid>:latest.")
+	f.StringSliceVar(&o.Platforms, "platform", nil,
+		"Platforms (os/arch[/variant]) to export from a multi-arch image, all when unset.")
+	f.StringVar(&o.BlobStore, "blob-store", "",
+		"Directory of blobs hard linked into oci layouts, so exporting images that share layers to several layouts stores each blob once.")
+
+	cmd.MarkFlagRequired("output")
+
+	return cmd
+}
+
+func (o *exportCommandOpts) Run(ctx context.Context, reference string) error {
+	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+	ctx = l.WithContext(ctx)
+
+	if o.Format != "oci" && o.Format != "docker" {
+		return fmt.Errorf("unknown export format %s", o.Format)
+	}
+
+	if o.BlobStore != "" && o.Format != "oci" {
+		return fmt.Errorf("--blob-store is only supported for oci layouts")
+	}
+
+	// Every image is exported unless platforms are requested
+	var match func(p *v1.Platform) bool
+	if len(o.Platforms) > 0 {
+		m, err := platformMatcher(o.Platforms)
+		if err != nil {
+			return err
+		}
+		match = m
+	}
+
+	kcfg := ctrl.GetConfigOrDie()
+
+	client, closer, err := o.connect(ctx, kcfg)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	root, err := resolveRoot(ctx, client, kcfg, o.Namespace, reference)
+	if err != nil {
+		return err
+	}
+
+	tag, err := o.tag(reference, root)
+	if err != nil {
+		return err
+	}
+
+	idx, err := registry.StoredIndex(ctx, client, root)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", root, err)
+	}
+
+	imgs, platforms, err := exportedImages(idx, match)
+	if err != nil {
+		return err
+	}
+
+	l.Info().Msgf("exporting %d image(s) from %s to %s as %s", len(imgs), root, o.Output, tag)
+
+	if o.Format == "docker" {
+		if len(imgs) != 1 {
+			return fmt.Errorf("a docker archive holds a single image, but %s has %d, pick one with --platform", root, len(imgs))
+		}
+		return tarball.WriteToFile(o.Output, tag, imgs[0])
+	}
+
+	p, err := layout.Write(o.Output, empty.Index)
+	if err != nil {
+		return err
+	}
+
+	// Whatever the image was stamped with when it was added travels with it, under the name it's exported as
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+
+	annotations := map[string]string{}
+	for k, v := range im.Annotations {
+		annotations[k] = v
+	}
+	annotations[ocispec.AnnotationRefName] = tag.String()
+
+	for i, img := range imgs {
+		opts := []layout.Option{layout.WithAnnotations(annotations)}
+		if platforms[i] != nil {
+			opts = append(opts, layout.WithPlatform(*platforms[i]))
+		}
+
+		// Blobs already in the layout aren't written again
+		if o.BlobStore != "" {
+			if err := linkBlobs(ctx, o.BlobStore, p, img); err != nil {
+				return fmt.Errorf("linking blobs from %s: %v", o.BlobStore, err)
+			}
+		}
+
+		if err := p.AppendImage(img, opts...); err != nil {
+			return fmt.Errorf("writing %s: %v", o.Output, err)
+		}
+	}
+
+	return nil
+}
+
+// tag is the name the export is tagged with, the reference itself when it's a mapped tag, otherwise ipfs/<cid>:latest
+func (o *exportCommandOpts) tag(reference string, root cid.Cid) (name.Tag, error) {
+	if o.Tag != "" {
+		return name.NewTag(o.Tag)
+	}
+
+	if _, err := cid.Decode(strings.TrimPrefix(reference, "/ipfs/")); err != nil {
+		if t, err := name.NewTag(reference); err == nil && !strings.HasPrefix(t.RepositoryStr(), "ipfs/") {
+			return t, nil
+		}
+	}
+
+	t, err := name.NewTag("ipfs/" + root.String() + ":latest")
+	if err != nil {
+		return name.Tag{}, fmt.Errorf("%s can't be used as a tag, set one with --tag: %v", root, err)
+	}
+	return t, nil
+}
+
+// exportedImages returns the images (and their platforms) within idx matching the requested platforms, nil matching
+// all of them
+func exportedImages(idx v1.ImageIndex, match func(p *v1.Platform) bool) ([]v1.Image, []*v1.Platform, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		imgs      []v1.Image
+		platforms []*v1.Platform
+	)
+	for _, desc := range im.Manifests {
+		if match != nil && (desc.Platform == nil || !match(desc.Platform)) {
+			continue
+		}
+
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		imgs = append(imgs, img)
+		platforms = append(platforms, desc.Platform)
+	}
+
+	if len(imgs) == 0 {
+		return nil, nil, fmt.Errorf("%w: no image matches the requested platforms", registry.ErrNotFound)
+	}
+	return imgs, platforms, nil
+}
+
+// linkBlobs hard links every blob of img into the layout at p from store, first writing any the store doesn't hold
+// yet. Blobs are copied instead wherever they can't be linked, such as across filesystems.
+func linkBlobs(ctx context.Context, store string, p layout.Path, img v1.Image) error {
+	l := zerolog.Ctx(ctx)
+
+	type blob struct {
+		hash v1.Hash
+		open func() (io.ReadCloser, error)
+	}
+
+	md, err := img.Digest()
+	if err != nil {
+		return err
+	}
+
+	cd, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+
+	blobs := []blob{
+		{hash: md, open: func() (io.ReadCloser, error) {
+			raw, err := img.RawManifest()
+			return io.NopCloser(bytes.NewReader(raw)), err
+		}},
+		{hash: cd, open: func() (io.ReadCloser, error) {
+			raw, err := img.RawConfigFile()
+			return io.NopCloser(bytes.NewReader(raw)), err
+		}},
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		d, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, blob{hash: d, open: layer.Compressed})
+	}
+
+	for _, b := range blobs {
+		src, err := storeBlob(store, b.hash, b.open)
+		if err != nil {
+			return fmt.Errorf("storing %s: %v", b.hash, err)
+		}
+
+		dir := filepath.Join(string(p), "blobs", b.hash.Algorithm)
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+
+		dst := filepath.Join(dir, b.hash.Hex)
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+
+		if err := os.Link(src, dst); err != nil {
+			l.Debug().Msgf("copying %s, it can't be linked: %v", b.hash, err)
+			if err := copyFile(src, dst); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// storeBlob writes the blob h to store unless it's already there, verifying its digest, and returns its path
+func storeBlob(store string, h v1.Hash, open func() (io.ReadCloser, error)) (string, error) {
+	dir := filepath.Join(store, h.Algorithm)
+	path := filepath.Join(dir, h.Hex)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	rc, err := open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	// Written aside and renamed into place, so an interrupted export never leaves a partial blob in the store
+	tmp, err := os.CreateTemp(dir, h.Hex+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	got, _, err := v1.SHA256(io.TeeReader(rc, tmp))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if got != h {
+		return "", fmt.Errorf("expected digest %s, got %s", h, got)
+	}
+
+	return path, os.Rename(tmp.Name(), path)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/joshrwolf/ripfs/internal/platform"
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+type inspectCommandOpts struct {
+	apiOpts
+
+	Output   string
+	Platform string
+}
+
+func newInspectCommand() *cobra.Command {
+	o := &inspectCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "inspect",
+		Short: "Show the metadata of an image stored in the registry",
+		Long: `Show the metadata of an image stored in the registry, without pulling it.
+
+The image may be given as a mapped reference (alpine:latest), a root cid, or an ipfs/<cid> reference. The image of a
+multi-platform root is the one for --platform, the host's linux platform by default.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Run(cmd.Context(), args[0])
+		},
+	}
+
+	o.apiOpts.Flags(cmd)
+
+	f := cmd.Flags()
+	f.StringVarP(&o.Output, "output", "o", "text",
+		"Output format (text, json).")
+	f.StringVar(&o.Platform, "platform", "",
+		"Platform (os/arch[/variant]) of the image to inspect within a multi-platform root (defaults to the host's linux platform).")
+
+	return cmd
+}
+
+func (o *inspectCommandOpts) Run(ctx context.Context, reference string) error {
+	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+	ctx = l.WithContext(ctx)
+
+	if o.Output != "text" && o.Output != "json" {
+		return fmt.Errorf("unknown output format %s", o.Output)
+	}
+
+	want := platform.Host()
+	if o.Platform != "" {
+		var err error
+		if want, err = platform.Parse(o.Platform); err != nil {
+			return err
+		}
+	}
+
+	kcfg := ctrl.GetConfigOrDie()
+
+	client, closer, err := o.connect(ctx, kcfg)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	root, err := resolveRoot(ctx, client, kcfg, o.Namespace, reference)
+	if err != nil {
+		return err
+	}
+
+	info, err := registry.Inspect(ctx, client, root, want)
+	if err != nil {
+		return fmt.Errorf("inspecting %s: %v", root, err)
+	}
+
+	if o.Output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+
+	printImageInfo(os.Stdout, info)
+	return nil
+}
+
+// resolveRoot resolves a root cid, an ipfs/<cid> reference, or a reference mapped by the mapper secret in namespace to
+// the image's root cid
+func resolveRoot(ctx context.Context, api iface.CoreAPI, kcfg *rest.Config, namespace string, reference string) (cid.Cid, error) {
+	if c, err := cid.Decode(strings.TrimPrefix(reference, "/ipfs/")); err == nil {
+		return c, nil
+	}
+
+	ref, err := name.ParseReference(reference)
+	if err != nil {
+		return cid.Cid{}, fmt.Errorf("%w: %v", registry.ErrInvalidReference, err)
+	}
+
+	if repo := ref.Context().RepositoryStr(); strings.HasPrefix(repo, "ipfs/") {
+		if c, err := cid.Decode(strings.TrimPrefix(repo, "ipfs/")); err == nil {
+			return c, nil
+		}
+	}
+
+	_, cidMap, err := readCidMap(ctx, api, kcfg, namespace)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+
+	p, ok := cidMap[ref.Name()]
+	if !ok {
+		return cid.Cid{}, fmt.Errorf("%w: %s has not been added to the registry", registry.ErrNotFound, ref.Name())
+	}
+	return cid.Decode(strings.TrimPrefix(p, "/ipfs/"))
+}
+
+func printImageInfo(w io.Writer, info *registry.ImageInfo) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Root:\t%s\n", info.Root)
+	fmt.Fprintf(tw, "Digest:\t%s\n", info.Digest)
+	fmt.Fprintf(tw, "Platform:\t%s/%s\n", info.OS, info.Architecture)
+	if !info.Created.IsZero() {
+		fmt.Fprintf(tw, "Created:\t%s\n", info.Created)
+	}
+	fmt.Fprintf(tw, "Entrypoint:\t%s\n", strings.Join(info.Entrypoint, " "))
+	fmt.Fprintf(tw, "Cmd:\t%s\n", strings.Join(info.Cmd, " "))
+	if info.WorkingDir != "" {
+		fmt.Fprintf(tw, "WorkingDir:\t%s\n", info.WorkingDir)
+	}
+	if info.User != "" {
+		fmt.Fprintf(tw, "User:\t%s\n", info.User)
+	}
+	if len(info.ExposedPorts) > 0 {
+		fmt.Fprintf(tw, "ExposedPorts:\t%s\n", strings.Join(info.ExposedPorts, ", "))
+	}
+	for _, e := range info.Env {
+		fmt.Fprintf(tw, "Env:\t%s\n", e)
+	}
+	for k, v := range info.Labels {
+		fmt.Fprintf(tw, "Label:\t%s=%s\n", k, v)
+	}
+	fmt.Fprintf(tw, "Size:\t%d\n", info.Size)
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tFORMAT\tSIZE\tCID")
+	for _, layer := range info.Layers {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", layer.Digest, layer.Format, layer.Size, layer.Cid)
+	}
+	tw.Flush()
+
+	if len(info.History) > 0 {
+		fmt.Fprintln(w)
+		tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CREATED\tCREATED BY")
+		for _, h := range info.History {
+			fmt.Fprintf(tw, "%s\t%s\n", h.Created.Format("2006-01-02 15:04:05"), h.CreatedBy)
+		}
+		tw.Flush()
+	}
+}
@@ -7,22 +7,31 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/fluxcd/pkg/ssa"
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/layout"
-	"github.com/google/go-containerregistry/pkg/v1/types"
+	iface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/mholt/archiver/v4"
+	"github.com/multiformats/go-multiaddr"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/joshrwolf/ripfs/config"
 	"github.com/joshrwolf/ripfs/internal/consts"
 	"github.com/joshrwolf/ripfs/internal/k8s"
 	"github.com/joshrwolf/ripfs/internal/k8s/offline"
 	"github.com/joshrwolf/ripfs/internal/manifests"
+	"github.com/joshrwolf/ripfs/internal/registry"
+	"github.com/joshrwolf/ripfs/internal/verify"
+	"github.com/joshrwolf/ripfs/internal/webhook"
 )
 
 type installCommandOpts struct {
@@ -30,6 +39,18 @@ type installCommandOpts struct {
 	Namespace string
 	Timeout   time.Duration
 	Export    bool
+
+	Join         []string
+	SwarmKeyFile string
+
+	WebhookDNSNames    []string
+	WebhookOptIn       bool
+	ExternalWebhookURL string
+
+	NodeLocalPort       int32
+	ConfigureContainerd bool
+	VerifyMappings      bool
+	ProvenanceKeys      []string
 }
 
 func newInstallCommand() *cobra.Command {
@@ -46,13 +67,31 @@ func newInstallCommand() *cobra.Command {
 	f := cmd.Flags()
 
 	f.StringVar(&o.Offline, "offline", "",
-		"Performs an offline installation with the specified payload.")
+		"Performs an offline installation with the specified payload, or the join manifest (<payload>.volumes.json) of a split one.")
 	f.StringVar(&o.Namespace, "namespace", "ripfs-system",
 		"The installation namespace.")
 	f.DurationVarP(&o.Timeout, "timeout", "t", 1*time.Minute,
 		"Timeout duration for the install.")
 	f.BoolVar(&o.Export, "export", false,
 		"When enabled, manifests will be written to stdout and not applied to the cluster.")
+	f.StringSliceVar(&o.Join, "join", nil,
+		"Multiaddr(s) of peers in an existing swarm (such as a central depot) to join, inheriting its content.")
+	f.StringVar(&o.SwarmKeyFile, "swarm-key-file", "",
+		"Path to the swarm key of the swarm being joined (required with --join).")
+	f.StringSliceVar(&o.WebhookDNSNames, "webhook-dns-names", nil,
+		"Additional dns names (or ips) the webhook's serving certificate is issued for, beyond the manager's service.")
+	f.BoolVar(&o.WebhookOptIn, "webhook-opt-in", false,
+		"Only rewrite the images of pods in namespaces labeled ripfs.dev/rewrite=true, or of pods labeled so themselves, rather than every pod of the cluster.")
+	f.StringVar(&o.ExternalWebhookURL, "external-webhook-url", "",
+		"Register the webhook at this https url rather than at the manager's service, such as when it's fronted by something else or the manager runs outside the cluster. Its host is added to the certificate.")
+	f.Int32Var(&o.NodeLocalPort, "node-local-port", 0,
+		"Serve the registry on this port of every node's localhost (a host port of its agent), and rewrite images to localhost:<port> so pulls never leave the node (0 rewrites them to the registry's node port instead).")
+	f.BoolVar(&o.ConfigureContainerd, "configure-containerd", false,
+		"Configure every node's containerd to pull through its agent as a registry mirror (ripfs configure-node), from an init container of the agents.")
+	f.BoolVar(&o.VerifyMappings, "verify-mappings", false,
+		"Only rewrite (and serve by name) images whose mapping is signed by a key of the "+consts.MappingKeysConfigMapName+" config map, such as the cluster's own mapping key.")
+	f.StringSliceVar(&o.ProvenanceKeys, "provenance-key", nil,
+		"Path(s) to the public keys (such as cosign.pub) a validating webhook verifies the stored signatures of every pod's images with, denying pods whose images aren't signed by one of them.")
 
 	return cmd
 }
@@ -65,32 +104,93 @@ func (o *installCommandOpts) Run(ctx context.Context) error {
 
 	mopts := manifests.DefaultOpts()
 
-	if o.Offline != "" {
-		// hoh boy... hold on to your seats
-		pl, teardown, err := o.prepPayload(ctx)
+	if len(o.Join) > 0 {
+		key, err := o.joinOpts()
 		if err != nil {
 			return err
 		}
-		defer teardown()
 
-		// TODO: This is cheating
-		rimgs, err := o.getImage(pl.(*offline.LayoutPayload).Path)
+		l.Info().Msgf("joining existing swarm through %s", strings.Join(o.Join, ", "))
+		mopts.JoinPeers = o.Join
+		mopts.SwarmKey = key
+	}
+
+	if o.NodeLocalPort < 0 || o.NodeLocalPort > 65535 {
+		return fmt.Errorf("invalid node local port %d", o.NodeLocalPort)
+	}
+	mopts.NodeLocalPort = o.NodeLocalPort
+	mopts.ContainerdMirror = o.ConfigureContainerd
+	mopts.VerifyMappings = o.VerifyMappings
+
+	mopts.WebhookDNSNames = o.WebhookDNSNames
+	mopts.WebhookOptIn = o.WebhookOptIn
+	if o.ExternalWebhookURL != "" {
+		u, err := webhook.ParseExternalURL(o.ExternalWebhookURL)
 		if err != nil {
-			return fmt.Errorf("loading image: %v", err)
+			return err
+		}
+
+		mopts.WebhookURL = strings.TrimSuffix(u.String(), "/") + webhook.DefaultPath
+		mopts.WebhookDNSNames = append(mopts.WebhookDNSNames, u.Hostname())
+		if len(o.ProvenanceKeys) > 0 {
+			mopts.ProvenanceURL = strings.TrimSuffix(u.String(), "/") + webhook.ValidatePath
 		}
+	}
+
+	if len(o.ProvenanceKeys) > 0 {
+		mopts.ProvenanceKeys = make(map[string][]byte, len(o.ProvenanceKeys))
+		for _, p := range o.ProvenanceKeys {
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return fmt.Errorf("reading provenance key: %v", err)
+			}
+			if _, err := verify.ParsePublicKey(data); err != nil {
+				return fmt.Errorf("invalid provenance key %s: %v", p, err)
+			}
+			mopts.ProvenanceKeys[filepath.Base(p)] = data
+		}
+	}
+
+	var (
+		pl     offline.Payload
+		mu     sync.Mutex
+		seeded v1.Platform
+	)
+	if o.Offline != "" {
+		// hoh boy... hold on to your seats
+		var (
+			teardown func() error
+			err      error
+		)
+		pl, teardown, err = o.prepPayload(ctx)
+		if err != nil {
+			return err
+		}
+		defer teardown()
 
 		s := offline.NewSeeder(kcfg, pl)
-		mi, err := s.Seed(ctx, nil, rimgs)
+		mi, err := s.Seed(ctx, nil, func(p v1.Platform) (map[string]v1.Image, error) {
+			img, err := pl.Image(p)
+			if err != nil {
+				return nil, fmt.Errorf("loading image: %v", err)
+			}
+
+			// Only single platform clusters can be seeded, so every node agrees
+			mu.Lock()
+			seeded = p
+			mu.Unlock()
+			return map[string]v1.Image{consts.ManagerImageReference: img}, nil
+		})
 		if err != nil {
 			return err
 		}
 
-		if len(mi) != 1 {
+		if _, ok := mi[consts.ManagerImageReference]; !ok || len(mi) != 1 {
 			return fmt.Errorf("expecting 1 image to be seeded, got %d", len(mi))
 		}
 
 		l.Info().Msgf("successfully seeded ripfs image(s) to target cluster")
-		mopts.ManagerImage = mi[0]
+		mopts.ManagerImage = mi[consts.ManagerImageReference]
 	}
 
 	gen := manifests.NewGenerator(mopts)
@@ -110,36 +210,172 @@ func (o *installCommandOpts) Run(ctx context.Context) error {
 		return err
 	}
 
-	a, err := k8s.NewApplier(kcfg)
+	a, err := k8s.NewApplier(kcfg, k8s.WithTimeout(o.Timeout), k8s.WithProgress(func(s k8s.ObjectStatus) {
+		l.Info().Msgf("%s: %s %s", s.Object, s.Status, s.Message)
+	}))
+	if err != nil {
+		return err
+	}
+
+	kc, err := client.New(kcfg, client.Options{})
 	if err != nil {
 		return err
 	}
+	if err := clearReleased(ctx, kc, o.Namespace); err != nil {
+		return err
+	}
 
 	l.Info().Msgf("applying ripfs components to cluster")
 	cs, err := a.Apply(ctx, objs)
 	if err != nil {
 		return err
 	}
-	_ = cs
+
+	for _, e := range cs.Entries {
+		l.Info().Msgf("%s %s", e.Subject, e.Action)
+	}
+
+	if pl != nil {
+		if err := o.addSelf(ctx, kcfg, pl, seeded); err != nil {
+			return fmt.Errorf("adding ripfs's own images: %v", err)
+		}
+	}
 
 	l.Info().Msgf("successfully installed ripfs!")
 
 	return nil
 }
 
+// addSelf adds the payload's manager and busybox images to the installed cluster once its manager is up, mapping them
+// so they're never evicted. ripfs can then always be restarted without the seed registries, or anything upstream.
+func (o *installCommandOpts) addSelf(ctx context.Context, kcfg *rest.Config, pl offline.Payload, p v1.Platform) error {
+	l := zerolog.Ctx(ctx)
+
+	mgr, err := pl.Image(p)
+	if err != nil {
+		return err
+	}
+
+	bb, err := offline.BusyboxImage(pl, p)
+	if err != nil {
+		return err
+	}
+
+	api := &apiOpts{
+		IPFSApiAddress: "/ip4/127.0.0.1/tcp/5001",
+		Name:           consts.BootstrapServiceName,
+		Namespace:      o.Namespace,
+		Container:      "manager",
+	}
+
+	var (
+		client iface.CoreAPI
+		closer func()
+	)
+	l.Info().Msgf("waiting for the manager to publish its mappings")
+	if err := wait.PollImmediate(5*time.Second, o.Timeout, func() (bool, error) {
+		c, cl, err := api.connect(ctx, kcfg)
+		if err != nil {
+			l.Debug().Msgf("connecting to manager: %v", err)
+			return false, nil
+		}
+
+		if _, _, err := readCidMap(ctx, c, kcfg, o.Namespace); err != nil {
+			l.Debug().Msgf("reading mappings: %v", err)
+			cl()
+			return false, nil
+		}
+
+		client, closer = c, cl
+		return true, nil
+	}); err != nil {
+		return fmt.Errorf("waiting for the manager: %v", err)
+	}
+	defer closer()
+
+	set := make(map[string]string)
+	for reference, img := range map[string]v1.Image{
+		consts.ManagerImageReference: mgr,
+		consts.BusyboxImageReference: bb,
+	} {
+		ref, err := name.ParseReference(reference)
+		if err != nil {
+			return err
+		}
+
+		rp, err := registry.AddImage(ctx, client, img, nil)
+		if err != nil {
+			return fmt.Errorf("adding %s: %v", reference, err)
+		}
+		set[ref.Name()] = rp.String()
+	}
+
+	if _, _, err := updateCidMap(ctx, client, kcfg, o.Namespace, "", set); err != nil {
+		return err
+	}
+
+	l.Info().Msgf("mapped ripfs's own images, which are never evicted")
+	return nil
+}
+
+// joinOpts validates the peers being joined, and returns the swarm key they're joined with
+func (o *installCommandOpts) joinOpts() ([]byte, error) {
+	for _, j := range o.Join {
+		ma, err := multiaddr.NewMultiaddr(j)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer %s: %v", j, err)
+		}
+
+		if _, err := ma.ValueForProtocol(multiaddr.P_P2P); err != nil {
+			return nil, fmt.Errorf("peer %s is missing its /p2p/<id>", j)
+		}
+	}
+
+	if o.SwarmKeyFile == "" {
+		return nil, fmt.Errorf("--swarm-key-file is required to join an existing swarm")
+	}
+
+	key, err := os.ReadFile(o.SwarmKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(key, []byte("/key/swarm/psk/1.0.0/")) {
+		return nil, fmt.Errorf("%s isn't a swarm key", o.SwarmKeyFile)
+	}
+	return key, nil
+}
+
+// openPayload opens the payload at p, which is either an archive or the join manifest of a split one
+func openPayload(p string) (string, io.ReadCloser, error) {
+	if strings.HasSuffix(p, offline.VolumesSuffix) {
+		vr, err := offline.OpenVolumes(p)
+		if err != nil {
+			return "", nil, err
+		}
+		return vr.Name(), vr, nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return "", nil, err
+	}
+	return p, f, nil
+}
+
 func (o *installCommandOpts) prepPayload(ctx context.Context) (offline.Payload, func() error, error) {
 	tmp, err := os.MkdirTemp("", consts.Name)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	af, err := os.Open(o.Offline)
+	name, af, err := openPayload(o.Offline)
 	if err != nil {
 		return nil, nil, err
 	}
 	defer af.Close()
 
-	format, input, err := archiver.Identify(o.Offline, af)
+	format, input, err := archiver.Identify(name, af)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -176,6 +412,11 @@ func (o *installCommandOpts) prepPayload(ctx context.Context) (offline.Payload,
 		}
 	}
 
+	// Archives aren't necessarily read to their end, but split payloads are only verified once they are
+	if _, err := io.Copy(io.Discard, input); err != nil {
+		return nil, nil, err
+	}
+
 	lp, err := offline.NewLayoutPayload(filepath.Join(tmp, "payload/oci"))
 	if err != nil {
 		return nil, nil, err
@@ -187,52 +428,3 @@ func (o *installCommandOpts) prepPayload(ctx context.Context) (offline.Payload,
 
 	return lp, teardown, nil
 }
-
-func (o *installCommandOpts) getImage(path string) (v1.Image, error) {
-	// TODO: This is cheating
-	l, err := layout.FromPath(path)
-	if err != nil {
-		return nil, err
-	}
-
-	p := v1.Platform{OS: "linux", Architecture: "amd64"}
-
-	idx, err := l.ImageIndex()
-	if err != nil {
-		return nil, err
-	}
-
-	idxm, err := idx.IndexManifest()
-	if err != nil {
-		return nil, err
-	}
-
-	// TODO: A better human than me would use recursion
-	var img v1.Image
-	for _, m := range idxm.Manifests {
-		switch m.MediaType {
-		case types.DockerManifestList, types.OCIImageIndex:
-			idx, err := idx.ImageIndex(m.Digest)
-			if err != nil {
-				return nil, err
-			}
-
-			idxm, err := idx.IndexManifest()
-			if err != nil {
-				return nil, err
-			}
-
-			for _, m := range idxm.Manifests {
-				if m.Platform.Equals(p) {
-					img, err = idx.Image(m.Digest)
-					break
-				}
-			}
-		}
-	}
-
-	if img == nil {
-		return nil, fmt.Errorf("couldn't find image")
-	}
-	return img, nil
-}
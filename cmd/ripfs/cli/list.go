@@ -0,0 +1,219 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	iopts "github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+type listCommandOpts struct {
+	apiOpts
+
+	Output          string
+	Providers       bool
+	ProviderTimeout time.Duration
+	Concurrency     int
+}
+
+func newListCommand() *cobra.Command {
+	o := &listCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List the images stored in the registry",
+		Long: `List every mapped image stored in the registry, along with its root cid, size and whether it's pinned.
+
+With --providers, the peers currently providing each image's root are looked up too, which can be slow on a large
+swarm.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Run(cmd.Context())
+		},
+	}
+
+	o.apiOpts.Flags(cmd)
+
+	f := cmd.Flags()
+	f.StringVarP(&o.Output, "output", "o", "text",
+		"Output format (text, json).")
+	f.BoolVar(&o.Providers, "providers", false,
+		"Look up the peers currently providing each image.")
+	f.DurationVar(&o.ProviderTimeout, "provider-timeout", 10*time.Second,
+		"How long to look for the providers of each image.")
+	f.IntVar(&o.Concurrency, "concurrency", 8,
+		"Number of images to look up at once.")
+
+	return cmd
+}
+
+// listedImage is a single mapped image
+type listedImage struct {
+	Reference string   `json:"reference"`
+	Root      string   `json:"root"`
+	Size      int64    `json:"size"`
+	Pinned    string   `json:"pinned"`
+	Providers []string `json:"providers,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+func (o *listCommandOpts) Run(ctx context.Context) error {
+	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+	ctx = l.WithContext(ctx)
+
+	if o.Output != "text" && o.Output != "json" {
+		return fmt.Errorf("unknown output format %s", o.Output)
+	}
+
+	if o.Concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+
+	kcfg := ctrl.GetConfigOrDie()
+
+	client, closer, err := o.connect(ctx, kcfg)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	_, cidMap, err := readCidMap(ctx, client, kcfg, o.Namespace)
+	if err != nil {
+		return fmt.Errorf("reading mappings: %v", err)
+	}
+
+	images := make([]*listedImage, 0, len(cidMap))
+	for ref, p := range cidMap {
+		images = append(images, &listedImage{Reference: ref, Root: strings.TrimPrefix(p, "/ipfs/")})
+	}
+	sort.Slice(images, func(a, b int) bool { return images[a].Reference < images[b].Reference })
+
+	var (
+		wg   sync.WaitGroup
+		imgc = make(chan *listedImage)
+	)
+	for w := 0; w < o.Concurrency && w < len(images); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for img := range imgc {
+				// Images that can't be read are still listed, the mapping itself is what's broken
+				if err := o.describe(ctx, client, img); err != nil {
+					img.Error = err.Error()
+				}
+			}
+		}()
+	}
+
+	for _, img := range images {
+		imgc <- img
+	}
+	close(imgc)
+	wg.Wait()
+
+	if o.Output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(images)
+	}
+
+	printImages(os.Stdout, images, o.Providers)
+	return nil
+}
+
+// describe fills in the size, pin status and (optionally) providers of img
+func (o *listCommandOpts) describe(ctx context.Context, api iface.CoreAPI, img *listedImage) error {
+	root, err := cid.Decode(img.Root)
+	if err != nil {
+		return fmt.Errorf("invalid root: %v", err)
+	}
+
+	if img.Size, err = registry.ImageSize(ctx, api, root); err != nil {
+		return err
+	}
+
+	refs, err := registry.References(ctx, api, root)
+	if err != nil {
+		return err
+	}
+
+	pinned := 0
+	for _, c := range refs {
+		_, ok, err := api.Pin().IsPinned(ctx, path.IpfsPath(c), iopts.Pin.IsPinned.Recursive())
+		if err != nil {
+			return err
+		}
+		if ok {
+			pinned++
+		}
+	}
+
+	switch pinned {
+	case len(refs):
+		img.Pinned = "pinned"
+	case 0:
+		img.Pinned = "unpinned"
+	default:
+		img.Pinned = "partial"
+	}
+
+	if !o.Providers {
+		return nil
+	}
+
+	fctx, cancel := context.WithTimeout(ctx, o.ProviderTimeout)
+	defer cancel()
+
+	provs, err := api.Dht().FindProviders(fctx, path.IpfsPath(root))
+	if err != nil {
+		return err
+	}
+
+	for prov := range provs {
+		img.Providers = append(img.Providers, prov.ID.String())
+	}
+	sort.Strings(img.Providers)
+	return nil
+}
+
+func printImages(w io.Writer, images []*listedImage, providers bool) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	if providers {
+		fmt.Fprintln(tw, "REFERENCE\tROOT\tSIZE\tPINNED\tPROVIDERS")
+	} else {
+		fmt.Fprintln(tw, "REFERENCE\tROOT\tSIZE\tPINNED")
+	}
+
+	for _, img := range images {
+		size, pinned := fmt.Sprint(img.Size), img.Pinned
+		if img.Error != "" {
+			size, pinned = "-", "error: "+img.Error
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s", img.Reference, img.Root, size, pinned)
+		if providers {
+			fmt.Fprintf(tw, "\t%s", strings.Join(img.Providers, ","))
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/joshrwolf/ripfs/internal/metrics"
+)
+
+type observabilityExportCommandOpts struct {
+	Format string
+	Output string
+}
+
+func newObservabilityCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "observability",
+		Short: "Generate monitoring for the metrics ripfs exposes",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+
+	cmd.AddCommand(
+		newObservabilityExportCommand(),
+	)
+
+	return cmd
+}
+
+func newObservabilityExportCommand() *cobra.Command {
+	o := &observabilityExportCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export a grafana dashboard, or prometheus alerting rules, for the metrics ripfs exposes",
+		Long: `Export a grafana dashboard, or prometheus alerting rules, for the metrics the manager and agents expose:
+swarm peers, repo usage, how long ago the mappings published to ipns were resolved, and the webhook's error rate.
+Both are generated from the same definitions the metrics are registered with, so they match the binary exporting them.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Run()
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVar(&o.Format, "format", "grafana",
+		"Format to export (grafana, prometheus-rules).")
+	f.StringVarP(&o.Output, "output", "o", "",
+		"File to write to, rather than stdout.")
+
+	return cmd
+}
+
+func (o *observabilityExportCommandOpts) Run() error {
+	if err := metrics.Check(); err != nil {
+		return err
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	switch o.Format {
+	case "grafana":
+		data, err = metrics.Dashboard()
+	case "prometheus-rules":
+		data, err = metrics.Rules()
+	default:
+		return fmt.Errorf("unknown format %s", o.Format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if o.Output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(o.Output, data, 0644)
+}
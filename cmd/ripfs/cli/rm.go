@@ -0,0 +1,174 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/ipfs/go-cid"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+type rmCommandOpts struct {
+	apiOpts
+
+	GC bool
+}
+
+func newRmCommand() *cobra.Command {
+	o := &rmCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "rm",
+		Short: "Remove an image from the registry, reclaiming its space",
+		Long: `Remove an image from the registry, reclaiming its space.
+
+The image may be given as a mapped reference (alpine:latest), a root cid, or an ipfs/<cid> reference. A reference
+only removes its own mapping, while a cid removes every mapping to it. The image is then unpinned (keeping anything
+still referenced by another mapped image, a node's assigned or drained images, or a content profile) and the ipfs
+repo garbage collected.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Run(cmd.Context(), args[0])
+		},
+	}
+
+	o.apiOpts.Flags(cmd)
+
+	f := cmd.Flags()
+	f.BoolVar(&o.GC, "gc", true,
+		"Garbage collect the ipfs repo once the image is unpinned.")
+
+	return cmd
+}
+
+func (o *rmCommandOpts) Run(ctx context.Context, reference string) error {
+	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+	ctx = l.WithContext(ctx)
+
+	kcfg := ctrl.GetConfigOrDie()
+
+	client, closer, err := o.connect(ctx, kcfg)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	root, err := resolveRoot(ctx, client, kcfg, o.Namespace, reference)
+	if err != nil {
+		return err
+	}
+
+	var (
+		removed []string
+		keep    []cid.Cid
+		still   []string
+	)
+	ap, _, err := commitCidMap(ctx, client, kcfg, o.Namespace, "", func(cidMap map[string]string) (registry.MappingDelta, error) {
+		removed, keep, still = nil, nil, nil
+
+		// A mapped reference only removes itself, anything else removes every reference to the root
+		only := ""
+		if ref, err := name.ParseReference(reference); err == nil {
+			if _, ok := cidMap[ref.Name()]; ok {
+				only = ref.Name()
+			}
+		}
+
+		for ref, v := range cidMap {
+			c, err := cid.Decode(strings.TrimPrefix(v, "/ipfs/"))
+			if err != nil {
+				return registry.MappingDelta{}, fmt.Errorf("invalid mapping for %s: %v", ref, err)
+			}
+
+			if c == root && (only == "" || only == ref) {
+				removed = append(removed, ref)
+				continue
+			}
+
+			if c == root {
+				still = append(still, ref)
+				continue
+			}
+			keep = append(keep, c)
+		}
+		sort.Strings(removed)
+
+		for _, ref := range removed {
+			delete(cidMap, ref)
+		}
+		return registry.MappingDelta{Removed: removed}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("publishing mappings: %v", err)
+	}
+
+	if len(removed) > 0 {
+		l.Info().Msgf("removed mappings [%s] => [%s]", strings.Join(removed, ", "), ap.String())
+
+		// Their replication policies go too, rather than applying again whenever they're added anew
+		err = updateReplicationPolicies(ctx, kcfg, o.Namespace, func(policies registry.ReplicationPolicies) bool {
+			n := len(policies)
+			for _, ref := range removed {
+				delete(policies, ref)
+			}
+			return len(policies) != n
+		})
+		if err != nil {
+			return fmt.Errorf("removing replication policies: %v", err)
+		}
+	}
+
+	if len(still) > 0 {
+		sort.Strings(still)
+		l.Info().Msgf("[%s] is still mapped by [%s], keeping its content", root, strings.Join(still, ", "))
+		return nil
+	}
+
+	// Roots still assigned to nodes, held for drained ones or prefetched by content profiles stay pinned too
+	pinned, err := pinnedRoots(ctx, kcfg, o.Namespace)
+	if err != nil {
+		return fmt.Errorf("listing pinned roots: %v", err)
+	}
+
+	for _, p := range pinned {
+		if p == root {
+			l.Info().Msgf("[%s] is still pinned by a node or content profile, keeping its content", root)
+			return nil
+		}
+		keep = append(keep, p)
+	}
+
+	unpinned, err := registry.Remove(ctx, client, root, keep)
+	if err != nil {
+		return fmt.Errorf("removing %s: %v", root, err)
+	}
+	l.Info().Msgf("unpinned %d objects of [%s]", len(unpinned), root)
+
+	if !o.GC {
+		return nil
+	}
+
+	l.Info().Msgf("collecting ipfs repo")
+	if err := registry.RepoGC(ctx, client); err != nil {
+		return fmt.Errorf("collecting repo: %v", err)
+	}
+	return nil
+}
+
+// pinnedRoots returns the roots the cluster holds pinned besides its mappings
+func pinnedRoots(ctx context.Context, kcfg *rest.Config, namespace string) ([]cid.Cid, error) {
+	c, err := client.New(kcfg, client.Options{})
+	if err != nil {
+		return nil, err
+	}
+	return registry.PinnedRoots(ctx, c, namespace)
+}
@@ -2,31 +2,110 @@ package cli
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/hashicorp/go-multierror"
+	"github.com/ipfs/go-cid"
+	config "github.com/ipfs/go-ipfs-config"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
 	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
+	"github.com/joshrwolf/ripfs/api/v1alpha1"
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/failover"
+	"github.com/joshrwolf/ripfs/internal/faults"
+	"github.com/joshrwolf/ripfs/internal/ipfs"
+	"github.com/joshrwolf/ripfs/internal/metrics"
 	"github.com/joshrwolf/ripfs/internal/registry"
 )
 
 type serveCommandOpts struct {
-	ipfsOpts *ipfsSharedOpts
+	ipfsOpts ipfsSharedOpts
 
 	Address    string
 	Standalone bool
+	IndexDir   string
+	IndexCache int
+	MapIpnsCid string
+	MapFile    string
+	MapImages  string
+
+	VerifyMappings bool
+
+	MapperCacheTTL   time.Duration
+	MapperCacheStale time.Duration
+	MapperPubsub     bool
+
+	VirtualHostsConfig string
+	RecordRequests     int
+	AllowPush          bool
+	AllowDelete        bool
+	Gateway            bool
+
+	MaxManifestSize   int64
+	MaxUploadSize     int64
+	UploadTTL         time.Duration
+	MaxUploads        int
+	MaxHeaderBytes    int
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+
+	Htpasswd     string
+	TokenRealm   string
+	TokenService string
+	TokenIssuer  string
+	TokenCerts   string
+
+	TLSCert   string
+	TLSKey    string
+	TLSSecret string
+
+	FaultInjection bool
+
+	ReadApiAddresses   []string
+	ReadHealthInterval time.Duration
+
+	ContentProfiles   string
+	ContentProfile    string
+	NodeName          string
+	PrefetchBandwidth string
+
+	PinAssignedInterval time.Duration
+
+	MetricsAddress string
 }
 
 func newServeCommand() *cobra.Command {
-	o := &serveCommandOpts{ipfsOpts: &ipfsOpts}
+	o := &serveCommandOpts{}
 
 	cmd := &cobra.Command{
 		Use:   "serve",
 		Short: "Start the ripfs registry server",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := o.applyProfile(cmd); err != nil {
+				return err
+			}
 			return o.Run(cmd.Context())
 		},
 	}
@@ -36,30 +115,191 @@ func newServeCommand() *cobra.Command {
 		"Address to serve on.")
 	f.BoolVar(&o.Standalone, "standalone", false,
 		"Toggle standalone mode (not part of a swarm), useful for localized deployments.")
+	f.StringVar(&o.IndexDir, "index-dir", "",
+		"Directory to persist the digest to cid index in (defaults to a directory within the ipfs repo).")
+	f.IntVar(&o.IndexCache, "index-cache-size", registry.DefaultIndexCacheSize,
+		"Number of images whose digest to cid index is kept in memory (negative disables).")
+	f.StringVar(&o.MapIpnsCid, "map-ipns-cid", "",
+		"IPNS name of the reference to cid mappings, used to list served repositories and tags.")
+	f.StringVar(&o.MapFile, "map-file", "",
+		"Path to a json file of reference to cid mappings to serve by name instead of --map-ipns-cid, re-read whenever it changes.")
+	f.StringVar(&o.MapImages, "map-images", "",
+		"Namespace of the cluster's Image resources to serve by name instead of --map-ipns-cid, resolved from a cache kept in sync with them.")
+	f.BoolVar(&o.VerifyMappings, "verify-mappings", false,
+		"Only serve the Images (of --map-images) whose mapping is signed by a key of the "+consts.MappingKeysConfigMapName+" config map.")
+	f.DurationVar(&o.MapperCacheTTL, "mapper-cache-ttl", time.Minute,
+		"How long to cache mappings for (or with --mapper-pubsub, how often the local copy is refreshed), updates announced over pubsub apply sooner.")
+	f.DurationVar(&o.MapperCacheStale, "mapper-cache-stale", 5*time.Minute,
+		"How long past --mapper-cache-ttl cached mappings are still served while they're refreshed in the background (0 waits on the refresh). The Images of --map-images are always current, only the keys verifying them are refreshed this way.")
+	f.BoolVar(&o.MapperPubsub, "mapper-pubsub", false,
+		"Keep a local copy of the mappings, updated with the deltas announced over pubsub, rather than caching them. With --map-images, the deltas apply ahead of the Images' cache.")
+	f.StringVar(&o.VirtualHostsConfig, "virtual-hosts-config", "",
+		"Path to a config file describing additional registries to serve by host or path prefix.")
+	f.IntVar(&o.RecordRequests, "record-requests", 0,
+		"Number of recent registry requests to keep for debugging, served at /_ripfs/debug/requests (0 disables).")
+	f.BoolVar(&o.AllowPush, "allow-push", false,
+		"Accept image pushes, pushed images are served by the root cid returned in the Ripfs-Root-Cid header.")
+	f.BoolVar(&o.AllowDelete, "allow-delete", false,
+		"Accept deletes of unmapped images by their root manifest digest, mapped images are removed with ripfs rm.")
+	f.BoolVar(&o.Gateway, "gateway", false,
+		"Serve the raw content of pinned cids at /ipfs/<cid>, a read only gateway for tooling that reads content by cid.")
+
+	f.Int64Var(&o.MaxManifestSize, "max-manifest-size", registry.DefaultMaxManifestSize,
+		"Largest manifest (or config) in bytes read into memory, whether pushed or served.")
+	f.Int64Var(&o.MaxUploadSize, "max-upload-size", 0,
+		"Largest blob in bytes accepted by a push (0 is unlimited).")
+	f.DurationVar(&o.UploadTTL, "upload-ttl", registry.DefaultUploadTTL,
+		"How long a blob upload may go without a request before it's abandoned and its buffer removed.")
+	f.IntVar(&o.MaxUploads, "max-uploads", registry.DefaultMaxUploads,
+		"Number of blob uploads in progress at once, further ones are refused until they complete or expire.")
+	f.IntVar(&o.MaxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes,
+		"Largest request headers in bytes accepted.")
+	f.DurationVar(&o.ReadHeaderTimeout, "read-header-timeout", 10*time.Second,
+		"How long clients have to send a request's headers, so slow clients can't hold connections open.")
+	f.DurationVar(&o.IdleTimeout, "idle-timeout", 2*time.Minute,
+		"How long idle keep-alive connections are kept open for.")
+
+	f.StringVar(&o.Htpasswd, "htpasswd", "",
+		"Path to an htpasswd file (bcrypt entries only) of users allowed to pull, such as one mounted from a secret.")
+	f.StringVar(&o.TokenRealm, "token-realm", "",
+		"Token service endpoint clients are sent to for bearer tokens, enables token auth.")
+	f.StringVar(&o.TokenService, "token-service", "ripfs",
+		"Service name tokens must be issued for.")
+	f.StringVar(&o.TokenIssuer, "token-issuer", "",
+		"Issuer tokens must be issued by.")
+	f.StringVar(&o.TokenCerts, "token-certs", "",
+		"Path to the pem encoded certificates (or public keys) the issuer signs tokens with.")
+
+	f.StringVar(&o.TLSCert, "tls-cert", "",
+		"Path to the certificate to serve tls with, reloaded whenever it changes (such as when mounted from a rotated secret).")
+	f.StringVar(&o.TLSKey, "tls-key", "",
+		"Path to the private key of --tls-cert.")
+	f.StringVar(&o.TLSSecret, "tls-secret", "",
+		"Kubernetes tls secret ([namespace/]name, in ripfs-system by default) to read the certificate and key to serve tls with from.")
+
+	f.BoolVar(&o.FaultInjection, "fault-injection", false,
+		"Inject faults into ipfs reads, configured at /debug/faults on the metrics address (which it requires), for testing against a degraded swarm. Never enable in production.")
+
+	f.StringSliceVar(&o.ReadApiAddresses, "ipfs-read-api-addresses", nil,
+		"Multiaddrs of other ipfs apis to read images through, round robin with the embedded node's and failing over between them.")
+	f.DurationVar(&o.ReadHealthInterval, "ipfs-read-health-interval", failover.DefaultInterval,
+		"How often the ipfs apis images are read through are health checked, unhealthy ones are skipped until they pass again.")
+
+	f.StringVar(&o.ContentProfiles, "content-profiles", "",
+		"Kubernetes config map ([namespace/]name, in the pod's namespace by default) of content profiles, whose roots are prefetched as soon as the swarm is joined.")
+	f.StringVar(&o.ContentProfile, "content-profile", "",
+		"Content profile to prefetch, rather than the one the node is labeled with ("+consts.ContentProfileLabel+", "+consts.DefaultContentProfile+" if unlabeled).")
+	f.StringVar(&o.PrefetchBandwidth, "prefetch-bandwidth", "",
+		"Bandwidth (such as 20MB) per second the content profile's layers are prefetched within, on average (empty is unlimited).")
+	f.StringVar(&o.MetricsAddress, "metrics-address", "",
+		"Address to serve the agent's metrics (/metrics) on, such as its node's swarm peers and repo usage, never when empty.")
+	f.DurationVar(&o.PinAssignedInterval, "pin-assigned-interval", time.Minute,
+		"How often the agent pins the images the manager assigned its node by their replication policies (and releases those it no longer does), once --node-name is known (0 disables).")
+	f.StringVar(&o.NodeName, "node-name", "",
+		"Name of the node the agent runs on, to read its content profile label and assigned images from.")
+	envFlag(f, "node-name")
 
 	o.ipfsOpts.Flags(cmd)
 
 	return cmd
 }
 
+// applyProfile sizes the registry's caches as the node's profile does, unless their flags are set
+func (o *serveCommandOpts) applyProfile(cmd *cobra.Command) error {
+	profile, err := ipfs.GetProfile(o.ipfsOpts.Profile)
+	if err != nil {
+		return err
+	}
+
+	f := cmd.Flags()
+	if profile.IndexCacheSize != 0 && !f.Changed("index-cache-size") {
+		o.IndexCache = profile.IndexCacheSize
+	}
+	if profile.MapperCacheStale != 0 && !f.Changed("mapper-cache-stale") {
+		o.MapperCacheStale = profile.MapperCacheStale
+	}
+	return nil
+}
+
 func (o *serveCommandOpts) Run(ctx context.Context) error {
-	ipfsDaemon, ipfsClient, _, err := o.ipfsOpts.initIpfs(false)
+	if (o.MapFile != "" && o.MapIpnsCid != "") || (o.MapImages != "" && (o.MapFile != "" || o.MapIpnsCid != "")) {
+		return fmt.Errorf("only one of --map-file, --map-ipns-cid and --map-images can be given")
+	}
+	if o.VerifyMappings && o.MapImages == "" {
+		return fmt.Errorf("--verify-mappings requires --map-images")
+	}
+	if o.FaultInjection && o.MetricsAddress == "" {
+		return fmt.Errorf("--fault-injection requires --metrics-address, its admin api is only served there")
+	}
+
+	recorder, err := o.ipfsOpts.eventRecorder("ripfs-agent")
+	if err != nil {
+		return fmt.Errorf("unable to set up events: %v", err)
+	}
+
+	ipfsDaemon, ipfsClient, err := o.ipfsOpts.initIpfs(false, recorder)
 	if err != nil {
 		return err
 	}
+	defer ipfsDaemon.Unlock()
 
-	opts := &registry.IpfsRegistryOpts{}
-	h := registry.NewIpfsRegistry(ipfsClient, opts)
+	// Content is prefetched to the node itself, never through faults or other apis
+	nodeClient := ipfsClient
 
-	errc := make(chan error)
-	go func() {
-		defer ipfsDaemon.Unlock()
-		if err := ipfsDaemon.Start(ctx); err != nil {
-			errc <- err
+	var fi *faults.Faults
+	if o.FaultInjection {
+		fi = faults.New()
+		ipfsClient = faults.Wrap(ipfsClient, fi)
+	}
+
+	if len(o.ReadApiAddresses) > 0 {
+		fa, err := o.failover(ipfsClient)
+		if err != nil {
+			return err
 		}
-	}()
 
-	http.Handle("/", h.Router)
+		go fa.Run(ctx)
+		ipfsClient = fa
+	}
+
+	indexDir := o.IndexDir
+	if indexDir == "" {
+		indexDir = filepath.Join(o.ipfsOpts.RepoPath, "ripfs-index")
+	}
+
+	h, invs, err := o.handler(ctx, ipfsClient, indexDir)
+	if err != nil {
+		return err
+	}
+
+	if len(invs) > 0 {
+		go registry.WatchInvalidations(ctx, ipfsClient, consts.MappingsTopic, invs...)
+	}
+	for _, inv := range invs {
+		if r, ok := inv.(registry.Refresher); ok {
+			go registry.RefreshEvery(ctx, r, o.MapperCacheTTL)
+		}
+	}
+
+	errc := make(chan error, 3)
+	stopIpfs := runIpfs(ipfsDaemon, errc)
+	defer stopIpfs()
+
+	disc, err := o.ipfsOpts.discoverer(nodeClient, false)
+	if err != nil {
+		return err
+	}
+	if disc != nil {
+		go disc.Start(ctx)
+	}
+
+	tlsCfg, err := o.tlsConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", h)
 
 	if !o.Standalone {
 		if err := o.ensureSwarmed(ctx, ipfsClient); err != nil {
@@ -67,9 +307,51 @@ func (o *serveCommandOpts) Run(ctx context.Context) error {
 		}
 	}
 
+	if o.ContentProfiles != "" {
+		go func() {
+			if err := o.prefetch(ctx, nodeClient, recorder); err != nil {
+				fmt.Println("prefetching content profile: ", err)
+			}
+		}()
+	}
+
+	if o.NodeName != "" && o.PinAssignedInterval > 0 {
+		go func() {
+			if err := o.pinAssigned(ctx, nodeClient, recorder); err != nil {
+				fmt.Println("pinning assigned images: ", err)
+			}
+		}()
+	}
+
+	if o.MetricsAddress != "" {
+		msrv, err := o.serveMetrics(ipfsDaemon, nodeClient, fi, errc)
+		if err != nil {
+			return err
+		}
+		defer shutdown(msrv, o.ipfsOpts.ShutdownTimeout)
+	}
+
+	// Bodies aren't given a deadline, layers can take as long as they take to pull (or push)
+	srv := &http.Server{
+		Addr:              o.Address,
+		Handler:           mux,
+		TLSConfig:         tlsCfg,
+		MaxHeaderBytes:    o.MaxHeaderBytes,
+		ReadHeaderTimeout: o.ReadHeaderTimeout,
+		IdleTimeout:       o.IdleTimeout,
+	}
+
 	go func() {
-		fmt.Println("starting registry on: ", o.Address)
-		if err := http.ListenAndServe(o.Address, nil); err != nil {
+		var err error
+		if tlsCfg != nil {
+			fmt.Println("starting registry (tls) on: ", o.Address)
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			fmt.Println("starting registry on: ", o.Address)
+			err = srv.ListenAndServe()
+		}
+
+		if err != http.ErrServerClosed {
 			errc <- err
 		}
 	}()
@@ -77,30 +359,641 @@ func (o *serveCommandOpts) Run(ctx context.Context) error {
 	select {
 	case <-ctx.Done():
 
-	case <-errc:
-		var errs error
-		for e := range errc {
-			errs = multierror.Append(e)
+	case err = <-errc:
+	}
+
+	// Pulls in flight are drained before the node they read from is stopped
+	fmt.Println("stopping registry")
+	shutdown(srv, o.ipfsOpts.ShutdownTimeout)
+	return err
+}
+
+// serveMetrics serves the metrics of the agent, and of its node, on the metrics address, along with the admin api of
+// any faults injected (never on the registry's own address)
+func (o *serveCommandOpts) serveMetrics(node ipfs.Node, client iface.CoreAPI, fi *faults.Faults, errc chan<- error) (*http.Server, error) {
+	repo, _ := node.(metrics.RepoStater)
+	if err := metrics.Registry.Register(metrics.NewNodeCollector(client, repo)); err != nil {
+		return nil, fmt.Errorf("registering ipfs metrics: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	if fi != nil {
+		fmt.Println("fault injection enabled at: /debug/faults")
+		mux.Handle("/debug/faults", fi)
+	}
+
+	srv := &http.Server{Addr: o.MetricsAddress, Handler: mux, ReadHeaderTimeout: o.ReadHeaderTimeout}
+	go func() {
+		fmt.Println("serving metrics on: ", o.MetricsAddress)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			errc <- err
+		}
+	}()
+	return srv, nil
+}
+
+// handler builds the default registry, and any configured virtual hosts in front of it. Every cache needing
+// invalidation when the mappings change is returned alongside it.
+func (o *serveCommandOpts) handler(ctx context.Context, client iface.CoreAPI, indexDir string) (http.Handler, []registry.Invalidator, error) {
+	var invs []registry.Invalidator
+	mapper := func(ipnsCid string) registry.ListingCidMapper {
+		if ipnsCid == "" {
+			return nil
+		}
+
+		ipns := registry.NewIpfsCidMapper(client, registry.StaticFetcher(ipnsCid))
+		if o.MapperPubsub {
+			m := registry.NewPubsubCidMapper(client, ipns)
+			invs = append(invs, m)
+			return m
+		}
+
+		m := registry.NewCachingCidMapper(ipns, o.MapperCacheTTL, registry.WithStaleWhileRevalidate(o.MapperCacheStale))
+		invs = append(invs, m)
+		return m
+	}
+
+	auth, err := o.auth()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idx, err := registry.NewFileIndex(indexDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening index: %v", err)
+	}
+
+	m := mapper(o.MapIpnsCid)
+	if o.MapFile != "" {
+		m = registry.NewFileCidMapper(o.MapFile)
+	}
+	if o.MapImages != "" {
+		im, err := o.imageMapper(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if o.MapperPubsub {
+			invs = append(invs, im)
+		}
+		m = im
+	}
+
+	cluster, clusterNs := o.pinnedRootsReader()
+
+	reg := registry.NewIpfsRegistry(client, &registry.IpfsRegistryOpts{
+		Mapper:         m,
+		Index:          idx,
+		IndexCacheSize: o.IndexCache,
+		Auth:           auth,
+		RecordRequests: o.RecordRequests,
+		AllowPush:      o.AllowPush,
+		AllowDelete:    o.AllowDelete,
+		Cluster:        cluster,
+		Gateway:        o.Gateway,
+		UploadDir:      filepath.Join(indexDir, "uploads"),
+
+		MaxManifestSize: o.MaxManifestSize,
+		MaxUploadSize:   o.MaxUploadSize,
+		UploadTTL:       o.UploadTTL,
+		MaxUploads:      o.MaxUploads,
+
+		ClusterNamespace: clusterNs,
+	})
+
+	if o.VirtualHostsConfig == "" {
+		return reg.Router, invs, nil
+	}
+
+	cfg, err := registry.LoadVirtualHostsConfig(o.VirtualHostsConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading virtual hosts: %v", err)
+	}
+
+	vh := registry.NewVirtualHosts(reg.Router)
+	for _, hc := range cfg.Hosts {
+		hidx, err := registry.NewFileIndex(filepath.Join(indexDir, hc.Name))
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening index for %s: %v", hc.Name, err)
+		}
+
+		hreg := registry.NewIpfsRegistry(client, &registry.IpfsRegistryOpts{
+			Mapper:         mapper(hc.MapIpnsCid),
+			Index:          hidx,
+			IndexCacheSize: o.IndexCache,
+			Auth:           auth,
+			RecordRequests: o.RecordRequests,
+			AllowPush:      o.AllowPush,
+			AllowDelete:    o.AllowDelete,
+			Cluster:        cluster,
+			Gateway:        o.Gateway,
+			UploadDir:      filepath.Join(indexDir, hc.Name, "uploads"),
+
+			MaxManifestSize: o.MaxManifestSize,
+			MaxUploadSize:   o.MaxUploadSize,
+			UploadTTL:       o.UploadTTL,
+			MaxUploads:      o.MaxUploads,
+
+			ClusterNamespace: clusterNs,
+		})
+
+		fmt.Println("serving virtual host: ", hc.Name)
+		vh.Add(hc.Host, hc.Prefix, hreg.Router)
+	}
+
+	return vh, invs, nil
+}
+
+// pinnedRootsReader returns the client (and namespace) deletes list the roots the cluster holds pinned with, or nil
+// when deletes aren't allowed or there's no cluster to ask
+func (o *serveCommandOpts) pinnedRootsReader() (client.Reader, string) {
+	if !o.AllowDelete {
+		return nil, ""
+	}
+
+	ns := o.ipfsOpts.PodNamespace
+	if ns == "" {
+		ns = "ripfs-system"
+	}
+
+	kcfg, err := ctrl.GetConfig()
+	if err != nil {
+		fmt.Println("deletes only keep mapped images, no cluster to list pinned roots from: ", err)
+		return nil, ""
+	}
+
+	c, err := client.New(kcfg, client.Options{})
+	if err != nil {
+		fmt.Println("deletes only keep mapped images, no cluster to list pinned roots from: ", err)
+		return nil, ""
+	}
+	return c, ns
+}
+
+// imageMapper resolves names from the Images of the --map-images namespace, through a cache kept in sync with them
+func (o *serveCommandOpts) imageMapper(ctx context.Context) (*registry.ImageCidMapper, error) {
+	kcfg, err := ctrl.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	c, err := cache.New(kcfg, cache.Options{Scheme: scheme, Namespace: o.MapImages})
+	if err != nil {
+		return nil, err
+	}
+
+	// The informer is started ahead of the first pull, rather than by it
+	if _, err := c.GetInformer(ctx, &v1alpha1.Image{}); err != nil {
+		return nil, err
+	}
+	go c.Start(ctx)
+
+	if !c.WaitForCacheSync(ctx) {
+		return nil, fmt.Errorf("syncing the images of %s", o.MapImages)
+	}
+
+	var opts []registry.ImageOption
+	if o.VerifyMappings {
+		// The keys are read directly rather than cached, agents may only get the config map itself
+		direct, err := client.New(kcfg, client.Options{})
+		if err != nil {
+			return nil, err
+		}
+
+		keys := registry.ConfigMapMappingKeys(direct, types.NamespacedName{Name: consts.MappingKeysConfigMapName, Namespace: o.MapImages})
+		opts = append(opts, registry.WithMappingKeys(registry.CachingMappingKeys(keys, time.Minute, o.MapperCacheStale)))
+	}
+
+	fmt.Println("serving the images of: ", o.MapImages)
+	return registry.NewImageCidMapper(c, o.MapImages, opts...), nil
+}
+
+// failover returns client reading through every configured ipfs api, with client (the node's) as the primary
+func (o *serveCommandOpts) failover(client iface.CoreAPI) (*failover.API, error) {
+	primary := o.ipfsOpts.ApiAddress
+	if o.ipfsOpts.ExternalIpfs != "" {
+		primary = o.ipfsOpts.ExternalIpfs
+	}
+
+	endpoints := []failover.Endpoint{{Name: primary, API: client}}
+	for _, addr := range o.ReadApiAddresses {
+		ma, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ipfs api address %s: %v", addr, err)
+		}
+
+		api, err := httpapi.NewApi(ma)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, failover.Endpoint{Name: addr, API: api})
+	}
+
+	fmt.Println("reading through ipfs apis: ", append([]string{primary}, o.ReadApiAddresses...))
+	return failover.New(endpoints, &failover.Options{Interval: o.ReadHealthInterval}), nil
+}
+
+// auth returns the configured authenticator, nil when the registry is open to everyone
+func (o *serveCommandOpts) auth() (registry.Authenticator, error) {
+	switch {
+	case o.Htpasswd != "" && o.TokenRealm != "":
+		return nil, fmt.Errorf("only one of --htpasswd or --token-realm may be specified")
+
+	case o.Htpasswd != "":
+		return registry.LoadHtpasswd(o.Htpasswd, "ripfs")
+
+	case o.TokenRealm != "":
+		if o.TokenIssuer == "" || o.TokenCerts == "" {
+			return nil, fmt.Errorf("--token-issuer and --token-certs are required for token auth")
+		}
+
+		keys, err := registry.LoadTokenKeys(o.TokenCerts)
+		if err != nil {
+			return nil, err
+		}
+
+		return &registry.TokenAuth{
+			Realm:   o.TokenRealm,
+			Service: o.TokenService,
+			Issuer:  o.TokenIssuer,
+			Keys:    keys,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// tlsConfig returns the configured tls config, nil when the registry is served over plain http
+func (o *serveCommandOpts) tlsConfig(ctx context.Context) (*tls.Config, error) {
+	switch {
+	case o.TLSSecret != "" && (o.TLSCert != "" || o.TLSKey != ""):
+		return nil, fmt.Errorf("only one of --tls-secret or --tls-cert/--tls-key may be specified")
+
+	case o.TLSSecret != "":
+		ns, name := "ripfs-system", o.TLSSecret
+		if i := strings.Index(name, "/"); i >= 0 {
+			ns, name = name[:i], name[i+1:]
+		}
+
+		kc, err := corev1client.NewForConfig(ctrl.GetConfigOrDie())
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := kc.Secrets(ns).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("reading tls secret: %v", err)
+		}
+
+		cert, err := tls.X509KeyPair(s.Data[corev1.TLSCertKey], s.Data[corev1.TLSPrivateKeyKey])
+		if err != nil {
+			return nil, fmt.Errorf("loading tls secret %s/%s: %v", ns, name, err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+
+	case o.TLSCert != "" || o.TLSKey != "":
+		if o.TLSCert == "" || o.TLSKey == "" {
+			return nil, fmt.Errorf("both --tls-cert and --tls-key are required")
+		}
+
+		fc := &fileCertificate{cert: o.TLSCert, key: o.TLSKey}
+		if _, err := fc.GetCertificate(nil); err != nil {
+			return nil, err
+		}
+		return &tls.Config{GetCertificate: fc.GetCertificate}, nil
+	}
+
+	return nil, nil
+}
+
+// prefetch pins the roots of the node's content profile, so nodes (such as those recreated by an autoscaler) start
+// with their standard images rather than fetching them on their first pull. Nothing is pinned until the node serves
+// its api, standalone registries don't wait for a swarm to be joined first.
+func (o *serveCommandOpts) prefetch(ctx context.Context, client iface.CoreAPI, recorder record.EventRecorder) error {
+	if err := waitForIpfs(ctx, client); err != nil {
+		return err
+	}
+
+	kcfg, err := ctrl.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	kc, err := corev1client.NewForConfig(kcfg)
+	if err != nil {
+		return err
+	}
+
+	profile, roots, err := o.contentProfile(ctx, kc)
+	if err != nil || roots == nil {
+		return err
+	}
+
+	popts, err := o.prefetchOptions()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("prefetching %d roots of content profile %s\n", len(roots), profile)
+	n, err := registry.Prefetch(ctx, client, roots, popts...)
+
+	if pod := o.ipfsOpts.pod(); recorder != nil && pod != nil {
+		if err != nil {
+			recorder.Eventf(pod, corev1.EventTypeWarning, consts.ContentProfileReason, "Prefetched %d of %d roots of content profile %s: %v", n, len(roots), profile, err)
+		} else {
+			recorder.Eventf(pod, corev1.EventTypeNormal, consts.ContentProfileReason, "Prefetched %d roots of content profile %s", n, profile)
+		}
+	}
+	return err
+}
+
+// contentProfile returns the name and roots of the node's content profile, or no roots if it has none
+func (o *serveCommandOpts) contentProfile(ctx context.Context, kc corev1client.CoreV1Interface) (string, []cid.Cid, error) {
+	if o.ContentProfiles == "" {
+		return "", nil, nil
+	}
+
+	ns, name := o.ipfsOpts.PodNamespace, o.ContentProfiles
+	if i := strings.Index(name, "/"); i >= 0 {
+		ns, name = name[:i], name[i+1:]
+	}
+	if ns == "" {
+		ns = "ripfs-system"
+	}
+
+	profile := o.ContentProfile
+	if profile == "" {
+		profile = consts.DefaultContentProfile
+
+		if o.NodeName != "" {
+			node, err := kc.Nodes().Get(ctx, o.NodeName, metav1.GetOptions{})
+			if err != nil {
+				return "", nil, fmt.Errorf("reading node %s: %v", o.NodeName, err)
+			}
+
+			if p, ok := node.Labels[consts.ContentProfileLabel]; ok {
+				profile = p
+			}
+		}
+	}
+
+	cm, err := kc.ConfigMaps(ns).Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		fmt.Printf("no content profiles in %s/%s\n", ns, name)
+		return profile, nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("reading content profiles: %v", err)
+	}
+
+	data, ok := cm.Data[profile]
+	if !ok {
+		fmt.Printf("no content profile %s in %s/%s\n", profile, ns, name)
+		return profile, nil, nil
+	}
+
+	roots, err := registry.ParseContentProfile(data)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid content profile %s: %v", profile, err)
+	}
+	return profile, roots, nil
+}
+
+// prefetchOptions are the options of every prefetch the agent makes
+func (o *serveCommandOpts) prefetchOptions() ([]registry.PrefetchOption, error) {
+	var popts []registry.PrefetchOption
+	if o.PrefetchBandwidth != "" {
+		bw, err := humanize.ParseBytes(o.PrefetchBandwidth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefetch bandwidth %s: %v", o.PrefetchBandwidth, err)
+		}
+		popts = append(popts, registry.WithBandwidth(int64(bw)))
+	}
+	return popts, nil
+}
+
+// pinAssigned pins the roots the manager assigns the node by their replication policies every interval, and releases
+// those it no longer does. The roots pinned are remembered in the repo, so those dropped while the agent was down are
+// released too.
+func (o *serveCommandOpts) pinAssigned(ctx context.Context, client iface.CoreAPI, recorder record.EventRecorder) error {
+	kcfg, err := ctrl.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	kc, err := corev1client.NewForConfig(kcfg)
+	if err != nil {
+		return err
+	}
+
+	t := time.NewTicker(o.PinAssignedInterval)
+	defer t.Stop()
+
+	for {
+		if err := o.syncAssigned(ctx, kc, client, recorder); err != nil && ctx.Err() == nil {
+			fmt.Println("pinning assigned images: ", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// syncAssigned pins the roots newly assigned to the node, and releases those no longer assigned
+func (o *serveCommandOpts) syncAssigned(ctx context.Context, kc corev1client.CoreV1Interface, client iface.CoreAPI, recorder record.EventRecorder) error {
+	node, err := kc.Nodes().Get(ctx, o.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("reading node %s: %v", o.NodeName, err)
+	}
+
+	// The annotation lists roots as a content profile does, only comma separated
+	assigned, err := registry.ParseContentProfile(strings.ReplaceAll(node.Annotations[consts.NodePinnedAnnotation], ",", "\n"))
+	if err != nil {
+		return fmt.Errorf("invalid %s annotation: %v", consts.NodePinnedAnnotation, err)
+	}
+
+	// The roots pinned are recorded one per line, as a content profile
+	state := filepath.Join(o.ipfsOpts.RepoPath, "ripfs-pinned")
+	var pinned []cid.Cid
+	if data, err := os.ReadFile(state); err == nil {
+		if pinned, err = registry.ParseContentProfile(string(data)); err != nil {
+			return fmt.Errorf("invalid %s: %v", state, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	isAssigned := make(map[cid.Cid]bool)
+	for _, root := range assigned {
+		isAssigned[root] = true
+	}
+	isPinned := make(map[cid.Cid]bool)
+	for _, root := range pinned {
+		isPinned[root] = true
+	}
+
+	popts, err := o.prefetchOptions()
+	if err != nil {
+		return err
+	}
+
+	var (
+		errs            error
+		kept            []cid.Cid
+		added, released int
+		pod             = o.ipfsOpts.pod()
+		event           = recorder != nil && pod != nil
+	)
+	for _, root := range assigned {
+		if isPinned[root] {
+			kept = append(kept, root)
+			continue
+		}
+
+		// Roots are prefetched one at a time, so those that fail are retried on the next sync
+		if _, err := registry.Prefetch(ctx, client, []cid.Cid{root}, popts...); err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		kept = append(kept, root)
+		added++
+	}
+
+	var dropped []cid.Cid
+	for _, root := range pinned {
+		if !isAssigned[root] {
+			dropped = append(dropped, root)
+		}
+	}
+
+	if len(dropped) > 0 {
+		// Anything the content profile pins too stays pinned, and so does whatever is shared with what's still assigned
+		_, profiled, err := o.contentProfile(ctx, kc)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			kept = append(kept, dropped...)
+			dropped = nil
+		}
+
+		inProfile := make(map[cid.Cid]bool)
+		for _, root := range profiled {
+			inProfile[root] = true
+		}
+		keep := append(append([]cid.Cid(nil), assigned...), profiled...)
+
+		for _, root := range dropped {
+			if !inProfile[root] {
+				if _, err := registry.Remove(ctx, client, root, keep); err != nil {
+					errs = multierror.Append(errs, fmt.Errorf("releasing %s: %v", root, err))
+					kept = append(kept, root)
+					continue
+				}
+			}
+			released++
+		}
+	}
+
+	var lines []string
+	for _, root := range kept {
+		lines = append(lines, root.String())
+	}
+	if err := os.WriteFile(state, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("recording the pinned roots: %v", err))
+	}
+
+	if added > 0 || released > 0 {
+		fmt.Printf("pinned %d and released %d images assigned to the node\n", added, released)
+	}
+	if event {
+		if added > 0 {
+			recorder.Eventf(pod, corev1.EventTypeNormal, consts.ReplicationReason, "Pinned %d images assigned to the node by their replication policies", added)
+		}
+		if released > 0 {
+			recorder.Eventf(pod, corev1.EventTypeNormal, consts.ReplicationReason, "Released %d images no longer assigned to the node", released)
 		}
 		if errs != nil {
-			return errs
+			recorder.Eventf(pod, corev1.EventTypeWarning, consts.ReplicationReason, "Failed to pin the images assigned to the node: %v", errs)
+		}
+	}
+	return errs
+}
+
+// fileCertificate serves the certificate and key at cert and key, loading them again whenever the certificate changes
+type fileCertificate struct {
+	cert string
+	key  string
+
+	mu      sync.Mutex
+	modTime time.Time
+	loaded  *tls.Certificate
+}
+
+func (c *fileCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fi, err := os.Stat(c.cert)
+	if err != nil {
+		if c.loaded != nil {
+			// Mid rotation, keep serving what was loaded last
+			return c.loaded, nil
 		}
+		return nil, err
 	}
 
-	return nil
+	if c.loaded != nil && fi.ModTime().Equal(c.modTime) {
+		return c.loaded, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		if c.loaded != nil {
+			return c.loaded, nil
+		}
+		return nil, fmt.Errorf("loading tls certificate: %v", err)
+	}
+
+	c.loaded, c.modTime = &cert, fi.ModTime()
+	return c.loaded, nil
 }
 
 func (o *serveCommandOpts) ensureSwarmed(ctx context.Context, client iface.CoreAPI) error {
+	bootstrap, err := config.ParseBootstrapPeers(o.ipfsOpts.BootstrapPeers)
+	if err != nil {
+		return fmt.Errorf("invalid bootstrap peers: %v", err)
+	}
+
 	// TODO: Make this timeout
 	for {
 		println("waiting to join a swarm...")
-		time.Sleep(5 * time.Second)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+
 		peers, err := client.Swarm().Peers(ctx)
 		if err != nil {
 			return err
 		}
 
 		if len(peers) < 1 {
+			// Every bootstrap peer is retried, so the swarm is joined through whichever of them is still up
+			for _, p := range bootstrap {
+				cctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				if err := client.Swarm().Connect(cctx, p); err != nil && ctx.Err() == nil {
+					fmt.Printf("connecting to bootstrap peer %s: %v\n", p.ID, err)
+				}
+				cancel()
+			}
 			continue
 		}
 
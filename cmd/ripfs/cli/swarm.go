@@ -0,0 +1,125 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	config "github.com/ipfs/go-ipfs-config"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+type swarmCommandOpts struct {
+	apiOpts
+}
+
+func newSwarmCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "swarm",
+		Short: "Manage the peers of the cluster's ipfs daemon",
+		Long: `Manage the peers of the cluster's ipfs daemon, such as to repair peering with another cluster or a depot
+without exec'ing into its pods.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+
+	cmd.AddCommand(
+		newSwarmConnectCommand(),
+		newSwarmDisconnectCommand(),
+	)
+
+	return cmd
+}
+
+func newSwarmConnectCommand() *cobra.Command {
+	o := &swarmCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "connect <multiaddr>...",
+		Short: "Connect the cluster's ipfs daemon to peers",
+		Long: `Connect the cluster's ipfs daemon to peers, each given by a multiaddr ending in its peer id, such as
+/ip4/10.0.0.1/tcp/4001/p2p/QmPeer`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Connect(cmd.Context(), args)
+		},
+	}
+
+	o.apiOpts.Flags(cmd)
+
+	return cmd
+}
+
+func newSwarmDisconnectCommand() *cobra.Command {
+	o := &swarmCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "disconnect <multiaddr>...",
+		Short: "Disconnect the cluster's ipfs daemon from peers",
+		Long: `Disconnect the cluster's ipfs daemon from peers, each given by a multiaddr (or only /p2p/<peer id>,
+closing every connection to the peer).`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Disconnect(cmd.Context(), args)
+		},
+	}
+
+	o.apiOpts.Flags(cmd)
+
+	return cmd
+}
+
+func (o *swarmCommandOpts) Connect(ctx context.Context, addrs []string) error {
+	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+	ctx = l.WithContext(ctx)
+
+	peers, err := config.ParseBootstrapPeers(addrs)
+	if err != nil {
+		return fmt.Errorf("invalid peer: %v", err)
+	}
+
+	client, closer, err := o.connect(ctx, ctrl.GetConfigOrDie())
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	for _, pi := range peers {
+		if err := client.Swarm().Connect(ctx, pi); err != nil {
+			return fmt.Errorf("connecting to %s: %v", pi.ID, err)
+		}
+		l.Info().Msgf("connected to [%s]", pi.ID)
+	}
+	return nil
+}
+
+func (o *swarmCommandOpts) Disconnect(ctx context.Context, addrs []string) error {
+	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+	ctx = l.WithContext(ctx)
+
+	mas := make([]multiaddr.Multiaddr, len(addrs))
+	for i, addr := range addrs {
+		ma, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			return fmt.Errorf("invalid peer %s: %v", addr, err)
+		}
+		mas[i] = ma
+	}
+
+	client, closer, err := o.connect(ctx, ctrl.GetConfigOrDie())
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	for _, ma := range mas {
+		if err := client.Swarm().Disconnect(ctx, ma); err != nil {
+			return fmt.Errorf("disconnecting from %s: %v", ma, err)
+		}
+		l.Info().Msgf("disconnected from [%s]", ma)
+	}
+	return nil
+}
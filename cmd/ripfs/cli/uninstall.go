@@ -0,0 +1,142 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fluxcd/pkg/ssa"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/joshrwolf/ripfs/config"
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/k8s"
+	"github.com/joshrwolf/ripfs/internal/manifests"
+)
+
+type uninstallCommandOpts struct {
+	Namespace string
+	Timeout   time.Duration
+}
+
+func newUninstallCommand() *cobra.Command {
+	o := &uninstallCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "uninstall",
+		Short: "Tear down ripfs and remove it from a cluster",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Run(cmd.Context())
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVar(&o.Namespace, "namespace", "ripfs-system",
+		"The installation namespace.")
+	f.DurationVarP(&o.Timeout, "timeout", "t", 5*time.Minute,
+		"Timeout duration for each managed secret to be torn down.")
+
+	return cmd
+}
+
+// Run deletes the managed secrets first, in order, waiting for the manager to tear down what each references before
+// removing everything else
+func (o *uninstallCommandOpts) Run(ctx context.Context) error {
+	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+	ctx = l.WithContext(ctx)
+
+	kcfg := ctrl.GetConfigOrDie()
+
+	c, err := client.New(kcfg, client.Options{})
+	if err != nil {
+		return err
+	}
+
+	for _, n := range []string{consts.CidMapperSecretName, consts.ClusterConfigSecretName} {
+		key := types.NamespacedName{Name: n, Namespace: o.Namespace}
+
+		l.Info().Msgf("tearing down %s", key)
+		if err := o.deleteAndWait(ctx, c, key); err != nil {
+			return fmt.Errorf("tearing down %s: %v", key, err)
+		}
+	}
+
+	data, err := manifests.NewGenerator(manifests.DefaultOpts()).Generate(ctx, config.EmbeddedManifests)
+	if err != nil {
+		return err
+	}
+
+	objs, err := ssa.ReadObjects(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	a, err := k8s.NewApplier(kcfg)
+	if err != nil {
+		return err
+	}
+
+	l.Info().Msgf("removing ripfs components from cluster")
+	if _, err := a.Delete(ctx, objs); err != nil {
+		return err
+	}
+
+	// Only once the manager is gone, so it doesn't create the secrets again
+	if err := clearReleased(ctx, c, o.Namespace); err != nil {
+		return err
+	}
+
+	l.Info().Msgf("successfully uninstalled ripfs!")
+	return nil
+}
+
+// deleteAndWait marks the secret at key as uninstalled and deletes it, then waits for the manager to tear down what it
+// references and release it
+func (o *uninstallCommandOpts) deleteAndWait(ctx context.Context, c client.Client, key types.NamespacedName) error {
+	s := &corev1.Secret{}
+	if err := c.Get(ctx, key, s); errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	patch := client.MergeFrom(s.DeepCopy())
+	if s.Annotations == nil {
+		s.Annotations = make(map[string]string)
+	}
+	s.Annotations[consts.UninstallAnnotation] = "true"
+	if err := c.Patch(ctx, s, patch); err != nil {
+		return err
+	}
+
+	if err := c.Delete(ctx, s); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return wait.PollImmediate(2*time.Second, o.Timeout, func() (bool, error) {
+		err := c.Get(ctx, key, &corev1.Secret{})
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+}
+
+// clearReleased forgets the managed secrets released by an earlier uninstall of the namespace, so the manager creates
+// them again
+func clearReleased(ctx context.Context, c client.Client, namespace string) error {
+	cm := &corev1.ConfigMap{}
+	cm.Name, cm.Namespace = consts.ReleasedConfigMapName, namespace
+	if err := c.Delete(ctx, cm); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("clearing released secrets: %v", err)
+	}
+	return nil
+}
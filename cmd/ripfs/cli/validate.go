@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+type validateCommandOpts struct {
+	File   string
+	Schema bool
+}
+
+func newValidateCommand() *cobra.Command {
+	o := &validateCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Validate a ripfs config file",
+		Long: `Validate a ripfs config file, such as the one given to serve --virtual-hosts-config.
+
+The config's json schema is printed with --schema, for editors (and admission) to validate against.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Run()
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVarP(&o.File, "file", "f", "",
+		"Path to the config file to validate.")
+	f.BoolVar(&o.Schema, "schema", false,
+		"Print the config's json schema rather than validating a file.")
+
+	return cmd
+}
+
+func (o *validateCommandOpts) Run() error {
+	if o.Schema {
+		_, err := os.Stdout.Write(registry.VirtualHostsConfigSchema)
+		return err
+	}
+
+	if o.File == "" {
+		return fmt.Errorf("a config file must be given with --file")
+	}
+
+	cfg, err := registry.LoadVirtualHostsConfig(o.File)
+	if err != nil {
+		return fmt.Errorf("invalid config %s: %v", o.File, err)
+	}
+
+	fmt.Printf("%s is valid, serving %d virtual hosts\n", o.File, len(cfg.Hosts))
+	return nil
+}
@@ -0,0 +1,238 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+	"github.com/hashicorp/go-multierror"
+	"github.com/ipfs/go-cid"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/k8s"
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+type warmCommandOpts struct {
+	apiOpts
+
+	Nodes       string
+	Concurrency int
+	Bandwidth   string
+}
+
+func newWarmCommand() *cobra.Command {
+	o := &warmCommandOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "warm [image...]",
+		Short: "Pin images on the agents of selected nodes ahead of their pulls",
+		Long: `Pin images on the agents of selected nodes ahead of their pulls.
+
+Every object of each image is fetched from the swarm and pinned by the agent on every node matching --nodes, through a
+tunnel to its ipfs api, so workloads scheduled there afterwards pull from their own node. Images are given as mapped
+references (alpine:latest), root cids, or ipfs/<cid> references.
+
+Warmed images stay pinned on those nodes, as a content profile's are. Images that should follow the nodes a workload
+runs on are better given a replication policy (ripfs add --replicas or --pin-on).`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.Run(cmd.Context(), args)
+		},
+	}
+
+	o.apiOpts.Flags(cmd)
+
+	f := cmd.Flags()
+	f.StringVar(&o.Nodes, "nodes", "",
+		"Label selector (such as node-role.kubernetes.io/worker,gpu=true) of the nodes to warm, every node when empty.")
+	f.IntVar(&o.Concurrency, "concurrency", 4,
+		"Number of nodes to warm at once.")
+	f.StringVar(&o.Bandwidth, "bandwidth", "",
+		"Bandwidth (such as 20MB) per second each node fetches layers within, on average (empty is unlimited).")
+
+	return cmd
+}
+
+func (o *warmCommandOpts) Run(ctx context.Context, references []string) error {
+	l := zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Logger()
+	ctx = l.WithContext(ctx)
+
+	if o.Concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+
+	var popts []registry.PrefetchOption
+	if o.Bandwidth != "" {
+		bw, err := humanize.ParseBytes(o.Bandwidth)
+		if err != nil {
+			return fmt.Errorf("invalid bandwidth %s: %v", o.Bandwidth, err)
+		}
+		popts = append(popts, registry.WithBandwidth(int64(bw)))
+	}
+
+	kcfg := ctrl.GetConfigOrDie()
+
+	client, closer, err := o.connect(ctx, kcfg)
+	if err != nil {
+		return err
+	}
+
+	var roots []cid.Cid
+	for _, reference := range references {
+		root, err := resolveRoot(ctx, client, kcfg, o.Namespace, reference)
+		if err != nil {
+			closer()
+			return err
+		}
+		roots = append(roots, root)
+	}
+	closer()
+
+	agents, err := o.agents(ctx, kcfg)
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		errs  error
+		nodes = make(chan string)
+	)
+	for w := 0; w < o.Concurrency && w < len(agents); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for node := range nodes {
+				n, err := o.warm(ctx, kcfg, agents[node], roots, popts)
+
+				mu.Lock()
+				if err != nil {
+					l.Error().Msgf("warmed %d of %d images on node %s: %v", n, len(roots), node, err)
+					errs = multierror.Append(errs, fmt.Errorf("warming node %s: %v", node, err))
+				} else {
+					l.Info().Msgf("warmed %d images on node %s", n, node)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	names := make([]string, 0, len(agents))
+	for node := range agents {
+		names = append(names, node)
+	}
+	sort.Strings(names)
+
+	for _, node := range names {
+		nodes <- node
+	}
+	close(nodes)
+	wg.Wait()
+
+	return errs
+}
+
+// agents returns the ready agent on every node matching the selector, by node. Selected nodes without one are warned
+// about, and fail the warm when none of them have one.
+func (o *warmCommandOpts) agents(ctx context.Context, kcfg *rest.Config) (map[string]k8s.Target, error) {
+	l := zerolog.Ctx(ctx)
+
+	kc, err := corev1client.NewForConfig(kcfg)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := kc.Nodes().List(ctx, metav1.ListOptions{LabelSelector: o.Nodes})
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes: %v", err)
+	}
+	if len(nodes.Items) == 0 {
+		return nil, fmt.Errorf("no nodes match %q", o.Nodes)
+	}
+
+	pods, err := kc.Pods(o.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: consts.AgentsLabel + "=" + consts.AgentsLabelValue,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing the ripfs agents: %v", err)
+	}
+
+	ready := make(map[string]k8s.Target)
+	for _, p := range pods.Items {
+		if !podIsReady(&p) {
+			continue
+		}
+		ready[p.Spec.NodeName] = k8s.Target{Name: p.Name, Namespace: p.Namespace, Container: "agent"}
+	}
+
+	agents := make(map[string]k8s.Target)
+	for _, n := range nodes.Items {
+		a, ok := ready[n.Name]
+		if !ok {
+			l.Warn().Msgf("no ready ripfs agent runs on node %s, skipping it", n.Name)
+			continue
+		}
+		agents[n.Name] = a
+	}
+
+	if len(agents) == 0 {
+		return nil, fmt.Errorf("no ready ripfs agent runs on any of the %d nodes matching %q", len(nodes.Items), o.Nodes)
+	}
+	return agents, nil
+}
+
+// warm prefetches roots on agent, through a tunnel to its ipfs api
+func (o *warmCommandOpts) warm(ctx context.Context, kcfg *rest.Config, agent k8s.Target, roots []cid.Cid, popts []registry.PrefetchOption) (int, error) {
+	t, err := k8s.NewTunneler(kcfg)
+	if err != nil {
+		return 0, err
+	}
+
+	// Every agent is tunneled to at once, each from its own local port
+	fwd, err := t.Tunnel(ctx, agent, []string{"0:5001"})
+	if err != nil {
+		return 0, fmt.Errorf("tunneling to %s: %v", agent.Name, err)
+	}
+	defer fwd.Close()
+
+	ports, err := fwd.GetPorts()
+	if err != nil || len(ports) == 0 {
+		return 0, fmt.Errorf("tunneling to %s: no local port forwarded", agent.Name)
+	}
+
+	ma, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", ports[0].Local))
+	if err != nil {
+		return 0, err
+	}
+
+	client, err := httpapi.NewApi(ma)
+	if err != nil {
+		return 0, err
+	}
+
+	return registry.Prefetch(ctx, client, roots, popts...)
+}
+
+// podIsReady reports whether pod is ready
+func podIsReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -3,15 +3,24 @@ package main
 import (
 	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/joshrwolf/ripfs/cmd/ripfs/cli"
 )
 
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
+	// Long running commands drain and close their ipfs node when the pod is terminated, rather than being killed mid write
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	// A second signal kills it outright
+	go func() {
+		<-ctx.Done()
+		cancel()
+	}()
+
 	if err := cli.New().ExecuteContext(ctx); err != nil {
-		os.Exit(1)
+		os.Exit(cli.ExitCode(err))
 	}
 }
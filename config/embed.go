@@ -2,5 +2,5 @@ package config
 
 import "embed"
 
-//go:embed **/*.yaml
+//go:embed **/*.yaml crd/bases/*.yaml
 var EmbeddedManifests embed.FS
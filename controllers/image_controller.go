@@ -0,0 +1,130 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	iopts "github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"k8s.io/apimachinery/pkg/api/equality"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/joshrwolf/ripfs/api/v1alpha1"
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+// ImageReconciler observes every Image on the manager's node, recording the size and platforms of its root, and
+// whether every object of it is pinned there, in its status. Images are only ever read, never pinned (or unpinned).
+type ImageReconciler struct {
+	Client client.Client
+
+	// Ipfs is the manager's node the images are observed on
+	Ipfs iface.CoreAPI
+
+	// Timeout bounds how long a single image is read for, so those missing from the swarm don't hold up the rest
+	Timeout time.Duration
+
+	// RecheckInterval is how often images are observed again, as their pins change without the Images changing
+	RecheckInterval time.Duration
+}
+
+// +kubebuilder:rbac:groups=registry.ripfs.dev,resources=images,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=registry.ripfs.dev,resources=images/status,verbs=get;update;patch
+
+func (r *ImageReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	img := &v1alpha1.Image{}
+	if err := r.Client.Get(ctx, req.NamespacedName, img); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	status := r.observe(ctx, img)
+	if !equality.Semantic.DeepEqual(status, img.Status) {
+		img.Status = status
+		if err := r.Client.Status().Update(ctx, img); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: r.RecheckInterval}, nil
+}
+
+// observe returns the status of img as it's stored on the manager's node. What can't be read is explained by its
+// message, keeping the size and platforms last observed for the same root.
+func (r *ImageReconciler) observe(ctx context.Context, img *v1alpha1.Image) v1alpha1.ImageStatus {
+	status := v1alpha1.ImageStatus{ObservedRoot: img.Spec.Root}
+	if img.Status.ObservedRoot == img.Spec.Root {
+		status.Size, status.Platforms = img.Status.Size, img.Status.Platforms
+	}
+
+	root, err := cid.Decode(strings.TrimPrefix(img.Spec.Root, "/ipfs/"))
+	if err != nil {
+		status.Message = fmt.Sprintf("Invalid root: %v", err)
+		return status
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	refs, err := registry.References(ctx, r.Ipfs, root)
+	if err != nil {
+		status.Message = fmt.Sprintf("Reading %s: %v", root, err)
+		return status
+	}
+
+	if status.Size, err = registry.ImageSize(ctx, r.Ipfs, root); err != nil {
+		status.Message = fmt.Sprintf("Reading the size of %s: %v", root, err)
+		return status
+	}
+
+	if status.Platforms, err = registry.Platforms(ctx, r.Ipfs, root); err != nil {
+		status.Message = fmt.Sprintf("Reading the platforms of %s: %v", root, err)
+		return status
+	}
+
+	var unpinned int
+	for _, c := range refs {
+		_, pinned, err := r.Ipfs.Pin().IsPinned(ctx, path.IpfsPath(c), iopts.Pin.IsPinned.Recursive())
+		if err != nil {
+			status.Message = fmt.Sprintf("Checking the pins of %s: %v", root, err)
+			return status
+		}
+		if !pinned {
+			unpinned++
+		}
+	}
+
+	status.Pinned = unpinned == 0
+	if !status.Pinned {
+		status.Message = fmt.Sprintf("%d of the %d objects of %s aren't pinned", unpinned, len(refs), root)
+	}
+	return status
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ImageReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("image").
+		For(&v1alpha1.Image{}).
+		Complete(r)
+}
@@ -0,0 +1,518 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/discovery"
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+// DrainRebalance is what happens to the images replicated away from a drained node once it's schedulable again
+type DrainRebalance string
+
+const (
+	// DrainRebalanceRelease unpins them from the manager again, once the node's agent (or enough other peers) provide them
+	DrainRebalanceRelease DrainRebalance = "release"
+
+	// DrainRebalanceKeep leaves them pinned, for the garbage collector to evict under storage pressure
+	DrainRebalanceKeep DrainRebalance = "keep"
+)
+
+// ParseDrainRebalance parses a DrainRebalance policy by name
+func ParseDrainRebalance(s string) (DrainRebalance, error) {
+	switch p := DrainRebalance(s); p {
+	case DrainRebalanceRelease, DrainRebalanceKeep:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid drain rebalance policy %s, must be one of %s or %s", s, DrainRebalanceRelease, DrainRebalanceKeep)
+}
+
+// autoscalerDeletionTaint is the taint the cluster autoscaler drains nodes it's about to remove with
+const autoscalerDeletionTaint = "ToBeDeletedByClusterAutoscaler"
+
+const (
+	// agentRetryInterval is how soon a drained node whose agent can't be reached is checked again
+	agentRetryInterval = 30 * time.Second
+
+	// agentDialTimeout bounds dialing the agent on a drained node
+	agentDialTimeout = 10 * time.Second
+)
+
+// errAgentUnreachable is returned for an agent running on a node that the manager can't connect to
+var errAgentUnreachable = errors.New("ripfs agent unreachable")
+
+// NodeDrainReconciler keeps images from being lost with the nodes that are drained. Images the garbage collector
+// evicted from the manager live on in the agents that pulled them, so once a node is cordoned (or tainted for removal
+// by the cluster autoscaler) every mapped image its agent provides, that fewer than MinReplicas other peers do, is
+// pinned on the manager again while the agent can still be fetched from. The node is then annotated as removable, only
+// without replicating anything once there's no agent on it at all: one that can't be reached is retried instead.
+//
+// Once the node is schedulable again, the images replicated away from it are rebalanced according to Rebalance.
+type NodeDrainReconciler struct {
+	Client   client.Client
+	Recorder record.EventRecorder
+
+	// Ipfs is the manager's node, which images are replicated to
+	Ipfs iface.CoreAPI
+
+	// Mapper lists the mapped images
+	Mapper registry.Lister
+
+	// AgentsNamespace is the namespace the agents serving the registry on every node run in
+	AgentsNamespace string
+
+	// Peers is the config map the agents register their ipfs nodes' addresses in for peer discovery, which agents the
+	// manager isn't connected to are dialed by. Unset without peer discovery, where only connected agents are found.
+	Peers types.NamespacedName
+
+	// MinReplicas is the number of other peers that must provide an image for it to not be replicated
+	MinReplicas int
+
+	Rebalance DrainRebalance
+
+	// RecheckInterval is how often drained nodes are checked again, for images pulled (or evicted) since, and returned
+	// nodes for the images they provide again
+	RecheckInterval time.Duration
+}
+
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+func (r *NodeDrainReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	node := &corev1.Node{}
+	if err := r.Client.Get(ctx, req.NamespacedName, node); err != nil {
+		// Anything replicated for a removed node stays pinned, it's gone for good
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if draining(node) {
+		return r.replicate(ctx, node)
+	}
+	return r.rebalance(ctx, node)
+}
+
+// replicate pins the images only the agent on drained node provides, and marks node removable once there are none left
+func (r *NodeDrainReconciler) replicate(ctx context.Context, node *corev1.Node) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	replicated := replicatedRoots(node)
+
+	agent, err := r.agentPeer(ctx, node.Name)
+	if errors.Is(err, errAgentUnreachable) {
+		// Whatever only the agent holds can't be checked (or replicated) until it's reached, so the node isn't
+		// removable until then
+		l.Info("ripfs agent on drained node can't be reached, checking again", "node", node.Name, "reason", err.Error())
+		if err := r.annotate(ctx, node, replicated, false); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: agentRetryInterval}, nil
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if agent != "" {
+		roots, err := r.roots(ctx)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		var needed []cid.Cid
+		for _, root := range roots {
+			if replicated[root] {
+				continue
+			}
+
+			provided, others, err := r.providers(ctx, root, agent)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+
+			if !provided || others >= r.MinReplicas {
+				continue
+			}
+
+			if held, err := r.pinned(ctx, root); err != nil {
+				return ctrl.Result{}, err
+			} else if held {
+				continue
+			}
+			needed = append(needed, root)
+		}
+
+		if len(needed) > 0 {
+			l.Info("replicating images away from drained node", "node", node.Name, "images", len(needed))
+
+			// Every image's metadata is fetched first and then the largest layers, the most useful part of an
+			// image to have replicated if the node goes away before all of it is
+			n, err := registry.Prefetch(ctx, r.Ipfs, needed, registry.WithPrefetchProgress(func(p registry.Progress) {
+				if root, err := cid.Decode(p.Cid); p.Phase == registry.PhaseAdded && err == nil {
+					replicated[root] = true
+				}
+			}))
+			if n > 0 {
+				r.Recorder.Eventf(node, corev1.EventTypeNormal, consts.NodeDrainReason, "Replicated %d images only the ripfs agent on the node provided to the manager", n)
+			}
+
+			// The node isn't removable until everything is replicated, what was is still recorded
+			if err != nil {
+				if aerr := r.annotate(ctx, node, replicated, false); aerr != nil {
+					return ctrl.Result{}, aerr
+				}
+				return ctrl.Result{}, fmt.Errorf("replicating images away from %s: %v", node.Name, err)
+			}
+		}
+	} else {
+		// Without an agent running there's nothing left to fetch from the node
+		l.Info("no ripfs agent runs on drained node", "node", node.Name)
+	}
+
+	if err := r.annotate(ctx, node, replicated, true); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Drained nodes are checked again for anything pulled since, or evicted from the manager again
+	return ctrl.Result{RequeueAfter: r.RecheckInterval}, nil
+}
+
+// rebalance releases the images replicated away from node, once it's schedulable again
+func (r *NodeDrainReconciler) rebalance(ctx context.Context, node *corev1.Node) (ctrl.Result, error) {
+	_, removable := node.Annotations[consts.NodeRemovableAnnotation]
+	replicated := replicatedRoots(node)
+	if !removable && len(replicated) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	if r.Rebalance == DrainRebalanceKeep {
+		return ctrl.Result{}, r.annotate(ctx, node, nil, false)
+	}
+
+	// An agent that can't be reached provides nothing, so only enough other peers providing an image release it
+	agent, err := r.agentPeer(ctx, node.Name)
+	if err != nil && !errors.Is(err, errAgentUnreachable) {
+		return ctrl.Result{}, err
+	}
+
+	roots, err := r.roots(ctx)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Roots held for other drained nodes, assigned to nodes or prefetched by content profiles stay pinned
+	pinned, err := registry.PinnedRoots(ctx, r.Client, r.AgentsNamespace, node.Name)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("listing pinned roots: %v", err)
+	}
+
+	held := make(map[cid.Cid]bool)
+	for _, root := range pinned {
+		held[root] = true
+	}
+
+	var released int
+	for root := range replicated {
+		provided, others, err := r.providers(ctx, root, agent)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		// The node may have come back without its agent's repo, in which case the manager keeps holding it
+		if !provided && others < r.MinReplicas {
+			continue
+		}
+
+		// Anything shared with another mapped image, or a root the cluster holds pinned, stays pinned
+		var keep []cid.Cid
+		for _, k := range append(roots, pinned...) {
+			if k != root {
+				keep = append(keep, k)
+			}
+		}
+
+		// Held for another node (or a content profile) too, so it's only released from this one
+		if held[root] {
+			delete(replicated, root)
+			released++
+			continue
+		}
+
+		if _, err := registry.Remove(ctx, r.Ipfs, root, keep); err != nil {
+			return ctrl.Result{}, fmt.Errorf("releasing %s: %v", root, err)
+		}
+		delete(replicated, root)
+		released++
+	}
+
+	if released > 0 {
+		log.FromContext(ctx).Info("released images replicated away from returned node", "node", node.Name, "released", released, "remaining", len(replicated))
+		r.Recorder.Eventf(node, corev1.EventTypeNormal, consts.NodeRebalanceReason, "Released %d images replicated to the manager while the node was drained", released)
+	}
+
+	if err := r.annotate(ctx, node, replicated, false); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if len(replicated) > 0 {
+		return ctrl.Result{RequeueAfter: r.RecheckInterval}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// annotate records the roots replicated away from node, and whether it's removable
+func (r *NodeDrainReconciler) annotate(ctx context.Context, node *corev1.Node, replicated map[cid.Cid]bool, removable bool) error {
+	patch := client.MergeFrom(node.DeepCopy())
+
+	if node.Annotations == nil {
+		node.Annotations = make(map[string]string)
+	}
+
+	if len(replicated) > 0 {
+		var roots []string
+		for root := range replicated {
+			roots = append(roots, root.String())
+		}
+		sort.Strings(roots)
+		node.Annotations[consts.NodeReplicatedAnnotation] = strings.Join(roots, ",")
+	} else {
+		delete(node.Annotations, consts.NodeReplicatedAnnotation)
+	}
+
+	if removable {
+		node.Annotations[consts.NodeRemovableAnnotation] = "true"
+	} else {
+		delete(node.Annotations, consts.NodeRemovableAnnotation)
+	}
+
+	if err := r.Client.Patch(ctx, node, patch); err != nil {
+		return fmt.Errorf("annotating %s: %v", node.Name, err)
+	}
+	return nil
+}
+
+// agentPeer returns the peer of the agent on node, found by the address it's connected to the manager from or else
+// dialed through its peer discovery registration. It's empty when no agent runs on node, and errAgentUnreachable is
+// returned for one that does but can't be connected to.
+func (r *NodeDrainReconciler) agentPeer(ctx context.Context, node string) (peer.ID, error) {
+	agents := &corev1.PodList{}
+	if err := r.Client.List(ctx, agents, client.InNamespace(r.AgentsNamespace), client.MatchingLabels{consts.AgentsLabel: consts.AgentsLabelValue}); err != nil {
+		return "", fmt.Errorf("listing the ripfs agents: %v", err)
+	}
+
+	var agent *corev1.Pod
+	for i, a := range agents.Items {
+		if a.Spec.NodeName == node {
+			agent = &agents.Items[i]
+			break
+		}
+	}
+	if agent == nil {
+		return "", nil
+	}
+	if agent.Status.PodIP == "" {
+		return "", fmt.Errorf("%w: %s has no address", errAgentUnreachable, agent.Name)
+	}
+
+	conns, err := r.Ipfs.Swarm().Peers(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, conn := range conns {
+		for _, p := range []int{multiaddr.P_IP4, multiaddr.P_IP6} {
+			if v, err := conn.Address().ValueForProtocol(p); err == nil && v == agent.Status.PodIP {
+				return conn.ID(), nil
+			}
+		}
+	}
+
+	// Agents aren't always connected, such as once the connection manager trimmed the connection
+	return r.dialAgent(ctx, agent)
+}
+
+// dialAgent connects to the agent pod by the addresses it registered for peer discovery, returning its peer
+func (r *NodeDrainReconciler) dialAgent(ctx context.Context, agent *corev1.Pod) (peer.ID, error) {
+	if r.Peers.Name == "" {
+		return "", fmt.Errorf("%w: %s isn't connected, and can't be dialed without peer discovery", errAgentUnreachable, agent.Name)
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := r.Client.Get(ctx, r.Peers, cm); err != nil {
+		return "", fmt.Errorf("reading the registered peers: %v", err)
+	}
+
+	var reg discovery.Registration
+	data, ok := cm.Data[agent.Name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s isn't connected, nor registered for peer discovery", errAgentUnreachable, agent.Name)
+	}
+	if err := json.Unmarshal([]byte(data), &reg); err != nil {
+		return "", fmt.Errorf("%w: invalid registration of %s: %v", errAgentUnreachable, agent.Name, err)
+	}
+
+	infos, err := reg.AddrInfos()
+	if err == nil && len(infos) == 0 {
+		err = fmt.Errorf("no addresses")
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid registration of %s: %v", errAgentUnreachable, agent.Name, err)
+	}
+
+	var errs error
+	for _, info := range infos {
+		dctx, cancel := context.WithTimeout(ctx, agentDialTimeout)
+		err := r.Ipfs.Swarm().Connect(dctx, info)
+		cancel()
+		if err == nil {
+			return info.ID, nil
+		}
+		errs = multierror.Append(errs, err)
+	}
+	return "", fmt.Errorf("%w: dialing %s: %v", errAgentUnreachable, agent.Name, errs)
+}
+
+// roots returns the roots of every mapped image
+func (r *NodeDrainReconciler) roots(ctx context.Context) ([]cid.Cid, error) {
+	_, mappings, err := r.Mapper.Mappings(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching mappings: %v", err)
+	}
+
+	var (
+		roots []cid.Cid
+		seen  = make(map[cid.Cid]bool)
+	)
+	for ref, v := range mappings {
+		rp, err := r.Ipfs.ResolvePath(ctx, path.New(v))
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s: %v", ref, err)
+		}
+
+		if !seen[rp.Cid()] {
+			seen[rp.Cid()] = true
+			roots = append(roots, rp.Cid())
+		}
+	}
+	return roots, nil
+}
+
+// providers reports whether agent provides root, along with how many other peers (besides the manager) do
+func (r *NodeDrainReconciler) providers(ctx context.Context, root cid.Cid, agent peer.ID) (bool, int, error) {
+	self, err := r.Ipfs.Key().Self(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+
+	fctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	provs, err := r.Ipfs.Dht().FindProviders(fctx, path.IpfsPath(root), options.Dht.NumProviders(r.MinReplicas+2))
+	if err != nil {
+		return false, 0, fmt.Errorf("finding the peers providing %s: %v", root, err)
+	}
+
+	var (
+		provided bool
+		others   int
+	)
+	for prov := range provs {
+		switch prov.ID {
+		case self.ID():
+		case agent:
+			provided = true
+		default:
+			others++
+		}
+	}
+	return provided, others, nil
+}
+
+// pinned reports whether the manager holds root in full, every object of it pinned and not only the root itself
+func (r *NodeDrainReconciler) pinned(ctx context.Context, root cid.Cid) (bool, error) {
+	return registry.Prefetched(ctx, r.Ipfs, root)
+}
+
+// replicatedRoots returns the roots recorded as replicated away from node
+func replicatedRoots(node *corev1.Node) map[cid.Cid]bool {
+	roots := make(map[cid.Cid]bool)
+	for _, s := range strings.Split(node.Annotations[consts.NodeReplicatedAnnotation], ",") {
+		if root, err := cid.Decode(strings.TrimSpace(s)); err == nil {
+			roots[root] = true
+		}
+	}
+	return roots
+}
+
+// draining reports whether node is cordoned, or about to be removed by the cluster autoscaler
+func draining(node *corev1.Node) bool {
+	if node.Spec.Unschedulable {
+		return true
+	}
+
+	for _, t := range node.Spec.Taints {
+		if t.Key == autoscalerDeletionTaint {
+			return true
+		}
+	}
+	return false
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *NodeDrainReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	changed := predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			old, ok := e.ObjectOld.(*corev1.Node)
+			if !ok {
+				return false
+			}
+			node, ok := e.ObjectNew.(*corev1.Node)
+			return ok && draining(old) != draining(node)
+		},
+		DeleteFunc: func(event.DeleteEvent) bool { return false },
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("nodedrain").
+		For(&corev1.Node{}, builder.WithPredicates(changed)).
+		Complete(r)
+}
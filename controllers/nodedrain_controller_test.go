@@ -0,0 +1,468 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/discovery"
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+// drainIpfs is an offline node's api connected to an agent from agentIP, with whichever providers it's given. Unless
+// it's dialable, the agent can't be connected to once it's disconnected.
+type drainIpfs struct {
+	iface.CoreAPI
+
+	agent     peer.ID
+	agentIP   string
+	providers map[cid.Cid][]peer.ID
+
+	disconnected bool
+	dialable     bool
+}
+
+func (d *drainIpfs) Swarm() iface.SwarmAPI {
+	return drainSwarm{d.CoreAPI.Swarm(), d}
+}
+
+func (d *drainIpfs) Dht() iface.DhtAPI {
+	return drainDht{d.CoreAPI.Dht(), d}
+}
+
+type drainSwarm struct {
+	iface.SwarmAPI
+	d *drainIpfs
+}
+
+func (s drainSwarm) Peers(context.Context) ([]iface.ConnectionInfo, error) {
+	if s.d.disconnected {
+		return nil, nil
+	}
+
+	addr, err := multiaddr.NewMultiaddr("/ip4/" + s.d.agentIP + "/tcp/4001")
+	if err != nil {
+		return nil, err
+	}
+	return []iface.ConnectionInfo{conn{id: s.d.agent, addr: addr}}, nil
+}
+
+func (s drainSwarm) Connect(_ context.Context, info peer.AddrInfo) error {
+	if info.ID != s.d.agent || !s.d.dialable {
+		return fmt.Errorf("dialing %s: unreachable", info.ID)
+	}
+	s.d.disconnected = false
+	return nil
+}
+
+type conn struct {
+	iface.ConnectionInfo
+	id   peer.ID
+	addr multiaddr.Multiaddr
+}
+
+func (c conn) ID() peer.ID                  { return c.id }
+func (c conn) Address() multiaddr.Multiaddr { return c.addr }
+
+type drainDht struct {
+	iface.DhtAPI
+	d *drainIpfs
+}
+
+func (h drainDht) FindProviders(_ context.Context, p path.Path, _ ...options.DhtFindProvidersOption) (<-chan peer.AddrInfo, error) {
+	rp, err := h.d.ResolvePath(context.Background(), p)
+	if err != nil {
+		return nil, err
+	}
+
+	provs := h.d.providers[rp.Cid()]
+	ch := make(chan peer.AddrInfo, len(provs))
+	for _, id := range provs {
+		ch <- peer.AddrInfo{ID: id}
+	}
+	close(ch)
+	return ch, nil
+}
+
+// staticLister lists the same mappings every time
+type staticLister map[string]string
+
+func (l staticLister) Mappings(context.Context) (path.Path, map[string]string, error) {
+	return nil, l, nil
+}
+
+func testingPeer(t *testing.T) peer.ID {
+	_, pub, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// addStored adds a random image to api, leaving every object but its root (when pinRoot is set) unpinned though still
+// stored, the way images evicted from the manager (but not yet collected) are
+func addStored(t *testing.T, ctx context.Context, api iface.CoreAPI, pinRoot bool) cid.Cid {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := registry.AddImage(ctx, api, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := registry.References(ctx, api, p.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range refs {
+		if pinRoot && c == p.Cid() {
+			continue
+		}
+		if err := api.Pin().Rm(ctx, path.IpfsPath(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p.Cid()
+}
+
+func testingNodeDrainReconciler(t *testing.T, api iface.CoreAPI, mappings staticLister, objs ...client.Object) (*NodeDrainReconciler, *record.FakeRecorder) {
+	agent := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "agents-abcde", Namespace: "ripfs-system", Labels: map[string]string{consts.AgentsLabel: consts.AgentsLabelValue}},
+		Spec:       corev1.PodSpec{NodeName: "node-a"},
+		Status:     corev1.PodStatus{PodIP: "10.0.0.1"},
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	return &NodeDrainReconciler{
+		Client:          fake.NewClientBuilder().WithScheme(testingScheme(t)).WithObjects(append(objs, agent)...).Build(),
+		Recorder:        recorder,
+		Ipfs:            api,
+		Mapper:          mappings,
+		AgentsNamespace: "ripfs-system",
+		MinReplicas:     1,
+		Rebalance:       DrainRebalanceRelease,
+		RecheckInterval: time.Minute,
+	}, recorder
+}
+
+func annotatedRoots(roots ...cid.Cid) string {
+	var s []string
+	for _, root := range roots {
+		s = append(s, root.String())
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func TestNodeDrainReplicate(t *testing.T) {
+	ctx := context.Background()
+
+	api := testingIpfs(t, ctx)
+	agent, other := testingPeer(t), testingPeer(t)
+
+	var (
+		// Only provided by the drained node's agent
+		only = addStored(t, ctx, api, false)
+		// Provided by enough other peers too
+		shared = addStored(t, ctx, api, false)
+		// Only provided by the agent, with nothing but its root held by the manager
+		partial = addStored(t, ctx, api, true)
+	)
+
+	d := &drainIpfs{CoreAPI: api, agent: agent, agentIP: "10.0.0.1", providers: map[cid.Cid][]peer.ID{
+		only:    {agent},
+		shared:  {agent, other},
+		partial: {agent},
+	}}
+
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}, Spec: corev1.NodeSpec{Unschedulable: true}}
+	r, recorder := testingNodeDrainReconciler(t, d, staticLister{
+		"docker.io/library/only:latest":    "/ipfs/" + only.String(),
+		"docker.io/library/shared:latest":  "/ipfs/" + shared.String(),
+		"docker.io/library/partial:latest": "/ipfs/" + partial.String(),
+	}, node)
+
+	res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(node)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RequeueAfter != r.RecheckInterval {
+		t.Errorf("expected the drained node to be checked again after %s, got %s", r.RecheckInterval, res.RequeueAfter)
+	}
+
+	got := &corev1.Node{}
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(node), got); err != nil {
+		t.Fatal(err)
+	}
+	if want := annotatedRoots(only, partial); got.Annotations[consts.NodeReplicatedAnnotation] != want {
+		t.Errorf("expected %s to be replicated, got %s", want, got.Annotations[consts.NodeReplicatedAnnotation])
+	}
+	if got.Annotations[consts.NodeRemovableAnnotation] != "true" {
+		t.Errorf("expected the node to be removable, got %v", got.Annotations)
+	}
+
+	// Replicated images are held in full, not only their root
+	for _, root := range []cid.Cid{only, partial} {
+		if ok, err := registry.Prefetched(ctx, api, root); err != nil || !ok {
+			t.Errorf("expected %s to be pinned in full, got %v: %v", root, ok, err)
+		}
+	}
+	if ok, err := registry.Prefetched(ctx, api, shared); err != nil || ok {
+		t.Errorf("expected %s provided by other peers not to be pinned, got %v: %v", shared, ok, err)
+	}
+
+	if e := events(recorder); len(e) != 1 || !strings.Contains(e[0], consts.NodeDrainReason) || !strings.Contains(e[0], "Replicated 2 images") {
+		t.Errorf("expected a drain event, got %v", e)
+	}
+}
+
+func TestNodeDrainNoAgent(t *testing.T) {
+	ctx := context.Background()
+
+	api := testingIpfs(t, ctx)
+	root := addStored(t, ctx, api, false)
+
+	// The agent runs on another node, so there's nothing left to fetch from this one
+	d := &drainIpfs{CoreAPI: api, agent: testingPeer(t), agentIP: "10.0.0.1", providers: map[cid.Cid][]peer.ID{}}
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-b"},
+		Spec:       corev1.NodeSpec{Taints: []corev1.Taint{{Key: autoscalerDeletionTaint, Effect: corev1.TaintEffectNoSchedule}}},
+	}
+	r, recorder := testingNodeDrainReconciler(t, d, staticLister{"docker.io/library/only:latest": "/ipfs/" + root.String()}, node)
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(node)}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := &corev1.Node{}
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(node), got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Annotations[consts.NodeRemovableAnnotation] != "true" || got.Annotations[consts.NodeReplicatedAnnotation] != "" {
+		t.Errorf("expected the node to be removable without replicating anything, got %v", got.Annotations)
+	}
+	if e := events(recorder); len(e) != 0 {
+		t.Errorf("expected no events, got %v", e)
+	}
+}
+
+func TestNodeDrainUnreachableAgent(t *testing.T) {
+	ctx := context.Background()
+
+	api := testingIpfs(t, ctx)
+	agent := testingPeer(t)
+	only := addStored(t, ctx, api, false)
+	mappings := staticLister{"docker.io/library/only:latest": "/ipfs/" + only.String()}
+
+	// The agent registered for peer discovery, which it's dialed by once it isn't connected
+	registration, err := json.Marshal(discovery.Registration{Addrs: []string{"/ip4/10.0.0.1/tcp/4001/p2p/" + agent.String()}, Seen: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "ripfs-peers", Namespace: "ripfs-system"},
+		Data:       map[string]string{"agents-abcde": string(registration)},
+	}
+
+	tests := []struct {
+		name     string
+		dialable bool
+		peers    bool
+	}{
+		{name: "without peer discovery"},
+		{name: "unreachable", peers: true},
+		{name: "dialed", peers: true, dialable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &drainIpfs{CoreAPI: api, agent: agent, agentIP: "10.0.0.1", providers: map[cid.Cid][]peer.ID{only: {agent}}, disconnected: true, dialable: tt.dialable}
+			node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}, Spec: corev1.NodeSpec{Unschedulable: true}}
+			r, _ := testingNodeDrainReconciler(t, d, mappings, node, peers)
+			if tt.peers {
+				r.Peers = client.ObjectKeyFromObject(peers)
+			}
+
+			res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(node)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := &corev1.Node{}
+			if err := r.Client.Get(ctx, client.ObjectKeyFromObject(node), got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !tt.dialable {
+				// What only the agent holds can't be known, so the node isn't removable until it's reached
+				if _, ok := got.Annotations[consts.NodeRemovableAnnotation]; ok {
+					t.Errorf("expected the node not to be removable, got %v", got.Annotations)
+				}
+				if res.RequeueAfter != agentRetryInterval {
+					t.Errorf("expected the agent to be retried after %s, got %s", agentRetryInterval, res.RequeueAfter)
+				}
+				return
+			}
+
+			if got.Annotations[consts.NodeRemovableAnnotation] != "true" || got.Annotations[consts.NodeReplicatedAnnotation] != only.String() {
+				t.Errorf("expected %s to be replicated from the dialed agent, got %v", only, got.Annotations)
+			}
+		})
+	}
+}
+
+func TestNodeDrainRebalance(t *testing.T) {
+	tests := []struct {
+		name      string
+		rebalance DrainRebalance
+		released  bool
+	}{
+		{name: "release", rebalance: DrainRebalanceRelease, released: true},
+		{name: "keep", rebalance: DrainRebalanceKeep},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			api := testingIpfs(t, ctx)
+			agent := testingPeer(t)
+
+			var (
+				// Provided by the returned node's agent again
+				provided = addStored(t, ctx, api, false)
+				// Assigned to another node, so the manager keeps holding it
+				assigned = addStored(t, ctx, api, false)
+				// Lost with the node's repo
+				lost = addStored(t, ctx, api, false)
+			)
+
+			mappings := staticLister{}
+			for i, root := range []cid.Cid{provided, assigned, lost} {
+				mappings["docker.io/library/"+string(rune('a'+i))+":latest"] = "/ipfs/" + root.String()
+			}
+
+			d := &drainIpfs{CoreAPI: api, agent: agent, agentIP: "10.0.0.1", providers: map[cid.Cid][]peer.ID{
+				provided: {agent},
+				assigned: {agent},
+			}}
+
+			node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+				Name: "node-a",
+				Annotations: map[string]string{
+					consts.NodeReplicatedAnnotation: annotatedRoots(provided, assigned, lost),
+					consts.NodeRemovableAnnotation:  "true",
+				},
+			}}
+			pinning := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+				Name:        "node-c",
+				Annotations: map[string]string{consts.NodePinnedAnnotation: assigned.String()},
+			}}
+			r, recorder := testingNodeDrainReconciler(t, d, mappings, node, pinning)
+			r.Rebalance = tt.rebalance
+
+			// Everything was replicated while the node was drained
+			if _, err := registry.Prefetch(ctx, api, []cid.Cid{provided, assigned, lost}); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(node)}); err != nil {
+				t.Fatal(err)
+			}
+
+			got := &corev1.Node{}
+			if err := r.Client.Get(ctx, client.ObjectKeyFromObject(node), got); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := got.Annotations[consts.NodeRemovableAnnotation]; ok {
+				t.Errorf("expected the returned node not to be removable, got %v", got.Annotations)
+			}
+
+			pinned := func(root cid.Cid) bool {
+				ok, err := registry.Prefetched(ctx, api, root)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return ok
+			}
+
+			if !tt.released {
+				if _, ok := got.Annotations[consts.NodeReplicatedAnnotation]; ok {
+					t.Errorf("expected the replicated images to be forgotten, got %v", got.Annotations)
+				}
+				for _, root := range []cid.Cid{provided, assigned, lost} {
+					if !pinned(root) {
+						t.Errorf("expected %s to be kept pinned", root)
+					}
+				}
+				if e := events(recorder); len(e) != 0 {
+					t.Errorf("expected no events, got %v", e)
+				}
+				return
+			}
+
+			// Only what the node lost is still held for it
+			if want := annotatedRoots(lost); got.Annotations[consts.NodeReplicatedAnnotation] != want {
+				t.Errorf("expected only %s to still be replicated, got %s", want, got.Annotations[consts.NodeReplicatedAnnotation])
+			}
+			if pinned(provided) {
+				t.Errorf("expected %s provided by the node again to be released", provided)
+			}
+			if !pinned(assigned) {
+				t.Errorf("expected %s assigned to another node to stay pinned", assigned)
+			}
+			if !pinned(lost) {
+				t.Errorf("expected %s lost with the node to stay pinned", lost)
+			}
+
+			if e := events(recorder); len(e) != 1 || !strings.Contains(e[0], consts.NodeRebalanceReason) || !strings.Contains(e[0], "Released 2 images") {
+				t.Errorf("expected a rebalance event, got %v", e)
+			}
+		})
+	}
+}
+
+func TestDraining(t *testing.T) {
+	tests := []struct {
+		name string
+		spec corev1.NodeSpec
+		want bool
+	}{
+		{name: "schedulable"},
+		{name: "cordoned", spec: corev1.NodeSpec{Unschedulable: true}, want: true},
+		{name: "removed by the autoscaler", spec: corev1.NodeSpec{Taints: []corev1.Taint{{Key: autoscalerDeletionTaint}}}, want: true},
+		{name: "other taints", spec: corev1.NodeSpec{Taints: []corev1.Taint{{Key: "node.kubernetes.io/not-ready"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := draining(&corev1.Node{Spec: tt.spec}); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
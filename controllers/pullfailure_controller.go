@@ -0,0 +1,462 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/registry"
+	"github.com/joshrwolf/ripfs/internal/webhook"
+)
+
+// The waiting reasons of containers whose image can't be pulled
+const (
+	reasonErrImagePull     = "ErrImagePull"
+	reasonImagePullBackOff = "ImagePullBackOff"
+)
+
+// PullFailureReconciler explains why pods fail to pull images rewritten to the ripfs registry, which the kubelet only
+// reports as a failed request. Once a pod's container starts failing to pull, the agent serving the registry on its
+// node and the swarm are asked about the image, and a warning event with the likely cause is attached to the pod.
+//
+// Containers that keep failing can also be rolled back to the image they were rewritten from, so applications heal
+// while operators investigate. The pod is patched back to the original image, and its deployment, statefulset or
+// daemonset annotated so its pods aren't rewritten again until the annotation is removed.
+type PullFailureReconciler struct {
+	// Client patches the pods and workloads rolled back, and Reader reads their workloads from any namespace
+	Client client.Client
+	Reader client.Reader
+
+	// Pods is a cache of every pod in the cluster, rather than only those of the manager's namespace
+	Pods cache.Cache
+
+	Recorder record.EventRecorder
+
+	// Diagnose attaches the likely cause of pull failures to pods
+	Diagnose bool
+
+	// RollbackAfter, if set, rolls containers back to their original image once they've failed to pull from ripfs
+	// this many times, as long as the upstream registry is reachable
+	RollbackAfter int
+
+	// Upstream returns an error unless an original image can be pulled instead, webhook.UpstreamReachable if nil
+	Upstream func(ctx context.Context, image string) error
+
+	// Ipfs finds the peers providing images
+	Ipfs iface.CoreAPI
+
+	// Mapper resolves images rewritten by name to their roots
+	Mapper registry.Lister
+
+	// Registry returns the host pods are currently rewritten to pull ripfs images from
+	Registry func() string
+
+	// AgentsNamespace is the namespace the agents serving the registry on every node run in
+	AgentsNamespace string
+
+	// HTTPClient asks agents for manifests, http.DefaultClient if nil
+	HTTPClient *http.Client
+
+	// failures counts the failed pulls of each container
+	mu       sync.Mutex
+	failures map[containerKey]int
+}
+
+// containerKey is a container of a pod
+type containerKey struct {
+	pod       client.ObjectKey
+	container string
+}
+
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets;replicasets,verbs=get;patch
+
+func (r *PullFailureReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	pod := &corev1.Pod{}
+	if err := r.Pods.Get(ctx, req.NamespacedName, pod); err != nil {
+		if errors.IsNotFound(err) {
+			r.forget(req.NamespacedName)
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	for _, s := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		if !pullFailing(s) {
+			continue
+		}
+
+		ref, err := name.ParseReference(s.Image)
+		if err != nil || ref.Context().RegistryStr() != r.Registry() {
+			continue
+		}
+
+		n := r.failed(containerKey{pod: req.NamespacedName, container: s.Name}, s.State.Waiting.Reason)
+
+		if r.Diagnose && n == 1 {
+			cause := r.diagnose(ctx, pod, ref)
+			l.Info("diagnosed pull failure", "pod", req.NamespacedName.String(), "image", ref.String(), "cause", cause)
+			r.Recorder.Eventf(pod, corev1.EventTypeWarning, consts.PullFailureReason, "Failed to pull %s: %s", ref, cause)
+		}
+
+		if r.RollbackAfter > 0 && n >= r.RollbackAfter {
+			if err := r.rollback(ctx, pod, s.Name, n); err != nil {
+				l.Error(err, "rolling back", "pod", req.NamespacedName.String(), "container", s.Name)
+			}
+		}
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// failed counts a failed pull of the container at key, returning how many it has failed. Every ErrImagePull is a pull
+// that failed, while backing off only counts when no failure was seen yet (such as after the manager restarted).
+func (r *PullFailureReconciler) failed(key containerKey, reason string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.failures == nil {
+		r.failures = make(map[containerKey]int)
+	}
+
+	if reason == reasonErrImagePull || r.failures[key] == 0 {
+		r.failures[key]++
+	}
+	return r.failures[key]
+}
+
+// forget drops the failures of every container of pod, once it's gone
+func (r *PullFailureReconciler) forget(pod client.ObjectKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k := range r.failures {
+		if k.pod == pod {
+			delete(r.failures, k)
+		}
+	}
+}
+
+// rollback rolls container of pod back to the image the webhook rewrote it from, along with the workload pod belongs
+// to, as long as that image can be pulled instead
+func (r *PullFailureReconciler) rollback(ctx context.Context, pod *corev1.Pod, container string, failures int) error {
+	original, ok := webhook.OriginalImages(pod)[container]
+	if !ok {
+		return nil
+	}
+
+	upstream := r.Upstream
+	if upstream == nil {
+		upstream = func(ctx context.Context, image string) error {
+			return webhook.UpstreamReachable(ctx, image)
+		}
+	}
+
+	uctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if err := upstream(uctx, original); err != nil {
+		return fmt.Errorf("not rolling back to %s: %v", original, err)
+	}
+
+	workload, err := r.workload(ctx, pod)
+	if err != nil {
+		return fmt.Errorf("finding the workload of %s: %v", pod.Name, err)
+	}
+
+	if workload != nil {
+		patch := client.MergeFrom(workload.DeepCopyObject().(client.Object))
+
+		tmpl := podTemplate(workload)
+		if tmpl.Annotations == nil {
+			tmpl.Annotations = make(map[string]string)
+		}
+		tmpl.Annotations[consts.RollbackAnnotation] = webhook.AddRollback(tmpl.Annotations, original)
+
+		if err := r.Client.Patch(ctx, workload, patch); err != nil {
+			return fmt.Errorf("rolling back %s: %v", workload.GetName(), err)
+		}
+	}
+
+	// The pod itself is rolled back too, it may never be replaced by its workload while it's failing
+	patch := client.StrategicMergeFrom(pod.DeepCopy())
+
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[consts.RollbackAnnotation] = webhook.AddRollback(pod.Annotations, original)
+
+	for _, cs := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range cs {
+			if cs[i].Name == container {
+				cs[i].Image = original
+			}
+		}
+	}
+
+	if err := r.Client.Patch(ctx, pod, patch); err != nil {
+		return fmt.Errorf("rolling back %s: %v", pod.Name, err)
+	}
+
+	r.Recorder.Eventf(pod, corev1.EventTypeWarning, consts.RollbackReason, "Rolled %s back to %s after %d failed pulls from ripfs", container, original, failures)
+	return nil
+}
+
+// workload returns the deployment, statefulset, daemonset or replicaset pod belongs to, if any
+func (r *PullFailureReconciler) workload(ctx context.Context, pod *corev1.Pod) (client.Object, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || !strings.HasPrefix(owner.APIVersion, appsv1.GroupName+"/") {
+		return nil, nil
+	}
+
+	key := client.ObjectKey{Namespace: pod.Namespace, Name: owner.Name}
+	switch owner.Kind {
+	case "StatefulSet":
+		sts := &appsv1.StatefulSet{}
+		return sts, r.Reader.Get(ctx, key, sts)
+
+	case "DaemonSet":
+		ds := &appsv1.DaemonSet{}
+		return ds, r.Reader.Get(ctx, key, ds)
+
+	case "ReplicaSet":
+		rs := &appsv1.ReplicaSet{}
+		if err := r.Reader.Get(ctx, key, rs); err != nil {
+			return nil, err
+		}
+
+		// Replica sets are rolled back through their deployment, which would otherwise replace them
+		if o := metav1.GetControllerOf(rs); o != nil && o.Kind == "Deployment" {
+			deploy := &appsv1.Deployment{}
+			return deploy, r.Reader.Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: o.Name}, deploy)
+		}
+		return rs, nil
+	}
+	return nil, nil
+}
+
+// podTemplate returns the pod template of a workload returned by workload
+func podTemplate(workload client.Object) *corev1.PodTemplateSpec {
+	switch w := workload.(type) {
+	case *appsv1.Deployment:
+		return &w.Spec.Template
+	case *appsv1.StatefulSet:
+		return &w.Spec.Template
+	case *appsv1.DaemonSet:
+		return &w.Spec.Template
+	case *appsv1.ReplicaSet:
+		return &w.Spec.Template
+	}
+	panic(fmt.Sprintf("not a workload: %T", workload))
+}
+
+// diagnose returns the likely cause of pod failing to pull ref, from the agent on its node and the peers providing it
+func (r *PullFailureReconciler) diagnose(ctx context.Context, pod *corev1.Pod, ref name.Reference) string {
+	repo := ref.Context().RepositoryStr()
+
+	var roots []cid.Cid
+	if root, err := cid.Decode(strings.TrimPrefix(repo, "ipfs/")); strings.HasPrefix(repo, "ipfs/") && err == nil {
+		roots = []cid.Cid{root}
+	} else {
+		_, mappings, err := r.Mapper.Mappings(ctx)
+		if err != nil {
+			return fmt.Sprintf("the mappings images are served by name with can't be read: %v", err)
+		}
+
+		if roots = registry.NamedRoots(mappings, repo, ref.Identifier()); len(roots) == 0 {
+			return fmt.Sprintf("%s is no longer mapped, add it again or recreate the pod to pull it upstream", repo)
+		}
+	}
+
+	var causes []string
+	served, agentCause := r.askAgent(ctx, pod.Spec.NodeName, repo, ref.Identifier())
+	if served {
+		return agentCause
+	}
+	causes = append(causes, agentCause)
+
+	for _, root := range roots {
+		causes = append(causes, r.providers(ctx, root))
+	}
+	return strings.Join(causes, "; ")
+}
+
+// askAgent asks the agent on node for the manifest, reporting whether it's served along with what went wrong
+func (r *PullFailureReconciler) askAgent(ctx context.Context, node string, repo string, reference string) (bool, string) {
+	agents := &corev1.PodList{}
+	if err := r.Pods.List(ctx, agents, client.InNamespace(r.AgentsNamespace), client.MatchingLabels{consts.AgentsLabel: consts.AgentsLabelValue}); err != nil {
+		return false, fmt.Sprintf("listing the ripfs agents: %v", err)
+	}
+
+	var agent *corev1.Pod
+	for i := range agents.Items {
+		if a := &agents.Items[i]; a.Spec.NodeName == node && podReady(a) && a.Status.PodIP != "" {
+			agent = a
+			break
+		}
+	}
+	if agent == nil {
+		return false, fmt.Sprintf("no ready ripfs agent is serving the registry on node %s", node)
+	}
+
+	hc := r.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	actx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	host := net.JoinHostPort(agent.Status.PodIP, strconv.Itoa(consts.AgentsRegistryPort))
+	req, err := http.NewRequestWithContext(actx, http.MethodHead, "http://"+host+"/v2/"+repo+"/manifests/"+reference, nil)
+	if err != nil {
+		return false, err.Error()
+	}
+	for _, mt := range []types.MediaType{types.OCIImageIndex, types.OCIManifestSchema1, types.DockerManifestList, types.DockerManifestSchema2} {
+		req.Header.Add("Accept", string(mt))
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return false, fmt.Sprintf("the ripfs agent %s on node %s doesn't serve the manifest: %v", agent.Name, node, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Sprintf("the ripfs agent %s on node %s fails to serve the manifest: %s", agent.Name, node, resp.Status)
+	}
+	return true, fmt.Sprintf("the ripfs agent %s on node %s serves it, so the node's container runtime likely can't reach %s (is it allowed to pull from it over http?)", agent.Name, node, r.Registry())
+}
+
+// providers reports how many peers provide root
+func (r *PullFailureReconciler) providers(ctx context.Context, root cid.Cid) string {
+	fctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	provs, err := r.Ipfs.Dht().FindProviders(fctx, path.IpfsPath(root), options.Dht.NumProviders(3))
+	if err != nil {
+		return fmt.Sprintf("finding the peers providing %s: %v", root, err)
+	}
+
+	n := 0
+	for range provs {
+		n++
+	}
+
+	if n == 0 {
+		return fmt.Sprintf("no peer provides %s, it may have been garbage collected or the peers storing it are down", root)
+	}
+	return fmt.Sprintf("%d peers provide %s", n, root)
+}
+
+// pullFailing reports whether the container of s is failing to pull its image
+func pullFailing(s corev1.ContainerStatus) bool {
+	w := s.State.Waiting
+	return w != nil && (w.Reason == reasonErrImagePull || w.Reason == reasonImagePullBackOff)
+}
+
+// pullFailed reports whether any container of pod has failed to pull again since old, either starting to fail or
+// failing once more after backing off
+func pullFailed(old, pod *corev1.Pod) bool {
+	reasons := make(map[string]string)
+	if old != nil {
+		for _, s := range append(old.Status.InitContainerStatuses, old.Status.ContainerStatuses...) {
+			if pullFailing(s) {
+				reasons[s.Name] = s.State.Waiting.Reason
+			}
+		}
+	}
+
+	for _, s := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		if !pullFailing(s) {
+			continue
+		}
+
+		if prev, ok := reasons[s.Name]; !ok || (s.State.Waiting.Reason == reasonErrImagePull && prev != reasonErrImagePull) {
+			return true
+		}
+	}
+	return false
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PullFailureReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	c, err := controller.New("pullfailure", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	failing := predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			pod, ok := e.Object.(*corev1.Pod)
+			return ok && pullFailed(nil, pod)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			old, ok := e.ObjectOld.(*corev1.Pod)
+			if !ok {
+				return false
+			}
+			pod, ok := e.ObjectNew.(*corev1.Pod)
+			return ok && pullFailed(old, pod)
+		},
+		// Deleted pods are reconciled to forget their failures
+		DeleteFunc:  func(event.DeleteEvent) bool { return true },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+	}
+
+	return c.Watch(source.NewKindWithCache(&corev1.Pod{}, r.Pods), &handler.EnqueueRequestForObject{}, failing)
+}
@@ -0,0 +1,316 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+// readerCache serves a cache's reads from a client, none of its informers are used
+type readerCache struct {
+	cache.Informers
+	client.Reader
+}
+
+const (
+	testingRegistry = "localhost:31609"
+	testingRoot     = "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"
+)
+
+// failingPod is a pod of a deployment whose app container, rewritten from nginx:1.21 to image, fails to pull for reason
+func failingPod(image string, reason string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-7d4b9-x2x4z",
+			Namespace: "default",
+			Annotations: map[string]string{
+				consts.OriginalImagesAnnotation: `{"app":"nginx:1.21"}`,
+			},
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app-7d4b9", Controller: boolPtr(true)}},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-a",
+			Containers: []corev1.Container{{Name: "app", Image: image}, {Name: "sidecar", Image: "busybox"}},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "app", Image: image, State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}}},
+				{Name: "sidecar", Image: "busybox", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+			},
+		},
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func testingPullFailureReconciler(t *testing.T, objs ...client.Object) (*PullFailureReconciler, *record.FakeRecorder) {
+	deploy := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Name:            "app-7d4b9",
+		Namespace:       "default",
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "app", Controller: boolPtr(true)}},
+	}}
+
+	c := fake.NewClientBuilder().WithScheme(testingScheme(t)).WithObjects(append(objs, deploy, rs)...).Build()
+	recorder := record.NewFakeRecorder(10)
+	return &PullFailureReconciler{
+		Client:          c,
+		Reader:          c,
+		Pods:            readerCache{Reader: c},
+		Recorder:        recorder,
+		Mapper:          registry.NewImageCidMapper(c, "ripfs-system"),
+		Registry:        func() string { return testingRegistry },
+		AgentsNamespace: "ripfs-system",
+		Upstream:        func(context.Context, string) error { return nil },
+	}, recorder
+}
+
+// setWaiting has the app container of the pod at key wait for reason
+func setWaiting(t *testing.T, ctx context.Context, c client.Client, key types.NamespacedName, reason string) {
+	pod := &corev1.Pod{}
+	if err := c.Get(ctx, key, pod); err != nil {
+		t.Fatal(err)
+	}
+	pod.Status.ContainerStatuses[0].State.Waiting.Reason = reason
+	if err := c.Status().Update(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func events(recorder *record.FakeRecorder) []string {
+	var got []string
+	for {
+		select {
+		case e := <-recorder.Events:
+			got = append(got, e)
+		default:
+			return got
+		}
+	}
+}
+
+func TestPullFailureRollback(t *testing.T) {
+	ctx := context.Background()
+
+	pod := failingPod(testingRegistry+"/ipfs/"+testingRoot, reasonErrImagePull)
+	r, recorder := testingPullFailureReconciler(t, pod)
+	r.RollbackAfter = 2
+
+	key := client.ObjectKeyFromObject(pod)
+	reconcile := func() {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first failure, and backing off from it, aren't enough to roll back
+	reconcile()
+	setWaiting(t, ctx, r.Client, key, reasonImagePullBackOff)
+	reconcile()
+
+	got := &corev1.Pod{}
+	if err := r.Client.Get(ctx, key, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Spec.Containers[0].Image != pod.Spec.Containers[0].Image {
+		t.Fatalf("expected the pod not to be rolled back after a single failed pull, got %s", got.Spec.Containers[0].Image)
+	}
+
+	// Failing once more rolls the container, and its deployment, back
+	setWaiting(t, ctx, r.Client, key, reasonErrImagePull)
+	reconcile()
+
+	if err := r.Client.Get(ctx, key, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Spec.Containers[0].Image != "nginx:1.21" {
+		t.Errorf("expected the container to be rolled back to nginx:1.21, got %s", got.Spec.Containers[0].Image)
+	}
+	if got.Spec.Containers[1].Image != "busybox" {
+		t.Errorf("expected the other containers to be left alone, got %s", got.Spec.Containers[1].Image)
+	}
+	if got.Annotations[consts.RollbackAnnotation] != "nginx:1.21" {
+		t.Errorf("expected the pod to be annotated with the rolled back image, got %v", got.Annotations)
+	}
+
+	deploy := &appsv1.Deployment{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: "app", Namespace: "default"}, deploy); err != nil {
+		t.Fatal(err)
+	}
+	if deploy.Spec.Template.Annotations[consts.RollbackAnnotation] != "nginx:1.21" {
+		t.Errorf("expected the deployment (rather than its replica set) to be annotated, got %v", deploy.Spec.Template.Annotations)
+	}
+
+	if e := events(recorder); len(e) != 1 || !strings.Contains(e[0], consts.RollbackReason) || !strings.Contains(e[0], "after 2 failed pulls") {
+		t.Errorf("expected a rollback event, got %v", e)
+	}
+
+	// Deleted pods are forgotten
+	if err := r.Client.Delete(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if len(r.failures) != 0 {
+		t.Errorf("expected the failures of a deleted pod to be forgotten, got %v", r.failures)
+	}
+}
+
+func TestPullFailureNoRollback(t *testing.T) {
+	tests := []struct {
+		name     string
+		image    string
+		upstream error
+	}{
+		{name: "upstream unreachable", image: testingRegistry + "/ipfs/" + testingRoot, upstream: fmt.Errorf("unreachable")},
+		{name: "not from ripfs", image: "docker.io/library/nginx:1.21"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			pod := failingPod(tt.image, reasonErrImagePull)
+			r, recorder := testingPullFailureReconciler(t, pod)
+			r.RollbackAfter = 1
+			r.Upstream = func(context.Context, string) error { return tt.upstream }
+
+			if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(pod)}); err != nil {
+				t.Fatal(err)
+			}
+
+			got := &corev1.Pod{}
+			if err := r.Client.Get(ctx, client.ObjectKeyFromObject(pod), got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Spec.Containers[0].Image != tt.image {
+				t.Errorf("expected the pod not to be rolled back, got %s", got.Spec.Containers[0].Image)
+			}
+			if e := events(recorder); len(e) != 0 {
+				t.Errorf("expected no events, got %v", e)
+			}
+		})
+	}
+}
+
+func TestPullFailureDiagnose(t *testing.T) {
+	ctx := context.Background()
+
+	// Every agent is reached at the test server, wherever it runs
+	var served bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !served {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, ts.Listener.Addr().String())
+		},
+	}}
+
+	agent := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "agents-abcde", Namespace: "ripfs-system", Labels: map[string]string{consts.AgentsLabel: consts.AgentsLabelValue}},
+		Spec:       corev1.PodSpec{NodeName: "node-a"},
+		Status: corev1.PodStatus{
+			PodIP:      "10.0.0.1",
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		image  string
+		agent  bool
+		served bool
+		want   string
+	}{
+		{name: "unmapped", image: testingRegistry + "/library/nginx:1.21", agent: true, want: "is no longer mapped"},
+		{name: "no agent", image: testingRegistry + "/ipfs/" + testingRoot, want: "no ready ripfs agent is serving the registry on node node-a"},
+		{name: "not served", image: testingRegistry + "/ipfs/" + testingRoot, agent: true, want: "fails to serve the manifest: 404"},
+		{name: "served", image: testingRegistry + "/ipfs/" + testingRoot, agent: true, served: true, want: "node's container runtime likely can't reach " + testingRegistry},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			served = tt.served
+
+			pod := failingPod(tt.image, reasonErrImagePull)
+			objs := []client.Object{pod}
+			if tt.agent {
+				objs = append(objs, agent.DeepCopy())
+			}
+
+			r, recorder := testingPullFailureReconciler(t, objs...)
+			r.Diagnose = true
+			r.HTTPClient = hc
+			r.Ipfs = testingIpfs(t, ctx)
+
+			key := client.ObjectKeyFromObject(pod)
+			if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+				t.Fatal(err)
+			}
+
+			e := events(recorder)
+			if len(e) != 1 || !strings.Contains(e[0], consts.PullFailureReason) || !strings.Contains(e[0], tt.want) {
+				t.Fatalf("expected a pull failure event explaining %q, got %v", tt.want, e)
+			}
+
+			// Only the first failure is diagnosed
+			setWaiting(t, ctx, r.Client, key, reasonErrImagePull)
+			if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+				t.Fatal(err)
+			}
+			if e := events(recorder); len(e) != 0 {
+				t.Errorf("expected a failure to only be diagnosed once, got %v", e)
+			}
+		})
+	}
+}
+
+func TestPullFailed(t *testing.T) {
+	image := testingRegistry + "/ipfs/" + testingRoot
+	running := failingPod(image, reasonErrImagePull)
+	running.Status.ContainerStatuses[0].State = corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+
+	tests := []struct {
+		name string
+		old  *corev1.Pod
+		pod  *corev1.Pod
+		want bool
+	}{
+		{name: "created failing", pod: failingPod(image, reasonErrImagePull), want: true},
+		{name: "created running", pod: running},
+		{name: "starts failing", old: running, pod: failingPod(image, reasonErrImagePull), want: true},
+		{name: "backing off", old: failingPod(image, reasonErrImagePull), pod: failingPod(image, reasonImagePullBackOff)},
+		{name: "failing again", old: failingPod(image, reasonImagePullBackOff), pod: failingPod(image, reasonErrImagePull), want: true},
+		{name: "still failing", old: failingPod(image, reasonErrImagePull), pod: failingPod(image, reasonErrImagePull)},
+		{name: "recovered", old: failingPod(image, reasonErrImagePull), pod: running},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pullFailed(tt.old, tt.pod); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
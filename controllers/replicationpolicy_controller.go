@@ -0,0 +1,280 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/joshrwolf/ripfs/api/v1alpha1"
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+// ReplicationPolicyReconciler assigns every mapped image with a replication policy to the nodes that pin it, so its
+// pulls are served from the nodes that will actually run it.
+//
+// Each policy's image is assigned to its Replicas nodes (every one if 0) among those matching its node selector that
+// are ready, schedulable and run an agent. Nodes are picked by rendezvous hashing, so an image only moves when one of
+// its nodes goes away (or a better placed one joins). A node's assigned roots are listed in its ripfs.dev/pinned
+// annotation, which its agent pins (and releases once they're dropped from it).
+type ReplicationPolicyReconciler struct {
+	Client   client.Client
+	Recorder record.EventRecorder
+
+	// Ipfs resolves the mapped images' roots
+	Ipfs iface.CoreAPI
+
+	// Mapper lists the mapped images
+	Mapper registry.Lister
+
+	// PoliciesKey is the config map holding the replication policies
+	PoliciesKey types.NamespacedName
+
+	// AgentsNamespace is the namespace the agents serving the registry on every node run in
+	AgentsNamespace string
+
+	// ResyncInterval is how often the policies are assigned again, besides whenever an image is (re)mapped
+	ResyncInterval time.Duration
+}
+
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+func (r *ReplicationPolicyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	cm := &corev1.ConfigMap{}
+	if err := r.Client.Get(ctx, r.PoliciesKey, cm); err != nil && !errors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+
+	policies, err := registry.ParseReplicationPolicies(cm.Data[consts.ReplicationPoliciesKey])
+	if err != nil {
+		r.Recorder.Eventf(cm, corev1.EventTypeWarning, consts.ReplicationReason, "Invalid replication policies: %v", err)
+		return ctrl.Result{}, nil
+	}
+
+	_, mappings, err := r.Mapper.Mappings(ctx)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("fetching mappings: %v", err)
+	}
+
+	nodes := &corev1.NodeList{}
+	if err := r.Client.List(ctx, nodes); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	eligible, err := r.eligible(ctx, nodes.Items)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	assigned := make(map[string]map[cid.Cid]bool)
+	for ref, p := range policies {
+		v, ok := mappings[ref]
+		if !ok {
+			continue
+		}
+
+		rp, err := r.Ipfs.ResolvePath(ctx, path.New(v))
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("resolving %s: %v", ref, err)
+		}
+
+		var candidates []string
+		for _, n := range eligible {
+			if p.Matches(n.Labels) {
+				candidates = append(candidates, n.Name)
+			}
+		}
+
+		chosen := rendezvous(rp.Cid().String(), candidates, p.Replicas)
+		if p.Replicas > len(chosen) {
+			r.Recorder.Eventf(cm, corev1.EventTypeWarning, consts.ReplicationReason, "Only %d of the %d replicas of %s can be placed on nodes matching its policy", len(chosen), p.Replicas, ref)
+		}
+
+		for _, n := range chosen {
+			if assigned[n] == nil {
+				assigned[n] = make(map[cid.Cid]bool)
+			}
+			assigned[n][rp.Cid()] = true
+		}
+	}
+
+	var changed int
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+
+		var roots []string
+		for root := range assigned[node.Name] {
+			roots = append(roots, root.String())
+		}
+		sort.Strings(roots)
+
+		if strings.Join(roots, ",") == node.Annotations[consts.NodePinnedAnnotation] {
+			continue
+		}
+
+		patch := client.MergeFrom(node.DeepCopy())
+		if len(roots) > 0 {
+			if node.Annotations == nil {
+				node.Annotations = make(map[string]string)
+			}
+			node.Annotations[consts.NodePinnedAnnotation] = strings.Join(roots, ",")
+		} else {
+			delete(node.Annotations, consts.NodePinnedAnnotation)
+		}
+
+		if err := r.Client.Patch(ctx, node, patch); err != nil {
+			return ctrl.Result{}, fmt.Errorf("annotating %s: %v", node.Name, err)
+		}
+		changed++
+	}
+
+	if changed > 0 {
+		l.Info("assigned images to nodes by their replication policies", "policies", len(policies), "nodes", changed)
+	}
+	return ctrl.Result{RequeueAfter: r.ResyncInterval}, nil
+}
+
+// eligible returns the nodes images can be assigned to, those ready and schedulable with an agent running on them
+func (r *ReplicationPolicyReconciler) eligible(ctx context.Context, nodes []corev1.Node) ([]corev1.Node, error) {
+	agents := &corev1.PodList{}
+	if err := r.Client.List(ctx, agents, client.InNamespace(r.AgentsNamespace), client.MatchingLabels{consts.AgentsLabel: consts.AgentsLabelValue}); err != nil {
+		return nil, fmt.Errorf("listing the ripfs agents: %v", err)
+	}
+
+	running := make(map[string]bool)
+	for _, a := range agents.Items {
+		if a.Status.Phase == corev1.PodRunning {
+			running[a.Spec.NodeName] = true
+		}
+	}
+
+	var eligible []corev1.Node
+	for _, n := range nodes {
+		if running[n.Name] && nodeReady(&n) && !draining(&n) {
+			eligible = append(eligible, n)
+		}
+	}
+	return eligible, nil
+}
+
+// nodeReady reports whether node is ready
+func nodeReady(node *corev1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// rendezvous returns the n of nodes scoring highest for key (every one of them if n is 0), so each key is spread
+// evenly and only moves when one of its nodes goes away
+func rendezvous(key string, nodes []string, n int) []string {
+	score := func(node string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(node))
+		return h.Sum64()
+	}
+
+	sorted := append([]string(nil), nodes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return score(sorted[i]) > score(sorted[j])
+	})
+
+	if n > 0 && n < len(sorted) {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ReplicationPolicyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// Every change is reconciled as the policies' config map, since any node (or agent) can change every assignment
+	policies := handler.EnqueueRequestsFromMapFunc(func(client.Object) []ctrl.Request {
+		return []ctrl.Request{{NamespacedName: r.PoliciesKey}}
+	})
+
+	nodeChanged := predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			old, ok := e.ObjectOld.(*corev1.Node)
+			if !ok {
+				return false
+			}
+			node, ok := e.ObjectNew.(*corev1.Node)
+			return ok && (draining(old) != draining(node) || nodeReady(old) != nodeReady(node) ||
+				!labels.Equals(old.Labels, node.Labels))
+		},
+	}
+
+	agentChanged := predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool { return isAgent(e.Object) },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			old, ok := e.ObjectOld.(*corev1.Pod)
+			if !ok || !isAgent(e.ObjectNew) {
+				return false
+			}
+			pod, ok := e.ObjectNew.(*corev1.Pod)
+			return ok && old.Status.Phase != pod.Status.Phase
+		},
+		DeleteFunc:  func(e event.DeleteEvent) bool { return isAgent(e.Object) },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("replicationpolicy").
+		For(&corev1.ConfigMap{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(o client.Object) bool {
+			return o.GetNamespace() == r.PoliciesKey.Namespace && o.GetName() == r.PoliciesKey.Name
+		}))).
+		Watches(&source.Kind{Type: &corev1.Node{}}, policies, builder.WithPredicates(nodeChanged)).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, policies, builder.WithPredicates(agentChanged)).
+		Watches(&source.Kind{Type: &v1alpha1.Image{}}, policies).
+		Complete(r)
+}
+
+// isAgent reports whether o is one of the agents' pods
+func isAgent(o client.Object) bool {
+	return o.GetLabels()[consts.AgentsLabel] == consts.AgentsLabelValue
+}
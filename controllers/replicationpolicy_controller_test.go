@@ -0,0 +1,275 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+// addRoot adds data to api as the root of an image, as far as resolving it goes
+func addRoot(t *testing.T, ctx context.Context, api iface.CoreAPI, data string) cid.Cid {
+	p, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte(data)), options.Unixfs.Pin(true), options.Unixfs.CidVersion(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Cid()
+}
+
+// policyNode is a node that's ready unless notReady is set, running an agent when agent is set
+func policyNode(name string, nodeLabels map[string]string, agent bool, notReady bool) []client.Object {
+	status := corev1.ConditionTrue
+	if notReady {
+		status = corev1.ConditionFalse
+	}
+
+	objs := []client.Object{&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: nodeLabels},
+		Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status}}},
+	}}
+	if agent {
+		objs = append(objs, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "agents-" + name, Namespace: "ripfs-system", Labels: map[string]string{consts.AgentsLabel: consts.AgentsLabelValue}},
+			Spec:       corev1.PodSpec{NodeName: name},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		})
+	}
+	return objs
+}
+
+func testingReplicationPolicyReconciler(t *testing.T, api iface.CoreAPI, mappings staticLister, policies registry.ReplicationPolicies, objs ...client.Object) (*ReplicationPolicyReconciler, *record.FakeRecorder) {
+	key := types.NamespacedName{Name: consts.ReplicationPoliciesConfigMapName, Namespace: "ripfs-system"}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+		Data:       map[string]string{consts.ReplicationPoliciesKey: policies.String()},
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	return &ReplicationPolicyReconciler{
+		Client:          fake.NewClientBuilder().WithScheme(testingScheme(t)).WithObjects(append(objs, cm)...).Build(),
+		Recorder:        recorder,
+		Ipfs:            api,
+		Mapper:          mappings,
+		PoliciesKey:     key,
+		AgentsNamespace: "ripfs-system",
+	}, recorder
+}
+
+// pinnedRoots returns the roots assigned to each node, by its ripfs.dev/pinned annotation
+func pinnedRoots(t *testing.T, ctx context.Context, c client.Client) map[string][]string {
+	nodes := &corev1.NodeList{}
+	if err := c.List(ctx, nodes); err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := make(map[string][]string)
+	for _, n := range nodes.Items {
+		if v, ok := n.Annotations[consts.NodePinnedAnnotation]; ok {
+			pinned[n.Name] = strings.Split(v, ",")
+		}
+	}
+	return pinned
+}
+
+// assignedTo returns the nodes root is assigned to
+func assignedTo(pinned map[string][]string, root cid.Cid) []string {
+	var nodes []string
+	for n, roots := range pinned {
+		for _, r := range roots {
+			if r == root.String() {
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func TestReplicationPolicyReconciler(t *testing.T) {
+	ctx := context.Background()
+
+	api := testingIpfs(t, ctx)
+	var (
+		anywhere = addRoot(t, ctx, api, "anywhere")
+		edge     = addRoot(t, ctx, api, "edge")
+		tooMany  = addRoot(t, ctx, api, "too many")
+	)
+
+	mappings := staticLister{
+		"docker.io/library/anywhere:latest": "/ipfs/" + anywhere.String(),
+		"docker.io/library/edge:latest":     "/ipfs/" + edge.String(),
+		"docker.io/library/too-many:latest": "/ipfs/" + tooMany.String(),
+		"docker.io/library/unpolicied:1.0":  "/ipfs/" + addRoot(t, ctx, api, "unpolicied").String(),
+	}
+	policies := registry.ReplicationPolicies{
+		"docker.io/library/anywhere:latest": {Replicas: 2},
+		"docker.io/library/edge:latest":     {NodeSelector: map[string]string{"zone": "edge"}},
+		"docker.io/library/too-many:latest": {Replicas: 10},
+		"docker.io/library/unmapped:latest": {Replicas: 1},
+	}
+
+	var objs []client.Object
+	objs = append(objs, policyNode("node-a", nil, true, false)...)
+	objs = append(objs, policyNode("node-b", nil, true, false)...)
+	objs = append(objs, policyNode("node-c", map[string]string{"zone": "edge"}, true, false)...)
+	objs = append(objs, policyNode("node-d", map[string]string{"zone": "edge"}, true, false)...)
+	// Neither ready nor running an agent, so nothing is assigned to them
+	objs = append(objs, policyNode("node-not-ready", map[string]string{"zone": "edge"}, true, true)...)
+	objs = append(objs, policyNode("node-no-agent", map[string]string{"zone": "edge"}, false, false)...)
+
+	// Draining nodes, and whatever was assigned to nodes no longer eligible, are dropped
+	cordoned := policyNode("node-cordoned", map[string]string{"zone": "edge"}, true, false)
+	cordoned[0].(*corev1.Node).Spec.Unschedulable = true
+	cordoned[0].SetAnnotations(map[string]string{consts.NodePinnedAnnotation: edge.String()})
+	objs = append(objs, cordoned...)
+
+	r, recorder := testingReplicationPolicyReconciler(t, api, mappings, policies, objs...)
+
+	reconcile := func() {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: r.PoliciesKey}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reconcile()
+
+	pinned := pinnedRoots(t, ctx, r.Client)
+	eligible := []string{"node-a", "node-b", "node-c", "node-d"}
+
+	// Every replica of an image is placed on a distinct eligible node, as rendezvous hashing picks them
+	want := rendezvous(anywhere.String(), eligible, 2)
+	sort.Strings(want)
+	if got := assignedTo(pinned, anywhere); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %s assigned to %v, got %v", anywhere, want, got)
+	}
+
+	// Without replicas, every matching node pins the image
+	if got := assignedTo(pinned, edge); !reflect.DeepEqual(got, []string{"node-c", "node-d"}) {
+		t.Errorf("expected %s assigned to every eligible edge node, got %v", edge, got)
+	}
+
+	// Policies that can't be met are placed as far as they can be, and reported
+	if got := assignedTo(pinned, tooMany); !reflect.DeepEqual(got, eligible) {
+		t.Errorf("expected %s assigned to every eligible node, got %v", tooMany, got)
+	}
+	if e := events(recorder); len(e) != 1 || !strings.Contains(e[0], "Only 4 of the 10 replicas of docker.io/library/too-many:latest") {
+		t.Errorf("expected a warning about the unmet policy, got %v", e)
+	}
+
+	for _, n := range []string{"node-not-ready", "node-no-agent", "node-cordoned"} {
+		if roots, ok := pinned[n]; ok {
+			t.Errorf("expected nothing assigned to %s, got %v", n, roots)
+		}
+	}
+
+	// Annotations list the roots sorted, so they only change along with the assignments
+	for n, roots := range pinned {
+		if !sort.StringsAreSorted(roots) {
+			t.Errorf("expected the roots of %s sorted, got %v", n, roots)
+		}
+	}
+
+	// Losing one of an image's nodes only moves the replica it held
+	lost := want[0]
+	node := &corev1.Node{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: lost}, node); err != nil {
+		t.Fatal(err)
+	}
+	node.Status.Conditions[0].Status = corev1.ConditionFalse
+	if err := r.Client.Status().Update(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+
+	moved := assignedTo(pinnedRoots(t, ctx, r.Client), anywhere)
+	if len(moved) != 2 {
+		t.Fatalf("expected %s to still be assigned to 2 nodes, got %v", anywhere, moved)
+	}
+	for _, n := range moved {
+		if n == lost {
+			t.Errorf("expected %s to be moved off of %s, got %v", anywhere, lost, moved)
+		}
+	}
+	if kept := want[1]; moved[0] != kept && moved[1] != kept {
+		t.Errorf("expected %s to stay on %s, got %v", anywhere, kept, moved)
+	}
+}
+
+func TestReplicationPolicyReconcilerInvalid(t *testing.T) {
+	ctx := context.Background()
+
+	r, recorder := testingReplicationPolicyReconciler(t, testingIpfs(t, ctx), staticLister{}, nil, policyNode("node-a", nil, true, false)...)
+
+	cm := &corev1.ConfigMap{}
+	if err := r.Client.Get(ctx, r.PoliciesKey, cm); err != nil {
+		t.Fatal(err)
+	}
+	cm.Data[consts.ReplicationPoliciesKey] = "not json"
+	if err := r.Client.Update(ctx, cm); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retrying won't help until they're fixed, which is reconciled anyways
+	if res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: r.PoliciesKey}); err != nil || res.RequeueAfter != 0 {
+		t.Errorf("expected invalid policies not to be retried, got %v: %v", res, err)
+	}
+	if e := events(recorder); len(e) != 1 || !strings.Contains(e[0], "Invalid replication policies") {
+		t.Errorf("expected a warning about the invalid policies, got %v", e)
+	}
+}
+
+func TestRendezvous(t *testing.T) {
+	nodes := []string{"node-a", "node-b", "node-c", "node-d", "node-e"}
+
+	if got := rendezvous("root", nodes, 0); len(got) != len(nodes) {
+		t.Errorf("expected every node without replicas, got %v", got)
+	}
+	if got := rendezvous("root", nodes, 10); len(got) != len(nodes) {
+		t.Errorf("expected every node with more replicas than nodes, got %v", got)
+	}
+
+	// Picks don't depend on the order nodes are listed in
+	chosen := rendezvous("root", nodes, 3)
+	reversed := []string{"node-e", "node-d", "node-c", "node-b", "node-a"}
+	if got := rendezvous("root", reversed, 3); !reflect.DeepEqual(got, chosen) {
+		t.Errorf("expected %v regardless of order, got %v", chosen, got)
+	}
+
+	// Removing a node that wasn't picked doesn't move anything
+	picked := map[string]bool{chosen[0]: true, chosen[1]: true, chosen[2]: true}
+	for i, n := range nodes {
+		if picked[n] {
+			continue
+		}
+
+		without := append(append([]string(nil), nodes[:i]...), nodes[i+1:]...)
+		if got := rendezvous("root", without, 3); !reflect.DeepEqual(got, chosen) {
+			t.Errorf("expected %v without %s, got %v", chosen, n, got)
+		}
+	}
+
+	// Keys are spread over the nodes
+	counts := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		counts[rendezvous(string(rune('a'+i%26))+strings.Repeat("x", i), nodes, 1)[0]]++
+	}
+	if len(counts) != len(nodes) {
+		t.Errorf("expected keys spread over every node, got %v", counts)
+	}
+}
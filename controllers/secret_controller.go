@@ -18,23 +18,44 @@ package controllers
 
 import (
 	"context"
+	"crypto"
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	files "github.com/ipfs/go-ipfs-files"
-	"github.com/ipfs/go-ipfs/repo"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"golang.org/x/time/rate"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
+	"github.com/joshrwolf/ripfs/api/v1alpha1"
 	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/ipfs"
+	"github.com/joshrwolf/ripfs/internal/registry"
+	"github.com/joshrwolf/ripfs/internal/verify"
 )
 
 // SecretReconciler reconciles a Secret object
@@ -43,18 +64,42 @@ type SecretReconciler struct {
 	Scheme *runtime.Scheme
 
 	IpfsClient iface.CoreAPI
-	IpfsRepo   repo.Repo
+	IpfsNode   ipfs.Node
 
 	ClusterSecretKey   types.NamespacedName
 	CidMapperSecretKey types.NamespacedName
+
+	// ImagesNamespace is where the Images recording the mappings are kept in sync with those committed to the mapper
+	// secret. They're left alone when it's empty. Those it records are signed with the cluster's mapping key, the
+	// MappingKey secret, once it's generated.
+	ImagesNamespace string
+	MappingKey      types.NamespacedName
+
+	// ReplicaLabels select the pods of the manager's replicas in the cluster secret's namespace. Each one that's
+	// annotated with its node's peer id is published as a bootstrap peer too, dialed through the headless
+	// BootstrapService, so the swarm isn't partitioned when any single replica is lost.
+	ReplicaLabels    map[string]string
+	BootstrapService string
+
+	// RequeueBaseDelay and RequeueMaxDelay bound the exponential backoff of failed (or waiting) reconciles, such as
+	// while waiting for the swarm's first peers
+	RequeueBaseDelay time.Duration
+	RequeueMaxDelay  time.Duration
+
+	// released are the secrets torn down and released, which mustn't be created again, as persisted in the
+	// ReleasedConfigMapName config map of their namespace
+	mu       sync.Mutex
+	released map[types.NamespacedName]bool
 }
 
 // +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=secrets/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=core,resources=secrets/finalizers,verbs=update
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch
 
 // TODO: Make these their own SA
 // +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=validatingwebhookconfigurations,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -68,35 +113,216 @@ type SecretReconciler struct {
 func (r *SecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	_ = log.FromContext(ctx)
 
-	switch req.NamespacedName {
-	case r.ClusterSecretKey:
+	if req.NamespacedName != r.ClusterSecretKey && req.NamespacedName != r.CidMapperSecretKey {
+		return ctrl.Result{}, nil
+	}
+
+	if released, err := r.isReleased(ctx, req.NamespacedName); err != nil {
+		return ctrl.Result{}, err
+	} else if released {
+		return ctrl.Result{}, nil
+	}
+
+	// Either managed secret is created first if it doesn't exist yet
+	if err := r.ensureSecret(ctx, req.NamespacedName); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	obj := &corev1.Secret{}
+	if err := r.Get(ctx, req.NamespacedName, obj); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if !obj.GetDeletionTimestamp().IsZero() {
+		return r.teardown(ctx, obj)
+	}
+
+	if !controllerutil.ContainsFinalizer(obj, consts.TeardownFinalizer) {
+		controllerutil.AddFinalizer(obj, consts.TeardownFinalizer)
+		if err := r.Update(ctx, obj, &client.UpdateOptions{}); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if req.NamespacedName == r.ClusterSecretKey {
 		return r.reconcileClusterConfig(ctx)
+	}
+
+	if res, err := r.reconcileCidMapper(ctx); err != nil || !res.IsZero() {
+		return res, err
+	}
+	return ctrl.Result{}, r.syncImages(ctx)
+}
+
+// teardown releases a secret deleted by an uninstall once whatever it references is torn down. The mappings are torn
+// down first: their content is unpinned and an empty mapping published in their place. The cluster config is only
+// released after that, since peers need the swarm until then. Secrets deleted any other way (by accident, or recreated
+// by a GitOps tool) are restored as they were instead.
+func (r *SecretReconciler) teardown(ctx context.Context, obj *corev1.Secret) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if !controllerutil.ContainsFinalizer(obj, consts.TeardownFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	if obj.Annotations[consts.UninstallAnnotation] != "true" {
+		l.Info("secret was deleted without being uninstalled, restoring it", "name", obj.GetName(), "annotation", consts.UninstallAnnotation)
+		return ctrl.Result{Requeue: true}, r.restore(ctx, obj)
+	}
 
+	switch client.ObjectKeyFromObject(obj) {
 	case r.CidMapperSecretKey:
-		return r.reconcileCidMapper(ctx)
+		if err := r.teardownCidMapper(ctx, obj); err != nil {
+			return ctrl.Result{}, fmt.Errorf("tearing down mappings: %v", err)
+		}
 
+	case r.ClusterSecretKey:
+		mapper := &corev1.Secret{}
+		if err := r.Get(ctx, r.CidMapperSecretKey, mapper); err == nil {
+			l.Info("waiting for the mappings to be torn down before releasing the cluster config")
+			return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+		} else if !errors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
 	}
 
-	// Ensure cluster config secret
-	if err := r.ensureSecret(ctx, r.ClusterSecretKey); err != nil {
-		return ctrl.Result{}, err
+	if err := r.release(ctx, client.ObjectKeyFromObject(obj)); err != nil {
+		return ctrl.Result{}, fmt.Errorf("recording the release: %v", err)
 	}
 
-	// Ensure cid mapper secret
-	if err := r.ensureSecret(ctx, r.CidMapperSecretKey); err != nil {
+	controllerutil.RemoveFinalizer(obj, consts.TeardownFinalizer)
+	if err := r.Update(ctx, obj, &client.UpdateOptions{}); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	// l.Info("doin it", "req", req)
-	// if _, err := ctrl.CreateOrUpdate(ctx, r.Client, cfg, func() error {
-	// 	return cfgBuilder.Build(cfg)
-	// }); err != nil {
-	// 	return ctrl.Result{}, nil
-	// }
-
+	l.Info("released secret", "name", obj.GetName())
 	return ctrl.Result{}, nil
 }
 
+// teardownCidMapper unpins every mapped root (and the mapping itself), then publishes an empty mapping in its place
+func (r *SecretReconciler) teardownCidMapper(ctx context.Context, obj *corev1.Secret) error {
+	l := log.FromContext(ctx)
+
+	if _, ok := obj.Data[consts.CidMapperSecretKey]; !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	// The mappings last committed, which ipns may not have caught up with (or may not resolve at all offline)
+	p, err := r.mappingsPath(ctx, obj)
+	if err != nil {
+		return err
+	}
+
+	mappings, err := registry.ReadMappings(ctx, r.IpfsClient, p)
+	if err != nil {
+		return err
+	}
+
+	for ref, root := range mappings {
+		if err := r.IpfsClient.Pin().Rm(ctx, path.New(root)); err != nil {
+			// Most likely it was never pinned here, or already unpinned by an earlier attempt
+			l.Info("unpinning root", "reference", ref, "root", root, "error", err.Error())
+		}
+	}
+
+	if err := r.IpfsClient.Pin().Rm(ctx, p); err != nil {
+		l.Info("unpinning mappings", "path", p.String(), "error", err.Error())
+	}
+
+	empty, err := r.IpfsClient.Unixfs().Add(ctx, files.NewBytesFile([]byte(`{}`)), options.Unixfs.Pin(false), options.Unixfs.CidVersion(1))
+	if err != nil {
+		return err
+	}
+
+	if _, err := r.IpfsClient.Name().Publish(ctx, empty, func(s *options.NamePublishSettings) error {
+		s.AllowOffline = true
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Anything following the mappings drops its copy straight away
+	if err := registry.PublishDelta(ctx, r.IpfsClient, consts.MappingsTopic, registry.MappingDelta{Path: empty.String()}); err != nil {
+		l.Info("announcing the empty mappings", "error", err.Error())
+	}
+
+	l.Info("tore down mappings", "roots", len(mappings))
+	return nil
+}
+
+// restore releases the deleted obj and creates it again with the same data, so whatever it references is kept
+func (r *SecretReconciler) restore(ctx context.Context, obj *corev1.Secret) error {
+	restored := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        obj.Name,
+			Namespace:   obj.Namespace,
+			Labels:      obj.Labels,
+			Annotations: obj.Annotations,
+		},
+		Type: obj.Type,
+		Data: obj.Data,
+	}
+
+	controllerutil.RemoveFinalizer(obj, consts.TeardownFinalizer)
+	if err := r.Update(ctx, obj, &client.UpdateOptions{}); err != nil {
+		return err
+	}
+
+	if err := r.Create(ctx, restored, &client.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// release records key as released, in memory and in its namespace's ReleasedConfigMapName config map
+func (r *SecretReconciler) release(ctx context.Context, key types.NamespacedName) error {
+	cm := &corev1.ConfigMap{}
+	cm.Name, cm.Namespace = consts.ReleasedConfigMapName, key.Namespace
+
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, cm, func() error {
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[key.Name] = time.Now().UTC().Format(time.RFC3339)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.released == nil {
+		r.released = make(map[types.NamespacedName]bool)
+	}
+	r.released[key] = true
+	return nil
+}
+
+// isReleased returns whether key was released, by this manager or an earlier one
+func (r *SecretReconciler) isReleased(ctx context.Context, key types.NamespacedName) (bool, error) {
+	r.mu.Lock()
+	released := r.released[key]
+	r.mu.Unlock()
+
+	if released {
+		return true, nil
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := r.Get(ctx, types.NamespacedName{Name: consts.ReleasedConfigMapName, Namespace: key.Namespace}, cm); errors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	_, ok := cm.Data[key.Name]
+	return ok, nil
+}
+
 func (r *SecretReconciler) ensureSecret(ctx context.Context, n types.NamespacedName) error {
 	var (
 		l = log.FromContext(ctx)
@@ -125,21 +351,25 @@ func (r *SecretReconciler) reconcileClusterConfig(ctx context.Context) (ctrl.Res
 		return ctrl.Result{}, err
 	}
 
-	swarmKey, err := r.IpfsRepo.SwarmKey()
+	swarmKey, err := r.IpfsNode.SwarmKey()
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
-	cfg, err := r.IpfsRepo.Config()
+	cfg, err := r.IpfsNode.Config()
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
-	bootstrapPeer := fmt.Sprintf("/dns/%s.%s.svc/tcp/4001/ipfs/%s", consts.BootstrapServiceName, obj.GetNamespace(), cfg.Identity.PeerID)
+	bootstrapPeers, err := r.bootstrapPeers(ctx, obj.GetNamespace(), cfg.Identity.PeerID)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
 
 	want := make(map[string][]byte)
 	want["swarm.key"] = swarmKey
-	want["bootstrap-peers"] = []byte(bootstrapPeer)
+	// Peers of any swarm the cluster joined are shared too, space separated as viper expects them
+	want["bootstrap-peers"] = []byte(strings.Join(append(bootstrapPeers, cfg.Bootstrap...), " "))
 
 	if reflect.DeepEqual(want, obj.Data) {
 		// Nothing to do here!
@@ -155,6 +385,36 @@ func (r *SecretReconciler) reconcileClusterConfig(ctx context.Context) (ctrl.Res
 	return ctrl.Result{}, nil
 }
 
+// bootstrapPeers returns the bootstrap peer of the manager's own node, dialed through the manager's service (which an
+// external node is routed through), followed by every replica's. Those are dialed through the headless service,
+// resolving to every replica, of which only the one with the peer's id completes the handshake.
+func (r *SecretReconciler) bootstrapPeers(ctx context.Context, ns, self string) ([]string, error) {
+	peers := []string{fmt.Sprintf("/dns/%s.%s.svc/tcp/4001/ipfs/%s", consts.BootstrapServiceName, ns, self)}
+	if r.BootstrapService == "" {
+		return peers, nil
+	}
+
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(ns), client.MatchingLabels(r.ReplicaLabels)); err != nil {
+		return nil, fmt.Errorf("listing manager replicas: %v", err)
+	}
+
+	ids := []string{self}
+	for _, pod := range pods.Items {
+		id := pod.Annotations[consts.PeerIDAnnotation]
+		if id == "" || id == self || !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids[1:])
+
+	for _, id := range ids {
+		peers = append(peers, fmt.Sprintf("/dns/%s.%s.svc/tcp/4001/ipfs/%s", r.BootstrapService, ns, id))
+	}
+	return peers, nil
+}
+
 func (r *SecretReconciler) reconcileCidMapper(ctx context.Context) (ctrl.Result, error) {
 	obj := &corev1.Secret{}
 	if err := r.Get(ctx, r.CidMapperSecretKey, obj); err != nil {
@@ -170,8 +430,8 @@ func (r *SecretReconciler) reconcileCidMapper(ctx context.Context) (ctrl.Result,
 	}
 
 	if len(peers) == 0 {
-		// Try again
-		return ctrl.Result{Requeue: true}, err
+		// Try again, backing off exponentially until the swarm has peers
+		return ctrl.Result{Requeue: true}, nil
 	}
 
 	if _, ok := obj.Data[consts.CidMapperSecretKey]; ok {
@@ -196,6 +456,7 @@ func (r *SecretReconciler) reconcileCidMapper(ctx context.Context) (ctrl.Result,
 	}
 
 	obj.Data[consts.CidMapperSecretKey] = []byte(e.Name())
+	obj.Data[consts.CidMapperPathKey] = []byte(p.String())
 
 	if err := r.Update(ctx, obj, &client.UpdateOptions{}); err != nil {
 		return ctrl.Result{}, err
@@ -204,9 +465,132 @@ func (r *SecretReconciler) reconcileCidMapper(ctx context.Context) (ctrl.Result,
 	return ctrl.Result{}, nil
 }
 
-// SetupWithManager sets up the controller with the Manager.
+// syncImages records the mappings committed to the mapper secret in the Images of ImagesNamespace. Add and rm record
+// the Images of what they commit themselves, so this catches up on whatever they missed (failing partway, or committed
+// before Images existed), along with Images changed by anything else.
+func (r *SecretReconciler) syncImages(ctx context.Context) error {
+	if r.ImagesNamespace == "" {
+		return nil
+	}
+
+	obj := &corev1.Secret{}
+	if err := r.Get(ctx, r.CidMapperSecretKey, obj); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	p, err := r.mappingsPath(ctx, obj)
+	if err != nil {
+		return err
+	}
+
+	mappings, err := registry.ReadMappings(ctx, r.IpfsClient, p)
+	if err != nil {
+		return fmt.Errorf("reading mappings %s: %v", p, err)
+	}
+
+	signer, err := r.mappingSigner(ctx)
+	if err != nil {
+		return fmt.Errorf("loading mapping key: %v", err)
+	}
+
+	generation, _ := strconv.ParseInt(string(obj.Data[consts.CidMapperGenerationKey]), 10, 64)
+	if err := registry.SyncImages(ctx, r.Client, r.ImagesNamespace, mappings, generation, signer); err != nil {
+		return fmt.Errorf("recording images: %v", err)
+	}
+	return nil
+}
+
+// mappingSigner returns the cluster's mapping key, or nil when there's none (yet)
+func (r *SecretReconciler) mappingSigner(ctx context.Context) (crypto.Signer, error) {
+	if r.MappingKey.Name == "" {
+		return nil, nil
+	}
+
+	s := &corev1.Secret{}
+	if err := r.Get(ctx, r.MappingKey, s); errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return verify.ParsePrivateKey(s.Data[consts.MappingKeySecretKey])
+}
+
+// mappingsPath returns the path of the mappings last committed to the mapper secret obj, resolving its ipns name for
+// mappings published before they were committed there
+func (r *SecretReconciler) mappingsPath(ctx context.Context, obj *corev1.Secret) (path.Path, error) {
+	if p, ok := obj.Data[consts.CidMapperPathKey]; ok {
+		return path.New(string(p)), nil
+	}
+
+	name, ok := obj.Data[consts.CidMapperSecretKey]
+	if !ok {
+		return nil, fmt.Errorf("no mappings committed to %s", obj.Name)
+	}
+
+	p, err := r.IpfsClient.Name().Resolve(ctx, string(name))
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %v", name, err)
+	}
+	return p, nil
+}
+
+// SetupWithManager sets up the controller with the Manager. Only events for the managed secrets are
+// reconciled, and each is reconciled once on startup so they're created even if nothing else ever touches them.
 func (r *SecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	base, max := r.RequeueBaseDelay, r.RequeueMaxDelay
+	if base == 0 {
+		base = time.Second
+	}
+	if max == 0 {
+		max = 5 * time.Minute
+	}
+
+	managed := predicate.NewPredicateFuncs(func(o client.Object) bool {
+		key := client.ObjectKeyFromObject(o)
+		return key == r.ClusterSecretKey || key == r.CidMapperSecretKey
+	})
+
+	initial := make(chan event.GenericEvent, 2)
+	for _, key := range []types.NamespacedName{r.ClusterSecretKey, r.CidMapperSecretKey} {
+		s := &corev1.Secret{}
+		s.Name, s.Namespace = key.Name, key.Namespace
+		initial <- event.GenericEvent{Object: s}
+	}
+
+	// Replicas coming and going (or annotating their peer id) change the bootstrap peers of the cluster config
+	replicas := predicate.NewPredicateFuncs(func(o client.Object) bool {
+		return r.BootstrapService != "" && o.GetNamespace() == r.ClusterSecretKey.Namespace &&
+			labels.SelectorFromSet(r.ReplicaLabels).Matches(labels.Set(o.GetLabels()))
+	})
+	clusterConfig := handler.EnqueueRequestsFromMapFunc(func(client.Object) []reconcile.Request {
+		return []reconcile.Request{{NamespacedName: r.ClusterSecretKey}}
+	})
+
+	// Images created, deleted or changed by anything else are recorded from the mappings again
+	images := predicate.And(
+		predicate.NewPredicateFuncs(func(o client.Object) bool {
+			return r.ImagesNamespace != "" && o.GetNamespace() == r.ImagesNamespace
+		}),
+		predicate.GenerationChangedPredicate{},
+	)
+	cidMapper := handler.EnqueueRequestsFromMapFunc(func(client.Object) []reconcile.Request {
+		return []reconcile.Request{{NamespacedName: r.CidMapperSecretKey}}
+	})
+
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Secret{}).
+		For(&corev1.Secret{}, builder.WithPredicates(managed)).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, clusterConfig, builder.WithPredicates(replicas)).
+		Watches(&source.Kind{Type: &v1alpha1.Image{}}, cidMapper, builder.WithPredicates(images)).
+		Watches(&source.Channel{Source: initial}, &handler.EnqueueRequestForObject{}).
+		WithOptions(controller.Options{
+			RateLimiter: workqueue.NewMaxOfRateLimiter(
+				workqueue.NewItemExponentialFailureRateLimiter(base, max),
+				// Overall, the same as client-go's default
+				&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+			),
+		}).
 		Complete(r)
 }
@@ -0,0 +1,366 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+
+	config "github.com/ipfs/go-ipfs-config"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/core/node/libp2p"
+	"github.com/ipfs/go-ipfs/plugin/loader"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/joshrwolf/ripfs/api/v1alpha1"
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+var pluginsOnce sync.Once
+
+// testingIpfs returns the api of an offline ipfs node backed by a temporary repo
+func testingIpfs(t *testing.T, ctx context.Context) iface.CoreAPI {
+	tmp := t.TempDir()
+
+	// Plugins can only be injected once per process
+	pluginsOnce.Do(func() {
+		plugins, err := loader.NewPluginLoader("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := plugins.Initialize(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := plugins.Inject(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	cfg, err := config.Init(ioutil.Discard, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fsrepo.Init(tmp, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := fsrepo.Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := core.NewNode(ctx, &core.BuildCfg{Online: false, Routing: libp2p.DHTOption, Repo: repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Close() })
+
+	api, err := coreapi.NewCoreAPI(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api
+}
+
+// peeredIpfs is an offline node's api reporting however many swarm peers it's given
+type peeredIpfs struct {
+	iface.CoreAPI
+	peers int
+}
+
+func (p *peeredIpfs) Swarm() iface.SwarmAPI {
+	return peeredSwarm{p.CoreAPI.Swarm(), p.peers}
+}
+
+type peeredSwarm struct {
+	iface.SwarmAPI
+	peers int
+}
+
+func (s peeredSwarm) Peers(context.Context) ([]iface.ConnectionInfo, error) {
+	return make([]iface.ConnectionInfo, s.peers), nil
+}
+
+func testingScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
+
+func testingSecretReconciler(t *testing.T, api iface.CoreAPI, objs ...client.Object) *SecretReconciler {
+	scheme := testingScheme(t)
+	return &SecretReconciler{
+		Client:             fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		Scheme:             scheme,
+		IpfsClient:         api,
+		ClusterSecretKey:   types.NamespacedName{Name: consts.ClusterConfigSecretName, Namespace: "ripfs-system"},
+		CidMapperSecretKey: types.NamespacedName{Name: consts.CidMapperSecretName, Namespace: "ripfs-system"},
+	}
+}
+
+func TestSecretReconcilerManagedSecrets(t *testing.T) {
+	ctx := context.Background()
+
+	api := &peeredIpfs{CoreAPI: testingIpfs(t, ctx)}
+	r := testingSecretReconciler(t, api)
+
+	// Secrets other than the managed ones are left alone
+	other := types.NamespacedName{Name: "other", Namespace: "ripfs-system"}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: other}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, other, &corev1.Secret{}); err == nil {
+		t.Errorf("expected %s not to be created", other)
+	}
+
+	// Without peers the mapper secret is created (and held), but the mappings wait, backing off
+	res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: r.CidMapperSecretKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Requeue {
+		t.Errorf("expected a requeue while the swarm has no peers")
+	}
+
+	s := &corev1.Secret{}
+	if err := r.Get(ctx, r.CidMapperSecretKey, s); err != nil {
+		t.Fatal(err)
+	}
+	if !controllerutil.ContainsFinalizer(s, consts.TeardownFinalizer) {
+		t.Errorf("expected the mapper secret to be held by %s", consts.TeardownFinalizer)
+	}
+	if _, ok := s.Data[consts.CidMapperSecretKey]; ok {
+		t.Errorf("expected no mappings to be published without peers")
+	}
+
+	// Once peers are found the empty mappings are published
+	api.peers = 1
+	if res, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: r.CidMapperSecretKey}); err != nil {
+		t.Fatal(err)
+	}
+	if res.Requeue {
+		t.Errorf("expected no requeue once the swarm has peers")
+	}
+
+	if err := r.Get(ctx, r.CidMapperSecretKey, s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Data[consts.CidMapperSecretKey]) == 0 || len(s.Data[consts.CidMapperPathKey]) == 0 {
+		t.Errorf("expected the mappings' name and path to be recorded, got %v", s.Data)
+	}
+}
+
+// publishMappings pins a file standing in for an image, then publishes mappings of reference to it, returning the
+// mapper secret's data and the image's root
+func publishMappings(t *testing.T, ctx context.Context, api iface.CoreAPI, reference string) (map[string][]byte, path.Resolved) {
+	root, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte(reference)), options.Unixfs.Pin(true), options.Unixfs.CidVersion(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(map[string]string{reference: root.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := api.Unixfs().Add(ctx, files.NewBytesFile(data), options.Unixfs.Pin(true), options.Unixfs.CidVersion(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := api.Name().Publish(ctx, p, options.Name.AllowOffline(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string][]byte{consts.CidMapperSecretKey: []byte(e.Name()), consts.CidMapperPathKey: []byte(p.String())}, root
+}
+
+func TestSecretReconcilerSyncImages(t *testing.T) {
+	ctx := context.Background()
+
+	api := &peeredIpfs{CoreAPI: testingIpfs(t, ctx), peers: 1}
+	data, root := publishMappings(t, ctx, api, "index.docker.io/library/app:v1")
+	data[consts.CidMapperGenerationKey] = []byte("3")
+
+	image := func(ref string, generation string) *v1alpha1.Image {
+		return &v1alpha1.Image{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        v1alpha1.ImageName(ref),
+				Namespace:   "ripfs-system",
+				Annotations: map[string]string{registry.AnnotationGeneration: generation},
+			},
+			Spec: v1alpha1.ImageSpec{Reference: ref, Root: "stale"},
+		}
+	}
+
+	r := testingSecretReconciler(t, api,
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: consts.CidMapperSecretName, Namespace: "ripfs-system"}, Data: data},
+		// Unmapped by the committed mappings, and by a later commit they don't include yet
+		image("index.docker.io/library/removed:v1", "2"),
+		image("index.docker.io/library/added:v1", "4"),
+	)
+	r.ImagesNamespace = "ripfs-system"
+
+	// Those recorded are signed with the cluster's mapping key
+	r.MappingKey = types.NamespacedName{Name: consts.MappingKeySecretName, Namespace: "ripfs-system"}
+	keys := types.NamespacedName{Name: consts.MappingKeysConfigMapName, Namespace: "ripfs-system"}
+	if err := registry.EnsureMappingKey(ctx, r.Client, r.MappingKey, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: r.CidMapperSecretKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	verified := registry.NewImageCidMapper(r.Client, "ripfs-system", registry.WithMappingKeys(registry.ConfigMapMappingKeys(r.Client, keys)))
+	if p, err := verified.Resolve(ctx, "index.docker.io/library/app:v1"); err != nil || p != root.String() {
+		t.Errorf("expected the recorded image to be verified, got %s: %v", p, err)
+	}
+
+	imgs := &v1alpha1.ImageList{}
+	if err := r.List(ctx, imgs, client.InNamespace("ripfs-system")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	for _, img := range imgs.Items {
+		got[img.Spec.Reference] = img.Spec.Root
+	}
+	want := map[string]string{
+		"index.docker.io/library/app:v1":   root.Cid().String(),
+		"index.docker.io/library/added:v1": "stale",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected images %v, got %v", want, got)
+	}
+}
+
+func TestSecretReconcilerRestore(t *testing.T) {
+	ctx := context.Background()
+
+	api := &peeredIpfs{CoreAPI: testingIpfs(t, ctx), peers: 1}
+	data, root := publishMappings(t, ctx, api, "index.docker.io/library/app:v1")
+
+	r := testingSecretReconciler(t, api)
+	mapper := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: r.CidMapperSecretKey.Name, Namespace: r.CidMapperSecretKey.Namespace, Finalizers: []string{consts.TeardownFinalizer}},
+		Data:       data,
+	}
+	if err := r.Create(ctx, mapper); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleted without being uninstalled, such as by accident
+	if err := r.Delete(ctx, mapper); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: r.CidMapperSecretKey}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restored := &corev1.Secret{}
+	if err := r.Get(ctx, r.CidMapperSecretKey, restored); err != nil {
+		t.Fatalf("expected the secret to be restored: %v", err)
+	}
+	if !restored.DeletionTimestamp.IsZero() {
+		t.Errorf("expected the restored secret not to be deleted")
+	}
+	if !reflect.DeepEqual(restored.Data, data) {
+		t.Errorf("expected the secret to be restored with %v, got %v", data, restored.Data)
+	}
+	if !controllerutil.ContainsFinalizer(restored, consts.TeardownFinalizer) {
+		t.Errorf("expected the restored secret to be held by %s", consts.TeardownFinalizer)
+	}
+
+	if _, pinned, err := api.Pin().IsPinned(ctx, root); err != nil || !pinned {
+		t.Errorf("expected %s to stay pinned (%v)", root, err)
+	}
+}
+
+func TestSecretReconcilerUninstall(t *testing.T) {
+	ctx := context.Background()
+
+	api := &peeredIpfs{CoreAPI: testingIpfs(t, ctx), peers: 1}
+	data, _ := publishMappings(t, ctx, api, "index.docker.io/library/app:v1")
+
+	// Mappings committed since they were last published are the ones torn down, without waiting on ipns
+	root, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte("app:v2")), options.Unixfs.Pin(true), options.Unixfs.CidVersion(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte(`{"index.docker.io/library/app:v2": "`+root.String()+`"}`)), options.Unixfs.CidVersion(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[consts.CidMapperPathKey] = []byte(committed.String())
+
+	r := testingSecretReconciler(t, api)
+	mapper := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        r.CidMapperSecretKey.Name,
+			Namespace:   r.CidMapperSecretKey.Namespace,
+			Finalizers:  []string{consts.TeardownFinalizer},
+			Annotations: map[string]string{consts.UninstallAnnotation: "true"},
+		},
+		Data: data,
+	}
+	if err := r.Create(ctx, mapper); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Delete(ctx, mapper); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: r.CidMapperSecretKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Get(ctx, r.CidMapperSecretKey, &corev1.Secret{}); !errors.IsNotFound(err) {
+		t.Errorf("expected the secret to be released, got %v", err)
+	}
+
+	if _, pinned, err := api.Pin().IsPinned(ctx, root); err != nil || pinned {
+		t.Errorf("expected %s to be unpinned (%v)", root, err)
+	}
+
+	// A restarted manager doesn't create the released secret again
+	restarted := testingSecretReconciler(t, api)
+	restarted.Client = r.Client
+	if _, err := restarted.Reconcile(ctx, ctrl.Request{NamespacedName: r.CidMapperSecretKey}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, r.CidMapperSecretKey, &corev1.Secret{}); !errors.IsNotFound(err) {
+		t.Errorf("expected the released secret not to be created again, got %v", err)
+	}
+}
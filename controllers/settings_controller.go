@@ -0,0 +1,140 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// SettingsReconciler keeps the webhook's runtime settings in sync with their config map. Every replica serves the
+// webhook, so every replica reloads them, whether it's the leader or not.
+type SettingsReconciler struct {
+	client.Client
+
+	// Key is the config map holding the settings. It's created from Defaults, which also fill in anything missing, and
+	// OnSettings is called with its data whenever it changes.
+	Key        types.NamespacedName
+	Defaults   map[string]string
+	OnSettings func(data map[string]string) error
+}
+
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch
+
+// Reconcile creates the settings config map if it doesn't exist, fills in anything missing from it, and hands it to
+// the webhook. Replicas racing to create (or fill in) the config map conflict, and are reconciled again.
+func (r *SettingsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if req.NamespacedName != r.Key {
+		return ctrl.Result{}, nil
+	}
+
+	obj := &corev1.ConfigMap{}
+	if err := r.Get(ctx, r.Key, obj); errors.IsNotFound(err) {
+		l.Info("creating webhook settings", "name", r.Key)
+
+		obj.Name = r.Key.Name
+		obj.Namespace = r.Key.Namespace
+		if err := r.Create(ctx, obj, &client.CreateOptions{}); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	missing := false
+	for k, v := range r.Defaults {
+		if _, ok := obj.Data[k]; ok {
+			continue
+		}
+
+		if obj.Data == nil {
+			obj.Data = make(map[string]string)
+		}
+		obj.Data[k] = v
+		missing = true
+	}
+
+	if missing {
+		// The update is reconciled again in turn
+		return ctrl.Result{}, r.Update(ctx, obj, &client.UpdateOptions{})
+	}
+
+	if r.OnSettings == nil {
+		return ctrl.Result{}, nil
+	}
+
+	if err := r.OnSettings(obj.Data); err != nil {
+		// Retrying won't help until they're fixed, which is reconciled anyways
+		l.Error(err, "invalid webhook settings, keeping the previous ones", "name", r.Key)
+		return ctrl.Result{}, nil
+	}
+
+	l.Info("reloaded webhook settings", "name", r.Key)
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager, running on every replica rather than only the leader.
+// The settings are reconciled once on startup, so they're created (and loaded) even if nothing else touches them.
+func (r *SettingsReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	c, err := controller.NewUnmanaged("settings", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	settings := predicate.NewPredicateFuncs(func(o client.Object) bool {
+		return client.ObjectKeyFromObject(o) == r.Key
+	})
+	if err := c.Watch(&source.Kind{Type: &corev1.ConfigMap{}}, &handler.EnqueueRequestForObject{}, settings); err != nil {
+		return err
+	}
+
+	initial := make(chan event.GenericEvent, 1)
+	cm := &corev1.ConfigMap{}
+	cm.Name, cm.Namespace = r.Key.Name, r.Key.Namespace
+	initial <- event.GenericEvent{Object: cm}
+
+	if err := c.Watch(&source.Channel{Source: initial}, &handler.EnqueueRequestForObject{}); err != nil {
+		return err
+	}
+
+	return mgr.Add(everyReplica{c})
+}
+
+var _ manager.LeaderElectionRunnable = everyReplica{}
+
+// everyReplica runs a controller on every replica, rather than only on the leader as controllers are by default
+type everyReplica struct {
+	controller.Controller
+}
+
+func (everyReplica) NeedLeaderElection() bool {
+	return false
+}
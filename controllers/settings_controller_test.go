@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+)
+
+func TestSettingsReconciler(t *testing.T) {
+	ctx := context.Background()
+
+	var loaded []map[string]string
+	r := &SettingsReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(testingScheme(t)).Build(),
+		Key:      types.NamespacedName{Name: consts.WebhookSettingsConfigMapName, Namespace: "ripfs-system"},
+		Defaults: map[string]string{"registry": "localhost:31609", "unresolved": "allow"},
+		OnSettings: func(data map[string]string) error {
+			if data["unresolved"] == "invalid" {
+				return fmt.Errorf("invalid unresolved policy")
+			}
+			loaded = append(loaded, data)
+			return nil
+		},
+	}
+
+	reconcile := func() {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: r.Key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Created from the defaults (the update is reconciled again in turn), then loaded
+	reconcile()
+	reconcile()
+
+	cm := &corev1.ConfigMap{}
+	if err := r.Get(ctx, r.Key, cm); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cm.Data, r.Defaults) {
+		t.Errorf("expected the settings to be created from %v, got %v", r.Defaults, cm.Data)
+	}
+	if len(loaded) != 1 || !reflect.DeepEqual(loaded[0], r.Defaults) {
+		t.Fatalf("expected the defaults to be loaded once, got %v", loaded)
+	}
+
+	// Changes are loaded, keeping anything already set
+	cm.Data["unresolved"] = "deny"
+	if err := r.Update(ctx, cm); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if len(loaded) != 2 || loaded[1]["unresolved"] != "deny" || loaded[1]["registry"] != "localhost:31609" {
+		t.Fatalf("expected the changed settings to be loaded, got %v", loaded)
+	}
+
+	// Invalid settings keep the previous ones, without retrying
+	cm.Data["unresolved"] = "invalid"
+	if err := r.Update(ctx, cm); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: r.Key}); err != nil || res.Requeue {
+		t.Errorf("expected invalid settings not to be retried, got %v: %v", res, err)
+	}
+	if len(loaded) != 2 {
+		t.Errorf("expected invalid settings not to be loaded, got %v", loaded)
+	}
+
+	// Other config maps are left alone
+	other := types.NamespacedName{Name: "other", Namespace: "ripfs-system"}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: other}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, other, &corev1.ConfigMap{}); err == nil {
+		t.Errorf("expected %s not to be created", other)
+	}
+}
+
+func TestSettingsReconcilerMissing(t *testing.T) {
+	ctx := context.Background()
+
+	key := types.NamespacedName{Name: consts.WebhookSettingsConfigMapName, Namespace: "ripfs-system"}
+	existing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+		Data:       map[string]string{"unresolved": "deny"},
+	}
+
+	r := &SettingsReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(testingScheme(t)).WithObjects(existing).Build(),
+		Key:      key,
+		Defaults: map[string]string{"registry": "localhost:31609", "unresolved": "allow"},
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only what's missing is filled in from the defaults
+	cm := &corev1.ConfigMap{}
+	if err := r.Get(ctx, key, cm); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"registry": "localhost:31609", "unresolved": "deny"}; !reflect.DeepEqual(cm.Data, want) {
+		t.Errorf("expected %v, got %v", want, cm.Data)
+	}
+}
+
+func TestSettingsEveryReplica(t *testing.T) {
+	// Replicas that aren't leading serve the webhook too, so they must reload its settings
+	if (everyReplica{}).NeedLeaderElection() {
+		t.Error("expected the settings to be reconciled without leader election")
+	}
+}
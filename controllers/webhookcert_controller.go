@@ -0,0 +1,139 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/joshrwolf/ripfs/internal/webhook"
+)
+
+// WebhookCertReconciler reissues the webhook's serving certificate, which the cert rotator only generates for the
+// manager's service, for every name the webhook is reached at. The reissued certificate is signed by the same ca and
+// still valid for the service, so the rotator keeps it until the ca itself is rotated.
+type WebhookCertReconciler struct {
+	client.Client
+
+	// SecretKey is the cert rotator's secret
+	SecretKey types.NamespacedName
+
+	// DNSNames are the dns names and ips the certificate is issued for, the first of which is the rotator's
+	DNSNames []string
+
+	// CertDir, if set, is kept up to date with the certificate, for managers running outside the cluster that don't
+	// have the secret mounted
+	CertDir string
+}
+
+func (r *WebhookCertReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, r.SecretKey, secret); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	// Nothing to sign with until the rotator generates its ca
+	caCert, caKey := secret.Data[webhook.CACertKey], secret.Data[webhook.CAKeyKey]
+	if len(caCert) == 0 || len(caKey) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	if !webhook.CoversNames(caCert, secret.Data[webhook.CertKey], r.DNSNames) {
+		cert, key, err := webhook.IssueCert(caCert, caKey, r.DNSNames)
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("issuing webhook certificate: %v", err)
+		}
+
+		secret.Data[webhook.CertKey] = cert
+		secret.Data[webhook.KeyKey] = key
+		if err := r.Update(ctx, secret); err != nil {
+			return ctrl.Result{}, err
+		}
+		l.Info("reissued webhook certificate", "names", r.DNSNames)
+	}
+
+	if r.CertDir != "" {
+		if err := writeCerts(r.CertDir, secret.Data); err != nil {
+			return ctrl.Result{}, fmt.Errorf("writing certificates to %s: %v", r.CertDir, err)
+		}
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// writeCerts writes the certificate and key to dir, replacing each file whole so the webhook server never loads half
+// of one, and leaving them be when unchanged
+func writeCerts(dir string, data map[string][]byte) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	// The key goes first, the webhook server reloads once the certificate changes
+	for _, k := range []string{webhook.KeyKey, webhook.CertKey} {
+		p := filepath.Join(dir, k)
+		if existing, err := os.ReadFile(p); err == nil && bytes.Equal(existing, data[k]) {
+			continue
+		}
+
+		tmp := p + ".tmp"
+		if err := os.WriteFile(tmp, data[k], 0o600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *WebhookCertReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	managed := predicate.NewPredicateFuncs(func(o client.Object) bool {
+		return client.ObjectKeyFromObject(o) == r.SecretKey
+	})
+
+	initial := make(chan event.GenericEvent, 1)
+	s := &corev1.Secret{}
+	s.Name, s.Namespace = r.SecretKey.Name, r.SecretKey.Namespace
+	initial <- event.GenericEvent{Object: s}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("webhookcert").
+		For(&corev1.Secret{}, builder.WithPredicates(managed)).
+		Watches(&source.Channel{Source: initial}, &handler.EnqueueRequestForObject{}).
+		Complete(r)
+}
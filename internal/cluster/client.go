@@ -0,0 +1,171 @@
+// Package cluster replicates images through an ipfs-cluster, pinning every object of each mapped image with a
+// replication factor, so a given number of copies is guaranteed to exist rather than whatever bitswap left behind.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Client is a client of an ipfs-cluster's rest api. Basic auth credentials may be given in the url's user info.
+type Client struct {
+	url  *url.URL
+	http *http.Client
+}
+
+// NewClient returns a client of the rest api at endpoint, such as http://ipfs-cluster:9094
+func NewClient(endpoint string) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ipfs-cluster api %s: %v", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid ipfs-cluster api %s, must be an http(s) url", endpoint)
+	}
+
+	return &Client{url: u, http: &http.Client{}}, nil
+}
+
+// Pin is an object pinned in the cluster, along with how many of its peers it's replicated to
+type Pin struct {
+	Cid            cid.Cid           `json:"-"`
+	Name           string            `json:"name"`
+	Metadata       map[string]string `json:"metadata"`
+	ReplicationMin int               `json:"replication_factor_min"`
+	ReplicationMax int               `json:"replication_factor_max"`
+	Allocations    []string          `json:"allocations"`
+}
+
+// UnmarshalJSON decodes a pin's cid as both versions of the api encode it, a string or an ipld link
+func (p *Pin) UnmarshalJSON(data []byte) error {
+	type pin Pin
+	var v struct {
+		pin
+		Cid json.RawMessage `json:"cid"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*p = Pin(v.pin)
+
+	var s string
+	if err := json.Unmarshal(v.Cid, &s); err != nil {
+		var link struct {
+			Cid string `json:"/"`
+		}
+		if err := json.Unmarshal(v.Cid, &link); err != nil {
+			return fmt.Errorf("invalid pin cid %s", v.Cid)
+		}
+		s = link.Cid
+	}
+
+	c, err := cid.Decode(s)
+	if err != nil {
+		return fmt.Errorf("invalid pin cid %s: %v", s, err)
+	}
+	p.Cid = c
+	return nil
+}
+
+// PinOptions are the replication factor and name of a pin. A replication factor of -1 replicates to every peer, and
+// 0 leaves it to the cluster's default.
+type PinOptions struct {
+	ReplicationMin int
+	ReplicationMax int
+	Name           string
+	Metadata       map[string]string
+}
+
+// Pin pins c in the cluster, or updates its replication factor if it's already pinned
+func (c *Client) Pin(ctx context.Context, id cid.Cid, opts PinOptions) error {
+	q := url.Values{}
+	q.Set("replication-min", strconv.Itoa(opts.ReplicationMin))
+	q.Set("replication-max", strconv.Itoa(opts.ReplicationMax))
+	if opts.Name != "" {
+		q.Set("name", opts.Name)
+	}
+	for k, v := range opts.Metadata {
+		q.Set("meta-"+k, v)
+	}
+
+	return c.do(ctx, http.MethodPost, "/pins/"+id.String(), q, nil)
+}
+
+// Unpin unpins c from the cluster
+func (c *Client) Unpin(ctx context.Context, id cid.Cid) error {
+	return c.do(ctx, http.MethodDelete, "/pins/"+id.String(), nil, nil)
+}
+
+// Pins lists every pin of the cluster
+func (c *Client) Pins(ctx context.Context) ([]Pin, error) {
+	var pins []Pin
+	err := c.do(ctx, http.MethodGet, "/allocations", url.Values{"filter": {"pin"}}, func(body io.Reader) error {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+
+		// Older apis respond with an array, newer ones stream each pin
+		data = bytes.TrimSpace(data)
+		if bytes.HasPrefix(data, []byte("[")) {
+			return json.Unmarshal(data, &pins)
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var p Pin
+			if err := dec.Decode(&p); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			pins = append(pins, p)
+		}
+	})
+	return pins, err
+}
+
+// apiError is the body of an api error
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, decode func(body io.Reader) error) error {
+	u := *c.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e apiError
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Message == "" {
+			return fmt.Errorf("ipfs-cluster %s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("ipfs-cluster %s %s: %s", method, path, e.Message)
+	}
+
+	if decode == nil {
+		return nil
+	}
+	return decode(resp.Body)
+}
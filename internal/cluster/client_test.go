@@ -0,0 +1,164 @@
+package cluster
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+func testingCid(t *testing.T, data string) cid.Cid {
+	mh, err := multihash.Sum([]byte(data), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(cid.Raw, mh)
+}
+
+// request is a request the testing api received
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	user   string
+}
+
+// testingCluster serves the api of an ipfs-cluster, recording every request and responding to each with body
+func testingCluster(t *testing.T, status int, body string) (*Client, *[]request) {
+	var reqs []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		reqs = append(reqs, request{method: r.Method, path: r.URL.Path, query: r.URL.Query(), user: user})
+
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = url.UserPassword("ripfs", "secret")
+	u.Path = "/api/"
+
+	c, err := NewClient(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, &reqs
+}
+
+func TestNewClient(t *testing.T) {
+	for _, endpoint := range []string{"ipfs-cluster:9094", "/dns4/ipfs-cluster/tcp/9094", "%"} {
+		if _, err := NewClient(endpoint); err == nil {
+			t.Errorf("expected %s to be invalid", endpoint)
+		}
+	}
+
+	if _, err := NewClient("https://ipfs-cluster:9094"); err != nil {
+		t.Errorf("expected an https api to be valid, got %v", err)
+	}
+}
+
+func TestClientPin(t *testing.T) {
+	ctx := context.Background()
+
+	c, reqs := testingCluster(t, http.StatusOK, "{}")
+	id := testingCid(t, "object")
+
+	if err := c.Pin(ctx, id, PinOptions{
+		ReplicationMin: 2,
+		ReplicationMax: -1,
+		Name:           "docker.io/library/nginx:1.21",
+		Metadata:       map[string]string{managedKey: managedValue},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Unpin(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []request{
+		{
+			method: http.MethodPost,
+			path:   "/api/pins/" + id.String(),
+			query: url.Values{
+				"replication-min": {"2"},
+				"replication-max": {"-1"},
+				"name":            {"docker.io/library/nginx:1.21"},
+				"meta-ripfs":      {"managed"},
+			},
+			user: "ripfs",
+		},
+		{method: http.MethodDelete, path: "/api/pins/" + id.String(), query: url.Values{}, user: "ripfs"},
+	}
+	if !reflect.DeepEqual(*reqs, want) {
+		t.Errorf("expected requests %+v, got %+v", want, *reqs)
+	}
+}
+
+func TestClientPins(t *testing.T) {
+	ctx := context.Background()
+
+	a, b := testingCid(t, "a"), testingCid(t, "b")
+
+	// Older apis respond with an array of string cids, newer ones stream pins with ipld links
+	tests := map[string]string{
+		"array": `[
+			{"cid": "` + a.String() + `", "name": "a", "replication_factor_min": 2, "replication_factor_max": 3, "metadata": {"ripfs": "managed"}},
+			{"cid": "` + b.String() + `", "name": "b", "replication_factor_min": -1, "replication_factor_max": -1}
+		]`,
+		"streamed": `{"cid": {"/": "` + a.String() + `"}, "name": "a", "replication_factor_min": 2, "replication_factor_max": 3, "metadata": {"ripfs": "managed"}}
+			{"cid": {"/": "` + b.String() + `"}, "name": "b", "replication_factor_min": -1, "replication_factor_max": -1}
+		`,
+	}
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, reqs := testingCluster(t, http.StatusOK, body)
+
+			pins, err := c.Pins(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := []Pin{
+				{Cid: a, Name: "a", ReplicationMin: 2, ReplicationMax: 3, Metadata: map[string]string{"ripfs": "managed"}},
+				{Cid: b, Name: "b", ReplicationMin: -1, ReplicationMax: -1},
+			}
+			if !reflect.DeepEqual(pins, want) {
+				t.Errorf("expected pins %+v, got %+v", want, pins)
+			}
+
+			if r := (*reqs)[0]; r.path != "/api/allocations" || r.query.Get("filter") != "pin" {
+				t.Errorf("expected the pins to be listed from the allocations, got %+v", r)
+			}
+		})
+	}
+
+	c, _ := testingCluster(t, http.StatusOK, `[{"cid": "not-a-cid"}]`)
+	if _, err := c.Pins(ctx); err == nil || !strings.Contains(err.Error(), "invalid pin cid") {
+		t.Errorf("expected an invalid cid to fail, got %v", err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	ctx := context.Background()
+
+	c, _ := testingCluster(t, http.StatusBadRequest, `{"code": 400, "message": "bad replication factor"}`)
+	if err := c.Pin(ctx, testingCid(t, "object"), PinOptions{}); err == nil || !strings.HasSuffix(err.Error(), ": bad replication factor") {
+		t.Errorf("expected the api's message, got %v", err)
+	}
+
+	// Errors without a message are reported by their status
+	c, _ = testingCluster(t, http.StatusBadGateway, "upstream unavailable")
+	if _, err := c.Pins(ctx); err == nil || !strings.HasSuffix(err.Error(), ": 502 Bad Gateway") {
+		t.Errorf("expected the status, got %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/go-multierror"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+var _ manager.Runnable = (*Replicator)(nil)
+var _ manager.LeaderElectionRunnable = (*Replicator)(nil)
+
+const (
+	// managedKey and managedValue are the metadata of every pin the replicator manages, only these are ever unpinned
+	managedKey   = "ripfs"
+	managedValue = "managed"
+
+	// mappingsName is the name the mappings themselves are pinned with
+	mappingsName = "ripfs mappings"
+)
+
+// Replicator pins every object of each mapped image in an ipfs-cluster with a replication factor, so the cluster keeps
+// at least ReplicationMin copies of it (and at most ReplicationMax) across its peers, and unpins them once they're no
+// longer mapped.
+//
+// Images aren't linked dags, so each object (and the mappings themselves) is its own cluster pin, named by the image
+// it belongs to.
+type Replicator struct {
+	Ipfs    iface.CoreAPI
+	Mapper  registry.Lister
+	Cluster *Client
+	Log     logr.Logger
+
+	Interval time.Duration
+
+	// ReplicationMin and ReplicationMax are the replication factor of every pin, -1 replicates to every peer
+	ReplicationMin int
+	ReplicationMax int
+}
+
+func (r *Replicator) NeedLeaderElection() bool {
+	return true
+}
+
+func (r *Replicator) Start(ctx context.Context) error {
+	t := time.NewTicker(r.Interval)
+	defer t.Stop()
+
+	for {
+		if err := r.Sync(ctx); err != nil && ctx.Err() == nil {
+			r.Log.Error(err, "replication pass failed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// Sync runs a single replication pass
+func (r *Replicator) Sync(ctx context.Context) error {
+	mp, mappings, err := r.Mapper.Mappings(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching mappings: %v", err)
+	}
+
+	// Anything we can't fully walk aborts the pass, it's better to unpin nothing than the wrong thing
+	mrp, err := r.Ipfs.ResolvePath(ctx, mp)
+	if err != nil {
+		return err
+	}
+	wanted := map[cid.Cid]string{mrp.Cid(): mappingsName}
+
+	for ref, v := range mappings {
+		rp, err := r.Ipfs.ResolvePath(ctx, path.New(v))
+		if err != nil {
+			return fmt.Errorf("resolving %s: %v", ref, err)
+		}
+
+		refs, err := registry.References(ctx, r.Ipfs, rp.Cid())
+		if err != nil {
+			return fmt.Errorf("walking %s: %v", ref, err)
+		}
+		for _, c := range refs {
+			if _, ok := wanted[c]; !ok {
+				wanted[c] = ref
+			}
+		}
+	}
+
+	pins, err := r.Cluster.Pins(ctx)
+	if err != nil {
+		return fmt.Errorf("listing cluster pins: %v", err)
+	}
+
+	pinned := make(map[cid.Cid]Pin, len(pins))
+	for _, p := range pins {
+		pinned[p.Cid] = p
+	}
+
+	var (
+		errs            error
+		added, unpinned int
+	)
+	for c, name := range wanted {
+		if p, ok := pinned[c]; ok && p.ReplicationMin == r.ReplicationMin && p.ReplicationMax == r.ReplicationMax {
+			continue
+		}
+
+		if err := r.Cluster.Pin(ctx, c, PinOptions{
+			ReplicationMin: r.ReplicationMin,
+			ReplicationMax: r.ReplicationMax,
+			Name:           name,
+			Metadata:       map[string]string{managedKey: managedValue},
+		}); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("pinning %s (%s): %v", c, name, err))
+			continue
+		}
+		added++
+	}
+
+	for c, p := range pinned {
+		if _, ok := wanted[c]; ok || p.Metadata[managedKey] != managedValue {
+			continue
+		}
+
+		if err := r.Cluster.Unpin(ctx, c); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("unpinning %s (%s): %v", c, p.Name, err))
+			continue
+		}
+		unpinned++
+	}
+
+	r.Log.V(1).Info("replication pass complete", "images", len(mappings), "objects", len(wanted), "pinned", added, "unpinned", unpinned)
+	return errs
+}
@@ -8,13 +8,146 @@ const (
 	CidMapperSecretName = Name + "-cid-mapper"
 	CidMapperSecretKey  = "ipns-cid"
 
+	// CidMapperPathKey is the path of the mappings last committed to the mapper secret, updated under its resource
+	// version so concurrent updates conflict (and merge) rather than overwriting one another
+	CidMapperPathKey = "path"
+
+	// CidMapperGenerationKey counts the updates committed to the mapper secret, so the Images recording them are
+	// applied in the order they were committed
+	CidMapperGenerationKey = "generation"
+
+	// MappingKeySecretName is the secret holding the cluster's key mappings are signed with (as MappingKeySecretKey),
+	// and MappingKeysConfigMapName the config map of public keys trusted to sign them, the cluster's as
+	// MappingKeysClusterKey
+	MappingKeySecretName     = Name + "-mapping-key"
+	MappingKeySecretKey      = "key.pem"
+	MappingKeysConfigMapName = Name + "-mapping-keys"
+	MappingKeysClusterKey    = "cluster.pub"
+
+	// MappingsTopic is the pubsub topic mapping updates are announced on
+	MappingsTopic = Name + "/mappings"
+
 	ClusterConfigSecretName = Name + "-cluster-config"
 
+	// ImagePriorityAnnotation gives the images a pod runs a priority class, ordering their eviction under storage pressure
+	ImagePriorityAnnotation = Name + ".dev/image-priority"
+
+	// OriginalImagesAnnotation records the images the webhook rewrote a pod's containers from, as a json object of
+	// container name => image
+	OriginalImagesAnnotation = Name + ".dev/original-images"
+
+	// RewrittenImagesAnnotation records what the webhook rewrote a pod's images to, as a json object of original image =>
+	// rewritten image
+	RewrittenImagesAnnotation = Name + ".dev/rewritten-images"
+
+	// UnresolvedImagesAnnotation lists the images (comma separated) of a pod that weren't available from ripfs when it
+	// was admitted, when the webhook warns of them
+	UnresolvedImagesAnnotation = Name + ".dev/unresolved-images"
+
+	// RollbackAnnotation lists the images (comma separated, as the pod references them) the webhook leaves as they are
+	// for a pod, or the pods of a workload's template, after they were rolled back from ripfs
+	RollbackAnnotation = Name + ".dev/rollback"
+
+	// SkipAnnotation opts a pod (or a workload's pod template) out of having its images rewritten when it's "true", and
+	// SkipContainersAnnotation opts the containers (init and ephemeral ones included) it lists by name (comma
+	// separated) out
+	SkipAnnotation           = Name + ".dev/skip"
+	SkipContainersAnnotation = Name + ".dev/skip-containers"
+
+	// NodeReplicatedAnnotation lists the roots (comma separated) the manager pinned for a drained node, which only its
+	// agent provided, and NodeRemovableAnnotation marks a drained node once nothing is left only on it
+	NodeReplicatedAnnotation = Name + ".dev/replicated"
+	NodeRemovableAnnotation  = Name + ".dev/removable"
+
+	// ContentProfilesConfigMapName holds the content profiles agents prefetch when they start, each key a profile of
+	// roots, and ContentProfileLabel picks the profile of a node (DefaultContentProfile if unlabeled)
+	ContentProfilesConfigMapName = Name + "-content-profiles"
+	ContentProfileLabel          = Name + ".dev/content-profile"
+	DefaultContentProfile        = "default"
+
+	// ReplicationPoliciesConfigMapName holds the replication policy of each image (by reference) under
+	// ReplicationPoliciesKey, and NodePinnedAnnotation lists the roots (comma separated) the manager assigned a node's
+	// agent to pin by them
+	ReplicationPoliciesConfigMapName = Name + "-replication-policies"
+	ReplicationPoliciesKey           = "policies"
+	NodePinnedAnnotation             = Name + ".dev/pinned"
+
+	// ManagerImageReference and BusyboxImageReference are the references ripfs's own images are mapped as, which are
+	// never evicted so ripfs can always be restarted without reaching an upstream registry
+	ManagerImageReference = Name + "/manager:seed"
+	BusyboxImageReference = Name + "/busybox:seed"
+
+	// TeardownFinalizer holds the managed secrets until whatever they reference has been torn down
+	TeardownFinalizer = Name + ".dev/teardown"
+
+	// UninstallAnnotation marks a managed secret as deleted by an uninstall, only then is what it references torn down.
+	// Secrets deleted without it are restored as they were.
+	UninstallAnnotation = Name + ".dev/uninstall"
+
+	// ReleasedConfigMapName records the managed secrets released by an uninstall, which mustn't be created again (even
+	// by a restarted manager) until ripfs is installed again
+	ReleasedConfigMapName = Name + "-released"
+
+	// WebhookSettingsConfigMapName holds the webhook's runtime settings, reloaded whenever it changes
+	WebhookSettingsConfigMapName = Name + "-webhook-settings"
+
+	// AgentsLabel selects the agents serving the registry on every node, at AgentsRegistryPort
+	AgentsLabel        = "control-plane"
+	AgentsLabelValue   = "agents"
+	AgentsRegistryPort = 5050
+
+	// ManagerDeploymentName is the deployment running the manager's replicas
+	ManagerDeploymentName = Name + "-controller-manager"
+
+	// ManagerLabelValue selects the manager's replicas (by AgentsLabel), each of them a bootstrap peer of the swarm
+	ManagerLabelValue = "controller-manager"
+
+	// PeerIDAnnotation records the peer id of the ipfs node a manager replica runs on its pod, so every replica is
+	// published as a bootstrap peer
+	PeerIDAnnotation = Name + ".dev/peer-id"
+
+	// PullFailureReason is the reason of the events explaining why pods fail to pull ripfs images, and RollbackReason
+	// of those recording their rollback to their original images
+	PullFailureReason = "RipfsPullFailure"
+	RollbackReason    = "RipfsRollback"
+
+	// UnresolvedReason is the reason of the events warning of pods admitted with images that aren't available from ripfs
+	UnresolvedReason = "RipfsUnresolvedImages"
+
+	// RepoGCReason is the reason of the events recording garbage collection of an ipfs repo, and RepoWatermarkReason of
+	// those warning that it grew beyond its watermark
+	RepoGCReason        = "RipfsRepoGC"
+	RepoWatermarkReason = "RipfsRepoWatermark"
+
+	// NodeDrainReason is the reason of the events recording what was replicated away from a drained node, and
+	// NodeRebalanceReason of those recording what was released once it returned
+	NodeDrainReason     = "RipfsNodeDrain"
+	NodeRebalanceReason = "RipfsNodeRebalance"
+
+	// ContentProfileReason is the reason of the events recording an agent's prefetch of its node's content profile
+	ContentProfileReason = "RipfsContentProfile"
+
+	// ReplicationReason is the reason of the events recording the images an agent pinned (or released) by their
+	// replication policies, and of those warning that a policy can't be met
+	ReplicationReason = "RipfsReplication"
+
 	MutatorMWHConfigurationName = Name + "-webhook"
 	MutatorCertsSecretName      = Name + "-webhook-certs"
 	MutatorCAName               = Name + "-ca"
 	MutatorCAOrg                = Name
 
+	// ValidatorVWHConfigurationName is the validating webhook configuration of the provenance validator, and
+	// ProvenanceKeysConfigMapName the config map of public keys it verifies the cosign signatures of images with
+	ValidatorVWHConfigurationName = Name + "-provenance"
+	ProvenanceKeysConfigMapName   = Name + "-provenance-keys"
+
 	BootstrapServiceName      = Name + "-controller-manager"
 	BootstrapLeaderElectionID = "48b90513.ripfs.dev"
+
+	// BootstrapHeadlessServiceName resolves to every manager replica (ready or not), so each one's bootstrap peer is
+	// dialed through it
+	BootstrapHeadlessServiceName = Name + "-bootstrap"
 )
+
+// Version is the version of ripfs, set when it's built (-ldflags "-X github.com/joshrwolf/ripfs/internal/consts.Version=...")
+var Version = "dev"
@@ -0,0 +1,268 @@
+// Package discovery finds the swarm's peers through Kubernetes rather than mDNS, which CNIs blocking multicast break.
+// Every ripfs pod registers its node's addresses in a shared config map, and connects to every other node registered
+// there.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// DefaultInterval is how often a pod refreshes its registration and connects to the peers registered
+	DefaultInterval = 30 * time.Second
+
+	// retryInterval is how soon a failed sync is retried, such as while the node is still starting
+	retryInterval = 5 * time.Second
+
+	// connectTimeout bounds each connection to a registered peer
+	connectTimeout = 10 * time.Second
+)
+
+// Registration is a node's entry in the config map, under the name of the pod it runs in
+type Registration struct {
+	// Addrs are the node's routable swarm addresses, each ending in its peer id
+	Addrs []string `json:"addrs"`
+
+	// Seen is when the registration was last refreshed, registrations not refreshed for a few intervals are pruned
+	Seen time.Time `json:"seen"`
+}
+
+// Discoverer registers a node in a config map, and connects it to every other node registered there
+type Discoverer struct {
+	api      iface.CoreAPI
+	cms      corev1client.ConfigMapInterface
+	name     string
+	pod      string
+	interval time.Duration
+
+	// create creates the config map when it doesn't exist yet, rather than waiting for it to be
+	create bool
+}
+
+// New returns a Discoverer registering the node behind api as pod, in the config map name of cms. Only a Discoverer
+// that may create the config map (the manager's) does so, the others wait for it to be created.
+func New(api iface.CoreAPI, cms corev1client.ConfigMapInterface, name, pod string, interval time.Duration, create bool) *Discoverer {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	return &Discoverer{
+		api:      api,
+		cms:      cms,
+		name:     name,
+		pod:      pod,
+		interval: interval,
+		create:   create,
+	}
+}
+
+// Start syncs every interval until ctx is done, then removes the node's registration
+func (d *Discoverer) Start(ctx context.Context) error {
+	for {
+		wait := d.interval
+		if err := d.Sync(ctx); err != nil && ctx.Err() == nil {
+			fmt.Println("discovering peers: ", err)
+			wait = retryInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return d.deregister()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// NeedLeaderElection runs the Discoverer on every replica rather than only the leader, as the node it registers is, so
+// every replica's node is discovered (and discovers its peers) whether it leads or not
+func (d *Discoverer) NeedLeaderElection() bool {
+	return false
+}
+
+// Sync refreshes the node's registration, prunes those gone stale, and connects to every other node registered that
+// the node isn't already connected to
+func (d *Discoverer) Sync(ctx context.Context) error {
+	self, err := d.api.Key().Self(ctx)
+	if err != nil {
+		return fmt.Errorf("reading the node's identity: %v", err)
+	}
+
+	addrs, err := d.addrs(ctx, self.ID())
+	if err != nil {
+		return err
+	}
+
+	cm, err := d.register(ctx, Registration{Addrs: addrs, Seen: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("registering in config map %s: %v", d.name, err)
+	}
+
+	conns, err := d.api.Swarm().Peers(ctx)
+	if err != nil {
+		return fmt.Errorf("listing swarm peers: %v", err)
+	}
+
+	connected := map[peer.ID]bool{self.ID(): true}
+	for _, c := range conns {
+		connected[c.ID()] = true
+	}
+
+	var (
+		errs  error
+		stale []string
+	)
+	for pod, data := range cm.Data {
+		if pod == d.pod {
+			continue
+		}
+
+		var r Registration
+		if err := json.Unmarshal([]byte(data), &r); err != nil || time.Since(r.Seen) > 3*d.interval {
+			stale = append(stale, pod)
+			continue
+		}
+
+		infos, err := r.AddrInfos()
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("peer of %s: %v", pod, err))
+			continue
+		}
+
+		for _, info := range infos {
+			if connected[info.ID] {
+				continue
+			}
+
+			cctx, cancel := context.WithTimeout(ctx, connectTimeout)
+			err := d.api.Swarm().Connect(cctx, info)
+			cancel()
+			if err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("connecting to %s (%s): %v", info.ID, pod, err))
+				continue
+			}
+			connected[info.ID] = true
+		}
+	}
+
+	if len(stale) > 0 {
+		if err := d.remove(ctx, stale); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("pruning stale registrations: %v", err))
+		}
+	}
+	return errs
+}
+
+// addrs returns the node's routable swarm addresses, each ending in its peer id
+func (d *Discoverer) addrs(ctx context.Context, id peer.ID) ([]string, error) {
+	local, err := d.api.Swarm().LocalAddrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing the node's addresses: %v", err)
+	}
+
+	p2p, err := multiaddr.NewComponent("p2p", id.String())
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, a := range local {
+		if manet.IsIPLoopback(a) || manet.IsIPUnspecified(a) {
+			continue
+		}
+		addrs = append(addrs, a.Encapsulate(p2p).String())
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("the node has no routable addresses")
+	}
+	return addrs, nil
+}
+
+// register writes r as the node's registration, creating the config map if it doesn't exist yet and d may
+func (d *Discoverer) register(ctx context.Context, r Registration) (*corev1.ConfigMap, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := map[string]interface{}{d.pod: string(data)}
+
+	cm, err := d.patchData(ctx, entry)
+	if !errors.IsNotFound(err) {
+		return cm, err
+	}
+
+	if !d.create {
+		// Retried until the manager creates it
+		return nil, fmt.Errorf("config map doesn't exist yet, waiting for the manager to create it")
+	}
+
+	cm, err = d.cms.Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: d.name},
+		Data:       map[string]string{d.pod: string(data)},
+	}, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		// Another pod created it first
+		return d.patchData(ctx, entry)
+	}
+	return cm, err
+}
+
+// deregister removes the node's registration, so its peers stop connecting to it right away
+func (d *Discoverer) deregister() error {
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+
+	if err := d.remove(ctx, []string{d.pod}); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("deregistering from config map %s: %v", d.name, err)
+	}
+	return nil
+}
+
+// remove removes the registrations of pods
+func (d *Discoverer) remove(ctx context.Context, pods []string) error {
+	entries := make(map[string]interface{})
+	for _, pod := range pods {
+		entries[pod] = nil
+	}
+
+	_, err := d.patchData(ctx, entries)
+	return err
+}
+
+// patchData merges entries into the config map's data (removing those that are nil) rather than updating all of it, so
+// pods registering at the same time never conflict
+func (d *Discoverer) patchData(ctx context.Context, entries map[string]interface{}) (*corev1.ConfigMap, error) {
+	data, err := json.Marshal(map[string]interface{}{"data": entries})
+	if err != nil {
+		return nil, err
+	}
+	return d.cms.Patch(ctx, d.name, types.MergePatchType, data, metav1.PatchOptions{})
+}
+
+// AddrInfos groups the registration's addresses by the peer each ends in
+func (r Registration) AddrInfos() ([]peer.AddrInfo, error) {
+	var mas []multiaddr.Multiaddr
+	for _, a := range r.Addrs {
+		ma, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return nil, err
+		}
+		mas = append(mas, ma)
+	}
+	return peer.AddrInfosFromP2pAddrs(mas...)
+}
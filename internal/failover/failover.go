@@ -0,0 +1,300 @@
+// Package failover spreads the reads of an ipfs api across several endpoints, so the registry keeps serving while
+// any of them can. Reads go round robin across the endpoints whose health check last passed, falling over to the
+// next one whenever a read fails. Everything else (adds, pins, pubsub, ...) only goes to the primary endpoint, which
+// owns the node's pins and index.
+package failover
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	format "github.com/ipfs/go-ipld-format"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/rs/zerolog"
+)
+
+const (
+	DefaultInterval = 10 * time.Second
+	DefaultTimeout  = 5 * time.Second
+)
+
+type Options struct {
+	// Interval is how often every endpoint is health checked, defaults to DefaultInterval
+	Interval time.Duration
+
+	// Timeout is how long a health check has to pass, defaults to DefaultTimeout
+	Timeout time.Duration
+
+	// Check health checks an endpoint, defaults to asking it for its own peer identity
+	Check func(ctx context.Context, api iface.CoreAPI) error
+}
+
+// Endpoint is one of the apis reads are spread across
+type Endpoint struct {
+	// Name identifies the endpoint when its health changes, such as its multiaddr
+	Name string
+
+	API iface.CoreAPI
+}
+
+// endpoint is an Endpoint along with its health, shared by every api derived with WithOptions
+type endpoint struct {
+	Endpoint
+	down *int32
+}
+
+func (e *endpoint) healthy() bool {
+	return atomic.LoadInt32(e.down) == 0
+}
+
+// API is an ipfs api reading from whichever of its endpoints are healthy
+type API struct {
+	iface.CoreAPI
+
+	opts      Options
+	endpoints []endpoint
+	next      *uint32
+}
+
+// New returns an api over endpoints (at least one), the first of which is the primary. Every endpoint starts out
+// healthy, and is only health checked while Run is running.
+func New(endpoints []Endpoint, opts *Options) *API {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	o := *opts
+	if o.Interval <= 0 {
+		o.Interval = DefaultInterval
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.Check == nil {
+		o.Check = func(ctx context.Context, api iface.CoreAPI) error {
+			_, err := api.Key().Self(ctx)
+			return err
+		}
+	}
+
+	a := &API{CoreAPI: endpoints[0].API, opts: o, next: new(uint32)}
+	for _, e := range endpoints {
+		a.endpoints = append(a.endpoints, endpoint{Endpoint: e, down: new(int32)})
+	}
+	return a
+}
+
+// Run health checks every endpoint each interval, until ctx is done
+func (a *API) Run(ctx context.Context) {
+	t := time.NewTicker(a.opts.Interval)
+	defer t.Stop()
+
+	for {
+		a.CheckHealth(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// CheckHealth health checks every endpoint once, concurrently
+func (a *API) CheckHealth(ctx context.Context) {
+	l := zerolog.Ctx(ctx)
+
+	done := make(chan struct{})
+	for i := range a.endpoints {
+		go func(e *endpoint) {
+			defer func() { done <- struct{}{} }()
+
+			cctx, cancel := context.WithTimeout(ctx, a.opts.Timeout)
+			defer cancel()
+
+			err := a.opts.Check(cctx, e.API)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err != nil {
+				if atomic.SwapInt32(e.down, 1) == 0 {
+					l.Warn().Err(err).Str("endpoint", e.Name).Msg("ipfs api unhealthy, no longer reading from it")
+				}
+				return
+			}
+
+			if atomic.SwapInt32(e.down, 0) == 1 {
+				l.Info().Str("endpoint", e.Name).Msg("ipfs api healthy again")
+			}
+		}(&a.endpoints[i])
+	}
+
+	for range a.endpoints {
+		<-done
+	}
+}
+
+// Healthy reports the health of each endpoint, in the order they were given
+func (a *API) Healthy() []bool {
+	h := make([]bool, len(a.endpoints))
+	for i := range a.endpoints {
+		h[i] = a.endpoints[i].healthy()
+	}
+	return h
+}
+
+// order returns the endpoints to try a read with, every healthy endpoint starting from the next in the rotation. With
+// nothing healthy every endpoint is tried anyways, the last health check may be stale.
+func (a *API) order() []*endpoint {
+	n := len(a.endpoints)
+	start := int(atomic.AddUint32(a.next, 1)-1) % n
+
+	var healthy, all []*endpoint
+	for i := 0; i < n; i++ {
+		e := &a.endpoints[(start+i)%n]
+		if e.healthy() {
+			healthy = append(healthy, e)
+		}
+		all = append(all, e)
+	}
+
+	if len(healthy) == 0 {
+		return all
+	}
+	return healthy
+}
+
+// read calls fn with each endpoint in turn until one succeeds, returning the last error when none do
+func (a *API) read(ctx context.Context, fn func(api iface.CoreAPI) error) error {
+	var err error
+	for _, e := range a.order() {
+		if err = fn(e.API); err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (a *API) Unixfs() iface.UnixfsAPI {
+	return &unixfsAPI{UnixfsAPI: a.CoreAPI.Unixfs(), a: a}
+}
+
+func (a *API) Block() iface.BlockAPI {
+	return &blockAPI{BlockAPI: a.CoreAPI.Block(), a: a}
+}
+
+func (a *API) Dag() iface.APIDagService {
+	return &dagAPI{APIDagService: a.CoreAPI.Dag(), a: a}
+}
+
+func (a *API) Name() iface.NameAPI {
+	return &nameAPI{NameAPI: a.CoreAPI.Name(), a: a}
+}
+
+func (a *API) ResolvePath(ctx context.Context, p path.Path) (path.Resolved, error) {
+	var rp path.Resolved
+	err := a.read(ctx, func(api iface.CoreAPI) (err error) {
+		rp, err = api.ResolvePath(ctx, p)
+		return err
+	})
+	return rp, err
+}
+
+func (a *API) ResolveNode(ctx context.Context, p path.Path) (format.Node, error) {
+	var nd format.Node
+	err := a.read(ctx, func(api iface.CoreAPI) (err error) {
+		nd, err = api.ResolveNode(ctx, p)
+		return err
+	})
+	return nd, err
+}
+
+// WithOptions applies opts to every endpoint, the returned api shares this one's health checks and rotation
+func (a *API) WithOptions(opts ...options.ApiOption) (iface.CoreAPI, error) {
+	wa := &API{opts: a.opts, next: a.next}
+	for _, e := range a.endpoints {
+		api, err := e.API.WithOptions(opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		e.API = api
+		wa.endpoints = append(wa.endpoints, e)
+	}
+
+	wa.CoreAPI = wa.endpoints[0].API
+	return wa, nil
+}
+
+type unixfsAPI struct {
+	iface.UnixfsAPI
+	a *API
+}
+
+// Get fails over while resolving p, once a node is returned its content is read from whichever endpoint returned it
+func (u *unixfsAPI) Get(ctx context.Context, p path.Path) (files.Node, error) {
+	var nd files.Node
+	err := u.a.read(ctx, func(api iface.CoreAPI) (err error) {
+		nd, err = api.Unixfs().Get(ctx, p)
+		return err
+	})
+	return nd, err
+}
+
+type blockAPI struct {
+	iface.BlockAPI
+	a *API
+}
+
+func (b *blockAPI) Get(ctx context.Context, p path.Path) (io.Reader, error) {
+	var r io.Reader
+	err := b.a.read(ctx, func(api iface.CoreAPI) (err error) {
+		r, err = api.Block().Get(ctx, p)
+		return err
+	})
+	return r, err
+}
+
+func (b *blockAPI) Stat(ctx context.Context, p path.Path) (iface.BlockStat, error) {
+	var bs iface.BlockStat
+	err := b.a.read(ctx, func(api iface.CoreAPI) (err error) {
+		bs, err = api.Block().Stat(ctx, p)
+		return err
+	})
+	return bs, err
+}
+
+type dagAPI struct {
+	iface.APIDagService
+	a *API
+}
+
+func (d *dagAPI) Get(ctx context.Context, c cid.Cid) (format.Node, error) {
+	var nd format.Node
+	err := d.a.read(ctx, func(api iface.CoreAPI) (err error) {
+		nd, err = api.Dag().Get(ctx, c)
+		return err
+	})
+	return nd, err
+}
+
+type nameAPI struct {
+	iface.NameAPI
+	a *API
+}
+
+func (n *nameAPI) Resolve(ctx context.Context, name string, opts ...options.NameResolveOption) (path.Path, error) {
+	var p path.Path
+	err := n.a.read(ctx, func(api iface.CoreAPI) (err error) {
+		p, err = api.Name().Resolve(ctx, name, opts...)
+		return err
+	})
+	return p, err
+}
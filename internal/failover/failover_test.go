@@ -0,0 +1,176 @@
+package failover
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	format "github.com/ipfs/go-ipld-format"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// stubAPI is an endpoint counting the blocks read through it, which it only has when has is set
+type stubAPI struct {
+	iface.CoreAPI
+
+	has   bool
+	reads *int32
+}
+
+func newStub(has bool) *stubAPI {
+	return &stubAPI{has: has, reads: new(int32)}
+}
+
+func (s *stubAPI) Block() iface.BlockAPI {
+	return stubBlock{s: s}
+}
+
+func (s *stubAPI) WithOptions(...options.ApiOption) (iface.CoreAPI, error) {
+	return s, nil
+}
+
+func (s *stubAPI) count() int {
+	return int(atomic.LoadInt32(s.reads))
+}
+
+type stubBlock struct {
+	iface.BlockAPI
+	s *stubAPI
+}
+
+func (b stubBlock) Get(ctx context.Context, p path.Path) (io.Reader, error) {
+	atomic.AddInt32(b.s.reads, 1)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !b.s.has {
+		return nil, format.ErrNotFound
+	}
+	return bytes.NewReader([]byte("block")), nil
+}
+
+func (b stubBlock) Put(context.Context, io.Reader, ...options.BlockPutOption) (iface.BlockStat, error) {
+	return nil, fmt.Errorf("stub")
+}
+
+var block = path.New("/ipfs/bafkqaaa")
+
+func TestFailover(t *testing.T) {
+	ctx := context.Background()
+
+	// Only the second endpoint has the block, every read through the first falls over to it
+	primary, other := newStub(false), newStub(true)
+
+	var down int32
+	a := New([]Endpoint{{Name: "primary", API: primary}, {Name: "other", API: other}}, &Options{
+		Check: func(ctx context.Context, api iface.CoreAPI) error {
+			if api == primary && atomic.LoadInt32(&down) == 1 {
+				return fmt.Errorf("down")
+			}
+			return nil
+		},
+	})
+
+	if got := a.Healthy(); !reflect.DeepEqual(got, []bool{true, true}) {
+		t.Fatalf("expected every endpoint to start out healthy, got %v", got)
+	}
+
+	// Round robin starts every other read on the primary
+	for i := 0; i < 4; i++ {
+		if _, err := a.Block().Get(ctx, block); err != nil {
+			t.Fatalf("expected reads to fall over to the endpoint with the block, got %v", err)
+		}
+	}
+	if primary.count() != 2 || other.count() != 4 {
+		t.Errorf("expected the primary to be tried by every other read, got %d (and %d of the other)", primary.count(), other.count())
+	}
+
+	// An unhealthy primary is skipped entirely once its health check fails
+	atomic.StoreInt32(&down, 1)
+	a.CheckHealth(ctx)
+
+	if got := a.Healthy(); !reflect.DeepEqual(got, []bool{false, true}) {
+		t.Fatalf("expected only the primary to be unhealthy, got %v", got)
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := a.Block().Get(ctx, block); err != nil {
+			t.Fatalf("expected reads to skip the unhealthy primary, got %v", err)
+		}
+	}
+	if primary.count() != 2 {
+		t.Errorf("expected the unhealthy primary not to be read from, got %d reads", primary.count())
+	}
+
+	// Apis derived with options share the endpoints' health
+	wa, err := a.WithOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := wa.(*API).Healthy(); !reflect.DeepEqual(got, []bool{false, true}) {
+		t.Errorf("expected the derived api to share the endpoints' health, got %v", got)
+	}
+
+	// Healthy again once its health check passes
+	atomic.StoreInt32(&down, 0)
+	a.CheckHealth(ctx)
+	if got := wa.(*API).Healthy(); !reflect.DeepEqual(got, []bool{true, true}) {
+		t.Errorf("expected the primary to be healthy again, got %v", got)
+	}
+}
+
+func TestFailoverNothingHealthy(t *testing.T) {
+	ctx := context.Background()
+
+	primary, other := newStub(false), newStub(true)
+	a := New([]Endpoint{{Name: "primary", API: primary}, {Name: "other", API: other}}, &Options{
+		Check: func(ctx context.Context, api iface.CoreAPI) error { return fmt.Errorf("down") },
+	})
+	a.CheckHealth(ctx)
+
+	// The last health check may be stale, so every endpoint is still tried
+	if _, err := a.Block().Get(ctx, block); err != nil {
+		t.Errorf("expected reads to be tried anyways with nothing healthy, got %v", err)
+	}
+
+	// Failing everywhere returns the last endpoint's error
+	b := New([]Endpoint{{Name: "primary", API: newStub(false)}, {Name: "other", API: newStub(false)}}, nil)
+	if _, err := b.Block().Get(ctx, block); err != format.ErrNotFound {
+		t.Errorf("expected the read to fail, got %v", err)
+	}
+}
+
+func TestFailoverCanceled(t *testing.T) {
+	primary, other := newStub(true), newStub(true)
+	a := New([]Endpoint{{Name: "primary", API: primary}, {Name: "other", API: other}}, nil)
+
+	// A canceled read isn't retried on the other endpoints
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := a.Block().Get(ctx, block); err != context.Canceled {
+		t.Errorf("expected the read to be canceled, got %v", err)
+	}
+	if n := primary.count() + other.count(); n != 1 {
+		t.Errorf("expected only one endpoint to be tried, got %d", n)
+	}
+}
+
+func TestFailoverWrites(t *testing.T) {
+	primary, other := newStub(true), newStub(true)
+	a := New([]Endpoint{{Name: "primary", API: primary}, {Name: "other", API: other}}, nil)
+
+	// Anything but reads only goes to the primary
+	if a.CoreAPI != primary {
+		t.Errorf("expected the primary to serve everything but reads")
+	}
+	if _, err := a.Block().Put(context.Background(), bytes.NewReader(nil)); err == nil || primary.count()+other.count() != 0 {
+		t.Errorf("expected puts to go to the primary as they are, got %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+// Package faults injects failures into an ipfs api, so the retry and fallback paths of the registry and webhook can
+// be exercised against a degraded swarm. Nothing is injected unless an api is explicitly wrapped, and nothing
+// should ever be wrapped outside of testing.
+package faults
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	format "github.com/ipfs/go-ipld-format"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// Config is the set of faults currently injected
+type Config struct {
+	// Latency delays every read of a block (or file)
+	Latency time.Duration `json:"latency,omitempty"`
+
+	// Missing cids fail to be read or resolved, as if nobody in the swarm provided them
+	Missing []string `json:"missing,omitempty"`
+
+	// DropPeers hides every peer, and fails every ipns resolution, as if the node was cut off from the swarm
+	DropPeers bool `json:"dropPeers,omitempty"`
+}
+
+// Faults holds the injected faults, which can be changed at any time (such as over its admin api)
+type Faults struct {
+	mu      sync.RWMutex
+	cfg     Config
+	missing map[cid.Cid]bool
+}
+
+func New() *Faults {
+	return &Faults{missing: make(map[cid.Cid]bool)}
+}
+
+// Set replaces the injected faults with cfg
+func (f *Faults) Set(cfg Config) error {
+	missing := make(map[cid.Cid]bool)
+	for _, m := range cfg.Missing {
+		c, err := cid.Decode(strings.TrimPrefix(m, "/ipfs/"))
+		if err != nil {
+			return err
+		}
+		missing[c] = true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.cfg, f.missing = cfg, missing
+	return nil
+}
+
+// Config returns the injected faults
+func (f *Faults) Config() Config {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.cfg
+}
+
+// ServeHTTP is the admin api, GET returns the injected faults, PUT replaces them and DELETE clears them
+func (f *Faults) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		cfg := Config{}
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := f.Set(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+	case http.MethodDelete:
+		f.Set(Config{})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.Config())
+}
+
+// read injects the faults of reading p
+func (f *Faults) read(ctx context.Context, p path.Path) error {
+	f.mu.RLock()
+	latency, missing := f.cfg.Latency, f.missing
+	f.mu.RUnlock()
+
+	if latency > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(latency):
+		}
+	}
+
+	if c, ok := pathCid(p); ok && missing[c] {
+		return format.ErrNotFound
+	}
+	return nil
+}
+
+func (f *Faults) dropped() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.cfg.DropPeers
+}
+
+// pathCid returns the cid p is rooted at
+func pathCid(p path.Path) (cid.Cid, bool) {
+	if rp, ok := p.(path.Resolved); ok {
+		return rp.Root(), true
+	}
+
+	segs := strings.Split(strings.Trim(p.String(), "/"), "/")
+	if len(segs) < 2 || segs[0] != "ipfs" {
+		return cid.Cid{}, false
+	}
+
+	c, err := cid.Decode(segs[1])
+	return c, err == nil
+}
+
+// Wrap returns api with f injected into every read, resolution and peer listing. Anything else is passed through
+// untouched, and the wrapped api no longer exposes the raw requests of an http client.
+func Wrap(api iface.CoreAPI, f *Faults) iface.CoreAPI {
+	return &coreAPI{CoreAPI: api, f: f}
+}
+
+type coreAPI struct {
+	iface.CoreAPI
+	f *Faults
+}
+
+func (a *coreAPI) Unixfs() iface.UnixfsAPI {
+	return &unixfsAPI{UnixfsAPI: a.CoreAPI.Unixfs(), f: a.f}
+}
+
+func (a *coreAPI) Block() iface.BlockAPI {
+	return &blockAPI{BlockAPI: a.CoreAPI.Block(), f: a.f}
+}
+
+func (a *coreAPI) Name() iface.NameAPI {
+	return &nameAPI{NameAPI: a.CoreAPI.Name(), f: a.f}
+}
+
+func (a *coreAPI) Swarm() iface.SwarmAPI {
+	return &swarmAPI{SwarmAPI: a.CoreAPI.Swarm(), f: a.f}
+}
+
+func (a *coreAPI) ResolvePath(ctx context.Context, p path.Path) (path.Resolved, error) {
+	if err := a.f.read(ctx, p); err != nil {
+		return nil, err
+	}
+	return a.CoreAPI.ResolvePath(ctx, p)
+}
+
+func (a *coreAPI) ResolveNode(ctx context.Context, p path.Path) (format.Node, error) {
+	if err := a.f.read(ctx, p); err != nil {
+		return nil, err
+	}
+	return a.CoreAPI.ResolveNode(ctx, p)
+}
+
+func (a *coreAPI) WithOptions(opts ...options.ApiOption) (iface.CoreAPI, error) {
+	api, err := a.CoreAPI.WithOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(api, a.f), nil
+}
+
+type unixfsAPI struct {
+	iface.UnixfsAPI
+	f *Faults
+}
+
+func (u *unixfsAPI) Get(ctx context.Context, p path.Path) (files.Node, error) {
+	if err := u.f.read(ctx, p); err != nil {
+		return nil, err
+	}
+	return u.UnixfsAPI.Get(ctx, p)
+}
+
+type blockAPI struct {
+	iface.BlockAPI
+	f *Faults
+}
+
+func (b *blockAPI) Get(ctx context.Context, p path.Path) (io.Reader, error) {
+	if err := b.f.read(ctx, p); err != nil {
+		return nil, err
+	}
+	return b.BlockAPI.Get(ctx, p)
+}
+
+type nameAPI struct {
+	iface.NameAPI
+	f *Faults
+}
+
+func (n *nameAPI) Resolve(ctx context.Context, name string, opts ...options.NameResolveOption) (path.Path, error) {
+	if n.f.dropped() {
+		return nil, fmt.Errorf("resolving %s: no peers in the swarm", name)
+	}
+	return n.NameAPI.Resolve(ctx, name, opts...)
+}
+
+type swarmAPI struct {
+	iface.SwarmAPI
+	f *Faults
+}
+
+func (s *swarmAPI) Peers(ctx context.Context) ([]iface.ConnectionInfo, error) {
+	if s.f.dropped() {
+		return nil, nil
+	}
+	return s.SwarmAPI.Peers(ctx)
+}
@@ -0,0 +1,190 @@
+package faults
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/multiformats/go-multihash"
+)
+
+// stubAPI serves a block for any path, resolves every name, and always has a peer
+type stubAPI struct {
+	iface.CoreAPI
+}
+
+func (stubAPI) Block() iface.BlockAPI { return stubBlock{} }
+func (stubAPI) Name() iface.NameAPI   { return stubName{} }
+func (stubAPI) Swarm() iface.SwarmAPI { return stubSwarm{} }
+
+type stubBlock struct {
+	iface.BlockAPI
+}
+
+func (stubBlock) Get(context.Context, path.Path) (io.Reader, error) {
+	return bytes.NewReader([]byte("block")), nil
+}
+
+type stubName struct {
+	iface.NameAPI
+}
+
+func (stubName) Resolve(_ context.Context, name string, _ ...options.NameResolveOption) (path.Path, error) {
+	return path.New("/ipfs/" + name), nil
+}
+
+type stubSwarm struct {
+	iface.SwarmAPI
+}
+
+func (stubSwarm) Peers(context.Context) ([]iface.ConnectionInfo, error) {
+	return make([]iface.ConnectionInfo, 1), nil
+}
+
+func testingCid(t *testing.T, data string) cid.Cid {
+	mh, err := multihash.Sum([]byte(data), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(cid.Raw, mh)
+}
+
+func TestWrap(t *testing.T) {
+	ctx := context.Background()
+
+	missing, present := testingCid(t, "missing"), testingCid(t, "present")
+
+	f := New()
+	api := Wrap(stubAPI{}, f)
+
+	// Nothing is injected until faults are set
+	if _, err := api.Block().Get(ctx, path.IpfsPath(missing)); err != nil {
+		t.Fatalf("expected the block to be read without faults, got %v", err)
+	}
+
+	if err := f.Set(Config{Missing: []string{"/ipfs/" + missing.String()}, DropPeers: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := api.Block().Get(ctx, path.IpfsPath(missing)); !errors.Is(err, format.ErrNotFound) {
+		t.Errorf("expected a missing cid not to be found, got %v", err)
+	}
+	if _, err := api.Block().Get(ctx, path.New("/ipfs/"+missing.String()+"/a/b")); !errors.Is(err, format.ErrNotFound) {
+		t.Errorf("expected paths within a missing cid not to be found, got %v", err)
+	}
+	if _, err := api.Block().Get(ctx, path.IpfsPath(present)); err != nil {
+		t.Errorf("expected other cids to be read, got %v", err)
+	}
+
+	if peers, err := api.Swarm().Peers(ctx); err != nil || len(peers) != 0 {
+		t.Errorf("expected no peers once dropped, got %d: %v", len(peers), err)
+	}
+	if _, err := api.Name().Resolve(ctx, "k51"); err == nil {
+		t.Error("expected names not to resolve once peers are dropped")
+	}
+
+	// Clearing the faults restores every read
+	if err := f.Set(Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.Block().Get(ctx, path.IpfsPath(missing)); err != nil {
+		t.Errorf("expected the block to be read once cleared, got %v", err)
+	}
+	if peers, err := api.Swarm().Peers(ctx); err != nil || len(peers) != 1 {
+		t.Errorf("expected the peer once cleared, got %d: %v", len(peers), err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	f := New()
+	api := Wrap(stubAPI{}, f)
+
+	if err := f.Set(Config{Latency: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delayed reads still give up with their context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := api.Block().Get(ctx, path.IpfsPath(testingCid(t, "slow"))); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the read to time out, got %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("expected the read to give up with its context, took %s", d)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	f := New()
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	do := func(method, body string) (int, Config) {
+		req, err := http.NewRequest(method, srv.URL, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		cfg := Config{}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, cfg
+	}
+
+	c := testingCid(t, "missing")
+	want := Config{Latency: time.Second, Missing: []string{c.String()}, DropPeers: true}
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code, cfg := do(http.MethodPut, string(data)); code != http.StatusOK || !reflect.DeepEqual(cfg, want) {
+		t.Errorf("expected the faults to be set, got %d: %+v", code, cfg)
+	}
+	if code, cfg := do(http.MethodGet, ""); code != http.StatusOK || !reflect.DeepEqual(cfg, want) {
+		t.Errorf("expected the faults set, got %d: %+v", code, cfg)
+	}
+
+	// Invalid faults leave the current ones as they are
+	if code, _ := do(http.MethodPut, `{"missing": ["not-a-cid"]}`); code != http.StatusBadRequest {
+		t.Errorf("expected an invalid cid to be rejected, got %d", code)
+	}
+	if code, _ := do(http.MethodPut, `not json`); code != http.StatusBadRequest {
+		t.Errorf("expected invalid json to be rejected, got %d", code)
+	}
+	if !reflect.DeepEqual(f.Config(), want) {
+		t.Errorf("expected the faults to be unchanged, got %+v", f.Config())
+	}
+
+	if code, _ := do(http.MethodPost, ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST not to be allowed, got %d", code)
+	}
+
+	if code, cfg := do(http.MethodDelete, ""); code != http.StatusOK || !reflect.DeepEqual(cfg, Config{}) {
+		t.Errorf("expected the faults to be cleared, got %d: %+v", code, cfg)
+	}
+}
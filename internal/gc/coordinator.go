@@ -0,0 +1,464 @@
+package gc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/peer"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+var _ manager.Runnable = (*Coordinator)(nil)
+var _ manager.LeaderElectionRunnable = (*Coordinator)(nil)
+
+// Coordinator garbage collects the manager's ipfs node without losing anything the cluster still relies on.
+//
+// Each pass keeps everything reachable from the current mappings. Anything else that is still referenced by a pod
+// is only unpinned once at least MinReplicas other peers provide it, and everything else is only unpinned once it
+// has been unreferenced for GracePeriod (giving in flight adds time to publish their mappings). The repo is then
+// collected.
+//
+// Once the repo grows beyond StorageMax, mapped images are evicted too, lowest priority first, until it fits again.
+// Pods give the images they run a priority with the ripfs.dev/image-priority annotation (system critical pods'
+// images are critical), and every other mapped image has DefaultPriority. ripfs's own images are always critical.
+// Evicted images stay mapped, and are fetched from other peers whenever they're pulled. Images held for drained nodes
+// are critical too, and anything shared with the roots nodes are assigned or content profiles prefetch is kept.
+//
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get
+type Coordinator struct {
+	Ipfs   iface.CoreAPI
+	Mapper registry.Lister
+	Reader client.Reader
+	Log    logr.Logger
+
+	// Namespace is the namespace of the content profiles
+	Namespace string
+
+	// Registry returns the host pods are currently rewritten to pull ripfs images from
+	Registry func() string
+
+	Interval    time.Duration
+	GracePeriod time.Duration
+	MinReplicas int
+
+	// StorageMax is the repo size in bytes beyond which mapped images are evicted (0 never evicts them)
+	StorageMax      uint64
+	DefaultPriority Priority
+
+	// Repo measures and collects the repo, through the api's repo commands by default
+	Repo Repo
+
+	// stale tracks when each unreferenced pin was first seen
+	stale map[cid.Cid]time.Time
+}
+
+// Repo is the repo behind the manager's ipfs node
+type Repo interface {
+	// Size returns the size of the repo in bytes
+	Size(ctx context.Context) (uint64, error)
+
+	// GC collects everything in the repo that is no longer pinned
+	GC(ctx context.Context) error
+}
+
+// apiRepo is the repo of an http api client
+type apiRepo struct {
+	api iface.CoreAPI
+}
+
+func (r apiRepo) Size(ctx context.Context) (uint64, error) {
+	return registry.RepoSize(ctx, r.api)
+}
+
+func (r apiRepo) GC(ctx context.Context) error {
+	return registry.RepoGC(ctx, r.api)
+}
+
+func (c *Coordinator) NeedLeaderElection() bool {
+	return true
+}
+
+func (c *Coordinator) Start(ctx context.Context) error {
+	t := time.NewTicker(c.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-t.C:
+			if err := c.Collect(ctx); err != nil {
+				c.Log.Error(err, "garbage collection pass failed")
+			}
+		}
+	}
+}
+
+// Collect runs a single garbage collection pass
+func (c *Coordinator) Collect(ctx context.Context) error {
+	if c.stale == nil {
+		c.stale = make(map[cid.Cid]time.Time)
+	}
+
+	mp, mappings, err := c.Mapper.Mappings(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching mappings: %v", err)
+	}
+
+	// Anything we can't fully walk aborts the pass, it's better to collect nothing than the wrong thing
+	mapped := make(map[cid.Cid]bool)
+	mrp, err := c.Ipfs.ResolvePath(ctx, mp)
+	if err != nil {
+		return err
+	}
+	mapped[mrp.Cid()] = true
+
+	roots := make(map[string]cid.Cid, len(mappings))
+	for ref, v := range mappings {
+		rp, err := c.Ipfs.ResolvePath(ctx, path.New(v))
+		if err != nil {
+			return fmt.Errorf("resolving %s: %v", ref, err)
+		}
+		roots[ref] = rp.Cid()
+
+		if err := c.reference(ctx, rp.Cid(), mapped); err != nil {
+			return fmt.Errorf("walking %s: %v", ref, err)
+		}
+	}
+
+	inUse, priorities, err := c.inUse(ctx)
+	if err != nil {
+		return fmt.Errorf("listing images in use: %v", err)
+	}
+
+	pins, err := c.Ipfs.Pin().Ls(ctx, options.Pin.Ls.Recursive())
+	if err != nil {
+		return err
+	}
+
+	var (
+		now      = time.Now()
+		unpinned int
+		seen     = make(map[cid.Cid]bool)
+	)
+	for pin := range pins {
+		if pin.Err() != nil {
+			return pin.Err()
+		}
+
+		pc := pin.Path().Cid()
+		seen[pc] = true
+		if mapped[pc] {
+			delete(c.stale, pc)
+			continue
+		}
+
+		if inUse[pc] {
+			ok, err := c.replicated(ctx, pc)
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				c.Log.V(1).Info("keeping under replicated content still in use", "cid", pc)
+				continue
+			}
+		} else {
+			since, ok := c.stale[pc]
+			if !ok {
+				c.stale[pc] = now
+				continue
+			}
+
+			if now.Sub(since) < c.GracePeriod {
+				continue
+			}
+		}
+
+		c.Log.Info("unpinning unreferenced content", "cid", pc)
+		if err := c.Ipfs.Pin().Rm(ctx, pin.Path()); err != nil {
+			return fmt.Errorf("unpinning %s: %v", pc, err)
+		}
+		delete(c.stale, pc)
+		unpinned++
+	}
+
+	// Forget anything unpinned elsewhere
+	for pc := range c.stale {
+		if !seen[pc] {
+			delete(c.stale, pc)
+		}
+	}
+
+	if unpinned > 0 {
+		c.Log.Info("collecting repo", "unpinned", unpinned)
+		if err := c.repoGC(ctx); err != nil {
+			return err
+		}
+	}
+
+	if c.StorageMax == 0 {
+		return nil
+	}
+	return c.evict(ctx, roots, inUse, priorities)
+}
+
+// evict unpins mapped images, lowest priority first, until the repo fits within StorageMax again. Within a priority,
+// images that no pod runs go first. Critical images are never evicted, and standard ones only once enough other
+// peers provide them.
+func (c *Coordinator) evict(ctx context.Context, roots map[string]cid.Cid, inUse map[cid.Cid]bool, priorities map[cid.Cid]Priority) error {
+	size, err := c.repo().Size(ctx)
+	if err != nil {
+		return fmt.Errorf("measuring repo: %v", err)
+	}
+
+	if size <= c.StorageMax {
+		return nil
+	}
+
+	type candidate struct {
+		ref      string
+		root     cid.Cid
+		priority Priority
+	}
+
+	pinned, err := registry.PinnedRoots(ctx, c.Reader, c.Namespace)
+	if err != nil {
+		return fmt.Errorf("listing pinned roots: %v", err)
+	}
+
+	held := make(map[cid.Cid]bool)
+	for _, root := range pinned {
+		held[root] = true
+	}
+
+	var (
+		candidates []candidate
+		seen       = make(map[cid.Cid]bool)
+		self       = selfRoots(roots)
+	)
+	for ref, root := range roots {
+		if seen[root] {
+			continue
+		}
+		seen[root] = true
+
+		p, ok := priorities[root]
+		if !ok {
+			p = c.DefaultPriority
+		}
+		if self[root] || held[root] {
+			p = PriorityCritical
+		}
+		candidates = append(candidates, candidate{ref: ref, root: root, priority: p})
+	}
+
+	sort.Slice(candidates, func(a, b int) bool {
+		ca, cb := candidates[a], candidates[b]
+		if ca.priority != cb.priority {
+			return ca.priority < cb.priority
+		}
+		if inUse[ca.root] != inUse[cb.root] {
+			return !inUse[ca.root]
+		}
+		return ca.ref < cb.ref
+	})
+
+	evicted := make(map[cid.Cid]bool)
+	for _, cand := range candidates {
+		if size <= c.StorageMax || cand.priority == PriorityCritical {
+			break
+		}
+
+		if cand.priority == PriorityStandard {
+			refs, err := registry.References(ctx, c.Ipfs, cand.root)
+			if err != nil {
+				return fmt.Errorf("walking %s: %v", cand.ref, err)
+			}
+
+			ok, err := c.replicated(ctx, refs...)
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				c.Log.V(1).Info("keeping under replicated image", "ref", cand.ref, "cid", cand.root)
+				continue
+			}
+		}
+
+		// Anything shared with an image that isn't being evicted, or a root the cluster holds pinned, is kept
+		keep := append([]cid.Cid(nil), pinned...)
+		for _, root := range roots {
+			if root != cand.root && !evicted[root] {
+				keep = append(keep, root)
+			}
+		}
+
+		removed, err := registry.Remove(ctx, c.Ipfs, cand.root, keep)
+		if err != nil {
+			return fmt.Errorf("evicting %s: %v", cand.ref, err)
+		}
+		evicted[cand.root] = true
+
+		if len(removed) == 0 {
+			continue
+		}
+
+		c.Log.Info("evicting image under storage pressure", "ref", cand.ref, "cid", cand.root, "priority", cand.priority.String(), "unpinned", len(removed))
+		if err := c.repoGC(ctx); err != nil {
+			return err
+		}
+
+		if size, err = c.repo().Size(ctx); err != nil {
+			return fmt.Errorf("measuring repo: %v", err)
+		}
+	}
+
+	if size > c.StorageMax {
+		c.Log.Info("repo still exceeds its storage max, nothing else can be evicted", "size", size, "max", c.StorageMax)
+	}
+	return nil
+}
+
+// reference adds root, and everything it references, to refs
+func (c *Coordinator) reference(ctx context.Context, root cid.Cid, refs map[cid.Cid]bool) error {
+	cids, err := registry.References(ctx, c.Ipfs, root)
+	if err != nil {
+		return err
+	}
+
+	for _, rc := range cids {
+		refs[rc] = true
+	}
+	return nil
+}
+
+// selfRoots returns the roots ripfs's own images are mapped to, which ripfs can't be restarted without
+func selfRoots(roots map[string]cid.Cid) map[cid.Cid]bool {
+	self := make(map[cid.Cid]bool)
+	for _, reference := range []string{consts.ManagerImageReference, consts.BusyboxImageReference} {
+		ref, err := name.ParseReference(reference)
+		if err != nil {
+			continue
+		}
+
+		if root, ok := roots[ref.Name()]; ok {
+			self[root] = true
+		}
+	}
+	return self
+}
+
+// inUse returns everything referenced by images that pods are currently running from the ripfs registry, along with
+// the highest priority any pod gives each image's root
+func (c *Coordinator) inUse(ctx context.Context) (map[cid.Cid]bool, map[cid.Cid]Priority, error) {
+	var pods corev1.PodList
+	if err := c.Reader.List(ctx, &pods); err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		refs       = make(map[cid.Cid]bool)
+		priorities = make(map[cid.Cid]Priority)
+	)
+	for _, pod := range pods.Items {
+		p, prioritized, err := podPriority(pod)
+		if err != nil {
+			c.Log.Error(err, "ignoring image priority", "pod", pod.Namespace+"/"+pod.Name)
+		}
+
+		for _, ctr := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+			ref, err := name.ParseReference(ctr.Image)
+			if err != nil || ref.Context().RegistryStr() != c.Registry() {
+				continue
+			}
+
+			root, err := cid.Decode(strings.TrimPrefix(ref.Context().RepositoryStr(), "ipfs/"))
+			if err != nil {
+				continue
+			}
+
+			if prev, ok := priorities[root]; prioritized && (!ok || p > prev) {
+				priorities[root] = p
+			}
+
+			if refs[root] {
+				continue
+			}
+
+			if err := c.reference(ctx, root, refs); err != nil {
+				return nil, nil, fmt.Errorf("walking %s used by %s/%s: %v", root, pod.Namespace, pod.Name, err)
+			}
+		}
+	}
+	return refs, priorities, nil
+}
+
+// replicated reports whether at least MinReplicas peers other than ourselves provide every one of cids. An image is
+// only as replicated as the least provided of its objects, its root being provided says nothing of its layers.
+func (c *Coordinator) replicated(ctx context.Context, cids ...cid.Cid) (bool, error) {
+	self, err := c.Ipfs.Key().Self(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, rc := range cids {
+		n, err := c.providers(ctx, rc, self.ID())
+		if err != nil {
+			return false, err
+		}
+
+		if n < c.MinReplicas {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// providers returns how many peers other than self provide rc, among the first MinReplicas+1 found
+func (c *Coordinator) providers(ctx context.Context, rc cid.Cid, self peer.ID) (int, error) {
+	fctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	provs, err := c.Ipfs.Dht().FindProviders(fctx, path.IpfsPath(rc), options.Dht.NumProviders(c.MinReplicas+1))
+	if err != nil {
+		return 0, fmt.Errorf("finding the peers providing %s: %v", rc, err)
+	}
+
+	n := 0
+	for prov := range provs {
+		if prov.ID != self {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (c *Coordinator) repo() Repo {
+	if c.Repo != nil {
+		return c.Repo
+	}
+	return apiRepo{api: c.Ipfs}
+}
+
+func (c *Coordinator) repoGC(ctx context.Context) error {
+	return c.repo().GC(ctx)
+}
@@ -0,0 +1,436 @@
+package gc
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/ipfs/go-cid"
+	config "github.com/ipfs/go-ipfs-config"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/core/node/libp2p"
+	"github.com/ipfs/go-ipfs/plugin/loader"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+var pluginsOnce sync.Once
+
+// testingIpfs returns the api of an offline ipfs node backed by a temporary repo
+func testingIpfs(t *testing.T, ctx context.Context) iface.CoreAPI {
+	tmp := t.TempDir()
+
+	// Plugins can only be injected once per process
+	pluginsOnce.Do(func() {
+		plugins, err := loader.NewPluginLoader("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := plugins.Initialize(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := plugins.Inject(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	cfg, err := config.Init(ioutil.Discard, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fsrepo.Init(tmp, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := fsrepo.Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := core.NewNode(ctx, &core.BuildCfg{Online: false, Routing: libp2p.DHTOption, Repo: repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Close() })
+
+	api, err := coreapi.NewCoreAPI(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api
+}
+
+// providedIpfs is an offline node's api, whose content is provided by whichever peers it's given
+type providedIpfs struct {
+	iface.CoreAPI
+	providers map[cid.Cid][]peer.ID
+}
+
+func (p *providedIpfs) Dht() iface.DhtAPI {
+	return providedDht{p.CoreAPI.Dht(), p}
+}
+
+type providedDht struct {
+	iface.DhtAPI
+	p *providedIpfs
+}
+
+func (d providedDht) FindProviders(_ context.Context, p path.Path, _ ...options.DhtFindProvidersOption) (<-chan peer.AddrInfo, error) {
+	rp, err := d.p.ResolvePath(context.Background(), p)
+	if err != nil {
+		return nil, err
+	}
+
+	provs := d.p.providers[rp.Cid()]
+	ch := make(chan peer.AddrInfo, len(provs))
+	for _, id := range provs {
+		ch <- peer.AddrInfo{ID: id}
+	}
+	close(ch)
+	return ch, nil
+}
+
+// provide has peer provide every object of root, or only root itself
+func (p *providedIpfs) provide(t *testing.T, ctx context.Context, root cid.Cid, id peer.ID, all bool) {
+	refs := []cid.Cid{root}
+	if all {
+		var err error
+		if refs, err = registry.References(ctx, p.CoreAPI, root); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range refs {
+		p.providers[c] = append(p.providers[c], id)
+	}
+}
+
+// pinsRepo sizes the repo by its recursive pins, a byte each, and collects nothing
+type pinsRepo struct {
+	api iface.CoreAPI
+}
+
+func (r pinsRepo) Size(ctx context.Context) (uint64, error) {
+	pins, err := r.api.Pin().Ls(ctx, options.Pin.Ls.Recursive())
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	for pin := range pins {
+		if pin.Err() != nil {
+			return 0, pin.Err()
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (pinsRepo) GC(context.Context) error {
+	return nil
+}
+
+// staticLister lists the same mappings every time, published at p
+type staticLister struct {
+	p        path.Path
+	mappings map[string]string
+}
+
+func (l staticLister) Mappings(context.Context) (path.Path, map[string]string, error) {
+	return l.p, l.mappings, nil
+}
+
+func testingPeer(t *testing.T) peer.ID {
+	_, pub, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func addImage(t *testing.T, ctx context.Context, api iface.CoreAPI) cid.Cid {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := registry.AddImage(ctx, api, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Cid()
+}
+
+// testingCoordinator returns a Coordinator of api, mapping each of roots by its reference
+func testingCoordinator(t *testing.T, ctx context.Context, api *providedIpfs, roots map[string]cid.Cid, objs ...client.Object) *Coordinator {
+	mp, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte(t.Name())), options.Unixfs.Pin(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mappings := make(map[string]string)
+	for ref, root := range roots {
+		mappings[ref] = path.IpfsPath(root).String()
+	}
+
+	return &Coordinator{
+		Ipfs:            api,
+		Mapper:          staticLister{p: mp, mappings: mappings},
+		Reader:          fake.NewClientBuilder().WithObjects(objs...).Build(),
+		Log:             logr.Discard(),
+		Namespace:       "ripfs-system",
+		Registry:        func() string { return "localhost:31609" },
+		GracePeriod:     time.Hour,
+		MinReplicas:     1,
+		DefaultPriority: PriorityStandard,
+		Repo:            pinsRepo{api: api},
+	}
+}
+
+// runningPod runs root from the ripfs registry, giving it priority unless it's empty
+func runningPod(name string, root cid.Cid, priority string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Image: "localhost:31609/ipfs/" + root.String() + ":latest"},
+		}},
+	}
+	if priority != "" {
+		pod.Annotations = map[string]string{consts.ImagePriorityAnnotation: priority}
+	}
+	return pod
+}
+
+// pinned reports whether every object of root is pinned, or none of it is
+func pinned(t *testing.T, ctx context.Context, api iface.CoreAPI, root cid.Cid) bool {
+	refs, err := registry.References(ctx, api, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for _, c := range refs {
+		_, ok, err := api.Pin().IsPinned(ctx, path.IpfsPath(c), options.Pin.IsPinned.Recursive())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			n++
+		}
+	}
+
+	if n != 0 && n != len(refs) {
+		t.Fatalf("expected all or none of %s to be pinned, %d of %d are", root, n, len(refs))
+	}
+	return n > 0
+}
+
+func TestCollectGracePeriod(t *testing.T) {
+	ctx := context.Background()
+
+	api := &providedIpfs{CoreAPI: testingIpfs(t, ctx), providers: make(map[cid.Cid][]peer.ID)}
+
+	mapped := addImage(t, ctx, api)
+	unreferenced := addImage(t, ctx, api)
+
+	c := testingCoordinator(t, ctx, api, map[string]cid.Cid{"index.docker.io/library/app:v1": mapped})
+
+	if err := c.Collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if !pinned(t, ctx, api, unreferenced) {
+		t.Fatalf("expected unreferenced content to be kept within its grace period")
+	}
+
+	// Once unreferenced for longer than the grace period, it's unpinned
+	for pc := range c.stale {
+		c.stale[pc] = time.Now().Add(-2 * c.GracePeriod)
+	}
+
+	if err := c.Collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if pinned(t, ctx, api, unreferenced) {
+		t.Errorf("expected unreferenced content to be unpinned after its grace period")
+	}
+	if !pinned(t, ctx, api, mapped) {
+		t.Errorf("expected mapped content to stay pinned")
+	}
+}
+
+func TestCollectInUse(t *testing.T) {
+	ctx := context.Background()
+
+	api := &providedIpfs{CoreAPI: testingIpfs(t, ctx), providers: make(map[cid.Cid][]peer.ID)}
+
+	used := addImage(t, ctx, api)
+
+	c := testingCoordinator(t, ctx, api, nil, runningPod("app", used, ""))
+	c.GracePeriod = 0
+
+	// Content pods run is kept, whatever the grace period, until another peer provides it
+	if err := c.Collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if !pinned(t, ctx, api, used) {
+		t.Fatalf("expected under replicated content in use to be kept")
+	}
+
+	api.provide(t, ctx, used, testingPeer(t), true)
+
+	if err := c.Collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if pinned(t, ctx, api, used) {
+		t.Errorf("expected replicated content in use to be unpinned")
+	}
+}
+
+func TestReplicated(t *testing.T) {
+	ctx := context.Background()
+
+	api := &providedIpfs{CoreAPI: testingIpfs(t, ctx), providers: make(map[cid.Cid][]peer.ID)}
+
+	root := addImage(t, ctx, api)
+	refs, err := registry.References(ctx, api, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	self, err := api.Key().Self(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := testingCoordinator(t, ctx, api, nil)
+
+	tests := []struct {
+		name    string
+		provide func()
+		want    bool
+	}{
+		{
+			name:    "unprovided",
+			provide: func() {},
+			want:    false,
+		},
+		{
+			name:    "only by ourselves",
+			provide: func() { api.provide(t, ctx, root, self.ID(), true) },
+			want:    false,
+		},
+		{
+			name:    "only the root",
+			provide: func() { api.provide(t, ctx, root, testingPeer(t), false) },
+			want:    false,
+		},
+		{
+			name:    "everything",
+			provide: func() { api.provide(t, ctx, root, testingPeer(t), true) },
+			want:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api.providers = make(map[cid.Cid][]peer.ID)
+			tt.provide()
+
+			got, err := c.replicated(ctx, refs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected replicated %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestEvict(t *testing.T) {
+	ctx := context.Background()
+
+	api := &providedIpfs{CoreAPI: testingIpfs(t, ctx), providers: make(map[cid.Cid][]peer.ID)}
+
+	roots := make(map[string]cid.Cid)
+	for _, name := range []string{"cache", "critical", "held", "partial", "standard", "used"} {
+		roots["index.docker.io/library/"+name+":v1"] = addImage(t, ctx, api)
+	}
+	root := func(name string) cid.Cid {
+		return roots["index.docker.io/library/"+name+":v1"]
+	}
+
+	// Every standard image but partial is provided in full by another peer, partial only by its root
+	other := testingPeer(t)
+	for _, name := range []string{"held", "standard", "used"} {
+		api.provide(t, ctx, root(name), other, true)
+	}
+	api.provide(t, ctx, root("partial"), other, false)
+
+	c := testingCoordinator(t, ctx, api, roots,
+		runningPod("cache", root("cache"), PriorityCache.String()),
+		runningPod("critical", root("critical"), PriorityCritical.String()),
+		runningPod("used", root("used"), ""),
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "drained", Annotations: map[string]string{
+			consts.NodeReplicatedAnnotation: root("held").String(),
+		}}},
+	)
+
+	// Each pass is just over the storage max, evicting a single image: cache images first, then standard images no
+	// pod runs, then those in use. Partial is under replicated, critical and held images are never evicted.
+	for _, want := range []string{"cache", "standard", "used", ""} {
+		size, err := c.repo().Size(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.StorageMax = size - 1
+
+		if err := c.Collect(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		var evicted []string
+		for ref, r := range roots {
+			if !pinned(t, ctx, api, r) {
+				evicted = append(evicted, ref)
+				delete(roots, ref)
+			}
+		}
+
+		switch {
+		case want == "" && len(evicted) > 0:
+			t.Fatalf("expected nothing else to be evicted, got %v", evicted)
+		case want != "" && (len(evicted) != 1 || !strings.Contains(evicted[0], "/"+want+":")):
+			t.Fatalf("expected %s to be evicted, got %v", want, evicted)
+		}
+	}
+}
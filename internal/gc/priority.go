@@ -0,0 +1,60 @@
+package gc
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+)
+
+// Priority orders which mapped images are evicted first when the repo is under storage pressure
+type Priority int
+
+const (
+	// PriorityCache images are evicted first, even when no other peer provides them
+	PriorityCache Priority = iota
+
+	// PriorityStandard images are evicted once nothing of lower priority is left, and only once other peers provide them
+	PriorityStandard
+
+	// PriorityCritical images (such as cni, csi or ripfs itself) are never evicted
+	PriorityCritical
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityCache:
+		return "cache"
+	case PriorityStandard:
+		return "standard"
+	case PriorityCritical:
+		return "critical"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// ParsePriority parses a priority class, either critical, standard or cache
+func ParsePriority(s string) (Priority, error) {
+	for _, p := range []Priority{PriorityCache, PriorityStandard, PriorityCritical} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid priority %q, expected critical, standard or cache", s)
+}
+
+// podPriority returns the priority pod gives the images it runs, either annotated or critical when the pod itself is
+// system critical. Pods without either don't give their images a priority.
+func podPriority(pod corev1.Pod) (Priority, bool, error) {
+	if s, ok := pod.Annotations[consts.ImagePriorityAnnotation]; ok {
+		p, err := ParsePriority(s)
+		return p, err == nil, err
+	}
+
+	switch pod.Spec.PriorityClassName {
+	case "system-node-critical", "system-cluster-critical":
+		return PriorityCritical, true, nil
+	}
+	return 0, false, nil
+}
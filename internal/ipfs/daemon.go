@@ -3,6 +3,7 @@ package ipfs
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
 
@@ -23,28 +24,88 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/rest"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
-var _ manager.Runnable = (*Daemon)(nil)
+var _ Node = (*Daemon)(nil)
+
+// DefaultShutdownTimeout is how long a Daemon drains its api servers of in flight requests before it's closed
+const DefaultShutdownTimeout = 20 * time.Second
 
 type Daemon struct {
 	path string
+
+	// mu guards repo, which is closed (and unset) along with node once it's started
+	mu   sync.Mutex
 	repo repo.Repo
+	node *core.IpfsNode
 
 	bootstrapper bool
+
+	profile Profile
+	gc      GCOptions
+	tuning  TuningOptions
+
+	// gateway is the address the read only gateway is served on, if at all
+	gateway string
+
+	shutdownTimeout time.Duration
+
+	// mdns is whether peers on the local network are discovered with mDNS, left as the repo has it when unset
+	mdns *bool
+
+	// bootstrap are the peers the node bootstraps from, left as the repo has them when empty
+	bootstrap []string
+}
+
+// DaemonOption configures a Daemon
+type DaemonOption func(d *Daemon)
+
+// WithGateway serves the node's read only http gateway (/ipfs and /ipns paths) on the multiaddr addr, so any content
+// can be fetched from it over http
+func WithGateway(addr string) DaemonOption {
+	return func(d *Daemon) {
+		d.gateway = addr
+	}
+}
+
+// WithShutdownTimeout drains the node's api servers of in flight requests for up to timeout once it's stopping
+func WithShutdownTimeout(timeout time.Duration) DaemonOption {
+	return func(d *Daemon) {
+		d.shutdownTimeout = timeout
+	}
+}
+
+// WithMDNS enables or disables the discovery of peers on the local network with mDNS, such as when they're discovered
+// through Kubernetes instead
+func WithMDNS(enabled bool) DaemonOption {
+	return func(d *Daemon) {
+		d.mdns = &enabled
+	}
+}
+
+// WithBootstrapPeers replaces the peers the node bootstraps from whenever it's opened, not only when its repo was
+// initialized, so a node kept across restarts follows the swarm's current bootstrap peers. The node keeps retrying
+// them (a few at a time) for as long as it's short of peers.
+func WithBootstrapPeers(peers []string) DaemonOption {
+	return func(d *Daemon) {
+		d.bootstrap = peers
+	}
 }
 
 // NewDaemon returns a Daemon
-func NewDaemon(repoPath string, bootstrapper bool) (*Daemon, error) {
+func NewDaemon(repoPath string, bootstrapper bool, opts ...DaemonOption) (*Daemon, error) {
 	if !fsrepo.IsInitialized(repoPath) {
 		return nil, fmt.Errorf("repo at %s not initialized", repoPath)
 	}
 
-	return &Daemon{
+	d := &Daemon{
 		path:         repoPath,
 		bootstrapper: bootstrapper,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d, nil
 }
 
 func (d *Daemon) Open() (repo.Repo, error) {
@@ -52,11 +113,44 @@ func (d *Daemon) Open() (repo.Repo, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	d.mu.Lock()
 	d.repo = r
+	d.mu.Unlock()
+
+	if err := d.configureProfile(); err != nil {
+		return nil, err
+	}
+	if err := d.configureGC(); err != nil {
+		return nil, err
+	}
+	if err := d.configureTuning(); err != nil {
+		return nil, err
+	}
+
+	if d.mdns != nil {
+		if err := r.SetConfigKey("Discovery.MDNS.Enabled", *d.mdns); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(d.bootstrap) > 0 {
+		if _, err := config.ParseBootstrapPeers(d.bootstrap); err != nil {
+			return nil, fmt.Errorf("invalid bootstrap peers: %v", err)
+		}
+		if err := r.SetConfigKey("Bootstrap", d.bootstrap); err != nil {
+			return nil, err
+		}
+	}
 	return r, nil
 }
 
+// Unlock closes the repo if the node never started (or is yet to), otherwise it was closed along with the node. It
+// waits for a node that is closing to be closed.
 func (d *Daemon) Unlock() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	if d.repo == nil {
 		return nil
 	}
@@ -69,35 +163,88 @@ func (d *Daemon) Unlock() error {
 	return nil
 }
 
+func (d *Daemon) NeedLeaderElection() bool {
+	return false
+}
+
+func (d *Daemon) SwarmKey() ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.repo == nil {
+		return nil, fmt.Errorf("repo is unopened")
+	}
+	return d.repo.SwarmKey()
+}
+
+func (d *Daemon) Config() (*config.Config, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.repo == nil {
+		return nil, fmt.Errorf("repo is unopened")
+	}
+	return d.repo.Config()
+}
+
+// Start runs the node until ctx is done, then drains its api (and gateway) servers of in flight requests for up to the
+// shutdown timeout before closing the node, which flushes and closes its repo. Start only returns once the node is
+// closed, so the repo is never left mid write (such as a badger datastore that would need to be recovered).
 func (d *Daemon) Start(ctx context.Context) error {
+	d.mu.Lock()
 	if d.repo == nil {
+		d.mu.Unlock()
 		return fmt.Errorf("repo is unopened, open it first before starting the node")
 	}
+	r := d.repo
+	d.mu.Unlock()
 
-	cfg, err := d.repo.Config()
+	cfg, err := r.Config()
 	if err != nil {
 		return err
 	}
 
-	var (
-		errc = make(chan error)
-		wg   sync.WaitGroup
-	)
-
-	node, err := core.NewNode(ctx, &core.BuildCfg{
+	// The node outlives ctx until everything using it is drained, it's closed once they are
+	node, err := core.NewNode(context.Background(), &core.BuildCfg{
 		Online:  true, // This doesn't do what you think it does
 		Routing: libp2p.DHTOption,
-		Repo:    d.repo,
+		Repo:    r,
+		ExtraOpts: map[string]bool{
+			// Mapping updates are announced over pubsub
+			"pubsub": true,
+		},
 	})
 	if err != nil {
 		return err
 	}
 
 	node.IsDaemon = true
+
+	d.mu.Lock()
+	d.node = node
+	d.mu.Unlock()
+
 	if node.PNetFingerprint != nil {
 		fmt.Println("Swarm key fingerprint: ", node.PNetFingerprint)
 	}
 
+	var (
+		errc    = make(chan error, 1)
+		wg      sync.WaitGroup
+		servers []*http.Server
+	)
+
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// fail stops the node with the first error of anything running alongside it
+	fail := func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+	}
+
 	// Start api servers
 	apiOpts := []corehttp.ServeOption{
 		corehttp.VersionOption(),
@@ -105,102 +252,170 @@ func (d *Daemon) Start(ctx context.Context) error {
 		corehttp.CommandsOption(d.reqctx(node)),
 	}
 	for _, addr := range cfg.Addresses.API {
-		a := addr
+		srv, err := d.serve(node, addr, fail, apiOpts...)
+		if err != nil {
+			return d.close(node, servers, &wg, err)
+		}
+		servers = append(servers, srv)
+	}
+
+	// Start the gateway server, read only so nothing can be added (or pinned) through it
+	if d.gateway != "" {
+		gwOpts := []corehttp.ServeOption{
+			corehttp.HostnameOption(),
+			corehttp.GatewayOption(false, "/ipfs", "/ipns"),
+			corehttp.VersionOption(),
+			corehttp.CheckVersionOption(),
+			corehttp.CommandsROOption(d.reqctx(node)),
+		}
+
+		fmt.Println("serving ipfs gateway on: ", d.gateway)
+		srv, err := d.serve(node, d.gateway, fail, gwOpts...)
+		if err != nil {
+			return d.close(node, servers, &wg, err)
+		}
+		servers = append(servers, srv)
+	}
+
+	if d.gc.Interval > 0 {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := d.serve(node, a, apiOpts...); err != nil {
-				errc <- err
-			}
+			d.collect(rctx, node)
 		}()
 	}
 
-	// Start gateway servers
-	// gwOpts := []corehttp.ServeOption{
-	// 	corehttp.HostnameOption(),
-	// 	corehttp.GatewayOption(true, "/ipfs", "/ipns"),
-	// 	corehttp.VersionOption(),
-	// 	corehttp.CheckVersionOption(),
-	// 	corehttp.CommandsROOption(d.reqctx(node)),
-	// }
-	// for _, addr := range cfg.Addresses.Gateway {
-	// 	a := addr
-	// 	wg.Add(1)
-	// 	go func() {
-	// 		defer wg.Done()
-	// 		if err := d.serve(node, a, gwOpts...); err != nil {
-	// 			errc <- err
-	// 		}
-	// 	}()
-	// }
-
 	if d.bootstrapper {
-		go func() {
-			for {
-				time.Sleep(5 * time.Second)
-				println("waiting for swarm peers...")
-				c, err := d.httpClient()
-				if err != nil {
-					errc <- err
-				}
-				ci, err := c.Swarm().Peers(ctx)
-				if err != nil {
-					errc <- err
-				}
-
-				if len(ci) == 0 {
-					continue
-				}
-
-				println("swarm established, adding index to ipns")
-				e, err := d.createMapper(ctx, c)
-				if err != nil {
-					break
-				}
-				_ = e
-				break
-			}
-		}()
+		c, err := d.httpClient(cfg)
+		if err != nil {
+			return d.close(node, servers, &wg, err)
+		}
 
+		wg.Add(1)
 		go func() {
-			for {
-				time.Sleep(10 * time.Second)
-				c, err := d.httpClient()
-				if err != nil {
-					errc <- err
-				}
-				ci, err := c.Swarm().Peers(ctx)
-				if err != nil {
-					errc <- err
-				}
-
-				println("connected to swarm of ", len(ci)-1, " peers")
-			}
+			defer wg.Done()
+			d.watchSwarm(rctx, c)
 		}()
 	}
 
 	select {
 	case <-ctx.Done():
+		err = nil
 
-	case err := <-errc:
-		return err
+	case err = <-errc:
 	}
 
-	return nil
+	cancel()
+	return d.close(node, servers, &wg, err)
 }
 
-func (d *Daemon) serve(node *core.IpfsNode, addr string, opt ...corehttp.ServeOption) error {
+// close drains servers of in flight requests, waits for everything else using node to stop, and closes node (and so its
+// repo), returning err or whatever went wrong closing it
+func (d *Daemon) close(node *core.IpfsNode, servers []*http.Server, wg *sync.WaitGroup, err error) error {
+	timeout := d.shutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		if serr := srv.Shutdown(sctx); serr != nil {
+			// Whatever is still in flight is cut off, the repo is closed regardless
+			fmt.Println("draining ipfs api server: ", serr)
+			srv.Close()
+		}
+	}
+	wg.Wait()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fmt.Println("closing ipfs node")
+	if cerr := node.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("closing ipfs node: %v", cerr)
+	}
+
+	// The node closes the repo it was built with
+	d.repo, d.node = nil, nil
+	return err
+}
+
+// serve serves node's api (with opts) on the multiaddr addr until it's shut down, calling fail if it stops on its own
+func (d *Daemon) serve(node *core.IpfsNode, addr string, fail func(error), opts ...corehttp.ServeOption) (*http.Server, error) {
 	ma, err := multiaddr.NewMultiaddr(addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	l, err := manet.Listen(ma)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	nl := manet.NetListener(l)
+
+	// As corehttp.Serve does, but shut down by us rather than as soon as the node closes
+	top := http.NewServeMux()
+	mux := top
+	for _, opt := range opts {
+		if mux, err = opt(node, nl, mux); err != nil {
+			nl.Close()
+			return nil, err
+		}
 	}
 
-	return corehttp.Serve(node, manet.NetListener(l), opt...)
+	srv := &http.Server{Handler: top}
+	go func() {
+		if err := srv.Serve(nl); err != nil && err != http.ErrServerClosed {
+			fail(fmt.Errorf("serving ipfs api on %s: %v", addr, err))
+		}
+	}()
+	return srv, nil
+}
+
+// watchSwarm publishes the mapper once the node's first swarm peers join, and then reports the swarm's size
+func (d *Daemon) watchSwarm(ctx context.Context, c *httpapi.HttpApi) {
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+
+	var (
+		published bool
+		reported  time.Time
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		ci, err := c.Swarm().Peers(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Println("listing swarm peers: ", err)
+			}
+			continue
+		}
+
+		if !published {
+			if len(ci) == 0 {
+				println("waiting for swarm peers...")
+				continue
+			}
+
+			println("swarm established, adding index to ipns")
+			if _, err := d.createMapper(ctx, c); err != nil {
+				fmt.Println("adding index to ipns: ", err)
+			}
+			published = true
+		}
+
+		if time.Since(reported) >= 10*time.Second {
+			println("connected to swarm of ", len(ci)-1, " peers")
+			reported = time.Now()
+		}
+	}
 }
 
 func (d *Daemon) reqctx(node *core.IpfsNode) commands.Context {
@@ -220,12 +435,7 @@ func (d *Daemon) reqctx(node *core.IpfsNode) commands.Context {
 	}
 }
 
-func (d *Daemon) httpClient() (*httpapi.HttpApi, error) {
-	cfg, err := d.repo.Config()
-	if err != nil {
-		return nil, err
-	}
-
+func (d *Daemon) httpClient(cfg *config.Config) (*httpapi.HttpApi, error) {
 	ma, err := multiaddr.NewMultiaddr(cfg.Addresses.API[0])
 	if err != nil {
 		return nil, err
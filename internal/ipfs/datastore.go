@@ -0,0 +1,67 @@
+package ipfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	config "github.com/ipfs/go-ipfs-config"
+)
+
+// Datastores are the datastores the embedded node's repo can be initialized with, selectable by name
+var Datastores = map[string]func(c *config.Config) error{
+	// badger is the fastest, but can hold on to gigabytes of memory (and disk after gc) with large layers
+	"badgerds": config.Profiles["badgerds"].Transform,
+
+	// flatfs stores every block as a file, slower but with a small and predictable memory footprint
+	"flatfs": config.Profiles["flatfs"].Transform,
+
+	// leveldb compacts as it goes, in between the two
+	"leveldb": func(c *config.Config) error {
+		c.Datastore.Spec = map[string]interface{}{
+			"type":   "measure",
+			"prefix": "leveldb.datastore",
+			"child": map[string]interface{}{
+				"type":        "levelds",
+				"path":        "datastore",
+				"compression": "none",
+			},
+		}
+		return nil
+	},
+}
+
+// SetDatastore initializes c with the named datastore, or an error listing the valid datastores
+func SetDatastore(c *config.Config, name string) error {
+	transform, ok := Datastores[name]
+	if !ok {
+		var names []string
+		for n := range Datastores {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown datastore %s, must be one of %v", name, names)
+	}
+	return transform(c)
+}
+
+// SetDatastoreSpec initializes c with the datastore spec (as in the Datastore.Spec of an ipfs config) in the json file
+// at path, for datastores that aren't known by name or need tuning
+func SetDatastoreSpec(c *config.Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var spec map[string]interface{}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("invalid datastore spec %s: %v", path, err)
+	}
+	if _, ok := spec["type"]; !ok {
+		return fmt.Errorf("invalid datastore spec %s: missing type", path)
+	}
+
+	c.Datastore.Spec = spec
+	return nil
+}
@@ -0,0 +1,120 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	config "github.com/ipfs/go-ipfs-config"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+	"github.com/multiformats/go-multiaddr"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var _ Node = (*External)(nil)
+
+// Node is the ipfs node ripfs runs against, either the embedded Daemon or an External one. Every replica of the
+// manager runs its own node (serving its webhook, and bootstrapping the swarm), whether it leads or not.
+type Node interface {
+	manager.Runnable
+	manager.LeaderElectionRunnable
+
+	// Unlock releases anything held open by the node once it's stopped
+	Unlock() error
+
+	// SwarmKey returns the key of the private swarm the node is part of, nil if it isn't part of one
+	SwarmKey() ([]byte, error)
+
+	// Config returns the node's config, of which only the identity and bootstrap peers are set for External nodes
+	Config() (*config.Config, error)
+
+	// Healthy returns why the node is wedged, nil while it's healthy
+	Healthy(ctx context.Context) error
+}
+
+// External is an already running ipfs daemon (such as an existing kubo node, or an ipfs-cluster peer's) reached
+// through its api, rather than a node embedded in ripfs
+type External struct {
+	api          *httpapi.HttpApi
+	swarmKeyPath string
+}
+
+// NewExternal returns the External node serving its api at addr, with the swarm key it was given at swarmKeyPath (if
+// it's part of a private swarm), which must exist when set
+func NewExternal(addr string, swarmKeyPath string) (*External, error) {
+	ma, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid external ipfs api address %s: %v", addr, err)
+	}
+
+	api, err := httpapi.NewApi(ma)
+	if err != nil {
+		return nil, err
+	}
+
+	if swarmKeyPath != "" {
+		if _, err := os.Stat(swarmKeyPath); err != nil {
+			return nil, fmt.Errorf("invalid external ipfs swarm key: %v", err)
+		}
+	}
+
+	return &External{
+		api:          api,
+		swarmKeyPath: swarmKeyPath,
+	}, nil
+}
+
+// API returns a client for the node's api
+func (e *External) API() *httpapi.HttpApi {
+	return e.api
+}
+
+// Start waits for ctx to be done, the node itself runs (and stops) on its own
+func (e *External) Start(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (e *External) NeedLeaderElection() bool {
+	return false
+}
+
+func (e *External) Unlock() error {
+	return nil
+}
+
+func (e *External) SwarmKey() ([]byte, error) {
+	if e.swarmKeyPath == "" {
+		return nil, nil
+	}
+
+	// A configured key that can't be read would otherwise leave agents outside the daemon's private swarm
+	data, err := os.ReadFile(e.swarmKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading swarm key of external ipfs node: %v", err)
+	}
+	return data, nil
+}
+
+func (e *External) Config() (*config.Config, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	self, err := e.api.Key().Self(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reaching external ipfs node: %v", err)
+	}
+
+	var bootstrap struct {
+		Peers []string
+	}
+	if err := e.api.Request("bootstrap/list").Exec(ctx, &bootstrap); err != nil {
+		return nil, fmt.Errorf("listing bootstrap peers of external ipfs node: %v", err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Identity.PeerID = self.ID().String()
+	cfg.Bootstrap = bootstrap.Peers
+	return cfg, nil
+}
@@ -0,0 +1,93 @@
+package ipfs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// startedNode records when the node it wraps is started
+type startedNode struct {
+	Node
+	started chan struct{}
+}
+
+func (n startedNode) Start(ctx context.Context) error {
+	close(n.started)
+	return n.Node.Start(ctx)
+}
+
+func TestNonLeaderReplica(t *testing.T) {
+	// The api server is unreachable, so the replica never wins the election
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	mgr, err := manager.New(&rest.Config{Host: srv.URL}, manager.Options{
+		LeaderElection:          true,
+		LeaderElectionID:        "ripfs-test",
+		LeaderElectionNamespace: "ripfs-system",
+		MetricsBindAddress:      "0",
+		HealthProbeBindAddress:  "0",
+		MapperProvider: func(*rest.Config) (meta.RESTMapper, error) {
+			return meta.NewDefaultRESTMapper(nil), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	external, err := NewExternal("/ip4/127.0.0.1/tcp/5001", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := startedNode{Node: external, started: make(chan struct{})}
+	if err := mgr.Add(node); err != nil {
+		t.Fatal(err)
+	}
+
+	leading := make(chan struct{})
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		close(leading)
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() { errc <- mgr.Start(ctx) }()
+
+	select {
+	case <-node.started:
+	case err := <-errc:
+		t.Fatalf("expected the manager to keep running, got %v", err)
+	case <-time.After(30 * time.Second):
+		t.Fatal("expected the node to be started without leading")
+	}
+
+	select {
+	case <-leading:
+		t.Fatal("expected the replica not to lead")
+	default:
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Errorf("expected the manager to stop cleanly, got %v", err)
+	}
+
+	if (&Daemon{}).NeedLeaderElection() {
+		t.Error("expected the embedded node to be started without leading too")
+	}
+}
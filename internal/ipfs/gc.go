@@ -0,0 +1,148 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/corerepo"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+)
+
+// GCOptions are the embedded node's storage quota, and how its repo is garbage collected to stay under it
+type GCOptions struct {
+	// StorageMax is the size (such as 50GB) the repo is kept under, and Watermark the percentage of it beyond which
+	// garbage is collected. Either is left as the repo has it when unset.
+	StorageMax string
+	Watermark  int64
+
+	// Interval is how often the repo's size is checked against its watermark, never when zero
+	Interval time.Duration
+
+	// Recorder, if set, records events on Object whenever the repo grows beyond its watermark or garbage is collected
+	Recorder record.EventRecorder
+	Object   runtime.Object
+}
+
+// WithGC sets the daemon's storage quota and garbage collection
+func WithGC(opts GCOptions) DaemonOption {
+	return func(d *Daemon) {
+		d.gc = opts
+	}
+}
+
+// configureGC writes the storage quota to the repo's config, so it's kept across restarts and seen by ipfs itself
+func (d *Daemon) configureGC() error {
+	if d.gc.StorageMax != "" {
+		if _, err := humanize.ParseBytes(d.gc.StorageMax); err != nil {
+			return fmt.Errorf("invalid storage max %s: %v", d.gc.StorageMax, err)
+		}
+		if err := d.repo.SetConfigKey("Datastore.StorageMax", d.gc.StorageMax); err != nil {
+			return err
+		}
+	}
+
+	if d.gc.Watermark != 0 {
+		if d.gc.Watermark < 0 || d.gc.Watermark > 100 {
+			return fmt.Errorf("invalid gc watermark %d, must be a percentage", d.gc.Watermark)
+		}
+		if err := d.repo.SetConfigKey("Datastore.StorageGCWatermark", d.gc.Watermark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collect garbage every interval, whenever the repo has grown beyond its watermark
+func (d *Daemon) collect(ctx context.Context, node *core.IpfsNode) {
+	t := time.NewTicker(d.gc.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if err := d.maybeCollect(ctx, node); err != nil {
+			fmt.Println("collecting garbage: ", err)
+			d.event(corev1.EventTypeWarning, consts.RepoGCReason, "Collecting garbage failed: %v", err)
+		}
+	}
+}
+
+func (d *Daemon) maybeCollect(ctx context.Context, node *core.IpfsNode) error {
+	gc, err := corerepo.NewGC(node)
+	if err != nil {
+		return err
+	}
+
+	before, err := node.Repo.GetStorageUsage(ctx)
+	if err != nil {
+		return err
+	}
+
+	if before < gc.StorageGC {
+		return nil
+	}
+
+	d.event(corev1.EventTypeWarning, consts.RepoWatermarkReason, "Repo uses %s, beyond its watermark of %s (of %s)",
+		humanize.Bytes(before), humanize.Bytes(gc.StorageGC), humanize.Bytes(gc.StorageMax))
+
+	start := time.Now()
+	if err := corerepo.GarbageCollect(node, ctx); err != nil {
+		return err
+	}
+
+	after, err := node.Repo.GetStorageUsage(ctx)
+	if err != nil {
+		return err
+	}
+
+	var freed uint64
+	if after < before {
+		freed = before - after
+	}
+
+	fmt.Printf("collected garbage in %s, freeing %s\n", time.Since(start).Round(time.Millisecond), humanize.Bytes(freed))
+	d.event(corev1.EventTypeNormal, consts.RepoGCReason, "Collected garbage in %s, freeing %s (%s used of %s)",
+		time.Since(start).Round(time.Millisecond), humanize.Bytes(freed), humanize.Bytes(after), humanize.Bytes(gc.StorageMax))
+	return nil
+}
+
+func (d *Daemon) event(eventtype, reason, message string, args ...interface{}) {
+	if d.gc.Recorder == nil || d.gc.Object == nil {
+		return
+	}
+	d.gc.Recorder.Eventf(d.gc.Object, eventtype, reason, message, args...)
+}
+
+// RepoStat returns the bytes stored in the running node's repo, and the storage max it's garbage collected to stay under
+func (d *Daemon) RepoStat(ctx context.Context) (uint64, uint64, error) {
+	d.mu.Lock()
+	node := d.node
+	d.mu.Unlock()
+
+	if node == nil {
+		return 0, 0, errors.New("node isn't running")
+	}
+
+	gc, err := corerepo.NewGC(node)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	size, err := node.Repo.GetStorageUsage(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, gc.StorageMax, nil
+}
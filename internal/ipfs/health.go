@@ -0,0 +1,106 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// healthTimeout bounds each health check, shorter than the probes' own timeouts so they fail with a reason
+const healthTimeout = 4 * time.Second
+
+// LivenessCheck fails once node is wedged (see Node.Healthy), so it's restarted
+func LivenessCheck(node Node) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), healthTimeout)
+		defer cancel()
+
+		return node.Healthy(ctx)
+	}
+}
+
+// ReadinessCheck fails until api responds, and is connected to at least minPeers swarm peers
+func ReadinessCheck(api iface.CoreAPI, minPeers int) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), healthTimeout)
+		defer cancel()
+
+		if _, err := api.Key().Self(ctx); err != nil {
+			return fmt.Errorf("ipfs api isn't responding: %v", err)
+		}
+
+		if minPeers <= 0 {
+			return nil
+		}
+
+		peers, err := api.Swarm().Peers(ctx)
+		if err != nil {
+			return fmt.Errorf("listing swarm peers: %v", err)
+		}
+
+		if len(peers) < minPeers {
+			return fmt.Errorf("connected to %d swarm peers, at least %d are required", len(peers), minPeers)
+		}
+		return nil
+	}
+}
+
+// Healthy reports whether the node's repo is still locked (and so not removed out from under it), and once it's
+// started, whether it's still running with a datastore that responds
+func (d *Daemon) Healthy(ctx context.Context) error {
+	d.mu.Lock()
+	r, node := d.repo, d.node
+	d.mu.Unlock()
+
+	if r == nil {
+		return errors.New("repo is closed")
+	}
+
+	if _, err := os.Stat(filepath.Join(d.path, "repo.lock")); err != nil {
+		return fmt.Errorf("repo is no longer locked: %v", err)
+	}
+
+	// Still starting
+	if node == nil {
+		return nil
+	}
+
+	select {
+	case <-node.Process.Closing():
+		return errors.New("node is closing")
+	default:
+	}
+
+	// A wedged datastore doesn't give up with ctx, so it's only waited for as long as ctx allows
+	errc := make(chan error, 1)
+	go func() {
+		_, err := node.Repo.Datastore().Has(ctx, datastore.NewKey("/ripfs/health"))
+		errc <- err
+	}()
+
+	select {
+	case <-ctx.Done():
+		return errors.New("datastore isn't responding")
+	case err := <-errc:
+		if err != nil {
+			return fmt.Errorf("datastore is failing: %v", err)
+		}
+	}
+	return nil
+}
+
+// Healthy reports whether the external node's api responds, its own health is up to whatever runs it
+func (e *External) Healthy(ctx context.Context) error {
+	if _, err := e.api.Key().Self(ctx); err != nil {
+		return fmt.Errorf("external ipfs api isn't responding: %v", err)
+	}
+	return nil
+}
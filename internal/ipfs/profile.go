@@ -0,0 +1,126 @@
+package ipfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	config "github.com/ipfs/go-ipfs-config"
+)
+
+// Profile tunes the embedded node for the environment it is deployed in
+type Profile struct {
+	Description string
+
+	// Datastore is the datastore the node's repo is initialized with, if not the default. Unlike the rest of the
+	// profile it can't change once the repo holds content.
+	Datastore string
+
+	// Transform is applied to the node's config whenever its repo is opened, so switching the profile of an existing
+	// repo takes effect on the next start
+	Transform func(c *config.Config) error
+
+	// GCPercent overrides the go runtime's garbage collection target when non zero
+	GCPercent int
+
+	// IndexCacheSize and MapperCacheStale size the registry's caches when non zero, unless ripfs serve is given
+	// --index-cache-size or --mapper-cache-stale
+	IndexCacheSize   int
+	MapperCacheStale time.Duration
+}
+
+// Profiles are the known node profiles, selectable by name
+var Profiles = map[string]Profile{
+	"default": {
+		Description: "Settings suited for general purpose cluster nodes.",
+		Transform:   func(c *config.Config) error { return nil },
+	},
+	"edge": {
+		Description: "Low memory settings suited for small edge and IoT nodes (~150MB RSS).",
+		Datastore:   "flatfs",
+		Transform:   edgeTransform,
+		GCPercent:   50,
+
+		IndexCacheSize:   16,
+		MapperCacheStale: time.Minute,
+	},
+}
+
+// GetProfile returns the named profile, or an error listing the valid profiles
+func GetProfile(name string) (Profile, error) {
+	p, ok := Profiles[name]
+	if !ok {
+		var names []string
+		for n := range Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return Profile{}, fmt.Errorf("unknown profile %s, must be one of %v", name, names)
+	}
+	return p, nil
+}
+
+// WithProfile applies the profile's transform to the repo's config whenever the daemon opens it
+func WithProfile(p Profile) DaemonOption {
+	return func(d *Daemon) {
+		d.profile = p
+	}
+}
+
+// configureProfile writes the profile's transform of the repo's config, before the explicitly set gc and tuning
+// options so they override it
+func (d *Daemon) configureProfile() error {
+	if d.profile.Transform == nil {
+		return nil
+	}
+
+	cfg, err := d.repo.Config()
+	if err != nil {
+		return err
+	}
+
+	c, err := cfg.Clone()
+	if err != nil {
+		return err
+	}
+
+	if err := d.profile.Transform(c); err != nil {
+		return fmt.Errorf("applying profile: %v", err)
+	}
+	return d.repo.SetConfig(c)
+}
+
+// edgeTransform is applied to the config of edge nodes, whose repo is also initialized with flatfs, trading some speed
+// for a much smaller (and more predictable) memory footprint than badger
+func edgeTransform(c *config.Config) error {
+	if err := config.Profiles["lowpower"].Transform(c); err != nil {
+		return fmt.Errorf("applying lowpower profile: %v", err)
+	}
+
+	c.Swarm.ConnMgr.Type = "basic"
+	c.Swarm.ConnMgr.LowWater = 10
+	c.Swarm.ConnMgr.HighWater = 30
+	c.Swarm.ConnMgr.GracePeriod = (30 * time.Second).String()
+
+	bs := &config.InternalBitswap{}
+	for field, v := range map[*config.OptionalInteger]int64{
+		&bs.TaskWorkerCount:             2,
+		&bs.EngineBlockstoreWorkerCount: 16,
+		&bs.EngineTaskWorkerCount:       2,
+		&bs.MaxOutstandingBytesPerPeer:  256 << 10,
+	} {
+		if err := optionalInteger(field, v); err != nil {
+			return err
+		}
+	}
+	c.Internal.Bitswap = bs
+
+	return nil
+}
+
+// optionalInteger sets an OptionalInteger, which doesn't otherwise expose a way to set its value
+func optionalInteger(o *config.OptionalInteger, v int64) error {
+	return json.Unmarshal([]byte(strconv.FormatInt(v, 10)), o)
+}
@@ -0,0 +1,79 @@
+package ipfs
+
+import (
+	"fmt"
+	"time"
+)
+
+// TuningOptions bound the connections the embedded node keeps to the swarm, and the work its bitswap does serving them,
+// such as to keep small edge nodes within their memory and cpu. Anything unset (zero) is left as the repo has it, after
+// its profile is applied.
+type TuningOptions struct {
+	// ConnHighWater is how many connections the node keeps before trimming them down to ConnLowWater, sparing those
+	// younger than ConnGracePeriod
+	ConnLowWater    int
+	ConnHighWater   int
+	ConnGracePeriod time.Duration
+
+	// BitswapTaskWorkers, BitswapEngineBlockstoreWorkers and BitswapEngineTaskWorkers are how many workers bitswap
+	// runs, and BitswapMaxOutstandingBytesPerPeer how many bytes it sends a single peer before serving the next
+	BitswapTaskWorkers                int
+	BitswapEngineBlockstoreWorkers    int
+	BitswapEngineTaskWorkers          int
+	BitswapMaxOutstandingBytesPerPeer int64
+}
+
+// WithTuning sets the limits of the daemon's connections and bitswap
+func WithTuning(opts TuningOptions) DaemonOption {
+	return func(d *Daemon) {
+		d.tuning = opts
+	}
+}
+
+// configureTuning writes the connection and bitswap limits to the repo's config, so they're kept across restarts
+func (d *Daemon) configureTuning() error {
+	t := d.tuning
+
+	if t.ConnLowWater < 0 || t.ConnHighWater < 0 || t.ConnGracePeriod < 0 {
+		return fmt.Errorf("invalid connection limits, must not be negative")
+	}
+	if t.ConnLowWater != 0 && t.ConnHighWater != 0 && t.ConnLowWater > t.ConnHighWater {
+		return fmt.Errorf("invalid connection limits, low water %d is above high water %d", t.ConnLowWater, t.ConnHighWater)
+	}
+
+	keys := make(map[string]interface{})
+	if t.ConnLowWater != 0 || t.ConnHighWater != 0 || t.ConnGracePeriod != 0 {
+		// Only the basic connection manager trims connections at all
+		keys["Swarm.ConnMgr.Type"] = "basic"
+	}
+	if t.ConnLowWater != 0 {
+		keys["Swarm.ConnMgr.LowWater"] = t.ConnLowWater
+	}
+	if t.ConnHighWater != 0 {
+		keys["Swarm.ConnMgr.HighWater"] = t.ConnHighWater
+	}
+	if t.ConnGracePeriod != 0 {
+		keys["Swarm.ConnMgr.GracePeriod"] = t.ConnGracePeriod.String()
+	}
+
+	for key, v := range map[string]int64{
+		"Internal.Bitswap.TaskWorkerCount":             int64(t.BitswapTaskWorkers),
+		"Internal.Bitswap.EngineBlockstoreWorkerCount": int64(t.BitswapEngineBlockstoreWorkers),
+		"Internal.Bitswap.EngineTaskWorkerCount":       int64(t.BitswapEngineTaskWorkers),
+		"Internal.Bitswap.MaxOutstandingBytesPerPeer":  t.BitswapMaxOutstandingBytesPerPeer,
+	} {
+		if v < 0 {
+			return fmt.Errorf("invalid %s %d, must not be negative", key, v)
+		}
+		if v != 0 {
+			keys[key] = v
+		}
+	}
+
+	for key, v := range keys {
+		if err := d.repo.SetConfigKey(key, v); err != nil {
+			return fmt.Errorf("setting %s: %v", key, err)
+		}
+	}
+	return nil
+}
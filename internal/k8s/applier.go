@@ -2,43 +2,103 @@ package k8s
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/fluxcd/pkg/ssa"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/rest"
+	"sigs.k8s.io/cli-utils/pkg/kstatus/polling"
+	"sigs.k8s.io/cli-utils/pkg/kstatus/polling/aggregator"
+	"sigs.k8s.io/cli-utils/pkg/kstatus/polling/collector"
+	"sigs.k8s.io/cli-utils/pkg/kstatus/polling/event"
+	"sigs.k8s.io/cli-utils/pkg/kstatus/status"
+	"sigs.k8s.io/cli-utils/pkg/object"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// ObjectStatus is the observed status of an object being waited on
+type ObjectStatus struct {
+	Object  string
+	Status  status.Status
+	Message string
+}
+
+// ApplierOption configures how an applier waits on what it applies
+type ApplierOption func(a *applier)
+
+// WithTimeout sets how long applied objects are waited on to become ready
+func WithTimeout(timeout time.Duration) ApplierOption {
+	return func(a *applier) {
+		a.wopts.Timeout = timeout
+	}
+}
+
+// WithProgress calls fn every time the status of an object being waited on changes
+func WithProgress(fn func(s ObjectStatus)) ApplierOption {
+	return func(a *applier) {
+		a.progress = fn
+	}
+}
+
 type applier struct {
-	manager *ssa.ResourceManager
-	wopts   ssa.WaitOptions
+	manager  *ssa.ResourceManager
+	poller   *polling.StatusPoller
+	wopts    ssa.WaitOptions
+	progress func(s ObjectStatus)
 }
 
-func NewApplier(kcfg *rest.Config) (*applier, error) {
+func NewApplier(kcfg *rest.Config, opts ...ApplierOption) (*applier, error) {
 	mgr, err := NewManager(kcfg)
 	if err != nil {
 		return nil, err
 	}
 
-	return &applier{
+	a := &applier{
 		manager: mgr,
+		poller:  polling.NewStatusPoller(mgr.Client(), mgr.Client().RESTMapper(), polling.Options{}),
 		wopts: ssa.WaitOptions{
 			Interval: 2 * time.Second,
 			Timeout:  1 * time.Minute,
 		},
-	}, nil
+		progress: func(s ObjectStatus) {},
+	}
+
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a, nil
 }
 
 func (a *applier) Apply(ctx context.Context, objs []*unstructured.Unstructured) (*ssa.ChangeSet, error) {
 	cobjs, objs := a.split(objs)
 
-	_, err := a.applyAndWait(ctx, cobjs)
+	ccs, err := a.applyAndWait(ctx, cobjs)
 	if err != nil {
 		return nil, err
 	}
 
-	return a.applyAndWait(ctx, objs)
+	cs, err := a.applyAndWait(ctx, objs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Webhook configurations are ready as soon as they're applied, but they're only available once served
+	if err := a.waitForWebhooks(ctx, append(cobjs, objs...)); err != nil {
+		return nil, err
+	}
+
+	all := ssa.NewChangeSet()
+	for _, c := range []*ssa.ChangeSet{ccs, cs} {
+		if c != nil {
+			all.Append(c.Entries)
+		}
+	}
+	return all, nil
 }
 
 func (a *applier) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
@@ -67,13 +127,203 @@ func (a *applier) applyAndWait(ctx context.Context, objs []*unstructured.Unstruc
 		return nil, err
 	}
 
-	if err := a.manager.WaitForSet(cs.ToObjMetadataSet(), a.wopts); err != nil {
+	if err := a.wait(ctx, cs.ToObjMetadataSet()); err != nil {
 		return nil, err
 	}
 
 	return cs, nil
 }
 
+// wait waits for every object in set to become ready, reporting each change in their status as it's observed. Much
+// like ssa's WaitForSet, except a timeout describes why each unready object isn't, conditions and all.
+func (a *applier) wait(ctx context.Context, set object.ObjMetadataSet) error {
+	ctx, cancel := context.WithTimeout(ctx, a.wopts.Timeout)
+	defer cancel()
+
+	var (
+		ready bool
+		coll  = collector.NewResourceStatusCollector(set)
+		last  = make(map[object.ObjMetadata]*event.ResourceStatus)
+	)
+
+	events := a.poller.Poll(ctx, set, polling.PollOptions{PollInterval: a.wopts.Interval})
+	done := coll.ListenWithObserver(events, collector.ObserverFunc(
+		func(c *collector.ResourceStatusCollector, e event.Event) {
+			if e.Type == event.ResourceUpdateEvent && e.Resource != nil {
+				// kstatus reports a deadline for every object once any times out, which says nothing about it
+				if e.Resource.Error != context.DeadlineExceeded {
+					last[e.Resource.Identifier] = e.Resource
+					a.progress(ObjectStatus{
+						Object:  ssa.FmtObjMetadata(e.Resource.Identifier),
+						Status:  e.Resource.Status,
+						Message: e.Resource.Message,
+					})
+				}
+			}
+
+			var rss []*event.ResourceStatus
+			for _, rs := range c.ResourceStatuses {
+				if rs != nil {
+					rss = append(rss, rs)
+				}
+			}
+
+			if aggregator.AggregateStatus(rss, status.CurrentStatus) == status.CurrentStatus {
+				ready = true
+				cancel()
+			}
+		}),
+	)
+	<-done
+
+	if coll.Error != nil {
+		return coll.Error
+	}
+
+	if ready {
+		return nil
+	}
+
+	if ctx.Err() == context.Canceled {
+		return ctx.Err()
+	}
+
+	var unready []string
+	for _, id := range set {
+		rs, ok := last[id]
+		switch {
+		case !ok:
+			unready = append(unready, fmt.Sprintf("%s (unknown status)", ssa.FmtObjMetadata(id)))
+		case rs.Status != status.CurrentStatus:
+			unready = append(unready, describeStatus(rs))
+		}
+	}
+	return fmt.Errorf("timeout waiting for: [%s]", strings.Join(unready, ", "))
+}
+
+// describeStatus describes why rs isn't ready, along with its conditions and those of anything it generated (such as
+// a deployment's pods) that isn't ready either
+func describeStatus(rs *event.ResourceStatus) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s status: '%s'", ssa.FmtObjMetadata(rs.Identifier), rs.Status)
+	if rs.Message != "" {
+		fmt.Fprintf(&b, ": %s", rs.Message)
+	}
+	if rs.Error != nil {
+		fmt.Fprintf(&b, ": %v", rs.Error)
+	}
+
+	if conds := conditions(rs.Resource); len(conds) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(conds, "; "))
+	}
+
+	for _, g := range rs.GeneratedResources {
+		if g != nil && g.Status != status.CurrentStatus {
+			fmt.Fprintf(&b, ", %s", describeStatus(g))
+		}
+	}
+	return b.String()
+}
+
+// conditions formats the status conditions of obj as type=status, along with their reason and message
+func conditions(obj *unstructured.Unstructured) []string {
+	if obj == nil {
+		return nil
+	}
+
+	conds, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+
+	var out []string
+	for _, c := range conds {
+		m, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		s := fmt.Sprintf("%v=%v", m["type"], m["status"])
+		if reason, ok := m["reason"].(string); ok && reason != "" {
+			s += " " + reason
+		}
+		if msg, ok := m["message"].(string); ok && msg != "" {
+			s += ": " + msg
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// webhookService is the service a webhook is served by
+type webhookService struct {
+	webhook   string
+	namespace string
+	name      string
+}
+
+// waitForWebhooks waits for every service serving a webhook configured within objs to have a ready endpoint, so the
+// webhooks don't fail requests (or, failing closed, block them) once the install returns
+func (a *applier) waitForWebhooks(ctx context.Context, objs []*unstructured.Unstructured) error {
+	var svcs []webhookService
+	for _, obj := range objs {
+		switch obj.GetKind() {
+		case "MutatingWebhookConfiguration", "ValidatingWebhookConfiguration":
+		default:
+			continue
+		}
+
+		webhooks, _, _ := unstructured.NestedSlice(obj.Object, "webhooks")
+		for _, w := range webhooks {
+			m, ok := w.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			ns, _, _ := unstructured.NestedString(m, "clientConfig", "service", "namespace")
+			name, _, _ := unstructured.NestedString(m, "clientConfig", "service", "name")
+			if name == "" {
+				continue
+			}
+
+			webhook, _, _ := unstructured.NestedString(m, "name")
+			svcs = append(svcs, webhookService{webhook: webhook, namespace: ns, name: name})
+		}
+	}
+	sort.Slice(svcs, func(i, j int) bool { return svcs[i].webhook < svcs[j].webhook })
+
+	ctx, cancel := context.WithTimeout(ctx, a.wopts.Timeout)
+	defer cancel()
+
+	for _, svc := range svcs {
+		id := fmt.Sprintf("Webhook/%s", svc.webhook)
+
+		var msg string
+		err := wait.PollImmediateUntil(a.wopts.Interval, func() (bool, error) {
+			ep := &corev1.Endpoints{}
+			if err := a.Get(ctx, client.ObjectKey{Namespace: svc.namespace, Name: svc.name}, ep); err != nil {
+				msg = fmt.Sprintf("getting endpoints of %s/%s: %v", svc.namespace, svc.name, err)
+				return false, nil
+			}
+
+			for _, s := range ep.Subsets {
+				if len(s.Addresses) > 0 {
+					a.progress(ObjectStatus{Object: id, Status: status.CurrentStatus, Message: "Webhook is served"})
+					return true, nil
+				}
+			}
+
+			next := fmt.Sprintf("Service %s/%s has no ready endpoints", svc.namespace, svc.name)
+			if next != msg {
+				a.progress(ObjectStatus{Object: id, Status: status.InProgressStatus, Message: next})
+			}
+			msg = next
+			return false, nil
+		}, ctx.Done())
+		if err != nil {
+			return fmt.Errorf("timeout waiting for: [%s status: '%s': %s]", id, status.InProgressStatus, msg)
+		}
+	}
+	return nil
+}
+
 // split will split objects into cluster objects and non cluster wide objects
 func (a *applier) split(objects []*unstructured.Unstructured) ([]*unstructured.Unstructured, []*unstructured.Unstructured) {
 	var (
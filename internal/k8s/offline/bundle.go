@@ -0,0 +1,335 @@
+package offline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/mholt/archiver/v4"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+
+	"github.com/joshrwolf/ripfs/internal/platform"
+)
+
+// PayloadBundle assembles an offline payload from a multi-arch ripfs image and its busybox counterparts
+type PayloadBundle struct {
+	// Index is the multi-arch ripfs image, nested indexes (such as ko's oci layouts) are supported
+	Index v1.ImageIndex
+
+	// Platforms to include, every platform must have both an image and a busybox
+	Platforms []v1.Platform
+
+	// BusyboxDir optionally contains busybox-<os>-<arch>[-<variant>] executables, the embedded ones are used otherwise
+	BusyboxDir string
+
+	// Images are additional images (keyed by reference) to carry across the air-gap, written to their own layout
+	Images map[string]v1.Image
+
+	// Since is the manifest of a previous bundle, blobs it already carried are left out of this one
+	Since *BundleManifest
+
+	// Compression of the payload archive, gzip when unset
+	Compression archiver.Compression
+}
+
+// BundleManifest records the images a bundle carries, and every blob they're made of (including those left out of a
+// differential bundle), so the next bundle can be generated against it
+type BundleManifest struct {
+	// Images are the manifest digests of each reference
+	Images map[string]string `json:"images"`
+
+	// Blobs are the digests of every manifest, config and layer of the images
+	Blobs []string `json:"blobs"`
+}
+
+// ReadBundleManifest reads a bundle manifest written alongside (or within) a previous bundle
+func ReadBundleManifest(path string) (*BundleManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &BundleManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("reading bundle manifest %s: %v", path, err)
+	}
+	return m, nil
+}
+
+// Manifest returns the manifest of the bundle's images. A differential bundle's manifest builds on the previous one,
+// so bundles can be chained without carrying what any earlier bundle already did.
+func (b *PayloadBundle) Manifest() (*BundleManifest, error) {
+	m := &BundleManifest{Images: make(map[string]string)}
+
+	seen := make(map[string]bool)
+	if b.Since != nil {
+		for ref, d := range b.Since.Images {
+			m.Images[ref] = d
+		}
+		for _, h := range b.Since.Blobs {
+			if !seen[h] {
+				seen[h] = true
+				m.Blobs = append(m.Blobs, h)
+			}
+		}
+	}
+
+	for ref, img := range b.Images {
+		d, err := img.Digest()
+		if err != nil {
+			return nil, err
+		}
+		m.Images[ref] = d.String()
+
+		blobs, err := imageBlobs(img)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", ref, err)
+		}
+
+		for _, h := range blobs {
+			if !seen[h.String()] {
+				seen[h.String()] = true
+				m.Blobs = append(m.Blobs, h.String())
+			}
+		}
+	}
+
+	sort.Strings(m.Blobs)
+	return m, nil
+}
+
+// Write writes the compressed payload archive to w
+func (b *PayloadBundle) Write(ctx context.Context, w io.Writer) error {
+	l := zerolog.Ctx(ctx)
+
+	tmp, err := os.MkdirTemp("", "ripfs-payload")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		idx = mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
+		bbd = filepath.Join(tmp, "busybox")
+	)
+
+	if err := os.MkdirAll(bbd, os.ModePerm); err != nil {
+		return err
+	}
+
+	lp := LayoutPayload{busyboxDir: b.BusyboxDir}
+	for _, p := range b.Platforms {
+		p := p
+		img, err := findImage(b.Index, p)
+		if err != nil {
+			return err
+		}
+		if img == nil {
+			return fmt.Errorf("no ripfs image found for %s", platform.Name(p))
+		}
+
+		bb, err := lp.Busybox(p)
+		if err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(filepath.Join(bbd, busyboxName(p)), bb, 0755); err != nil {
+			return err
+		}
+
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add: img,
+			Descriptor: v1.Descriptor{
+				Platform: &p,
+			},
+		})
+		l.Info().Msgf("bundling %s", platform.Name(p))
+	}
+
+	// Nest the index just like ko does, so payloads built either way are read the same
+	lo, err := layout.Write(filepath.Join(tmp, "oci"), empty.Index)
+	if err != nil {
+		return err
+	}
+
+	if err := lo.AppendIndex(idx); err != nil {
+		return fmt.Errorf("writing layout: %v", err)
+	}
+
+	if err := b.writeImages(ctx, tmp); err != nil {
+		return err
+	}
+
+	files, err := archiver.FilesFromDisk(nil, map[string]string{
+		tmp: "payload",
+	})
+	if err != nil {
+		return err
+	}
+
+	format := archiver.CompressedArchive{
+		Compression: b.Compression,
+		Archival:    archiver.Tar{},
+	}
+	if format.Compression == nil {
+		format.Compression = archiver.Gz{}
+	}
+	return format.Archive(ctx, w, files)
+}
+
+// writeImages writes the bundle's images to an images layout and the bundle's manifest alongside it. Blobs carried by
+// earlier bundles are left out, so a differential payload's images are only complete once it's extracted over theirs.
+func (b *PayloadBundle) writeImages(ctx context.Context, dir string) error {
+	l := zerolog.Ctx(ctx)
+
+	if len(b.Images) == 0 {
+		return nil
+	}
+
+	m, err := b.Manifest()
+	if err != nil {
+		return err
+	}
+
+	skip := make(map[string]bool)
+	if b.Since != nil {
+		for _, h := range b.Since.Blobs {
+			skip[h] = true
+		}
+	}
+
+	lo, err := layout.Write(filepath.Join(dir, "images"), empty.Index)
+	if err != nil {
+		return err
+	}
+
+	refs := make([]string, 0, len(b.Images))
+	for ref := range b.Images {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+
+	for _, ref := range refs {
+		n, err := writeImageBlobs(lo, b.Images[ref], skip)
+		if err != nil {
+			return fmt.Errorf("writing %s: %v", ref, err)
+		}
+
+		desc, err := partial.Descriptor(b.Images[ref])
+		if err != nil {
+			return err
+		}
+		desc.Annotations = map[string]string{ocispec.AnnotationRefName: ref}
+
+		if err := lo.AppendDescriptor(*desc); err != nil {
+			return err
+		}
+		l.Info().Msgf("bundling %s (%d new blobs)", ref, n)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "bundle.json"), data, 0644)
+}
+
+// imageBlobs returns the digests of the manifest, config and layers of img
+func imageBlobs(img v1.Image) ([]v1.Hash, error) {
+	d, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := img.ConfigName()
+	if err != nil {
+		return nil, err
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := []v1.Hash{d, cfg}
+	for _, layer := range layers {
+		ld, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, ld)
+	}
+	return blobs, nil
+}
+
+// writeImageBlobs writes every blob of img not in skip to lo, returning how many were written
+func writeImageBlobs(lo layout.Path, img v1.Image, skip map[string]bool) (int, error) {
+	n := 0
+	write := func(h v1.Hash, open func() (io.ReadCloser, error)) error {
+		if skip[h.String()] {
+			return nil
+		}
+
+		rc, err := open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		n++
+		return lo.WriteBlob(h, rc)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, layer := range layers {
+		d, err := layer.Digest()
+		if err != nil {
+			return 0, err
+		}
+
+		if err := write(d, layer.Compressed); err != nil {
+			return 0, err
+		}
+	}
+
+	cfg, err := img.ConfigName()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := write(cfg, func() (io.ReadCloser, error) {
+		data, err := img.RawConfigFile()
+		return io.NopCloser(bytes.NewReader(data)), err
+	}); err != nil {
+		return 0, err
+	}
+
+	d, err := img.Digest()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := write(d, func() (io.ReadCloser, error) {
+		data, err := img.RawManifest()
+		return io.NopCloser(bytes.NewReader(data)), err
+	}); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
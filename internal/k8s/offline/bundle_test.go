@@ -0,0 +1,204 @@
+package offline
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/mholt/archiver/v4"
+)
+
+func TestPayloadBundle_Write(t *testing.T) {
+	ctx := context.Background()
+
+	platforms := []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+
+	var idx v1.ImageIndex = empty.Index
+	for _, p := range platforms {
+		p := p
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &p}})
+	}
+
+	// Only amd64 is embedded, so arm64 must come from the busybox dir
+	bbd := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bbd, "busybox-linux-arm64"), []byte("arm64"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	b := &PayloadBundle{Index: idx, Platforms: platforms, BusyboxDir: bbd}
+	if err := b.Write(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp := extractBundle(t, &buf)
+
+	lp, err := NewLayoutPayload(filepath.Join(tmp, "payload/oci"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range platforms {
+		if _, err := lp.Image(p); err != nil {
+			t.Errorf("expected an image for %v: %v", p, err)
+		}
+
+		if _, err := lp.Busybox(p); err != nil {
+			t.Errorf("expected a busybox for %v: %v", p, err)
+		}
+	}
+
+	bb, err := lp.Busybox(platforms[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(bb) != "arm64" {
+		t.Errorf("expected the bundled busybox to be preferred, got %d bytes", len(bb))
+	}
+
+	if _, err := lp.Image(v1.Platform{OS: "linux", Architecture: "s390x"}); err == nil {
+		t.Errorf("expected an error for a platform not in the payload")
+	}
+}
+
+func TestPayloadBundle_Since(t *testing.T) {
+	ctx := context.Background()
+
+	p := v1.Platform{OS: "linux", Architecture: "amd64"}
+	ripfs, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: ripfs, Descriptor: v1.Descriptor{Platform: &p}})
+
+	base, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := &PayloadBundle{
+		Index:     idx,
+		Platforms: []v1.Platform{p},
+		Images:    map[string]v1.Image{"example.com/app:v1": base},
+	}
+
+	m, err := first.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// v2 only adds a layer on top of v1
+	extra, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := mutate.AppendLayers(base, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	second := &PayloadBundle{
+		Index:     idx,
+		Platforms: []v1.Platform{p},
+		Images:    map[string]v1.Image{"example.com/app:v2": next},
+		Since:     m,
+
+		Compression: archiver.Zstd{},
+	}
+	if err := second.Write(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp := extractBundle(t, &buf)
+
+	blobs, err := os.ReadDir(filepath.Join(tmp, "payload/images/blobs/sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only v2's manifest, config and new layer are carried
+	if len(blobs) != 3 {
+		t.Errorf("expected 3 blobs in the differential bundle, got %d", len(blobs))
+	}
+
+	ed, err := extra.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "payload/images/blobs/sha256", ed.Hex)); err != nil {
+		t.Errorf("expected the new layer to be carried: %v", err)
+	}
+
+	bm, err := ReadBundleManifest(filepath.Join(tmp, "payload/bundle.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest builds on the previous one, so later bundles are generated against everything carried so far
+	if _, ok := bm.Images["example.com/app:v1"]; !ok {
+		t.Errorf("expected the previous bundle's images in the manifest")
+	}
+	if len(bm.Blobs) != len(m.Blobs)+3 {
+		t.Errorf("expected %d blobs in the manifest, got %d", len(m.Blobs)+3, len(bm.Blobs))
+	}
+
+	// The ripfs payload itself is always complete
+	if _, err := NewLayoutPayload(filepath.Join(tmp, "payload/oci")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// extractBundle extracts the payload archive in r to a temporary directory
+func extractBundle(t *testing.T, r io.Reader) string {
+	ctx := context.Background()
+
+	tmp := t.TempDir()
+	format, input, err := archiver.Identify("", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := format.(archiver.Extractor).Extract(ctx, input, nil, func(ctx context.Context, f archiver.File) error {
+		wp := filepath.Join(tmp, f.NameInArchive)
+		if f.IsDir() {
+			return os.MkdirAll(wp, os.ModePerm)
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		wf, err := os.Create(wp)
+		if err != nil {
+			return err
+		}
+		defer wf.Close()
+
+		_, err = io.Copy(wf, rc)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return tmp
+}
@@ -1,14 +1,22 @@
 package offline
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
 	"embed"
 	"fmt"
 	"io"
 	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/mholt/archiver/v4"
 	"github.com/spf13/afero"
@@ -18,6 +26,8 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/rand"
+
+	"github.com/joshrwolf/ripfs/internal/platform"
 )
 
 //go:embed payload
@@ -25,24 +35,104 @@ var busybox embed.FS
 
 type Payload interface {
 	// Deployment returns a deployment with the appropriate image and configmap mounts
-	Deployment(image string, nodeName string, selector map[string]string) (*appsv1.Deployment, error)
+	Deployment(image string, nodeName string, p v1.Platform, selector map[string]string) (*appsv1.Deployment, error)
+
+	// Image returns the payloads ripfs image for a given platform
+	Image(p v1.Platform) (v1.Image, error)
 
-	// Bin returns the payloads executable
-	Bin() (fs.File, error)
+	// Bin returns the payloads executable for a given platform
+	Bin(p v1.Platform) (fs.File, error)
+
+	// Busybox returns the busybox executable for a given platform
+	Busybox(p v1.Platform) ([]byte, error)
 }
 
 type LayoutPayload struct {
 	Path string
 
-	layout   layout.Path
-	platform *v1.Platform
+	layout     layout.Path
+	busyboxDir string
 }
 
-func (l LayoutPayload) Image() (v1.Image, error) {
-	return nil, nil
+// Image finds the platform specific image within the (possibly nested) layout index
+func (l LayoutPayload) Image(p v1.Platform) (v1.Image, error) {
+	idx, err := l.layout.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := findImage(idx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if img == nil {
+		return nil, fmt.Errorf("payload doesn't contain an image for %s", platform.Name(p))
+	}
+	return img, nil
+}
+
+// Busybox prefers a busybox bundled alongside the layout, and falls back to the embedded ones
+func (l LayoutPayload) Busybox(p v1.Platform) ([]byte, error) {
+	name := busyboxName(p)
+
+	if l.busyboxDir != "" {
+		if data, err := os.ReadFile(filepath.Join(l.busyboxDir, name)); err == nil {
+			return data, nil
+		}
+	}
+
+	data, err := fs.ReadFile(busybox, path.Join("payload", name))
+	if err != nil {
+		return nil, fmt.Errorf("no busybox found for %s: %v", platform.Name(p), err)
+	}
+	return data, nil
 }
 
-func (l LayoutPayload) Deployment(image string, nodeName string, selector map[string]string) (*appsv1.Deployment, error) {
+// BusyboxImage returns an image of just the payload's busybox for a given platform, at /bin/busybox
+func BusyboxImage(pl Payload, p v1.Platform) (v1.Image, error) {
+	data, err := pl.Busybox(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "bin/busybox",
+		Typeflag: tar.TypeReg,
+		Mode:     0755,
+		Size:     int64(len(data)),
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := mutate.ConfigFile(empty.Image, &v1.ConfigFile{
+		Architecture: p.Architecture,
+		OS:           p.OS,
+		RootFS:       v1.RootFS{Type: "layers"},
+		Config:       v1.Config{Entrypoint: []string{"/bin/busybox"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mutate.AppendLayers(img, layer)
+}
+
+func (l LayoutPayload) Deployment(image string, nodeName string, p v1.Platform, selector map[string]string) (*appsv1.Deployment, error) {
 	var (
 		gen      = rand.String(5)
 		perm     = int32(int64(0777))
@@ -110,7 +200,7 @@ func (l LayoutPayload) Deployment(image string, nodeName string, selector map[st
 							VolumeSource: corev1.VolumeSource{
 								ConfigMap: &corev1.ConfigMapVolumeSource{
 									LocalObjectReference: corev1.LocalObjectReference{
-										Name: "seed-payload",
+										Name: payloadConfigMapName(p),
 									},
 									DefaultMode: &perm,
 								},
@@ -131,43 +221,10 @@ func (l LayoutPayload) Deployment(image string, nodeName string, selector map[st
 	return dep, nil
 }
 
-func (l LayoutPayload) Bin() (fs.File, error) {
-	idx, err := l.layout.ImageIndex()
+func (l LayoutPayload) Bin(p v1.Platform) (fs.File, error) {
+	img, err := l.Image(p)
 	if err != nil {
-		return nil, err
-	}
-
-	idxm, err := idx.IndexManifest()
-	if err != nil {
-		return nil, err
-	}
-
-	// TODO: A better human than me would use recursion
-	var img v1.Image
-	for _, m := range idxm.Manifests {
-		switch m.MediaType {
-		case types.DockerManifestList, types.OCIImageIndex:
-			idx, err := idx.ImageIndex(m.Digest)
-			if err != nil {
-				return nil, err
-			}
-
-			idxm, err := idx.IndexManifest()
-			if err != nil {
-				return nil, err
-			}
-
-			for _, m := range idxm.Manifests {
-				if m.Platform.Equals(*l.platform) {
-					img, err = idx.Image(m.Digest)
-					break
-				}
-			}
-		}
-	}
-
-	if img == nil {
-		return nil, fmt.Errorf("couldn't find payload")
+		return nil, fmt.Errorf("couldn't find payload: %v", err)
 	}
 
 	// don't look
@@ -236,11 +293,52 @@ func NewLayoutPayload(path string) (*LayoutPayload, error) {
 		Path:   path,
 		layout: l,
 
-		// TODO: Make this configurable
-		platform: &v1.Platform{OS: "linux", Architecture: "amd64"},
+		// Bundles place their busybox's as a sibling to the oci layout
+		busyboxDir: filepath.Join(filepath.Dir(path), "busybox"),
 	}, nil
 }
 
+// findImage recursively searches an index for an image matching the platform
+func findImage(idx v1.ImageIndex, p v1.Platform) (v1.Image, error) {
+	idxm, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range idxm.Manifests {
+		switch m.MediaType {
+		case types.DockerManifestList, types.OCIImageIndex:
+			child, err := idx.ImageIndex(m.Digest)
+			if err != nil {
+				return nil, err
+			}
+
+			img, err := findImage(child, p)
+			if err != nil {
+				return nil, err
+			}
+
+			if img != nil {
+				return img, nil
+			}
+
+		case types.DockerManifestSchema2, types.OCIManifestSchema1:
+			if m.Platform != nil && platform.Matches(*m.Platform, p) {
+				return idx.Image(m.Digest)
+			}
+		}
+	}
+	return nil, nil
+}
+
+func busyboxName(p v1.Platform) string {
+	return "busybox-" + platform.Name(p)
+}
+
+func payloadConfigMapName(p v1.Platform) string {
+	return "seed-payload-" + platform.Name(p)
+}
+
 var uconverter = func(obj interface{}) (*unstructured.Unstructured, error) {
 	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
 	if err != nil {
@@ -1,6 +1,7 @@
 package offline
 
 import (
+	"archive/tar"
 	"context"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/mholt/archiver/v4"
 
 	"github.com/joshrwolf/ripfs/internal/consts"
@@ -72,9 +74,73 @@ func TestTarPayload_Bin(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	bf, err := lp.Bin()
+	bf, err := lp.Bin(v1.Platform{OS: "linux", Architecture: "amd64"})
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer bf.Close()
 }
+
+// busyboxPayload is a payload of only a busybox
+type busyboxPayload struct {
+	Payload
+	data []byte
+}
+
+func (b busyboxPayload) Busybox(v1.Platform) ([]byte, error) {
+	return b.data, nil
+}
+
+func TestBusyboxImage(t *testing.T) {
+	pl := busyboxPayload{data: []byte("#!/bin/busybox")}
+	p := v1.Platform{OS: "linux", Architecture: "arm64"}
+
+	img, err := BusyboxImage(pl, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.OS != p.OS || cfg.Architecture != p.Architecture {
+		t.Fatalf("expected a %s/%s image, got %s/%s", p.OS, p.Architecture, cfg.OS, cfg.Architecture)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(layers) != 1 {
+		t.Fatalf("expected only busybox's layer, got %d", len(layers))
+	}
+
+	rc, err := layers[0].Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	hdr, err := tar.NewReader(rc).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.Name != "bin/busybox" || hdr.Mode != 0755 {
+		t.Fatalf("expected an executable bin/busybox, got %s (%o)", hdr.Name, hdr.Mode)
+	}
+
+	// The same busybox is always the same image, so re-adding it maps the same root
+	again, err := BusyboxImage(pl, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := img.Digest()
+	if got, _ := again.Digest(); got != want {
+		t.Fatalf("expected the same image %s, got %s", want, got)
+	}
+}
@@ -2,19 +2,25 @@ package offline
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/ipfs/go-ipfs-http-client"
 	"github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/rs/zerolog"
 	"golang.org/x/sync/errgroup"
@@ -32,9 +38,18 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/joshrwolf/ripfs/internal/k8s"
+	"github.com/joshrwolf/ripfs/internal/platform"
 	"github.com/joshrwolf/ripfs/internal/registry"
 )
 
+const (
+	// seedRegistry is where the seed pods' registries are reachable from every node
+	seedRegistry = "localhost:31619"
+
+	// seedMapFile is where a seed pod's registry reads its reference => cid mappings from
+	seedMapFile = "/ripfs/bin/mappings.json"
+)
+
 // seeder seeds a local image into a kubernetes cluster
 type seeder struct {
 	kcfg    *rest.Config
@@ -48,8 +63,14 @@ func NewSeeder(kcfg *rest.Config, payload Payload) *seeder {
 	}
 }
 
-// Seed seeds a specified node with a specified image
-func (s *seeder) Seed(ctx context.Context, nodes []string, imgs ...v1.Image) ([]string, error) {
+// ImagesFor returns the images to seed onto nodes of a given platform, by their reference
+type ImagesFor func(p v1.Platform) (map[string]v1.Image, error)
+
+// Seed seeds every node with the images for its platform, returning the reference each was loaded (and so is cached on
+// the nodes) as, which is what workloads must run them by to start without a registry. The seed registries serve every
+// image by its reference too, from mappings written alongside them, so loading them is pulled the same way as in a
+// running cluster.
+func (s *seeder) Seed(ctx context.Context, nodes []string, imagesFor ImagesFor) (map[string]string, error) {
 	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
@@ -60,29 +81,50 @@ func (s *seeder) Seed(ctx context.Context, nodes []string, imgs ...v1.Image) ([]
 		return nil, err
 	}
 
-	l.Info().Msgf("creating seed configmap payload")
-	scm, err := s.configMap()
+	nodeList, err := s.listNodes(ctx)
 	if err != nil {
 		return nil, err
 	}
-	scmObj, _ := uconverter(scm)
 
+	// Rejected before anything is seeded, rather than after every node was
+	p, err := seedPlatform(nodeList.Items)
+	if err != nil {
+		return nil, err
+	}
+
+	nodePlatforms := make(map[string]v1.Platform)
+	for _, no := range nodeList.Items {
+		nodePlatforms[no.Name] = p
+	}
+
+	l.Info().Msgf("creating seed configmap payload for %s", platform.Name(p))
+	scm, err := s.configMap(p)
+	if err != nil {
+		return nil, err
+	}
+	scmObj, _ := uconverter(scm)
 	seedObjs := []*unstructured.Unstructured{scmObj}
+
 	if _, err := ap.Apply(ctx, seedObjs); err != nil {
 		return nil, err
 	}
 
-	pods, objs, err := s.seeds(ctx, nil)
+	pods, objs, err := s.seeds(ctx, nodeList, nodePlatforms)
 	if err != nil {
 		return nil, err
 	}
 	defer ap.Delete(ctx, objs)
 
+	var (
+		mu   sync.Mutex
+		refs = make(map[string]map[string]string)
+	)
+
 	errs, ctx := errgroup.WithContext(ctx)
-	refs := make([]string, len(imgs))
 	for _, pod := range pods.Items {
 		nl := l.With().Str("node", pod.Spec.NodeName).Logger()
 		node := pod.Spec.NodeName
+		p := nodePlatforms[node]
 
 		target := k8s.Target{
 			Name:      pod.Name,
@@ -91,9 +133,14 @@ func (s *seeder) Seed(ctx context.Context, nodes []string, imgs ...v1.Image) ([]
 		}
 
 		errs.Go(func() error {
+			imgs, err := imagesFor(p)
+			if err != nil {
+				return err
+			}
+
 			go func() {
 				nl.Info().Msgf("starting registry")
-				s.exec(target, []string{"/ripfs/bin/ripfs", "serve", "--standalone"})
+				s.exec(target, []string{"/ripfs/bin/ripfs", "serve", "--standalone", "--map-file", seedMapFile})
 			}()
 
 			// TODO: lol, do an actual healthcheck
@@ -107,14 +154,47 @@ func (s *seeder) Seed(ctx context.Context, nodes []string, imgs ...v1.Image) ([]
 
 			nl.Info().Msgf("connected to registry at %s", target.Name)
 
-			// TODO: Run these in goroutine, just scared of overloading api server
-			for i, img := range imgs {
-				ref, err := s.load(ctx, c, node, img)
+			var (
+				nrefs    = make(map[string]string, len(imgs))
+				mappings = make(map[string]string, len(imgs))
+				loads    []string
+			)
+			for reference, img := range imgs {
+				ref, err := name.ParseReference(reference)
 				if err != nil {
+					return err
+				}
+
+				rp, err := s.add(ctx, c, node, img)
+				if err != nil {
+					return fmt.Errorf("adding %s: %v", reference, err)
+				}
+				// Returned as it's loaded, the image is only cached on the nodes by the reference it's pulled by
+				nrefs[reference] = seededImage(ref, seedRegistry+rp.String())
+				mappings[ref.Name()] = rp.String()
+				loads = append(loads, nrefs[reference])
+			}
+
+			data, err := json.Marshal(mappings)
+			if err != nil {
+				return err
+			}
+
+			nl.Info().Msgf("writing %d mappings to registry", len(mappings))
+			if err := s.write(target, seedMapFile, data); err != nil {
+				return fmt.Errorf("writing mappings: %v", err)
+			}
+
+			// TODO: Run these in goroutine, just scared of overloading api server
+			for _, image := range loads {
+				if err := s.load(ctx, node, p, image); err != nil {
 					return fmt.Errorf("loading: %v", err)
 				}
-				refs[i] = ref
 			}
+
+			mu.Lock()
+			refs[platform.Name(p)] = nrefs
+			mu.Unlock()
 			return nil
 		})
 
@@ -124,7 +204,32 @@ func (s *seeder) Seed(ctx context.Context, nodes []string, imgs ...v1.Image) ([]
 		return nil, err
 	}
 
-	return refs, nil
+	for _, r := range refs {
+		return r, nil
+	}
+	return nil, fmt.Errorf("no nodes were seeded")
+}
+
+// seedPlatform returns the platform every node runs. Every platform is seeded with its own image, so the references
+// only agree on single platform clusters.
+func seedPlatform(nodes []corev1.Node) (v1.Platform, error) {
+	if len(nodes) == 0 {
+		return v1.Platform{}, fmt.Errorf("no nodes to seed")
+	}
+
+	platforms := make(map[string]bool)
+	for _, no := range nodes {
+		platforms[platform.Name(platform.ForNode(no))] = true
+	}
+	if len(platforms) > 1 {
+		names := make([]string, 0, len(platforms))
+		for name := range platforms {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return v1.Platform{}, fmt.Errorf("seeding clusters with mixed platforms (%s) is not supported yet", strings.Join(names, ", "))
+	}
+	return platform.ForNode(nodes[0]), nil
 }
 
 // findHostImage either looks up or finds an existing image in the cluster to act as the seed pod
@@ -147,14 +252,9 @@ func (s *seeder) listNodes(ctx context.Context) (*corev1.NodeList, error) {
 	return nodes, nil
 }
 
-// configMap builds the configmap for the right platform from the embedded busybox's
-func (s *seeder) configMap() (*corev1.ConfigMap, error) {
-	f, err := busybox.Open("payload/busybox-linux-amd64")
-	if err != nil {
-		return nil, err
-	}
-
-	bbdata, err := io.ReadAll(f)
+// configMap builds the configmap for the right platform from the payload's busybox
+func (s *seeder) configMap(p v1.Platform) (*corev1.ConfigMap, error) {
+	bbdata, err := s.payload.Busybox(p)
 	if err != nil {
 		return nil, err
 	}
@@ -165,7 +265,7 @@ func (s *seeder) configMap() (*corev1.ConfigMap, error) {
 			Kind:       "ConfigMap",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      "seed-payload",
+			Name:      payloadConfigMapName(p),
 			Namespace: "default",
 		},
 		BinaryData: map[string][]byte{
@@ -176,22 +276,33 @@ func (s *seeder) configMap() (*corev1.ConfigMap, error) {
 	return cm, nil
 }
 
-// load will spin up a loader pod to seed the node
-func (s *seeder) load(ctx context.Context, c iface.CoreAPI, node string, img v1.Image) (string, error) {
+// add adds an image to a seed pod's registry, returning the path it's served by
+func (s *seeder) add(ctx context.Context, c iface.CoreAPI, node string, img v1.Image) (path.Resolved, error) {
 	l := zerolog.Ctx(ctx).With().Str("node", node).Logger()
 
 	h, err := img.Digest()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	l.Info().Msgf("seeding registry with image: %s", h.String())
-	p, err := registry.AddImage(ctx, c, img)
-	if err != nil {
-		return "", err
+	return registry.AddImage(ctx, c, img, nil)
+}
+
+// seededImage is the image ref is pulled by from the seed registries. Added images aren't served by the digest they
+// were referenced by, so only tags are pulled by name rather than by their cid reference.
+func seededImage(ref name.Reference, cidImage string) string {
+	t, ok := ref.(name.Tag)
+	if !ok {
+		return cidImage
 	}
+	return seedRegistry + "/" + registry.RepositoryName(ref) + ":" + t.TagStr()
+}
+
+// load will spin up a loader pod to pull image onto the node
+func (s *seeder) load(ctx context.Context, node string, p v1.Platform, image string) error {
+	l := zerolog.Ctx(ctx).With().Str("node", node).Logger()
 
-	image := fmt.Sprintf("localhost:31619%s", p.String())
 	var perm = int32(int64(0777))
 
 	r := rand.String(5)
@@ -230,7 +341,7 @@ func (s *seeder) load(ctx context.Context, c iface.CoreAPI, node string, img v1.
 							VolumeSource: corev1.VolumeSource{
 								ConfigMap: &corev1.ConfigMapVolumeSource{
 									LocalObjectReference: corev1.LocalObjectReference{
-										Name: "seed-payload",
+										Name: payloadConfigMapName(p),
 									},
 									DefaultMode: &perm,
 								},
@@ -245,17 +356,17 @@ func (s *seeder) load(ctx context.Context, c iface.CoreAPI, node string, img v1.
 
 	ap, err := k8s.NewApplier(s.kcfg)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	l.Info().Msgf("creating loader job: %s", job.Name)
+	l.Info().Msgf("creating loader job %s for %s", job.Name, image)
 	objs := []*unstructured.Unstructured{jobObj}
 	if _, err := ap.Apply(ctx, objs); err != nil {
-		return "", err
+		return err
 	}
 	defer ap.Delete(ctx, objs)
 
-	return image, nil
+	return nil
 }
 
 // connect will open a connection to a seed pod
@@ -293,7 +404,7 @@ func (s *seeder) connect(ctx context.Context, target k8s.Target) (iface.CoreAPI,
 	return api, fwd, nil
 }
 
-func (s *seeder) seeds(ctx context.Context, nodeSelector []string) (*corev1.PodList, []*unstructured.Unstructured, error) {
+func (s *seeder) seeds(ctx context.Context, nodes *corev1.NodeList, nodePlatforms map[string]v1.Platform) (*corev1.PodList, []*unstructured.Unstructured, error) {
 	l := zerolog.Ctx(ctx)
 
 	mgr, err := k8s.NewManager(s.kcfg)
@@ -301,13 +412,6 @@ func (s *seeder) seeds(ctx context.Context, nodeSelector []string) (*corev1.PodL
 		return nil, nil, err
 	}
 
-	nodes := &corev1.NodeList{}
-	if err := mgr.Client().List(ctx, nodes, &client.ListOptions{
-		// TODO: Selector
-	}); err != nil {
-		return nil, nil, err
-	}
-
 	ap, err := k8s.NewApplier(s.kcfg)
 	if err != nil {
 		return nil, nil, err
@@ -322,7 +426,7 @@ func (s *seeder) seeds(ctx context.Context, nodeSelector []string) (*corev1.PodL
 	)
 
 	for _, no := range nodes.Items {
-		d, err := s.payload.Deployment(s.findHostImage(), no.Name, selector)
+		d, err := s.payload.Deployment(s.findHostImage(), no.Name, nodePlatforms[no.Name], selector)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -382,9 +486,9 @@ func (s *seeder) seeds(ctx context.Context, nodeSelector []string) (*corev1.PodL
 	for _, pod := range pods.Items {
 		p := pod
 		errs.Go(func() error {
-			bin, err := s.payload.Bin()
+			bin, err := s.payload.Bin(nodePlatforms[p.Spec.NodeName])
 			if err != nil {
-				return nil
+				return err
 			}
 			defer bin.Close()
 
@@ -461,6 +565,21 @@ func (s *seeder) copy(f fs.File, target k8s.Target, dest string) error {
 	return <-errc
 }
 
+// write replaces the file at dest within a pod with data, renaming it into place so it's never read half written
+func (s *seeder) write(target k8s.Target, dest string, data []byte) error {
+	exec, err := s.executor(target, []string{"/ripfs/bin/busybox", "sh", "-c", fmt.Sprintf("cat > %[1]s.tmp && mv %[1]s.tmp %[1]s", dest)})
+	if err != nil {
+		return err
+	}
+
+	return exec.Stream(remotecommand.StreamOptions{
+		Stdin:  bytes.NewReader(data),
+		Stdout: io.Discard,
+		Stderr: io.Discard,
+		Tty:    false,
+	})
+}
+
 func (s *seeder) exec(target k8s.Target, cmd []string) error {
 	exec, err := s.executor(target, cmd)
 	if err != nil {
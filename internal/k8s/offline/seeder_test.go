@@ -0,0 +1,96 @@
+package offline
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/fluxcd/pkg/ssa"
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/joshrwolf/ripfs/config"
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/manifests"
+)
+
+func testingNode(name string, arch string) corev1.Node {
+	return corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			NodeInfo: corev1.NodeSystemInfo{OperatingSystem: "linux", Architecture: arch},
+		},
+	}
+}
+
+func TestSeedPlatform(t *testing.T) {
+	p, err := seedPlatform([]corev1.Node{testingNode("a", "arm64"), testingNode("b", "arm64")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.OS != "linux" || p.Architecture != "arm64" {
+		t.Errorf("expected linux/arm64, got %v", p)
+	}
+
+	// Mixed clusters are rejected before any node is seeded
+	if _, err := seedPlatform([]corev1.Node{testingNode("a", "amd64"), testingNode("b", "arm64")}); err == nil {
+		t.Errorf("expected mixed platforms to be rejected")
+	}
+
+	if _, err := seedPlatform(nil); err == nil {
+		t.Errorf("expected a cluster without nodes to be rejected")
+	}
+}
+
+func TestSeededManagerImage(t *testing.T) {
+	ref, err := name.ParseReference(consts.ManagerImageReference)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The manager runs by the reference it was loaded (and cached) as, not by its cid reference
+	seeded := seededImage(ref, seedRegistry+"/ipfs/bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi")
+	if seeded != seedRegistry+"/ripfs/manager:seed" {
+		t.Fatalf("expected the manager to be loaded by its tag, got %s", seeded)
+	}
+
+	opts := manifests.DefaultOpts()
+	opts.ManagerImage = seeded
+	data, err := manifests.NewGenerator(opts).Generate(context.Background(), config.EmbeddedManifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objs, err := ssa.ReadObjects(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var checked int
+	for _, obj := range objs {
+		if obj.GetKind() != "Deployment" && obj.GetKind() != "DaemonSet" {
+			continue
+		}
+
+		containers, _, err := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range containers {
+			c := c.(map[string]interface{})
+			if c["name"] != "manager" && c["name"] != "agent" {
+				continue
+			}
+
+			if c["image"] != seeded {
+				t.Errorf("expected %s %s to run the seeded %s, got %v", obj.GetKind(), obj.GetName(), seeded, c["image"])
+			}
+			checked++
+		}
+	}
+	if checked == 0 {
+		t.Fatal("expected the manager's deployment to be rendered")
+	}
+}
@@ -0,0 +1,237 @@
+package offline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// VolumesSuffix is appended to a split payload's name for its join manifest
+const VolumesSuffix = ".volumes.json"
+
+// VolumeManifest joins the volumes of a split payload back together, and verifies them along the way
+type VolumeManifest struct {
+	// Name is the name the payload was split from
+	Name string `json:"name"`
+
+	// Digest and Size are of the joined payload
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+
+	Volumes []Volume `json:"volumes"`
+}
+
+// Volume is a single volume of a split payload, named relative to its join manifest
+type Volume struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// VolumeWriter splits everything written to it across volumes of at most size bytes, named <path>.000, <path>.001
+// and so on. The join manifest is written to <path>.volumes.json on Close.
+type VolumeWriter struct {
+	path string
+	size int64
+
+	m     VolumeManifest
+	total digest.Digester
+
+	cur     *os.File
+	written int64
+	vd      digest.Digester
+}
+
+func NewVolumeWriter(path string, size int64) (*VolumeWriter, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("volume size must be positive, got %d", size)
+	}
+
+	return &VolumeWriter{
+		path:  path,
+		size:  size,
+		m:     VolumeManifest{Name: filepath.Base(path)},
+		total: digest.Canonical.Digester(),
+	}, nil
+}
+
+func (w *VolumeWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if w.cur == nil || w.written == w.size {
+			if err := w.next(); err != nil {
+				return n, err
+			}
+		}
+
+		chunk := p
+		if rem := w.size - w.written; int64(len(chunk)) > rem {
+			chunk = chunk[:rem]
+		}
+
+		wn, err := w.cur.Write(chunk)
+		w.vd.Hash().Write(chunk[:wn])
+		w.total.Hash().Write(chunk[:wn])
+		w.written += int64(wn)
+		n += wn
+		if err != nil {
+			return n, err
+		}
+
+		p = p[wn:]
+	}
+	return n, nil
+}
+
+// next finishes the current volume (if any) and starts the next one
+func (w *VolumeWriter) next() error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s.%03d", filepath.Base(w.path), len(w.m.Volumes))
+	f, err := os.Create(filepath.Join(filepath.Dir(w.path), name))
+	if err != nil {
+		return err
+	}
+
+	w.cur, w.written, w.vd = f, 0, digest.Canonical.Digester()
+	w.m.Volumes = append(w.m.Volumes, Volume{Name: name})
+	return nil
+}
+
+func (w *VolumeWriter) finish() error {
+	if w.cur == nil {
+		return nil
+	}
+
+	v := &w.m.Volumes[len(w.m.Volumes)-1]
+	v.Digest, v.Size = w.vd.Digest().String(), w.written
+	w.m.Size += w.written
+
+	err := w.cur.Close()
+	w.cur = nil
+	return err
+}
+
+// Close finishes the last volume and writes the join manifest
+func (w *VolumeWriter) Close() error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+	w.m.Digest = w.total.Digest().String()
+
+	data, err := json.MarshalIndent(w.m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(w.path+VolumesSuffix, data, 0644)
+}
+
+// OpenVolumes joins the volumes listed by the join manifest at path back together. Every volume is checked to be
+// present up front, and each is verified against its digest as it's read, failing the read on any mismatch.
+func OpenVolumes(path string) (*VolumeReader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := VolumeManifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("reading join manifest %s: %v", path, err)
+	}
+
+	if _, err := digest.Parse(m.Digest); err != nil {
+		return nil, fmt.Errorf("invalid join manifest %s: %v", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	for _, v := range m.Volumes {
+		if _, err := digest.Parse(v.Digest); err != nil {
+			return nil, fmt.Errorf("invalid digest for volume %s: %v", v.Name, err)
+		}
+
+		fi, err := os.Stat(filepath.Join(dir, v.Name))
+		if err != nil {
+			return nil, fmt.Errorf("missing volume: %v", err)
+		}
+
+		if fi.Size() != v.Size {
+			return nil, fmt.Errorf("volume %s is %d bytes, expected %d", v.Name, fi.Size(), v.Size)
+		}
+	}
+
+	return &VolumeReader{
+		dir:   dir,
+		m:     m,
+		total: digest.Digest(m.Digest).Verifier(),
+	}, nil
+}
+
+// VolumeReader reads the volumes of a split payload as one
+type VolumeReader struct {
+	dir   string
+	m     VolumeManifest
+	total digest.Verifier
+
+	i   int
+	cur *os.File
+	vv  digest.Verifier
+}
+
+// Name is the name the payload was split from
+func (r *VolumeReader) Name() string {
+	return r.m.Name
+}
+
+func (r *VolumeReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if r.i == len(r.m.Volumes) {
+				if !r.total.Verified() {
+					return 0, fmt.Errorf("joined payload doesn't match digest %s", r.m.Digest)
+				}
+				return 0, io.EOF
+			}
+
+			v := r.m.Volumes[r.i]
+			f, err := os.Open(filepath.Join(r.dir, v.Name))
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.vv = f, digest.Digest(v.Digest).Verifier()
+		}
+
+		n, err := r.cur.Read(p)
+		r.vv.Write(p[:n])
+		r.total.Write(p[:n])
+
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+
+			v := r.m.Volumes[r.i]
+			r.i++
+			if !r.vv.Verified() {
+				return n, fmt.Errorf("volume %s is corrupt, it doesn't match digest %s", v.Name, v.Digest)
+			}
+
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+func (r *VolumeReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	return r.cur.Close()
+}
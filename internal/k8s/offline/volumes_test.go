@@ -0,0 +1,88 @@
+package offline
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVolumes(t *testing.T) {
+	want := make([]byte, 10*1024)
+	if _, err := rand.Read(want); err != nil {
+		t.Fatal(err)
+	}
+
+	p := filepath.Join(t.TempDir(), "payload.tar.zst")
+
+	w, err := NewVolumeWriter(p, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Written in chunks that don't line up with the volumes
+	for rem := want; len(rem) > 0; {
+		n := 700
+		if n > len(rem) {
+			n = len(rem)
+		}
+		if _, err := w.Write(rem[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rem = rem[n:]
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	vr, err := OpenVolumes(p + VolumesSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(vr.m.Volumes) != 4 {
+		t.Fatalf("expected 4 volumes, got %d", len(vr.m.Volumes))
+	}
+
+	got, err := io.ReadAll(vr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vr.Close()
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("expected the joined volumes to match what was written")
+	}
+
+	// Corrupt (but don't resize) a volume
+	vp := filepath.Join(filepath.Dir(p), vr.m.Volumes[1].Name)
+	data, err := os.ReadFile(vp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 0xff
+	if err := os.WriteFile(vp, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vr, err = OpenVolumes(p + VolumesSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vr.Close()
+
+	if _, err := io.ReadAll(vr); err == nil {
+		t.Fatal("expected a corrupt volume to fail verification")
+	}
+
+	if err := os.Remove(filepath.Join(filepath.Dir(p), vr.m.Volumes[3].Name)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenVolumes(p + VolumesSuffix); err == nil {
+		t.Fatal("expected a missing volume to be caught up front")
+	}
+}
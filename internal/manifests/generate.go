@@ -6,6 +6,7 @@ import (
 	"context"
 	"io/fs"
 	"path/filepath"
+	"strings"
 	"sync"
 	"text/template"
 
@@ -20,7 +21,73 @@ type generator struct {
 }
 
 type Opts struct {
+	// ManagerImage is the image the manager and agents run, by tag or digest
 	ManagerImage string
+
+	// JoinPeers are the multiaddrs of an existing swarm the installed cluster joins, using SwarmKey
+	JoinPeers []string
+	SwarmKey  []byte
+
+	// WebhookDNSNames are the additional dns names (or ips) the manager issues the webhook's certificate for
+	WebhookDNSNames []string
+
+	// WebhookOptIn only has the webhook admit the pods of namespaces labeled ripfs.dev/rewrite=true, or pods labeled so
+	// themselves, rather than every pod of the cluster
+	WebhookOptIn bool
+
+	// WebhookURL, if set, is the https url (including its path) the webhook is registered at rather than the manager's
+	// service
+	WebhookURL string
+
+	// NodeLocalPort, if set, is the port every agent serves the registry on at its node's localhost, which the webhook
+	// rewrites images to, so kubelet only ever pulls from the agent on its own node
+	NodeLocalPort int32
+
+	// ContainerdMirror configures every node's containerd (from an init container of its agent) to pull through the
+	// agents as a mirror of upstream registries
+	ContainerdMirror bool
+
+	// VerifyMappings has both the webhook and the agents only resolve images whose mapping is signed by a trusted key
+	VerifyMappings bool
+
+	// ProvenanceKeys, if any, are the pem encoded public keys (by name) a validating webhook verifies the cosign
+	// signatures of every pod's images with, denying pods whose images aren't signed by one of them
+	ProvenanceKeys map[string][]byte
+
+	// ProvenanceURL, if set, is the https url (including its path) the validating webhook is registered at rather than
+	// the manager's service
+	ProvenanceURL string
+}
+
+// ManagerImageName is ManagerImage without its tag or digest, which kustomize sets separately
+func (o *Opts) ManagerImageName() string {
+	n, _, _ := splitImage(o.ManagerImage)
+	return n
+}
+
+// ManagerImageTag is the tag of ManagerImage, if it has one
+func (o *Opts) ManagerImageTag() string {
+	_, t, _ := splitImage(o.ManagerImage)
+	return t
+}
+
+// ManagerImageDigest is the digest of ManagerImage, if it has one
+func (o *Opts) ManagerImageDigest() string {
+	_, _, d := splitImage(o.ManagerImage)
+	return d
+}
+
+// splitImage splits image into its name, tag and digest. A registry's port isn't mistaken for a tag.
+func splitImage(image string) (string, string, string) {
+	var digest string
+	if i := strings.Index(image, "@"); i >= 0 {
+		image, digest = image[:i], image[i+1:]
+	}
+
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:], digest
+	}
+	return image, "", digest
 }
 
 func DefaultOpts() *Opts {
@@ -88,6 +155,24 @@ func (g *generator) overlay(ctx context.Context, data []byte) ([]byte, error) {
 		return nil, err
 	}
 
+	if len(g.config.SwarmKey) > 0 {
+		if err := fsys.WriteFile("swarm.key", g.config.SwarmKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(g.config.ProvenanceKeys) > 0 {
+		for n, key := range g.config.ProvenanceKeys {
+			if err := fsys.WriteFile(filepath.Join("provenance-keys", n), key); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := g.renderTemplate(g.config, fsys, provenanceWebhook, "provenance.yaml"); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := g.renderTemplate(g.config, fsys, baseKustomize, "kustomization.yaml"); err != nil {
 		return nil, err
 	}
@@ -5,9 +5,242 @@ apiVersion: kustomize.config.k8s.io/v1beta1
 kind: Kustomization
 resources:
 - generated.yaml
+{{- if .ProvenanceKeys }}
+- provenance.yaml
+{{- end }}
 images:
 {{- if .ManagerImage }}
 - name: controller
-  newName: {{ .ManagerImage }}
+  newName: {{ .ManagerImageName }}
+{{- if .ManagerImageDigest }}
+  digest: {{ .ManagerImageDigest }}
+{{- else if .ManagerImageTag }}
+  newTag: {{ .ManagerImageTag }}
+{{- end }}
+{{- end }}
+{{- if .SwarmKey }}
+secretGenerator:
+- name: ripfs-join
+  namespace: ripfs-system
+  files:
+  - swarm.key
+  options:
+    disableNameSuffixHash: true
+{{- end }}
+{{- if .ProvenanceKeys }}
+configMapGenerator:
+- name: ripfs-provenance-keys
+  namespace: ripfs-system
+  files:
+{{- range $n, $k := .ProvenanceKeys }}
+  - provenance-keys/{{ $n }}
+{{- end }}
+  options:
+    disableNameSuffixHash: true
+{{- end }}
+{{- if or .SwarmKey .WebhookDNSNames .WebhookOptIn .WebhookURL .NodeLocalPort .ContainerdMirror .VerifyMappings .ProvenanceKeys }}
+patches:
+{{- end }}
+{{- if .SwarmKey }}
+- target:
+    kind: Deployment
+    name: ripfs-controller-manager
+  patch: |-
+    apiVersion: apps/v1
+    kind: Deployment
+    metadata:
+      name: ripfs-controller-manager
+    spec:
+      template:
+        spec:
+          containers:
+          - name: manager
+            env:
+            - name: IPFS_BOOTSTRAP_PEERS
+              value: "{{ range $i, $p := .JoinPeers }}{{ if $i }} {{ end }}{{ $p }}{{ end }}"
+            volumeMounts:
+            - name: ipfs-swarm-key
+              mountPath: /data/ipfs/swarm.key
+              subPath: swarm.key
+          volumes:
+          - name: ipfs-swarm-key
+            secret:
+              secretName: ripfs-join
+              defaultMode: 0444
+{{- end }}
+{{- if .WebhookDNSNames }}
+- target:
+    kind: Deployment
+    name: ripfs-controller-manager
+  patch: |-
+    - op: add
+      path: /spec/template/spec/containers/0/args/-
+      value: "--webhook-dns-names={{ range $i, $n := .WebhookDNSNames }}{{ if $i }},{{ end }}{{ $n }}{{ end }}"
+{{- end }}
+{{- if .WebhookOptIn }}
+- target:
+    kind: MutatingWebhookConfiguration
+    name: ripfs-webhook
+  patch: |-
+    - op: copy
+      from: /webhooks/0
+      path: /webhooks/1
+    - op: add
+      path: /webhooks/0/namespaceSelector
+      value:
+        matchLabels:
+          ripfs.dev/rewrite: "true"
+    - op: replace
+      path: /webhooks/1/name
+      value: pods.mutator.ripfs.io
+    - op: add
+      path: /webhooks/1/namespaceSelector
+      value:
+        matchExpressions:
+        - key: ripfs.dev/rewrite
+          operator: NotIn
+          values:
+          - "true"
+    - op: add
+      path: /webhooks/1/objectSelector
+      value:
+        matchLabels:
+          ripfs.dev/rewrite: "true"
+{{- end }}
+{{- if .WebhookURL }}
+- target:
+    kind: MutatingWebhookConfiguration
+    name: ripfs-webhook
+  patch: |-
+    - op: replace
+      path: /webhooks/0/clientConfig
+      value:
+        url: "{{ .WebhookURL }}"
+{{- if .WebhookOptIn }}
+    - op: replace
+      path: /webhooks/1/clientConfig
+      value:
+        url: "{{ .WebhookURL }}"
+{{- end }}
+{{- end }}
+{{- if .NodeLocalPort }}
+- target:
+    kind: DaemonSet
+    name: ripfs-agents
+  patch: |-
+    - op: add
+      path: /spec/template/spec/containers/0/ports/0/hostPort
+      value: {{ .NodeLocalPort }}
+    - op: add
+      path: /spec/template/spec/containers/0/ports/0/hostIP
+      value: 127.0.0.1
+- target:
+    kind: Deployment
+    name: ripfs-controller-manager
+  patch: |-
+    - op: add
+      path: /spec/template/spec/containers/0/args/-
+      value: "--registry=localhost:{{ .NodeLocalPort }}"
+{{- end }}
+{{- if .ContainerdMirror }}
+- target:
+    kind: DaemonSet
+    name: ripfs-agents
+  patch: |-
+    - op: add
+      path: /spec/template/spec/initContainers
+      value:
+      - name: configure-node
+        image: controller:latest
+        command:
+        - /ko-app/ripfs
+        - configure-node
+        - --endpoint=http://localhost:{{ if .NodeLocalPort }}{{ .NodeLocalPort }}{{ else }}31609{{ end }}
+        - --certs-dir=/host/etc/containerd/certs.d
+        - --containerd-config=/host/etc/containerd/config.toml
+        securityContext:
+          runAsUser: 0
+          allowPrivilegeEscalation: false
+        volumeMounts:
+        - name: containerd-config
+          mountPath: /host/etc/containerd
+    - op: add
+      path: /spec/template/spec/volumes/-
+      value:
+        name: containerd-config
+        hostPath:
+          path: /etc/containerd
+          type: DirectoryOrCreate
+{{- end }}
+{{- if .VerifyMappings }}
+- target:
+    kind: Deployment
+    name: ripfs-controller-manager
+  patch: |-
+    - op: add
+      path: /spec/template/spec/containers/0/args/-
+      value: --verify-mappings
+- target:
+    kind: DaemonSet
+    name: ripfs-agents
+  patch: |-
+    - op: add
+      path: /spec/template/spec/containers/0/command/-
+      value: --verify-mappings
+{{- end }}
+{{- if .ProvenanceKeys }}
+- target:
+    kind: Deployment
+    name: ripfs-controller-manager
+  patch: |-
+    - op: add
+      path: /spec/template/spec/containers/0/args/-
+      value: --validate-provenance
+{{- end }}
+`
+
+// provenanceWebhook is the validating webhook of the provenance validator, which fails closed (leaving the cluster's
+// own namespaces out) since it's enforcing
+const provenanceWebhook = `
+apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingWebhookConfiguration
+metadata:
+  name: ripfs-provenance
+webhooks:
+- name: provenance.ripfs.io
+  admissionReviewVersions:
+  - v1
+  - v1beta1
+  clientConfig:
+{{- if .ProvenanceURL }}
+    url: "{{ .ProvenanceURL }}"
+{{- else }}
+    service:
+      name: ripfs-controller-manager
+      namespace: ripfs-system
+      path: /validate
+      port: 443
 {{- end }}
+  sideEffects: None
+  timeoutSeconds: 10
+  failurePolicy: Fail
+  matchPolicy: Exact
+  namespaceSelector:
+    matchExpressions:
+    - key: kubernetes.io/metadata.name
+      operator: NotIn
+      values:
+      - kube-system
+      - ripfs-system
+  rules:
+  - apiGroups:
+    - ""
+    apiVersions:
+    - v1
+    operations:
+    - CREATE
+    - UPDATE
+    resources:
+    - pods
+    scope: Namespaced
 `
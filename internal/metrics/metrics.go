@@ -0,0 +1,191 @@
+// Package metrics defines the metrics the manager and agents expose, and the dashboard and alerts built from those
+// same definitions, so neither drifts from what's actually exposed.
+package metrics
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/prometheus/client_golang/prometheus"
+	crmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Registry is the registry every metric is registered with, the one the manager's metrics endpoint serves
+var Registry = crmetrics.Registry
+
+// Definition defines a metric, by the name, help and labels it's exposed with
+type Definition struct {
+	Name   string
+	Help   string
+	Labels []string
+}
+
+func (d Definition) desc() *prometheus.Desc {
+	return prometheus.NewDesc(d.Name, d.Help, d.Labels, nil)
+}
+
+var (
+	SwarmPeers = Definition{
+		Name: "ripfs_ipfs_swarm_peers",
+		Help: "Number of swarm peers the ipfs node is connected to.",
+	}
+	RepoSize = Definition{
+		Name: "ripfs_ipfs_repo_size_bytes",
+		Help: "Bytes stored in the embedded ipfs node's repo.",
+	}
+	RepoStorageMax = Definition{
+		Name: "ripfs_ipfs_repo_storage_max_bytes",
+		Help: "Bytes the embedded ipfs node's repo is garbage collected to stay under.",
+	}
+	MappingsResolved = Definition{
+		Name: "ripfs_mappings_resolved_timestamp_seconds",
+		Help: "Unix time the mappings published to ipns were last resolved.",
+	}
+	MappingsResolveFailures = Definition{
+		Name: "ripfs_mappings_resolve_failures_total",
+		Help: "Number of times resolving the mappings published to ipns failed.",
+	}
+
+	WebhookMutatedPods = Definition{
+		Name: "ripfs_webhook_mutated_pods_total",
+		Help: "Number of pods the webhook rewrote images of.",
+	}
+	WebhookResolutions = Definition{
+		Name:   "ripfs_webhook_resolutions_total",
+		Help:   "Number of images the webhook resolved, by whether they were mapped (hit), weren't (miss) or failed to resolve (error).",
+		Labels: []string{"result"},
+	}
+	WebhookRewrites = Definition{
+		Name:   "ripfs_webhook_image_rewrites_total",
+		Help:   "Number of containers the webhook rewrote, by the mapped image they were rewritten from.",
+		Labels: []string{"image"},
+	}
+	WebhookAdmissionDuration = Definition{
+		Name:   "ripfs_webhook_admission_duration_seconds",
+		Help:   "Time the webhooks took to admit pods, by webhook and whether they were allowed.",
+		Labels: []string{"webhook", "allowed"},
+	}
+
+	// WebhookRequests is registered by controller-runtime, for every admission request the webhook serves
+	WebhookRequests = Definition{
+		Name:   "controller_runtime_webhook_requests_total",
+		Help:   "Total number of admission requests by HTTP status code.",
+		Labels: []string{"webhook", "code"},
+	}
+)
+
+var (
+	mappingsResolved = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: MappingsResolved.Name,
+		Help: MappingsResolved.Help,
+	})
+	mappingsResolveFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: MappingsResolveFailures.Name,
+		Help: MappingsResolveFailures.Help,
+	})
+	webhookMutatedPods = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: WebhookMutatedPods.Name,
+		Help: WebhookMutatedPods.Help,
+	})
+	webhookResolutions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: WebhookResolutions.Name,
+		Help: WebhookResolutions.Help,
+	}, WebhookResolutions.Labels)
+	webhookRewrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: WebhookRewrites.Name,
+		Help: WebhookRewrites.Help,
+	}, WebhookRewrites.Labels)
+	webhookAdmissionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    WebhookAdmissionDuration.Name,
+		Help:    WebhookAdmissionDuration.Help,
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, WebhookAdmissionDuration.Labels)
+)
+
+func init() {
+	Registry.MustRegister(mappingsResolved, mappingsResolveFailures)
+	Registry.MustRegister(webhookMutatedPods, webhookResolutions, webhookRewrites, webhookAdmissionDuration)
+}
+
+// ObserveMappings records a resolution of the mappings published to ipns, that failed with err unless it's nil
+func ObserveMappings(err error) {
+	if err != nil {
+		mappingsResolveFailures.Inc()
+		return
+	}
+	mappingsResolved.SetToCurrentTime()
+}
+
+// The results of the webhook resolving an image
+const (
+	ResolutionHit   = "hit"
+	ResolutionMiss  = "miss"
+	ResolutionError = "error"
+)
+
+// ObserveResolution records the webhook resolving an image, with one of the Resolution results
+func ObserveResolution(result string) {
+	webhookResolutions.WithLabelValues(result).Inc()
+}
+
+// ObserveMutation records the webhook rewriting a pod, rewritten being the mapping each of its rewritten containers was
+// rewritten by (repeated for containers sharing one). Only mapped images are ever rewritten, so labelling rewrites by
+// their mapping rather than the image as the pod spelled it keeps the image label bounded by the mappings.
+func ObserveMutation(rewritten []string) {
+	webhookMutatedPods.Inc()
+	for _, image := range rewritten {
+		webhookRewrites.WithLabelValues(image).Inc()
+	}
+}
+
+// ObserveAdmission records a webhook taking d to admit a pod
+func ObserveAdmission(webhook string, allowed bool, d time.Duration) {
+	webhookAdmissionDuration.WithLabelValues(webhook, strconv.FormatBool(allowed)).Observe(d.Seconds())
+}
+
+// collectTimeout bounds how long a scrape waits on the ipfs node
+const collectTimeout = 4 * time.Second
+
+// RepoStater is an ipfs node whose repo's usage can be read, such as the embedded one
+type RepoStater interface {
+	RepoStat(ctx context.Context) (size uint64, storageMax uint64, err error)
+}
+
+type nodeCollector struct {
+	api  iface.CoreAPI
+	repo RepoStater
+}
+
+// NewNodeCollector collects the swarm peers of the ipfs node behind api, and its repo's usage when repo isn't nil.
+// Whatever the node fails to report within a scrape is left out of it.
+func NewNodeCollector(api iface.CoreAPI, repo RepoStater) prometheus.Collector {
+	return &nodeCollector{api: api, repo: repo}
+}
+
+func (c *nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- SwarmPeers.desc()
+	if c.repo != nil {
+		ch <- RepoSize.desc()
+		ch <- RepoStorageMax.desc()
+	}
+}
+
+func (c *nodeCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+
+	if peers, err := c.api.Swarm().Peers(ctx); err == nil {
+		ch <- prometheus.MustNewConstMetric(SwarmPeers.desc(), prometheus.GaugeValue, float64(len(peers)))
+	}
+
+	if c.repo == nil {
+		return
+	}
+
+	if size, storageMax, err := c.repo.RepoStat(ctx); err == nil {
+		ch <- prometheus.MustNewConstMetric(RepoSize.desc(), prometheus.GaugeValue, float64(size))
+		ch <- prometheus.MustNewConstMetric(RepoStorageMax.desc(), prometheus.GaugeValue, float64(storageMax))
+	}
+}
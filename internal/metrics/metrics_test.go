@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	_ "sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/yaml"
+)
+
+func TestObserveMutation(t *testing.T) {
+	want := map[string]float64{"index.docker.io/library/nginx:1.21": 2, "ghcr.io/org/app:v1": 1}
+
+	pods := testutil.ToFloat64(webhookMutatedPods)
+	rewrites := make(map[string]float64)
+	for image := range want {
+		rewrites[image] = testutil.ToFloat64(webhookRewrites.WithLabelValues(image))
+	}
+
+	// Every container counts, even those sharing a mapping
+	ObserveMutation([]string{"index.docker.io/library/nginx:1.21", "index.docker.io/library/nginx:1.21", "ghcr.io/org/app:v1"})
+
+	if got := testutil.ToFloat64(webhookMutatedPods) - pods; got != 1 {
+		t.Errorf("expected 1 mutated pod, got %v", got)
+	}
+	for image, want := range want {
+		if got := testutil.ToFloat64(webhookRewrites.WithLabelValues(image)) - rewrites[image]; got != want {
+			t.Errorf("expected %v rewrites of %s, got %v", want, image, got)
+		}
+	}
+}
+
+func TestObserveResolution(t *testing.T) {
+	for _, result := range []string{ResolutionHit, ResolutionMiss, ResolutionError} {
+		before := testutil.ToFloat64(webhookResolutions.WithLabelValues(result))
+		ObserveResolution(result)
+		if got := testutil.ToFloat64(webhookResolutions.WithLabelValues(result)) - before; got != 1 {
+			t.Errorf("expected 1 %s resolution, got %v", result, got)
+		}
+	}
+}
+
+func TestObserveAdmission(t *testing.T) {
+	ObserveAdmission("mutator", true, 30*time.Millisecond)
+	ObserveAdmission("mutator", false, time.Second)
+
+	if got := testutil.CollectAndCount(webhookAdmissionDuration, WebhookAdmissionDuration.Name); got != 2 {
+		t.Errorf("expected admissions to be observed by whether they were allowed, got %d series", got)
+	}
+}
+
+func TestObserveMappings(t *testing.T) {
+	failures := testutil.ToFloat64(mappingsResolveFailures)
+
+	ObserveMappings(errors.New("unreachable"))
+	if got := testutil.ToFloat64(mappingsResolveFailures) - failures; got != 1 {
+		t.Errorf("expected 1 failure, got %v", got)
+	}
+
+	ObserveMappings(nil)
+	if got := testutil.ToFloat64(mappingsResolved); time.Since(time.Unix(int64(got), 0)) > time.Minute {
+		t.Errorf("expected the mappings to be resolved just now, got %v", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	// controller-runtime's webhook metrics are registered along with its webhook package
+	if err := Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDashboardAndRules(t *testing.T) {
+	data, err := Dashboard()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dashboard struct {
+		Panels []struct {
+			Targets []struct {
+				Expr string `json:"expr"`
+			} `json:"targets"`
+		} `json:"panels"`
+	}
+	if err := json.Unmarshal(data, &dashboard); err != nil {
+		t.Fatal(err)
+	}
+	if len(dashboard.Panels) != len(Panels()) {
+		t.Errorf("expected %d panels, got %d", len(Panels()), len(dashboard.Panels))
+	}
+	for i, p := range dashboard.Panels {
+		if len(p.Targets) != 1 || p.Targets[0].Expr != Panels()[i].Expr {
+			t.Errorf("expected panel %d to graph %s, got %+v", i, Panels()[i].Expr, p.Targets)
+		}
+	}
+
+	data, err = Rules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rules struct {
+		Groups []struct {
+			Rules []struct {
+				Alert string `json:"alert"`
+			} `json:"rules"`
+		} `json:"groups"`
+	}
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.Groups) != 1 || len(rules.Groups[0].Rules) != len(Alerts()) {
+		t.Errorf("expected every alert in a single group, got %+v", rules.Groups)
+	}
+}
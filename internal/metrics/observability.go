@@ -0,0 +1,246 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/yaml"
+)
+
+// Panel is a graph of the dashboard
+type Panel struct {
+	Title       string
+	Description string
+	Unit        string
+	Expr        string
+	Legend      string
+}
+
+// Alert is an alerting rule
+type Alert struct {
+	Name        string
+	Expr        string
+	For         string
+	Severity    string
+	Summary     string
+	Description string
+}
+
+// Panels is every graph of the dashboard
+func Panels() []Panel {
+	return []Panel{
+		{
+			Title:       "Swarm peers",
+			Description: SwarmPeers.Help,
+			Unit:        "short",
+			Expr:        SwarmPeers.Name,
+			Legend:      "{{pod}}",
+		},
+		{
+			Title:       "Repo usage",
+			Description: "Bytes stored in each embedded ipfs node's repo, of the bytes it's garbage collected to stay under.",
+			Unit:        "percentunit",
+			Expr:        repoUsage(),
+			Legend:      "{{pod}}",
+		},
+		{
+			Title:       "Mappings age",
+			Description: "Time since the mappings published to ipns were last resolved.",
+			Unit:        "s",
+			Expr:        mappingsAge(),
+			Legend:      "{{pod}}",
+		},
+		{
+			Title:       "Webhook error rate",
+			Description: "Share of admission requests the webhook failed to serve.",
+			Unit:        "percentunit",
+			Expr:        webhookErrorRate(),
+			Legend:      "{{webhook}}",
+		},
+		{
+			Title:       "Webhook resolution misses",
+			Description: "Share of the images the webhook resolved that weren't mapped (or failed to resolve), and were left as they are.",
+			Unit:        "percentunit",
+			Expr:        fmt.Sprintf(`sum(rate(%[1]s{result!="hit"}[5m])) / sum(rate(%[1]s[5m]))`, WebhookResolutions.Name),
+			Legend:      "misses",
+		},
+		{
+			Title:       "Webhook rewrites",
+			Description: "Containers the webhook rewrites, by the image they're rewritten from.",
+			Unit:        "ops",
+			Expr:        fmt.Sprintf(`topk(10, sum by (image) (rate(%s[5m])))`, WebhookRewrites.Name),
+			Legend:      "{{image}}",
+		},
+		{
+			Title:       "Webhook admission latency",
+			Description: "99th percentile of the time the webhooks take to admit pods.",
+			Unit:        "s",
+			Expr:        fmt.Sprintf(`histogram_quantile(0.99, sum by (webhook, le) (rate(%s_bucket[5m])))`, WebhookAdmissionDuration.Name),
+			Legend:      "{{webhook}}",
+		},
+	}
+}
+
+// Alerts is every alerting rule
+func Alerts() []Alert {
+	return []Alert{
+		{
+			Name:        "RipfsSwarmIsolated",
+			Expr:        fmt.Sprintf("%s == 0", SwarmPeers.Name),
+			For:         "5m",
+			Severity:    "critical",
+			Summary:     "An ipfs node has no swarm peers",
+			Description: "{{ $labels.pod }} isn't connected to any swarm peer, so it only serves what it already stores.",
+		},
+		{
+			Name:        "RipfsSwarmPeersDropped",
+			Expr:        fmt.Sprintf("%[1]s < 0.5 * max_over_time(%[1]s[1h])", SwarmPeers.Name),
+			For:         "10m",
+			Severity:    "warning",
+			Summary:     "An ipfs node lost most of its swarm peers",
+			Description: "{{ $labels.pod }} is connected to {{ $value }} swarm peers, less than half as many as within the last hour.",
+		},
+		{
+			Name:        "RipfsRepoNearCapacity",
+			Expr:        fmt.Sprintf("%s > 0.95", repoUsage()),
+			For:         "30m",
+			Severity:    "warning",
+			Summary:     "An ipfs repo is nearly full",
+			Description: "{{ $labels.pod }}'s repo is {{ $value | humanizePercentage }} full, garbage collection isn't keeping it under its watermark.",
+		},
+		{
+			Name:        "RipfsMappingsStale",
+			Expr:        fmt.Sprintf("%s > 900 and increase(%s[15m]) > 0", mappingsAge(), MappingsResolveFailures.Name),
+			For:         "5m",
+			Severity:    "warning",
+			Summary:     "The mappings published to ipns can't be resolved",
+			Description: "{{ $labels.pod }} last resolved the mappings {{ $value | humanizeDuration }} ago, and is failing to resolve them since.",
+		},
+		{
+			Name:        "RipfsWebhookErrors",
+			Expr:        fmt.Sprintf("%s > 0.05", webhookErrorRate()),
+			For:         "10m",
+			Severity:    "critical",
+			Summary:     "The webhook is failing admission requests",
+			Description: "{{ $labels.webhook }} fails {{ $value | humanizePercentage }} of admission requests.",
+		},
+	}
+}
+
+func repoUsage() string {
+	return fmt.Sprintf("%s / %s", RepoSize.Name, RepoStorageMax.Name)
+}
+
+func mappingsAge() string {
+	return fmt.Sprintf("time() - %s", MappingsResolved.Name)
+}
+
+func webhookErrorRate() string {
+	return fmt.Sprintf(`sum by (webhook) (rate(%[1]s{code!~"2.."}[5m])) / sum by (webhook) (rate(%[1]s[5m]))`, WebhookRequests.Name)
+}
+
+// Check fails unless every definition registered at startup (rather than alongside an ipfs node) is registered just
+// as it's defined, such as controller-runtime's webhook metrics after an upgrade
+func Check() error {
+	for _, d := range []Definition{MappingsResolved, MappingsResolveFailures, WebhookRequests, WebhookMutatedPods, WebhookResolutions, WebhookRewrites, WebhookAdmissionDuration} {
+		c := descCollector{d.desc()}
+
+		err := Registry.Register(c)
+		if err == nil {
+			Registry.Unregister(c)
+			return fmt.Errorf("metric %s isn't registered", d.Name)
+		}
+
+		var are prometheus.AlreadyRegisteredError
+		if !errors.As(err, &are) {
+			return fmt.Errorf("metric %s isn't registered as it's defined: %v", d.Name, err)
+		}
+	}
+	return nil
+}
+
+type descCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c descCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c descCollector) Collect(chan<- prometheus.Metric) {}
+
+// Dashboard renders Panels as a grafana dashboard, reading from the prometheus datasource picked on the dashboard
+func Dashboard() ([]byte, error) {
+	const width, height = 12, 8
+
+	datasource := map[string]interface{}{"type": "prometheus", "uid": "${datasource}"}
+
+	var panels []interface{}
+	for i, p := range Panels() {
+		panels = append(panels, map[string]interface{}{
+			"id":          i + 1,
+			"type":        "timeseries",
+			"title":       p.Title,
+			"description": p.Description,
+			"datasource":  datasource,
+			"gridPos":     map[string]int{"h": height, "w": width, "x": i % 2 * width, "y": i / 2 * height},
+			"fieldConfig": map[string]interface{}{
+				"defaults":  map[string]interface{}{"unit": p.Unit},
+				"overrides": []interface{}{},
+			},
+			"targets": []interface{}{
+				map[string]interface{}{"refId": "A", "datasource": datasource, "expr": p.Expr, "legendFormat": p.Legend},
+			},
+		})
+	}
+
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"uid":           "ripfs",
+		"title":         "ripfs",
+		"tags":          []string{"ripfs"},
+		"editable":      true,
+		"schemaVersion": 36,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating": map[string]interface{}{
+			"list": []interface{}{
+				map[string]interface{}{"name": "datasource", "label": "Datasource", "type": "datasource", "query": "prometheus"},
+			},
+		},
+		"panels": panels,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Rules renders Alerts as a prometheus rules file
+func Rules() ([]byte, error) {
+	type rule struct {
+		Alert       string            `json:"alert"`
+		Expr        string            `json:"expr"`
+		For         string            `json:"for,omitempty"`
+		Labels      map[string]string `json:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	}
+	type group struct {
+		Name  string `json:"name"`
+		Rules []rule `json:"rules"`
+	}
+
+	g := group{Name: "ripfs"}
+	for _, a := range Alerts() {
+		g.Rules = append(g.Rules, rule{
+			Alert:       a.Name,
+			Expr:        a.Expr,
+			For:         a.For,
+			Labels:      map[string]string{"severity": a.Severity},
+			Annotations: map[string]string{"summary": a.Summary, "description": a.Description},
+		})
+	}
+
+	return yaml.Marshal(map[string]interface{}{"groups": []group{g}})
+}
@@ -0,0 +1,82 @@
+package platform
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Parse parses a platform in the form os/arch[/variant]
+func Parse(s string) (v1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return v1.Platform{}, fmt.Errorf("invalid platform %s, expected os/arch[/variant]", s)
+	}
+
+	p := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// ParseAll parses each of the given platforms
+func ParseAll(ss []string) ([]v1.Platform, error) {
+	var ps []v1.Platform
+	for _, s := range ss {
+		p, err := Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// String returns the platform in the form os/arch[/variant], the inverse of Parse
+func String(p v1.Platform) string {
+	parts := []string{p.OS, p.Architecture}
+	if p.Variant != "" {
+		parts = append(parts, p.Variant)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Name returns a file name friendly representation of a platform, ex: linux-arm-v7
+func Name(p v1.Platform) string {
+	return strings.ReplaceAll(String(p), "/", "-")
+}
+
+// Matches returns true if p satisfies want, an empty variant in want matches any variant
+func Matches(p v1.Platform, want v1.Platform) bool {
+	if p.OS != want.OS || p.Architecture != want.Architecture {
+		return false
+	}
+	return want.Variant == "" || p.Variant == want.Variant
+}
+
+// ForNode returns the platform a node is running
+func ForNode(n corev1.Node) v1.Platform {
+	p := v1.Platform{
+		OS:           n.Status.NodeInfo.OperatingSystem,
+		Architecture: n.Status.NodeInfo.Architecture,
+	}
+
+	// The kubelet doesn't report arm variants, v7 is by far the most common
+	if p.Architecture == "arm" {
+		p.Variant = "v7"
+	}
+	return p
+}
+
+// Host returns the linux platform matching the host's architecture, which is what a cluster run from it most likely is
+func Host() v1.Platform {
+	p := v1.Platform{OS: "linux", Architecture: runtime.GOARCH}
+	if p.Architecture == "arm" {
+		p.Variant = "v7"
+	}
+	return p
+}
@@ -5,6 +5,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"sync"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/types"
@@ -13,18 +15,104 @@ import (
 	"github.com/ipfs/interface-go-ipfs-core"
 	iopts "github.com/ipfs/interface-go-ipfs-core/options"
 	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/sync/errgroup"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
 )
 
 const (
 	IPFSSchema = "ipfs://"
 )
 
+// The annotations the index of an image added with WithProvenance is stamped with, alongside the reference it was
+// added from (org.opencontainers.image.ref.name)
+const (
+	// AnnotationSourceDigest is the digest of the image (or index) as it was added, before it was rewritten for ipfs
+	AnnotationSourceDigest = consts.Name + ".dev/source-digest"
+
+	// AnnotationVersion is the version of ripfs that added the image
+	AnnotationVersion = consts.Name + ".dev/version"
+
+	// AnnotationSignedDigest is the digest whose cosign signature was verified when the image was added, which for a
+	// single platform of a multi-arch image is the index's
+	AnnotationSignedDigest = consts.Name + ".dev/signed-digest"
+)
+
+// AnnotationAdded is when an image was last mapped to its root (rfc 3339). It's recorded on the image's Image rather
+// than its index, so the same image added again is stored under the same root.
+const AnnotationAdded = consts.Name + ".dev/added"
+
+// AddOption configures how AddImage and AddIndex add images
+type AddOption func(o *addOptions)
+
+type addOptions struct {
+	provenance bool
+	ref        string
+	signed     v1.Hash
+	chunking   Chunking
+	progress   func(p Progress)
+}
+
+// WithProvenance stamps the stored index with where the image came from, ref (the reference it was added from), the
+// digest it had and the version of ripfs that added it. Nothing of it changes from one add to the next, so the same
+// image added again (by the same version) is stored under the same root.
+func WithProvenance(ref string) AddOption {
+	return func(o *addOptions) {
+		o.provenance, o.ref = true, ref
+	}
+}
+
+// WithSignedDigest stamps the stored index (along with its provenance) with the digest d whose signature was verified
+// before it was added
+func WithSignedDigest(d v1.Hash) AddOption {
+	return func(o *addOptions) {
+		o.signed = d
+	}
+}
+
+// annotations returns the annotations of the index of an image (or index) whose digest was source
+func (o addOptions) annotations(source v1.Hash) map[string]string {
+	if !o.provenance {
+		return nil
+	}
+
+	a := map[string]string{
+		AnnotationSourceDigest: source.String(),
+		AnnotationVersion:      consts.Version,
+	}
+	if o.ref != "" {
+		a[ocispec.AnnotationRefName] = o.ref
+	}
+	if o.signed != (v1.Hash{}) {
+		a[AnnotationSignedDigest] = o.signed.String()
+	}
+	return a
+}
+
+func newAddOptions(opts []AddOption) addOptions {
+	o := addOptions{chunking: DefaultChunking}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
 var addOpts = []iopts.UnixfsAddOption{
 	iopts.Unixfs.Pin(true),
 	iopts.Unixfs.CidVersion(1),
 }
 
+// ociManifest is an image manifest along with the fields artifacts (signatures, attestations and sboms) declare
+// what they're attached to with, which v1.Manifest doesn't know of yet
+type ociManifest struct {
+	v1.Manifest
+
+	ArtifactType string         `json:"artifactType,omitempty"`
+	Subject      *v1.Descriptor `json:"subject,omitempty"`
+}
+
 type IpfsManifest struct {
 	MediaType types.MediaType `json:"mediaType"`
 	Digest    v1.Hash         `json:"digest"`
@@ -32,53 +120,206 @@ type IpfsManifest struct {
 	URLs      []string        `json:"urls,omitempty"`
 }
 
-// AddImage adds an image to a given ipfs backend
-func AddImage(ctx context.Context, api iface.CoreAPI, img v1.Image) (path.Resolved, error) {
-	cidMap, err := writeLayers(ctx, api, img)
+// AddImage adds an image to a given ipfs backend. Layers that layers (which may be nil) knows to still be stored
+// aren't added again, so re-adding overlapping images only transfers their new layers.
+func AddImage(ctx context.Context, api iface.CoreAPI, img v1.Image, layers LayerIndex, opts ...AddOption) (path.Resolved, error) {
+	o := newAddOptions(opts)
+
+	if err := o.chunking.Validate(); err != nil {
+		return nil, err
+	}
+
+	manifest, cidMap, err := writeContent(ctx, api, img, layers, o)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: .RawConfigFile returns the "real" config, but .ConfigFile doesn't? somehow the two don't byte equal
-	cfgData, err := img.RawConfigFile()
+	var annotations map[string]string
+	if o.provenance {
+		d, err := img.Digest()
+		if err != nil {
+			return nil, err
+		}
+		annotations = o.annotations(d)
+	}
+
+	desc, err := writeManifest(ctx, api, manifest, cidMap)
 	if err != nil {
 		return nil, err
 	}
 
-	cfgPath, err := api.Unixfs().Add(ctx, files.NewBytesFile(cfgData), addOpts...)
+	// The image's platform is recorded in the index just as it would be in a multi-arch image's, so runtimes select it
+	// without reading its config first. Artifacts whose config isn't an image's are left without one.
+	if cf, err := img.ConfigFile(); err == nil && cf.OS != "" && cf.Architecture != "" {
+		desc.Platform = &v1.Platform{OS: cf.OS, Architecture: cf.Architecture, OSVersion: cf.OSVersion}
+	}
+
+	p, err := writeIndex(ctx, api, []v1.Descriptor{desc}, annotations)
 	if err != nil {
-		return nil, fmt.Errorf("writing config to ipfs: %v", err)
+		return nil, err
 	}
 
-	manifest, err := img.Manifest()
+	o.report(Progress{Phase: PhaseAdded, Digest: desc.Digest.String(), Cid: p.Cid().String()})
+	return p, nil
+}
+
+// AddIndex adds every image within an index whose platform satisfies match (a nil match adds all of them), storing
+// the index as the root object so clients can select their own platform. Layers are skipped just as with AddImage.
+func AddIndex(ctx context.Context, api iface.CoreAPI, idx v1.ImageIndex, match func(p *v1.Platform) bool, layers LayerIndex, opts ...AddOption) (path.Resolved, error) {
+	o := newAddOptions(opts)
+
+	if err := o.chunking.Validate(); err != nil {
+		return nil, err
+	}
+
+	im, err := idx.IndexManifest()
 	if err != nil {
 		return nil, err
 	}
 
-	cidMap[manifest.Config.Digest] = cfgPath.Cid()
+	var descs []v1.Descriptor
+	for _, desc := range im.Manifests {
+		switch desc.MediaType {
+		case types.OCIManifestSchema1, types.DockerManifestSchema2:
+		default:
+			// Nested indexes and anything else that isn't runnable is skipped
+			continue
+		}
+
+		if match != nil && (desc.Platform == nil || !match(desc.Platform)) {
+			continue
+		}
 
-	ipfsManifest, err := convertIpfs(manifest, cidMap)
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		manifest, cidMap, err := writeContent(ctx, api, img, layers, o)
+		if err != nil {
+			return nil, fmt.Errorf("adding %s: %v", desc.Digest, err)
+		}
+
+		mdesc, err := writeManifest(ctx, api, manifest, cidMap)
+		if err != nil {
+			return nil, err
+		}
+
+		mdesc.Platform = desc.Platform
+		mdesc.Annotations = desc.Annotations
+		descs = append(descs, mdesc)
+	}
+
+	if len(descs) == 0 {
+		return nil, fmt.Errorf("no images within the index matched the requested platforms")
+	}
+
+	var annotations map[string]string
+	if o.provenance {
+		d, err := idx.Digest()
+		if err != nil {
+			return nil, err
+		}
+		annotations = o.annotations(d)
+	}
+
+	p, err := writeIndex(ctx, api, descs, annotations)
 	if err != nil {
 		return nil, err
 	}
 
-	ipfsManifestPath, ipfsManifestHash, ipfsManifestSize, err := writeObj(ctx, api, ipfsManifest)
+	d, err := idx.Digest()
 	if err != nil {
 		return nil, err
 	}
 
-	// Build/store the image's index
+	o.report(Progress{Phase: PhaseAdded, Digest: d.String(), Cid: p.Cid().String()})
+	return p, nil
+}
+
+// writeContent writes an image's config and layers (chunked as o chunks them, and reporting their progress),
+// returning its manifest and the cid of everything it references
+func writeContent(ctx context.Context, api iface.CoreAPI, img v1.Image, layers LayerIndex, o addOptions) (*ociManifest, map[v1.Hash]cid.Cid, error) {
+	cidMap, err := writeLayers(ctx, api, img, layers, o)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// TODO: .RawConfigFile returns the "real" config, but .ConfigFile doesn't? somehow the two don't byte equal
+	cfgData, err := img.RawConfigFile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfgCid, err := writeBlob(ctx, api, cfgData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("writing config to ipfs: %v", err)
+	}
+
+	raw, err := img.RawManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest := &ociManifest{}
+	if err := json.Unmarshal(raw, manifest); err != nil {
+		return nil, nil, err
+	}
+
+	cidMap[manifest.Config.Digest] = cfgCid
+	return manifest, cidMap, nil
+}
+
+// writeImage writes the ipfs flavored manifest, index and root for a manifest whose config and layers are already
+// stored within ipfs at the given cids
+func writeImage(ctx context.Context, api iface.CoreAPI, manifest *ociManifest, cidMap map[v1.Hash]cid.Cid) (path.Resolved, error) {
+	desc, err := writeManifest(ctx, api, manifest, cidMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return writeIndex(ctx, api, []v1.Descriptor{desc}, nil)
+}
+
+// writeManifest writes the ipfs flavored manifest, returning the descriptor an index refers to it by
+func writeManifest(ctx context.Context, api iface.CoreAPI, manifest *ociManifest, cidMap map[v1.Hash]cid.Cid) (v1.Descriptor, error) {
+	converted, err := convertIpfs(&manifest.Manifest, cidMap)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	ipfsManifest := &ociManifest{
+		Manifest:     *converted,
+		ArtifactType: manifest.ArtifactType,
+		Subject:      manifest.Subject,
+	}
+
+	ipfsManifestPath, ipfsManifestHash, ipfsManifestSize, err := writeObj(ctx, api, ipfsManifest)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	// OCI manifests needn't declare their own media type, the index referring to them still has to
+	mt := ipfsManifest.MediaType
+	if mt == "" {
+		mt = types.OCIManifestSchema1
+	}
+
+	return v1.Descriptor{
+		MediaType: mt,
+		Size:      ipfsManifestSize,
+		Digest:    ipfsManifestHash,
+		URLs:      []string{IPFSSchema + ipfsManifestPath.Cid().String()},
+	}, nil
+}
+
+// writeIndex writes the index of the given manifests (with any annotations), and the root pointing at it
+func writeIndex(ctx context.Context, api iface.CoreAPI, manifests []v1.Descriptor, annotations map[string]string) (path.Resolved, error) {
 	idx := v1.IndexManifest{
 		SchemaVersion: 2,
 		MediaType:     types.OCIImageIndex,
-		Manifests: []v1.Descriptor{
-			{
-				MediaType: ipfsManifest.MediaType,
-				Size:      ipfsManifestSize,
-				Digest:    ipfsManifestHash,
-				URLs:      []string{IPFSSchema + ipfsManifestPath.Cid().String()},
-			},
-		},
+		Manifests:     manifests,
+		Annotations:   annotations,
 	}
 
 	idxPath, idxHash, idxSize, err := writeObj(ctx, api, idx)
@@ -117,7 +358,7 @@ func convertIpfs(m *v1.Manifest, cids map[v1.Hash]cid.Cid) (*v1.Manifest, error)
 	return n, nil
 }
 
-// writeObj adds any marshallable object
+// writeObj adds any marshallable object, as a raw block found by its digest unless it's too large to be one
 func writeObj(ctx context.Context, api iface.CoreAPI, obj interface{}) (path.Resolved, v1.Hash, int64, error) {
 	data, err := json.Marshal(obj)
 	if err != nil {
@@ -129,16 +370,31 @@ func writeObj(ctx context.Context, api iface.CoreAPI, obj interface{}) (path.Res
 		return nil, v1.Hash{}, 0, err
 	}
 
-	p, err := api.Unixfs().Add(ctx, files.NewBytesFile(data), addOpts...)
+	c, err := writeBlob(ctx, api, data)
 	if err != nil {
 		return nil, v1.Hash{}, 0, err
 	}
 
-	return p, h, size, nil
+	return path.IpfsPath(c), h, size, nil
 }
 
-func writeLayers(ctx context.Context, api iface.CoreAPI, img v1.Image) (map[v1.Hash]cid.Cid, error) {
-	cidMap := make(map[v1.Hash]cid.Cid)
+// writeLayers writes an image's layers chunked as o chunks them, skipping any that the index knows to still be pinned.
+// Layers written as raw blocks are known by their digest, and so are skipped without the index.
+func writeLayers(ctx context.Context, api iface.CoreAPI, img v1.Image, index LayerIndex, o addOptions) (map[v1.Hash]cid.Cid, error) {
+	if index == nil {
+		index = nopLayerIndex{}
+	}
+
+	chunking := o.chunking
+	opts, err := chunking.options()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu     sync.Mutex
+		cidMap = make(map[v1.Hash]cid.Cid)
+	)
 
 	var g errgroup.Group
 	layers, err := img.Layers()
@@ -149,23 +405,58 @@ func writeLayers(ctx context.Context, api iface.CoreAPI, img v1.Image) (map[v1.H
 	for _, layer := range layers {
 		layer := layer
 		g.Go(func() error {
-			rc, err := layer.Compressed()
+			d, err := layer.Digest()
 			if err != nil {
 				return err
 			}
-			defer rc.Close()
 
-			d, err := layer.Digest()
+			size, err := layer.Size()
 			if err != nil {
 				return err
 			}
 
-			p, err := api.Unixfs().Add(ctx, files.NewReaderFile(rc), addOpts...)
-			if err != nil {
-				return err
+			if chunking.rawBlocks() && size <= MaxRawBlockSize {
+				c, added, err := writeRawLayer(ctx, api, layer, d)
+				if err != nil {
+					return err
+				}
+				o.reportLayer(d, size, c, added)
+
+				mu.Lock()
+				cidMap[d] = c
+				mu.Unlock()
+				return nil
+			}
+
+			c, ok := index.Get(ctx, d)
+			if ok {
+				ok, err = stored(ctx, api, c)
+				if err != nil {
+					return err
+				}
 			}
 
-			cidMap[d] = p.Cid()
+			if !ok {
+				rc, err := layer.Compressed()
+				if err != nil {
+					return err
+				}
+				defer rc.Close()
+
+				p, err := api.Unixfs().Add(ctx, files.NewReaderFile(o.trackLayer(rc, d, size)), opts...)
+				if err != nil {
+					return err
+				}
+				c = p.Cid()
+
+				// Failing to remember a layer only means it's added again next time
+				index.Put(ctx, d, c)
+			}
+			o.reportLayer(d, size, c, !ok)
+
+			mu.Lock()
+			cidMap[d] = c
+			mu.Unlock()
 			return nil
 		})
 	}
@@ -175,3 +466,35 @@ func writeLayers(ctx context.Context, api iface.CoreAPI, img v1.Image) (map[v1.H
 
 	return cidMap, nil
 }
+
+// writeRawLayer writes a layer of digest d as a single raw block, unless it's already pinned as one, reporting whether
+// it was written
+func writeRawLayer(ctx context.Context, api iface.CoreAPI, layer v1.Layer, d v1.Hash) (cid.Cid, bool, error) {
+	if c, ok := digestCid(digest.Digest(d.String())); ok {
+		if pinned, err := stored(ctx, api, c); err != nil {
+			return cid.Undef, false, err
+		} else if pinned {
+			return c, false, nil
+		}
+	}
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		return cid.Undef, false, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, MaxRawBlockSize+1))
+	if err != nil {
+		return cid.Undef, false, err
+	}
+
+	c, err := writeBlob(ctx, api, data)
+	return c, err == nil, err
+}
+
+// stored reports whether c is still pinned (and so wasn't collected since it was added)
+func stored(ctx context.Context, api iface.CoreAPI, c cid.Cid) (bool, error) {
+	_, pinned, err := api.Pin().IsPinned(ctx, path.IpfsPath(c), iopts.Pin.IsPinned.Recursive())
+	return pinned, err
+}
@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// ArtifactSuffixes are the suffixes of the tags cosign attaches signatures, attestations and sboms to an image with
+var ArtifactSuffixes = []string{"sig", "att", "sbom"}
+
+// ArtifactType is the artifact type cosign's artifacts of the given suffix are stored with
+func ArtifactType(suffix string) string {
+	return fmt.Sprintf("application/vnd.dev.cosign.artifact.%s.v1+json", suffix)
+}
+
+// ArtifactTag is cosign's tag of the artifacts of the given suffix attached to the image d
+func ArtifactTag(d v1.Hash, suffix string) string {
+	return fmt.Sprintf("%s-%s.%s", d.Algorithm, d.Hex, suffix)
+}
+
+// AddArtifacts adds the cosign artifacts attached to repo@d, stored as artifacts referring to the image already
+// stored at root so they're served as its referrers. The artifacts found are returned by the tag (cosign's tag of the
+// stored image) they should be mapped to within the image's repository, images without any return none.
+func AddArtifacts(ctx context.Context, api iface.CoreAPI, repo name.Repository, d v1.Hash, root path.Resolved, layers LayerIndex, opts ...remote.Option) (map[string]path.Resolved, error) {
+	subject, err := rootDescriptor(ctx, api, root)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", root, err)
+	}
+
+	added := make(map[string]path.Resolved)
+	for _, suffix := range ArtifactSuffixes {
+		tag := repo.Tag(ArtifactTag(d, suffix))
+
+		img, err := remote.Image(tag, opts...)
+		if err != nil {
+			if te, ok := err.(*transport.Error); ok && te.StatusCode == http.StatusNotFound {
+				continue
+			}
+			return added, fmt.Errorf("fetching %s: %v", tag, err)
+		}
+
+		m, cidMap, err := writeContent(ctx, api, img, layers, newAddOptions(nil))
+		if err != nil {
+			return added, fmt.Errorf("adding %s: %v", tag, err)
+		}
+
+		if m.ArtifactType == "" {
+			m.ArtifactType = ArtifactType(suffix)
+		}
+		m.Subject = &subject
+
+		p, err := writeImage(ctx, api, m, cidMap)
+		if err != nil {
+			return added, fmt.Errorf("adding %s: %v", tag, err)
+		}
+
+		added[ArtifactTag(subject.Digest, suffix)] = p
+	}
+	return added, nil
+}
+
+// rootDescriptor returns the descriptor of what root is served as, the index it points at
+func rootDescriptor(ctx context.Context, api iface.CoreAPI, root path.Resolved) (v1.Descriptor, error) {
+	i := ipfs{client: api, index: nopIndex{}}
+
+	f, err := i.open(ctx, root.Cid())
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	_, d, mt, size, err := i.step(f)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	h, err := v1.NewHash(d.String())
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return v1.Descriptor{MediaType: types.MediaType(mt), Digest: h, Size: size}, nil
+}
@@ -0,0 +1,300 @@
+package registry
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Authenticator gates access to the registry
+type Authenticator interface {
+	// Authorize returns an error unless the request may access scope, a nil scope only requires authentication
+	Authorize(r *http.Request, scope *Scope) error
+
+	// Challenge is the WWW-Authenticate header unauthorized requests are answered with
+	Challenge(scope *Scope) string
+}
+
+// Scope is the resource a request accesses, as named by the token spec
+// ref: https://docs.docker.com/registry/spec/auth/scope/
+type Scope struct {
+	Type    string
+	Name    string
+	Actions []string
+}
+
+func (s Scope) String() string {
+	return fmt.Sprintf("%s:%s:%s", s.Type, s.Name, strings.Join(s.Actions, ","))
+}
+
+// requestScope returns the scope a request accesses, nil for anything that isn't scoped to a repository, the catalog
+// or ripfs' own routes (such as the /v2/ version check)
+func requestScope(r *http.Request) *Scope {
+	// Transfers and inspections read a root as much as pulling it does, and the gateway serves any pinned cid
+	for _, prefix := range []string{"/_ripfs/v1/car/", "/_ripfs/v1/inspect/", "/ipfs/"} {
+		if c := strings.TrimPrefix(r.URL.Path, prefix); c != r.URL.Path {
+			return &Scope{Type: "repository", Name: ipfsSchemePrefix + "/" + c, Actions: []string{"pull"}}
+		}
+	}
+
+	if rest := strings.TrimPrefix(r.URL.Path, "/_ripfs/"); rest != r.URL.Path {
+		if rest == "v1/info" {
+			return &Scope{Type: "registry", Name: "ripfs", Actions: []string{"pull"}}
+		}
+		return &Scope{Type: "registry", Name: "ripfs", Actions: []string{"*"}}
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if rest == r.URL.Path || rest == "" {
+		return nil
+	}
+
+	if rest == "_catalog" {
+		return &Scope{Type: "registry", Name: "catalog", Actions: []string{"*"}}
+	}
+
+	actions := []string{"pull"}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		// Mirrored requests are served from the repository ns names, so that's the one they're scoped to
+		rest = mirroredPath(rest, r.URL.Query().Get("ns"))
+	case http.MethodDelete:
+		// Cancelling an upload is part of pushing, anything else deletes content
+		if !strings.Contains(rest, "/blobs/uploads") {
+			actions = []string{"delete"}
+			break
+		}
+		actions = append(actions, "push")
+	default:
+		actions = append(actions, "push")
+	}
+
+	for _, sep := range []string{"/manifests/", "/blobs/", "/tags/", "/referrers/"} {
+		if n := strings.LastIndex(rest, sep); n > 0 {
+			return &Scope{Type: "repository", Name: rest[:n], Actions: actions}
+		}
+	}
+	return nil
+}
+
+// authMiddleware rejects every request a doesn't authorize, challenging the client to authenticate
+func authMiddleware(a Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scope := requestScope(r)
+			if err := a.Authorize(r, scope); err != nil {
+				w.Header().Set("WWW-Authenticate", a.Challenge(scope))
+				writeError(w, err, http.StatusUnauthorized, ErrUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HtpasswdAuth authorizes every user of an htpasswd file (such as one mounted from a secret) with basic auth. Only
+// bcrypt entries (htpasswd -B) are supported.
+type HtpasswdAuth struct {
+	realm string
+	users map[string][]byte
+}
+
+// LoadHtpasswd reads the htpasswd file at path
+func LoadHtpasswd(path string, realm string) (*HtpasswdAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a, err := ParseHtpasswd(f, realm)
+	if err != nil {
+		return nil, fmt.Errorf("reading htpasswd %s: %v", path, err)
+	}
+	return a, nil
+}
+
+func ParseHtpasswd(r io.Reader, realm string) (*HtpasswdAuth, error) {
+	a := &HtpasswdAuth{realm: realm, users: make(map[string][]byte)}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid entry %q", line)
+		}
+
+		user, hash := line[:i], line[i+1:]
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("entry for %s isn't bcrypt: %v", user, err)
+		}
+		a.users[user] = []byte(hash)
+	}
+	return a, s.Err()
+}
+
+func (a *HtpasswdAuth) Authorize(r *http.Request, _ *Scope) error {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return regError(http.StatusUnauthorized, ErrUnauthorized, "authentication required")
+	}
+
+	hash, ok := a.users[user]
+	if !ok || bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil {
+		return regError(http.StatusUnauthorized, ErrUnauthorized, "invalid credentials")
+	}
+	return nil
+}
+
+func (a *HtpasswdAuth) Challenge(*Scope) string {
+	return fmt.Sprintf("Basic realm=%q", a.realm)
+}
+
+// TokenAuth authorizes bearer tokens (jwts) minted by a token service for the registry, clients are sent to the
+// service's realm to get one
+// ref: https://docs.docker.com/registry/spec/auth/token/
+type TokenAuth struct {
+	// Realm is the token service's endpoint
+	Realm string
+
+	// Service is the registry's name, which tokens must be issued for
+	Service string
+
+	// Issuer is who tokens must be issued by
+	Issuer string
+
+	// Keys are the issuer's public keys, tokens signed by any of them are accepted
+	Keys []crypto.PublicKey
+}
+
+// tokenClaims are the registry specific claims of a token
+type tokenClaims struct {
+	Access []struct {
+		Type    string   `json:"type"`
+		Name    string   `json:"name"`
+		Actions []string `json:"actions"`
+	} `json:"access"`
+}
+
+// LoadTokenKeys reads the issuer's certificates (or public keys) from the pem file at path
+func LoadTokenKeys(path string) ([]crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []crypto.PublicKey
+	for {
+		var b *pem.Block
+		if b, data = pem.Decode(data); b == nil {
+			break
+		}
+
+		switch b.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(b.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, cert.PublicKey)
+
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(b.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no certificates or public keys found in %s", path)
+	}
+	return keys, nil
+}
+
+func (a *TokenAuth) Authorize(r *http.Request, scope *Scope) error {
+	raw := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if raw == "" || raw == r.Header.Get("Authorization") {
+		return regError(http.StatusUnauthorized, ErrUnauthorized, "authentication required")
+	}
+
+	tok, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return regError(http.StatusUnauthorized, ErrUnauthorized, "invalid token: %v", err)
+	}
+
+	var (
+		claims jwt.Claims
+		access tokenClaims
+	)
+
+	verified := false
+	for _, key := range a.Keys {
+		if err := tok.Claims(key, &claims, &access); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return regError(http.StatusUnauthorized, ErrUnauthorized, "token isn't signed by a trusted key")
+	}
+
+	if err := claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:   a.Issuer,
+		Audience: jwt.Audience{a.Service},
+		Time:     time.Now(),
+	}, time.Minute); err != nil {
+		return regError(http.StatusUnauthorized, ErrUnauthorized, "invalid token: %v", err)
+	}
+
+	if scope == nil {
+		return nil
+	}
+
+	for _, want := range scope.Actions {
+		if !access.allows(scope.Type, scope.Name, want) {
+			return regError(http.StatusUnauthorized, ErrUnauthorized, "token doesn't grant %s", scope)
+		}
+	}
+	return nil
+}
+
+func (a *TokenAuth) Challenge(scope *Scope) string {
+	c := fmt.Sprintf("Bearer realm=%q,service=%q", a.Realm, a.Service)
+	if scope != nil {
+		c += fmt.Sprintf(",scope=%q", scope.String())
+	}
+	return c
+}
+
+func (c tokenClaims) allows(typ string, name string, action string) bool {
+	for _, a := range c.Access {
+		if a.Type != typ || a.Name != name {
+			continue
+		}
+
+		for _, granted := range a.Actions {
+			if granted == action || granted == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
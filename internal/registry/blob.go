@@ -0,0 +1,177 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/opencontainers/go-digest"
+)
+
+// requester is satisfied by http api clients, which expose commands (like cat from an offset, or repo gc) the
+// CoreAPI doesn't
+type requester interface {
+	Request(command string, args ...string) httpapi.RequestBuilder
+}
+
+// lazyFile is a file of known size that is only opened once it's first read, from wherever it was last seeked to.
+// Serving a HEAD or a range then never fetches more of it than is needed.
+type lazyFile struct {
+	ctx  context.Context
+	open func(ctx context.Context, offset int64) (io.ReadCloser, error)
+	size int64
+
+	at int64
+	rc io.ReadCloser
+}
+
+func (f *lazyFile) Read(p []byte) (int, error) {
+	if f.at >= f.size {
+		return 0, io.EOF
+	}
+
+	if f.rc == nil {
+		rc, err := f.open(f.ctx, f.at)
+		if err != nil {
+			return 0, err
+		}
+		f.rc = rc
+	}
+
+	n, err := f.rc.Read(p)
+	f.at += int64(n)
+	return n, err
+}
+
+func (f *lazyFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.at
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	// Whatever was opened is reopened from the new offset on the next read
+	if offset != f.at && f.rc != nil {
+		f.rc.Close()
+		f.rc = nil
+	}
+
+	f.at = offset
+	return offset, nil
+}
+
+func (f *lazyFile) Close() error {
+	if f.rc == nil {
+		return nil
+	}
+
+	err := f.rc.Close()
+	f.rc = nil
+	return err
+}
+
+// openAt opens the file at c from offset
+func (i ipfs) openAt(ctx context.Context, c cid.Cid, offset int64) (io.ReadCloser, error) {
+	if r, ok := i.client.(requester); ok {
+		resp, err := r.Request("cat", path.IpfsPath(c).String()).Option("offset", offset).Send(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.Error != nil {
+			resp.Cancel()
+			return nil, resp.Error
+		}
+		return resp.Output, nil
+	}
+
+	f, err := i.open(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+const (
+	// cacheImmutable is the Cache-Control of anything addressed by digest (or cid), which can never change
+	cacheImmutable = "public, max-age=31536000, immutable"
+
+	// cacheRevalidate is the Cache-Control of manifests referenced by tag, which caches must revalidate by ETag
+	cacheRevalidate = "no-cache"
+)
+
+// serveContent serves content (closing it once done) with support for range requests, so interrupted pulls can be
+// resumed. Content with a digest is served with it as its ETag, answering a matching If-None-Match with a 304, and is
+// cacheable forever unless a Cache-Control was already set.
+func serveContent(w http.ResponseWriter, r *http.Request, d digest.Digest, mediaType string, content io.ReadSeekCloser) {
+	defer content.Close()
+
+	if d != "" {
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.Header().Set("Etag", `"`+d.String()+`"`)
+
+		if w.Header().Get("Cache-Control") == "" {
+			w.Header().Set("Cache-Control", cacheImmutable)
+		}
+	}
+
+	// Blobs found by their digest alone don't know what they were referenced as
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// digestContent reads content (closing it) to compute its digest, for manifests that weren't referenced by one.
+// Manifests are small enough that this is cheaper than another walk to find the digest they were indexed at.
+func digestContent(content io.ReadSeekCloser, limit int64) (digest.Digest, io.ReadSeekCloser, error) {
+	defer content.Close()
+
+	data, err := readManifest(content, limit)
+	if err != nil {
+		return "", nil, err
+	}
+	return digest.FromBytes(data), nopSeekCloser{bytes.NewReader(data)}, nil
+}
+
+// readManifest reads all of content, refusing anything larger than limit (as a manifest could never be)
+func readManifest(content io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(content, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("manifest is larger than %d bytes", limit)
+	}
+	return data, nil
+}
+
+// nopSeekCloser is a ReadSeeker with nothing to close
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
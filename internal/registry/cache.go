@@ -0,0 +1,185 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/rs/zerolog"
+)
+
+// Invalidator is anything caching state that a mapping update may make stale
+type Invalidator interface {
+	Invalidate()
+}
+
+// CachingCidMapper caches another mapper's mappings for up to a ttl, or until invalidated
+type CachingCidMapper struct {
+	mapper ListingCidMapper
+	ttl    time.Duration
+	stale  time.Duration
+
+	mu         sync.Mutex
+	p          path.Path
+	mappings   map[string]string
+	expires    time.Time
+	refreshing bool
+
+	// invalidations counts the invalidations, so a refresh racing one doesn't cache the mappings it made stale
+	invalidations uint64
+}
+
+// CachingOption configures a CachingCidMapper
+type CachingOption func(m *CachingCidMapper)
+
+// WithStaleWhileRevalidate keeps serving expired mappings for up to stale past their ttl, while they're refreshed in
+// the background. Lookups then only wait on the mapper when nothing (or nothing recent enough) is cached.
+func WithStaleWhileRevalidate(stale time.Duration) CachingOption {
+	return func(m *CachingCidMapper) {
+		m.stale = stale
+	}
+}
+
+// cacheRefreshTimeout bounds a background refresh, which no lookup is waiting on to give up
+const cacheRefreshTimeout = time.Minute
+
+func NewCachingCidMapper(mapper ListingCidMapper, ttl time.Duration, opts ...CachingOption) *CachingCidMapper {
+	m := &CachingCidMapper{
+		mapper: mapper,
+		ttl:    ttl,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+func (m *CachingCidMapper) Resolve(ctx context.Context, reference string) (string, error) {
+	_, mappings, err := m.Mappings(ctx)
+	if err != nil {
+		return "", fmt.Errorf("retrieving mappings: %w", err)
+	}
+
+	return resolveMapping(mappings, reference)
+}
+
+func (m *CachingCidMapper) Mappings(ctx context.Context) (path.Path, map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.mappings != nil && now.Before(m.expires) {
+		return m.p, m.mappings, nil
+	}
+
+	if m.mappings != nil && now.Before(m.expires.Add(m.stale)) {
+		if !m.refreshing {
+			m.refreshing = true
+			go m.refresh(zerolog.Ctx(ctx).WithContext(context.Background()), m.invalidations)
+		}
+		return m.p, m.mappings, nil
+	}
+
+	p, mappings, err := m.mapper.Mappings(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m.p, m.mappings, m.expires = p, mappings, time.Now().Add(m.ttl)
+	return p, mappings, nil
+}
+
+// refresh fetches the mappings in the background, caching them unless they were invalidated in the meantime.
+// Should it fail, the stale mappings are kept until the next lookup tries again.
+func (m *CachingCidMapper) refresh(ctx context.Context, invalidations uint64) {
+	ctx, cancel := context.WithTimeout(ctx, cacheRefreshTimeout)
+	defer cancel()
+
+	p, mappings, err := m.mapper.Mappings(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.refreshing = false
+	if err != nil {
+		zerolog.Ctx(ctx).Debug().Msgf("refreshing mappings: %v", err)
+		return
+	}
+
+	if m.invalidations == invalidations {
+		m.p, m.mappings, m.expires = p, mappings, time.Now().Add(m.ttl)
+	}
+}
+
+// Invalidate drops the cached mappings, the next lookup fetches them again (past any cache of the mapper's own)
+func (m *CachingCidMapper) Invalidate() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.mappings = nil
+	m.invalidations++
+
+	if inv, ok := m.mapper.(Invalidator); ok {
+		inv.Invalidate()
+	}
+}
+
+// WatchInvalidations invalidates each of invs whenever a mapping update is announced on topic, until ctx is done.
+// Appliers are given the announced delta to apply instead.
+// The subscription is retried for as long as it fails (such as while the node is still starting). Refreshers are
+// refreshed whenever it's (re)established, seeding them ahead of their first lookup and catching up on whatever was
+// announced while nothing was subscribed.
+func WatchInvalidations(ctx context.Context, api iface.CoreAPI, topic string, invs ...Invalidator) {
+	l := zerolog.Ctx(ctx)
+
+	for {
+		sub, err := api.PubSub().Subscribe(ctx, topic)
+		if err != nil {
+			l.Debug().Msgf("subscribing to %s: %v", topic, err)
+		} else {
+			for _, inv := range invs {
+				if r, ok := inv.(Refresher); ok {
+					go func() {
+						if err := r.Refresh(ctx); err != nil {
+							l.Debug().Msgf("refreshing mappings: %v", err)
+						}
+					}()
+				}
+			}
+
+			for {
+				msg, err := sub.Next(ctx)
+				if err != nil {
+					break
+				}
+
+				var d MappingDelta
+				derr := json.Unmarshal(msg.Data(), &d)
+				if derr != nil || d.Path == "" {
+					derr = fmt.Errorf("invalid mapping delta")
+				}
+
+				l.Debug().Msgf("mappings updated to %s, invalidating caches", d.Path)
+				for _, inv := range invs {
+					if a, ok := inv.(Applier); ok && derr == nil {
+						a.Apply(ctx, d)
+					} else {
+						inv.Invalidate()
+					}
+				}
+			}
+			sub.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+			// Resubscribe, whatever was missed in the meantime still expires with the ttl
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/ipld/go-car"
+)
+
+const (
+	// TransferCar transfers an entire image as a single CAR stream
+	TransferCar = "car"
+
+	infoPath = "/_ripfs/v1/info"
+	carPath  = "/_ripfs/v1/car/"
+)
+
+// Info is served by every ripfs registry, letting clients negotiate how images can be transferred
+type Info struct {
+	Transfers []string `json:"transfers"`
+}
+
+// Exporter exports everything reachable from an image root
+type Exporter interface {
+	ExportCar(ctx context.Context, name string, w io.Writer) error
+}
+
+func (i *IpfsRegistry) buildInfoHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Info{Transfers: []string{TransferCar}})
+	}
+}
+
+func (i *IpfsRegistry) buildGetCarHandler(exp Exporter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.ipld.car")
+		if err := exp.ExportCar(r.Context(), chi.URLParam(r, "cid"), w); err != nil {
+			// Nothing has been written when the root can't be walked, otherwise the stream is simply cut short
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+	}
+}
+
+// ExportCar writes a CAR containing the root and every object it references. Images link their objects by ipfs://
+// urls rather than ipld links, so each object is exported as its own root.
+func (i ipfs) ExportCar(ctx context.Context, name string, w io.Writer) error {
+	rootc, err := cid.Decode(name)
+	if err != nil {
+		return err
+	}
+
+	entries, err := i.entries(ctx, rootc)
+	if err != nil {
+		return err
+	}
+
+	var cids []cid.Cid
+	for _, e := range entries {
+		cids = append(cids, e.Cid)
+	}
+	sort.Slice(cids, func(a, b int) bool { return cids[a].KeyString() < cids[b].KeyString() })
+
+	return car.WriteCar(ctx, i.client.Dag(), append([]cid.Cid{rootc}, cids...), w)
+}
+
+// ExportCar writes a CAR of the image stored at root, and everything it references, to w
+func ExportCar(ctx context.Context, api iface.CoreAPI, root cid.Cid, w io.Writer) error {
+	return ipfs{client: api, index: nopIndex{}}.ExportCar(ctx, root.String(), w)
+}
+
+// ImportCar adds every block within a CAR to api and pins each of its roots, the first root is returned
+func ImportCar(ctx context.Context, api iface.CoreAPI, r io.Reader) (path.Resolved, error) {
+	cr, err := car.NewCarReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cr.Header.Roots) == 0 {
+		return nil, fmt.Errorf("car has no roots")
+	}
+
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		nd, err := format.Decode(blk)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := api.Dag().Add(ctx, nd); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range cr.Header.Roots {
+		if err := api.Pin().Add(ctx, path.IpfsPath(c)); err != nil {
+			return nil, fmt.Errorf("pinning %s: %v", c, err)
+		}
+	}
+
+	return path.IpfsPath(cr.Header.Roots[0]), nil
+}
+
+// ProbeRipfs returns the transfer info of reg, or nil if reg isn't a ripfs registry
+func ProbeRipfs(ctx context.Context, reg name.Registry, t http.RoundTripper) (*Info, error) {
+	resp, err := ripfsGet(ctx, reg, t, infoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+
+	var info Info
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		// Anything else is free to serve whatever it likes here
+		return nil, nil
+	}
+	return &info, nil
+}
+
+// ImportRemoteCar transfers root and everything it references from the ripfs registry reg into api
+func ImportRemoteCar(ctx context.Context, api iface.CoreAPI, reg name.Registry, root cid.Cid, t http.RoundTripper) (path.Resolved, error) {
+	resp, err := ripfsGet(ctx, reg, t, carPath+root.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching car for %s from %s: %s", root, reg.Name(), resp.Status)
+	}
+
+	return ImportCar(ctx, api, resp.Body)
+}
+
+func ripfsGet(ctx context.Context, reg name.Registry, t http.RoundTripper, p string) (*http.Response, error) {
+	u := url.URL{
+		Scheme: reg.Scheme(),
+		Host:   reg.RegistryStr(),
+		Path:   p,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return (&http.Client{Transport: t}).Do(req)
+}
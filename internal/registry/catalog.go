@@ -0,0 +1,148 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// RepositoryName is the name a mapped reference's repository is served as. Docker Hub images keep their familiar
+// names (library/nginx), everything else is prefixed with its original registry's host (ghcr.io/org/app).
+func RepositoryName(ref name.Reference) string {
+	repo := ref.Context()
+	if repo.RegistryStr() == name.DefaultRegistry {
+		return repo.RepositoryStr()
+	}
+
+	host := repo.RegistryStr()
+	if i := strings.Index(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	return host + "/" + repo.RepositoryStr()
+}
+
+// tags returns the served repository names and their tags for every mapped reference
+func tags(mappings map[string]string) map[string][]string {
+	repos := make(map[string][]string)
+	for m := range mappings {
+		ref, err := name.ParseReference(m)
+		if err != nil {
+			continue
+		}
+
+		rn := RepositoryName(ref)
+		if t, ok := ref.(name.Tag); ok {
+			repos[rn] = append(repos[rn], t.TagStr())
+		} else if _, ok := repos[rn]; !ok {
+			repos[rn] = nil
+		}
+	}
+	return repos
+}
+
+// paginate returns up to n sorted items following last (n <= 0 returns everything), and whether more remain
+func paginate(items []string, last string, n int) ([]string, bool) {
+	sort.Strings(items)
+
+	start := 0
+	if last != "" {
+		start = sort.Search(len(items), func(i int) bool { return items[i] > last })
+	}
+	items = items[start:]
+
+	if n <= 0 || n >= len(items) {
+		return items, false
+	}
+	return items[:n], true
+}
+
+func (i *IpfsRegistry) buildCatalogHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var repos []string
+		if i.mapper != nil {
+			_, mappings, err := i.mapper.Mappings(r.Context())
+			if err != nil {
+				writeError(w, err, http.StatusServiceUnavailable, ErrUnavailable)
+				return
+			}
+
+			for rn := range tags(mappings) {
+				repos = append(repos, rn)
+			}
+		}
+
+		page, ok := i.page(w, r, repos)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Repositories []string `json:"repositories"`
+		}{Repositories: page})
+	}
+}
+
+func (i *IpfsRegistry) serveTags(w http.ResponseWriter, r *http.Request, repo string) {
+	if i.mapper == nil {
+		regError(http.StatusNotFound, ErrNameUnknown, "repository %s unknown", repo).write(w)
+		return
+	}
+
+	_, mappings, err := i.mapper.Mappings(r.Context())
+	if err != nil {
+		writeError(w, err, http.StatusServiceUnavailable, ErrUnavailable)
+		return
+	}
+
+	ts, ok := tags(mappings)[repo]
+	if !ok {
+		regError(http.StatusNotFound, ErrNameUnknown, "repository %s unknown", repo).write(w)
+		return
+	}
+
+	page, ok := i.page(w, r, ts)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{Name: repo, Tags: page})
+}
+
+// page paginates items per the distribution spec's n and last parameters, linking to the next page when one exists
+func (i *IpfsRegistry) page(w http.ResponseWriter, r *http.Request, items []string) ([]string, bool) {
+	q := r.URL.Query()
+
+	n := 0
+	if s := q.Get("n"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 0 {
+			regError(http.StatusBadRequest, ErrPaginationInvalid, "invalid n %s", s).write(w)
+			return nil, false
+		}
+		n = v
+	}
+
+	page, more := paginate(items, q.Get("last"), n)
+	if page == nil {
+		page = []string{}
+	}
+
+	if more {
+		next := url.Values{}
+		next.Set("n", strconv.Itoa(n))
+		next.Set("last", page[len(page)-1])
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+	return page, true
+}
@@ -0,0 +1,68 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+
+	chunk "github.com/ipfs/go-ipfs-chunker"
+	iopts "github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/multiformats/go-multihash"
+)
+
+// Chunking configures how layers are split into blocks as they're added. It decides the cid a layer is stored at,
+// and so which blocks layers (such as those of successive versions of an image) share.
+type Chunking struct {
+	// Chunker is the unixfs chunker, such as size-1048576, rabin-262144-524288-1048576 or buzhash. Empty uses ipfs'
+	// default (size-262144).
+	Chunker string
+
+	// RawLeaves stores a layer's leaves as raw blocks, rather than wrapped in unixfs nodes
+	RawLeaves bool
+
+	// Hash is the multihash function blocks are hashed with, such as sha2-256 or blake2b-256. Empty uses sha2-256.
+	Hash string
+}
+
+// DefaultChunking is how layers are added unless WithChunking says otherwise
+var DefaultChunking = Chunking{RawLeaves: true}
+
+// Validate returns an error if the chunker or hash function isn't known
+func (c Chunking) Validate() error {
+	_, err := c.options()
+	return err
+}
+
+// options returns the add options of layers chunked with c
+func (c Chunking) options() ([]iopts.UnixfsAddOption, error) {
+	opts := append([]iopts.UnixfsAddOption{iopts.Unixfs.RawLeaves(c.RawLeaves)}, addOpts...)
+
+	if c.Chunker != "" {
+		if _, err := chunk.FromString(bytes.NewReader(nil), c.Chunker); err != nil {
+			return nil, fmt.Errorf("invalid chunker %s: %v", c.Chunker, err)
+		}
+		opts = append(opts, iopts.Unixfs.Chunker(c.Chunker))
+	}
+
+	if c.Hash != "" {
+		code, ok := multihash.Names[c.Hash]
+		if !ok {
+			return nil, fmt.Errorf("unknown hash function %s", c.Hash)
+		}
+		opts = append(opts, iopts.Unixfs.Hash(code))
+	}
+	return opts, nil
+}
+
+// rawBlocks reports whether layers no larger than MaxRawBlockSize are written as a single raw block, found by their
+// digest, which only chunking with ipfs' defaults does
+func (c Chunking) rawBlocks() bool {
+	return c.Chunker == "" && c.RawLeaves && (c.Hash == "" || c.Hash == "sha2-256")
+}
+
+// WithChunking adds layers chunked with c, rather than DefaultChunking. Layers already stored (and remembered by the
+// layer index) are kept as they were chunked then.
+func WithChunking(c Chunking) AddOption {
+	return func(o *addOptions) {
+		o.chunking = c
+	}
+}
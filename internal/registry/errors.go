@@ -0,0 +1,108 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorCode is one of the distribution spec's error codes
+// ref: https://github.com/opencontainers/distribution-spec/blob/v1.0.1/spec.md#error-codes
+type ErrorCode string
+
+const (
+	ErrBlobUnknown         ErrorCode = "BLOB_UNKNOWN"
+	ErrBlobUploadInvalid   ErrorCode = "BLOB_UPLOAD_INVALID"
+	ErrBlobUploadUnknown   ErrorCode = "BLOB_UPLOAD_UNKNOWN"
+	ErrDigestInvalid       ErrorCode = "DIGEST_INVALID"
+	ErrManifestBlobUnknown ErrorCode = "MANIFEST_BLOB_UNKNOWN"
+	ErrManifestInvalid     ErrorCode = "MANIFEST_INVALID"
+	ErrManifestUnknown     ErrorCode = "MANIFEST_UNKNOWN"
+	ErrNameInvalid         ErrorCode = "NAME_INVALID"
+	ErrNameUnknown         ErrorCode = "NAME_UNKNOWN"
+	ErrSizeInvalid         ErrorCode = "SIZE_INVALID"
+	ErrUnauthorized        ErrorCode = "UNAUTHORIZED"
+	ErrDenied              ErrorCode = "DENIED"
+	ErrUnsupported         ErrorCode = "UNSUPPORTED"
+	ErrTooManyRequests     ErrorCode = "TOOMANYREQUESTS"
+
+	// Not part of the spec, but understood by most clients
+	ErrPaginationInvalid ErrorCode = "PAGINATION_NUMBER_INVALID"
+	ErrRangeInvalid      ErrorCode = "RANGE_INVALID"
+	ErrUnavailable       ErrorCode = "UNAVAILABLE"
+	ErrUnknown           ErrorCode = "UNKNOWN"
+)
+
+var (
+	// ErrNotFound is returned for references, digests and cids that aren't known to ripfs
+	ErrNotFound = errors.New("not found")
+
+	// ErrNotPeered is returned when nothing can be resolved (over ipns) because the swarm has no peers yet
+	ErrNotPeered = errors.New("not peered with the swarm")
+
+	// ErrInvalidReference is returned for references (and cids) that can't be parsed, or don't point at a ripfs image
+	ErrInvalidReference = errors.New("invalid reference")
+
+	// ErrUnverified is returned for references whose mapping isn't signed by any of the trusted mapping keys
+	ErrUnverified = errors.New("mapping not verified")
+)
+
+// Error is a registry error, served with its status as the spec's json error body
+type Error struct {
+	Status  int
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Is matches the sentinel errors to the codes they're served as
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Code == ErrBlobUnknown || e.Code == ErrManifestUnknown || e.Code == ErrNameUnknown
+	case ErrInvalidReference:
+		return e.Code == ErrNameInvalid || e.Code == ErrDigestInvalid
+	}
+	return false
+}
+
+func regError(status int, code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// writeError serves err, anything that isn't already an *Error is served with status and fallback (and err as its
+// message), unless it's one of the sentinel errors
+func writeError(w http.ResponseWriter, err error, status int, fallback ErrorCode) {
+	var re *Error
+	if !errors.As(err, &re) {
+		switch {
+		case errors.Is(err, ErrNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ErrInvalidReference):
+			status, fallback = http.StatusBadRequest, ErrNameInvalid
+		case errors.Is(err, ErrNotPeered):
+			status, fallback = http.StatusServiceUnavailable, ErrUnavailable
+		case errors.Is(err, ErrUnverified):
+			status, fallback = http.StatusForbidden, ErrDenied
+		}
+		re = regError(status, fallback, "%v", err)
+	}
+	re.write(w)
+}
+
+func (e *Error) write(w http.ResponseWriter) {
+	type detail struct {
+		Code    ErrorCode `json:"code"`
+		Message string    `json:"message"`
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(struct {
+		Errors []detail `json:"errors"`
+	}{Errors: []detail{{Code: e.Code, Message: e.Message}}})
+}
@@ -0,0 +1,167 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/opencontainers/go-digest"
+)
+
+// StoredIndex returns the index stored at root, read straight from ipfs rather than through a registry, such as to
+// export it. Single images are stored as an index of one image too. Nothing but manifests is read until an image's
+// layers are.
+func StoredIndex(ctx context.Context, api iface.CoreAPI, root cid.Cid) (v1.ImageIndex, error) {
+	// Every blob read walks the root's entries, remembered so that isn't repeated for each layer
+	i := ipfs{client: api, index: NewMemoryIndex(1, nil)}
+
+	content, mediaType, err := i.ReadManifest(ctx, root.String(), "latest")
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	raw, err := readManifest(content, DefaultMaxManifestSize)
+	if err != nil {
+		return nil, err
+	}
+
+	switch types.MediaType(mediaType) {
+	case types.OCIImageIndex, types.DockerManifestList:
+	default:
+		return nil, fmt.Errorf("%s is a %s, not an index", root, mediaType)
+	}
+
+	return &storedIndex{ctx: ctx, i: i, root: root.String(), raw: raw, mediaType: types.MediaType(mediaType)}, nil
+}
+
+// readStored reads the manifest (or config) d stored within root
+func (i ipfs) readStored(ctx context.Context, root string, d v1.Hash) ([]byte, error) {
+	content, _, err := i.ReadBlob(ctx, root, digest.Digest(d.String()))
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	return readManifest(content, DefaultMaxManifestSize)
+}
+
+type storedIndex struct {
+	ctx       context.Context
+	i         ipfs
+	root      string
+	raw       []byte
+	mediaType types.MediaType
+}
+
+func (s *storedIndex) MediaType() (types.MediaType, error) {
+	return s.mediaType, nil
+}
+
+func (s *storedIndex) Digest() (v1.Hash, error) {
+	return partial.Digest(s)
+}
+
+func (s *storedIndex) Size() (int64, error) {
+	return int64(len(s.raw)), nil
+}
+
+func (s *storedIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return v1.ParseIndexManifest(bytes.NewReader(s.raw))
+}
+
+func (s *storedIndex) RawManifest() ([]byte, error) {
+	return s.raw, nil
+}
+
+func (s *storedIndex) Image(h v1.Hash) (v1.Image, error) {
+	im, err := s.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, desc := range im.Manifests {
+		if desc.Digest != h {
+			continue
+		}
+
+		raw, err := s.i.readStored(s.ctx, s.root, h)
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := v1.ParseManifest(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+
+		return partial.CompressedToImage(&storedImage{storedIndex: s, raw: raw, manifest: m, mediaType: desc.MediaType})
+	}
+	return nil, fmt.Errorf("image %s not found within %s", h, s.root)
+}
+
+func (s *storedIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	return nil, fmt.Errorf("nested indexes aren't stored")
+}
+
+type storedImage struct {
+	*storedIndex
+
+	raw       []byte
+	manifest  *v1.Manifest
+	mediaType types.MediaType
+}
+
+func (s *storedImage) MediaType() (types.MediaType, error) {
+	return s.mediaType, nil
+}
+
+func (s *storedImage) RawManifest() ([]byte, error) {
+	return s.raw, nil
+}
+
+func (s *storedImage) RawConfigFile() ([]byte, error) {
+	return s.i.readStored(s.ctx, s.root, s.manifest.Config.Digest)
+}
+
+func (s *storedImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	if h == s.manifest.Config.Digest {
+		return &storedLayer{storedIndex: s.storedIndex, desc: s.manifest.Config}, nil
+	}
+
+	for _, desc := range s.manifest.Layers {
+		if desc.Digest == h {
+			return &storedLayer{storedIndex: s.storedIndex, desc: desc}, nil
+		}
+	}
+	return nil, fmt.Errorf("layer %s not found", h)
+}
+
+type storedLayer struct {
+	*storedIndex
+
+	desc v1.Descriptor
+}
+
+func (s *storedLayer) Digest() (v1.Hash, error) {
+	return s.desc.Digest, nil
+}
+
+func (s *storedLayer) Size() (int64, error) {
+	return s.desc.Size, nil
+}
+
+func (s *storedLayer) MediaType() (types.MediaType, error) {
+	return s.desc.MediaType, nil
+}
+
+func (s *storedLayer) Compressed() (io.ReadCloser, error) {
+	content, _, err := s.i.ReadBlob(s.ctx, s.root, digest.Digest(s.desc.Digest.String()))
+	return content, err
+}
@@ -0,0 +1,50 @@
+package registry
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ipfs/go-cid"
+	iopts "github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// buildGatewayHandler serves the raw content of a cid at /ipfs/<cid>, for tooling (such as the stargz snapshotter's
+// ipfs mode, or curl) that reads content by cid rather than through the distribution api. Unlike a full gateway, it's
+// read only and only serves cids that are pinned, so it never fetches anything from the swarm on a client's behalf.
+func (i *IpfsRegistry) buildGatewayHandler(rdr ipfs) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		c, err := cid.Decode(chi.URLParam(r, "cid"))
+		if err != nil {
+			http.Error(w, "invalid cid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, pinned, err := rdr.client.Pin().IsPinned(ctx, path.IpfsPath(c), iopts.Pin.IsPinned.Recursive())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		if !pinned {
+			http.Error(w, c.String()+" is not stored by this registry", http.StatusNotFound)
+			return
+		}
+
+		f, err := rdr.open(ctx, c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Etag", `"`+c.String()+`"`)
+		w.Header().Set("Cache-Control", cacheImmutable)
+		w.Header().Set("X-Ipfs-Path", path.IpfsPath(c).String())
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, f)
+	}
+}
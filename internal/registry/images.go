@@ -0,0 +1,345 @@
+package registry
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/joshrwolf/ripfs/api/v1alpha1"
+	"github.com/joshrwolf/ripfs/internal/consts"
+)
+
+// ImageCidMapper resolves references from the cluster's Image resources. Read from an informer's cache, resolving
+// never waits on the swarm (or ipns), and is current as soon as the cache is, so there's nothing to cache (or refresh)
+// in front of it. Only the keys verifying them are fetched, which CachingMappingKeys caches. Applying the deltas announced over pubsub
+// makes them current sooner still, ahead of the cache.
+type ImageCidMapper struct {
+	reader    client.Reader
+	namespace string
+	keys      MappingKeys
+
+	// pending are the mappings of the deltas applied ahead of the cache, by reference, until it records them
+	mu      sync.Mutex
+	pending map[string]pendingMapping
+}
+
+// pendingMapping is a mapping applied from a delta, nil when the delta removed it
+type pendingMapping struct {
+	image      *v1alpha1.Image
+	generation int64
+	applied    time.Time
+}
+
+// pendingTimeout bounds how long an applied mapping is held without the cache recording it, in case it never does
+// (such as when its Image was never recorded), after which the cache is taken as is
+const pendingTimeout = time.Minute
+
+var _ Applier = (*ImageCidMapper)(nil)
+
+// ImageOption configures an ImageCidMapper
+type ImageOption func(m *ImageCidMapper)
+
+// WithMappingKeys only resolves (and lists) Images whose mapping is signed by one of keys, so nothing able to create
+// Images (or publish mappings) can map a reference to content of its own without the signing key
+func WithMappingKeys(keys MappingKeys) ImageOption {
+	return func(m *ImageCidMapper) {
+		m.keys = keys
+	}
+}
+
+func NewImageCidMapper(reader client.Reader, namespace string, opts ...ImageOption) *ImageCidMapper {
+	m := &ImageCidMapper{
+		reader:    reader,
+		namespace: namespace,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+func (m *ImageCidMapper) Resolve(ctx context.Context, reference string) (string, error) {
+	ref, err := name.ParseReference(reference)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidReference, err)
+	}
+
+	img := &v1alpha1.Image{}
+	err = m.reader.Get(ctx, types.NamespacedName{Name: v1alpha1.ImageName(ref.Name()), Namespace: m.namespace}, img)
+	if errors.IsNotFound(err) || (err == nil && img.Spec.Reference != ref.Name()) {
+		img = nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if img = m.current(ref.Name(), img); img == nil {
+		return "", fmt.Errorf("%w: no cid mapped for %s", ErrNotFound, ref.Name())
+	}
+
+	if m.keys != nil {
+		keys, err := m.keys(ctx)
+		if err != nil {
+			return "", err
+		}
+		if err := VerifyMapping(keys, img.Spec.Reference, img.Spec.Root, img.Spec.Signature); err != nil {
+			return "", err
+		}
+	}
+
+	return rootPath(img.Spec.Root), nil
+}
+
+// Mappings returns every reference => root mapping of the Images, leaving out those that aren't verified. They're never
+// published as a whole, so there's no path of them.
+func (m *ImageCidMapper) Mappings(ctx context.Context) (path.Path, map[string]string, error) {
+	imgs := &v1alpha1.ImageList{}
+	if err := m.reader.List(ctx, imgs, client.InNamespace(m.namespace)); err != nil {
+		return nil, nil, err
+	}
+
+	var keys []crypto.PublicKey
+	if m.keys != nil {
+		var err error
+		if keys, err = m.keys(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	current := make(map[string]*v1alpha1.Image, len(imgs.Items))
+	for i := range imgs.Items {
+		current[imgs.Items[i].Spec.Reference] = &imgs.Items[i]
+	}
+
+	m.mu.Lock()
+	for ref := range m.pending {
+		if _, ok := current[ref]; !ok {
+			current[ref] = nil
+		}
+	}
+	m.mu.Unlock()
+
+	mappings := make(map[string]string, len(current))
+	for ref, img := range current {
+		img = m.current(ref, img)
+		if img == nil || (m.keys != nil && VerifyMapping(keys, img.Spec.Reference, img.Spec.Root, img.Spec.Signature) != nil) {
+			continue
+		}
+		mappings[img.Spec.Reference] = rootPath(img.Spec.Root)
+	}
+	return nil, mappings, nil
+}
+
+// Apply holds the mappings d sets and removes ahead of the cache, until it records their Images. Deltas without a
+// generation can't be ordered against the Images, so they're left to the cache.
+func (m *ImageCidMapper) Apply(ctx context.Context, d MappingDelta) {
+	if d.Generation == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.pending == nil {
+		m.pending = make(map[string]pendingMapping)
+	}
+
+	now := time.Now()
+	hold := func(ref string, img *v1alpha1.Image) {
+		if p, ok := m.pending[ref]; ok && p.generation > d.Generation {
+			return
+		}
+		m.pending[ref] = pendingMapping{image: img, generation: d.Generation, applied: now}
+	}
+
+	for ref, v := range d.Set {
+		hold(ref, &v1alpha1.Image{Spec: v1alpha1.ImageSpec{Reference: ref, Root: strings.TrimPrefix(v, "/ipfs/"), Signature: d.Signatures[ref]}})
+	}
+	for _, ref := range d.Removed {
+		hold(ref, nil)
+	}
+}
+
+// Invalidate drops the mappings held ahead of the cache
+func (m *ImageCidMapper) Invalidate() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pending = nil
+}
+
+// current returns the Image ref is mapped by, either img as cached (nil when there's none) or the mapping applied
+// since, should the cache not have recorded it yet
+func (m *ImageCidMapper) current(ref string, img *v1alpha1.Image) *v1alpha1.Image {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.pending[ref]
+	if !ok {
+		return img
+	}
+
+	var generation int64
+	if img != nil {
+		generation = imageGeneration(img)
+	}
+	if generation >= p.generation || time.Since(p.applied) > pendingTimeout {
+		delete(m.pending, ref)
+		return img
+	}
+	return p.image
+}
+
+// AnnotationGeneration is the generation of the mappings an Image was last recorded from, as counted by the mapper
+// secret. Images only ever move forward, so a delta applied late (or a sync of mappings since replaced) never reverts
+// one committed after it.
+const AnnotationGeneration = consts.Name + ".dev/generation"
+
+// errSuperseded is returned recording an Image already recorded by a later generation
+var errSuperseded = fmt.Errorf("recorded by a later generation")
+
+// ApplyImages records the delta d in the Images of namespace, creating (or updating) an Image for every reference it
+// sets (along with its signature) and deleting those of every reference it removes. Images recorded by a later
+// generation than d's are left alone.
+func ApplyImages(ctx context.Context, c client.Client, namespace string, d MappingDelta) error {
+	for ref, v := range d.Set {
+		if err := setImage(ctx, c, namespace, ref, v, d.Signatures[ref], d.Generation); err != nil {
+			return fmt.Errorf("mapping %s: %v", ref, err)
+		}
+	}
+
+	for _, ref := range d.Removed {
+		if err := deleteImage(ctx, c, namespace, ref, d.Generation); err != nil {
+			return fmt.Errorf("unmapping %s: %v", ref, err)
+		}
+	}
+	return nil
+}
+
+// SyncImages reconciles the Images of namespace with mappings, as committed at generation. Images are recorded for
+// every reference mapped without one (or mapped to another root), signed by signer unless it's nil, and deleted for
+// every reference no longer mapped. Images recorded by a later generation are left alone, as are the signatures of
+// those already matching.
+func SyncImages(ctx context.Context, c client.Client, namespace string, mappings map[string]string, generation int64, signer crypto.Signer) error {
+	imgs := &v1alpha1.ImageList{}
+	if err := c.List(ctx, imgs, client.InNamespace(namespace)); err != nil {
+		return err
+	}
+
+	recorded := make(map[string]string, len(imgs.Items))
+	for _, img := range imgs.Items {
+		if _, ok := mappings[img.Spec.Reference]; ok {
+			recorded[img.Spec.Reference] = img.Spec.Root
+			continue
+		}
+
+		if err := deleteImage(ctx, c, namespace, img.Spec.Reference, generation); err != nil {
+			return fmt.Errorf("unmapping %s: %v", img.Spec.Reference, err)
+		}
+	}
+
+	for ref, v := range mappings {
+		if root, ok := recorded[ref]; ok && root == strings.TrimPrefix(v, "/ipfs/") {
+			continue
+		}
+
+		var sig string
+		if signer != nil {
+			var err error
+			if sig, err = SignMapping(signer, ref, v); err != nil {
+				return fmt.Errorf("signing %s: %v", ref, err)
+			}
+		}
+
+		if err := setImage(ctx, c, namespace, ref, v, sig, generation); err != nil {
+			return fmt.Errorf("mapping %s: %v", ref, err)
+		}
+	}
+	return nil
+}
+
+func setImage(ctx context.Context, c client.Client, namespace string, ref string, root string, sig string, generation int64) error {
+	// Creating an Image another sync created meanwhile conflicts just the same
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}, func() error {
+		img := &v1alpha1.Image{ObjectMeta: metav1.ObjectMeta{Name: v1alpha1.ImageName(ref), Namespace: namespace}}
+
+		_, err := controllerutil.CreateOrUpdate(ctx, c, img, func() error {
+			if imageGeneration(img) > generation {
+				return errSuperseded
+			}
+
+			root := strings.TrimPrefix(root, "/ipfs/")
+			if img.Annotations == nil {
+				img.Annotations = make(map[string]string)
+			}
+
+			// When it was added is only stamped as the mapping changes, the root itself stays content addressed
+			if img.Spec.Root != root || img.Annotations[AnnotationAdded] == "" {
+				img.Annotations[AnnotationAdded] = time.Now().UTC().Format(time.RFC3339)
+			}
+			if generation > 0 {
+				img.Annotations[AnnotationGeneration] = strconv.FormatInt(generation, 10)
+			}
+
+			// A signature of the same mapping stays valid, so it isn't dropped by recording the mapping unsigned
+			if sig == "" && img.Spec.Reference == ref && img.Spec.Root == root {
+				sig = img.Spec.Signature
+			}
+
+			img.Spec = v1alpha1.ImageSpec{Reference: ref, Root: root, Signature: sig}
+			return nil
+		})
+		return err
+	})
+	if err == errSuperseded {
+		return nil
+	}
+	return err
+}
+
+func deleteImage(ctx context.Context, c client.Client, namespace string, ref string, generation int64) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		img := &v1alpha1.Image{}
+		if err := c.Get(ctx, types.NamespacedName{Name: v1alpha1.ImageName(ref), Namespace: namespace}, img); errors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if imageGeneration(img) > generation {
+			return nil
+		}
+
+		// Only the Image as it was checked is deleted, conflicting with one recorded since
+		err := c.Delete(ctx, img, client.Preconditions{UID: &img.UID, ResourceVersion: &img.ResourceVersion})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// imageGeneration returns the generation img was last recorded from, 0 for Images recorded before they were counted
+func imageGeneration(img *v1alpha1.Image) int64 {
+	generation, _ := strconv.ParseInt(img.Annotations[AnnotationGeneration], 10, 64)
+	return generation
+}
+
+// rootPath returns the path of root as it's mapped, whether it's a bare cid (as Images hold them) or a path already
+func rootPath(root string) string {
+	return "/ipfs/" + strings.TrimPrefix(root, "/ipfs/")
+}
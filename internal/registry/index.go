@@ -0,0 +1,244 @@
+package registry
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/ipfs/go-cid"
+	"github.com/opencontainers/go-digest"
+)
+
+// IndexEntry is a single object discovered while walking an image's root
+type IndexEntry struct {
+	Cid       cid.Cid `json:"cid"`
+	MediaType string  `json:"mediaType"`
+	Size      int64   `json:"size,omitempty"`
+}
+
+// Entries maps every digest reachable from an image's root to where it lives in ipfs
+type Entries map[digest.Digest]IndexEntry
+
+// Index is anything that can store and retrieve the digest => cid mappings of an image root
+type Index interface {
+	Get(ctx context.Context, root cid.Cid) (Entries, bool)
+	Put(ctx context.Context, root cid.Cid, entries Entries) error
+}
+
+type nopIndex struct{}
+
+func (nopIndex) Get(context.Context, cid.Cid) (Entries, bool) { return nil, false }
+
+func (nopIndex) Put(context.Context, cid.Cid, Entries) error { return nil }
+
+// FileIndex persists each image root's entries as a json document within a local directory
+type FileIndex struct {
+	dir string
+	mu  sync.RWMutex
+}
+
+// NewFileIndex returns a FileIndex rooted at dir, creating it if needed
+func NewFileIndex(dir string) (*FileIndex, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &FileIndex{dir: dir}, nil
+}
+
+func (i *FileIndex) Get(_ context.Context, root cid.Cid) (Entries, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	data, err := os.ReadFile(i.path(root))
+	if err != nil {
+		return nil, false
+	}
+
+	var e Entries
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, false
+	}
+	return e, true
+}
+
+func (i *FileIndex) Put(_ context.Context, root cid.Cid, entries Entries) error {
+	if !root.Defined() {
+		return errors.New("cannot index an undefined root cid")
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// Write then rename so a crash mid write never leaves a truncated entry behind
+	tmp, err := os.CreateTemp(i.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), i.path(root))
+}
+
+func (i *FileIndex) path(root cid.Cid) string {
+	return filepath.Join(i.dir, root.String()+".json")
+}
+
+// DefaultIndexCacheSize is the number of image roots whose entries are kept in memory by default
+const DefaultIndexCacheSize = 256
+
+// MemoryIndex keeps the entries of the most recently used image roots in memory, in front of another (typically on
+// disk) index. Pulling an image's layers then never decodes its entries more than once.
+type MemoryIndex struct {
+	next Index
+	size int
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[cid.Cid]*list.Element
+}
+
+type memoryIndexItem struct {
+	root    cid.Cid
+	entries Entries
+}
+
+// NewMemoryIndex returns a MemoryIndex of at most size roots in front of next, which may be nil
+func NewMemoryIndex(size int, next Index) *MemoryIndex {
+	if next == nil {
+		next = nopIndex{}
+	}
+
+	return &MemoryIndex{
+		next:  next,
+		size:  size,
+		ll:    list.New(),
+		items: make(map[cid.Cid]*list.Element),
+	}
+}
+
+func (i *MemoryIndex) Get(ctx context.Context, root cid.Cid) (Entries, bool) {
+	i.mu.Lock()
+	if el, ok := i.items[root]; ok {
+		i.ll.MoveToFront(el)
+		i.mu.Unlock()
+		return el.Value.(*memoryIndexItem).entries, true
+	}
+	i.mu.Unlock()
+
+	e, ok := i.next.Get(ctx, root)
+	if ok {
+		i.add(root, e)
+	}
+	return e, ok
+}
+
+func (i *MemoryIndex) Put(ctx context.Context, root cid.Cid, entries Entries) error {
+	i.add(root, entries)
+	return i.next.Put(ctx, root, entries)
+}
+
+func (i *MemoryIndex) add(root cid.Cid, entries Entries) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if el, ok := i.items[root]; ok {
+		el.Value.(*memoryIndexItem).entries = entries
+		i.ll.MoveToFront(el)
+		return
+	}
+
+	i.items[root] = i.ll.PushFront(&memoryIndexItem{root: root, entries: entries})
+
+	for i.ll.Len() > i.size {
+		oldest := i.ll.Back()
+		i.ll.Remove(oldest)
+		delete(i.items, oldest.Value.(*memoryIndexItem).root)
+	}
+}
+
+// LayerIndex remembers the cid each layer (or config) was added as, so adding it again can be skipped while it's
+// still stored
+type LayerIndex interface {
+	Get(ctx context.Context, d v1.Hash) (cid.Cid, bool)
+	Put(ctx context.Context, d v1.Hash, c cid.Cid) error
+}
+
+type nopLayerIndex struct{}
+
+func (nopLayerIndex) Get(context.Context, v1.Hash) (cid.Cid, bool) { return cid.Undef, false }
+
+func (nopLayerIndex) Put(context.Context, v1.Hash, cid.Cid) error { return nil }
+
+// FileLayerIndex persists the cid of each layer within a local directory, one file per digest
+type FileLayerIndex struct {
+	dir string
+}
+
+// NewFileLayerIndex returns a FileLayerIndex rooted at dir, creating it if needed
+func NewFileLayerIndex(dir string) (*FileLayerIndex, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &FileLayerIndex{dir: dir}, nil
+}
+
+func (i *FileLayerIndex) Get(_ context.Context, d v1.Hash) (cid.Cid, bool) {
+	data, err := os.ReadFile(i.path(d))
+	if err != nil {
+		return cid.Undef, false
+	}
+
+	c, err := cid.Decode(strings.TrimSpace(string(data)))
+	if err != nil {
+		return cid.Undef, false
+	}
+	return c, true
+}
+
+func (i *FileLayerIndex) Put(_ context.Context, d v1.Hash, c cid.Cid) error {
+	if !c.Defined() {
+		return errors.New("cannot index an undefined cid")
+	}
+
+	// Write then rename, concurrent adds of the same layer each write the same cid
+	tmp, err := os.CreateTemp(i.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(c.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), i.path(d))
+}
+
+func (i *FileLayerIndex) path(d v1.Hash) string {
+	return filepath.Join(i.dir, d.Algorithm+"-"+d.Hex)
+}
@@ -0,0 +1,399 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/joshrwolf/ripfs/internal/platform"
+)
+
+// ImageInfo is the metadata of a stored image, derived from its manifest and config
+type ImageInfo struct {
+	Root      string          `json:"root"`
+	Digest    v1.Hash         `json:"digest"`
+	MediaType types.MediaType `json:"mediaType"`
+	Created   time.Time       `json:"created,omitempty"`
+
+	OS           string `json:"os,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+
+	Entrypoint   []string          `json:"entrypoint,omitempty"`
+	Cmd          []string          `json:"cmd,omitempty"`
+	Env          []string          `json:"env,omitempty"`
+	WorkingDir   string            `json:"workingDir,omitempty"`
+	User         string            `json:"user,omitempty"`
+	ExposedPorts []string          `json:"exposedPorts,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+
+	Layers  []LayerInfo  `json:"layers"`
+	Size    int64        `json:"size"`
+	History []v1.History `json:"history,omitempty"`
+}
+
+// LayerInfo describes a single (compressed) layer of an image
+type LayerInfo struct {
+	Digest    v1.Hash         `json:"digest"`
+	MediaType types.MediaType `json:"mediaType"`
+	Format    string          `json:"format,omitempty"`
+	Size      int64           `json:"size"`
+	Cid       string          `json:"cid"`
+
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// The media types and annotations of zstd and estargz layers, which zstd aware runtimes and lazy pulling snapshotters
+// rely on. Like every other layer's, they're stored exactly as they were added.
+const (
+	// MediaTypeOCILayerZstd is a zstd compressed oci layer, which go-containerregistry has no type for yet
+	MediaTypeOCILayerZstd types.MediaType = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// AnnotationTOCDigest is the digest of an estargz layer's table of contents, which snapshotters verify it against
+	AnnotationTOCDigest = "containerd.io/snapshot/stargz/toc.digest"
+
+	// AnnotationUncompressedSize is the size of an estargz layer once decompressed
+	AnnotationUncompressedSize = "io.containers.estargz.uncompressed-size"
+)
+
+// The formats of layers, as reported by Inspect
+const (
+	LayerFormatTar     = "tar"
+	LayerFormatGzip    = "gzip"
+	LayerFormatZstd    = "zstd"
+	LayerFormatEstargz = "estargz"
+)
+
+// layerFormat returns the format of the layer desc describes, estargz layers being gzip layers with a table of
+// contents. Anything that isn't a layer (such as an artifact's blobs) has none.
+func layerFormat(desc v1.Descriptor) string {
+	if _, ok := desc.Annotations[AnnotationTOCDigest]; ok {
+		return LayerFormatEstargz
+	}
+
+	switch desc.MediaType {
+	case types.DockerLayer, types.OCILayer, types.DockerForeignLayer, types.OCIRestrictedLayer:
+		return LayerFormatGzip
+	case MediaTypeOCILayerZstd:
+		return LayerFormatZstd
+	case types.DockerUncompressedLayer, types.OCIUncompressedLayer, types.OCIUncompressedRestrictedLayer:
+		return LayerFormatTar
+	}
+	return ""
+}
+
+// Inspector derives image metadata from a stored image root, the image for want when the root is an index
+type Inspector interface {
+	Inspect(ctx context.Context, name string, want v1.Platform) (*ImageInfo, error)
+}
+
+// Inspect returns the metadata of the image stored at root, without pulling any of its layers. The image of an index
+// is the first one it lists for want, a root of a single image is that image whatever its platform.
+func Inspect(ctx context.Context, api iface.CoreAPI, root cid.Cid, want v1.Platform) (*ImageInfo, error) {
+	return ipfs{client: api, index: nopIndex{}}.Inspect(ctx, root.String(), want)
+}
+
+// References returns root and the cids of every object it references
+func References(ctx context.Context, api iface.CoreAPI, root cid.Cid) ([]cid.Cid, error) {
+	entries, err := ipfs{client: api, index: nopIndex{}}.entries(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []cid.Cid{root}
+	for _, e := range entries {
+		refs = append(refs, e.Cid)
+	}
+	return refs, nil
+}
+
+// ImageSize returns the size of everything stored for the image at root, without pulling any of its layers
+func ImageSize(ctx context.Context, api iface.CoreAPI, root cid.Cid) (int64, error) {
+	blobs, err := StoredBlobs(ctx, api, root)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, s := range blobs {
+		size += s
+	}
+	return size, nil
+}
+
+// Platforms returns the platforms (such as linux/amd64) the image stored at root is available for, without pulling any
+// of its layers. Those of an index are listed by the index, an image's is its config's, and artifacts have none.
+func Platforms(ctx context.Context, api iface.CoreAPI, root cid.Cid) ([]string, error) {
+	i := ipfs{client: api, index: nopIndex{}}
+
+	entries, err := i.entries(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		indexed   = make(map[string]bool)
+		configs   = make(map[string]bool)
+		platforms []string
+	)
+	for d, e := range entries {
+		mt := types.MediaType(e.MediaType)
+		if !mt.IsIndex() && mt != types.OCIManifestSchema1 && mt != types.DockerManifestSchema2 {
+			continue
+		}
+
+		f, err := i.open(ctx, e.Cid)
+		if err != nil {
+			return nil, err
+		}
+
+		if mt.IsIndex() {
+			idx := &v1.IndexManifest{}
+			err = i.decode(f, idx)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("parsing index %s: %v", d, err)
+			}
+
+			// Attestations are listed as manifests of an unknown platform
+			for _, m := range idx.Manifests {
+				if m.Platform != nil && m.Platform.OS != "" && m.Platform.OS != "unknown" {
+					indexed[platform.String(*m.Platform)] = true
+				}
+			}
+			continue
+		}
+
+		m := &v1.Manifest{}
+		err = i.decode(f, m)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing manifest %s: %v", d, err)
+		}
+
+		ce, ok := entries[digest.Digest(m.Config.Digest.String())]
+		if !ok || (m.Config.MediaType != types.OCIConfigJSON && m.Config.MediaType != types.DockerConfigJSON) {
+			continue
+		}
+
+		cf, err := i.open(ctx, ce.Cid)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := &v1.ConfigFile{}
+		err = i.decode(cf, cfg)
+		cf.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing config %s: %v", m.Config.Digest, err)
+		}
+
+		if cfg.OS != "" {
+			configs[platform.String(v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture})] = true
+		}
+	}
+
+	if len(indexed) == 0 {
+		indexed = configs
+	}
+	for p := range indexed {
+		platforms = append(platforms, p)
+	}
+	sort.Strings(platforms)
+	return platforms, nil
+}
+
+// StoredBlobs returns the size of everything stored for the image at root (its index, manifests, configs and layers)
+// by digest, without pulling any of its layers
+func StoredBlobs(ctx context.Context, api iface.CoreAPI, root cid.Cid) (map[digest.Digest]int64, error) {
+	entries, err := ipfs{client: api, index: nopIndex{}}.entries(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make(map[digest.Digest]int64, len(entries))
+	for d, e := range entries {
+		blobs[d] = e.Size
+	}
+	return blobs, nil
+}
+
+// RootDigest returns the digest the image stored at root is served by, without reading anything beyond the root
+func RootDigest(ctx context.Context, api iface.CoreAPI, root cid.Cid) (digest.Digest, error) {
+	i := ipfs{client: api, index: nopIndex{}}
+
+	f, err := i.open(ctx, root)
+	if err != nil {
+		return "", err
+	}
+
+	_, d, _, _, err := i.step(f)
+	return d, err
+}
+
+func (i *IpfsRegistry) buildInspectHandler(ins Inspector) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		want := platform.Host()
+		if p := r.URL.Query().Get("platform"); p != "" {
+			var err error
+			if want, err = platform.Parse(p); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		info, err := ins.Inspect(r.Context(), chi.URLParam(r, "cid"), want)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}
+}
+
+func (i ipfs) Inspect(ctx context.Context, name string, want v1.Platform) (*ImageInfo, error) {
+	rootc, err := cid.Decode(name)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := i.entries(ctx, rootc)
+	if err != nil {
+		return nil, err
+	}
+
+	rf, err := i.open(ctx, rootc)
+	if err != nil {
+		return nil, err
+	}
+
+	_, d, rmt, _, err := i.step(rf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Indexes (even nested ones) are followed to the first image they list for want
+	mmt := types.MediaType(rmt)
+	for mmt.IsIndex() {
+		idx := &v1.IndexManifest{}
+		if err := i.decodeEntry(ctx, entries, d, idx); err != nil {
+			return nil, fmt.Errorf("parsing index %s: %v", d, err)
+		}
+
+		// The index of a single image, as every image added on its own is stored, is that image whatever its platform
+		if len(idx.Manifests) == 1 {
+			d, mmt = digest.Digest(idx.Manifests[0].Digest.String()), idx.Manifests[0].MediaType
+			continue
+		}
+
+		var (
+			found     bool
+			available []string
+		)
+		for _, desc := range idx.Manifests {
+			if desc.Platform == nil {
+				continue
+			}
+			if platform.Matches(*desc.Platform, want) {
+				d, mmt, found = digest.Digest(desc.Digest.String()), desc.MediaType, true
+				break
+			}
+			available = append(available, platform.String(*desc.Platform))
+		}
+
+		if !found {
+			return nil, fmt.Errorf("%w: no image for %s within %s, it has [%s]", ErrNotFound, platform.String(want), rootc, strings.Join(available, ", "))
+		}
+	}
+
+	if mmt != types.OCIManifestSchema1 && mmt != types.DockerManifestSchema2 {
+		return nil, fmt.Errorf("no image manifest found within %s, its root is a %s", rootc, mmt)
+	}
+
+	m := &v1.Manifest{}
+	if err := i.decodeEntry(ctx, entries, d, m); err != nil {
+		return nil, fmt.Errorf("parsing manifest %s: %v", d, err)
+	}
+
+	md, err := v1.NewHash(d.String())
+	if err != nil {
+		return nil, err
+	}
+
+	ce, ok := entries[digest.Digest(m.Config.Digest.String())]
+	if !ok {
+		return nil, fmt.Errorf("config %s not found within %s", m.Config.Digest, rootc)
+	}
+
+	cf, err := i.open(ctx, ce.Cid)
+	if err != nil {
+		return nil, err
+	}
+	defer cf.Close()
+
+	cfg := &v1.ConfigFile{}
+	if err := i.decode(cf, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %v", m.Config.Digest, err)
+	}
+
+	info := &ImageInfo{
+		Root:         rootc.String(),
+		Digest:       md,
+		MediaType:    mmt,
+		Created:      cfg.Created.Time,
+		OS:           cfg.OS,
+		Architecture: cfg.Architecture,
+		Entrypoint:   cfg.Config.Entrypoint,
+		Cmd:          cfg.Config.Cmd,
+		Env:          cfg.Config.Env,
+		WorkingDir:   cfg.Config.WorkingDir,
+		User:         cfg.Config.User,
+		Labels:       cfg.Config.Labels,
+		History:      cfg.History,
+	}
+
+	for p := range cfg.Config.ExposedPorts {
+		info.ExposedPorts = append(info.ExposedPorts, p)
+	}
+	sort.Strings(info.ExposedPorts)
+
+	for _, l := range m.Layers {
+		li := LayerInfo{Digest: l.Digest, MediaType: l.MediaType, Format: layerFormat(l), Size: l.Size, Annotations: l.Annotations}
+		if le, ok := entries[digest.Digest(l.Digest.String())]; ok {
+			li.Cid = le.Cid.String()
+		}
+
+		info.Layers = append(info.Layers, li)
+		info.Size += l.Size
+	}
+
+	return info, nil
+}
+
+// decodeEntry decodes the json document of d within entries into v
+func (i ipfs) decodeEntry(ctx context.Context, entries Entries, d digest.Digest, v interface{}) error {
+	e, ok := entries[d]
+	if !ok {
+		return fmt.Errorf("%s not found", d)
+	}
+
+	f, err := i.open(ctx, e.Cid)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return i.decode(f, v)
+}
@@ -4,16 +4,23 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	files "github.com/ipfs/go-ipfs-files"
 	iface "github.com/ipfs/interface-go-ipfs-core"
+	iopts "github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 
 	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/metrics"
 )
 
 // CidMapper is anything that can resolve oci references to IPFS CIDs
@@ -21,6 +28,17 @@ type CidMapper interface {
 	Resolve(ctx context.Context, reference string) (string, error)
 }
 
+// Lister is anything that can list every reference => cid mapping
+type Lister interface {
+	Mappings(ctx context.Context) (path.Path, map[string]string, error)
+}
+
+// ListingCidMapper is a CidMapper that can also list its mappings
+type ListingCidMapper interface {
+	CidMapper
+	Lister
+}
+
 // Updater is anything that can update the CidMapper
 type Updater interface {
 	Update(ctx context.Context) error
@@ -31,6 +49,102 @@ type Fetcher interface {
 	Fetch(ctx context.Context) (string, error)
 }
 
+// StaticFetcher is an ipns cid known ahead of time
+type StaticFetcher string
+
+func (f StaticFetcher) Fetch(ctx context.Context) (string, error) {
+	return string(f), nil
+}
+
+// MemoryCidMapper holds mappings owned by this process, rather than ones published elsewhere
+type MemoryCidMapper struct {
+	mu       sync.RWMutex
+	p        path.Path
+	mappings map[string]string
+}
+
+func NewMemoryCidMapper() *MemoryCidMapper {
+	return &MemoryCidMapper{mappings: make(map[string]string)}
+}
+
+func (m *MemoryCidMapper) Resolve(ctx context.Context, reference string) (string, error) {
+	_, mappings, err := m.Mappings(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return resolveMapping(mappings, reference)
+}
+
+func (m *MemoryCidMapper) Mappings(ctx context.Context) (path.Path, map[string]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.p, m.mappings, nil
+}
+
+// Set replaces the mappings with those published at p
+func (m *MemoryCidMapper) Set(p path.Path, mappings map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.p, m.mappings = p, mappings
+}
+
+// FileCidMapper holds mappings read from a local json file (in the same format they're published in), such as one
+// written by the seeder of an offline install. The file is re-read whenever it changes, and has no mappings until
+// it's first written.
+type FileCidMapper struct {
+	path string
+
+	mu       sync.Mutex
+	modTime  time.Time
+	size     int64
+	mappings map[string]string
+}
+
+func NewFileCidMapper(path string) *FileCidMapper {
+	return &FileCidMapper{path: path}
+}
+
+func (m *FileCidMapper) Resolve(ctx context.Context, reference string) (string, error) {
+	_, mappings, err := m.Mappings(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return resolveMapping(mappings, reference)
+}
+
+func (m *FileCidMapper) Mappings(ctx context.Context) (path.Path, map[string]string, error) {
+	fi, err := os.Stat(m.path)
+	if os.IsNotExist(err) {
+		return nil, map[string]string{}, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.mappings != nil && fi.ModTime().Equal(m.modTime) && fi.Size() == m.size {
+		return nil, m.mappings, nil
+	}
+
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mappings := make(map[string]string)
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return nil, nil, fmt.Errorf("reading mappings from %s: %v", m.path, err)
+	}
+
+	m.modTime, m.size, m.mappings = fi.ModTime(), fi.Size(), mappings
+	return nil, mappings, nil
+}
+
 type SecretFetcher struct {
 	KCfg    *rest.Config
 	Key     types.NamespacedName
@@ -68,8 +182,13 @@ func (f SecretFetcher) Fetch(ctx context.Context) (string, error) {
 type IpnsCidMapper struct {
 	client  iface.CoreAPI
 	fetcher Fetcher
+
+	// uncached is set once invalidated, the next resolution then skips the name cache holding the previous mappings
+	uncached uint32
 }
 
+var _ Invalidator = (*IpnsCidMapper)(nil)
+
 func NewIpfsCidMapper(client iface.CoreAPI, f Fetcher) *IpnsCidMapper {
 	return &IpnsCidMapper{
 		client:  client,
@@ -80,38 +199,65 @@ func NewIpfsCidMapper(client iface.CoreAPI, f Fetcher) *IpnsCidMapper {
 func (m *IpnsCidMapper) Resolve(ctx context.Context, reference string) (string, error) {
 	mapper, err := m.fetch(ctx)
 	if err != nil {
-		return "", fmt.Errorf("unable to retrieve cid mapper")
+		return "", fmt.Errorf("retrieving mappings: %w", err)
 	}
 
-	ref, err := name.ParseReference(reference)
-	if err != nil {
-		return "", err
-	}
-
-	cid, ok := mapper[ref.Name()]
-	if !ok {
-		return "", fmt.Errorf("cid does not exist for reference %s", ref.Name())
-	}
+	return resolveMapping(mapper, reference)
+}
 
-	return cid, nil
+// Mappings returns every current reference => root mapping, along with the path of the published mapping itself
+func (m *IpnsCidMapper) Mappings(ctx context.Context) (path.Path, map[string]string, error) {
+	p, cidMap, err := m.mappings(ctx)
+	metrics.ObserveMappings(err)
+	return p, cidMap, err
 }
 
-func (m *IpnsCidMapper) fetch(ctx context.Context) (map[string]string, error) {
+func (m *IpnsCidMapper) mappings(ctx context.Context) (path.Path, map[string]string, error) {
 	if !m.peered(ctx) {
-		return nil, fmt.Errorf("swarm not initialized yet, ipns cannot exist")
+		return nil, nil, fmt.Errorf("%w: ipns can't be resolved until the swarm is initialized", ErrNotPeered)
 	}
 
 	cid, err := m.fetcher.Fetch(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("fetching ipns cid: %v", err)
+		return nil, nil, fmt.Errorf("fetching ipns cid: %v", err)
+	}
+
+	var opts []iopts.NameResolveOption
+	uncached := atomic.SwapUint32(&m.uncached, 0) == 1
+	if uncached {
+		opts = append(opts, iopts.Name.Cache(false))
 	}
 
-	p, err := m.client.Name().Resolve(ctx, cid)
+	p, err := m.client.Name().Resolve(ctx, cid, opts...)
 	if err != nil {
-		return nil, err
+		if uncached {
+			atomic.StoreUint32(&m.uncached, 1)
+		}
+		return nil, nil, err
 	}
 
-	nd, err := m.client.Unixfs().Get(ctx, p)
+	cidMap, err := ReadMappings(ctx, m.client, p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return p, cidMap, nil
+}
+
+// Invalidate resolves the name again on the next lookup rather than from the name cache, which still holds whatever
+// it last resolved to until its ttl passes
+func (m *IpnsCidMapper) Invalidate() {
+	atomic.StoreUint32(&m.uncached, 1)
+}
+
+func (m *IpnsCidMapper) fetch(ctx context.Context) (map[string]string, error) {
+	_, cidMap, err := m.Mappings(ctx)
+	return cidMap, err
+}
+
+// ReadMappings reads the mappings published at p
+func ReadMappings(ctx context.Context, client iface.CoreAPI, p path.Path) (map[string]string, error) {
+	nd, err := client.Unixfs().Get(ctx, p)
 	if err != nil {
 		return nil, err
 	}
@@ -126,10 +272,24 @@ func (m *IpnsCidMapper) fetch(ctx context.Context) (map[string]string, error) {
 	if err := json.NewDecoder(f).Decode(&cidMap); err != nil {
 		return nil, err
 	}
-
 	return cidMap, nil
 }
 
+// resolveMapping looks reference up within mappings
+func resolveMapping(mappings map[string]string, reference string) (string, error) {
+	ref, err := name.ParseReference(reference)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidReference, err)
+	}
+
+	cid, ok := mappings[ref.Name()]
+	if !ok {
+		return "", fmt.Errorf("%w: no cid mapped for %s", ErrNotFound, ref.Name())
+	}
+
+	return cid, nil
+}
+
 func (m *IpnsCidMapper) peered(ctx context.Context) bool {
 	peers, err := m.client.Swarm().Peers(ctx)
 	if err != nil {
@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/ipfs/go-cid"
+	"github.com/opencontainers/go-digest"
+)
+
+// repositoryRoots returns the roots mapped to the served repository repo, by tag, along with every root mapped to it
+func repositoryRoots(mappings map[string]string, repo string) (map[string]cid.Cid, []cid.Cid) {
+	var (
+		tagged = make(map[string]cid.Cid)
+		roots  []cid.Cid
+		seen   = make(map[cid.Cid]bool)
+	)
+
+	for m, v := range mappings {
+		ref, err := name.ParseReference(m)
+		if err != nil || RepositoryName(ref) != repo {
+			continue
+		}
+
+		c, err := cid.Decode(strings.TrimPrefix(v, "/ipfs/"))
+		if err != nil {
+			continue
+		}
+
+		if t, ok := ref.(name.Tag); ok {
+			tagged[t.TagStr()] = c
+		}
+
+		if !seen[c] {
+			seen[c] = true
+			roots = append(roots, c)
+		}
+	}
+	return tagged, roots
+}
+
+// NamedRoots returns the roots an image served by name (repository repo, at a tag or digest reference) is read from:
+// the root its tag is mapped to, or every root mapped to the repository for digests
+func NamedRoots(mappings map[string]string, repo string, reference string) []cid.Cid {
+	tagged, roots := repositoryRoots(mappings, repo)
+	if _, err := digest.Parse(reference); err == nil {
+		return roots
+	}
+
+	if root, ok := tagged[reference]; ok {
+		return []cid.Cid{root}
+	}
+	return nil
+}
+
+// serveNamed serves a manifest or blob of a repository by name, resolving tags to roots with the mapper. Digests are
+// searched for within every root mapped to the repository, falling back to pushed blobs when pushing is enabled.
+func (i *IpfsRegistry) serveNamed(w http.ResponseWriter, r *http.Request, repo string, reference string, manifest bool, push http.Handler) {
+	ctx := r.Context()
+
+	_, mappings, err := i.mapper.Mappings(ctx)
+	if err != nil {
+		writeError(w, err, http.StatusServiceUnavailable, ErrUnavailable)
+		return
+	}
+
+	tagged, roots := repositoryRoots(mappings, repo)
+
+	var (
+		content   io.ReadSeekCloser
+		mediaType string
+	)
+
+	d, derr := digest.Parse(reference)
+	if derr == nil {
+		for _, root := range roots {
+			if content, mediaType, err = i.reader.ReadBlob(ctx, root.String(), d); err == nil {
+				break
+			}
+		}
+	} else if root, ok := tagged[reference]; ok && manifest {
+		if content, mediaType, err = i.reader.ReadManifest(ctx, root.String(), "latest"); err == nil {
+			if d, content, err = digestContent(content, i.maxManifestSize); err != nil {
+				writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+				return
+			}
+
+			// Tags can be remapped at any time
+			w.Header().Set("Cache-Control", cacheRevalidate)
+		}
+	}
+
+	if content == nil {
+		if !manifest && push != nil {
+			push.ServeHTTP(w, r)
+			return
+		}
+
+		switch {
+		case len(roots) == 0:
+			regError(http.StatusNotFound, ErrNameUnknown, "repository %s unknown", repo).write(w)
+		case manifest:
+			regError(http.StatusNotFound, ErrManifestUnknown, "manifest %s unknown", reference).write(w)
+		default:
+			regError(http.StatusNotFound, ErrBlobUnknown, "blob %s unknown", reference).write(w)
+		}
+		return
+	}
+
+	if manifest {
+		if mediaType, content, err = negotiateManifest(w, r, mediaType, content, i.maxManifestSize); err != nil {
+			writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+			return
+		}
+	}
+
+	serveContent(w, r, d, mediaType, content)
+}
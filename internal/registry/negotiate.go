@@ -0,0 +1,108 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// manifestEquivalents are the docker and oci manifest media types that describe the same thing, and only differ by
+// what the manifest declares itself as
+var manifestEquivalents = map[string]string{
+	string(types.DockerManifestSchema2): string(types.OCIManifestSchema1),
+	string(types.OCIManifestSchema1):    string(types.DockerManifestSchema2),
+	string(types.DockerManifestList):    string(types.OCIImageIndex),
+	string(types.OCIImageIndex):         string(types.DockerManifestList),
+}
+
+// accepts returns whether the Accept headers of r include mediaType, anything is accepted without one
+func accepts(r *http.Request, mediaType string) bool {
+	values := r.Header.Values("Accept")
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, v := range values {
+		for _, a := range strings.Split(v, ",") {
+			a = strings.TrimSpace(strings.SplitN(a, ";", 2)[0])
+			if a == mediaType || a == "*/*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// negotiateManifest returns the media type to serve a manifest of mediaType as, from the request's Accept headers.
+// A manifest that isn't accepted as is can only be served as its docker (or oci) equivalent when it doesn't declare a
+// mediaType of its own, since its bytes (and digest) must stay the same. Anything else is rejected like the
+// distribution registry does, rather than rewritten to a manifest nobody pushed.
+func negotiateManifest(w http.ResponseWriter, r *http.Request, mediaType string, content io.ReadSeekCloser, limit int64) (string, io.ReadSeekCloser, error) {
+	w.Header().Add("Vary", "Accept")
+
+	if mediaType == "" {
+		data, err := readManifest(content, limit)
+		content.Close()
+		if err != nil {
+			return "", nil, err
+		}
+
+		if mediaType, err = sniffManifest(data); err != nil {
+			return "", nil, err
+		}
+		content = nopSeekCloser{bytes.NewReader(data)}
+	}
+
+	if accepts(r, mediaType) {
+		return mediaType, content, nil
+	}
+
+	alt, ok := manifestEquivalents[mediaType]
+	if !ok || !accepts(r, alt) {
+		content.Close()
+		return "", nil, regError(http.StatusNotFound, ErrManifestUnknown, "manifest is a %s, which isn't accepted", mediaType)
+	}
+
+	data, err := readManifest(content, limit)
+	content.Close()
+	if err != nil {
+		return "", nil, err
+	}
+
+	m := struct {
+		MediaType string `json:"mediaType"`
+	}{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", nil, regError(http.StatusInternalServerError, ErrManifestInvalid, "invalid manifest: %v", err)
+	}
+
+	if m.MediaType != "" && m.MediaType != alt {
+		return "", nil, regError(http.StatusNotFound, ErrManifestUnknown, "manifest declares itself a %s, which isn't accepted", m.MediaType)
+	}
+	return alt, nopSeekCloser{bytes.NewReader(data)}, nil
+}
+
+// sniffManifest returns the media type of a manifest read without one (such as a raw block found by its digest alone),
+// the one it declares or otherwise an oci index or manifest by whether it lists manifests
+func sniffManifest(data []byte) (string, error) {
+	m := struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", regError(http.StatusInternalServerError, ErrManifestInvalid, "invalid manifest: %v", err)
+	}
+
+	switch {
+	case m.MediaType != "":
+		return m.MediaType, nil
+	case m.Manifests != nil:
+		return string(types.OCIImageIndex), nil
+	default:
+		return string(types.OCIManifestSchema1), nil
+	}
+}
@@ -0,0 +1,65 @@
+package registry
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// ReplicationPolicy is where an image is pinned ahead of its pulls, so they're served from the nodes that will actually
+// run it rather than fetched from the swarm
+type ReplicationPolicy struct {
+	// Replicas is how many of the matching nodes pin the image, every one of them if 0
+	Replicas int `json:"replicas,omitempty"`
+
+	// NodeSelector limits the image to nodes with these labels, any node if empty
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+}
+
+// Validate fails unless p is a valid policy
+func (p ReplicationPolicy) Validate() error {
+	if p.Replicas < 0 {
+		return fmt.Errorf("invalid replicas %d, must not be negative", p.Replicas)
+	}
+	if _, err := labels.ValidatedSelectorFromSet(p.NodeSelector); err != nil {
+		return fmt.Errorf("invalid node selector: %v", err)
+	}
+	return nil
+}
+
+// Matches reports whether a node labeled with nodeLabels is selected by p
+func (p ReplicationPolicy) Matches(nodeLabels map[string]string) bool {
+	return labels.SelectorFromSet(p.NodeSelector).Matches(labels.Set(nodeLabels))
+}
+
+// ReplicationPolicies are the policies of every image that has one, by the reference it's mapped as
+type ReplicationPolicies map[string]ReplicationPolicy
+
+// ParseReplicationPolicies parses policies, as a yaml (or json) object of reference => policy
+func ParseReplicationPolicies(data string) (ReplicationPolicies, error) {
+	policies := make(ReplicationPolicies)
+	if err := yaml.UnmarshalStrict([]byte(data), &policies); err != nil {
+		return nil, err
+	}
+
+	for ref, p := range policies {
+		if _, err := name.ParseReference(ref); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidReference, ref, err)
+		}
+		if err := p.Validate(); err != nil {
+			return nil, fmt.Errorf("policy of %s: %v", ref, err)
+		}
+	}
+	return policies, nil
+}
+
+// String renders the policies as yaml, as they're parsed
+func (p ReplicationPolicies) String() string {
+	data, err := yaml.Marshal(map[string]ReplicationPolicy(p))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
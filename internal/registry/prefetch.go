@@ -0,0 +1,258 @@
+package registry
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/hashicorp/go-multierror"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/opencontainers/go-digest"
+)
+
+// ParseContentProfile parses a content profile, the roots a class of nodes prefetches as soon as its agent starts.
+// Roots are given one per line, as cids or /ipfs/ paths, and blank lines and # comments are ignored.
+func ParseContentProfile(data string) ([]cid.Cid, error) {
+	var (
+		roots []cid.Cid
+		seen  = make(map[cid.Cid]bool)
+	)
+
+	s := bufio.NewScanner(strings.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		root, err := cid.Decode(strings.TrimPrefix(line, "/ipfs/"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid cid %s: %v", n, line, err)
+		}
+
+		if !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+	}
+	return roots, s.Err()
+}
+
+// PrefetchOption configures a Prefetch
+type PrefetchOption func(o *prefetchOptions)
+
+type prefetchOptions struct {
+	bandwidth int64
+	progress  func(p Progress)
+}
+
+// WithBandwidth budgets the layers fetched by a Prefetch to bytesPerSecond on average, pausing in between them
+func WithBandwidth(bytesPerSecond int64) PrefetchOption {
+	return func(o *prefetchOptions) {
+		o.bandwidth = bytesPerSecond
+	}
+}
+
+// WithPrefetchProgress reports each layer fetched (PhaseLayerAdded) and each root fetched in full (PhaseAdded) to report
+func WithPrefetchProgress(report func(p Progress)) PrefetchOption {
+	return func(o *prefetchOptions) {
+		o.progress = report
+	}
+}
+
+// Prefetch pins every object of each of roots, fetching it from the swarm, so images are served from the node itself
+// rather than fetched on their first pull. Objects are pinned one by one (as they are when added), in the order that
+// leaves the most useful partial progress if the prefetch is interrupted: every root's metadata (its index, manifests
+// and configs) first, so every image can at least be resolved and inspected, and then every layer largest first, since
+// those are the slowest to fetch on demand.
+//
+// Roots that can't be fetched are skipped, the number prefetched in full is returned along with why the rest weren't.
+func Prefetch(ctx context.Context, api iface.CoreAPI, roots []cid.Cid, opts ...PrefetchOption) (int, error) {
+	o := prefetchOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	type blob struct {
+		cid   cid.Cid
+		d     digest.Digest
+		size  int64
+		roots []cid.Cid
+	}
+
+	var (
+		errs   error
+		n      int
+		failed = make(map[cid.Cid]bool)
+		pinned = make(map[cid.Cid]bool)
+		blobs  = make(map[cid.Cid]*blob)
+		walker = ipfs{client: api, index: nopIndex{}}
+
+		// remaining counts the layers of each root left to fetch, it's prefetched in full once there are none
+		remaining = make(map[cid.Cid]int)
+	)
+
+	fail := func(root cid.Cid, err error) {
+		if !failed[root] {
+			failed[root] = true
+			errs = multierror.Append(errs, fmt.Errorf("prefetching %s: %v", root, err))
+		}
+	}
+	fetched := func(root cid.Cid) {
+		if remaining[root]--; remaining[root] == 0 && !failed[root] {
+			o.report(Progress{Phase: PhaseAdded, Cid: root.String()})
+			n++
+		}
+	}
+
+	// Walking a root fetches its index and manifests, which are pinned along with its configs before any layer
+	for _, root := range roots {
+		if _, ok := remaining[root]; ok || failed[root] {
+			continue
+		}
+
+		entries, err := walker.entries(ctx, root)
+		if err != nil {
+			fail(root, err)
+			continue
+		}
+
+		meta := []cid.Cid{root}
+		for d, e := range entries {
+			if metadata(types.MediaType(e.MediaType)) {
+				meta = append(meta, e.Cid)
+				continue
+			}
+
+			b, ok := blobs[e.Cid]
+			if !ok {
+				b = &blob{cid: e.Cid, d: d, size: e.Size}
+				blobs[e.Cid] = b
+			}
+			b.roots = append(b.roots, root)
+		}
+
+		// The metadata counts as one more thing to fetch, so roots without layers are prefetched once it is
+		remaining[root] = len(entries) - len(meta) + 2
+		for _, c := range meta {
+			if pinned[c] {
+				continue
+			}
+			if err := api.Pin().Add(ctx, path.IpfsPath(c)); err != nil {
+				fail(root, err)
+				break
+			}
+			pinned[c] = true
+		}
+		fetched(root)
+	}
+
+	var ordered []*blob
+	for _, b := range blobs {
+		ordered = append(ordered, b)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].size != ordered[j].size {
+			return ordered[i].size > ordered[j].size
+		}
+		return ordered[i].cid.String() < ordered[j].cid.String()
+	})
+
+	for _, b := range ordered {
+		if ctx.Err() != nil {
+			return n, multierror.Append(errs, ctx.Err())
+		}
+
+		needed := false
+		for _, root := range b.roots {
+			needed = needed || !failed[root]
+		}
+		if !needed {
+			continue
+		}
+
+		start := time.Now()
+		if err := api.Pin().Add(ctx, path.IpfsPath(b.cid)); err != nil {
+			for _, root := range b.roots {
+				fail(root, fmt.Errorf("layer %s: %v", b.d, err))
+			}
+			continue
+		}
+		o.report(Progress{Phase: PhaseLayerAdded, Digest: b.d.String(), Bytes: b.size, Total: b.size, Cid: b.cid.String()})
+
+		for _, root := range b.roots {
+			fetched(root)
+		}
+
+		if err := o.budget(ctx, b.size, time.Since(start)); err != nil {
+			return n, multierror.Append(errs, err)
+		}
+	}
+
+	return n, errs
+}
+
+// Prefetched reports whether every object of root is pinned, as it is once it's prefetched (or added) in full. Every
+// object is pinned on its own, so the root being pinned doesn't say anything about the rest of the image.
+func Prefetched(ctx context.Context, api iface.CoreAPI, root cid.Cid) (bool, error) {
+	if ok, err := stored(ctx, api, root); err != nil || !ok {
+		return false, err
+	}
+
+	entries, err := ipfs{client: api, index: nopIndex{}}.entries(ctx, root)
+	if err != nil {
+		return false, err
+	}
+
+	for _, e := range entries {
+		if ok, err := stored(ctx, api, e.Cid); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (o prefetchOptions) report(p Progress) {
+	if o.progress != nil {
+		o.progress(p)
+	}
+}
+
+// budget waits out whatever is left of the time budgeted for size bytes, once fetching them took took
+func (o prefetchOptions) budget(ctx context.Context, size int64, took time.Duration) error {
+	if o.bandwidth <= 0 {
+		return nil
+	}
+
+	wait := time.Duration(float64(size)/float64(o.bandwidth)*float64(time.Second)) - took
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// metadata reports whether an object of media type mt is an image's metadata (its index, manifests or config, configs
+// always being json), rather than a layer or an artifact's blob
+func metadata(mt types.MediaType) bool {
+	return mt.IsIndex() || mt.IsImage() || strings.HasSuffix(string(mt), "json")
+}
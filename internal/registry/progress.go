@@ -0,0 +1,89 @@
+package registry
+
+import (
+	"io"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/ipfs/go-cid"
+)
+
+// Phase is what an add was doing when it reported its Progress
+type Phase string
+
+const (
+	// PhaseLayer reports the bytes of a layer transferred so far
+	PhaseLayer Phase = "layer"
+
+	// PhaseLayerStored reports a layer that was already stored, and so isn't transferred again
+	PhaseLayerStored Phase = "layer-stored"
+
+	// PhaseLayerAdded reports a layer that was transferred in full, along with its cid
+	PhaseLayerAdded Phase = "layer-added"
+
+	// PhaseAdded reports an image (or index) that was added, along with the cid of its root
+	PhaseAdded Phase = "added"
+)
+
+// Progress is an event of an add's progress. Bytes and Total are the bytes of a layer transferred so far and its size.
+type Progress struct {
+	Phase  Phase  `json:"phase"`
+	Digest string `json:"digest,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+	Total  int64  `json:"total,omitempty"`
+	Cid    string `json:"cid,omitempty"`
+}
+
+// progressInterval is how many bytes of a layer are transferred in between reports of its progress
+const progressInterval = 1 << 20
+
+// WithProgress reports the progress of an add to report, which is called concurrently as layers are added
+func WithProgress(report func(p Progress)) AddOption {
+	return func(o *addOptions) {
+		o.progress = report
+	}
+}
+
+func (o addOptions) report(p Progress) {
+	if o.progress != nil {
+		o.progress(p)
+	}
+}
+
+// reportLayer reports a layer of digest d and size that was stored (c is its cid) when added is false, or added
+func (o addOptions) reportLayer(d v1.Hash, size int64, c cid.Cid, added bool) {
+	phase := PhaseLayerStored
+	if added {
+		phase = PhaseLayerAdded
+	}
+	o.report(Progress{Phase: phase, Digest: d.String(), Bytes: size, Total: size, Cid: c.String()})
+}
+
+// progressReader reports the bytes of a layer read through it every progressInterval
+type progressReader struct {
+	io.Reader
+
+	o      addOptions
+	digest v1.Hash
+	total  int64
+
+	read, reported int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+
+	if r.read-r.reported >= progressInterval {
+		r.reported = r.read
+		r.o.report(Progress{Phase: PhaseLayer, Digest: r.digest.String(), Bytes: r.read, Total: r.total})
+	}
+	return n, err
+}
+
+// trackLayer returns rc, reporting the progress of reading it when progress is reported at all
+func (o addOptions) trackLayer(rc io.Reader, d v1.Hash, size int64) io.Reader {
+	if o.progress == nil {
+		return rc
+	}
+	return &progressReader{Reader: rc, o: o, digest: d, total: size}
+}
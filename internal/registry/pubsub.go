@@ -0,0 +1,200 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/rs/zerolog"
+)
+
+// MappingDelta is a single change to the mappings, announced to every peer as soon as it's published
+type MappingDelta struct {
+	// Path is the full mapping once the delta is applied, and Previous the mapping it was applied to
+	Path     string `json:"path"`
+	Previous string `json:"previous,omitempty"`
+
+	// Set are the references (re)mapped by the delta
+	Set map[string]string `json:"set,omitempty"`
+
+	// Removed are the references unmapped by the delta
+	Removed []string `json:"removed,omitempty"`
+
+	// Signatures are the signatures of the mappings of Set, by reference, recorded alongside them in their Images
+	Signatures map[string]string `json:"signatures,omitempty"`
+
+	// Generation is the generation the delta was committed as, counted by the mapper secret
+	Generation int64 `json:"generation,omitempty"`
+}
+
+// Applier is an Invalidator that can apply announced deltas itself, rather than dropping everything it holds
+type Applier interface {
+	Invalidator
+	Apply(ctx context.Context, d MappingDelta)
+}
+
+// Refresher is an Invalidator that can refresh what it holds in place, rather than dropping it until the next lookup
+type Refresher interface {
+	Invalidator
+	Refresh(ctx context.Context) error
+}
+
+// PublishDelta announces a mapping update on topic, so every subscriber can update (or drop) its copy
+func PublishDelta(ctx context.Context, api iface.CoreAPI, topic string, d MappingDelta) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	return api.PubSub().Publish(ctx, topic, data)
+}
+
+// PubsubCidMapper keeps a local copy of the mappings, seeded from another mapper (typically ipns) and kept up to date
+// with the deltas announced over pubsub. Updates propagate as fast as pubsub does, without resolving ipns again.
+type PubsubCidMapper struct {
+	client iface.CoreAPI
+	seed   ListingCidMapper
+
+	mu       sync.Mutex
+	p        path.Path
+	mappings map[string]string
+
+	// applied counts the deltas applied, so a refresh racing one doesn't replace it with the older mappings it read
+	applied uint64
+}
+
+var (
+	_ Applier   = (*PubsubCidMapper)(nil)
+	_ Refresher = (*PubsubCidMapper)(nil)
+)
+
+func NewPubsubCidMapper(client iface.CoreAPI, seed ListingCidMapper) *PubsubCidMapper {
+	return &PubsubCidMapper{
+		client: client,
+		seed:   seed,
+	}
+}
+
+func (m *PubsubCidMapper) Resolve(ctx context.Context, reference string) (string, error) {
+	_, mappings, err := m.Mappings(ctx)
+	if err != nil {
+		return "", fmt.Errorf("retrieving mappings: %w", err)
+	}
+
+	return resolveMapping(mappings, reference)
+}
+
+func (m *PubsubCidMapper) Mappings(ctx context.Context) (path.Path, map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.mappings != nil {
+		return m.p, m.mappings, nil
+	}
+
+	p, mappings, err := m.seed.Mappings(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m.p, m.mappings = p, mappings
+	return p, mappings, nil
+}
+
+// Apply applies d to the local copy when it follows on from it. Otherwise updates were missed, and the full mapping
+// d points at is read instead.
+func (m *PubsubCidMapper) Apply(ctx context.Context, d MappingDelta) {
+	l := zerolog.Ctx(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.mappings != nil && m.p != nil && m.p.String() == d.Previous {
+		mappings := make(map[string]string, len(m.mappings)+len(d.Set))
+		for k, v := range m.mappings {
+			mappings[k] = v
+		}
+		for k, v := range d.Set {
+			mappings[k] = v
+		}
+		for _, k := range d.Removed {
+			delete(mappings, k)
+		}
+
+		m.p, m.mappings = path.New(d.Path), mappings
+		m.applied++
+		return
+	}
+
+	// Nothing is held yet, or updates were missed, either way the full mapping is as current as it gets
+	mappings, err := ReadMappings(ctx, m.client, path.New(d.Path))
+	if err != nil {
+		l.Debug().Msgf("reading mappings %s, dropping the local copy: %v", d.Path, err)
+		m.p, m.mappings = nil, nil
+		return
+	}
+
+	m.p, m.mappings = path.New(d.Path), mappings
+	m.applied++
+}
+
+// Refresh seeds the local copy again, catching up on any update that was missed. The current copy is kept should the
+// seed fail, or should a delta be applied while it's read.
+func (m *PubsubCidMapper) Refresh(ctx context.Context) error {
+	m.mu.Lock()
+	applied := m.applied
+	m.mu.Unlock()
+
+	// Whatever the seed cached may be older than the deltas already applied
+	if inv, ok := m.seed.(Invalidator); ok {
+		inv.Invalidate()
+	}
+
+	p, mappings, err := m.seed.Mappings(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.applied == applied {
+		m.p, m.mappings = p, mappings
+	}
+	return nil
+}
+
+// RefreshEvery refreshes r every interval until ctx is done, bounding how long an update lost by pubsub goes unseen
+func RefreshEvery(ctx context.Context, r Refresher, interval time.Duration) {
+	l := zerolog.Ctx(ctx)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := r.Refresh(ctx); err != nil {
+				l.Debug().Msgf("refreshing mappings: %v", err)
+			}
+		}
+	}
+}
+
+// Invalidate drops the local copy, the next lookup seeds it again (past any cache of the seed's own)
+func (m *PubsubCidMapper) Invalidate() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.p, m.mappings = nil, nil
+
+	if inv, ok := m.seed.(Invalidator); ok {
+		inv.Invalidate()
+	}
+}
@@ -0,0 +1,516 @@
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// RootCidHeader is set on successful manifest pushes to the root cid the image is now served from
+	RootCidHeader = "Ripfs-Root-Cid"
+
+	// DefaultMaxManifestSize is the largest manifest (or config) read into memory, unless configured otherwise
+	DefaultMaxManifestSize = 4 << 20
+
+	// DefaultUploadTTL is how long an upload may go without a request before it's abandoned, unless configured otherwise
+	DefaultUploadTTL = 15 * time.Minute
+
+	// DefaultMaxUploads is the number of uploads in progress at once, unless configured otherwise
+	DefaultMaxUploads = 64
+)
+
+// repoName is the distribution spec's repository name grammar
+var repoName = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+
+type upload struct {
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+
+	// requests is the number of requests in progress for the upload, which expires once it has none for the ttl
+	requests int
+	expiry   *time.Timer
+}
+
+// pusher implements the distribution push flow, buffering blob uploads to disk before adding them to ipfs. Pushed
+// images are written just as AddImage would write them, and are served by their root cid.
+type pusher struct {
+	client iface.CoreAPI
+	dir    string
+
+	// maxManifestSize is the largest manifest accepted, and maxUploadSize the largest blob (unlimited when zero)
+	maxManifestSize int64
+	maxUploadSize   int64
+
+	// uploadTTL is how long an upload may go without a request, and maxUploads how many may be in progress at once
+	uploadTTL  time.Duration
+	maxUploads int
+
+	mu      sync.Mutex
+	uploads map[string]*upload
+
+	// blobs remembers the cid of each completed upload, which manifests may reference while it's still pinned
+	blobs LayerIndex
+}
+
+func newPusher(client iface.CoreAPI, opts *IpfsRegistryOpts, maxManifestSize int64) *pusher {
+	dir := opts.UploadDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "ripfs-uploads")
+	}
+
+	uploadTTL := opts.UploadTTL
+	if uploadTTL <= 0 {
+		uploadTTL = DefaultUploadTTL
+	}
+
+	maxUploads := opts.MaxUploads
+	if maxUploads <= 0 {
+		maxUploads = DefaultMaxUploads
+	}
+
+	return &pusher{
+		client:          client,
+		dir:             dir,
+		maxManifestSize: maxManifestSize,
+		maxUploadSize:   opts.MaxUploadSize,
+		uploadTTL:       uploadTTL,
+		maxUploads:      maxUploads,
+		uploads:         make(map[string]*upload),
+		blobs:           &FileLayerIndex{dir: filepath.Join(dir, "blobs")},
+	}
+}
+
+// ServeHTTP dispatches everything beneath /v2/, repository names may contain any number of path segments
+func (p *pusher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/v2/")
+
+	if i := strings.LastIndex(rest, "/blobs/uploads"); i > 0 {
+		name, id := rest[:i], strings.Trim(rest[i+len("/blobs/uploads"):], "/")
+		if !repoName.MatchString(name) {
+			regError(http.StatusBadRequest, ErrNameInvalid, "invalid repository name").write(w)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodPost && id == "":
+			p.startUpload(w, r, name)
+		case r.Method == http.MethodPatch && id != "":
+			p.patchUpload(w, r, name, id)
+		case r.Method == http.MethodPut && id != "":
+			p.finishUpload(w, r, name, id)
+		case r.Method == http.MethodGet && id != "":
+			p.uploadStatus(w, r, name, id)
+		case r.Method == http.MethodDelete && id != "":
+			p.cancelUpload(w, r, id)
+		default:
+			regError(http.StatusMethodNotAllowed, ErrUnsupported, "%s not supported", r.Method).write(w)
+		}
+		return
+	}
+
+	if i := strings.LastIndex(rest, "/blobs/"); i > 0 {
+		if r.Method != http.MethodHead && r.Method != http.MethodGet {
+			regError(http.StatusMethodNotAllowed, ErrUnsupported, "%s not supported", r.Method).write(w)
+			return
+		}
+		p.getBlob(w, r, rest[i+len("/blobs/"):])
+		return
+	}
+
+	if i := strings.LastIndex(rest, "/manifests/"); i > 0 && r.Method == http.MethodPut {
+		name := rest[:i]
+		if !repoName.MatchString(name) {
+			regError(http.StatusBadRequest, ErrNameInvalid, "invalid repository name").write(w)
+			return
+		}
+		p.putManifest(w, r, rest[i+len("/manifests/"):])
+		return
+	}
+
+	regError(http.StatusNotFound, ErrNameUnknown, "repository name not known to registry").write(w)
+}
+
+func (p *pusher) startUpload(w http.ResponseWriter, r *http.Request, name string) {
+	id, err := p.newUpload()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+		return
+	}
+
+	// Monolithic uploads provide the whole blob (and its digest) up front
+	if r.URL.Query().Get("digest") != "" {
+		p.finishUpload(w, r, name, id)
+		return
+	}
+
+	w.Header().Set("Location", uploadLocation(name, id))
+	w.Header().Set("Range", "0-0")
+	w.Header().Set("Docker-Upload-UUID", id)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (p *pusher) patchUpload(w http.ResponseWriter, r *http.Request, name string, id string) {
+	u, ok := p.upload(id)
+	if !ok {
+		regError(http.StatusNotFound, ErrBlobUploadUnknown, "blob upload unknown").write(w)
+		return
+	}
+	defer p.release(id, u)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// Chunks must arrive in order
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		start, err := strconv.ParseInt(strings.SplitN(cr, "-", 2)[0], 10, 64)
+		if err != nil || start != u.size {
+			regError(http.StatusRequestedRangeNotSatisfiable, ErrRangeInvalid, "blob upload out of order").write(w)
+			return
+		}
+	}
+
+	if err := p.write(u, r.Body); err != nil {
+		writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+		return
+	}
+
+	w.Header().Set("Location", uploadLocation(name, id))
+	w.Header().Set("Range", fmt.Sprintf("0-%d", u.size-1))
+	w.Header().Set("Docker-Upload-UUID", id)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (p *pusher) uploadStatus(w http.ResponseWriter, r *http.Request, name string, id string) {
+	u, ok := p.upload(id)
+	if !ok {
+		regError(http.StatusNotFound, ErrBlobUploadUnknown, "blob upload unknown").write(w)
+		return
+	}
+	defer p.release(id, u)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	w.Header().Set("Location", uploadLocation(name, id))
+	w.Header().Set("Range", fmt.Sprintf("0-%d", u.size-1))
+	w.Header().Set("Docker-Upload-UUID", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *pusher) finishUpload(w http.ResponseWriter, r *http.Request, name string, id string) {
+	ctx := r.Context()
+
+	d, err := digest.Parse(r.URL.Query().Get("digest"))
+	if err != nil {
+		regError(http.StatusBadRequest, ErrDigestInvalid, "invalid digest").write(w)
+		return
+	}
+
+	u, ok := p.upload(id)
+	if !ok {
+		regError(http.StatusNotFound, ErrBlobUploadUnknown, "blob upload unknown").write(w)
+		return
+	}
+	defer p.cancel(id)
+	defer p.release(id, u)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err := p.write(u, r.Body); err != nil {
+		writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+		return
+	}
+
+	if _, err := u.f.Seek(0, io.SeekStart); err != nil {
+		writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+		return
+	}
+
+	got, err := d.Algorithm().FromReader(u.f)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+		return
+	}
+
+	if got != d {
+		regError(http.StatusBadRequest, ErrDigestInvalid, "digest mismatch, got %s", got).write(w)
+		return
+	}
+
+	if _, err := u.f.Seek(0, io.SeekStart); err != nil {
+		writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+		return
+	}
+
+	c, err := p.writeUpload(ctx, u)
+	if err != nil {
+		regError(http.StatusInternalServerError, ErrBlobUploadInvalid, "writing blob to ipfs: %v", err).write(w)
+		return
+	}
+
+	if err := p.blobs.Put(ctx, v1.Hash{Algorithm: d.Algorithm().String(), Hex: d.Encoded()}, c); err != nil {
+		writeError(w, fmt.Errorf("indexing blob: %v", err), http.StatusInternalServerError, ErrUnknown)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, d))
+	w.Header().Set("Docker-Content-Digest", d.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// writeUpload writes the completed upload u to ipfs, as a raw block when it's small enough to be one
+func (p *pusher) writeUpload(ctx context.Context, u *upload) (cid.Cid, error) {
+	if u.size <= MaxRawBlockSize {
+		data, err := io.ReadAll(u.f)
+		if err != nil {
+			return cid.Undef, err
+		}
+		return writeBlob(ctx, p.client, data)
+	}
+
+	rp, err := p.client.Unixfs().Add(ctx, files.NewReaderFile(u.f), addOpts...)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return rp.Cid(), nil
+}
+
+// write appends a chunk to u, refusing to grow it beyond the largest blob accepted
+func (p *pusher) write(u *upload, chunk io.Reader) error {
+	if p.maxUploadSize > 0 {
+		chunk = io.LimitReader(chunk, p.maxUploadSize-u.size+1)
+	}
+
+	n, err := io.Copy(u.f, chunk)
+	u.size += n
+	if err != nil {
+		return err
+	}
+
+	if p.maxUploadSize > 0 && u.size > p.maxUploadSize {
+		return regError(http.StatusRequestEntityTooLarge, ErrSizeInvalid, "blob is larger than %d bytes", p.maxUploadSize)
+	}
+	return nil
+}
+
+func (p *pusher) cancelUpload(w http.ResponseWriter, r *http.Request, id string) {
+	u, ok := p.upload(id)
+	if !ok {
+		regError(http.StatusNotFound, ErrBlobUploadUnknown, "blob upload unknown").write(w)
+		return
+	}
+
+	p.release(id, u)
+	p.cancel(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getBlob serves blobs pushed to this registry, which clients check for before uploading them again
+func (p *pusher) getBlob(w http.ResponseWriter, r *http.Request, ref string) {
+	d, err := digest.Parse(ref)
+	if err != nil {
+		regError(http.StatusBadRequest, ErrDigestInvalid, "invalid digest").write(w)
+		return
+	}
+
+	c, ok, err := p.blob(r.Context(), d)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+		return
+	}
+
+	if !ok {
+		regError(http.StatusNotFound, ErrBlobUnknown, "blob unknown").write(w)
+		return
+	}
+
+	f, err := ipfs{client: p.client}.open(r.Context(), c)
+	if err != nil {
+		writeError(w, err, http.StatusNotFound, ErrBlobUnknown)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Docker-Content-Digest", d.String())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+func (p *pusher) putManifest(w http.ResponseWriter, r *http.Request, reference string) {
+	ctx := r.Context()
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, p.maxManifestSize+1))
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest, ErrManifestInvalid)
+		return
+	}
+
+	if int64(len(data)) > p.maxManifestSize {
+		regError(http.StatusRequestEntityTooLarge, ErrSizeInvalid, "manifest is larger than %d bytes", p.maxManifestSize).write(w)
+		return
+	}
+
+	d := digest.FromBytes(data)
+	if rd, err := digest.Parse(reference); err == nil && rd != d {
+		regError(http.StatusBadRequest, ErrDigestInvalid, "manifest digest doesn't match its reference").write(w)
+		return
+	}
+
+	switch mt := types.MediaType(r.Header.Get("Content-Type")); mt {
+	case types.OCIManifestSchema1, types.DockerManifestSchema2:
+	default:
+		regError(http.StatusBadRequest, ErrManifestInvalid, "unsupported manifest media type %s", mt).write(w)
+		return
+	}
+
+	m := &ociManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		regError(http.StatusBadRequest, ErrManifestInvalid, "invalid manifest: %v", err).write(w)
+		return
+	}
+
+	cidMap := make(map[v1.Hash]cid.Cid)
+	for _, desc := range append([]v1.Descriptor{m.Config}, m.Layers...) {
+		c, ok, err := p.blob(ctx, digest.Digest(desc.Digest.String()))
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+			return
+		}
+
+		if !ok {
+			regError(http.StatusBadRequest, ErrManifestBlobUnknown, "blob unknown %s", desc.Digest).write(w)
+			return
+		}
+		cidMap[desc.Digest] = c
+	}
+
+	root, err := writeImage(ctx, p.client, m, cidMap)
+	if err != nil {
+		regError(http.StatusInternalServerError, ErrUnknown, "writing image to ipfs: %v", err).write(w)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/ipfs/%s/manifests/latest", root.Cid()))
+	w.Header().Set("Docker-Content-Digest", d.String())
+	w.Header().Set(RootCidHeader, root.Cid().String())
+	if m.Subject != nil {
+		// Tells clients the subject was understood, so they needn't maintain a referrers tag themselves
+		w.Header().Set("OCI-Subject", m.Subject.Digest.String())
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// blob returns the cid the blob of d was pushed as, so long as it's still pinned
+func (p *pusher) blob(ctx context.Context, d digest.Digest) (cid.Cid, bool, error) {
+	c, ok := p.blobs.Get(ctx, v1.Hash{Algorithm: d.Algorithm().String(), Hex: d.Encoded()})
+	if !ok {
+		return cid.Undef, false, nil
+	}
+
+	pinned, err := stored(ctx, p.client, c)
+	if err != nil {
+		return cid.Undef, false, err
+	}
+	return c, pinned, nil
+}
+
+func (p *pusher) newUpload() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	// The completed uploads are indexed beneath the uploads themselves
+	if err := os.MkdirAll(filepath.Join(p.dir, "blobs"), os.ModePerm); err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.uploads) >= p.maxUploads {
+		return "", regError(http.StatusTooManyRequests, ErrTooManyRequests, "too many uploads in progress, at most %d", p.maxUploads)
+	}
+
+	f, err := os.Create(filepath.Join(p.dir, id))
+	if err != nil {
+		return "", err
+	}
+
+	p.uploads[id] = &upload{f: f, expiry: time.AfterFunc(p.uploadTTL, func() { p.expire(id) })}
+	return id, nil
+}
+
+// upload returns the upload of id, which doesn't expire until the request it's returned to releases it
+func (p *pusher) upload(id string) (*upload, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u, ok := p.uploads[id]
+	if ok {
+		u.requests++
+	}
+	return u, ok
+}
+
+// release ends a request for the upload of id, which expires once it has gone without one for the ttl
+func (p *pusher) release(id string, u *upload) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u.requests--
+	if u.requests == 0 {
+		u.expiry.Reset(p.uploadTTL)
+	}
+}
+
+// expire abandons the upload of id unless a request for it is in progress, which resets its expiry once released
+func (p *pusher) expire(id string) {
+	p.remove(id, func(u *upload) bool { return u.requests == 0 })
+}
+
+func (p *pusher) cancel(id string) {
+	p.remove(id, func(*upload) bool { return true })
+}
+
+// remove closes and removes the upload of id when it's still in progress and should be
+func (p *pusher) remove(id string, should func(u *upload) bool) {
+	p.mu.Lock()
+	u, ok := p.uploads[id]
+	if !ok || !should(u) {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.uploads, id)
+	p.mu.Unlock()
+
+	u.expiry.Stop()
+	u.f.Close()
+	os.Remove(u.f.Name())
+}
+
+func uploadLocation(name string, id string) string {
+	return fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id)
+}
@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	iopts "github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/multiformats/go-multihash"
+	"github.com/opencontainers/go-digest"
+)
+
+// MaxRawBlockSize is the largest blob written as a single raw block, rather than a unixfs dag. A raw block's cid is
+// the blob's sha256 digest, so it's found without walking anything, and peers still exchange it whole.
+const MaxRawBlockSize = 1 << 20
+
+// digestCid returns the cid of the raw block a blob of d is written as, which only sha256 digests have
+func digestCid(d digest.Digest) (cid.Cid, bool) {
+	if d.Validate() != nil || d.Algorithm() != digest.SHA256 {
+		return cid.Undef, false
+	}
+
+	sum, err := hex.DecodeString(d.Encoded())
+	if err != nil {
+		return cid.Undef, false
+	}
+
+	mh, err := multihash.Encode(sum, multihash.SHA2_256)
+	if err != nil {
+		return cid.Undef, false
+	}
+	return cid.NewCidV1(cid.Raw, mh), true
+}
+
+// writeBlob writes (and pins) data as a raw block when it's small enough to be one, and as a unixfs file otherwise
+func writeBlob(ctx context.Context, api iface.CoreAPI, data []byte) (cid.Cid, error) {
+	if len(data) > MaxRawBlockSize {
+		p, err := api.Unixfs().Add(ctx, files.NewBytesFile(data), addOpts...)
+		if err != nil {
+			return cid.Undef, err
+		}
+		return p.Cid(), nil
+	}
+
+	bs, err := api.Block().Put(ctx, bytes.NewReader(data), iopts.Block.Format("raw"), iopts.Block.Pin(true))
+	if err != nil {
+		return cid.Undef, fmt.Errorf("writing raw block: %v", err)
+	}
+	return bs.Path().Cid(), nil
+}
+
+// storedRaw returns the size of the blob of d when it's pinned as a raw block, which is then read straight from the
+// local repo
+func (i ipfs) storedRaw(ctx context.Context, d digest.Digest) (cid.Cid, int64, bool) {
+	c, ok := digestCid(d)
+	if !ok {
+		return cid.Undef, 0, false
+	}
+
+	p := path.IpfsPath(c)
+	if _, pinned, err := i.client.Pin().IsPinned(ctx, p, iopts.Pin.IsPinned.Recursive()); err != nil || !pinned {
+		return cid.Undef, 0, false
+	}
+
+	bs, err := i.client.Block().Stat(ctx, p)
+	if err != nil {
+		return cid.Undef, 0, false
+	}
+	return c, int64(bs.Size()), true
+}
+
+// errReferenced stops walking a root once the blob looked for is found
+var errReferenced = errors.New("referenced")
+
+// references returns the media type of the blob of d when the manifests of rootc reference it, only walking them
+// until it's found. Raw blocks are pinned by whichever image added them, so this keeps them from being read through
+// the root of any other image.
+func (i ipfs) references(ctx context.Context, rootc cid.Cid, d digest.Digest) (string, bool, error) {
+	var mt string
+	err := i.walk(ctx, rootc, func(_ cid.Cid, ed digest.Digest, emt string, _ int64) error {
+		if ed != d {
+			return nil
+		}
+		mt = emt
+		return errReferenced
+	})
+	if err == errReferenced {
+		return mt, true, nil
+	}
+	return "", false, err
+}
@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// RequestRecord is the metadata (never the body) of a single registry request and its response. Ranged responses
+// record the part of the content served, such as the rest of a layer a resumed pull was missing.
+type RequestRecord struct {
+	Time         time.Time     `json:"time"`
+	Method       string        `json:"method"`
+	Path         string        `json:"path"`
+	Host         string        `json:"host"`
+	RemoteAddr   string        `json:"remoteAddr"`
+	UserAgent    string        `json:"userAgent,omitempty"`
+	Accept       string        `json:"accept,omitempty"`
+	Range        string        `json:"range,omitempty"`
+	ContentRange string        `json:"contentRange,omitempty"`
+	Status       int           `json:"status"`
+	Bytes        int           `json:"bytes"`
+	MediaType    string        `json:"mediaType,omitempty"`
+	Duration     time.Duration `json:"duration"`
+}
+
+// Recorder keeps the most recent requests in a fixed size ring buffer
+type Recorder struct {
+	mu      sync.Mutex
+	records []RequestRecord
+	next    int
+	full    bool
+}
+
+// NewRecorder returns a Recorder holding up to size requests
+func NewRecorder(size int) *Recorder {
+	return &Recorder{records: make([]RequestRecord, size)}
+}
+
+// Middleware records every request passing through next
+func (rec *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		defer func() {
+			rec.add(RequestRecord{
+				Time:         start,
+				Method:       r.Method,
+				Path:         r.URL.Path,
+				Host:         r.Host,
+				RemoteAddr:   r.RemoteAddr,
+				UserAgent:    r.UserAgent(),
+				Accept:       r.Header.Get("Accept"),
+				Range:        r.Header.Get("Range"),
+				Status:       ww.Status(),
+				Bytes:        ww.BytesWritten(),
+				MediaType:    ww.Header().Get("Content-Type"),
+				Duration:     time.Since(start),
+				ContentRange: ww.Header().Get("Content-Range"),
+			})
+		}()
+
+		next.ServeHTTP(ww, r)
+	})
+}
+
+// Records returns the recorded requests, oldest first
+func (rec *Recorder) Records() []RequestRecord {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if !rec.full {
+		return append([]RequestRecord{}, rec.records[:rec.next]...)
+	}
+	return append(append([]RequestRecord{}, rec.records[rec.next:]...), rec.records[:rec.next]...)
+}
+
+// ServeHTTP serves the recorded requests as json
+func (rec *Recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec.Records())
+}
+
+func (rec *Recorder) add(r RequestRecord) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if len(rec.records) == 0 {
+		return
+	}
+
+	rec.records[rec.next] = r
+	rec.next = (rec.next + 1) % len(rec.records)
+	if rec.next == 0 {
+		rec.full = true
+	}
+}
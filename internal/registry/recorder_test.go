@@ -0,0 +1,32 @@
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	rec := NewRecorder(2)
+	h := rec.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	for _, target := range []string{"/v2/a", "/v2/b", "/v2/c"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	records := rec.Records()
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+
+	// The oldest request should have been evicted
+	if records[0].Path != "/v2/b" || records[1].Path != "/v2/c" {
+		t.Errorf("unexpected records: %s, %s", records[0].Path, records[1].Path)
+	}
+
+	if records[0].Status != http.StatusTeapot {
+		t.Errorf("expected status %d, got %d", http.StatusTeapot, records[0].Status)
+	}
+}
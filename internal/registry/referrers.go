@@ -0,0 +1,146 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/ipfs/go-cid"
+	"github.com/opencontainers/go-digest"
+)
+
+// Referrer describes an artifact (such as a signature, attestation or sbom) whose manifest refers to a subject
+// ref: https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-referrers
+type Referrer struct {
+	MediaType    types.MediaType   `json:"mediaType"`
+	Digest       digest.Digest     `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// ReferrersReader finds the artifacts within an image root that refer to a subject
+type ReferrersReader interface {
+	Referrers(ctx context.Context, name string, subject digest.Digest) ([]Referrer, error)
+}
+
+// Referrers returns every manifest within the root name whose subject is subject
+func (i ipfs) Referrers(ctx context.Context, name string, subject digest.Digest) ([]Referrer, error) {
+	rootc, err := cid.Decode(name)
+	if err != nil {
+		return nil, regError(http.StatusBadRequest, ErrNameInvalid, "invalid cid %s: %v", name, err)
+	}
+
+	entries, err := i.entries(ctx, rootc)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []Referrer
+	for d, e := range entries {
+		switch types.MediaType(e.MediaType) {
+		case types.OCIManifestSchema1, types.DockerManifestSchema2:
+		default:
+			continue
+		}
+
+		f, err := i.open(ctx, e.Cid)
+		if err != nil {
+			return nil, err
+		}
+
+		m := ociManifest{}
+		err = i.decode(f, &m)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if m.Subject == nil || m.Subject.Digest.String() != subject.String() {
+			continue
+		}
+
+		// Artifacts without their own type are typed by their config
+		at := m.ArtifactType
+		if at == "" {
+			at = string(m.Config.MediaType)
+		}
+
+		refs = append(refs, Referrer{
+			MediaType:    types.MediaType(e.MediaType),
+			Digest:       d,
+			Size:         e.Size,
+			ArtifactType: at,
+			Annotations:  m.Annotations,
+		})
+	}
+	return refs, nil
+}
+
+// serveReferrers serves an index of every artifact mapped to repo that refers to subject, optionally filtered by
+// artifact type. Artifacts are added (and mapped) alongside the images they're attached to, such as cosign's
+// sha256-<digest>.sig tags.
+func (i *IpfsRegistry) serveReferrers(w http.ResponseWriter, r *http.Request, repo string, reference string) {
+	ctx := r.Context()
+
+	subject, err := digest.Parse(reference)
+	if err != nil {
+		regError(http.StatusBadRequest, ErrDigestInvalid, "invalid digest: %v", err).write(w)
+		return
+	}
+
+	rr, ok := i.reader.(ReferrersReader)
+	if !ok {
+		regError(http.StatusNotFound, ErrUnsupported, "referrers aren't supported").write(w)
+		return
+	}
+
+	_, mappings, err := i.mapper.Mappings(ctx)
+	if err != nil {
+		writeError(w, err, http.StatusServiceUnavailable, ErrUnavailable)
+		return
+	}
+
+	_, roots := repositoryRoots(mappings, repo)
+
+	var (
+		refs = []Referrer{}
+		seen = make(map[digest.Digest]bool)
+	)
+	for _, root := range roots {
+		found, err := rr.Referrers(ctx, root.String(), subject)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+			return
+		}
+
+		for _, ref := range found {
+			if !seen[ref.Digest] {
+				seen[ref.Digest] = true
+				refs = append(refs, ref)
+			}
+		}
+	}
+
+	if at := r.URL.Query().Get("artifactType"); at != "" {
+		filtered := []Referrer{}
+		for _, ref := range refs {
+			if ref.ArtifactType == at {
+				filtered = append(filtered, ref)
+			}
+		}
+		refs = filtered
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+
+	sort.Slice(refs, func(a, b int) bool { return refs[a].Digest < refs[b].Digest })
+
+	w.Header().Set("Content-Type", string(types.OCIImageIndex))
+	json.NewEncoder(w).Encode(struct {
+		SchemaVersion int64           `json:"schemaVersion"`
+		MediaType     types.MediaType `json:"mediaType"`
+		Manifests     []Referrer      `json:"manifests"`
+	}{SchemaVersion: 2, MediaType: types.OCIImageIndex, Manifests: refs})
+}
@@ -7,27 +7,34 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/httplog"
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/ipfs/go-cid"
 	files "github.com/ipfs/go-ipfs-files"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/ipfs/interface-go-ipfs-core/path"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/singleflight"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const (
 	ipfsSchemePrefix = "ipfs"
 )
 
-// Reader defines data implementations that can satisfy all of a registry's read operations
+// Reader defines data implementations that can satisfy all of a registry's read operations. Content is returned as
+// a stream the caller must close, which is only read from ipfs as it's consumed, so serving any number of (multi GB)
+// layers at once never holds more than a read buffer of each in memory.
 type Reader interface {
-	ReadManifest(ctx context.Context, name string, reference string) (io.ReadSeeker, string, error)
+	ReadManifest(ctx context.Context, name string, reference string) (io.ReadSeekCloser, string, error)
 
-	ReadBlob(ctx context.Context, name string, d digest.Digest) (io.ReadSeeker, string, error)
+	ReadBlob(ctx context.Context, name string, d digest.Digest) (io.ReadSeekCloser, string, error)
 }
 
 // IpfsRegistry is a registry backed by ipfs
@@ -35,23 +42,131 @@ type IpfsRegistry struct {
 	Router *chi.Mux
 
 	reader Reader
-	mapper CidMapper
+	mapper ListingCidMapper
+
+	cluster          client.Reader
+	clusterNamespace string
+
+	maxManifestSize int64
 }
 
 type IpfsRegistryOpts struct {
+	// MapIpnsCid is the ipns name of the reference => cid mappings used to list (and resolve) images by name
 	MapIpnsCid string
+
+	// Mapper overrides the mapper otherwise built from MapIpnsCid
+	Mapper ListingCidMapper
+
+	// Index persists the digest => cid mappings discovered while walking image roots
+	Index Index
+
+	// IndexCacheSize is the number of image roots whose mappings are kept in memory in front of Index, defaults to
+	// DefaultIndexCacheSize and negative disables it
+	IndexCacheSize int
+
+	// RecordRequests is the number of recent requests to keep for debugging, zero disables recording
+	RecordRequests int
+
+	// AllowPush enables the distribution push flow, pushed images are served by the root cid returned on push
+	AllowPush bool
+
+	// AllowDelete enables deleting images by their root cid and root manifest digest, unpinning everything they
+	// reference that no mapped image also does
+	AllowDelete bool
+
+	// Cluster lists the roots the cluster holds pinned besides its mappings (see PinnedRoots) in ClusterNamespace,
+	// their content is kept when deleting images
+	Cluster          client.Reader
+	ClusterNamespace string
+
+	// Gateway serves the raw content of pinned cids at /ipfs/<cid>, a read only gateway for tooling that reads by cid
+	Gateway bool
+
+	// UploadDir buffers in progress blob uploads, defaults to a temporary directory
+	UploadDir string
+
+	// MaxManifestSize is the largest manifest (or config) read into memory, whether pushed or served, defaults to
+	// DefaultMaxManifestSize
+	MaxManifestSize int64
+
+	// MaxUploadSize is the largest blob accepted by a push, unlimited when zero
+	MaxUploadSize int64
+
+	// UploadTTL is how long a blob upload may go without a request before it's abandoned and its buffer removed,
+	// defaults to DefaultUploadTTL
+	UploadTTL time.Duration
+
+	// MaxUploads is the number of blob uploads in progress at once, further ones are refused until they complete or
+	// expire, defaults to DefaultMaxUploads
+	MaxUploads int
+
+	// Auth optionally gates every request, such as with an HtpasswdAuth or TokenAuth
+	Auth Authenticator
 }
 
 func NewIpfsRegistry(client iface.CoreAPI, opts *IpfsRegistryOpts) *IpfsRegistry {
 	r := chi.NewRouter()
 	r.Use(httplog.RequestLogger(httplog.NewLogger("ripfs", httplog.DefaultOptions)))
 
-	reg := &IpfsRegistry{}
-	reader := ipfs{client: client}
+	maxManifestSize := opts.MaxManifestSize
+	if maxManifestSize <= 0 {
+		maxManifestSize = DefaultMaxManifestSize
+	}
+
+	reg := &IpfsRegistry{
+		mapper:           opts.Mapper,
+		cluster:          opts.Cluster,
+		clusterNamespace: opts.ClusterNamespace,
+		maxManifestSize:  maxManifestSize,
+	}
+	if reg.mapper == nil && opts.MapIpnsCid != "" {
+		reg.mapper = NewIpfsCidMapper(client, StaticFetcher(opts.MapIpnsCid))
+	}
+
+	reader := ipfs{client: client, index: opts.Index, walks: &singleflight.Group{}, maxManifestSize: maxManifestSize}
+	if reader.index == nil {
+		reader.index = nopIndex{}
+	}
+
+	switch {
+	case opts.IndexCacheSize == 0:
+		reader.index = NewMemoryIndex(DefaultIndexCacheSize, reader.index)
+	case opts.IndexCacheSize > 0:
+		reader.index = NewMemoryIndex(opts.IndexCacheSize, reader.index)
+	}
+	reg.reader = reader
+
+	var rec *Recorder
+	if opts.RecordRequests > 0 {
+		rec = NewRecorder(opts.RecordRequests)
+		r.Use(rec.Middleware)
+	}
+
+	if opts.Auth != nil {
+		r.Use(authMiddleware(opts.Auth))
+	}
+
+	r.Route("/_ripfs", func(r chi.Router) {
+		r.Get("/v1/info", reg.buildInfoHandler())
+		r.Get("/v1/car/{cid:[a-z0-9]+}", reg.buildGetCarHandler(reader))
+		r.Get("/v1/inspect/{cid:[a-z0-9]+}", reg.buildInspectHandler(reader))
+
+		if rec != nil {
+			r.Get("/debug/requests", rec.ServeHTTP)
+		}
+	})
+
+	if opts.Gateway {
+		r.Get("/ipfs/{cid:[a-zA-Z0-9]+}", reg.buildGatewayHandler(reader))
+		r.Head("/ipfs/{cid:[a-zA-Z0-9]+}", reg.buildGatewayHandler(reader))
+	}
 
 	// Health
 	r.Get("/v2/", reg.buildHealthHandler(reader))
 
+	// Catalog
+	r.Get("/v2/_catalog", reg.buildCatalogHandler())
+
 	r.Route("/v2/ipfs/{cid:[a-z0-9]+}", func(r chi.Router) {
 		// HEAD: Manifests
 		r.Head("/manifests/{reference}", reg.buildGetManifestHandler(reader))
@@ -64,8 +179,24 @@ func NewIpfsRegistry(client iface.CoreAPI, opts *IpfsRegistryOpts) *IpfsRegistry
 
 		// GET: Blobs
 		r.Get("/blobs/{reference}", reg.buildGetBlobsHandler(reader))
+
+		if opts.AllowDelete {
+			// DELETE: Manifests
+			r.Delete("/manifests/{reference}", reg.buildDeleteManifestHandler(client, reader))
+
+			// DELETE: Blobs
+			r.Delete("/blobs/{reference}", deleteBlob)
+		}
 	})
 
+	var push http.Handler
+	if opts.AllowPush {
+		push = newPusher(client, opts, maxManifestSize)
+	}
+
+	// Anything with a repository name, which may contain any number of path segments
+	r.HandleFunc("/v2/*", reg.buildNamedHandler(push))
+
 	reg.Router = r
 	return reg
 }
@@ -77,17 +208,91 @@ func (i *IpfsRegistry) buildHealthHandler(rdr Reader) func(w http.ResponseWriter
 	}
 }
 
+func (i *IpfsRegistry) buildNamedHandler(push http.Handler) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, "/v2/")
+
+		read := r.Method == http.MethodGet || r.Method == http.MethodHead
+		if read {
+			rest = mirroredPath(rest, r.URL.Query().Get("ns"))
+		}
+
+		if strings.HasSuffix(rest, "/tags/list") && read {
+			i.serveTags(w, r, strings.TrimSuffix(rest, "/tags/list"))
+			return
+		}
+
+		if n := strings.LastIndex(rest, "/referrers/"); n > 0 && r.Method == http.MethodGet && i.mapper != nil {
+			i.serveReferrers(w, r, rest[:n], rest[n+len("/referrers/"):])
+			return
+		}
+
+		if read && i.mapper != nil && !strings.Contains(rest, "/blobs/uploads") {
+			if n := strings.LastIndex(rest, "/manifests/"); n > 0 {
+				i.serveNamed(w, r, rest[:n], rest[n+len("/manifests/"):], true, push)
+				return
+			}
+
+			if n := strings.LastIndex(rest, "/blobs/"); n > 0 {
+				i.serveNamed(w, r, rest[:n], rest[n+len("/blobs/"):], false, push)
+				return
+			}
+		}
+
+		if push != nil {
+			push.ServeHTTP(w, r)
+			return
+		}
+
+		regError(http.StatusNotFound, ErrNameUnknown, "repository name not known to registry").write(w)
+	}
+}
+
+// mirroredPath returns the path (after /v2/) of a request made to the registry as a mirror of the registry ns, which
+// containerd names in every request it makes to a mirror. Repositories are requested by their name within ns, and are
+// served by the name they're mapped as, prefixed with ns unless it's docker hub.
+func mirroredPath(rest string, ns string) string {
+	if ns == "" {
+		return rest
+	}
+
+	reg, err := name.NewRegistry(ns)
+	if err != nil || reg.RegistryStr() == name.DefaultRegistry {
+		return rest
+	}
+
+	host := reg.RegistryStr()
+	if i := strings.Index(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	return host + "/" + rest
+}
+
 func (i *IpfsRegistry) buildGetManifestHandler(rdr Reader) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		content, mediaType, err := rdr.ReadManifest(ctx, chi.URLParam(r, "cid"), chi.URLParam(r, "reference"))
+		reference := chi.URLParam(r, "reference")
+		content, mediaType, err := rdr.ReadManifest(ctx, chi.URLParam(r, "cid"), reference)
 		if err != nil {
+			writeError(w, err, http.StatusNotFound, ErrManifestUnknown)
 			return
 		}
 
-		w.Header().Set("Content-Type", mediaType)
-		http.ServeContent(w, r, "", time.Now(), content)
+		d, err := digest.Parse(reference)
+		if err != nil {
+			if d, content, err = digestContent(content, i.maxManifestSize); err != nil {
+				writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+				return
+			}
+		}
+
+		if mediaType, content, err = negotiateManifest(w, r, mediaType, content, i.maxManifestSize); err != nil {
+			writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+			return
+		}
+
+		serveContent(w, r, d, mediaType, content)
 	}
 }
 
@@ -97,29 +302,51 @@ func (i *IpfsRegistry) buildGetBlobsHandler(rdr Reader) func(w http.ResponseWrit
 
 		d, err := digest.Parse(chi.URLParam(r, "reference"))
 		if err != nil {
+			regError(http.StatusBadRequest, ErrDigestInvalid, "invalid digest: %v", err).write(w)
 			return
 		}
 
 		content, mediaType, err := rdr.ReadBlob(ctx, chi.URLParam(r, "cid"), d)
 		if err != nil {
+			writeError(w, err, http.StatusNotFound, ErrBlobUnknown)
 			return
 		}
 
-		w.Header().Set("Content-Type", mediaType)
-		http.ServeContent(w, r, "", time.Now(), content)
+		serveContent(w, r, d, mediaType, content)
 	}
 }
 
 type ipfs struct {
 	client iface.CoreAPI
+	index  Index
+
+	// walks dedupes concurrent walks of the same root, such as every layer of an image being pulled at once
+	walks *singleflight.Group
+
+	// maxManifestSize is the largest manifest (or config) decoded, DefaultMaxManifestSize when zero
+	maxManifestSize int64
 }
 
-// ReadManifest returns an io.ReadSeeker for the ipfs backed manifest
+// decode decodes the json of f (such as a manifest) into v, refusing anything larger than a manifest may be
+func (i ipfs) decode(f io.Reader, v interface{}) error {
+	limit := i.maxManifestSize
+	if limit <= 0 {
+		limit = DefaultMaxManifestSize
+	}
+
+	data, err := readManifest(f, limit)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ReadManifest returns a stream of the ipfs backed manifest
 // ref: https://github.com/containerd/stargz-snapshotter/blob/v0.10.0/docs/ipfs.md#ipfs-enabled-oci-image
-func (i ipfs) ReadManifest(ctx context.Context, name string, reference string) (io.ReadSeeker, string, error) {
+func (i ipfs) ReadManifest(ctx context.Context, name string, reference string) (io.ReadSeekCloser, string, error) {
 	c, err := cid.Decode(name)
 	if err != nil {
-		return nil, "", err
+		return nil, "", regError(http.StatusBadRequest, ErrNameInvalid, "invalid cid %s: %v", name, err)
 	}
 
 	if reference == "latest" {
@@ -129,7 +356,7 @@ func (i ipfs) ReadManifest(ctx context.Context, name string, reference string) (
 			return nil, "", err
 		}
 
-		idxc, _, idxmt, err := i.step(rootf)
+		idxc, _, idxmt, _, err := i.step(rootf)
 		if err != nil {
 			return nil, "", err
 		}
@@ -144,47 +371,106 @@ func (i ipfs) ReadManifest(ctx context.Context, name string, reference string) (
 
 	d, err := digest.Parse(reference)
 	if err != nil {
-		return nil, "", fmt.Errorf("reference must either be 'latest' or a valid digest: %v", err)
+		return nil, "", regError(http.StatusNotFound, ErrManifestUnknown, "reference must either be 'latest' or a valid digest: %v", err)
 	}
 
 	// Everything not at the root gets walked
-	return i.ReadBlob(ctx, name, d)
+	content, mediaType, err := i.ReadBlob(ctx, name, d)
+	if re, ok := err.(*Error); ok && re.Code == ErrBlobUnknown {
+		return nil, "", regError(http.StatusNotFound, ErrManifestUnknown, "manifest unknown %s", d)
+	}
+	return content, mediaType, err
 }
 
-func (i ipfs) ReadBlob(ctx context.Context, name string, d digest.Digest) (io.ReadSeeker, string, error) {
+// ReadBlob returns a stream of anything reachable from the root name by its digest, nothing is fetched from ipfs
+// until it's first read. Blobs pinned as raw blocks (manifests, configs and small layers) are found by their digest
+// without indexing the root, once its manifests are found to reference them.
+func (i ipfs) ReadBlob(ctx context.Context, name string, d digest.Digest) (io.ReadSeekCloser, string, error) {
 	rootc, err := cid.Decode(name)
 	if err != nil {
-		return nil, "", err
+		return nil, "", regError(http.StatusBadRequest, ErrNameInvalid, "invalid cid %s: %v", name, err)
 	}
 
-	var (
-		found  bool
-		fcid   cid.Cid
-		fmtype string
-	)
+	entries, ok := i.index.Get(ctx, rootc)
+	if !ok {
+		if c, size, ok := i.storedRaw(ctx, d); ok {
+			mt, ok, err := i.references(ctx, rootc, d)
+			if err != nil {
+				return nil, "", err
+			}
+			if !ok {
+				return nil, "", regError(http.StatusNotFound, ErrBlobUnknown, "blob %s not found within %s", d, rootc)
+			}
+			return i.lazy(ctx, c, size), mt, nil
+		}
 
-	if err := i.walk(ctx, rootc, func(c cid.Cid, _d digest.Digest, mt string) error {
-		if d == _d {
-			found = true
-			fcid = c
-			fmtype = mt
+		if entries, err = i.entries(ctx, rootc); err != nil {
+			return nil, "", err
 		}
+	}
 
-		return nil
-	}); err != nil {
-		return nil, "", err
+	e, ok := entries[d]
+	if !ok {
+		return nil, "", regError(http.StatusNotFound, ErrBlobUnknown, "blob %s not found within %s", d, rootc)
+	}
+
+	// Entries indexed before sizes were recorded are opened up front to learn it
+	if e.Size == 0 {
+		ff, err := i.open(ctx, e.Cid)
+		if err != nil {
+			return nil, "", err
+		}
+		return ff, e.MediaType, nil
+	}
+
+	return i.lazy(ctx, e.Cid, e.Size), e.MediaType, nil
+}
+
+// lazy returns a stream of the size bytes at c, only opened once it's first read
+func (i ipfs) lazy(ctx context.Context, c cid.Cid, size int64) io.ReadSeekCloser {
+	return &lazyFile{
+		ctx:  ctx,
+		size: size,
+		open: func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+			return i.openAt(ctx, c, offset)
+		},
+	}
+}
+
+// entries returns everything reachable from rootc, only walking the root when it isn't already indexed
+func (i ipfs) entries(ctx context.Context, rootc cid.Cid) (Entries, error) {
+	if e, ok := i.index.Get(ctx, rootc); ok {
+		return e, nil
 	}
 
-	if !found {
-		return nil, "", fmt.Errorf("didn't find desired digest %s", d.String())
+	if i.walks == nil {
+		return i.walkEntries(ctx, rootc)
 	}
 
-	ff, err := i.open(ctx, fcid)
+	e, err, _ := i.walks.Do(rootc.KeyString(), func() (interface{}, error) {
+		return i.walkEntries(ctx, rootc)
+	})
 	if err != nil {
-		return nil, "", err
+		return nil, err
+	}
+	return e.(Entries), nil
+}
+
+// walkEntries walks rootc, indexing everything reachable from it
+func (i ipfs) walkEntries(ctx context.Context, rootc cid.Cid) (Entries, error) {
+	e := make(Entries)
+	if err := i.walk(ctx, rootc, func(c cid.Cid, d digest.Digest, mt string, size int64) error {
+		e[d] = IndexEntry{Cid: c, MediaType: mt, Size: size}
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
-	return ff, fmtype, nil
+	// The index only saves walking rootc again, failing to persist it mustn't fail the read
+	if err := i.index.Put(ctx, rootc, e); err != nil {
+		zerolog.Ctx(ctx).Warn().Msgf("indexing %s: %v", rootc, err)
+	}
+	return e, nil
 }
 
 func (i ipfs) open(ctx context.Context, c cid.Cid) (files.File, error) {
@@ -201,7 +487,7 @@ func (i ipfs) open(ctx context.Context, c cid.Cid) (files.File, error) {
 }
 
 func (i ipfs) resolveCids(urls []string) (cid.Cid, error) {
-	if len(urls) > 1 {
+	if len(urls) != 1 {
 		return cid.Cid{}, fmt.Errorf("expected a single cid, got %d", len(urls))
 	}
 
@@ -220,23 +506,28 @@ func (i ipfs) resolveCids(urls []string) (cid.Cid, error) {
 type catch struct {
 	MediaType string   `json:"mediaType"`
 	Digest    string   `json:"digest,omitempty"`
+	Size      int64    `json:"size,omitempty"`
 	URLs      []string `json:"urls,omitempty"`
 	Manifests []struct {
 		MediaType string   `json:"mediaType,omitempty"`
 		Digest    string   `json:"digest,omitempty"`
+		Size      int64    `json:"size,omitempty"`
 		URLs      []string `json:"urls,omitempty"`
 	} `json:"manifests,omitempty"`
 }
 
-func (i ipfs) walk(ctx context.Context, rootc cid.Cid, fn func(c cid.Cid, d digest.Digest, mt string) error) error {
+func (i ipfs) walk(ctx context.Context, rootc cid.Cid, fn func(c cid.Cid, d digest.Digest, mt string, size int64) error) error {
 	rootf, err := i.open(ctx, rootc)
 	if err != nil {
 		return err
 	}
 
-	idxc, idxd, idxmt, err := i.step(rootf)
+	idxc, idxd, idxmt, idxsize, err := i.step(rootf)
+	if err != nil {
+		return err
+	}
 
-	if err := fn(idxc, idxd, idxmt); err != nil {
+	if err := fn(idxc, idxd, idxmt, idxsize); err != nil {
 		return err
 	}
 
@@ -244,23 +535,51 @@ func (i ipfs) walk(ctx context.Context, rootc cid.Cid, fn func(c cid.Cid, d dige
 	if err != nil {
 		return err
 	}
+	defer idxf.Close()
 
-	mc, md, mmt, err := i.step(idxf)
-	if err != nil {
+	var idx catch
+	if err := i.decode(idxf, &idx); err != nil {
 		return err
 	}
 
-	if err := fn(mc, md, mmt); err != nil {
-		return err
+	if len(idx.Manifests) == 0 {
+		return fmt.Errorf("index %s doesn't contain any manifests", idxc)
+	}
+
+	// Multi platform images have one manifest per platform
+	for _, desc := range idx.Manifests {
+		mc, err := i.resolveCids(desc.URLs)
+		if err != nil {
+			return err
+		}
+
+		md, err := digest.Parse(desc.Digest)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(mc, md, desc.MediaType, desc.Size); err != nil {
+			return err
+		}
+
+		if err := i.walkManifest(ctx, mc, fn); err != nil {
+			return err
+		}
 	}
 
+	return nil
+}
+
+// walkManifest visits a manifest's config and layers
+func (i ipfs) walkManifest(ctx context.Context, mc cid.Cid, fn func(c cid.Cid, d digest.Digest, mt string, size int64) error) error {
 	mf, err := i.open(ctx, mc)
 	if err != nil {
 		return err
 	}
+	defer mf.Close()
 
 	var m v1.Manifest
-	if err := json.NewDecoder(mf).Decode(&m); err != nil {
+	if err := i.decode(mf, &m); err != nil {
 		return err
 	}
 
@@ -269,7 +588,7 @@ func (i ipfs) walk(ctx context.Context, rootc cid.Cid, fn func(c cid.Cid, d dige
 		return err
 	}
 
-	if err := fn(cc, m.Config.Digest, m.Config.MediaType); err != nil {
+	if err := fn(cc, m.Config.Digest, m.Config.MediaType, m.Config.Size); err != nil {
 		return err
 	}
 
@@ -279,7 +598,7 @@ func (i ipfs) walk(ctx context.Context, rootc cid.Cid, fn func(c cid.Cid, d dige
 			return err
 		}
 
-		if err := fn(lc, layer.Digest, layer.MediaType); err != nil {
+		if err := fn(lc, layer.Digest, layer.MediaType, layer.Size); err != nil {
 			return err
 		}
 	}
@@ -288,37 +607,46 @@ func (i ipfs) walk(ctx context.Context, rootc cid.Cid, fn func(c cid.Cid, d dige
 }
 
 // step will search for a digest one step down, and will return a cid if found
-func (i ipfs) step(f files.File) (cid.Cid, digest.Digest, string, error) {
+func (i ipfs) step(f files.File) (cid.Cid, digest.Digest, string, int64, error) {
+	defer f.Close()
+
 	var robj catch
-	if err := json.NewDecoder(f).Decode(&robj); err != nil {
-		return cid.Cid{}, "", "", err
+	if err := i.decode(f, &robj); err != nil {
+		return cid.Cid{}, "", "", 0, err
 	}
 
 	var (
 		ds   string
+		mt   string
+		size int64
 		urls []string
 	)
 
 	if robj.URLs != nil {
 		ds = robj.Digest
+		mt = robj.MediaType
+		size = robj.Size
 		urls = robj.URLs
 	} else if len(robj.Manifests) == 1 {
+		// The descriptor's media type is the manifest's, not the index's
 		ds = robj.Manifests[0].Digest
+		mt = robj.Manifests[0].MediaType
+		size = robj.Manifests[0].Size
 		urls = robj.Manifests[0].URLs
 	} else {
-		return cid.Cid{}, "", "", fmt.Errorf("nope")
+		return cid.Cid{}, "", "", 0, fmt.Errorf("%w: expected a descriptor or an index of a single manifest, got %d manifests", ErrInvalidReference, len(robj.Manifests))
 	}
 
 	c, err := i.resolveCids(urls)
 	if err != nil {
-		return cid.Cid{}, "", "", err
+		return cid.Cid{}, "", "", 0, err
 	}
 
 	d, err := digest.Parse(ds)
 	if err != nil {
-		return cid.Cid{}, "", "", err
+		return cid.Cid{}, "", "", 0, err
 	}
 
-	return c, d, robj.MediaType, nil
+	return c, d, mt, size, nil
 
 }
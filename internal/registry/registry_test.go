@@ -1,18 +1,39 @@
 package registry
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/ipfs/go-cid"
 	config "github.com/ipfs/go-ipfs-config"
 	files "github.com/ipfs/go-ipfs-files"
 	"github.com/ipfs/go-ipfs/core"
@@ -21,9 +42,24 @@ import (
 	"github.com/ipfs/go-ipfs/plugin/loader"
 	"github.com/ipfs/go-ipfs/repo/fsrepo"
 	iface "github.com/ipfs/interface-go-ipfs-core"
+	iopts "github.com/ipfs/interface-go-ipfs-core/options"
 	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/multiformats/go-multihash"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 
+	"github.com/joshrwolf/ripfs/api/v1alpha1"
 	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/faults"
+	"github.com/joshrwolf/ripfs/internal/platform"
+	"github.com/joshrwolf/ripfs/internal/verify"
 )
 
 func TestServe(t *testing.T) {
@@ -57,7 +93,7 @@ func TestServe(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	s := NewIpfsRegistry(client)
+	s := NewIpfsRegistry(client, &IpfsRegistryOpts{})
 
 	tests := []struct {
 		name    string
@@ -103,24 +139,29 @@ func TestServe(t *testing.T) {
 	}
 }
 
+var pluginsOnce sync.Once
+
 func testingIpfs(t *testing.T, ctx context.Context) iface.CoreAPI {
 	tmp, err := os.MkdirTemp("", consts.Name)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	plugins, err := loader.NewPluginLoader("")
-	if err != nil {
-		t.Fatal(err)
-	}
+	// Plugins can only be injected once per process
+	pluginsOnce.Do(func() {
+		plugins, err := loader.NewPluginLoader("")
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	if err := plugins.Initialize(); err != nil {
-		t.Fatal(err)
-	}
+		if err := plugins.Initialize(); err != nil {
+			t.Fatal(err)
+		}
 
-	if err := plugins.Inject(); err != nil {
-		t.Fatal(err)
-	}
+		if err := plugins.Inject(); err != nil {
+			t.Fatal(err)
+		}
+	})
 
 	cfg, err := config.Init(ioutil.Discard, 2048)
 	if err != nil {
@@ -160,10 +201,3990 @@ func addImage(t *testing.T, ctx context.Context, client iface.CoreAPI) (v1.Image
 		t.Fatal(err)
 	}
 
-	p, err := AddImage(ctx, client, img)
+	p, err := AddImage(ctx, client, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return img, p
+}
+
+// addLargeImage adds an image whose layers are too large to be raw blocks, so they're only found by walking its root
+func addLargeImage(t *testing.T, ctx context.Context, client iface.CoreAPI) (v1.Image, path.Resolved) {
+	img, err := random.Image(MaxRawBlockSize+1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := AddImage(ctx, client, img, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	return img, p
 }
+
+func TestFileIndex(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, p := addLargeImage(t, ctx, client)
+
+	tmp, err := os.MkdirTemp("", consts.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	idx, err := NewFileIndex(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := idx.Get(ctx, p.Cid()); ok {
+		t.Fatalf("expected empty index for %s", p.Cid())
+	}
+
+	s := NewIpfsRegistry(client, &IpfsRegistryOpts{Index: idx})
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v2/ipfs/%s/blobs/%s", p.Cid().String(), h.String()), nil)
+	rr := httptest.NewRecorder()
+	s.Router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	// A fresh index over the same directory should see what was persisted by the walk
+	reopened, err := NewFileIndex(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok := reopened.Get(ctx, p.Cid())
+	if !ok {
+		t.Fatalf("expected persisted entries for %s", p.Cid())
+	}
+
+	if _, ok := e[digest.Digest(h.String())]; !ok {
+		t.Errorf("expected layer %s to be indexed", h)
+	}
+}
+
+func TestFileIndexUnwritable(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, p := addLargeImage(t, ctx, client)
+
+	tmp, err := os.MkdirTemp("", consts.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := NewFileIndex(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Persisting the walk fails, but the blob is still served
+	if err := os.RemoveAll(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewIpfsRegistry(client, &IpfsRegistryOpts{Index: idx})
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v2/ipfs/%s/blobs/%s", p.Cid().String(), h.String()), nil)
+	rr := httptest.NewRecorder()
+	s.Router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestCarTransfer(t *testing.T) {
+	ctx := context.Background()
+
+	src := testingIpfs(t, ctx)
+	dst := testingIpfs(t, ctx)
+
+	img, p := addImage(t, ctx, src)
+
+	ts := httptest.NewServer(NewIpfsRegistry(src, &IpfsRegistryOpts{}).Router)
+	defer ts.Close()
+
+	reg, err := name.NewRegistry(strings.TrimPrefix(ts.URL, "http://"), name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := ProbeRipfs(ctx, reg, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || len(info.Transfers) == 0 || info.Transfers[0] != TransferCar {
+		t.Fatalf("expected car transfers, got %v", info)
+	}
+
+	rp, err := ImportRemoteCar(ctx, dst, reg, p.Cid(), http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !rp.Cid().Equals(p.Cid()) {
+		t.Fatalf("expected root %s, got %s", p.Cid(), rp.Cid())
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything should now be served by the destination alone
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v2/ipfs/%s/blobs/%s", p.Cid(), h), nil)
+	rr := httptest.NewRecorder()
+	NewIpfsRegistry(dst, &IpfsRegistryOpts{}).Router.ServeHTTP(rr, req)
+
+	got, _, err := v1.SHA256(rr.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != h {
+		t.Fatalf("expected blob %s, got %s", h, got)
+	}
+}
+
+func TestCarFile(t *testing.T) {
+	ctx := context.Background()
+
+	src := testingIpfs(t, ctx)
+	dst := testingIpfs(t, ctx)
+
+	_, p := addImage(t, ctx, src)
+
+	var buf bytes.Buffer
+	if err := ExportCar(ctx, src, p.Cid(), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	rp, err := ImportCar(ctx, dst, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !rp.Cid().Equals(p.Cid()) {
+		t.Fatalf("expected root %s, got %s", p.Cid(), rp.Cid())
+	}
+
+	refs, err := References(ctx, dst, rp.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every object is pinned on its own, just as when added directly
+	for _, c := range refs {
+		if _, ok, err := dst.Pin().IsPinned(ctx, path.IpfsPath(c), iopts.Pin.IsPinned.Recursive()); err != nil || !ok {
+			t.Errorf("expected %s to be pinned, got %v (%v)", c, ok, err)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, p := addImage(t, ctx, client)
+
+	// A single image is inspected whatever its platform
+	info, err := Inspect(ctx, client, p.Cid(), v1.Platform{OS: "plan9", Architecture: "386"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(info.Layers) != len(m.Layers) {
+		t.Fatalf("expected %d layers, got %d", len(m.Layers), len(info.Layers))
+	}
+
+	for i, l := range m.Layers {
+		if info.Layers[i].Digest != l.Digest || info.Layers[i].Cid == "" {
+			t.Errorf("unexpected layer %d: %+v", i, info.Layers[i])
+		}
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(info.History) != len(cfg.History) {
+		t.Errorf("expected %d history entries, got %d", len(cfg.History), len(info.History))
+	}
+}
+
+func TestInspectPlatform(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	platforms := []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm", Variant: "v6"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	}
+
+	var idx v1.ImageIndex = empty.Index
+	digests := make(map[string]v1.Hash)
+	for _, pl := range platforms {
+		pl := pl
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Manifests are rewritten as they're added, their layers aren't
+		layers, err := img.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digests[platform.String(pl)], err = layers[0].Digest(); err != nil {
+			t.Fatal(err)
+		}
+
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &pl},
+		})
+	}
+
+	p, err := AddIndex(ctx, client, idx, func(*v1.Platform) bool { return true }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		want    v1.Platform
+		digest  string
+		wantErr bool
+	}{
+		{name: "amd64", want: platforms[0], digest: "linux/amd64"},
+		{name: "variant", want: platforms[2], digest: "linux/arm/v7"},
+		// Without a variant, the first of the architecture listed is inspected
+		{name: "any variant", want: v1.Platform{OS: "linux", Architecture: "arm"}, digest: "linux/arm/v6"},
+		{name: "arm64", want: v1.Platform{OS: "linux", Architecture: "arm64"}, digest: "linux/arm64/v8"},
+		{name: "missing", want: v1.Platform{OS: "windows", Architecture: "amd64"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The image inspected never depends on the order entries happen to be walked in
+			for n := 0; n < 10; n++ {
+				info, err := Inspect(ctx, client, p.Cid(), tt.want)
+				if tt.wantErr {
+					if !errors.Is(err, ErrNotFound) {
+						t.Fatalf("expected %v, got %v", ErrNotFound, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if want := digests[tt.digest]; info.Layers[0].Digest != want {
+					t.Fatalf("expected the %s image of layer %s, got %s", tt.digest, want, info.Layers[0].Digest)
+				}
+			}
+		})
+	}
+
+	// As is the image the inspect endpoint serves
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{}).Router)
+	defer ts.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%s/_ripfs/v1/inspect/%s?platform=linux/arm64", ts.URL, p.Cid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	info := &ImageInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	if want := digests["linux/arm64/v8"]; len(info.Layers) == 0 || info.Layers[0].Digest != want {
+		t.Errorf("expected the linux/arm64/v8 image of layer %s, got %+v", want, info.Layers)
+	}
+}
+
+func TestStoredBlobs(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	// Two images sharing a base
+	base, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extra, err := random.Layer(512, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derived, err := mutate.AppendLayers(base, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := func(img v1.Image) map[digest.Digest]int64 {
+		p, err := AddImage(ctx, client, img, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := StoredBlobs(ctx, client, p.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size, err := ImageSize(ctx, client, p.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var total int64
+		for _, s := range b {
+			total += s
+		}
+		if total != size {
+			t.Errorf("expected the blobs to add up to the image's size %d, got %d", size, total)
+		}
+		return b
+	}
+
+	bb, db := blobs(base), blobs(derived)
+
+	layers, err := derived.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, layer := range layers {
+		d, err := layer.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size, err := layer.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if db[digest.Digest(d.String())] != size {
+			t.Errorf("expected layer %s of size %d, got %d", d, size, db[digest.Digest(d.String())])
+		}
+
+		// Only the appended layer isn't shared with the base
+		if _, shared := bb[digest.Digest(d.String())]; shared != (i < len(layers)-1) {
+			t.Errorf("expected layer %d shared %v, got %v", i, i < len(layers)-1, shared)
+		}
+	}
+}
+
+func TestStoredIndex(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, p := addImage(t, ctx, client)
+
+	idx, err := StoredIndex(ctx, client, p.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	im, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(im.Manifests) != 1 {
+		t.Fatalf("expected 1 manifest, got %d", len(im.Manifests))
+	}
+
+	stored, err := idx.Image(im.Manifests[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validate.Image(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stored manifests carry their content's ipfs urls, so only the config and layers match the original
+	want, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := stored.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != want {
+		t.Errorf("expected config %s, got %s", want, got)
+	}
+
+	wantLayers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotLayers, err := stored.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(gotLayers) != len(wantLayers) {
+		t.Fatalf("expected %d layers, got %d", len(wantLayers), len(gotLayers))
+	}
+
+	for i := range wantLayers {
+		w, _ := wantLayers[i].Digest()
+		g, _ := gotLayers[i].Digest()
+		if g != w {
+			t.Errorf("expected layer %d to be %s, got %s", i, w, g)
+		}
+	}
+
+	if _, err := idx.Image(v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("0", 64)}); err == nil {
+		t.Error("expected an error for an image not within the index")
+	}
+}
+
+// headerCapture records a response header from every round trip
+type headerCapture struct {
+	header string
+	value  string
+}
+
+func (h *headerCapture) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil && resp.Header.Get(h.header) != "" {
+		h.value = resp.Header.Get(h.header)
+	}
+	return resp, err
+}
+
+func TestAddProvenance(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without provenance, the same image is always stored under the same root
+	plain, err := AddImage(ctx, client, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := AddImage(ctx, client, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plain.Cid() != again.Cid() {
+		t.Errorf("expected re-adding an image to store it under the same root, got %s and %s", plain.Cid(), again.Cid())
+	}
+
+	idx, err := StoredIndex(ctx, client, plain.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(im.Annotations) != 0 {
+		t.Errorf("expected no annotations without provenance, got %v", im.Annotations)
+	}
+
+	signed := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+	p, err := AddImage(ctx, client, img, nil, WithProvenance("ghcr.io/org/app:v1"), WithSignedDigest(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err = StoredIndex(ctx, client, p.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if im, err = idx.IndexManifest(); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, want := range map[string]string{
+		"org.opencontainers.image.ref.name": "ghcr.io/org/app:v1",
+		AnnotationSourceDigest:              d.String(),
+		AnnotationVersion:                   consts.Version,
+		AnnotationSignedDigest:              signed.String(),
+	} {
+		if got := im.Annotations[k]; got != want {
+			t.Errorf("expected %s to be %q, got %q", k, want, got)
+		}
+	}
+
+	// Only what doesn't change between adds is stamped, so adding it again stores it under the same root
+	if _, ok := im.Annotations[AnnotationAdded]; ok {
+		t.Errorf("expected the add time not to be stamped on the index, got %v", im.Annotations)
+	}
+
+	p2, err := AddImage(ctx, client, img, nil, WithProvenance("ghcr.io/org/app:v1"), WithSignedDigest(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Cid() != p2.Cid() {
+		t.Errorf("expected re-adding an image with provenance to store it under the same root, got %s and %s", p.Cid(), p2.Cid())
+	}
+
+	// The image itself is stored just as it is without provenance
+	if len(im.Manifests) != 1 {
+		t.Fatalf("expected a single manifest, got %d", len(im.Manifests))
+	}
+	stored, err := idx.Image(im.Manifests[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate.Image(stored); err != nil {
+		t.Errorf("expected the stored image to be valid, got %v", err)
+	}
+}
+
+func TestPush(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	tmp, err := os.MkdirTemp("", consts.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{AllowPush: true, UploadDir: tmp}).Router)
+	defer ts.Close()
+
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := name.ParseReference(host+"/library/pushed:latest", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &headerCapture{header: RootCidHeader}
+	if err := remote.Write(ref, img, remote.WithTransport(hc)); err != nil {
+		t.Fatal(err)
+	}
+
+	if hc.value == "" {
+		t.Fatalf("expected a root cid to be returned")
+	}
+
+	pref, err := name.ParseReference(fmt.Sprintf("%s/ipfs/%s:latest", host, hc.value), name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pulled, err := remote.Image(pref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validate.Image(pulled); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := pulled.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != want {
+		t.Fatalf("expected config %s, got %s", want, got)
+	}
+}
+
+func TestPushLimits(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	tmp, err := os.MkdirTemp("", consts.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{
+		AllowPush:       true,
+		UploadDir:       tmp,
+		MaxManifestSize: 512,
+		MaxUploadSize:   1024,
+	}).Router)
+	defer ts.Close()
+
+	// Monolithic uploads larger than the limit are refused
+	blob := bytes.Repeat([]byte("a"), 2048)
+	resp, err := http.Post(ts.URL+"/v2/library/limited/blobs/uploads/?digest="+digest.FromBytes(blob).String(),
+		"application/octet-stream", bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected oversized blob to be refused with %d, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+
+	// As are manifests
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"annotations":{"padding":%q}}`,
+		types.OCIManifestSchema1, strings.Repeat("a", 1024))
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/v2/library/limited/manifests/latest", strings.NewReader(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", string(types.OCIManifestSchema1))
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected oversized manifest to be refused with %d, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+}
+
+func TestPushUploads(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	tmp, err := os.MkdirTemp("", consts.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{
+		AllowPush:  true,
+		UploadDir:  tmp,
+		UploadTTL:  200 * time.Millisecond,
+		MaxUploads: 2,
+	}).Router)
+	defer ts.Close()
+
+	start := func() (*http.Response, error) {
+		resp, err := http.Post(ts.URL+"/v2/library/uploads/blobs/uploads/", "application/octet-stream", nil)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return resp, nil
+	}
+
+	var locations []string
+	for i := 0; i < 2; i++ {
+		resp, err := start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("expected upload %d to start, got %d", i, resp.StatusCode)
+		}
+		locations = append(locations, resp.Header.Get("Location"))
+	}
+
+	// Further uploads are refused while they're in progress
+	resp, err := start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected a third upload to be refused with %d, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+
+	// Until they go without a request for the ttl, and are removed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(ts.URL + locations[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the upload to expire, got %d", resp.StatusCode)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			t.Errorf("expected expired uploads to be removed, found %s", e.Name())
+		}
+	}
+
+	// Completed blobs are known while they're pinned
+	blob := bytes.Repeat([]byte("a"), 2048)
+	d := digest.FromBytes(blob)
+
+	resp, err = http.Post(ts.URL+"/v2/library/uploads/blobs/uploads/?digest="+d.String(), "application/octet-stream", bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected the blob to be pushed, got %d", resp.StatusCode)
+	}
+
+	head := func() int {
+		resp, err := http.Head(ts.URL + "/v2/library/uploads/blobs/" + d.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := head(); status != http.StatusOK {
+		t.Fatalf("expected the pushed blob to be known, got %d", status)
+	}
+
+	c, ok := digestCid(d)
+	if !ok {
+		t.Fatalf("expected a cid for %s", d)
+	}
+	if err := client.Pin().Rm(ctx, path.IpfsPath(c)); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := head(); status != http.StatusNotFound {
+		t.Fatalf("expected an unpinned blob to be unknown, got %d", status)
+	}
+}
+
+func TestGateway(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	data := bytes.Repeat([]byte("ripfs"), 1024)
+	pinned, err := client.Unixfs().Add(ctx, files.NewBytesFile(data), addOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unpinned, err := client.Unixfs().Add(ctx, files.NewBytesFile([]byte("unpinned")), iopts.Unixfs.Pin(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{Gateway: true}).Router)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/ipfs/" + pinned.Cid().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, data) {
+		t.Fatalf("expected the pinned content, got %d with %d bytes", resp.StatusCode, len(got))
+	}
+
+	if etag := resp.Header.Get("Etag"); etag != `"`+pinned.Cid().String()+`"` {
+		t.Fatalf("expected the cid as the etag, got %s", etag)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipfs/"+pinned.Cid().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=5-9")
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent || string(got) != "ripfs" {
+		t.Fatalf("expected a range of the pinned content, got %d: %q", resp.StatusCode, got)
+	}
+
+	// Only what's pinned is served, nothing is fetched from the swarm on a client's behalf
+	resp, err = http.Get(ts.URL + "/ipfs/" + unpinned.Cid().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected unpinned content to be unknown, got %d", resp.StatusCode)
+	}
+
+	// The gateway is only served when enabled
+	off := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{}).Router)
+	defer off.Close()
+
+	resp, err = http.Get(off.URL + "/ipfs/" + pinned.Cid().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the gateway to be disabled by default, got %d", resp.StatusCode)
+	}
+}
+
+type fakeMapper map[string]string
+
+func (m fakeMapper) Resolve(ctx context.Context, reference string) (string, error) {
+	ref, err := name.ParseReference(reference)
+	if err != nil {
+		return "", err
+	}
+
+	c, ok := m[ref.Name()]
+	if !ok {
+		return "", fmt.Errorf("cid does not exist for reference %s", ref.Name())
+	}
+	return c, nil
+}
+
+func (m fakeMapper) Mappings(ctx context.Context) (path.Path, map[string]string, error) {
+	return path.New("/ipfs/bafkqaaa"), m, nil
+}
+
+func TestCatalog(t *testing.T) {
+	mapper := fakeMapper{
+		"index.docker.io/library/alpine:3.15":   "/ipfs/a",
+		"index.docker.io/library/alpine:latest": "/ipfs/b",
+		"index.docker.io/library/nginx:1.21":    "/ipfs/c",
+		"ghcr.io/org/app:v1":                    "/ipfs/d",
+		"localhost:5000/app@sha256:8f0aed1bf1b0b0d5c62a1b3b0c2a9bc1ad1b9e5d1a0a0c8c1a8e3b3d9f2a1c3b": "/ipfs/e",
+	}
+
+	s := NewIpfsRegistry(nil, &IpfsRegistryOpts{Mapper: mapper})
+
+	tests := []struct {
+		name     string
+		target   string
+		want     string
+		wantLink bool
+	}{
+		{
+			name:   "catalog",
+			target: "/v2/_catalog",
+			want:   `{"repositories":["ghcr.io/org/app","library/alpine","library/nginx","localhost/app"]}`,
+		},
+		{
+			name:     "catalog first page",
+			target:   "/v2/_catalog?n=2",
+			want:     `{"repositories":["ghcr.io/org/app","library/alpine"]}`,
+			wantLink: true,
+		},
+		{
+			name:   "catalog last page",
+			target: "/v2/_catalog?n=2&last=library/alpine",
+			want:   `{"repositories":["library/nginx","localhost/app"]}`,
+		},
+		{
+			name:   "tags",
+			target: "/v2/library/alpine/tags/list",
+			want:   `{"name":"library/alpine","tags":["3.15","latest"]}`,
+		},
+		{
+			name:   "untagged",
+			target: "/v2/localhost/app/tags/list",
+			want:   `{"name":"localhost/app","tags":[]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			s.Router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			if got := strings.TrimSpace(rr.Body.String()); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+
+			if link := rr.Header().Get("Link"); (link != "") != tt.wantLink {
+				t.Errorf("unexpected link header %q", link)
+			}
+		})
+	}
+}
+
+// countingMapper counts how often its mappings are fetched
+type countingMapper struct {
+	fakeMapper
+	fetches int
+}
+
+func (m *countingMapper) Mappings(ctx context.Context) (path.Path, map[string]string, error) {
+	m.fetches++
+
+	mappings := make(map[string]string)
+	for k, v := range m.fakeMapper {
+		mappings[k] = v
+	}
+	return path.New("/ipfs/bafkqaaa"), mappings, nil
+}
+
+func TestCachingCidMapper(t *testing.T) {
+	ctx := context.Background()
+
+	inner := &countingMapper{fakeMapper: fakeMapper{}}
+	m := NewCachingCidMapper(inner, time.Hour)
+
+	if _, err := m.Resolve(ctx, "alpine:latest"); err == nil {
+		t.Fatal("expected alpine to be unmapped")
+	}
+
+	// The negative lookup is cached until invalidated
+	inner.fakeMapper["index.docker.io/library/alpine:latest"] = "/ipfs/a"
+	if _, err := m.Resolve(ctx, "alpine:latest"); err == nil {
+		t.Fatal("expected the cached mappings to be used")
+	}
+
+	m.Invalidate()
+	if c, err := m.Resolve(ctx, "alpine:latest"); err != nil || c != "/ipfs/a" {
+		t.Fatalf("expected alpine to resolve after invalidation, got %s: %v", c, err)
+	}
+
+	if inner.fetches != 2 {
+		t.Errorf("expected 2 fetches, got %d", inner.fetches)
+	}
+}
+
+func TestCachingCidMapperStaleWhileRevalidate(t *testing.T) {
+	ctx := context.Background()
+
+	inner := &countingMapper{fakeMapper: fakeMapper{"index.docker.io/library/alpine:latest": "/ipfs/a"}}
+	m := NewCachingCidMapper(inner, time.Millisecond, WithStaleWhileRevalidate(time.Hour))
+
+	if c, err := m.Resolve(ctx, "alpine:latest"); err != nil || c != "/ipfs/a" {
+		t.Fatalf("expected alpine to resolve, got %s: %v", c, err)
+	}
+
+	// Expired mappings are served as they are, while they're refreshed in the background
+	inner.fakeMapper["index.docker.io/library/alpine:latest"] = "/ipfs/b"
+	time.Sleep(10 * time.Millisecond)
+
+	if c, err := m.Resolve(ctx, "alpine:latest"); err != nil || c != "/ipfs/a" {
+		t.Fatalf("expected the stale mapping to be served, got %s: %v", c, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := m.Resolve(ctx, "alpine:latest")
+		if err == nil && c == "/ipfs/b" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the refreshed mapping to be served, got %s: %v", c, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCachingMappingKeysStaleWhileRevalidate(t *testing.T) {
+	ctx := context.Background()
+
+	a, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu      sync.Mutex
+		current = []crypto.PublicKey{a.Public()}
+		fetched int
+	)
+	keys := CachingMappingKeys(func(context.Context) ([]crypto.PublicKey, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetched++
+		return current, nil
+	}, time.Millisecond, time.Hour)
+
+	if k, err := keys(ctx); err != nil || len(k) != 1 {
+		t.Fatalf("expected the keys to be fetched, got %v: %v", k, err)
+	}
+
+	// Expired keys are served as they are, while they're fetched again in the background
+	mu.Lock()
+	current = nil
+	mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+
+	if k, err := keys(ctx); err != nil || len(k) != 1 {
+		t.Fatalf("expected the stale keys to be served, got %v: %v", k, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := fetched
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the keys to be fetched again in the background, fetched %d times", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileCidMapper(t *testing.T) {
+	ctx := context.Background()
+
+	f := filepath.Join(t.TempDir(), "mappings.json")
+	m := NewFileCidMapper(f)
+
+	if _, err := m.Resolve(ctx, "alpine:latest"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected nothing to be mapped before the file is written, got %v", err)
+	}
+
+	if err := os.WriteFile(f, []byte(`{"index.docker.io/library/alpine:latest":"/ipfs/a"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err := m.Resolve(ctx, "alpine:latest"); err != nil || c != "/ipfs/a" {
+		t.Fatalf("expected alpine to resolve, got %s: %v", c, err)
+	}
+
+	// Rewritten mappings are read without waiting on anything
+	if err := os.WriteFile(f, []byte(`{"index.docker.io/library/alpine:latest":"/ipfs/bb"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err := m.Resolve(ctx, "alpine:latest"); err != nil || c != "/ipfs/bb" {
+		t.Fatalf("expected alpine to resolve to its new mapping, got %s: %v", c, err)
+	}
+
+	if err := os.WriteFile(f, []byte(`not json`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := m.Mappings(ctx); err == nil {
+		t.Errorf("expected invalid mappings to error")
+	}
+}
+
+func TestImageCidMapper(t *testing.T) {
+	ctx := context.Background()
+
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	m := NewImageCidMapper(c, "ripfs-system")
+
+	if _, err := m.Resolve(ctx, "alpine:latest"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected nothing to be mapped before any image is, got %v", err)
+	}
+
+	err := ApplyImages(ctx, c, "ripfs-system", MappingDelta{Set: map[string]string{
+		"index.docker.io/library/alpine:latest": "/ipfs/a",
+		"ghcr.io/org/app:v1":                    "/ipfs/b",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r, err := m.Resolve(ctx, "alpine:latest"); err != nil || r != "/ipfs/a" {
+		t.Fatalf("expected alpine to resolve, got %s: %v", r, err)
+	}
+	if _, err := m.Resolve(ctx, "alpine:3.15"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected an unmapped tag not to resolve, got %v", err)
+	}
+	if _, err := m.Resolve(ctx, "Not A Reference"); !errors.Is(err, ErrInvalidReference) {
+		t.Errorf("expected an invalid reference to fail, got %v", err)
+	}
+
+	// When each image was added is recorded on its Image, and only changes along with its root
+	added := func() string {
+		img := &v1alpha1.Image{}
+		if err := c.Get(ctx, ktypes.NamespacedName{Name: v1alpha1.ImageName("ghcr.io/org/app:v1"), Namespace: "ripfs-system"}, img); err != nil {
+			t.Fatal(err)
+		}
+		return img.Annotations[AnnotationAdded]
+	}
+	first := added()
+	if _, err := time.Parse(time.RFC3339, first); err != nil {
+		t.Fatalf("expected the add time to be recorded, got %v", err)
+	}
+
+	img := &v1alpha1.Image{}
+	if err := c.Get(ctx, ktypes.NamespacedName{Name: v1alpha1.ImageName("ghcr.io/org/app:v1"), Namespace: "ripfs-system"}, img); err != nil {
+		t.Fatal(err)
+	}
+	img.Annotations[AnnotationAdded] = "2006-01-02T15:04:05Z"
+	if err := c.Update(ctx, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyImages(ctx, c, "ripfs-system", MappingDelta{Set: map[string]string{"ghcr.io/org/app:v1": "/ipfs/b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := added(); got != "2006-01-02T15:04:05Z" {
+		t.Errorf("expected mapping the same root again to keep its add time, got %s", got)
+	}
+
+	// Remapping updates the image in place
+	err = ApplyImages(ctx, c, "ripfs-system", MappingDelta{Set: map[string]string{
+		"ghcr.io/org/app:v1": "/ipfs/c",
+		"quay.io/org/db:v2":  "/ipfs/d",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := added(); got == "2006-01-02T15:04:05Z" {
+		t.Errorf("expected remapping to record a new add time")
+	}
+
+	if err := ApplyImages(ctx, c, "ripfs-system", MappingDelta{Removed: []string{"index.docker.io/library/alpine:latest", "unmapped"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, mappings, err := m.Mappings(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"ghcr.io/org/app:v1": "/ipfs/c", "quay.io/org/db:v2": "/ipfs/d"}
+	if !reflect.DeepEqual(mappings, want) {
+		t.Errorf("expected mappings %v, got %v", want, mappings)
+	}
+
+	// Images of other namespaces aren't mapped
+	if _, mappings, err := NewImageCidMapper(c, "default").Mappings(ctx); err != nil || len(mappings) != 0 {
+		t.Errorf("expected no mappings in another namespace, got %v: %v", mappings, err)
+	}
+}
+
+func TestSyncImages(t *testing.T) {
+	ctx := context.Background()
+
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	m := NewImageCidMapper(c, "ripfs-system")
+
+	mappings := func() map[string]string {
+		t.Helper()
+		_, mappings, err := m.Mappings(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mappings
+	}
+	signature := func(ref string) string {
+		t.Helper()
+		img := &v1alpha1.Image{}
+		if err := c.Get(ctx, ktypes.NamespacedName{Name: v1alpha1.ImageName(ref), Namespace: "ripfs-system"}, img); err != nil {
+			t.Fatal(err)
+		}
+		return img.Spec.Signature
+	}
+
+	// Deltas applied out of order end up as the last one committed left them
+	if err := ApplyImages(ctx, c, "ripfs-system", MappingDelta{Set: map[string]string{"ghcr.io/org/app:v1": "/ipfs/b"}, Generation: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyImages(ctx, c, "ripfs-system", MappingDelta{Set: map[string]string{"ghcr.io/org/app:v1": "/ipfs/a"}, Generation: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyImages(ctx, c, "ripfs-system", MappingDelta{Removed: []string{"ghcr.io/org/app:v1"}, Generation: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := mappings(); got["ghcr.io/org/app:v1"] != "/ipfs/b" {
+		t.Errorf("expected an earlier delta not to revert a later one, got %v", got)
+	}
+
+	err := ApplyImages(ctx, c, "ripfs-system", MappingDelta{
+		Set:        map[string]string{"index.docker.io/library/alpine:latest": "/ipfs/c", "quay.io/org/db:v2": "/ipfs/d"},
+		Signatures: map[string]string{"index.docker.io/library/alpine:latest": "signed"},
+		Generation: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Syncing the mappings committed before those leaves them alone
+	if err := SyncImages(ctx, c, "ripfs-system", map[string]string{"ghcr.io/org/app:v1": "/ipfs/b"}, 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := mappings(); len(got) != 3 {
+		t.Errorf("expected images recorded by a later generation to be kept, got %v", got)
+	}
+
+	// Syncing the mappings committed since records what was missed, keeping the signatures of the rest
+	committed := map[string]string{
+		"index.docker.io/library/alpine:latest": "/ipfs/c",
+		"ghcr.io/org/app:v1":                    "/ipfs/e",
+		"docker.io/library/busybox:latest":      "/ipfs/f",
+	}
+	if err := SyncImages(ctx, c, "ripfs-system", committed, 5, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := mappings(); !reflect.DeepEqual(got, committed) {
+		t.Errorf("expected mappings %v, got %v", committed, got)
+	}
+	if sig := signature("index.docker.io/library/alpine:latest"); sig != "signed" {
+		t.Errorf("expected the signature of an unchanged mapping to be kept, got %q", sig)
+	}
+
+	// Those synced are signed when there's a signer
+	signer, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed["docker.io/library/busybox:latest"] = "/ipfs/g"
+	if err := SyncImages(ctx, c, "ripfs-system", committed, 6, signer); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyMapping([]crypto.PublicKey{signer.Public()}, "docker.io/library/busybox:latest", "g", signature("docker.io/library/busybox:latest")); err != nil {
+		t.Errorf("expected the synced mapping to be signed, got %v", err)
+	}
+}
+
+func TestImageCidMapperApply(t *testing.T) {
+	ctx := context.Background()
+
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	m := NewImageCidMapper(c, "ripfs-system")
+
+	resolve := func(reference string) string {
+		t.Helper()
+		r, err := m.Resolve(ctx, reference)
+		if errors.Is(err, ErrNotFound) {
+			return ""
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	// Deltas apply ahead of the Images, unless they can't be ordered against them
+	m.Apply(ctx, MappingDelta{Set: map[string]string{"index.docker.io/library/alpine:latest": "/ipfs/a"}})
+	if r := resolve("alpine:latest"); r != "" {
+		t.Errorf("expected a delta without a generation to be left to the cache, got %s", r)
+	}
+	m.Apply(ctx, MappingDelta{Set: map[string]string{"index.docker.io/library/alpine:latest": "/ipfs/a"}, Generation: 2})
+	if r := resolve("alpine:latest"); r != "/ipfs/a" {
+		t.Errorf("expected the applied delta to resolve, got %s", r)
+	}
+	if _, mappings, err := m.Mappings(ctx); err != nil || mappings["index.docker.io/library/alpine:latest"] != "/ipfs/a" {
+		t.Errorf("expected the applied delta to be listed, got %v: %v", mappings, err)
+	}
+
+	// Once the Images record the delta (or a later one), they're resolved from again
+	if err := ApplyImages(ctx, c, "ripfs-system", MappingDelta{Set: map[string]string{"index.docker.io/library/alpine:latest": "/ipfs/b"}, Generation: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if r := resolve("alpine:latest"); r != "/ipfs/b" {
+		t.Errorf("expected the recorded image to resolve, got %s", r)
+	}
+	m.Apply(ctx, MappingDelta{Set: map[string]string{"index.docker.io/library/alpine:latest": "/ipfs/c"}, Generation: 1})
+	if r := resolve("alpine:latest"); r != "/ipfs/b" {
+		t.Errorf("expected an earlier delta not to apply, got %s", r)
+	}
+
+	// Removals apply ahead of the Images too, until invalidated
+	m.Apply(ctx, MappingDelta{Removed: []string{"index.docker.io/library/alpine:latest"}, Generation: 4})
+	if r := resolve("alpine:latest"); r != "" {
+		t.Errorf("expected the removed image not to resolve, got %s", r)
+	}
+	if _, mappings, err := m.Mappings(ctx); err != nil || len(mappings) != 0 {
+		t.Errorf("expected the removed image not to be listed, got %v: %v", mappings, err)
+	}
+	m.Invalidate()
+	if r := resolve("alpine:latest"); r != "/ipfs/b" {
+		t.Errorf("expected the image to resolve from the cache once invalidated, got %s", r)
+	}
+}
+
+func TestSignedImageCidMapper(t *testing.T) {
+	ctx := context.Background()
+
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+	key := ktypes.NamespacedName{Name: consts.MappingKeySecretName, Namespace: "ripfs-system"}
+	keys := ktypes.NamespacedName{Name: consts.MappingKeysConfigMapName, Namespace: "ripfs-system"}
+	if err := EnsureMappingKey(ctx, c, key, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensuring it again keeps the key it generated
+	s := &corev1.Secret{}
+	if err := c.Get(ctx, key, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureMappingKey(ctx, c, key, keys); err != nil {
+		t.Fatal(err)
+	}
+	again := &corev1.Secret{}
+	if err := c.Get(ctx, key, again); err != nil || !bytes.Equal(again.Data[consts.MappingKeySecretKey], s.Data[consts.MappingKeySecretKey]) {
+		t.Fatalf("expected the mapping key to be kept, got %v", err)
+	}
+
+	signer, err := verify.ParsePrivateKey(s.Data[consts.MappingKeySecretKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := SignMapping(signer, "index.docker.io/library/alpine:latest", "/ipfs/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ApplyImages(ctx, c, "ripfs-system", MappingDelta{
+		Set: map[string]string{
+			"index.docker.io/library/alpine:latest": "/ipfs/a",
+			"ghcr.io/org/app:v1":                    "/ipfs/b",
+		},
+		Signatures: map[string]string{"index.docker.io/library/alpine:latest": sig},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewImageCidMapper(c, "ripfs-system", WithMappingKeys(ConfigMapMappingKeys(c, keys)))
+
+	if r, err := m.Resolve(ctx, "alpine:latest"); err != nil || r != "/ipfs/a" {
+		t.Fatalf("expected the signed image to resolve, got %s: %v", r, err)
+	}
+	if _, err := m.Resolve(ctx, "ghcr.io/org/app:v1"); !errors.Is(err, ErrUnverified) {
+		t.Errorf("expected the unsigned image not to be verified, got %v", err)
+	}
+
+	// A signature doesn't carry over to another root
+	img := &v1alpha1.Image{}
+	if err := c.Get(ctx, ktypes.NamespacedName{Name: v1alpha1.ImageName("index.docker.io/library/alpine:latest"), Namespace: "ripfs-system"}, img); err != nil {
+		t.Fatal(err)
+	}
+	img.Spec.Root = "c"
+	if err := c.Update(ctx, img); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Resolve(ctx, "alpine:latest"); !errors.Is(err, ErrUnverified) {
+		t.Errorf("expected the remapped image not to be verified, got %v", err)
+	}
+
+	if _, mappings, err := m.Mappings(ctx); err != nil || len(mappings) != 0 {
+		t.Errorf("expected unverified images not to be listed, got %v: %v", mappings, err)
+	}
+}
+
+func TestNamedPull(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, p := addImage(t, ctx, client)
+
+	mapper := fakeMapper{"index.docker.io/library/app:v1": p.String()}
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{Mapper: mapper}).Router)
+	defer ts.Close()
+
+	ref, err := name.ParseReference(strings.TrimPrefix(ts.URL, "http://")+"/library/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pulled, err := remote.Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validate.Image(pulled); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := pulled.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != want {
+		t.Fatalf("expected config %s, got %s", want, got)
+	}
+
+	missing, err := name.ParseReference(strings.TrimPrefix(ts.URL, "http://")+"/library/app:v2", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := remote.Image(missing); err == nil {
+		t.Fatal("expected an unmapped tag to fail")
+	}
+
+	if roots := NamedRoots(mapper, "library/app", "v1"); len(roots) != 1 || roots[0].String() != strings.TrimPrefix(p.String(), "/ipfs/") {
+		t.Errorf("expected library/app:v1 read from %s, got %v", p, roots)
+	}
+	if roots := NamedRoots(mapper, "library/app", want.String()); len(roots) != 1 {
+		t.Errorf("expected digests of library/app searched for in its one root, got %v", roots)
+	}
+	if roots := NamedRoots(mapper, "library/app", "v2"); len(roots) != 0 {
+		t.Errorf("expected an unmapped tag to have no roots, got %v", roots)
+	}
+
+	// containerd names the registry it pulls from through a mirror
+	mirrored := fakeMapper{"ghcr.io/org/app:v1": p.String(), "index.docker.io/library/app:v1": p.String()}
+	ms := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{Mapper: mirrored}).Router)
+	defer ms.Close()
+
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/v2/org/app/manifests/v1?ns=ghcr.io", http.StatusOK},
+		{"/v2/library/app/manifests/v1?ns=docker.io", http.StatusOK},
+		{"/v2/org/app/manifests/v1?ns=quay.io", http.StatusNotFound},
+		{"/v2/org/app/manifests/v1", http.StatusNotFound},
+	} {
+		resp, err := http.Get(ms.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.want {
+			t.Errorf("expected %d for %s, got %d", tt.want, tt.path, resp.StatusCode)
+		}
+	}
+}
+
+func TestAddImagePlatform(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.OS, cf.Architecture = "linux", "arm64"
+
+	img, err = mutate.ConfigFile(img, cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := AddImage(ctx, client, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{}).Router)
+	defer ts.Close()
+
+	ref, err := name.ParseReference(fmt.Sprintf("%s/ipfs/%s:latest", strings.TrimPrefix(ts.URL, "http://"), p.Cid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := remote.Index(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	im, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &v1.Platform{OS: "linux", Architecture: "arm64"}
+	if len(im.Manifests) != 1 || !reflect.DeepEqual(im.Manifests[0].Platform, want) {
+		t.Fatalf("expected the index to record the image's platform %v, got %+v", want, im.Manifests)
+	}
+
+	// Clients selecting their platform resolve the image, and anything else resolves nothing
+	got, err := remote.Image(ref, remote.WithPlatform(*want))
+	if err != nil {
+		t.Fatalf("expected the image to be pulled for its platform, got %v", err)
+	}
+	if err := validate.Image(got); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := remote.Image(ref, remote.WithPlatform(v1.Platform{OS: "linux", Architecture: "amd64"})); err == nil {
+		t.Error("expected no image for another platform")
+	}
+}
+
+func TestLayerFormats(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	gz, err := random.Layer(1024, types.OCILayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	esgz, err := random.Layer(1024, types.OCILayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zstd := static.NewLayer(bytes.Repeat([]byte("zstd"), 512), MediaTypeOCILayerZstd)
+
+	toc := map[string]string{
+		AnnotationTOCDigest:        "sha256:" + strings.Repeat("a", 64),
+		AnnotationUncompressedSize: "4096",
+	}
+
+	img, err := mutate.Append(empty.Image,
+		mutate.Addendum{Layer: gz},
+		mutate.Addendum{Layer: zstd},
+		mutate.Addendum{Layer: esgz, Annotations: toc},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img = mutate.MediaType(img, types.OCIManifestSchema1)
+
+	want, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := AddImage(ctx, client, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{}).Router)
+	defer ts.Close()
+
+	ref, err := name.ParseReference(fmt.Sprintf("%s/ipfs/%s:latest", strings.TrimPrefix(ts.URL, "http://"), p.Cid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := remote.Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := got.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Layers) != len(want.Layers) {
+		t.Fatalf("expected %d layers, got %d", len(want.Layers), len(m.Layers))
+	}
+
+	// Layers are served just as they were added, only pointing at ipfs
+	for i, l := range m.Layers {
+		w := want.Layers[i]
+		if l.MediaType != w.MediaType || l.Digest != w.Digest || l.Size != w.Size || !reflect.DeepEqual(l.Annotations, w.Annotations) {
+			t.Errorf("expected layer %d to be served as %+v, got %+v", i, w, l)
+		}
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lazy pulling reads layers in ranges, which are served for every format
+	for _, l := range layers {
+		d, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rc, err := l.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/ipfs/%s/blobs/%s", ts.URL, p.Cid(), d), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Range", "bytes=16-31")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[16:32]) {
+			t.Errorf("expected bytes 16-31 of %s, got %d %q", d, resp.StatusCode, body)
+		}
+	}
+
+	info, err := Inspect(ctx, client, p.Cid(), platform.Host())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var formats []string
+	for _, l := range info.Layers {
+		formats = append(formats, l.Format)
+	}
+	if wantFormats := []string{LayerFormatGzip, LayerFormatZstd, LayerFormatEstargz}; !reflect.DeepEqual(formats, wantFormats) {
+		t.Errorf("expected layer formats %v, got %v", wantFormats, formats)
+	}
+	if !reflect.DeepEqual(info.Layers[2].Annotations, toc) {
+		t.Errorf("expected the estargz layer's annotations %v, got %v", toc, info.Layers[2].Annotations)
+	}
+}
+
+func TestAddIndex(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	platforms := []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "windows", Architecture: "amd64"},
+	}
+
+	var idx v1.ImageIndex = empty.Index
+	configs := make(map[string]v1.Hash)
+	for _, pl := range platforms {
+		pl := pl
+		img, err := random.Image(1024, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if configs[pl.Architecture+pl.OS], err = img.ConfigName(); err != nil {
+			t.Fatal(err)
+		}
+
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &pl},
+		})
+	}
+
+	p, err := AddIndex(ctx, client, idx, func(p *v1.Platform) bool { return p.OS == "linux" }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{}).Router)
+	defer ts.Close()
+
+	ref, err := name.ParseReference(fmt.Sprintf("%s/ipfs/%s:latest", strings.TrimPrefix(ts.URL, "http://"), p.Cid()), name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pulledIdx, err := remote.Index(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	im, err := pulledIdx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(im.Manifests) != 2 {
+		t.Fatalf("expected the 2 linux images, got %d", len(im.Manifests))
+	}
+
+	for _, pl := range platforms[:2] {
+		img, err := remote.Image(ref, remote.WithPlatform(pl))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := validate.Image(img); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := img.ConfigName()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := configs[pl.Architecture+pl.OS]; got != want {
+			t.Fatalf("expected %s/%s config %s, got %s", pl.OS, pl.Architecture, want, got)
+		}
+	}
+
+	got, err := Platforms(ctx, client, p.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"linux/amd64", "linux/arm64/v8"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected platforms %v, got %v", want, got)
+	}
+
+	if _, err := AddIndex(ctx, client, idx, func(p *v1.Platform) bool { return false }, nil); err == nil {
+		t.Fatal("expected an index without matching images to fail")
+	}
+}
+
+// unreadableImage is an image whose layers fail to be read, as if they had to be pulled again
+type unreadableImage struct {
+	v1.Image
+}
+
+type unreadableLayer struct {
+	v1.Layer
+}
+
+func (l unreadableLayer) Compressed() (io.ReadCloser, error) {
+	return nil, errors.New("layer read")
+}
+
+func (i unreadableImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	for n, l := range layers {
+		layers[n] = unreadableLayer{l}
+	}
+	return layers, nil
+}
+
+func TestAddLayerIndex(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	tmp, err := os.MkdirTemp("", consts.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	layers, err := NewFileLayerIndex(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := random.Image(MaxRawBlockSize+1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := AddImage(ctx, client, img, layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every layer is still stored, so nothing is read again
+	again, err := AddImage(ctx, client, unreadableImage{img}, layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.Cid() != p.Cid() {
+		t.Fatalf("expected re-adding to write the same root %s, got %s", p.Cid(), again.Cid())
+	}
+
+	// Layers that were collected since are added again
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := ls[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, ok := layers.Get(ctx, d)
+	if !ok {
+		t.Fatalf("expected layer %s to be indexed", d)
+	}
+
+	if err := client.Pin().Rm(ctx, path.IpfsPath(c)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := AddImage(ctx, client, unreadableImage{img}, layers); err == nil {
+		t.Fatal("expected an unpinned layer to be read again")
+	}
+
+	if _, err := AddImage(ctx, client, img, layers); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddChunking(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, err := random.Image(4096, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := ls[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// layerCid returns the cid the layer was stored at within root
+	layerCid := func(root path.Resolved) cid.Cid {
+		info, err := Inspect(ctx, client, root.Cid(), platform.Host())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, l := range info.Layers {
+			if l.Digest == d {
+				c, err := cid.Decode(l.Cid)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return c
+			}
+		}
+		t.Fatalf("layer %s not found within %s", d, root)
+		return cid.Cid{}
+	}
+
+	def, err := AddImage(ctx, client, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A layer smaller than a default chunk is a single raw block
+	if c := layerCid(def); c.Prefix().Codec != cid.Raw || c.Prefix().MhType != multihash.SHA2_256 {
+		t.Errorf("expected the layer stored as a raw sha2-256 block, got %s", c)
+	}
+
+	chunked, err := AddImage(ctx, client, img, nil, WithChunking(Chunking{Chunker: "size-1024", Hash: "sha2-512"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := layerCid(chunked)
+	if c.Prefix().Codec != cid.DagProtobuf || c.Prefix().MhType != multihash.SHA2_512 {
+		t.Fatalf("expected the layer stored as a sha2-512 unixfs dag, got %s", c)
+	}
+
+	links, err := client.Object().Links(ctx, path.IpfsPath(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := ls[0].Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int((size + 1023) / 1024); len(links) != want {
+		t.Errorf("expected the layer split into %d chunks, got %d", want, len(links))
+	}
+
+	// Non-raw leaves are unixfs nodes
+	if lc := links[0].Cid; lc.Prefix().Codec != cid.DagProtobuf {
+		t.Errorf("expected leaves wrapped in unixfs nodes, got %s", lc)
+	}
+
+	// The image is served the same however its layers were chunked
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{}).Router)
+	defer ts.Close()
+
+	ref, err := name.ParseReference(fmt.Sprintf("%s/ipfs/%s:latest", strings.TrimPrefix(ts.URL, "http://"), chunked.Cid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := remote.Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate.Image(got); err != nil {
+		t.Error(err)
+	}
+
+	for _, c := range []Chunking{{Chunker: "size-0"}, {Chunker: "fixed"}, {Hash: "md5000"}} {
+		if _, err := AddImage(ctx, client, img, nil, WithChunking(c)); err == nil {
+			t.Errorf("expected %+v to be rejected", c)
+		}
+	}
+}
+
+func TestPubsubCidMapper(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	seed := &countingMapper{fakeMapper: fakeMapper{"index.docker.io/library/alpine:latest": "/ipfs/a"}}
+	m := NewPubsubCidMapper(client, seed)
+
+	if c, err := m.Resolve(ctx, "alpine:latest"); err != nil || c != "/ipfs/a" {
+		t.Fatalf("expected alpine to resolve from the seed, got %s: %v", c, err)
+	}
+
+	// Deltas following on from the local copy are applied in place
+	m.Apply(ctx, MappingDelta{
+		Path:     "/ipfs/bafkqaab",
+		Previous: "/ipfs/bafkqaaa",
+		Set:      map[string]string{"index.docker.io/library/nginx:1.21": "/ipfs/b"},
+	})
+
+	if c, err := m.Resolve(ctx, "nginx:1.21"); err != nil || c != "/ipfs/b" {
+		t.Fatalf("expected nginx to resolve from the delta, got %s: %v", c, err)
+	}
+
+	// A missed delta reads the full mapping instead
+	data, err := json.Marshal(map[string]string{"ghcr.io/org/app:v1": "/ipfs/c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := client.Unixfs().Add(ctx, files.NewBytesFile(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Apply(ctx, MappingDelta{
+		Path:     p.String(),
+		Previous: "/ipfs/bafkqaac",
+		Set:      map[string]string{"ghcr.io/org/app:v1": "/ipfs/c"},
+	})
+
+	if c, err := m.Resolve(ctx, "ghcr.io/org/app:v1"); err != nil || c != "/ipfs/c" {
+		t.Fatalf("expected app to resolve from the full mapping, got %s: %v", c, err)
+	}
+
+	if _, err := m.Resolve(ctx, "alpine:latest"); err == nil {
+		t.Fatal("expected alpine to be dropped by the full mapping")
+	}
+
+	if seed.fetches != 1 {
+		t.Errorf("expected a single seed, got %d", seed.fetches)
+	}
+
+	// Refreshing catches up with the seed again
+	if err := m.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err := m.Resolve(ctx, "alpine:latest"); err != nil || c != "/ipfs/a" {
+		t.Fatalf("expected alpine to resolve once refreshed, got %s: %v", c, err)
+	}
+
+	// A mapper holding nothing yet is seeded by the first delta, without waiting on the seed
+	unseeded := &countingMapper{fakeMapper: fakeMapper{}}
+	m = NewPubsubCidMapper(client, unseeded)
+	m.Apply(ctx, MappingDelta{Path: p.String(), Set: map[string]string{"ghcr.io/org/app:v1": "/ipfs/c"}})
+
+	if c, err := m.Resolve(ctx, "ghcr.io/org/app:v1"); err != nil || c != "/ipfs/c" {
+		t.Fatalf("expected app to resolve from the first delta, got %s: %v", c, err)
+	}
+
+	if unseeded.fetches != 0 {
+		t.Errorf("expected no seed, got %d", unseeded.fetches)
+	}
+}
+
+// namedIpfs is a peered node's api whose name cache still resolves to cached, though the name has moved on to current
+type namedIpfs struct {
+	iface.CoreAPI
+	cached, current path.Path
+
+	uncached int
+}
+
+func (n *namedIpfs) Name() iface.NameAPI {
+	return namedName{n.CoreAPI.Name(), n}
+}
+
+func (n *namedIpfs) Swarm() iface.SwarmAPI {
+	return peeredSwarm{n.CoreAPI.Swarm()}
+}
+
+type namedName struct {
+	iface.NameAPI
+	n *namedIpfs
+}
+
+func (a namedName) Resolve(_ context.Context, _ string, opts ...iopts.NameResolveOption) (path.Path, error) {
+	settings, err := iopts.NameResolveOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if !settings.Cache {
+		a.n.uncached++
+		return a.n.current, nil
+	}
+	return a.n.cached, nil
+}
+
+type peeredSwarm struct {
+	iface.SwarmAPI
+}
+
+func (peeredSwarm) Peers(context.Context) ([]iface.ConnectionInfo, error) {
+	return []iface.ConnectionInfo{nil}, nil
+}
+
+func TestIpnsCidMapperInvalidate(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	publish := func(mappings map[string]string) path.Path {
+		data, err := json.Marshal(mappings)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := client.Unixfs().Add(ctx, files.NewBytesFile(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	api := &namedIpfs{
+		CoreAPI: client,
+		cached:  publish(map[string]string{"index.docker.io/library/alpine:latest": "/ipfs/a"}),
+		current: publish(map[string]string{"index.docker.io/library/alpine:latest": "/ipfs/b"}),
+	}
+
+	tests := []struct {
+		name   string
+		mapper func(ipns *IpnsCidMapper) ListingCidMapper
+	}{
+		{
+			name:   "caching",
+			mapper: func(ipns *IpnsCidMapper) ListingCidMapper { return NewCachingCidMapper(ipns, time.Hour) },
+		},
+		{
+			name:   "pubsub",
+			mapper: func(ipns *IpnsCidMapper) ListingCidMapper { return NewPubsubCidMapper(client, ipns) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api.uncached = 0
+
+			ipns := NewIpfsCidMapper(api, StaticFetcher("k51"))
+			m := tt.mapper(ipns)
+
+			if c, err := m.Resolve(ctx, "alpine:latest"); err != nil || c != "/ipfs/a" {
+				t.Fatalf("expected alpine to resolve through the name cache, got %s: %v", c, err)
+			}
+
+			// Invalidated mappings are fetched again past the name cache, which would still return the previous ones
+			m.(Invalidator).Invalidate()
+			if c, err := m.Resolve(ctx, "alpine:latest"); err != nil || c != "/ipfs/b" {
+				t.Fatalf("expected alpine to resolve to its current mapping once invalidated, got %s: %v", c, err)
+			}
+
+			// Only the fetch following the invalidation skips the name cache
+			if _, _, err := ipns.Mappings(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if api.uncached != 1 {
+				t.Errorf("expected a single uncached resolution, got %d", api.uncached)
+			}
+		})
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, p := addImage(t, ctx, client)
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := layers[0].Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	want, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{}).Router)
+	defer ts.Close()
+
+	target := fmt.Sprintf("%s/v2/ipfs/%s/blobs/%s", ts.URL, p.Cid(), d)
+
+	head, err := http.Head(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head.Body.Close()
+
+	if head.ContentLength != int64(len(want)) {
+		t.Errorf("expected a content length of %d, got %d", len(want), head.ContentLength)
+	}
+
+	if got := head.Header.Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("expected byte ranges to be accepted, got %q", got)
+	}
+
+	tests := []struct {
+		name       string
+		rng        string
+		ifRange    string
+		wantStatus int
+		want       []byte
+	}{
+		{
+			name:       "range",
+			rng:        "bytes=10-19",
+			wantStatus: http.StatusPartialContent,
+			want:       want[10:20],
+		},
+		{
+			name:       "suffix",
+			rng:        "bytes=-16",
+			wantStatus: http.StatusPartialContent,
+			want:       want[len(want)-16:],
+		},
+		{
+			name:       "resume",
+			rng:        "bytes=100-",
+			ifRange:    `"` + d.String() + `"`,
+			wantStatus: http.StatusPartialContent,
+			want:       want[100:],
+		},
+		{
+			name:       "stale if-range",
+			rng:        "bytes=100-",
+			ifRange:    `"sha256:stale"`,
+			wantStatus: http.StatusOK,
+			want:       want,
+		},
+		{
+			name:       "unsatisfiable",
+			rng:        fmt.Sprintf("bytes=%d-", len(want)),
+			wantStatus: http.StatusRequestedRangeNotSatisfiable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Range", tt.rng)
+			if tt.ifRange != "" {
+				req.Header.Set("If-Range", tt.ifRange)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+
+			if tt.want == nil {
+				return
+			}
+
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != string(tt.want) {
+				t.Errorf("expected %d bytes of content, got %d different bytes", len(tt.want), len(got))
+			}
+		})
+	}
+}
+
+func TestResumeLargeLayer(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, err := random.Image(16<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := AddImage(ctx, client, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := layers[0].Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{RecordRequests: 8}).Router)
+	defer ts.Close()
+
+	target := fmt.Sprintf("%s/v2/ipfs/%s/blobs/%s", ts.URL, p.Cid(), d)
+
+	// The pull is interrupted part way through the layer
+	resp, err := http.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got strings.Builder
+	offset := size / 3
+	if _, err := io.CopyN(&got, resp.Body, offset); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// containerd resumes from what it already has, without an If-Range
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected status %d, got %d", http.StatusPartialContent, resp.StatusCode)
+	}
+
+	contentRange := fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size)
+	if got := resp.Header.Get("Content-Range"); got != contentRange {
+		t.Errorf("expected content range %s, got %s", contentRange, got)
+	}
+
+	if _, err := io.Copy(&got, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if digest.FromString(got.String()).String() != d.String() {
+		t.Fatalf("expected the resumed layer to be %s, got %d bytes of something else", d, got.Len())
+	}
+
+	// Only the rest of the layer is served (and accounted for) on resume
+	resp, err = http.Get(ts.URL + "/_ripfs/debug/requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var records []RequestRecord
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		t.Fatal(err)
+	}
+
+	last := records[len(records)-1]
+	if last.ContentRange != contentRange || int64(last.Bytes) != size-offset {
+		t.Errorf("expected %d bytes of %s to be recorded, got %d bytes of %s", size-offset, contentRange, last.Bytes, last.ContentRange)
+	}
+}
+
+func TestConcurrentBlobStreams(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, err := random.Image(8<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := AddImage(ctx, client, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{}).Router)
+	defer ts.Close()
+
+	target := fmt.Sprintf("%s/v2/ipfs/%s/blobs/%s", ts.URL, p.Cid(), d)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := http.Get(target)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+
+			// Digest the layer as it's streamed, rather than holding it
+			verifier := digest.Digest(d.String()).Verifier()
+			if _, err := io.Copy(verifier, resp.Body); err != nil {
+				errs <- err
+				return
+			}
+
+			if !verifier.Verified() {
+				errs <- fmt.Errorf("streamed layer didn't match %s", d)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestManifestNegotiation(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	_, p := addImage(t, ctx, client)
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{}).Router)
+	defer ts.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%s/v2/ipfs/%s/manifests/latest", ts.URL, p.Cid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	idx, err := v1.ParseIndexManifest(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := idx.Manifests[0].Digest
+
+	const (
+		docker = string(types.DockerManifestSchema2) + ", " + string(types.DockerManifestList)
+		oci    = string(types.OCIManifestSchema1) + ", " + string(types.OCIImageIndex)
+	)
+
+	tests := []struct {
+		name          string
+		reference     string
+		accept        string
+		wantStatus    int
+		wantMediaType string
+	}{
+		{
+			name:          "no accept",
+			reference:     d.String(),
+			wantStatus:    http.StatusOK,
+			wantMediaType: string(types.DockerManifestSchema2),
+		},
+		{
+			name:          "accepted",
+			reference:     d.String(),
+			accept:        docker,
+			wantStatus:    http.StatusOK,
+			wantMediaType: string(types.DockerManifestSchema2),
+		},
+		{
+			name:          "wildcard",
+			reference:     d.String(),
+			accept:        "*/*",
+			wantStatus:    http.StatusOK,
+			wantMediaType: string(types.DockerManifestSchema2),
+		},
+		{
+			name:       "declared docker manifest",
+			reference:  d.String(),
+			accept:     oci,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "declared oci index",
+			reference:  "latest",
+			accept:     docker,
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/ipfs/%s/manifests/%s", ts.URL, p.Cid(), tt.reference), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+
+			if got := resp.Header.Get("Content-Type"); tt.wantMediaType != "" && got != tt.wantMediaType {
+				t.Errorf("expected a %s, got %s", tt.wantMediaType, got)
+			}
+		})
+	}
+
+	// Manifests that don't declare what they are can be served as either
+	undeclared := `{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","size":2,"digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},"layers":[]}`
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", docker)
+
+	mt, content, err := negotiateManifest(httptest.NewRecorder(), req, string(types.OCIManifestSchema1), nopSeekCloser{strings.NewReader(undeclared)}, DefaultMaxManifestSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mt != string(types.DockerManifestSchema2) || string(got) != undeclared {
+		t.Errorf("expected the same manifest as a %s, got a %s", types.DockerManifestSchema2, mt)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	_, p := addImage(t, ctx, client)
+
+	mapper := fakeMapper{"index.docker.io/library/app:v1": p.String()}
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{Mapper: mapper}).Router)
+	defer ts.Close()
+
+	missing := digest.FromString("missing")
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+		wantCode   ErrorCode
+	}{
+		{
+			name:       "unknown manifest",
+			target:     fmt.Sprintf("/v2/ipfs/%s/manifests/%s", p.Cid(), missing),
+			wantStatus: http.StatusNotFound,
+			wantCode:   ErrManifestUnknown,
+		},
+		{
+			name:       "unknown tag",
+			target:     fmt.Sprintf("/v2/ipfs/%s/manifests/v1", p.Cid()),
+			wantStatus: http.StatusNotFound,
+			wantCode:   ErrManifestUnknown,
+		},
+		{
+			name:       "unknown blob",
+			target:     fmt.Sprintf("/v2/ipfs/%s/blobs/%s", p.Cid(), missing),
+			wantStatus: http.StatusNotFound,
+			wantCode:   ErrBlobUnknown,
+		},
+		{
+			name:       "invalid digest",
+			target:     fmt.Sprintf("/v2/ipfs/%s/blobs/sha256:nope", p.Cid()),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   ErrDigestInvalid,
+		},
+		{
+			name:       "invalid cid",
+			target:     "/v2/ipfs/notacid/manifests/latest",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   ErrNameInvalid,
+		},
+		{
+			name:       "unknown repository",
+			target:     "/v2/library/nope/manifests/latest",
+			wantStatus: http.StatusNotFound,
+			wantCode:   ErrNameUnknown,
+		},
+		{
+			name:       "unknown named tag",
+			target:     "/v2/library/app/manifests/v2",
+			wantStatus: http.StatusNotFound,
+			wantCode:   ErrManifestUnknown,
+		},
+		{
+			name:       "invalid pagination",
+			target:     "/v2/_catalog?n=nope",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   ErrPaginationInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+
+			var body struct {
+				Errors []struct {
+					Code    ErrorCode `json:"code"`
+					Message string    `json:"message"`
+				} `json:"errors"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(body.Errors) != 1 || body.Errors[0].Code != tt.wantCode {
+				t.Fatalf("expected a %s error, got %+v", tt.wantCode, body.Errors)
+			}
+		})
+	}
+}
+
+func TestCachingHeaders(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, p := addImage(t, ctx, client)
+
+	mapper := fakeMapper{"index.docker.io/library/app:v1": p.String()}
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{Mapper: mapper}).Router)
+	defer ts.Close()
+
+	cfg, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/v2/ipfs/%s/manifests/latest", ts.URL, p.Cid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	idx, err := v1.ParseIndexManifest(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := idx.Manifests[0].Digest
+
+	tests := []struct {
+		name      string
+		target    string
+		wantCache string
+	}{
+		{
+			name:      "latest",
+			target:    fmt.Sprintf("/v2/ipfs/%s/manifests/latest", p.Cid()),
+			wantCache: cacheImmutable,
+		},
+		{
+			name:      "manifest by digest",
+			target:    fmt.Sprintf("/v2/ipfs/%s/manifests/%s", p.Cid(), md),
+			wantCache: cacheImmutable,
+		},
+		{
+			name:      "named tag",
+			target:    "/v2/library/app/manifests/v1",
+			wantCache: cacheRevalidate,
+		},
+		{
+			name:      "named blob",
+			target:    fmt.Sprintf("/v2/library/app/blobs/%s", cfg),
+			wantCache: cacheImmutable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+
+			d := digest.FromBytes(body)
+			if got := resp.Header.Get("Docker-Content-Digest"); got != d.String() {
+				t.Errorf("expected digest %s, got %q", d, got)
+			}
+
+			if resp.ContentLength != int64(len(body)) {
+				t.Errorf("expected a content length of %d, got %d", len(body), resp.ContentLength)
+			}
+
+			if got := resp.Header.Get("Cache-Control"); got != tt.wantCache {
+				t.Errorf("expected cache control %q, got %q", tt.wantCache, got)
+			}
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL+tt.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("If-None-Match", resp.Header.Get("Etag"))
+
+			cached, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cached.Body.Close()
+
+			if cached.StatusCode != http.StatusNotModified {
+				t.Errorf("expected a matching etag to be not modified, got %d", cached.StatusCode)
+			}
+		})
+	}
+}
+
+// countingIndex counts the lookups and walks that reach it
+type countingIndex struct {
+	mu         sync.Mutex
+	gets, puts int
+}
+
+func (i *countingIndex) Get(context.Context, cid.Cid) (Entries, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.gets++
+	return nil, false
+}
+
+func (i *countingIndex) Put(context.Context, cid.Cid, Entries) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.puts++
+	return nil
+}
+
+func TestMemoryIndex(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, p := addLargeImage(t, ctx, client)
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backing := &countingIndex{}
+	s := NewIpfsRegistry(client, &IpfsRegistryOpts{Index: backing})
+
+	// Every layer (a few times over) pulled at once
+	var wg sync.WaitGroup
+	for n := 0; n < 3; n++ {
+		for _, layer := range layers {
+			h, err := layer.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v2/ipfs/%s/blobs/%s", p.Cid(), h), nil)
+				rr := httptest.NewRecorder()
+				s.Router.ServeHTTP(rr, req)
+
+				if rr.Code != http.StatusOK {
+					t.Errorf("expected %d, got %d", http.StatusOK, rr.Code)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	if backing.puts != 1 {
+		t.Errorf("expected the root to be walked once, got %d", backing.puts)
+	}
+
+	gets := backing.gets
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v2/ipfs/%s/manifests/latest", p.Cid()), nil)
+	s.Router.ServeHTTP(httptest.NewRecorder(), req)
+
+	cfg, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest(http.MethodHead, fmt.Sprintf("/v2/ipfs/%s/blobs/%s", p.Cid(), cfg), nil)
+	s.Router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if backing.gets != gets {
+		t.Errorf("expected cached roots to be served from memory, the backing index was consulted %d more times", backing.gets-gets)
+	}
+
+	// The least recently used root is evicted
+	mi := NewMemoryIndex(1, nil)
+	a, b := p.Cid(), cid.NewCidV1(cid.DagCBOR, p.Cid().Hash())
+	if err := mi.Put(ctx, a, Entries{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mi.Put(ctx, b, Entries{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := mi.Get(ctx, a); ok {
+		t.Errorf("expected %s to be evicted", a)
+	}
+	if _, ok := mi.Get(ctx, b); !ok {
+		t.Errorf("expected %s to be cached", b)
+	}
+}
+
+func TestRawBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, p := addImage(t, ctx, client)
+
+	info, err := Inspect(ctx, client, p.Cid(), platform.Host())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Small layers are raw blocks addressed by their digest
+	for _, l := range info.Layers {
+		want, ok := digestCid(digest.Digest(l.Digest.String()))
+		if !ok || l.Cid != want.String() {
+			t.Errorf("expected layer %s stored at %s, got %s", l.Digest, want, l.Cid)
+		}
+	}
+
+	// Nothing is indexed to serve blobs pinned as raw blocks
+	backing := &countingIndex{}
+	s := NewIpfsRegistry(client, &IpfsRegistryOpts{Index: backing, IndexCacheSize: -1})
+
+	get := func(kind string, reference string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v2/ipfs/%s/%s/%s", p.Cid(), kind, reference), nil)
+		rr := httptest.NewRecorder()
+		s.Router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected %d for %s %s, got %d", http.StatusOK, kind, reference, rr.Code)
+		}
+		return rr
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, layer := range layers {
+		d, err := layer.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := get("blobs", d.String())
+		if got := digest.FromBytes(rr.Body.Bytes()); got.String() != d.String() {
+			t.Errorf("expected layer %s, got %s", d, got)
+		}
+	}
+
+	cfg, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	get("blobs", cfg.String())
+
+	// Manifests found by their digest are served as what they declare themselves as
+	var idx v1.IndexManifest
+	if err := json.Unmarshal(get("manifests", "latest").Body.Bytes(), &idx); err != nil {
+		t.Fatal(err)
+	}
+
+	desc := idx.Manifests[0]
+	if got := get("manifests", desc.Digest.String()).Header().Get("Content-Type"); got != string(desc.MediaType) {
+		t.Errorf("expected manifest served as a %s, got %s", desc.MediaType, got)
+	}
+
+	if backing.puts != 0 {
+		t.Errorf("expected nothing to be indexed, got %d walks", backing.puts)
+	}
+
+	// Raw blocks of other images aren't served through this one
+	other, _ := addImage(t, ctx, client)
+	od, err := other.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v2/ipfs/%s/blobs/%s", p.Cid(), od), nil)
+	rr := httptest.NewRecorder()
+	s.Router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected %d for a blob of another image, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	// Manifests that don't declare what they are are sniffed
+	for data, want := range map[string]types.MediaType{
+		`{"schemaVersion":2,"manifests":[]}`:                          types.OCIImageIndex,
+		`{"schemaVersion":2,"config":{},"layers":[]}`:                 types.OCIManifestSchema1,
+		`{"mediaType":"` + string(types.DockerManifestSchema2) + `"}`: types.DockerManifestSchema2,
+	} {
+		if got, err := sniffManifest([]byte(data)); err != nil || got != string(want) {
+			t.Errorf("expected %s sniffed as a %s, got %s (%v)", data, want, got, err)
+		}
+	}
+}
+
+func TestAddProgress(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	// One layer large enough to be chunked and tracked as it's transferred, and one small enough to be a raw block
+	large, err := random.Layer(3*progressInterval, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := mutate.AppendLayers(empty.Image, large, small)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu     sync.Mutex
+		events []Progress
+	)
+	report := func(p Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, p)
+	}
+
+	layers, err := NewFileLayerIndex(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := AddImage(ctx, client, img, layers, WithProgress(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(phase Phase, d v1.Hash) int {
+		n := 0
+		for _, e := range events {
+			if e.Phase == phase && (d == v1.Hash{} || e.Digest == d.String()) {
+				n++
+			}
+		}
+		return n
+	}
+
+	ld, err := large.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := small.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := count(PhaseLayer, ld); n < 2 {
+		t.Errorf("expected the large layer's transfer reported as it went, got %d reports", n)
+	}
+	if count(PhaseLayerAdded, ld) != 1 || count(PhaseLayerAdded, sd) != 1 {
+		t.Errorf("expected each layer reported once added, got %v", events)
+	}
+	if last := events[len(events)-1]; last.Phase != PhaseAdded || last.Cid != p.Cid().String() {
+		t.Errorf("expected the image's root reported last, got %v", last)
+	}
+
+	// Adding it again only reports its layers as already stored
+	events = nil
+	if _, err := AddImage(ctx, client, img, layers, WithProgress(report)); err != nil {
+		t.Fatal(err)
+	}
+
+	if count(PhaseLayerAdded, v1.Hash{}) != 0 || count(PhaseLayerStored, ld) != 1 || count(PhaseLayerStored, sd) != 1 {
+		t.Errorf("expected stored layers reported as such, got %v", events)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	_, p := addImage(t, ctx, client)
+
+	mapper := fakeMapper{"index.docker.io/library/app:v1": p.String(), "ghcr.io/org/app:v1": p.String()}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	htpasswd, err := ParseHtpasswd(strings.NewReader("# users\nadmin:"+string(hash)+"\n"), "ripfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseHtpasswd(strings.NewReader("admin:{SHA}nope\n"), "ripfs"); err == nil {
+		t.Errorf("expected non bcrypt entries to be rejected")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := func(t *testing.T, issuer string, name string, actions ...string) string {
+		tok, err := jwt.Signed(signer).Claims(jwt.Claims{
+			Issuer:   issuer,
+			Audience: jwt.Audience{"ripfs"},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}).Claims(map[string]interface{}{
+			"access": []map[string]interface{}{{"type": "repository", "name": name, "actions": actions}},
+		}).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + tok
+	}
+
+	tokenAuth := &TokenAuth{
+		Realm:   "https://auth.example.com/token",
+		Service: "ripfs",
+		Issuer:  "example",
+		Keys:    []crypto.PublicKey{key.Public()},
+	}
+
+	basic := func(user, pass string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(user, pass)
+		return req.Header.Get("Authorization")
+	}
+
+	tests := []struct {
+		name          string
+		auth          Authenticator
+		target        string
+		authorization string
+		wantStatus    int
+		wantChallenge string
+	}{
+		{
+			name:          "basic challenge",
+			auth:          htpasswd,
+			target:        "/v2/",
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Basic realm="ripfs"`,
+		},
+		{
+			name:          "basic wrong password",
+			auth:          htpasswd,
+			target:        "/v2/library/app/manifests/v1",
+			authorization: basic("admin", "nope"),
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Basic realm="ripfs"`,
+		},
+		{
+			name:          "basic",
+			auth:          htpasswd,
+			target:        "/v2/library/app/manifests/v1",
+			authorization: basic("admin", "hunter2"),
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:          "token challenge",
+			auth:          tokenAuth,
+			target:        "/v2/library/app/manifests/v1",
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="https://auth.example.com/token",service="ripfs",scope="repository:library/app:pull"`,
+		},
+		{
+			name:          "token",
+			auth:          tokenAuth,
+			target:        "/v2/library/app/manifests/v1",
+			authorization: token(t, "example", "library/app", "pull"),
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:          "token for another repository",
+			auth:          tokenAuth,
+			target:        "/v2/library/app/manifests/v1",
+			authorization: token(t, "example", "library/other", "pull"),
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="https://auth.example.com/token",service="ripfs",scope="repository:library/app:pull"`,
+		},
+		{
+			name:          "token from another issuer",
+			auth:          tokenAuth,
+			target:        "/v2/library/app/manifests/v1",
+			authorization: token(t, "someone", "library/app", "pull"),
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="https://auth.example.com/token",service="ripfs",scope="repository:library/app:pull"`,
+		},
+		{
+			name:          "token for a repository mirrored from another registry",
+			auth:          tokenAuth,
+			target:        "/v2/org/app/manifests/v1?ns=ghcr.io",
+			authorization: token(t, "example", "org/app", "pull"),
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="https://auth.example.com/token",service="ripfs",scope="repository:ghcr.io/org/app:pull"`,
+		},
+		{
+			name:          "token for a mirrored repository",
+			auth:          tokenAuth,
+			target:        "/v2/org/app/manifests/v1?ns=ghcr.io",
+			authorization: token(t, "example", "ghcr.io/org/app", "pull"),
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:          "token for a cid",
+			auth:          tokenAuth,
+			target:        fmt.Sprintf("/v2/ipfs/%s/manifests/latest", p.Cid()),
+			authorization: token(t, "example", "ipfs/"+p.Cid().String(), "*"),
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:          "token for a cid inspected",
+			auth:          tokenAuth,
+			target:        fmt.Sprintf("/_ripfs/v1/inspect/%s", p.Cid()),
+			authorization: token(t, "example", "ipfs/"+p.Cid().String(), "pull"),
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:          "token for another repository inspecting a cid",
+			auth:          tokenAuth,
+			target:        fmt.Sprintf("/_ripfs/v1/inspect/%s", p.Cid()),
+			authorization: token(t, "example", "library/app", "pull"),
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: fmt.Sprintf(`Bearer realm="https://auth.example.com/token",service="ripfs",scope="repository:ipfs/%s:pull"`, p.Cid()),
+		},
+		{
+			name:          "token for a repository transferring a cid",
+			auth:          tokenAuth,
+			target:        fmt.Sprintf("/_ripfs/v1/car/%s", p.Cid()),
+			authorization: token(t, "example", "library/app", "pull"),
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: fmt.Sprintf(`Bearer realm="https://auth.example.com/token",service="ripfs",scope="repository:ipfs/%s:pull"`, p.Cid()),
+		},
+		{
+			name:          "token for a repository reading ripfs info",
+			auth:          tokenAuth,
+			target:        "/_ripfs/v1/info",
+			authorization: token(t, "example", "library/app", "pull"),
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="https://auth.example.com/token",service="ripfs",scope="registry:ripfs:pull"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewIpfsRegistry(client, &IpfsRegistryOpts{Mapper: mapper, Auth: tt.auth})
+
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+
+			rr := httptest.NewRecorder()
+			s.Router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, rr.Code, rr.Body.String())
+			}
+
+			if got := rr.Header().Get("WWW-Authenticate"); got != tt.wantChallenge {
+				t.Errorf("expected challenge %q, got %q", tt.wantChallenge, got)
+			}
+		})
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	ctx := context.Background()
+
+	mapper := NewMemoryCidMapper()
+	mapper.Set(path.New("/ipfs/bafkqaaa"), map[string]string{"index.docker.io/library/app:v1": "/ipfs/bafkqaaa"})
+
+	if _, err := mapper.Resolve(ctx, "library/app:v2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected an unmapped reference to be not found, got %v", err)
+	}
+
+	if _, err := mapper.Resolve(ctx, "Not A Reference"); !errors.Is(err, ErrInvalidReference) {
+		t.Errorf("expected an invalid reference, got %v", err)
+	}
+
+	client := testingIpfs(t, ctx)
+	_, p := addImage(t, ctx, client)
+
+	reader := ipfs{client: client, index: nopIndex{}}
+	if _, _, err := reader.ReadBlob(ctx, p.Cid().String(), digest.FromString("missing")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a missing blob to be not found, got %v", err)
+	}
+
+	if _, _, err := reader.ReadBlob(ctx, "notacid", digest.FromString("missing")); !errors.Is(err, ErrInvalidReference) {
+		t.Errorf("expected an invalid cid to be an invalid reference, got %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	writeError(rr, fmt.Errorf("resolving: %w", ErrNotPeered), http.StatusNotFound, ErrManifestUnknown)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected an unpeered swarm to be unavailable, got %d", rr.Code)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, p := addImage(t, ctx, client)
+
+	// Mapped image sharing every layer of the one being deleted
+	layer, err := random.Layer(1024, types.OCILayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared, err := mutate.AppendLayers(img, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sp, err := AddImage(ctx, client, shared, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapper := fakeMapper{"index.docker.io/library/app:v1": sp.String()}
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{Mapper: mapper, AllowDelete: true}).Router)
+	defer ts.Close()
+
+	rootDigest := func(p path.Resolved) digest.Digest {
+		resp, err := http.Get(fmt.Sprintf("%s/v2/ipfs/%s/manifests/latest", ts.URL, p.Cid()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return digest.Digest(resp.Header.Get("Docker-Content-Digest"))
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ld, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+	}{
+		{
+			name:       "blob",
+			target:     fmt.Sprintf("/v2/ipfs/%s/blobs/%s", p.Cid(), ld),
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "tag",
+			target:     fmt.Sprintf("/v2/ipfs/%s/manifests/latest", p.Cid()),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "mapped image",
+			target:     fmt.Sprintf("/v2/ipfs/%s/manifests/%s", sp.Cid(), rootDigest(sp)),
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "unmapped image",
+			target:     fmt.Sprintf("/v2/ipfs/%s/manifests/%s", p.Cid(), rootDigest(p)),
+			wantStatus: http.StatusAccepted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodDelete, ts.URL+tt.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("expected %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+		})
+	}
+
+	pinned := func(c cid.Cid) bool {
+		_, ok, err := client.Pin().IsPinned(ctx, path.IpfsPath(c), iopts.Pin.IsPinned.Recursive())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if pinned(p.Cid()) {
+		t.Errorf("expected deleted root %s to be unpinned", p.Cid())
+	}
+
+	refs, err := References(ctx, client, sp.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range refs {
+		if !pinned(c) {
+			t.Errorf("expected %s, still referenced by a mapped image, to stay pinned", c)
+		}
+	}
+}
+
+func TestDeletePinned(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	img, p := addImage(t, ctx, client)
+
+	// Content profile root sharing every layer of the one being deleted
+	layer, err := random.Layer(1024, types.OCILayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profiled, err := mutate.AppendLayers(img, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pp, err := AddImage(ctx, client, profiled, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Root still held for a drained node
+	_, hp := addImage(t, ctx, client)
+
+	cluster := fake.NewClientBuilder().WithObjects(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "a", Annotations: map[string]string{
+			consts.NodeReplicatedAnnotation: hp.Cid().String(),
+		}}},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: consts.ContentProfilesConfigMapName, Namespace: "ripfs-system"},
+			Data:       map[string]string{consts.DefaultContentProfile: pp.Cid().String()},
+		},
+	).Build()
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{
+		Mapper:           fakeMapper{},
+		AllowDelete:      true,
+		Cluster:          cluster,
+		ClusterNamespace: "ripfs-system",
+	}).Router)
+	defer ts.Close()
+
+	del := func(p path.Resolved) int {
+		resp, err := http.Get(fmt.Sprintf("%s/v2/ipfs/%s/manifests/latest", ts.URL, p.Cid()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/v2/ipfs/%s/manifests/%s", ts.URL, p.Cid(), resp.Header.Get("Docker-Content-Digest")), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := del(hp); status != http.StatusConflict {
+		t.Errorf("expected deleting a held root to conflict, got %d", status)
+	}
+
+	if status := del(p); status != http.StatusAccepted {
+		t.Fatalf("expected %d, got %d", http.StatusAccepted, status)
+	}
+
+	pinned := func(c cid.Cid) bool {
+		_, ok, err := client.Pin().IsPinned(ctx, path.IpfsPath(c), iopts.Pin.IsPinned.Recursive())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if pinned(p.Cid()) {
+		t.Errorf("expected deleted root %s to be unpinned", p.Cid())
+	}
+
+	for _, root := range []path.Resolved{pp, hp} {
+		refs, err := References(ctx, client, root.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range refs {
+			if !pinned(c) {
+				t.Errorf("expected %s, referenced by pinned root %s, to stay pinned", c, root.Cid())
+			}
+		}
+	}
+}
+
+func TestFaults(t *testing.T) {
+	ctx := context.Background()
+
+	fi := faults.New()
+	client := faults.Wrap(testingIpfs(t, ctx), fi)
+
+	_, p := addImage(t, ctx, client)
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{IndexCacheSize: -1}).Router)
+	defer ts.Close()
+
+	status := func() int {
+		resp, err := http.Get(fmt.Sprintf("%s/v2/ipfs/%s/manifests/latest", ts.URL, p.Cid()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if err := fi.Set(faults.Config{Missing: []string{p.String()}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(); got != http.StatusNotFound {
+		t.Errorf("expected a missing root to be not found, got %d", got)
+	}
+
+	fi.Set(faults.Config{})
+	if got := status(); got != http.StatusOK {
+		t.Errorf("expected the root to be served once it's provided again, got %d", got)
+	}
+
+	fi.Set(faults.Config{Latency: time.Second})
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	reader := ipfs{client: client, index: nopIndex{}}
+	if _, _, err := reader.ReadManifest(tctx, p.Cid().String(), "latest"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected slow blocks to exceed the deadline, got %v", err)
+	}
+
+	e, err := client.Name().Publish(ctx, p, func(settings *iopts.NamePublishSettings) error {
+		settings.AllowOffline = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi.Set(faults.Config{DropPeers: true})
+	if _, err := client.Name().Resolve(ctx, e.Name()); err == nil {
+		t.Errorf("expected ipns not to resolve once peers are dropped")
+	}
+
+	if _, _, err := NewIpfsCidMapper(client, StaticFetcher(e.Name())).Mappings(ctx); !errors.Is(err, ErrNotPeered) {
+		t.Errorf("expected mappings to be unavailable once peers are dropped, got %v", err)
+	}
+}
+
+func TestAddArtifacts(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	// A remote image with a signature and an sbom attached by cosign, but no attestation
+	rs := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer rs.Close()
+
+	repo, err := name.NewRepository(strings.TrimPrefix(rs.URL, "http://") + "/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(repo.Tag("v1"), img); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, suffix := range []string{"sig", "sbom"} {
+		a, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(repo.Tag(ArtifactTag(d, suffix)), a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root, err := AddImage(ctx, client, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	artifacts, err := AddArtifacts(ctx, client, repo, d, root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := rootDescriptor(ctx, client, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mappings := fakeMapper{"index.docker.io/library/app:v1": root.String()}
+	for _, suffix := range []string{"sig", "sbom"} {
+		p, ok := artifacts[ArtifactTag(subject.Digest, suffix)]
+		if !ok {
+			t.Fatalf("expected the %s to be added by cosign's tag of the stored image, got %v", suffix, artifacts)
+		}
+		mappings["index.docker.io/library/app:"+ArtifactTag(subject.Digest, suffix)] = p.String()
+	}
+	if len(artifacts) != 2 {
+		t.Errorf("expected only the attached artifacts to be added, got %v", artifacts)
+	}
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{Mapper: mappings}).Router)
+	defer ts.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%s/v2/library/app/referrers/%s", ts.URL, subject.Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var idx struct {
+		Manifests []Referrer `json:"manifests"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&idx); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, ref := range idx.Manifests {
+		got = append(got, ref.ArtifactType)
+	}
+	sort.Strings(got)
+
+	if want := []string{ArtifactType("sbom"), ArtifactType("sig")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the stored image's referrers to be %v, got %v", want, got)
+	}
+}
+
+func TestReferrers(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	_, p := addImage(t, ctx, client)
+
+	ts := httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{Mapper: fakeMapper{
+		"index.docker.io/library/app:v1": p.String(),
+	}}).Router)
+
+	resp, err := http.Get(ts.URL + "/v2/library/app/manifests/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	ts.Close()
+
+	subject, err := v1.NewHash(resp.Header.Get("Docker-Content-Digest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A signature attached to the image, added alongside it
+	sig, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, cidMap, err := writeContent(ctx, client, sig, nil, newAddOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const sigType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	m.ArtifactType = sigType
+	m.Subject = &v1.Descriptor{MediaType: types.OCIImageIndex, Digest: subject, Size: resp.ContentLength}
+
+	sp, err := writeImage(ctx, client, m, cidMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts = httptest.NewServer(NewIpfsRegistry(client, &IpfsRegistryOpts{Mapper: fakeMapper{
+		"index.docker.io/library/app:v1": p.String(),
+		"index.docker.io/library/app:" + strings.Replace(subject.String(), ":", "-", 1) + ".sig": sp.String(),
+	}}).Router)
+	defer ts.Close()
+
+	tests := []struct {
+		name        string
+		target      string
+		wantTypes   []string
+		wantFilters string
+	}{
+		{
+			name:      "subject",
+			target:    fmt.Sprintf("/v2/library/app/referrers/%s", subject),
+			wantTypes: []string{sigType},
+		},
+		{
+			name:        "filtered",
+			target:      fmt.Sprintf("/v2/library/app/referrers/%s?artifactType=application/spdx+json", subject),
+			wantTypes:   []string{},
+			wantFilters: "artifactType",
+		},
+		{
+			name:      "no referrers",
+			target:    fmt.Sprintf("/v2/library/app/referrers/%s", digest.FromString("unreferenced")),
+			wantTypes: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d", resp.StatusCode)
+			}
+
+			if got := resp.Header.Get("OCI-Filters-Applied"); got != tt.wantFilters {
+				t.Errorf("expected filters %q, got %q", tt.wantFilters, got)
+			}
+
+			var idx struct {
+				Manifests []Referrer `json:"manifests"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&idx); err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for _, ref := range idx.Manifests {
+				got = append(got, ref.ArtifactType)
+
+				// Referrers are pulled by digest, like any other manifest of the repository
+				mresp, err := http.Get(fmt.Sprintf("%s/v2/library/app/manifests/%s", ts.URL, ref.Digest))
+				if err != nil {
+					t.Fatal(err)
+				}
+				mresp.Body.Close()
+
+				if mresp.StatusCode != http.StatusOK {
+					t.Errorf("expected referrer %s to be pulled, got %d", ref.Digest, mresp.StatusCode)
+				}
+			}
+
+			if !reflect.DeepEqual(got, tt.wantTypes) {
+				t.Errorf("expected artifact types %v, got %v", tt.wantTypes, got)
+			}
+		})
+	}
+}
+
+func TestContentProfile(t *testing.T) {
+	ctx := context.Background()
+
+	client := testingIpfs(t, ctx)
+
+	_, p := addImage(t, ctx, client)
+
+	roots, err := ParseContentProfile(fmt.Sprintf(`
+# the standard image set
+%s
+/ipfs/%s # listed twice
+`, p.Cid(), p.Cid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(roots) != 1 || roots[0] != p.Cid() {
+		t.Fatalf("expected only %s, got %v", p.Cid(), roots)
+	}
+
+	if _, err := ParseContentProfile("not-a-cid"); err == nil {
+		t.Error("expected an invalid cid to be rejected")
+	}
+
+	// Nothing of the image is pinned anymore, as on a node that has yet to fetch it
+	if _, err := Remove(ctx, client, p.Cid(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []Progress
+	n, err := Prefetch(ctx, client, roots, WithPrefetchProgress(func(p Progress) {
+		events = append(events, p)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 root prefetched, got %d", n)
+	}
+
+	// Every object is held in full, through the node's own garbage collection
+	refs, err := References(ctx, client, p.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range refs {
+		if _, pinned, err := client.Pin().IsPinned(ctx, path.IpfsPath(c), iopts.Pin.IsPinned.Recursive()); err != nil {
+			t.Fatal(err)
+		} else if !pinned {
+			t.Errorf("expected %s to be pinned", c)
+		}
+	}
+
+	// Layers are fetched largest first, and the root is only prefetched once all of them are
+	var layers int
+	for i, e := range events {
+		switch e.Phase {
+		case PhaseLayerAdded:
+			if layers++; i > 0 && events[i-1].Phase == PhaseLayerAdded && e.Bytes > events[i-1].Bytes {
+				t.Errorf("expected layers largest first, got %d after %d", e.Bytes, events[i-1].Bytes)
+			}
+		case PhaseAdded:
+			if i != len(events)-1 || e.Cid != p.Cid().String() {
+				t.Errorf("expected %s prefetched last, got %+v", p.Cid(), e)
+			}
+		}
+	}
+	if layers != 3 {
+		t.Errorf("expected 3 layers fetched, got %d", layers)
+	}
+}
+
+func TestPinnedRoots(t *testing.T) {
+	ctx := context.Background()
+
+	roots := make([]cid.Cid, 4)
+	for i := range roots {
+		mh, err := multihash.Sum([]byte(fmt.Sprintf("root-%d", i)), multihash.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots[i] = cid.NewCidV1(cid.Raw, mh)
+	}
+
+	c := fake.NewClientBuilder().WithObjects(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "a", Annotations: map[string]string{
+			consts.NodePinnedAnnotation:     roots[0].String(),
+			consts.NodeReplicatedAnnotation: roots[1].String(),
+		}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "b", Annotations: map[string]string{
+			consts.NodeReplicatedAnnotation: roots[2].String() + "," + roots[1].String(),
+		}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "c"}},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: consts.ContentProfilesConfigMapName, Namespace: "ripfs-system"},
+			Data:       map[string]string{consts.DefaultContentProfile: roots[3].String() + "\n/ipfs/" + roots[0].String()},
+		},
+	).Build()
+
+	tests := []struct {
+		name      string
+		namespace string
+		skip      []string
+		want      []cid.Cid
+	}{
+		{name: "everything", namespace: "ripfs-system", want: roots},
+		{name: "without content profiles", namespace: "other", want: roots[:3]},
+		// b still holds roots[1], only roots[2] is left out
+		{name: "releasing b", namespace: "ripfs-system", skip: []string{"b"}, want: []cid.Cid{roots[0], roots[1], roots[3]}},
+		{name: "releasing a and b", namespace: "ripfs-system", skip: []string{"a", "b"}, want: []cid.Cid{roots[0], roots[3]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PinnedRoots(ctx, c, tt.namespace, tt.skip...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := make(map[cid.Cid]bool)
+			for _, root := range tt.want {
+				want[root] = true
+			}
+			have := make(map[cid.Cid]bool)
+			for _, root := range got {
+				have[root] = true
+			}
+			if len(got) != len(have) || !reflect.DeepEqual(have, want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	bad := fake.NewClientBuilder().WithObjects(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "a", Annotations: map[string]string{
+		consts.NodePinnedAnnotation: "not-a-cid",
+	}}}).Build()
+	if _, err := PinnedRoots(ctx, bad, "ripfs-system"); err == nil {
+		t.Error("expected an invalid annotation to fail")
+	}
+}
+
+func TestReplicationPolicies(t *testing.T) {
+	policies, err := ParseReplicationPolicies(`
+docker.io/library/nginx:1.21:
+  replicas: 3
+index.docker.io/nvidia/cuda:11.6.0-base-ubuntu20.04:
+  nodeSelector:
+    gpu: "true"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := policies["docker.io/library/nginx:1.21"]; p.Replicas != 3 || !p.Matches(map[string]string{"zone": "a"}) {
+		t.Errorf("expected 3 replicas on any node, got %+v", p)
+	}
+	if p := policies["index.docker.io/nvidia/cuda:11.6.0-base-ubuntu20.04"]; p.Matches(nil) || !p.Matches(map[string]string{"gpu": "true", "zone": "a"}) {
+		t.Errorf("expected only gpu nodes to match, got %+v", p)
+	}
+
+	// Policies are recorded as they're parsed
+	again, err := ParseReplicationPolicies(policies.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(policies, again) {
+		t.Errorf("expected %v after a round trip, got %v", policies, again)
+	}
+
+	for _, invalid := range []string{
+		"nginx:latest: {replicas: -1}",
+		"nginx:latest: {nodeSelector: {'not a label': x}}",
+		"'Not A Reference': {replicas: 1}",
+		"nginx:latest: {replica: 1}",
+	} {
+		if _, err := ParseReplicationPolicies(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
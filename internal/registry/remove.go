@@ -0,0 +1,257 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	iopts "github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/opencontainers/go-digest"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+)
+
+// Remove unpins root and everything it references, except for anything still referenced by one of keep (such as
+// layers shared with other images). The unpinned cids are returned, their content is only reclaimed by a repo gc.
+func Remove(ctx context.Context, api iface.CoreAPI, root cid.Cid, keep []cid.Cid) ([]cid.Cid, error) {
+	refs, err := References(ctx, api, root)
+	if err != nil {
+		return nil, fmt.Errorf("walking %s: %v", root, err)
+	}
+
+	kept := make(map[cid.Cid]bool)
+	for _, k := range keep {
+		if k == root {
+			return nil, fmt.Errorf("%s is still referenced", root)
+		}
+
+		krefs, err := References(ctx, api, k)
+		if err != nil {
+			return nil, fmt.Errorf("walking %s: %v", k, err)
+		}
+
+		for _, kc := range krefs {
+			kept[kc] = true
+		}
+	}
+
+	var removed []cid.Cid
+	for _, c := range refs {
+		if kept[c] {
+			continue
+		}
+
+		// Objects are each pinned as they're added, anything that isn't was pinned by something else
+		if _, pinned, err := api.Pin().IsPinned(ctx, path.IpfsPath(c), iopts.Pin.IsPinned.Recursive()); err != nil {
+			return removed, err
+		} else if !pinned {
+			continue
+		}
+
+		if err := api.Pin().Rm(ctx, path.IpfsPath(c)); err != nil {
+			return removed, fmt.Errorf("unpinning %s: %v", c, err)
+		}
+		removed = append(removed, c)
+	}
+	return removed, nil
+}
+
+// PinnedRoots returns the roots the cluster holds pinned besides its mappings: those assigned to nodes by replication
+// policies, those the manager holds for drained nodes, and those of every content profile (in namespace). Anything
+// shared with one of them must be kept when removing an image, even once nothing maps them anymore. The roots held for
+// the drained nodes named by skip are left out, for releasing them.
+func PinnedRoots(ctx context.Context, c client.Reader, namespace string, skip ...string) ([]cid.Cid, error) {
+	var (
+		roots []cid.Cid
+		seen  = make(map[cid.Cid]bool)
+	)
+	add := func(what, data string) error {
+		rs, err := ParseContentProfile(data)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", what, err)
+		}
+
+		for _, root := range rs {
+			if !seen[root] {
+				seen[root] = true
+				roots = append(roots, root)
+			}
+		}
+		return nil
+	}
+
+	nodes := &corev1.NodeList{}
+	if err := c.List(ctx, nodes); err != nil {
+		return nil, fmt.Errorf("listing nodes: %v", err)
+	}
+
+	// The annotations list roots as a content profile does, only comma separated
+	skipped := make(map[string]bool)
+	for _, name := range skip {
+		skipped[name] = true
+	}
+
+	for _, node := range nodes.Items {
+		for _, a := range []string{consts.NodePinnedAnnotation, consts.NodeReplicatedAnnotation} {
+			if skipped[node.Name] && a == consts.NodeReplicatedAnnotation {
+				continue
+			}
+
+			if err := add(node.Name+" "+a, strings.ReplaceAll(node.Annotations[a], ",", "\n")); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cm := &corev1.ConfigMap{}
+	err := c.Get(ctx, types.NamespacedName{Name: consts.ContentProfilesConfigMapName, Namespace: namespace}, cm)
+	if errors.IsNotFound(err) {
+		return roots, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading content profiles: %v", err)
+	}
+
+	for profile, data := range cm.Data {
+		if err := add("content profile "+profile, data); err != nil {
+			return nil, err
+		}
+	}
+	return roots, nil
+}
+
+// RepoGC collects everything in the repo that is no longer pinned
+func RepoGC(ctx context.Context, api iface.CoreAPI) error {
+	r, ok := api.(requester)
+	if !ok {
+		return fmt.Errorf("ipfs client doesn't support repo gc")
+	}
+
+	resp, err := r.Request("repo/gc").Send(ctx)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	_, err = io.Copy(io.Discard, resp.Output)
+	return err
+}
+
+// RepoSize returns the size of the repo in bytes
+func RepoSize(ctx context.Context, api iface.CoreAPI) (uint64, error) {
+	r, ok := api.(requester)
+	if !ok {
+		return 0, fmt.Errorf("ipfs client doesn't support repo stat")
+	}
+
+	stat := struct {
+		RepoSize uint64
+	}{}
+	if err := r.Request("repo/stat").Option("size-only", true).Exec(ctx, &stat); err != nil {
+		return 0, err
+	}
+	return stat.RepoSize, nil
+}
+
+// buildDeleteManifestHandler removes an image by its root manifest's digest. Images that are still mapped to a name
+// must be removed with ripfs rm instead, which also removes their mapping.
+func (i *IpfsRegistry) buildDeleteManifestHandler(client iface.CoreAPI, rdr Reader) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		name := chi.URLParam(r, "cid")
+		root, err := cid.Decode(name)
+		if err != nil {
+			regError(http.StatusBadRequest, ErrNameInvalid, "invalid cid %s: %v", name, err).write(w)
+			return
+		}
+
+		d, err := digest.Parse(chi.URLParam(r, "reference"))
+		if err != nil {
+			regError(http.StatusBadRequest, ErrDigestInvalid, "manifests can only be deleted by digest").write(w)
+			return
+		}
+
+		content, _, err := rdr.ReadManifest(ctx, name, "latest")
+		if err != nil {
+			writeError(w, err, http.StatusNotFound, ErrManifestUnknown)
+			return
+		}
+
+		rd, _, err := digestContent(content, i.maxManifestSize)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+			return
+		}
+
+		if rd != d {
+			regError(http.StatusMethodNotAllowed, ErrUnsupported, "only the root manifest (%s) of an image can be deleted", rd).write(w)
+			return
+		}
+
+		var keep []cid.Cid
+		if i.mapper != nil {
+			_, mappings, err := i.mapper.Mappings(ctx)
+			if err != nil {
+				writeError(w, err, http.StatusServiceUnavailable, ErrUnavailable)
+				return
+			}
+
+			for ref, v := range mappings {
+				rp, err := client.ResolvePath(ctx, path.New(v))
+				if err != nil {
+					writeError(w, fmt.Errorf("resolving %s: %v", ref, err), http.StatusInternalServerError, ErrUnknown)
+					return
+				}
+
+				if rp.Cid() == root {
+					regError(http.StatusConflict, ErrDenied, "%s is still mapped by %s, remove it with ripfs rm", root, ref).write(w)
+					return
+				}
+				keep = append(keep, rp.Cid())
+			}
+		}
+
+		// Roots still assigned to nodes, held for drained ones or prefetched by content profiles stay pinned too
+		if i.cluster != nil {
+			pinned, err := PinnedRoots(ctx, i.cluster, i.clusterNamespace)
+			if err != nil {
+				writeError(w, fmt.Errorf("listing pinned roots: %v", err), http.StatusServiceUnavailable, ErrUnavailable)
+				return
+			}
+
+			for _, p := range pinned {
+				if p == root {
+					regError(http.StatusConflict, ErrDenied, "%s is still pinned by a node or content profile", root).write(w)
+					return
+				}
+				keep = append(keep, p)
+			}
+		}
+
+		if _, err := Remove(ctx, client, root, keep); err != nil {
+			writeError(w, err, http.StatusInternalServerError, ErrUnknown)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// deleteBlob refuses to delete blobs on their own, they're shared between images and removed along with them
+func deleteBlob(w http.ResponseWriter, r *http.Request) {
+	regError(http.StatusMethodNotAllowed, ErrUnsupported, "blobs are removed along with the images referencing them").write(w)
+}
@@ -0,0 +1,197 @@
+package registry
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/verify"
+)
+
+// MappingKeys returns the public keys trusted to sign mappings
+type MappingKeys func(ctx context.Context) ([]crypto.PublicKey, error)
+
+// StaticMappingKeys always trusts keys
+func StaticMappingKeys(keys ...crypto.PublicKey) MappingKeys {
+	return func(ctx context.Context) ([]crypto.PublicKey, error) {
+		return keys, nil
+	}
+}
+
+// ConfigMapMappingKeys trusts every pem encoded public key held by the config map key, so keys are added (or revoked)
+// by editing it. Read from an informer's cache, it's only fetched once.
+func ConfigMapMappingKeys(reader client.Reader, key types.NamespacedName) MappingKeys {
+	return func(ctx context.Context) ([]crypto.PublicKey, error) {
+		cm := &corev1.ConfigMap{}
+		if err := reader.Get(ctx, key, cm); err != nil {
+			return nil, fmt.Errorf("reading mapping keys: %v", err)
+		}
+
+		keys := make([]crypto.PublicKey, 0, len(cm.Data))
+		for name, data := range cm.Data {
+			k, err := verify.ParsePublicKey([]byte(data))
+			if err != nil {
+				return nil, fmt.Errorf("invalid mapping key %s: %v", name, err)
+			}
+			keys = append(keys, k)
+		}
+		return keys, nil
+	}
+}
+
+// CachingMappingKeys caches the keys returned by keys for up to ttl, rather than fetching them for every lookup. Expired
+// keys are served for up to stale longer while they're fetched again in the background, as with
+// WithStaleWhileRevalidate, so lookups only wait on keys when nothing recent enough is cached.
+func CachingMappingKeys(keys MappingKeys, ttl time.Duration, stale time.Duration) MappingKeys {
+	var (
+		mu         sync.Mutex
+		cached     []crypto.PublicKey
+		expires    time.Time
+		refreshing bool
+	)
+
+	refresh := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cacheRefreshTimeout)
+		defer cancel()
+
+		k, err := keys(ctx)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		refreshing = false
+		if err == nil {
+			cached, expires = k, time.Now().Add(ttl)
+		}
+	}
+
+	return func(ctx context.Context) ([]crypto.PublicKey, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := time.Now()
+		if cached != nil && now.Before(expires) {
+			return cached, nil
+		}
+		if cached != nil && now.Before(expires.Add(stale)) {
+			if !refreshing {
+				refreshing = true
+				go refresh()
+			}
+			return cached, nil
+		}
+
+		k, err := keys(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cached, expires = k, time.Now().Add(ttl)
+		return k, nil
+	}
+}
+
+// mappingPayload is what's signed for the mapping of reference to root, binding the two so neither can be swapped
+// for another
+func mappingPayload(reference string, root string) []byte {
+	return []byte("ripfs.dev/mapping/v1\n" + reference + "\n" + strings.TrimPrefix(root, "/ipfs/"))
+}
+
+// SignMapping signs the mapping of reference to root with key, returning the (base64 encoded) signature recorded
+// alongside it
+func SignMapping(key crypto.Signer, reference string, root string) (string, error) {
+	sig, err := verify.Sign(key, mappingPayload(reference, root))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// VerifyMapping returns ErrUnverified unless sig is a signature of the mapping of reference to root by one of keys
+func VerifyMapping(keys []crypto.PublicKey, reference string, root string, sig string) error {
+	if sig == "" {
+		return fmt.Errorf("%w: %s isn't signed", ErrUnverified, reference)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("%w: invalid signature of %s: %v", ErrUnverified, reference, err)
+	}
+
+	payload := mappingPayload(reference, root)
+	for _, k := range keys {
+		if verify.VerifySignature(k, payload, raw) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s isn't signed by a trusted key", ErrUnverified, reference)
+}
+
+// EnsureMappingKey generates the cluster's mapping key into the secret key when there's none yet, and makes sure its
+// public key is trusted by the config map keys
+func EnsureMappingKey(ctx context.Context, c client.Client, key types.NamespacedName, keys types.NamespacedName) error {
+	s := &corev1.Secret{}
+	err := c.Get(ctx, key, s)
+	if errors.IsNotFound(err) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return err
+		}
+
+		s = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+			Data:       map[string][]byte{consts.MappingKeySecretKey: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})},
+		}
+		if err := c.Create(ctx, s); err != nil {
+			// Should another replica have generated it meanwhile, its key is trusted once this is retried
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	signer, err := verify.ParsePrivateKey(s.Data[consts.MappingKeySecretKey])
+	if err != nil {
+		return fmt.Errorf("invalid mapping key: %v", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+	pub := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: keys.Name, Namespace: keys.Namespace}}
+		_, err := controllerutil.CreateOrUpdate(ctx, c, cm, func() error {
+			if cm.Data == nil {
+				cm.Data = make(map[string]string)
+			}
+			cm.Data[consts.MappingKeysClusterKey] = pub
+			return nil
+		})
+		return err
+	})
+}
@@ -0,0 +1,121 @@
+package registry
+
+import (
+	_ "embed"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// VirtualHostsConfigSchema is the json schema of a VirtualHostsConfig, for editors and admission to validate against
+//
+//go:embed vhost.schema.json
+var VirtualHostsConfigSchema []byte
+
+// VirtualHostsConfig describes the logical registries served from a single process
+type VirtualHostsConfig struct {
+	Hosts []VirtualHostConfig `json:"hosts"`
+}
+
+// VirtualHostConfig describes a single logical registry, selected by either its Host header or path prefix
+type VirtualHostConfig struct {
+	Name string `json:"name"`
+
+	// Host matches the request's Host header (without the port)
+	Host string `json:"host,omitempty"`
+
+	// Prefix matches (and is stripped from) the beginning of the request's path
+	Prefix string `json:"prefix,omitempty"`
+
+	MapIpnsCid string `json:"mapIpnsCid,omitempty"`
+}
+
+// LoadVirtualHostsConfig reads a VirtualHostsConfig from a yaml or json file
+func LoadVirtualHostsConfig(path string) (*VirtualHostsConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &VirtualHostsConfig{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, h := range cfg.Hosts {
+		if h.Name == "" {
+			return nil, fmt.Errorf("virtual host is missing a name")
+		}
+		if names[h.Name] {
+			return nil, fmt.Errorf("virtual host %s is defined more than once", h.Name)
+		}
+		if h.Host == "" && h.Prefix == "" {
+			return nil, fmt.Errorf("virtual host %s must specify a host, prefix, or both", h.Name)
+		}
+		names[h.Name] = true
+	}
+	return cfg, nil
+}
+
+type virtualHost struct {
+	host    string
+	prefix  string
+	handler http.Handler
+}
+
+// VirtualHosts dispatches requests to one of several registries by Host header or path prefix
+type VirtualHosts struct {
+	hosts    []virtualHost
+	fallback http.Handler
+}
+
+// NewVirtualHosts returns a VirtualHosts that serves anything unmatched with fallback
+func NewVirtualHosts(fallback http.Handler) *VirtualHosts {
+	return &VirtualHosts{fallback: fallback}
+}
+
+// Add registers handler for requests matching either host or prefix, when both are given both must match
+func (v *VirtualHosts) Add(host string, prefix string, handler http.Handler) {
+	v.hosts = append(v.hosts, virtualHost{
+		host:    strings.ToLower(host),
+		prefix:  "/" + strings.Trim(prefix, "/"),
+		handler: handler,
+	})
+}
+
+func (v *VirtualHosts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, vh := range v.hosts {
+		if vh.host != "" && vh.host != host {
+			continue
+		}
+
+		if vh.prefix == "/" {
+			vh.handler.ServeHTTP(w, r)
+			return
+		}
+
+		if r.URL.Path != vh.prefix && !strings.HasPrefix(r.URL.Path, vh.prefix+"/") {
+			continue
+		}
+
+		http.StripPrefix(vh.prefix, vh.handler).ServeHTTP(w, r)
+		return
+	}
+
+	if v.fallback == nil {
+		http.NotFound(w, r)
+		return
+	}
+	v.fallback.ServeHTTP(w, r)
+}
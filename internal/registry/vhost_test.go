@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + ":" + r.URL.Path))
+		})
+	}
+
+	vh := NewVirtualHosts(named("default"))
+	vh.Add("dev.example.com", "", named("dev"))
+	vh.Add("", "/prod", named("prod"))
+	vh.Add("edge.example.com", "/staging", named("staging"))
+
+	tests := []struct {
+		name   string
+		host   string
+		target string
+		want   string
+	}{
+		{name: "host", host: "dev.example.com:5050", target: "/v2/", want: "dev:/v2/"},
+		{name: "prefix", host: "localhost", target: "/prod/v2/", want: "prod:/v2/"},
+		{name: "host and prefix", host: "edge.example.com", target: "/staging/v2/", want: "staging:/v2/"},
+		{name: "host without prefix", host: "edge.example.com", target: "/v2/", want: "default:/v2/"},
+		{name: "partial prefix", host: "localhost", target: "/production/v2/", want: "default:/production/v2/"},
+		{name: "fallback", host: "localhost", target: "/v2/", want: "default:/v2/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Host = tt.host
+			rr := httptest.NewRecorder()
+
+			vh.ServeHTTP(rr, req)
+
+			got, err := io.ReadAll(rr.Result().Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestVirtualHostsConfigSchema keeps the published schema in step with the config's types
+func TestVirtualHostsConfigSchema(t *testing.T) {
+	var schema struct {
+		Properties map[string]struct {
+			Items struct {
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"items"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(VirtualHostsConfigSchema, &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := func(typ reflect.Type) []string {
+		var names []string
+		for i := 0; i < typ.NumField(); i++ {
+			names = append(names, strings.Split(typ.Field(i).Tag.Get("json"), ",")[0])
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	keys := func(m interface{}) []string {
+		var names []string
+		for _, k := range reflect.ValueOf(m).MapKeys() {
+			names = append(names, k.String())
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if got, want := keys(schema.Properties), fields(reflect.TypeOf(VirtualHostsConfig{})); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected config properties %v, got %v", want, got)
+	}
+
+	if got, want := keys(schema.Properties["hosts"].Items.Properties), fields(reflect.TypeOf(VirtualHostConfig{})); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected host properties %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,442 @@
+// Package verify verifies the cosign signatures of images, either made with a key pair or keylessly with a fulcio
+// certificate, entirely offline so it works from within an air gap.
+package verify
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	// SignatureAnnotation, CertificateAnnotation, ChainAnnotation and BundleAnnotation are the annotations cosign
+	// gives each signature layer
+	SignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	CertificateAnnotation = "dev.sigstore.cosign/certificate"
+	ChainAnnotation       = "dev.sigstore.cosign/chain"
+	BundleAnnotation      = "dev.sigstore.cosign/bundle"
+
+	// SignatureType is the type of the simple signing payloads cosign signs
+	SignatureType = "cosign container image signature"
+)
+
+var (
+	// ErrNoSignatures is returned when an image isn't signed at all
+	ErrNoSignatures = errors.New("no signatures found")
+
+	// oidIssuer and oidIssuerV2 are the fulcio extensions carrying the oidc issuer a certificate was issued for
+	oidIssuer   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// Verifier verifies the cosign signatures of images. Signatures are verified with Key when it's set, otherwise
+// keylessly: signed with a certificate chaining to Roots, issued to Identity by Issuer, and logged by the rekor
+// instance signing with RekorKey while the certificate was still valid.
+type Verifier struct {
+	Key crypto.PublicKey
+
+	Roots         *x509.CertPool
+	Intermediates *x509.CertPool
+	Identity      string
+	Issuer        string
+	RekorKey      crypto.PublicKey
+
+	// Options are used to fetch signatures
+	Options []remote.Option
+}
+
+// Verify returns an error unless the image (or index) with digest d, within repo, has at least one valid signature
+func (v *Verifier) Verify(repo name.Repository, d v1.Hash) error {
+	if v.Key == nil && (v.Roots == nil || v.RekorKey == nil || v.Identity == "" || v.Issuer == "") {
+		return fmt.Errorf("keyless verification requires fulcio roots, a rekor key, and the expected identity and issuer")
+	}
+
+	tag := repo.Tag(fmt.Sprintf("%s-%s.sig", d.Algorithm, d.Hex))
+
+	img, err := remote.Image(tag, v.Options...)
+	if err != nil {
+		return fmt.Errorf("%w: fetching %s: %v", ErrNoSignatures, tag, err)
+	}
+
+	if err := v.VerifyImage(img, d); err != nil {
+		return fmt.Errorf("%s: %w", tag, err)
+	}
+	return nil
+}
+
+// VerifyImage returns an error unless the cosign signature image sig (such as one stored alongside an image, rather
+// than fetched from its registry) holds at least one valid signature of digest d
+func (v *Verifier) VerifyImage(sig v1.Image, d v1.Hash) error {
+	if v.Key == nil && (v.Roots == nil || v.RekorKey == nil || v.Identity == "" || v.Issuer == "") {
+		return fmt.Errorf("keyless verification requires fulcio roots, a rekor key, and the expected identity and issuer")
+	}
+
+	m, err := sig.Manifest()
+	if err != nil {
+		return err
+	}
+
+	if len(m.Layers) == 0 {
+		return fmt.Errorf("%w: no signature layers", ErrNoSignatures)
+	}
+
+	var errs error
+	for _, desc := range m.Layers {
+		l, err := sig.LayerByDigest(desc.Digest)
+		if err != nil {
+			return err
+		}
+
+		rc, err := l.Compressed()
+		if err != nil {
+			return err
+		}
+		payload, err := io.ReadAll(io.LimitReader(rc, 1<<20))
+		rc.Close()
+		if err != nil {
+			return err
+		}
+
+		err = v.verifyLayer(desc.Annotations, payload, d)
+		if err == nil {
+			return nil
+		}
+		errs = multierror.Append(errs, fmt.Errorf("signature %s: %v", desc.Digest, err))
+	}
+	return fmt.Errorf("no valid signatures: %v", errs)
+}
+
+// payload is the simple signing payload cosign signs
+type payload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// verifyLayer verifies a single signature layer, with the given annotations and payload, signs d
+func (v *Verifier) verifyLayer(annotations map[string]string, data []byte, d v1.Hash) error {
+	var p payload
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("invalid payload: %v", err)
+	}
+
+	if p.Critical.Type != SignatureType {
+		return fmt.Errorf("unexpected payload type %q", p.Critical.Type)
+	}
+
+	if p.Critical.Image.DockerManifestDigest != d.String() {
+		return fmt.Errorf("signs %s, not %s", p.Critical.Image.DockerManifestDigest, d)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(annotations[SignatureAnnotation])
+	if err != nil || len(sig) == 0 {
+		return fmt.Errorf("missing or invalid signature annotation")
+	}
+
+	if v.Key != nil {
+		return VerifySignature(v.Key, data, sig)
+	}
+
+	cert, err := parseCertificate([]byte(annotations[CertificateAnnotation]))
+	if err != nil {
+		return fmt.Errorf("invalid certificate: %v", err)
+	}
+
+	integrated, err := v.verifyBundle([]byte(annotations[BundleAnnotation]), data, annotations[SignatureAnnotation])
+	if err != nil {
+		return fmt.Errorf("invalid transparency log bundle: %v", err)
+	}
+
+	if err := v.verifyCertificate(cert, []byte(annotations[ChainAnnotation]), integrated); err != nil {
+		return err
+	}
+
+	return VerifySignature(cert.PublicKey, data, sig)
+}
+
+// verifyCertificate verifies cert chains to the fulcio roots as of t, and was issued to the expected identity
+func (v *Verifier) verifyCertificate(cert *x509.Certificate, chain []byte, t time.Time) error {
+	intermediates := x509.NewCertPool()
+	if v.Intermediates != nil {
+		intermediates = v.Intermediates.Clone()
+	}
+	if len(chain) > 0 {
+		intermediates.AppendCertsFromPEM(chain)
+	}
+
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   t,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return fmt.Errorf("untrusted certificate: %v", err)
+	}
+
+	var identities []string
+	identities = append(identities, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		identities = append(identities, u.String())
+	}
+
+	found := false
+	for _, id := range identities {
+		if id == v.Identity {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("certificate issued to %v, not %s", identities, v.Identity)
+	}
+
+	if issuer := certificateIssuer(cert); issuer != v.Issuer {
+		return fmt.Errorf("certificate issued by %q, not %s", issuer, v.Issuer)
+	}
+	return nil
+}
+
+// certificateIssuer returns the oidc issuer a fulcio certificate was issued for
+func certificateIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidIssuerV2):
+			var s string
+			if _, err := asn1.Unmarshal(ext.Value, &s); err == nil {
+				return s
+			}
+		case ext.Id.Equal(oidIssuer):
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+// bundle is rekor's signed promise that a signature was logged
+type bundle struct {
+	SignedEntryTimestamp []byte `json:"SignedEntryTimestamp"`
+	Payload              struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogIndex       int64  `json:"logIndex"`
+		LogID          string `json:"logID"`
+	} `json:"Payload"`
+}
+
+// hashedRekord is the body of the rekor entries cosign logs
+type hashedRekord struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content string `json:"content"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// verifyBundle verifies rekor signed the bundle, logging the signature sig over data, and returns when it was logged
+func (v *Verifier) verifyBundle(raw []byte, data []byte, sig string) (time.Time, error) {
+	if len(raw) == 0 {
+		return time.Time{}, fmt.Errorf("missing")
+	}
+
+	var b bundle
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return time.Time{}, err
+	}
+
+	// The signed entry timestamp signs the payload's canonical json, which for these fields is simply sorted
+	canonical, err := json.Marshal(map[string]interface{}{
+		"body":           b.Payload.Body,
+		"integratedTime": b.Payload.IntegratedTime,
+		"logIndex":       b.Payload.LogIndex,
+		"logID":          b.Payload.LogID,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := VerifySignature(v.RekorKey, canonical, b.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("not signed by rekor: %v", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(b.Payload.Body)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var entry hashedRekord
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, err
+	}
+
+	if entry.Kind != "hashedrekord" {
+		return time.Time{}, fmt.Errorf("unsupported entry kind %q", entry.Kind)
+	}
+
+	h := sha256.Sum256(data)
+	if entry.Spec.Data.Hash.Algorithm != "sha256" || entry.Spec.Data.Hash.Value != hex.EncodeToString(h[:]) {
+		return time.Time{}, fmt.Errorf("logs a different payload")
+	}
+
+	if entry.Spec.Signature.Content != sig {
+		return time.Time{}, fmt.Errorf("logs a different signature")
+	}
+
+	return time.Unix(b.Payload.IntegratedTime, 0), nil
+}
+
+// verifySignature verifies sig signs the sha256 digest of data (or data itself, for ed25519 keys)
+func VerifySignature(pub crypto.PublicKey, data []byte, sig []byte) error {
+	digest := sha256.Sum256(data)
+
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, data, sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", pub)
+}
+
+// Sign signs the sha256 digest of data (or data itself, for ed25519 keys) with key, as VerifySignature verifies it
+func Sign(key crypto.Signer, data []byte) ([]byte, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+
+	digest := sha256.Sum256(data)
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// LoadPublicKey loads a pem encoded public key, such as cosign.pub
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := ParsePublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return k, nil
+}
+
+// ParsePublicKey parses a pem encoded public key
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("not pem encoded")
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// LoadPrivateKey loads an unencrypted, pem encoded pkcs8 private key
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return k, nil
+}
+
+// ParsePrivateKey parses an unencrypted, pem encoded pkcs8 private key
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("not pem encoded")
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", k)
+	}
+	return signer, nil
+}
+
+// LoadCertificates loads a bundle of pem encoded certificates (such as fulcio's) into a pool of its self signed roots,
+// and a pool of everything else
+func LoadCertificates(path string) (*x509.CertPool, *x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for n := 0; ; n++ {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			if n == 0 {
+				return nil, nil, fmt.Errorf("%s has no certificates", path)
+			}
+			return roots, intermediates, nil
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+			roots.AddCert(cert)
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+}
+
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("missing")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,267 @@
+package verify
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+)
+
+// testRepo serves a repository with a single random image, returning it along with the image's digest
+func testRepo(t *testing.T) (name.Repository, v1.Hash) {
+	ts := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	t.Cleanup(ts.Close)
+
+	repo, err := name.NewRepository(strings.TrimPrefix(ts.URL, "http://") + "/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remote.Write(repo.Tag("v1"), img); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo, d
+}
+
+func signedPayload(d v1.Hash) []byte {
+	return []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"app"},"image":{"docker-manifest-digest":%q},"type":%q},"optional":null}`, d, SignatureType))
+}
+
+// sign signs payload with key, returning the signature's base64
+func sign(t *testing.T, key *ecdsa.PrivateKey, payload []byte) string {
+	h := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// writeSignature writes a cosign signature of d, with the given payload and annotations, to repo
+func writeSignature(t *testing.T, repo name.Repository, d v1.Hash, payload []byte, annotations map[string]string) {
+	img, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       static.NewLayer(payload, "application/vnd.dev.cosign.simplesigning.v1+json"),
+		Annotations: annotations,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remote.Write(repo.Tag(fmt.Sprintf("%s-%s.sig", d.Algorithm, d.Hex)), img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerifyKey(t *testing.T) {
+	repo, d := testRepo(t)
+
+	key := newKey(t)
+	payload := signedPayload(d)
+	writeSignature(t, repo, d, payload, map[string]string{SignatureAnnotation: sign(t, key, payload)})
+
+	if err := (&Verifier{Key: &key.PublicKey}).Verify(repo, d); err != nil {
+		t.Fatalf("expected a valid signature, got %v", err)
+	}
+
+	if err := (&Verifier{Key: &newKey(t).PublicKey}).Verify(repo, d); err == nil {
+		t.Error("expected a signature made with another key to be invalid")
+	}
+
+	other := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+	if err := (&Verifier{Key: &key.PublicKey}).Verify(repo, other); !errors.Is(err, ErrNoSignatures) {
+		t.Errorf("expected an unsigned image to have no signatures, got %v", err)
+	}
+
+	// A valid signature of another image doesn't sign this one
+	writeSignature(t, repo, other, payload, map[string]string{SignatureAnnotation: sign(t, key, payload)})
+	if err := (&Verifier{Key: &key.PublicKey}).Verify(repo, other); err == nil {
+		t.Error("expected a signature of another image to be invalid")
+	}
+}
+
+func TestVerifyKeyless(t *testing.T) {
+	const (
+		identity = "dev@example.com"
+		issuer   = "https://issuer.example.com"
+	)
+
+	repo, d := testRepo(t)
+
+	// A fulcio-like root, issuing a short lived certificate that has long since expired
+	rootKey := newKey(t)
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fulcio"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuerExt, err := asn1.Marshal(issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := time.Now().Add(-time.Hour)
+	leafKey := newKey(t)
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       signed.Add(-time.Minute),
+		NotAfter:        signed.Add(10 * time.Minute),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses:  []string{identity},
+		ExtraExtensions: []pkix.Extension{{Id: oidIssuerV2, Value: issuerExt}},
+	}, root, &leafKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rekorKey := newKey(t)
+
+	payload := signedPayload(d)
+	sig := sign(t, leafKey, payload)
+
+	// bundleAt is rekor's bundle of the signature, logged at integrated
+	bundleAt := func(integrated time.Time) string {
+		h := sha256.Sum256(payload)
+		body, err := json.Marshal(map[string]interface{}{
+			"apiVersion": "0.0.1",
+			"kind":       "hashedrekord",
+			"spec": map[string]interface{}{
+				"data":      map[string]interface{}{"hash": map[string]string{"algorithm": "sha256", "value": hex.EncodeToString(h[:])}},
+				"signature": map[string]interface{}{"content": sig},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bundle
+		b.Payload.Body = base64.StdEncoding.EncodeToString(body)
+		b.Payload.IntegratedTime = integrated.Unix()
+		b.Payload.LogIndex = 42
+		b.Payload.LogID = hex.EncodeToString(h[:])
+
+		canonical := fmt.Sprintf(`{"body":%q,"integratedTime":%d,"logID":%q,"logIndex":%d}`,
+			b.Payload.Body, b.Payload.IntegratedTime, b.Payload.LogID, b.Payload.LogIndex)
+		set, err := base64.StdEncoding.DecodeString(sign(t, rekorKey, []byte(canonical)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.SignedEntryTimestamp = set
+
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	tests := []struct {
+		name     string
+		identity string
+		bundle   string
+		wantErr  bool
+	}{
+		{
+			name:     "valid",
+			identity: identity,
+			bundle:   bundleAt(signed),
+		},
+		{
+			name:     "other identity",
+			identity: "someone@example.com",
+			bundle:   bundleAt(signed),
+			wantErr:  true,
+		},
+		{
+			name:     "logged once expired",
+			identity: identity,
+			bundle:   bundleAt(signed.Add(time.Hour)),
+			wantErr:  true,
+		},
+		{
+			name:     "unlogged",
+			identity: identity,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeSignature(t, repo, d, payload, map[string]string{
+				SignatureAnnotation:   sig,
+				CertificateAnnotation: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})),
+				BundleAnnotation:      tt.bundle,
+			})
+
+			v := &Verifier{
+				Roots:    roots,
+				Identity: tt.identity,
+				Issuer:   issuer,
+				RekorKey: &rekorKey.PublicKey,
+			}
+
+			if err := v.Verify(repo, d); (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
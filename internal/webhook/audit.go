@@ -0,0 +1,36 @@
+package webhook
+
+import (
+	"context"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// audit logs a structured entry of what webhook decided for the pod admitted by req, and the images it rewrote (by
+// the image they were rewritten from)
+func audit(ctx context.Context, webhook string, req admission.Request, resp admission.Response, rewritten map[string]string) {
+	kv := []interface{}{
+		"webhook", webhook,
+		"uid", req.UID,
+		"operation", req.Operation,
+		"namespace", req.Namespace,
+		"name", req.Name,
+		"user", req.UserInfo.Username,
+		"allowed", resp.Allowed,
+	}
+	if req.SubResource != "" {
+		kv = append(kv, "subresource", req.SubResource)
+	}
+	// Allowed and denied responses carry their reason as the result's reason, errored ones as its message
+	if resp.Result != nil && resp.Result.Reason != "" {
+		kv = append(kv, "reason", string(resp.Result.Reason))
+	} else if resp.Result != nil && resp.Result.Message != "" {
+		kv = append(kv, "reason", resp.Result.Message)
+	}
+	if len(rewritten) > 0 {
+		kv = append(kv, "rewritten", rewritten)
+	}
+
+	log.FromContext(ctx).WithName("audit").Info("admission", kv...)
+}
@@ -0,0 +1,80 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// audited returns the audit entry logged by audit, with the given arguments
+func audited(t *testing.T, webhook string, req admission.Request, resp admission.Response, rewritten map[string]string) map[string]interface{} {
+	var buf bytes.Buffer
+	ctx := log.IntoContext(context.Background(), zap.New(zap.WriteTo(&buf)))
+
+	audit(ctx, webhook, req, resp, rewritten)
+
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a single json entry, got %q: %v", buf.String(), err)
+	}
+	return entry
+}
+
+func TestAudit(t *testing.T) {
+	req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		UID:       "uid",
+		Operation: admissionv1.Create,
+		Namespace: "default",
+		Name:      "app",
+		UserInfo:  authenticationv1.UserInfo{Username: "alice"},
+	}}
+
+	entry := audited(t, mutatorName, req, admission.Allowed("rewritten"), map[string]string{"nginx:1.21": "localhost:31609/ipfs/" + testingRoot})
+	want := map[string]interface{}{
+		"logger":    "audit",
+		"msg":       "admission",
+		"webhook":   mutatorName,
+		"uid":       "uid",
+		"operation": "CREATE",
+		"namespace": "default",
+		"name":      "app",
+		"user":      "alice",
+		"allowed":   true,
+		"reason":    "rewritten",
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("expected %s to be %v, got %v", k, v, entry[k])
+		}
+	}
+	if rewritten, ok := entry["rewritten"].(map[string]interface{}); !ok || rewritten["nginx:1.21"] != "localhost:31609/ipfs/"+testingRoot {
+		t.Errorf("expected what was rewritten to be audited, got %v", entry["rewritten"])
+	}
+	if _, ok := entry["subresource"]; ok {
+		t.Errorf("expected no subresource when admitting the pod itself, got %v", entry["subresource"])
+	}
+
+	// Denials are audited with their reason, along with the subresource they came through
+	req.SubResource = "ephemeralcontainers"
+	entry = audited(t, validatorName, req, admission.Denied("unsigned"), nil)
+	if entry["allowed"] != false || entry["reason"] != "unsigned" || entry["subresource"] != "ephemeralcontainers" {
+		t.Errorf("expected a denial through the ephemeralcontainers subresource, got %v", entry)
+	}
+	if _, ok := entry["rewritten"]; ok {
+		t.Errorf("expected nothing rewritten to be audited, got %v", entry["rewritten"])
+	}
+
+	entry = audited(t, mutatorName, req, admission.Errored(http.StatusBadRequest, errors.New("invalid pod")), nil)
+	if entry["allowed"] != false || entry["reason"] != "invalid pod" {
+		t.Errorf("expected the error to be audited as the reason, got %v", entry)
+	}
+}
@@ -0,0 +1,184 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The keys of the webhook's certificate secret, as written by the cert rotator
+const (
+	CertKey   = "tls.crt"
+	KeyKey    = "tls.key"
+	CACertKey = "ca.crt"
+	CAKeyKey  = "ca.key"
+)
+
+// DefaultPath is the path the webhook is served at
+const DefaultPath = "/mutate"
+
+// CoversNames reports whether the pem encoded cert is signed by caCert and valid for every one of names (dns names or
+// ips)
+func CoversNames(caCert, cert []byte, names []string) bool {
+	ca, err := parseCert(caCert)
+	if err != nil {
+		return false
+	}
+
+	crt, err := parseCert(cert)
+	if err != nil {
+		return false
+	}
+
+	if crt.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+
+	for _, n := range names {
+		if crt.VerifyHostname(n) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// IssueCert signs a serving certificate and key for names (dns names or ips, the first of which is its common name)
+// with the pem encoded ca, valid for as long as the ca is
+func IssueCert(caCert, caKey []byte, names []string) (cert, key []byte, err error) {
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("no names to issue a certificate for")
+	}
+
+	ca, err := parseCert(caCert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ca certificate: %v", err)
+	}
+
+	b, _ := pem.Decode(caKey)
+	if b == nil {
+		return nil, nil, fmt.Errorf("parsing ca key: no pem block")
+	}
+	signer, err := x509.ParsePKCS1PrivateKey(b.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ca key: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	templ := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              ca.NotAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, n := range names {
+		if ip := net.ParseIP(n); ip != nil {
+			templ.IPAddresses = append(templ.IPAddresses, ip)
+		} else {
+			templ.DNSNames = append(templ.DNSNames, n)
+		}
+	}
+
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating key: %v", err)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, templ, ca, k.Public(), signer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating certificate: %v", err)
+	}
+
+	var certBuf, keyBuf bytes.Buffer
+	if err := pem.Encode(&certBuf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		return nil, nil, err
+	}
+	if err := pem.Encode(&keyBuf, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}); err != nil {
+		return nil, nil, err
+	}
+	return certBuf.Bytes(), keyBuf.Bytes(), nil
+}
+
+func parseCert(data []byte) (*x509.Certificate, error) {
+	b, _ := pem.Decode(data)
+	if b == nil {
+		return nil, fmt.Errorf("no pem block")
+	}
+	return x509.ParseCertificate(b.Bytes)
+}
+
+// ParseExternalURL parses the url the api server reaches a webhook served outside the cluster at, which must be https
+func ParseExternalURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook url %s: %v", raw, err)
+	}
+
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url %s: must be an https url", raw)
+	}
+	return u, nil
+}
+
+// SetExternalURL registers every webhook of the mutating webhook configuration name at u, followed by the path its
+// service was registered with (or DefaultPath), rather than at the manager's service. Any ca bundle already injected
+// is kept.
+func SetExternalURL(ctx context.Context, c client.Client, name string, u *url.URL) error {
+	mwc := &admissionregistrationv1.MutatingWebhookConfiguration{}
+	if err := c.Get(ctx, types.NamespacedName{Name: name}, mwc); err != nil {
+		return err
+	}
+
+	for i := range mwc.Webhooks {
+		setExternalURL(&mwc.Webhooks[i].ClientConfig, u, DefaultPath)
+	}
+
+	return c.Update(ctx, mwc)
+}
+
+// SetExternalValidatingURL is SetExternalURL for the validating webhook configuration name, whose webhooks default to
+// ValidatePath
+func SetExternalValidatingURL(ctx context.Context, c client.Client, name string, u *url.URL) error {
+	vwc := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+	if err := c.Get(ctx, types.NamespacedName{Name: name}, vwc); err != nil {
+		return err
+	}
+
+	for i := range vwc.Webhooks {
+		setExternalURL(&vwc.Webhooks[i].ClientConfig, u, ValidatePath)
+	}
+
+	return c.Update(ctx, vwc)
+}
+
+// setExternalURL points cc at u, followed by the path of the service it was registered with (or path)
+func setExternalURL(cc *admissionregistrationv1.WebhookClientConfig, u *url.URL, path string) {
+	p := path
+	if cc.Service != nil && cc.Service.Path != nil {
+		p = *cc.Service.Path
+	}
+
+	ext := strings.TrimSuffix(u.String(), "/") + p
+	cc.URL = &ext
+	cc.Service = nil
+}
@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/cert-controller/pkg/rotator"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// testCA returns a pem encoded ca certificate and key, as the cert rotator generates them
+func testCA(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templ := &x509.Certificate{
+		SerialNumber:          big.NewInt(0),
+		Subject:               pkix.Name{CommonName: "ripfs-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, templ, templ, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cert, k bytes.Buffer
+	pem.Encode(&cert, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&k, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return cert.Bytes(), k.Bytes()
+}
+
+func TestIssueCert(t *testing.T) {
+	caCert, caKey := testCA(t)
+	names := []string{"ripfs-controller-manager.ripfs-system.svc", "webhook.example.com", "10.0.0.5"}
+
+	cert, key, err := IssueCert(caCert, caKey, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !CoversNames(caCert, cert, names) {
+		t.Errorf("issued certificate doesn't cover %v", names)
+	}
+
+	if CoversNames(caCert, cert, append(names, "other.example.com")) {
+		t.Errorf("issued certificate covers a name it wasn't issued for")
+	}
+
+	otherCA, _ := testCA(t)
+	if CoversNames(otherCA, cert, names) {
+		t.Errorf("issued certificate covers names for a ca it wasn't signed by")
+	}
+
+	// The rotator must keep the reissued certificate rather than replacing it
+	valid, err := rotator.ValidCert(caCert, cert, key, names[0], time.Now().Add(90*24*time.Hour))
+	if !valid {
+		t.Errorf("rotator rejects the issued certificate: %v", err)
+	}
+}
+
+func TestSetExternalURL(t *testing.T) {
+	ctx := context.Background()
+
+	path := "/mutate"
+	mwc := &admissionregistrationv1.MutatingWebhookConfiguration{
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name: "mutator.ripfs.io",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service:  &admissionregistrationv1.ServiceReference{Namespace: "ripfs-system", Name: "ripfs-controller-manager", Path: &path},
+				CABundle: []byte("ca"),
+			},
+		}},
+	}
+	mwc.Name = "ripfs-webhook"
+
+	vwc := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{{
+			Name: "provenance.ripfs.io",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{Namespace: "ripfs-system", Name: "ripfs-controller-manager"},
+			},
+		}},
+	}
+	vwc.Name = "ripfs-provenance"
+
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(mwc, vwc).Build()
+
+	u, err := ParseExternalURL("https://10.0.0.5:9443/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Setting it again must leave it as it is
+	for i := 0; i < 2; i++ {
+		if err := SetExternalURL(ctx, c, "ripfs-webhook", u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := &admissionregistrationv1.MutatingWebhookConfiguration{}
+	if err := c.Get(ctx, types.NamespacedName{Name: "ripfs-webhook"}, got); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := got.Webhooks[0].ClientConfig
+	if cc.Service != nil || cc.URL == nil || *cc.URL != "https://10.0.0.5:9443/mutate" {
+		t.Errorf("expected the webhook registered at https://10.0.0.5:9443/mutate, got %+v", cc)
+	}
+	if string(cc.CABundle) != "ca" {
+		t.Errorf("expected the ca bundle to be kept, got %q", cc.CABundle)
+	}
+
+	// Validating webhooks without a path default to the validator's
+	if err := SetExternalValidatingURL(ctx, c, "ripfs-provenance", u); err != nil {
+		t.Fatal(err)
+	}
+
+	gotv := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+	if err := c.Get(ctx, types.NamespacedName{Name: "ripfs-provenance"}, gotv); err != nil {
+		t.Fatal(err)
+	}
+
+	if cc := gotv.Webhooks[0].ClientConfig; cc.Service != nil || cc.URL == nil || *cc.URL != "https://10.0.0.5:9443"+ValidatePath {
+		t.Errorf("expected the validator registered at https://10.0.0.5:9443%s, got %+v", ValidatePath, cc)
+	}
+
+	if _, err := ParseExternalURL("http://10.0.0.5:9443"); err == nil {
+		t.Errorf("expected an http url to be rejected")
+	}
+}
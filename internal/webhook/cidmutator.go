@@ -3,28 +3,68 @@ package webhook
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"path"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/metrics"
 	"github.com/joshrwolf/ripfs/internal/registry"
 )
 
+// mutatorName is what the mutator's metrics and audit entries are labelled with
+const mutatorName = "mutator"
+
 var _ admission.Handler = (*podRelocatorHandler)(nil)
 
+// PodRelocatorOpts configures how pod images are rewritten
+type PodRelocatorOpts struct {
+	// Settings are how images are rewritten (and which aren't), reloaded as they change
+	Settings *SettingsStore
+
+	// Ipfs reads the digests templates may rewrite images by
+	Ipfs iface.CoreAPI
+
+	// Recorder records the events warning of unresolved images, none are recorded without one
+	Recorder record.EventRecorder
+}
+
 type podRelocatorHandler struct {
 	decoder   *admission.Decoder
 	cidMapper registry.CidMapper
-	registry  string
+	settings  *SettingsStore
+	ipfs      iface.CoreAPI
+	recorder  record.EventRecorder
 }
 
 func (h *podRelocatorHandler) Handle(ctx context.Context, req admission.Request) admission.Response {
+	start := time.Now()
+	resp, rewritten, mapped := h.handle(ctx, req)
+	if len(mapped) > 0 {
+		metrics.ObserveMutation(mapped)
+	}
+
+	metrics.ObserveAdmission(mutatorName, resp.Allowed, time.Since(start))
+	audit(ctx, mutatorName, req, resp, rewritten)
+	return resp
+}
+
+// handle admits the pod of req, returning what its images were rewritten to (by the image they were rewritten from),
+// and the mapping each rewritten container was rewritten by
+func (h *podRelocatorHandler) handle(ctx context.Context, req admission.Request) (admission.Response, map[string]string, []string) {
 	l := log.FromContext(ctx).WithName("mutator")
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
@@ -33,59 +73,286 @@ func (h *podRelocatorHandler) Handle(ctx context.Context, req admission.Request)
 
 	l.V(2).Info("decoding pod information")
 	if err := h.decoder.Decode(req, pod); err != nil {
-		return admission.Errored(http.StatusBadRequest, err)
+		return admission.Errored(http.StatusBadRequest, err), nil, nil
 	}
 
 	l.Info("handling mutator", "pod", pod.GetName())
 
-	changed := make(map[string]string)
+	settings := h.settings.load()
+	if settings.excludesNamespace(req.Namespace) {
+		l.Info("namespace is excluded, returning empty patch", "namespace", req.Namespace)
+		return admission.Allowed("namespace excluded"), nil, nil
+	}
+
+	if Skipped(pod.Annotations) {
+		l.Info("pod opted out, returning empty patch", "pod", pod.GetName())
+		return admission.Allowed("pod opted out"), nil, nil
+	}
+	skipped := SkippedContainers(pod.Annotations)
+
+	var podObj map[string]interface{}
+	if len(settings.policies) > 0 {
+		obj, err := podObject(pod)
+		if err != nil {
+			return admission.Errored(http.StatusBadRequest, err), nil, nil
+		}
+		podObj = obj
+	}
+
+	// Images rolled back after failing to pull from ripfs are left as they are, even when the pod is updated
+	rolledBack := RolledBack(pod.Annotations)
+
+	// Images of the containers being added that couldn't be resolved, which are acted on as the settings say once
+	// every container's been processed. Containers are only added as the pod is created, or ephemeral ones through
+	// its ephemeralcontainers subresource, and those already running are left to run.
+	unresolved := make(map[string]bool)
+	creating := req.Operation == admissionv1.Create
+
+	// What was rewritten is only ever recorded by the mutator, so whatever the client recorded as the pod is created
+	// is dropped rather than merged with it, before it's trusted by the provenance validator or rolled back to
+	scrubbed := creating && req.SubResource == "" && scrubRecordedImages(pod)
+
+	// Images pinned to a digest their tag is no longer mapped to, which pods are denied for when they're created
+	// with RejectMismatched
+	var mismatched []string
+
+	// rewrite returns the image the container name is rewritten to, unless its image is left as it is
+	rewrite := func(name string, image string, init bool, ephemeral bool) (string, bool) {
+		if skipped[name] {
+			l.Info("container opted out", "name", name, "image", image)
+			return "", false
+		}
+
+		if settings.excludesImage(image) {
+			l.Info("image is excluded", "name", name, "image", image)
+			return "", false
+		}
+
+		p, err := settings.deniedBy(PolicyInput{Pod: podObj, Namespace: req.Namespace, Container: name, Init: init, Ephemeral: ephemeral, Image: image})
+		if err != nil {
+			l.Error(err, "evaluating policy, leaving image as is", "name", name, "image", image)
+			return "", false
+		}
+		if p != nil {
+			l.Info("image is denied by policy", "name", name, "image", image, "policy", p.Name)
+			return "", false
+		}
+
+		if rolledBack[image] {
+			l.Info("image was rolled back", "name", name, "image", image)
+			return "", false
+		}
+
+		if settings.onRegistry(image) {
+			l.Info("image is already pulled from ripfs", "name", name, "image", image)
+			return "", false
+		}
+
+		// Ephemeral containers are only ever processed as they're added, the rest only as the pod is created
+		adding := creating || ephemeral
+
+		// Images pinned to a digest as well as a tag are mapped by their tag
+		mapped, pinned := image, ""
+		if settings.PinDigests {
+			mapped, pinned = splitPinned(image)
+		}
+
+		cid, err := h.cidMapper.Resolve(ctx, mapped)
+		if errors.Is(err, registry.ErrNotFound) {
+			l.Info("no matching cid found", "name", name, "image", image)
+			metrics.ObserveResolution(metrics.ResolutionMiss)
+			if adding {
+				unresolved[image] = true
+			}
+			return "", false
+		} else if err != nil {
+			l.Error(err, "resolving image", "name", name, "image", image)
+			metrics.ObserveResolution(metrics.ResolutionError)
+			if adding {
+				unresolved[image] = true
+			}
+			return "", false
+		}
+		metrics.ObserveResolution(metrics.ResolutionHit)
+
+		l.Info("resolved image reference to cid", "cid", cid, "image", image)
+
+		resolved, err := settings.render(ctx, h.ipfs, mapped, cid, pinned)
+		if errors.Is(err, ErrDigestMismatch) {
+			l.Info("image is pinned to another digest than it's mapped to", "name", name, "image", image, "reason", err.Error())
+			mismatched = append(mismatched, image)
+			return "", false
+		} else if err != nil {
+			l.Error(err, "rewriting image", "name", name, "image", image)
+			return "", false
+		}
+		return resolved, true
+	}
+
+	var (
+		changed   = make(map[string]string)
+		originals = make(map[string]string)
+	)
 	for i, c := range pod.Spec.InitContainers {
 		l.Info("processing init container", "container", c.Name, "image", c.Image)
-		cid, err := h.cidMapper.Resolve(ctx, c.Image)
-		if err != nil {
-			l.Info("no matching cid found", "name", c.Name, "image", c.Image)
+		resolved, ok := rewrite(c.Name, c.Image, true, false)
+		if !ok {
 			continue
 		}
 
-		l.Info("resolved image reference to cid", "cid", cid, "image", c.Image)
-
-		resolved := h.prefixIpfsRegistry(cid)
 		pod.Spec.InitContainers[i].Image = resolved
+		if settings.NormalizePullPolicy {
+			pod.Spec.InitContainers[i].ImagePullPolicy = normalizePullPolicy(resolved, c.ImagePullPolicy)
+		}
 		changed[c.Image] = resolved
+		originals[c.Name] = c.Image
 	}
 
 	for i, c := range pod.Spec.Containers {
 		l.Info("processing container", "container", c.Name, "image", c.Image)
-		cid, err := h.cidMapper.Resolve(ctx, c.Image)
-		if err != nil {
-			l.Info("no matching cid found", "name", c.Name, "image", c.Image)
+		resolved, ok := rewrite(c.Name, c.Image, false, false)
+		if !ok {
 			continue
 		}
 
-		l.Info("resolved image reference to cid", "cid", cid, "image", c.Image)
-
-		resolved := h.prefixIpfsRegistry(cid)
 		pod.Spec.Containers[i].Image = resolved
+		if settings.NormalizePullPolicy {
+			pod.Spec.Containers[i].ImagePullPolicy = normalizePullPolicy(resolved, c.ImagePullPolicy)
+		}
 		changed[c.Image] = resolved
+		originals[c.Name] = c.Image
+	}
+
+	// Ephemeral containers can't be changed once they're added, so only those being added (through the pod's
+	// ephemeralcontainers subresource, such as by kubectl debug) are rewritten
+	added, err := h.addedEphemeralContainers(req, pod)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err), nil, nil
+	}
+	for i, c := range pod.Spec.EphemeralContainers {
+		if !added[c.Name] {
+			continue
+		}
+
+		l.Info("processing ephemeral container", "container", c.Name, "image", c.Image)
+		resolved, ok := rewrite(c.Name, c.Image, false, true)
+		if !ok {
+			continue
+		}
+
+		pod.Spec.EphemeralContainers[i].Image = resolved
+		if settings.NormalizePullPolicy {
+			pod.Spec.EphemeralContainers[i].ImagePullPolicy = normalizePullPolicy(resolved, c.ImagePullPolicy)
+		}
+		changed[c.Image] = resolved
+		originals[c.Name] = c.Image
+	}
+
+	if len(mismatched) > 0 && settings.RejectMismatched && creating {
+		return admission.Denied(fmt.Sprintf("images %s are pinned to digests their tags are no longer mapped to", strings.Join(mismatched, ", "))), nil, nil
+	}
+
+	var warnings []string
+	if images := sortedImages(unresolved); len(images) > 0 {
+		switch settings.Unresolved {
+		case UnresolvedDeny:
+			return admission.Denied(fmt.Sprintf("images %s aren't available from ripfs", strings.Join(images, ", "))), nil, nil
+		case UnresolvedWarn:
+			warnings = append(warnings, fmt.Sprintf("images %s aren't available from ripfs", strings.Join(images, ", ")))
+
+			// Like what was rewritten, the annotation only sticks when the pod itself is admitted
+			if creating {
+				if pod.Annotations == nil {
+					pod.Annotations = make(map[string]string)
+				}
+				pod.Annotations[consts.UnresolvedImagesAnnotation] = strings.Join(images, ",")
+			}
+
+			// Pods named by the api server once they're admitted have no name to record events of yet
+			if h.recorder != nil && pod.Name != "" {
+				h.recorder.Eventf(pod, corev1.EventTypeWarning, consts.UnresolvedReason, "Images %s aren't available from ripfs", strings.Join(images, ", "))
+			}
+		}
+	}
+
+	// Pull secrets can't be changed once the pod exists
+	if len(originals) > 0 && req.Operation == admissionv1.Create {
+		updatePullSecrets(pod, originals, settings.StripPullSecrets, settings.PullSecret)
+	}
+
+	// What was rewritten is recorded in the pod's annotations, which the ephemeralcontainers subresource drops along
+	// with every other change but to the ephemeral containers themselves, so only admitting the pod itself records it
+	if len(originals) > 0 && req.SubResource != "ephemeralcontainers" {
+		if err := recordOriginalImages(pod, originals); err != nil {
+			return admission.Errored(http.StatusInternalServerError, err), nil, nil
+		}
+		if err := recordRewrittenImages(pod, changed); err != nil {
+			return admission.Errored(http.StatusInternalServerError, err), nil, nil
+		}
 	}
 
 	marshaledPod, err := json.Marshal(pod)
 	if err != nil {
-		return admission.Errored(http.StatusInternalServerError, err)
+		return admission.Errored(http.StatusInternalServerError, err), nil, nil
 	}
 
-	if len(changed) > 0 {
+	if len(changed) > 0 || len(warnings) > 0 || scrubbed {
 		l.Info("successfully mutated pod images", "n", len(changed))
-		return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
+		return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod).WithWarnings(warnings...), changed, mappedImages(originals, settings.PinDigests)
 	} else {
 		l.Info("no pod images matched, returning empty patch")
-		return admission.Allowed("no image resolutions found")
+		return admission.Allowed("no image resolutions found"), nil, nil
+	}
+}
+
+// sortedImages returns the images of set in order
+func sortedImages(set map[string]bool) []string {
+	images := make([]string, 0, len(set))
+	for image := range set {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images
+}
+
+// mappedImages returns the mapping each container in originals (the images they were rewritten from) was rewritten by,
+// normalized as mappings are, so they're bounded by the mappings however pods spell their images
+func mappedImages(originals map[string]string, pinDigests bool) []string {
+	images := make([]string, 0, len(originals))
+	for _, image := range originals {
+		if pinDigests {
+			image, _ = splitPinned(image)
+		}
+		if ref, err := name.ParseReference(image); err == nil {
+			image = ref.Name()
+		}
+		images = append(images, image)
 	}
+	return images
 }
 
-// prefixIpfsRegistry prefixes the registry (TODO: replace with a registry)
-func (h *podRelocatorHandler) prefixIpfsRegistry(cid string) string {
-	return path.Join(h.registry, cid)
+// addedEphemeralContainers returns the ephemeral containers of pod being added by req, by name. Only requests to the
+// ephemeralcontainers subresource add any.
+func (h *podRelocatorHandler) addedEphemeralContainers(req admission.Request, pod *corev1.Pod) (map[string]bool, error) {
+	added := make(map[string]bool)
+	if req.SubResource != "ephemeralcontainers" {
+		return added, nil
+	}
+
+	for _, c := range pod.Spec.EphemeralContainers {
+		added[c.Name] = true
+	}
+
+	if len(req.OldObject.Raw) > 0 {
+		old := &corev1.Pod{}
+		if err := h.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return nil, err
+		}
+		for _, c := range old.Spec.EphemeralContainers {
+			delete(added, c.Name)
+		}
+	}
+	return added, nil
 }
 
 func (h *podRelocatorHandler) InjectDecoder(d *admission.Decoder) error {
@@ -93,15 +360,21 @@ func (h *podRelocatorHandler) InjectDecoder(d *admission.Decoder) error {
 	return nil
 }
 
-func AddPodRelocatorToManager(mgr manager.Manager, cm registry.CidMapper, registry string) error {
+func AddPodRelocatorToManager(mgr manager.Manager, cm registry.CidMapper, opts PodRelocatorOpts) error {
+	if opts.Settings == nil {
+		return fmt.Errorf("the webhook requires settings")
+	}
+
 	wh := &admission.Webhook{
 		Handler: &podRelocatorHandler{
 			cidMapper: cm,
-			registry:  registry,
+			settings:  opts.Settings,
+			ipfs:      opts.Ipfs,
+			recorder:  opts.Recorder,
 		},
 	}
 
-	mgr.GetWebhookServer().Register("/mutate", &webhook.Admission{
+	mgr.GetWebhookServer().Register(DefaultPath, &webhook.Admission{
 		Handler: wh,
 	})
 
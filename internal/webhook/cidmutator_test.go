@@ -0,0 +1,335 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/metrics"
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+const testingRoot = "bafkreia4g3rtkhc72daogxsw4ytd7av2fye7w2xoto4jzcfnkg7cf7mc6e"
+
+func testingDecoder(t *testing.T) *admission.Decoder {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// testingMutator rewrites images to localhost:31609 by mappings, with settings on top of the defaults
+func testingMutator(t *testing.T, mappings map[string]string, settings map[string]string) *podRelocatorHandler {
+	mapper := registry.NewMemoryCidMapper()
+	mapper.Set(nil, mappings)
+
+	store, err := NewSettingsStore(Settings{Registry: "localhost:31609"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(settings); err != nil {
+		t.Fatal(err)
+	}
+
+	return &podRelocatorHandler{decoder: testingDecoder(t), cidMapper: mapper, settings: store}
+}
+
+// podRequest is a request admitting pod, updating old unless it's nil, through subresource unless it's empty
+func podRequest(t *testing.T, pod *corev1.Pod, old *corev1.Pod, subresource string) admission.Request {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation:   admissionv1.Create,
+		Namespace:   pod.Namespace,
+		Name:        pod.Name,
+		SubResource: subresource,
+		Object:      runtime.RawExtension{Raw: raw},
+	}}
+	if old != nil {
+		if req.OldObject.Raw, err = json.Marshal(old); err != nil {
+			t.Fatal(err)
+		}
+		req.Operation = admissionv1.Update
+	}
+	return req
+}
+
+// patched returns the values resp patches, by path
+func patched(resp admission.Response) map[string]interface{} {
+	values := make(map[string]interface{})
+	for _, p := range resp.Patches {
+		values[p.Path] = p.Value
+	}
+	return values
+}
+
+func ephemeral(name string, image string) corev1.EphemeralContainer {
+	return corev1.EphemeralContainer{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: name, Image: image}}
+}
+
+func TestHandleEphemeralContainers(t *testing.T) {
+	ctx := context.Background()
+
+	h := testingMutator(t, map[string]string{
+		"index.docker.io/library/alpine:latest":  "/ipfs/" + testingRoot,
+		"index.docker.io/library/busybox:latest": "/ipfs/" + testingRoot,
+	}, nil)
+
+	old := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers:          []corev1.Container{{Name: "app", Image: "localhost:31609/ipfs/" + testingRoot}},
+			EphemeralContainers: []corev1.EphemeralContainer{ephemeral("debugger", "busybox")},
+		},
+	}
+	pod := old.DeepCopy()
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, ephemeral("debug", "alpine"))
+
+	resp := h.Handle(ctx, podRequest(t, pod, old, "ephemeralcontainers"))
+	if !resp.Allowed {
+		t.Fatalf("expected the ephemeral container to be allowed, got %v", resp.Result)
+	}
+
+	// Only the container being added is rewritten, those added before can't be changed
+	want := map[string]interface{}{"/spec/ephemeralContainers/1/image": "localhost:31609/ipfs/" + testingRoot}
+	if got := patched(resp); len(got) != len(want) || got["/spec/ephemeralContainers/1/image"] != want["/spec/ephemeralContainers/1/image"] {
+		t.Errorf("expected patches %v, got %v", want, got)
+	}
+
+	// Nothing is rewritten when the ephemeral containers aren't being added
+	resp = h.Handle(ctx, podRequest(t, pod, old, ""))
+	if got := patched(resp); len(got) != 0 {
+		t.Errorf("expected updating the pod not to rewrite its ephemeral containers, got %v", got)
+	}
+
+	// Admitting the pod itself records what was rewritten
+	created := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "alpine"}}},
+	}
+	resp = h.Handle(ctx, podRequest(t, created, nil, ""))
+	if got := patched(resp); got["/metadata/annotations"] == nil {
+		t.Errorf("expected the original images to be recorded, got %v", got)
+	} else if annotations := got["/metadata/annotations"].(map[string]interface{}); annotations[consts.OriginalImagesAnnotation] == nil {
+		t.Errorf("expected the original images to be recorded, got %v", annotations)
+	}
+}
+
+func TestHandleUnresolved(t *testing.T) {
+	ctx := context.Background()
+
+	running := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Image: "ghcr.io/org/app:v1"},
+			// Already pulled from ripfs, so never unresolved
+			{Name: "sidecar", Image: "localhost:31609/ipfs/" + testingRoot},
+		}},
+	}
+	debugging := func(image string) *corev1.Pod {
+		pod := running.DeepCopy()
+		pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{ephemeral("debug", image)}
+		return pod
+	}
+
+	type want struct {
+		allowed  bool
+		warnings int
+		recorded string
+	}
+	tests := []struct {
+		name string
+		req  admission.Request
+
+		// by unresolved mode
+		want map[string]want
+	}{
+		{
+			name: "create",
+			req:  podRequest(t, running, nil, ""),
+			want: map[string]want{
+				UnresolvedAllow: {allowed: true},
+				UnresolvedWarn:  {allowed: true, warnings: 1, recorded: "ghcr.io/org/app:v1"},
+				UnresolvedDeny:  {allowed: false},
+			},
+		},
+		{
+			// Containers of a pod that's already running aren't added
+			name: "update",
+			req:  podRequest(t, running, running, ""),
+			want: map[string]want{
+				UnresolvedAllow: {allowed: true},
+				UnresolvedWarn:  {allowed: true},
+				UnresolvedDeny:  {allowed: true},
+			},
+		},
+		{
+			name: "unresolved ephemeral container",
+			req:  podRequest(t, debugging("ghcr.io/org/debug:v1"), running, "ephemeralcontainers"),
+			want: map[string]want{
+				UnresolvedAllow: {allowed: true},
+				UnresolvedWarn:  {allowed: true, warnings: 1},
+				UnresolvedDeny:  {allowed: false},
+			},
+		},
+		{
+			// Only the container being added counts, not the pod's own unresolved images
+			name: "resolved ephemeral container",
+			req:  podRequest(t, debugging("alpine"), running, "ephemeralcontainers"),
+			want: map[string]want{
+				UnresolvedAllow: {allowed: true},
+				UnresolvedWarn:  {allowed: true},
+				UnresolvedDeny:  {allowed: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		for mode, want := range tt.want {
+			t.Run(tt.name+"/"+mode, func(t *testing.T) {
+				h := testingMutator(t, map[string]string{"index.docker.io/library/alpine:latest": "/ipfs/" + testingRoot}, map[string]string{SettingsUnresolved: mode})
+
+				resp := h.Handle(ctx, tt.req)
+				if resp.Allowed != want.allowed {
+					t.Fatalf("expected allowed to be %t, got %v", want.allowed, resp.Result)
+				}
+				if !want.allowed {
+					if reason := string(resp.Result.Reason); !strings.Contains(reason, "aren't available from ripfs") || strings.Contains(reason, "localhost:31609") {
+						t.Errorf("expected only the unresolved images to be denied, got %s", reason)
+					}
+				}
+				if len(resp.Warnings) != want.warnings {
+					t.Errorf("expected %d warnings, got %v", want.warnings, resp.Warnings)
+				}
+
+				var recorded interface{}
+				if annotations, ok := patched(resp)["/metadata/annotations"].(map[string]interface{}); ok {
+					recorded = annotations[consts.UnresolvedImagesAnnotation]
+				}
+				if (want.recorded == "" && recorded != nil) || (want.recorded != "" && recorded != want.recorded) {
+					t.Errorf("expected %q to be recorded as unresolved, got %v", want.recorded, recorded)
+				}
+			})
+		}
+	}
+}
+
+// rewrites returns how many containers the mutator has rewritten from image, by its metrics
+func rewrites(t *testing.T, image string) float64 {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != metrics.WebhookRewrites.Name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			if l := m.GetLabel(); len(l) == 1 && l[0].GetValue() == image {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestHandleMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	const mapped = "index.docker.io/library/alpine:latest"
+	h := testingMutator(t, map[string]string{mapped: "/ipfs/" + testingRoot}, nil)
+	before := rewrites(t, mapped)
+
+	// Containers sharing an image each count, labelled by the mapping however they spell it
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "alpine"}},
+			Containers:     []corev1.Container{{Name: "app", Image: "alpine:latest"}, {Name: "sidecar", Image: "docker.io/library/alpine"}},
+		},
+	}
+	if resp := h.Handle(ctx, podRequest(t, pod, nil, "")); !resp.Allowed {
+		t.Fatalf("expected the pod to be allowed, got %v", resp.Result)
+	}
+
+	if got := rewrites(t, mapped) - before; got != 3 {
+		t.Errorf("expected 3 containers rewritten from %s, got %v", mapped, got)
+	}
+	for _, image := range []string{"alpine", "alpine:latest", "docker.io/library/alpine"} {
+		if got := rewrites(t, image); got != 0 {
+			t.Errorf("expected no rewrites labelled %s, got %v", image, got)
+		}
+	}
+}
+
+func TestHandleRecordedImages(t *testing.T) {
+	ctx := context.Background()
+
+	h := testingMutator(t, map[string]string{"index.docker.io/library/alpine:latest": "/ipfs/" + testingRoot}, nil)
+
+	// Clients can't record what was rewritten themselves, as it's trusted to validate and roll back pods
+	spoofed := map[string]string{
+		consts.OriginalImagesAnnotation:  `{"app": "registry.k8s.io/pause:3.6", "sidecar": "alpine"}`,
+		consts.RewrittenImagesAnnotation: `{"registry.k8s.io/pause:3.6": "ghcr.io/evil/app:v1"}`,
+	}
+	pod := func(images ...string) *corev1.Pod {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: map[string]string{"team": "a"}}}
+		for k, v := range spoofed {
+			pod.Annotations[k] = v
+		}
+		for i, image := range images {
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: []string{"app", "sidecar"}[i], Image: image})
+		}
+		return pod
+	}
+
+	// Pods with nothing rewritten are still patched to drop them
+	resp := h.Handle(ctx, podRequest(t, pod("ghcr.io/evil/app:v1"), nil, ""))
+	removed := make(map[string]bool)
+	for _, p := range resp.Patches {
+		if p.Operation == "remove" {
+			removed[p.Path] = true
+		}
+	}
+	if !resp.Allowed || len(removed) != 2 || !removed["/metadata/annotations/ripfs.dev~1original-images"] || !removed["/metadata/annotations/ripfs.dev~1rewritten-images"] {
+		t.Errorf("expected the recorded images to be dropped, got %v", resp.Patches)
+	}
+
+	// Pods with rewritten images only record those
+	resp = h.Handle(ctx, podRequest(t, pod("ghcr.io/evil/app:v1", "alpine"), nil, ""))
+	got := make(map[string]string)
+	for _, p := range resp.Patches {
+		switch {
+		case p.Path == "/metadata/annotations/ripfs.dev~1original-images":
+			got[consts.OriginalImagesAnnotation], _ = p.Value.(string)
+		case p.Path == "/metadata/annotations/ripfs.dev~1rewritten-images":
+			got[consts.RewrittenImagesAnnotation], _ = p.Value.(string)
+		}
+	}
+	want := map[string]string{
+		consts.OriginalImagesAnnotation:  `{"sidecar":"alpine"}`,
+		consts.RewrittenImagesAnnotation: `{"alpine":"localhost:31609/ipfs/` + testingRoot + `"}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected only the rewritten images to be recorded %v, got %v", want, resp.Patches)
+	}
+}
@@ -0,0 +1,140 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/go-containerregistry/pkg/name"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// SettingsPolicyPrefix prefixes the keys of the settings config map holding rewrite policies, each named by the rest
+// of its key (policy.prod-only)
+const SettingsPolicyPrefix = "policy."
+
+// policyEnv declares what policies are evaluated over:
+//
+//	pod        the pod being admitted, as it was submitted (pod.metadata.labels, pod.spec.nodeSelector, ...)
+//	request    the admission request, its namespace (request.namespace) the pod is admitted into
+//	container  the container whose image is rewritten (name, init for init containers and ephemeral for ephemeral ones)
+//	image      the image as written (reference), and its registry, repository, tag and digest
+//
+// Images are parsed as the runtime would pull them, so alpine is index.docker.io's library/alpine, tagged latest.
+var policyEnv = func() *cel.Env {
+	env, err := cel.NewEnv(cel.Declarations(
+		decls.NewVar("pod", decls.NewMapType(decls.String, decls.Dyn)),
+		decls.NewVar("request", decls.NewMapType(decls.String, decls.String)),
+		decls.NewVar("container", decls.NewMapType(decls.String, decls.Dyn)),
+		decls.NewVar("image", decls.NewMapType(decls.String, decls.String)),
+	))
+	if err != nil {
+		panic(err)
+	}
+	return env
+}()
+
+// Policy is a CEL expression deciding whether a container's image is rewritten
+type Policy struct {
+	Name       string
+	Expression string
+
+	program cel.Program
+}
+
+// CompilePolicy compiles expression, which must evaluate to a bool
+func CompilePolicy(name, expression string) (*Policy, error) {
+	ast, iss := policyEnv.Compile(expression)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", name, iss.Err())
+	}
+
+	if t := ast.ResultType(); t.GetPrimitive() != exprpb.Type_BOOL && t.GetDyn() == nil {
+		return nil, fmt.Errorf("invalid policy %s: must evaluate to a bool", name)
+	}
+
+	prg, err := policyEnv.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", name, err)
+	}
+	return &Policy{Name: name, Expression: expression, program: prg}, nil
+}
+
+// CompilePolicies compiles every policy of policies (name => expression), ordered by name
+func CompilePolicies(policies map[string]string) ([]*Policy, error) {
+	names := make([]string, 0, len(policies))
+	for n := range policies {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var compiled []*Policy
+	for _, n := range names {
+		p, err := CompilePolicy(n, policies[n])
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, p)
+	}
+	return compiled, nil
+}
+
+// PolicyInput is what a policy is evaluated against, once per container
+type PolicyInput struct {
+	// Pod is the pod as an unstructured object
+	Pod       map[string]interface{}
+	Namespace string
+	Container string
+	Init      bool
+	Ephemeral bool
+	Image     string
+}
+
+// podObject returns pod as the map policies see it as
+func podObject(pod *corev1.Pod) (map[string]interface{}, error) {
+	return runtime.DefaultUnstructuredConverter.ToUnstructured(pod)
+}
+
+func (in PolicyInput) activation() map[string]interface{} {
+	image := map[string]string{"reference": in.Image, "registry": "", "repository": "", "tag": "", "digest": ""}
+	if ref, err := name.ParseReference(in.Image); err == nil {
+		image["registry"] = ref.Context().RegistryStr()
+		image["repository"] = ref.Context().RepositoryStr()
+
+		switch r := ref.(type) {
+		case name.Tag:
+			image["tag"] = r.TagStr()
+		case name.Digest:
+			image["digest"] = r.DigestStr()
+		}
+	}
+
+	pod := in.Pod
+	if pod == nil {
+		pod = map[string]interface{}{}
+	}
+
+	return map[string]interface{}{
+		"pod":       pod,
+		"request":   map[string]string{"namespace": in.Namespace},
+		"container": map[string]interface{}{"name": in.Container, "init": in.Init, "ephemeral": in.Ephemeral},
+		"image":     image,
+	}
+}
+
+// Allows evaluates the policy against in
+func (p *Policy) Allows(in PolicyInput) (bool, error) {
+	out, _, err := p.program.Eval(in.activation())
+	if err != nil {
+		return false, fmt.Errorf("evaluating policy %s: %v", p.Name, err)
+	}
+
+	allowed, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("evaluating policy %s: evaluated to a %T rather than a bool", p.Name, out.Value())
+	}
+	return allowed, nil
+}
@@ -0,0 +1,130 @@
+package webhook
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestPolicy(t *testing.T) {
+	pod := &corev1.Pod{}
+	pod.Labels = map[string]string{"ripfs.io/rewrite": "true", "app": "web"}
+
+	obj, err := podObject(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := PolicyInput{Pod: obj, Namespace: "prod", Container: "app", Image: "ghcr.io/org/app:v1"}
+
+	tests := []struct {
+		name       string
+		expression string
+		in         PolicyInput
+		want       bool
+		wantErr    bool
+	}{
+		{
+			name:       "namespace",
+			expression: `request.namespace == "prod"`,
+			in:         in,
+			want:       true,
+		},
+		{
+			name:       "label",
+			expression: `has(pod.metadata.labels) && pod.metadata.labels["ripfs.io/rewrite"] == "true"`,
+			in:         in,
+			want:       true,
+		},
+		{
+			name:       "registry",
+			expression: `image.registry != "ghcr.io"`,
+			in:         in,
+			want:       false,
+		},
+		{
+			name:       "docker hub",
+			expression: `image.registry == "index.docker.io" && image.repository == "library/nginx" && image.tag == "latest"`,
+			in:         PolicyInput{Pod: obj, Image: "nginx"},
+			want:       true,
+		},
+		{
+			name:       "digest",
+			expression: `image.digest != ""`,
+			in:         PolicyInput{Pod: obj, Image: "nginx@sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+			want:       true,
+		},
+		{
+			name:       "init containers",
+			expression: `!container.init || container.name.startsWith("setup-")`,
+			in:         PolicyInput{Pod: obj, Container: "migrate", Init: true, Image: "ghcr.io/org/app:v1"},
+			want:       false,
+		},
+		{
+			name:       "missing key",
+			expression: `pod.metadata.annotations["missing"] == "x"`,
+			in:         in,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := CompilePolicy(tt.name, tt.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := p.Allows(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	for _, expression := range []string{"request.namespace ==", `image.tag`, `unknown == 1`} {
+		if _, err := CompilePolicy("invalid", expression); err == nil {
+			t.Errorf("expected %q to be refused", expression)
+		}
+	}
+}
+
+func TestSettingsPolicies(t *testing.T) {
+	s, err := NewSettingsStore(Settings{Registry: "localhost:31609"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Reload(map[string]string{
+		SettingsPolicyPrefix + "prod-only":  `request.namespace == "prod"`,
+		SettingsPolicyPrefix + "not-pinned": `image.digest == ""`,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := s.load()
+	for _, tt := range []struct {
+		in   PolicyInput
+		want string
+	}{
+		{in: PolicyInput{Namespace: "prod", Image: "nginx:1.21"}},
+		{in: PolicyInput{Namespace: "dev", Image: "nginx:1.21"}, want: "prod-only"},
+		{in: PolicyInput{Namespace: "prod", Image: "nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"}, want: "not-pinned"},
+	} {
+		p, err := loaded.deniedBy(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := ""
+		if p != nil {
+			got = p.Name
+		}
+		if got != tt.want {
+			t.Errorf("expected %+v denied by %q, got %q", tt.in, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package webhook
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/hashicorp/go-multierror"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/joshrwolf/ripfs/internal/metrics"
+	"github.com/joshrwolf/ripfs/internal/registry"
+	"github.com/joshrwolf/ripfs/internal/verify"
+)
+
+// ValidatePath is the path the provenance validator is served at
+const ValidatePath = "/validate"
+
+// validatorName is what the provenance validator's metrics and audit entries are labelled with
+const validatorName = "provenance"
+
+var (
+	// ErrUnsigned is returned for images that aren't stored by ripfs along with a verified signature
+	ErrUnsigned = errors.New("unsigned")
+
+	// ErrTampered is returned for images that aren't what the image they were rewritten from is mapped to
+	ErrTampered = errors.New("tampered")
+)
+
+var _ admission.Handler = (*provenanceValidatorHandler)(nil)
+
+// ProvenanceOpts configures how the provenance of pod images is validated
+type ProvenanceOpts struct {
+	// Settings are how images are rewritten (and which aren't validated at all), reloaded as they change
+	Settings *SettingsStore
+
+	// Ipfs reads the images, and the signatures stored alongside them
+	Ipfs iface.CoreAPI
+
+	// Keys are the public keys the signatures of images are verified with, any one of them verifying is enough
+	Keys registry.MappingKeys
+}
+
+type provenanceValidatorHandler struct {
+	decoder   *admission.Decoder
+	cidMapper registry.CidMapper
+	settings  *SettingsStore
+	ipfs      iface.CoreAPI
+	keys      registry.MappingKeys
+}
+
+// Handle denies pods whose images aren't stored by ripfs along with a cosign signature verifying against one of the
+// keys, or that were rewritten to anything but what their original image is mapped to. Images (and namespaces)
+// excluded by the settings aren't validated, and on update only the images that changed are.
+func (h *provenanceValidatorHandler) Handle(ctx context.Context, req admission.Request) admission.Response {
+	start := time.Now()
+	resp := h.handle(ctx, req)
+
+	metrics.ObserveAdmission(validatorName, resp.Allowed, time.Since(start))
+	audit(ctx, validatorName, req, resp, nil)
+	return resp
+}
+
+func (h *provenanceValidatorHandler) handle(ctx context.Context, req admission.Request) admission.Response {
+	l := log.FromContext(ctx).WithName("provenance")
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	pod := &corev1.Pod{}
+	if err := h.decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	settings := h.settings.load()
+	if settings.excludesNamespace(req.Namespace) {
+		return admission.Allowed("namespace excluded")
+	}
+
+	admitted := make(map[string]string)
+	if len(req.OldObject.Raw) > 0 {
+		old := &corev1.Pod{}
+		if err := h.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		for _, c := range podContainers(old) {
+			admitted[c.Name] = c.Image
+		}
+	}
+
+	keys, err := h.keys(ctx)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	var (
+		originals = OriginalImages(pod)
+		denied    []string
+	)
+	for _, c := range podContainers(pod) {
+		if image, ok := admitted[c.Name]; ok && image == c.Image {
+			continue
+		}
+
+		// Only the image being run decides whether it's excluded, the original images are recorded in an annotation
+		// that isn't trusted any further than to check the image is what it was rewritten to
+		if settings.excludesImage(c.Image) {
+			continue
+		}
+		original := originals[c.Name]
+
+		if err := h.validate(ctx, settings, keys, c.Image, original); err != nil {
+			l.Info("denying image", "container", c.Name, "image", c.Image, "reason", err.Error())
+			denied = append(denied, fmt.Sprintf("%s (%s): %v", c.Name, c.Image, err))
+		}
+	}
+
+	if len(denied) > 0 {
+		return admission.Denied(fmt.Sprintf("images failed provenance validation: %s", strings.Join(denied, "; ")))
+	}
+	return admission.Allowed("images are signed")
+}
+
+// validate returns an error unless image, rewritten from original (if it was), is stored along with a signature
+// verifying against one of keys
+func (h *provenanceValidatorHandler) validate(ctx context.Context, settings *loadedSettings, keys []crypto.PublicKey, image string, original string) error {
+	ref := image
+	if original != "" {
+		ref = original
+	}
+
+	mapped, pinned := ref, ""
+	if settings.PinDigests {
+		mapped, pinned = splitPinned(ref)
+	}
+
+	root, err := h.cidMapper.Resolve(ctx, mapped)
+	if errors.Is(err, registry.ErrNotFound) {
+		return fmt.Errorf("%w: %s isn't stored by ripfs", ErrUnsigned, mapped)
+	} else if err != nil {
+		return err
+	}
+
+	// What the pod runs must be exactly what the mutator rewrote its original image to
+	if original != "" {
+		want, err := settings.render(ctx, h.ipfs, mapped, root, pinned)
+		if err != nil {
+			return err
+		}
+		if want != image {
+			return fmt.Errorf("%w: %s is mapped to %s", ErrTampered, original, want)
+		}
+	}
+
+	return h.verify(ctx, keys, mapped, root)
+}
+
+// verify returns an error unless the root at p, mapped from ref, is stored along with a signature of the digest it
+// was verified as when it was added, verifying against one of keys
+func (h *provenanceValidatorHandler) verify(ctx context.Context, keys []crypto.PublicKey, ref string, p string) error {
+	root, err := cid.Decode(strings.TrimPrefix(p, "/ipfs/"))
+	if err != nil {
+		return fmt.Errorf("invalid root %s: %v", p, err)
+	}
+
+	idx, err := registry.StoredIndex(ctx, h.ipfs, root)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", root, err)
+	}
+
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+
+	signed, err := v1.NewHash(im.Annotations[registry.AnnotationSignedDigest])
+	if err != nil {
+		return fmt.Errorf("%w: %s wasn't verified when it was added", ErrUnsigned, ref)
+	}
+
+	stored, err := idx.Digest()
+	if err != nil {
+		return err
+	}
+
+	// Signatures are mapped alongside the image, tagged by the digest it's stored as
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return err
+	}
+	sigRef := r.Context().Tag(registry.ArtifactTag(stored, "sig")).Name()
+
+	sp, err := h.cidMapper.Resolve(ctx, sigRef)
+	if errors.Is(err, registry.ErrNotFound) {
+		return fmt.Errorf("%w: no signature of %s is stored", ErrUnsigned, ref)
+	} else if err != nil {
+		return err
+	}
+
+	sigRoot, err := cid.Decode(strings.TrimPrefix(sp, "/ipfs/"))
+	if err != nil {
+		return fmt.Errorf("invalid root %s: %v", sp, err)
+	}
+
+	sigIdx, err := registry.StoredIndex(ctx, h.ipfs, sigRoot)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", sigRef, err)
+	}
+
+	sigs, err := sigIdx.IndexManifest()
+	if err != nil {
+		return err
+	}
+
+	var errs error
+	for _, desc := range sigs.Manifests {
+		sig, err := sigIdx.Image(desc.Digest)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			err := (&verify.Verifier{Key: k}).VerifyImage(sig, signed)
+			if err == nil {
+				return nil
+			}
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return fmt.Errorf("%w: no signature of %s verifies: %v", ErrUnsigned, ref, errs)
+}
+
+func (h *provenanceValidatorHandler) InjectDecoder(d *admission.Decoder) error {
+	h.decoder = d
+	return nil
+}
+
+// podContainers returns every container of pod, init and ephemeral ones included
+func podContainers(pod *corev1.Pod) []corev1.Container {
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, ec := range pod.Spec.EphemeralContainers {
+		containers = append(containers, corev1.Container(ec.EphemeralContainerCommon))
+	}
+	return containers
+}
+
+// AddProvenanceValidatorToManager serves the provenance validator at ValidatePath, resolving images with cm
+func AddProvenanceValidatorToManager(mgr manager.Manager, cm registry.CidMapper, opts ProvenanceOpts) error {
+	if opts.Settings == nil || opts.Ipfs == nil || opts.Keys == nil {
+		return fmt.Errorf("validating provenance requires settings, an ipfs api and keys")
+	}
+
+	wh := &admission.Webhook{
+		Handler: &provenanceValidatorHandler{
+			cidMapper: cm,
+			settings:  opts.Settings,
+			ipfs:      opts.Ipfs,
+			keys:      opts.Keys,
+		},
+	}
+
+	mgr.GetWebhookServer().Register(ValidatePath, &webhook.Admission{
+		Handler: wh,
+	})
+
+	return nil
+}
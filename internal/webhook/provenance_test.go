@@ -0,0 +1,214 @@
+package webhook
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+	"github.com/joshrwolf/ripfs/internal/registry"
+	"github.com/joshrwolf/ripfs/internal/verify"
+)
+
+func TestProvenanceValidate(t *testing.T) {
+	const root = "/ipfs/bafkreia4g3rtkhc72daogxsw4ytd7av2fye7w2xoto4jzcfnkg7cf7mc6e"
+
+	mapper := registry.NewMemoryCidMapper()
+	mapper.Set(nil, map[string]string{"index.docker.io/library/nginx:1.21": root})
+
+	store, err := NewSettingsStore(Settings{Registry: "localhost:31609"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &provenanceValidatorHandler{cidMapper: mapper, settings: store}
+	ctx := context.Background()
+
+	// Images that ripfs doesn't store at all are unsigned
+	if err := h.validate(ctx, store.load(), nil, "ghcr.io/org/app:v1", ""); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("expected an unmapped image to be unsigned, got %v", err)
+	}
+
+	// Images that aren't what their original is rewritten to have been tampered with
+	err = h.validate(ctx, store.load(), []crypto.PublicKey{}, "localhost:31609/ipfs/bafkreia4g3rtkhc72daogxsw4ytd7av2fye7w2xoto4jzcfnkg7cf7aaaa", "nginx:1.21")
+	if !errors.Is(err, ErrTampered) {
+		t.Errorf("expected a rewritten image other than the mapped one to be tampered, got %v", err)
+	}
+}
+
+func TestPodContainers(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app"},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "busybox"}},
+			Containers:     []corev1.Container{{Name: "app", Image: "nginx:1.21"}},
+			EphemeralContainers: []corev1.EphemeralContainer{
+				{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Image: "alpine"}},
+			},
+		},
+	}
+
+	got := podContainers(pod)
+	if len(got) != 3 || got[0].Name != "init" || got[1].Name != "app" || got[2].Name != "debug" || got[2].Image != "alpine" {
+		t.Errorf("expected every container in order, got %+v", got)
+	}
+}
+
+// signatureRepo serves a repository holding a cosign signature of d made with key, as cosign attaches them
+func signatureRepo(t *testing.T, key *ecdsa.PrivateKey, d v1.Hash) name.Repository {
+	ts := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(ioutil.Discard, "", 0))))
+	t.Cleanup(ts.Close)
+
+	repo, err := name.NewRepository(strings.TrimPrefix(ts.URL, "http://") + "/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"app"},"image":{"docker-manifest-digest":%q},"type":%q},"optional":null}`, d, verify.SignatureType))
+	h := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       static.NewLayer(payload, "application/vnd.dev.cosign.simplesigning.v1+json"),
+		Annotations: map[string]string{verify.SignatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(repo.Tag(registry.ArtifactTag(d, "sig")), img); err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func TestProvenanceHandle(t *testing.T) {
+	ctx := context.Background()
+	api := testingIpfs(t, ctx)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Images are added as ripfs add does once their signature is verified: stamped with the digest that was signed,
+	// with the signature mapped alongside them by the digest they're stored as
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := registry.AddImage(ctx, api, img, nil, registry.WithProvenance("index.docker.io/library/app:v1"), registry.WithSignedDigest(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifacts, err := registry.AddArtifacts(ctx, api, signatureRepo(t, key, source), source, root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsignedRoot, err := registry.AddImage(ctx, api, unsigned, nil, registry.WithProvenance("index.docker.io/library/app:unsigned"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mappings := map[string]string{
+		"index.docker.io/library/app:v1":       root.String(),
+		"index.docker.io/library/app:unsigned": unsignedRoot.String(),
+	}
+	if len(artifacts) != 1 {
+		t.Fatalf("expected the signature to be added, got %v", artifacts)
+	}
+	for tag, p := range artifacts {
+		mappings["index.docker.io/library/app:"+tag] = p.String()
+	}
+
+	h := testingMutator(t, mappings, map[string]string{SettingsExcludeImages: "registry.k8s.io/*"})
+	rewritten, err := h.settings.load().render(ctx, api, "index.docker.io/library/app:v1", root.String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pod runs image in its app container, rewritten from original unless it's empty
+	pod := func(image string, original string) *corev1.Pod {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+		}
+		if original != "" {
+			pod.Annotations = map[string]string{consts.OriginalImagesAnnotation: fmt.Sprintf(`{"app": %q}`, original)}
+		}
+		return pod
+	}
+
+	tests := []struct {
+		name   string
+		key    *ecdsa.PrivateKey
+		pod    *corev1.Pod
+		denied string
+	}{
+		{name: "signed", key: key, pod: pod("app:v1", "")},
+		{name: "rewritten", key: key, pod: pod(rewritten, "app:v1")},
+		{name: "other key", key: other, pod: pod(rewritten, "app:v1"), denied: "invalid signature"},
+		{name: "unsigned", key: key, pod: pod("app:unsigned", ""), denied: "wasn't verified when it was added"},
+		{name: "tampered", key: key, pod: pod("localhost:31609/ipfs/"+unsignedRoot.Cid().String(), "app:v1"), denied: ErrTampered.Error()},
+		{name: "unmapped", key: key, pod: pod("ghcr.io/org/app:v1", ""), denied: "isn't stored by ripfs"},
+		{name: "excluded", key: key, pod: pod("registry.k8s.io/pause:3.6", "")},
+		// Claiming to be rewritten from an excluded image doesn't exclude the image that's run
+		{name: "excluded original", key: key, pod: pod("ghcr.io/evil/app:v1", "registry.k8s.io/pause:3.6"), denied: "isn't stored by ripfs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &provenanceValidatorHandler{
+				decoder:   h.decoder,
+				cidMapper: h.cidMapper,
+				settings:  h.settings,
+				ipfs:      api,
+				keys:      registry.StaticMappingKeys(tt.key.Public()),
+			}
+
+			resp := v.Handle(ctx, podRequest(t, tt.pod, nil, ""))
+			if resp.Allowed != (tt.denied == "") {
+				t.Fatalf("expected allowed to be %t, got %v", tt.denied == "", resp.Result)
+			}
+			if reason := string(resp.Result.Reason); tt.denied != "" && !strings.Contains(reason, tt.denied) {
+				t.Errorf("expected to be denied for %q, got %s", tt.denied, reason)
+			}
+		})
+	}
+}
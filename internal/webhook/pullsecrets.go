@@ -0,0 +1,25 @@
+package webhook
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// updatePullSecrets updates the pull secrets of pod, once its images are rewritten to ripfs. With strip, the upstream
+// secrets are dropped when every image of the pod was rewritten, since none of them is pulled from upstream anymore.
+// secret, if set, is the ripfs registry's pull secret, always added unless the pod already references it. The webhook
+// can't tell whether the registry requires auth, so it's only meant to be set when it does.
+func updatePullSecrets(pod *corev1.Pod, rewritten map[string]string, strip bool, secret string) {
+	if strip && len(rewritten) == len(pod.Spec.InitContainers)+len(pod.Spec.Containers) {
+		pod.Spec.ImagePullSecrets = nil
+	}
+
+	if secret == "" {
+		return
+	}
+	for _, s := range pod.Spec.ImagePullSecrets {
+		if s.Name == secret {
+			return
+		}
+	}
+	pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: secret})
+}
@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestUpdatePullSecrets(t *testing.T) {
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{Spec: corev1.PodSpec{
+			InitContainers:   []corev1.Container{{Name: "init", Image: "busybox"}},
+			Containers:       []corev1.Container{{Name: "app", Image: "ghcr.io/org/app:v1"}},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "ghcr"}},
+		}}
+	}
+
+	tests := []struct {
+		name      string
+		rewritten map[string]string
+		strip     bool
+		secret    string
+		want      []corev1.LocalObjectReference
+	}{
+		{
+			name:      "every image rewritten",
+			rewritten: map[string]string{"init": "busybox", "app": "ghcr.io/org/app:v1"},
+			strip:     true,
+			secret:    "ripfs-pull",
+			want:      []corev1.LocalObjectReference{{Name: "ripfs-pull"}},
+		},
+		{
+			name:      "upstream images left",
+			rewritten: map[string]string{"app": "ghcr.io/org/app:v1"},
+			strip:     true,
+			secret:    "ripfs-pull",
+			want:      []corev1.LocalObjectReference{{Name: "ghcr"}, {Name: "ripfs-pull"}},
+		},
+		{
+			name:      "nothing stripped",
+			rewritten: map[string]string{"init": "busybox", "app": "ghcr.io/org/app:v1"},
+			want:      []corev1.LocalObjectReference{{Name: "ghcr"}},
+		},
+		{
+			name:      "already referenced",
+			rewritten: map[string]string{"app": "ghcr.io/org/app:v1"},
+			secret:    "ghcr",
+			want:      []corev1.LocalObjectReference{{Name: "ghcr"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPod()
+			updatePullSecrets(pod, tt.rewritten, tt.strip, tt.secret)
+			if !reflect.DeepEqual(pod.Spec.ImagePullSecrets, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, pod.Spec.ImagePullSecrets)
+			}
+		})
+	}
+}
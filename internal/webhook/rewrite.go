@@ -0,0 +1,187 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+// DefaultRewriteTemplate rewrites images to be pulled by their root cid
+const DefaultRewriteTemplate = "{{.Registry}}/ipfs/{{.CID}}"
+
+// Rewrite is what rewrite templates render a resolved image with
+type Rewrite struct {
+	ctx  context.Context
+	api  iface.CoreAPI
+	root cid.Cid
+
+	// Image is the pod's original image
+	Image string
+
+	// Registry is the ripfs registry's host
+	Registry string
+
+	// CID is the image's root cid
+	CID string
+
+	// Repo is the repository the image is served by name as (such as library/nginx), and Tag its tag (if any)
+	Repo string
+	Tag  string
+}
+
+// Digest is the digest the image is served by, only read from ipfs when a template uses it
+func (r *Rewrite) Digest() (string, error) {
+	if r.api == nil {
+		return "", fmt.Errorf("digests can't be rewritten to without an ipfs api")
+	}
+
+	d, err := registry.RootDigest(r.ctx, r.api, r.root)
+	if err != nil {
+		return "", err
+	}
+	return d.String(), nil
+}
+
+// ErrDigestMismatch is returned when an image is pinned to a digest other than the one its tag is mapped to
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// splitPinned splits an image pinned to a digest as well as a tag (such as nginx:1.21@sha256:...) into the tagged
+// image it's mapped by and the digest. Anything else is returned as it is, without a digest.
+func splitPinned(image string) (string, string) {
+	i := strings.LastIndex(image, "@")
+	if i < 0 {
+		return image, ""
+	}
+
+	tagged := image[:i]
+	if t, err := name.NewTag(tagged); err != nil || !strings.HasSuffix(tagged, ":"+t.TagStr()) {
+		return image, ""
+	}
+	return tagged, image[i+1:]
+}
+
+// pinDigest returns rewritten pinned to the digest the root at p is served by, refusing it when the pod pinned the
+// image to another digest. Pods pin the digest the image had upstream, which ripfs stores under another, so pinned is
+// compared against the digests the root's index was stamped with when it was added (see registry.WithProvenance).
+func pinDigest(ctx context.Context, api iface.CoreAPI, rewritten string, p string, pinned string) (string, error) {
+	if api == nil {
+		return "", fmt.Errorf("digests can't be pinned without an ipfs api")
+	}
+
+	root, err := cid.Decode(strings.TrimPrefix(p, "/ipfs/"))
+	if err != nil {
+		return "", fmt.Errorf("invalid root %s: %v", p, err)
+	}
+
+	idx, err := registry.StoredIndex(ctx, api, root)
+	if err != nil {
+		return "", err
+	}
+
+	d, err := idx.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	if pinned != "" {
+		im, err := idx.IndexManifest()
+		if err != nil {
+			return "", err
+		}
+
+		// The digest it's served by is accepted too, for pods pinning what ripfs stores
+		source, signed := im.Annotations[registry.AnnotationSourceDigest], im.Annotations[registry.AnnotationSignedDigest]
+		if pinned != source && pinned != signed && pinned != d.String() {
+			if source == "" {
+				source = "an unknown digest"
+			}
+			return "", fmt.Errorf("%w: pinned to %s, mapped to %s", ErrDigestMismatch, pinned, source)
+		}
+	}
+
+	ref, err := name.ParseReference(rewritten)
+	if err != nil {
+		return "", err
+	}
+	return ref.Context().Digest(d.String()).String(), nil
+}
+
+// ParseRewriteTemplate parses a rewrite template, the default when text is empty
+func ParseRewriteTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultRewriteTemplate
+	}
+
+	t, err := template.New("rewrite").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rewrite template: %v", err)
+	}
+	return t, nil
+}
+
+// rewriteImage renders t for image, resolved to the root at p
+func rewriteImage(ctx context.Context, t *template.Template, api iface.CoreAPI, reg string, image string, p string) (string, error) {
+	root, err := cid.Decode(strings.TrimPrefix(p, "/ipfs/"))
+	if err != nil {
+		return "", fmt.Errorf("invalid root %s: %v", p, err)
+	}
+
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+
+	rw := &Rewrite{
+		ctx:      ctx,
+		api:      api,
+		root:     root,
+		Image:    image,
+		Registry: reg,
+		CID:      root.String(),
+		Repo:     registry.RepositoryName(ref),
+	}
+	if t, ok := ref.(name.Tag); ok {
+		rw.Tag = t.TagStr()
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, rw); err != nil {
+		return "", err
+	}
+
+	rewritten := strings.TrimSpace(buf.String())
+	if _, err := name.ParseReference(rewritten); err != nil {
+		return "", fmt.Errorf("rewritten image %q is invalid: %v", rewritten, err)
+	}
+	return rewritten, nil
+}
+
+// render returns what image, resolved to the root at p, is rewritten to with s, pinned to the root's digest when s pins
+// digests. pinned is the digest the pod pinned the image to itself, if any.
+func (s *loadedSettings) render(ctx context.Context, api iface.CoreAPI, image string, p string, pinned string) (string, error) {
+	rewritten, err := rewriteImage(ctx, s.template, api, s.Registry, image, p)
+	if err != nil || !s.PinDigests {
+		return rewritten, err
+	}
+	return pinDigest(ctx, api, rewritten, p, pinned)
+}
+
+// normalizePullPolicy returns the pull policy of a container rewritten to image. Digested images are left as they
+// are, since they already default to only being pulled when not present, while everything else is pulled
+// IfNotPresent rather than contacting the registry on every start.
+func normalizePullPolicy(image string, policy corev1.PullPolicy) corev1.PullPolicy {
+	if _, err := name.NewDigest(image); err == nil {
+		return policy
+	}
+	return corev1.PullIfNotPresent
+}
@@ -0,0 +1,251 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	config "github.com/ipfs/go-ipfs-config"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/core/node/libp2p"
+	"github.com/ipfs/go-ipfs/plugin/loader"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/joshrwolf/ripfs/internal/registry"
+)
+
+var pluginsOnce sync.Once
+
+// testingIpfs returns the api of an offline ipfs node backed by a temporary repo
+func testingIpfs(t *testing.T, ctx context.Context) iface.CoreAPI {
+	tmp := t.TempDir()
+
+	// Plugins can only be injected once per process
+	pluginsOnce.Do(func() {
+		plugins, err := loader.NewPluginLoader("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := plugins.Initialize(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := plugins.Inject(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	cfg, err := config.Init(ioutil.Discard, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fsrepo.Init(tmp, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := fsrepo.Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := core.NewNode(ctx, &core.BuildCfg{Online: false, Routing: libp2p.DHTOption, Repo: repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Close() })
+
+	api, err := coreapi.NewCoreAPI(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api
+}
+
+func TestRewriteImage(t *testing.T) {
+	const root = "/ipfs/bafkreia4g3rtkhc72daogxsw4ytd7av2fye7w2xoto4jzcfnkg7cf7mc6e"
+
+	tests := []struct {
+		name     string
+		template string
+		image    string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:  "default",
+			image: "nginx:1.21",
+			want:  "localhost:31609/ipfs/bafkreia4g3rtkhc72daogxsw4ytd7av2fye7w2xoto4jzcfnkg7cf7mc6e",
+		},
+		{
+			name:     "named",
+			template: "{{.Registry}}/{{.Repo}}:{{.Tag}}",
+			image:    "nginx:1.21",
+			want:     "localhost:31609/library/nginx:1.21",
+		},
+		{
+			name:     "named elsewhere",
+			template: "{{.Registry}}/{{.Repo}}:{{.Tag}}",
+			image:    "ghcr.io/org/app:v1",
+			want:     "localhost:31609/ghcr.io/org/app:v1",
+		},
+		{
+			name:     "digest without ipfs",
+			template: "{{.Registry}}/{{.Repo}}@{{.Digest}}",
+			image:    "nginx:1.21",
+			wantErr:  true,
+		},
+		{
+			name:     "invalid reference",
+			template: "{{.Registry}}/{{.Repo}} {{.Tag}}",
+			image:    "nginx:1.21",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseRewriteTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := rewriteImage(context.Background(), tmpl, nil, "localhost:31609", tt.image, root)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := ParseRewriteTemplate("{{.Registry"); err == nil {
+		t.Errorf("expected an unparseable template to be rejected")
+	}
+}
+
+func TestSplitPinned(t *testing.T) {
+	const d = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+	tests := []struct {
+		image      string
+		wantImage  string
+		wantDigest string
+	}{
+		{image: "nginx:1.21@" + d, wantImage: "nginx:1.21", wantDigest: d},
+		{image: "localhost:5000/app:v1@" + d, wantImage: "localhost:5000/app:v1", wantDigest: d},
+		{image: "nginx@" + d, wantImage: "nginx@" + d},
+		{image: "localhost:5000/app@" + d, wantImage: "localhost:5000/app@" + d},
+		{image: "nginx:1.21", wantImage: "nginx:1.21"},
+	}
+
+	for _, tt := range tests {
+		image, digest := splitPinned(tt.image)
+		if image != tt.wantImage || digest != tt.wantDigest {
+			t.Errorf("%s: expected %s and %q, got %s and %q", tt.image, tt.wantImage, tt.wantDigest, image, digest)
+		}
+	}
+
+	if _, err := pinDigest(context.Background(), nil, "localhost:31609/ipfs/abc", "/ipfs/abc", ""); err == nil {
+		t.Errorf("expected pinning without an ipfs api to fail")
+	}
+}
+
+func TestNormalizePullPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		image  string
+		policy corev1.PullPolicy
+		want   corev1.PullPolicy
+	}{
+		{
+			name:   "cid",
+			image:  "localhost:31609/ipfs/bafkreia4g3rtkhc72daogxsw4ytd7av2fye7w2xoto4jzcfnkg7cf7mc6e",
+			policy: corev1.PullAlways,
+			want:   corev1.PullIfNotPresent,
+		},
+		{
+			name:  "unset",
+			image: "localhost:31609/library/nginx:1.21",
+			want:  corev1.PullIfNotPresent,
+		},
+		{
+			name:   "digested",
+			image:  "localhost:31609/library/nginx@sha256:4ff102c5d78d254a6f0da062b3cf39eaf07f01eec0927fd21e219d0af8bc0591",
+			policy: corev1.PullAlways,
+			want:   corev1.PullAlways,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizePullPolicy(tt.image, tt.policy); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPinDigest(t *testing.T) {
+	ctx := context.Background()
+	api := testingIpfs(t, ctx)
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := registry.AddImage(ctx, api, img, nil, registry.WithProvenance("index.docker.io/library/app:v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := registry.RootDigest(ctx, api, root.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.String() == source.String() {
+		t.Fatalf("expected the image to be stored under another digest than it had")
+	}
+
+	rewritten := "localhost:31609/ipfs/" + root.Cid().String()
+	want := rewritten + "@" + stored.String()
+
+	// Pods pin the digest the image had upstream, or the one ripfs serves it by
+	for _, pinned := range []string{"", source.String(), stored.String()} {
+		if got, err := pinDigest(ctx, api, rewritten, root.String(), pinned); err != nil || got != want {
+			t.Errorf("%q: expected %s, got %s: %v", pinned, want, got, err)
+		}
+	}
+
+	other := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	if _, err := pinDigest(ctx, api, rewritten, root.String(), other); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("expected another digest to mismatch, got %v", err)
+	}
+
+	// Pods pinning the image as it was added are rewritten to it as it's served
+	h := testingMutator(t, map[string]string{"index.docker.io/library/app:v1": root.String()}, map[string]string{SettingsPinDigests: "true"})
+	h.ipfs = api
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app:v1@" + source.String()}}},
+	}
+	resp := h.Handle(ctx, podRequest(t, pod, nil, ""))
+	if got := patched(resp)["/spec/containers/0/image"]; got != want {
+		t.Errorf("expected the pinned image to be rewritten to %s, got %v", want, got)
+	}
+}
@@ -0,0 +1,119 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+)
+
+// OriginalImages returns the images the webhook rewrote the containers of pod from, by container name
+func OriginalImages(pod *corev1.Pod) map[string]string {
+	return imagesAnnotation(pod, consts.OriginalImagesAnnotation)
+}
+
+// RewrittenImages returns the images the webhook rewrote for pod, by the image they were rewritten from
+func RewrittenImages(pod *corev1.Pod) map[string]string {
+	return imagesAnnotation(pod, consts.RewrittenImagesAnnotation)
+}
+
+// recordOriginalImages records the images containers of pod were rewritten from (by container name), alongside any
+// recorded when it was first admitted
+func recordOriginalImages(pod *corev1.Pod, rewritten map[string]string) error {
+	return recordImages(pod, consts.OriginalImagesAnnotation, rewritten)
+}
+
+// recordRewrittenImages records what images of pod were rewritten to (by the image they were rewritten from),
+// alongside any recorded when it was first admitted
+func recordRewrittenImages(pod *corev1.Pod, rewritten map[string]string) error {
+	return recordImages(pod, consts.RewrittenImagesAnnotation, rewritten)
+}
+
+func imagesAnnotation(pod *corev1.Pod, annotation string) map[string]string {
+	images := make(map[string]string)
+	if v, ok := pod.Annotations[annotation]; ok {
+		// Anything that isn't ours to parse is ignored, as if nothing was rewritten
+		_ = json.Unmarshal([]byte(v), &images)
+	}
+	return images
+}
+
+// scrubRecordedImages drops the images recorded as rewritten from pod, reporting whether any were
+func scrubRecordedImages(pod *corev1.Pod) bool {
+	scrubbed := false
+	for _, annotation := range []string{consts.OriginalImagesAnnotation, consts.RewrittenImagesAnnotation} {
+		if _, ok := pod.Annotations[annotation]; ok {
+			delete(pod.Annotations, annotation)
+			scrubbed = true
+		}
+	}
+	return scrubbed
+}
+
+func recordImages(pod *corev1.Pod, annotation string, images map[string]string) error {
+	recorded := imagesAnnotation(pod, annotation)
+	for k, v := range images {
+		recorded[k] = v
+	}
+
+	data, err := json.Marshal(recorded)
+	if err != nil {
+		return err
+	}
+
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[annotation] = string(data)
+	return nil
+}
+
+// RolledBack returns the images rolled back by annotations (of a pod, or a workload's pod template), which are never
+// rewritten again
+func RolledBack(annotations map[string]string) map[string]bool {
+	images := make(map[string]bool)
+	for _, image := range splitList(annotations[consts.RollbackAnnotation]) {
+		images[image] = true
+	}
+	return images
+}
+
+// AddRollback returns the rollback annotation of annotations with image added
+func AddRollback(annotations map[string]string, image string) string {
+	images := splitList(annotations[consts.RollbackAnnotation])
+	for _, i := range images {
+		if i == image {
+			return strings.Join(images, ",")
+		}
+	}
+	return strings.Join(append(images, image), ",")
+}
+
+// UpstreamReachable returns an error unless the registry image is from has it, or at least answers for it by asking
+// for credentials that nodes may have
+func UpstreamReachable(ctx context.Context, image string, opts ...remote.Option) error {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return err
+	}
+
+	_, err = remote.Head(ref, append([]remote.Option{remote.WithContext(ctx)}, opts...)...)
+
+	var te *transport.Error
+	if errors.As(err, &te) && (te.StatusCode == http.StatusUnauthorized || te.StatusCode == http.StatusForbidden) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s is unreachable: %v", image, err)
+	}
+	return nil
+}
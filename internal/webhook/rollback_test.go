@@ -0,0 +1,106 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+)
+
+func TestRollbackAnnotations(t *testing.T) {
+	pod := &corev1.Pod{}
+
+	if err := recordOriginalImages(pod, map[string]string{"app": "nginx:1.21"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pods updated later keep what was recorded when they were admitted
+	if err := recordOriginalImages(pod, map[string]string{"init": "busybox"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := OriginalImages(pod)
+	if len(got) != 2 || got["app"] != "nginx:1.21" || got["init"] != "busybox" {
+		t.Errorf("expected both original images recorded, got %v", got)
+	}
+
+	if err := recordRewrittenImages(pod, map[string]string{"nginx:1.21": "localhost:5050/ipfs/abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := RewrittenImages(pod); len(got) != 1 || got["nginx:1.21"] != "localhost:5050/ipfs/abc" {
+		t.Errorf("expected the rewritten image recorded, got %v", got)
+	}
+
+	pod.Annotations[consts.OriginalImagesAnnotation] = "not json"
+	if got := OriginalImages(pod); len(got) != 0 {
+		t.Errorf("expected an invalid annotation to be ignored, got %v", got)
+	}
+
+	annotations := map[string]string{}
+	annotations[consts.RollbackAnnotation] = AddRollback(annotations, "nginx:1.21")
+	annotations[consts.RollbackAnnotation] = AddRollback(annotations, "busybox")
+	annotations[consts.RollbackAnnotation] = AddRollback(annotations, "nginx:1.21")
+
+	if v := annotations[consts.RollbackAnnotation]; v != "nginx:1.21,busybox" {
+		t.Errorf("expected each image rolled back once, got %q", v)
+	}
+
+	rolledBack := RolledBack(annotations)
+	if !rolledBack["nginx:1.21"] || !rolledBack["busybox"] || rolledBack["alpine"] {
+		t.Errorf("unexpected rolled back images %v", rolledBack)
+	}
+}
+
+func TestUpstreamReachable(t *testing.T) {
+	ctx := context.Background()
+
+	ts := httptest.NewServer(registry.New())
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	ref, err := name.ParseReference(host + "/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpstreamReachable(ctx, host+"/app:v1"); err != nil {
+		t.Errorf("expected a stored image to be reachable: %v", err)
+	}
+
+	if err := UpstreamReachable(ctx, host+"/app:v2"); err == nil {
+		t.Errorf("expected a missing image to be unreachable")
+	}
+
+	// Registries asking for credentials are reachable, nodes may have them
+	authed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer authed.Close()
+
+	if err := UpstreamReachable(ctx, strings.TrimPrefix(authed.URL, "http://")+"/app:v1"); err != nil {
+		t.Errorf("expected a registry asking for credentials to be reachable: %v", err)
+	}
+
+	ts.Close()
+	if err := UpstreamReachable(ctx, host+"/app:v1"); err == nil {
+		t.Errorf("expected a registry that's down to be unreachable")
+	}
+}
@@ -0,0 +1,297 @@
+package webhook
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// The keys of the settings config map
+const (
+	SettingsRegistry            = "registry"
+	SettingsRewriteTemplate     = "rewrite-template"
+	SettingsNormalizePullPolicy = "normalize-pull-policy"
+	SettingsPinDigests          = "pin-digests"
+	SettingsRejectMismatched    = "reject-mismatched-digests"
+	SettingsUnresolved          = "unresolved"
+	SettingsStripPullSecrets    = "strip-pull-secrets"
+	SettingsPullSecret          = "pull-secret"
+	SettingsExcludeImages       = "exclude-images"
+	SettingsExcludeNamespaces   = "exclude-namespaces"
+)
+
+// What the webhook does with pods whose images aren't available from ripfs
+const (
+	// UnresolvedAllow leaves their images as they are
+	UnresolvedAllow = "allow"
+
+	// UnresolvedWarn leaves their images as they are, annotating the pods with them along with an event and a warning
+	UnresolvedWarn = "warn"
+
+	// UnresolvedDeny denies the pods (and the ephemeral containers added to them), so every image comes from ripfs
+	UnresolvedDeny = "deny"
+)
+
+// Settings are the webhook's runtime settings, kept in a config map managed by the manager so they can be changed
+// without restarting it
+type Settings struct {
+	// Registry is the ripfs registry's host
+	Registry string
+
+	// Template renders rewritten images, defaults to DefaultRewriteTemplate
+	Template string
+
+	// NormalizePullPolicy pulls rewritten images IfNotPresent, unless they're rewritten by digest
+	NormalizePullPolicy bool
+
+	// PinDigests rewrites images to the digest they were added as (their root's), so runtimes verify what they pull
+	// is exactly that, whatever the rewritten image's tag. Images pinned to a digest by the pod as well as a tag (such
+	// as nginx:1.21@sha256:...) are resolved by their tag, and only rewritten when it's still mapped to that digest.
+	PinDigests bool
+
+	// RejectMismatched denies pods pinning an image to a digest its tag is no longer mapped to, rather than leaving
+	// the image as it is. Only applies with PinDigests.
+	RejectMismatched bool
+
+	// Unresolved is what's done with pods whose images can't be resolved to a cid (UnresolvedAllow, UnresolvedWarn or
+	// UnresolvedDeny), those left as they are by the settings (or the pod) aside. Defaults to UnresolvedAllow.
+	Unresolved string
+
+	// StripPullSecrets drops the pull secrets of pods whose every image is rewritten, which only upstream registries
+	// needed
+	StripPullSecrets bool
+
+	// PullSecret is the secret (within each pod's namespace) pods with rewritten images pull from the ripfs registry
+	// with. It's added whenever it's set, so it's only set when the registry requires auth.
+	PullSecret string
+
+	// ExcludeImages are globs (such as registry.k8s.io/*) of images that are never rewritten, matched against both the
+	// image as written and its full repository name
+	ExcludeImages []string
+
+	// ExcludeNamespaces are the namespaces whose pods are never rewritten
+	ExcludeNamespaces []string
+
+	// Policies are CEL expressions (by name) that must all evaluate to true for a container's image to be rewritten
+	Policies map[string]string
+}
+
+// ParseSettings parses the data of the settings config map, anything it doesn't set is left as it is in defaults.
+// Lists are separated by commas or whitespace.
+func ParseSettings(data map[string]string, defaults Settings) (Settings, error) {
+	s := defaults
+
+	if v, ok := data[SettingsRegistry]; ok {
+		s.Registry = strings.TrimSpace(v)
+	}
+
+	if v, ok := data[SettingsRewriteTemplate]; ok {
+		s.Template = strings.TrimSpace(v)
+	}
+
+	for k, b := range map[string]*bool{
+		SettingsNormalizePullPolicy: &s.NormalizePullPolicy,
+		SettingsPinDigests:          &s.PinDigests,
+		SettingsRejectMismatched:    &s.RejectMismatched,
+		SettingsStripPullSecrets:    &s.StripPullSecrets,
+	} {
+		v, ok := data[k]
+		if !ok {
+			continue
+		}
+
+		parsed, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return Settings{}, fmt.Errorf("invalid %s %q: %v", k, v, err)
+		}
+		*b = parsed
+	}
+
+	if v, ok := data[SettingsPullSecret]; ok {
+		s.PullSecret = strings.TrimSpace(v)
+	}
+	if errs := validation.IsDNS1123Subdomain(s.PullSecret); s.PullSecret != "" && len(errs) > 0 {
+		return Settings{}, fmt.Errorf("invalid %s %q: %s", SettingsPullSecret, s.PullSecret, strings.Join(errs, ", "))
+	}
+
+	if v, ok := data[SettingsUnresolved]; ok {
+		s.Unresolved = strings.TrimSpace(v)
+	}
+	switch s.Unresolved {
+	case "", UnresolvedAllow, UnresolvedWarn, UnresolvedDeny:
+	default:
+		return Settings{}, fmt.Errorf("invalid %s %q: must be one of %s, %s or %s", SettingsUnresolved, s.Unresolved, UnresolvedAllow, UnresolvedWarn, UnresolvedDeny)
+	}
+
+	if v, ok := data[SettingsExcludeImages]; ok {
+		s.ExcludeImages = splitList(v)
+		for _, pattern := range s.ExcludeImages {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return Settings{}, fmt.Errorf("invalid %s pattern %q: %v", SettingsExcludeImages, pattern, err)
+			}
+		}
+	}
+
+	if v, ok := data[SettingsExcludeNamespaces]; ok {
+		s.ExcludeNamespaces = splitList(v)
+	}
+
+	// Any policies replace the defaults' whole
+	var policies map[string]string
+	for k, v := range data {
+		if !strings.HasPrefix(k, SettingsPolicyPrefix) {
+			continue
+		}
+
+		if policies == nil {
+			policies = make(map[string]string)
+		}
+		policies[strings.TrimPrefix(k, SettingsPolicyPrefix)] = strings.TrimSpace(v)
+	}
+	if policies != nil {
+		if _, err := CompilePolicies(policies); err != nil {
+			return Settings{}, err
+		}
+		s.Policies = policies
+	}
+
+	if s.Registry == "" {
+		return Settings{}, fmt.Errorf("%s is required", SettingsRegistry)
+	}
+	return s, nil
+}
+
+// Data returns s as the data of the settings config map
+func (s Settings) Data() map[string]string {
+	data := map[string]string{
+		SettingsRegistry:            s.Registry,
+		SettingsRewriteTemplate:     s.Template,
+		SettingsNormalizePullPolicy: strconv.FormatBool(s.NormalizePullPolicy),
+		SettingsPinDigests:          strconv.FormatBool(s.PinDigests),
+		SettingsRejectMismatched:    strconv.FormatBool(s.RejectMismatched),
+		SettingsUnresolved:          s.Unresolved,
+		SettingsStripPullSecrets:    strconv.FormatBool(s.StripPullSecrets),
+		SettingsPullSecret:          s.PullSecret,
+		SettingsExcludeImages:       strings.Join(s.ExcludeImages, "\n"),
+		SettingsExcludeNamespaces:   strings.Join(s.ExcludeNamespaces, "\n"),
+	}
+	for n, expr := range s.Policies {
+		data[SettingsPolicyPrefix+n] = expr
+	}
+	return data
+}
+
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+}
+
+// loadedSettings are settings along with their parsed template and compiled policies
+type loadedSettings struct {
+	Settings
+
+	template *template.Template
+	policies []*Policy
+}
+
+// deniedBy returns the first policy that doesn't allow rewriting in's image, if any
+func (s *loadedSettings) deniedBy(in PolicyInput) (*Policy, error) {
+	for _, p := range s.policies {
+		allowed, err := p.Allows(in)
+		if err != nil {
+			return p, err
+		}
+		if !allowed {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// excludesNamespace reports whether pods within ns are never rewritten
+func (s *loadedSettings) excludesNamespace(ns string) bool {
+	for _, n := range s.ExcludeNamespaces {
+		if n == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// excludesImage reports whether image is never rewritten
+func (s *loadedSettings) excludesImage(image string) bool {
+	repo := ""
+	if ref, err := name.ParseReference(image); err == nil {
+		repo = ref.Context().Name()
+	}
+
+	for _, pattern := range s.ExcludeImages {
+		if ok, _ := path.Match(pattern, image); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, repo); ok && repo != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// onRegistry reports whether image is already pulled from the ripfs registry, such as once it's been rewritten
+func (s *loadedSettings) onRegistry(image string) bool {
+	ref, err := name.ParseReference(image)
+	return err == nil && s.Registry != "" && ref.Context().RegistryStr() == s.Registry
+}
+
+// SettingsStore holds the webhook's current settings, swapped out whole whenever they're reloaded so every request is
+// handled with a consistent set
+type SettingsStore struct {
+	defaults Settings
+	current  atomic.Value
+}
+
+// NewSettingsStore returns a store holding defaults, which any settings reloaded are parsed on top of
+func NewSettingsStore(defaults Settings) (*SettingsStore, error) {
+	s := &SettingsStore{defaults: defaults}
+	if err := s.Reload(nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload parses data (the settings config map's) and swaps it in. Invalid settings are refused, leaving the current
+// ones in place.
+func (s *SettingsStore) Reload(data map[string]string) error {
+	settings, err := ParseSettings(data, s.defaults)
+	if err != nil {
+		return err
+	}
+
+	t, err := ParseRewriteTemplate(settings.Template)
+	if err != nil {
+		return err
+	}
+
+	policies, err := CompilePolicies(settings.Policies)
+	if err != nil {
+		return err
+	}
+
+	s.current.Store(&loadedSettings{Settings: settings, template: t, policies: policies})
+	return nil
+}
+
+// Registry is the current ripfs registry host
+func (s *SettingsStore) Registry() string {
+	return s.load().Registry
+}
+
+func (s *SettingsStore) load() *loadedSettings {
+	return s.current.Load().(*loadedSettings)
+}
@@ -0,0 +1,146 @@
+package webhook
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSettings(t *testing.T) {
+	defaults := Settings{Registry: "localhost:31609", Template: DefaultRewriteTemplate}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    Settings
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: defaults,
+		},
+		{
+			name: "everything",
+			data: map[string]string{
+				SettingsRegistry:                   "registry.local:5000",
+				SettingsRewriteTemplate:            "{{.Registry}}/{{.Repo}}:{{.Tag}}",
+				SettingsNormalizePullPolicy:        "true",
+				SettingsPinDigests:                 "true",
+				SettingsRejectMismatched:           "1",
+				SettingsUnresolved:                 " deny ",
+				SettingsStripPullSecrets:           "true",
+				SettingsPullSecret:                 " ripfs-pull ",
+				SettingsExcludeImages:              "registry.k8s.io/*\n*/library/busybox",
+				SettingsExcludeNamespaces:          "kube-system, ripfs-system",
+				SettingsPolicyPrefix + "prod-only": ` request.namespace == "prod" `,
+			},
+			want: Settings{
+				Registry:            "registry.local:5000",
+				Template:            "{{.Registry}}/{{.Repo}}:{{.Tag}}",
+				NormalizePullPolicy: true,
+				PinDigests:          true,
+				RejectMismatched:    true,
+				Unresolved:          UnresolvedDeny,
+				StripPullSecrets:    true,
+				PullSecret:          "ripfs-pull",
+				ExcludeImages:       []string{"registry.k8s.io/*", "*/library/busybox"},
+				ExcludeNamespaces:   []string{"kube-system", "ripfs-system"},
+				Policies:            map[string]string{"prod-only": `request.namespace == "prod"`},
+			},
+		},
+		{
+			name:    "invalid bool",
+			data:    map[string]string{SettingsNormalizePullPolicy: "sometimes"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid unresolved",
+			data:    map[string]string{SettingsUnresolved: "ignore"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid pull secret",
+			data:    map[string]string{SettingsPullSecret: "Ripfs_Pull"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid pattern",
+			data:    map[string]string{SettingsExcludeImages: "registry.k8s.io/["},
+			wantErr: true,
+		},
+		{
+			name:    "invalid policy",
+			data:    map[string]string{SettingsPolicyPrefix + "broken": "request.namespace =="},
+			wantErr: true,
+		},
+		{
+			name:    "no registry",
+			data:    map[string]string{SettingsRegistry: " "},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSettings(tt.data, defaults)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+
+	// Settings round trip through the config map's data
+	got, err := ParseSettings(tests[1].want.Data(), defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, tests[1].want) {
+		t.Errorf("expected %+v, got %+v", tests[1].want, got)
+	}
+}
+
+func TestSettingsStore(t *testing.T) {
+	s, err := NewSettingsStore(Settings{Registry: "localhost:31609"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Reload(map[string]string{
+		SettingsRegistry:          "registry.local:5000",
+		SettingsExcludeImages:     "registry.k8s.io/*",
+		SettingsExcludeNamespaces: "kube-system",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Registry() != "registry.local:5000" {
+		t.Errorf("expected the reloaded registry, got %s", s.Registry())
+	}
+
+	// Invalid settings leave the current ones in place
+	if err := s.Reload(map[string]string{SettingsRewriteTemplate: "{{.Registry"}); err == nil {
+		t.Fatal("expected an invalid template to be refused")
+	}
+
+	loaded := s.load()
+	if loaded.Registry != "registry.local:5000" || loaded.template == nil {
+		t.Errorf("expected the previous settings to be kept, got %+v", loaded.Settings)
+	}
+
+	if !loaded.excludesNamespace("kube-system") || loaded.excludesNamespace("default") {
+		t.Error("expected only kube-system to be excluded")
+	}
+
+	for image, want := range map[string]bool{
+		"registry.k8s.io/pause:3.6": true,
+		"nginx:1.21":                false,
+		"ghcr.io/org/app:v1":        false,
+	} {
+		if got := loaded.excludesImage(image); got != want {
+			t.Errorf("expected %s excluded %v, got %v", image, want, got)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package webhook
+
+import (
+	"strconv"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+)
+
+// Skipped reports whether annotations (of a pod, or a workload's pod template) opt the pod out of being rewritten
+func Skipped(annotations map[string]string) bool {
+	skip, err := strconv.ParseBool(annotations[consts.SkipAnnotation])
+	return err == nil && skip
+}
+
+// SkippedContainers returns the containers annotations opt out of being rewritten, by name
+func SkippedContainers(annotations map[string]string) map[string]bool {
+	containers := make(map[string]bool)
+	for _, c := range splitList(annotations[consts.SkipContainersAnnotation]) {
+		containers[c] = true
+	}
+	return containers
+}
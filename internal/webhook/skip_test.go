@@ -0,0 +1,23 @@
+package webhook
+
+import (
+	"testing"
+
+	"github.com/joshrwolf/ripfs/internal/consts"
+)
+
+func TestSkipAnnotations(t *testing.T) {
+	for v, want := range map[string]bool{"true": true, "True": true, "1": true, "false": false, "": false, "yes": false} {
+		if got := Skipped(map[string]string{consts.SkipAnnotation: v}); got != want {
+			t.Errorf("expected %q to skip the pod: %t, got %t", v, want, got)
+		}
+	}
+	if Skipped(nil) {
+		t.Error("expected an unannotated pod not to be skipped")
+	}
+
+	skipped := SkippedContainers(map[string]string{consts.SkipContainersAnnotation: "sidecar, istio-init"})
+	if len(skipped) != 2 || !skipped["sidecar"] || !skipped["istio-init"] {
+		t.Errorf("unexpected skipped containers %v", skipped)
+	}
+}